@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/client"
+)
+
+// benchFlags holds the flags of the bench subcommand.
+type benchFlags struct {
+	*targetFlags
+	clients      *int
+	count        *int
+	minSize      *int
+	maxSize      *int
+	loss         *float64
+	duplicate    *float64
+	delay        *int
+	queryTimeout *int
+	retries      *int
+	timeout      *int
+}
+
+func registerBenchFlags(fs *flag.FlagSet) *benchFlags {
+	return &benchFlags{
+		targetFlags:  registerTargetFlags(fs),
+		clients:      fs.Int("clients", 10, "number of clients sending messages concurrently"),
+		count:        fs.Int("count", 100, "number of messages to send, shared between the clients"),
+		minSize:      fs.Int("minSize", 100, "minimum size of a message in bytes"),
+		maxSize:      fs.Int("maxSize", 1000, "maximum size of a message in bytes"),
+		loss:         fs.Float64("loss", 0, "fraction of the queries dropped on their way to the server, between 0 and 1 (requires -net udp)"),
+		duplicate:    fs.Float64("duplicate", 0, "fraction of the queries delivered to the server twice, between 0 and 1 (requires -net udp)"),
+		delay:        fs.Int("delay", 0, "milliseconds each client waits between queries"),
+		queryTimeout: fs.Int("queryTimeout", int(client.DefaultTimeout/time.Millisecond), "milliseconds to wait for each answer"),
+		retries:      fs.Int("retries", client.DefaultRetries, "times a failed query, or the fragments acknowledged as missing, are sent again"),
+		timeout:      fs.Int("timeout", 10, "seconds to wait for the messages to be reassembled once every message is sent"),
+	}
+}
+
+// A lossyProxy forwards DNS queries over UDP to a server, dropping and duplicating them at random
+// to simulate an unreliable path between clients and the tunnel.
+type lossyProxy struct {
+	conn      net.PacketConn
+	server    string
+	loss      float64
+	duplicate float64
+	timeout   time.Duration
+
+	queries    atomic.Int64
+	dropped    atomic.Int64
+	duplicated atomic.Int64
+}
+
+// newLossyProxy listens on a random port of the loopback address for queries to forward to server.
+func newLossyProxy(server string, loss, duplicate float64, timeout time.Duration) (*lossyProxy, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &lossyProxy{conn: conn, server: server, loss: loss, duplicate: duplicate, timeout: timeout}
+	go p.serve()
+	return p, nil
+}
+
+func (p *lossyProxy) serve() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p.queries.Add(1)
+		if rand.Float64() < p.loss {
+			p.dropped.Add(1)
+			continue
+		}
+		copies := 1
+		if rand.Float64() < p.duplicate {
+			p.duplicated.Add(1)
+			copies = 2
+		}
+		go p.forward(append([]byte(nil), buf[:n]...), addr, copies)
+	}
+}
+
+// forward sends copies of query to the server, and relays the first answer to the client at addr.
+func (p *lossyProxy) forward(query []byte, addr net.Addr, copies int) {
+	conn, err := net.Dial("udp", p.server)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for i := 0; i < copies; i++ {
+		if _, err := conn.Write(query); err != nil {
+			return
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	p.conn.WriteTo(buf[:n], addr)
+}
+
+func (p *lossyProxy) Close() error {
+	return p.conn.Close()
+}
+
+// percentile returns the p-th percentile of sorted, using the nearest rank.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// A benchMessage is a message sent by bench that hasn't been reassembled yet.
+type benchMessage struct {
+	sum   [sha256.Size]byte
+	start time.Time
+}
+
+// runBench implements the bench subcommand, which sends -count messages of random sizes from
+// -clients concurrent clients through a tunnel, optionally dropping and duplicating their queries,
+// and reports how many were reassembled as sent and how long they took, from their first query
+// to their delivery. The tunnel is chosen as by selftest.
+func runBench(fs *flag.FlagSet, args []string) {
+	f := registerBenchFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fatal("Unexpected arguments", "args", fs.Args())
+	}
+	if *f.clients < 1 || *f.count < 1 {
+		fatal("-clients and -count must be positive", "clients", *f.clients, "count", *f.count)
+	}
+	if *f.minSize < 1 || *f.minSize > *f.maxSize {
+		fatal("-minSize must be positive and at most -maxSize", "minSize", *f.minSize, "maxSize", *f.maxSize)
+	}
+	if *f.loss < 0 || *f.loss >= 1 || *f.duplicate < 0 || *f.duplicate > 1 {
+		fatal("-loss must be in [0, 1) and -duplicate in [0, 1]", "loss", *f.loss, "duplicate", *f.duplicate)
+	}
+	base, subscribe, release := f.target(*f.maxSize)
+	defer release()
+	base.Delay = time.Duration(*f.delay) * time.Millisecond
+	base.Timeout = time.Duration(*f.queryTimeout) * time.Millisecond
+	base.Retries = *f.retries
+	if base.Retries == 0 {
+		base.Retries = -1
+	}
+	var proxy *lossyProxy
+	if *f.loss > 0 || *f.duplicate > 0 {
+		if base.Server == "" || base.Net != "udp" {
+			fatal("-loss and -duplicate require -net udp, and a -server with -domain")
+		}
+		var err error
+		if proxy, err = newLossyProxy(base.Server, *f.loss, *f.duplicate, base.Timeout); err != nil {
+			fatal("Failed to start proxy", "error", err)
+		}
+		defer proxy.Close()
+		base.Server = proxy.conn.LocalAddr().String()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run, err := client.NewID()
+	if err != nil {
+		fatal("Failed to generate a message ID", "error", err)
+	}
+	msgs, err := subscribe(ctx, run)
+	if err != nil {
+		fatal("Failed to subscribe to the messages", "error", err)
+	}
+
+	var mu sync.Mutex
+	pending := make(map[string]benchMessage)
+	var latencies []time.Duration
+	var incorrect, fragments int
+	settled := make(chan struct{})
+	go func() {
+		for msg := range msgs {
+			mu.Lock()
+			m, ok := pending[msg.id]
+			if ok {
+				delete(pending, msg.id)
+				if sha256.Sum256(msg.payload) == m.sum {
+					latencies = append(latencies, msg.received.Sub(m.start))
+					fragments += msg.fragments
+				} else {
+					incorrect++
+				}
+				if len(latencies)+incorrect == *f.count {
+					close(settled)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := 0; i < *f.count; i++ {
+			next <- i
+		}
+	}()
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *f.clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := *base
+			for i := range next {
+				id := fmt.Sprint(run, i)
+				payload := randomText(*f.minSize + rand.Intn(*f.maxSize-*f.minSize+1))
+				mu.Lock()
+				pending[id] = benchMessage{sum: sha256.Sum256(payload), start: time.Now()}
+				mu.Unlock()
+				if err := c.SendID(ctx, id, payload); err != nil {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	sent := time.Since(start)
+	select {
+	case <-settled:
+	case <-time.After(time.Duration(*f.timeout) * time.Second):
+	}
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("Sent %d messages of %d to %d bytes from %d clients in %s (%.1f messages/s), %d failed to send\n",
+		*f.count, *f.minSize, *f.maxSize, *f.clients, sent.Round(time.Millisecond), float64(*f.count)/sent.Seconds(), failed.Load())
+	fmt.Printf("Reassembled %d messages (%.1f%%) from %d fragments, %d incorrectly, %d missing\n",
+		len(latencies), 100*float64(len(latencies))/float64(*f.count), fragments, incorrect, len(pending))
+	fmt.Printf("Latency p50 %s, p90 %s, p99 %s, max %s\n", percentile(latencies, 50).Round(time.Microsecond),
+		percentile(latencies, 90).Round(time.Microsecond), percentile(latencies, 99).Round(time.Microsecond), percentile(latencies, 100).Round(time.Microsecond))
+	if proxy != nil {
+		fmt.Printf("Dropped %d and duplicated %d of %d queries\n", proxy.dropped.Load(), proxy.duplicated.Load(), proxy.queries.Load())
+	}
+}
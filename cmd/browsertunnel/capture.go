@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/pcap"
+)
+
+// capturedWriter is the dns.ResponseWriter of a query that the tunnels observed rather than
+// received, which discards the answers. It reports the query as received at receivedAt.
+type capturedWriter struct {
+	source     net.Addr
+	receivedAt time.Time
+}
+
+func (w capturedWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w capturedWriter) RemoteAddr() net.Addr        { return w.source }
+func (w capturedWriter) WriteMsg(m *dns.Msg) error   { return nil }
+func (w capturedWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w capturedWriter) Close() error                { return nil }
+func (w capturedWriter) TsigStatus() error           { return nil }
+func (w capturedWriter) TsigTimersOnly(bool)         {}
+func (w capturedWriter) Hijack()                     {}
+func (w capturedWriter) ReceivedAt() time.Time       { return w.receivedAt }
+
+// serveCaptured feeds h the queries among the captured msgs, as received from their senders when
+// they were captured, and returns how many there were. Responses are skipped, since they repeat
+// the questions of the queries.
+func serveCaptured(h dns.Handler, msgs []pcap.Message) int {
+	queries := 0
+	for _, m := range msgs {
+		if m.Msg.Response || len(m.Msg.Question) == 0 {
+			continue
+		}
+		queries++
+		at := m.Time
+		if at.IsZero() {
+			at = time.Now()
+		}
+		h.ServeDNS(capturedWriter{source: m.Source, receivedAt: at}, m.Msg)
+	}
+	return queries
+}
+
+// A capture passively observes the DNS queries sent to port on a network interface, such as a
+// mirror port or a tap, and feeds them to the tunnels without answering them, for networks where
+// the server can't be authoritative for the top domains.
+type capture struct {
+	iface       string
+	port        int
+	promiscuous bool
+	live        atomic.Pointer[pcap.LiveCapture]
+	packets     atomic.Uint64
+	queries     atomic.Uint64
+	skipped     atomic.Uint64
+}
+
+// name identifies c in health checks.
+func (c *capture) name() string {
+	return "capture/" + c.iface
+}
+
+// serve feeds h the queries captured by c until the capture fails, calling started once it is
+// capturing.
+func (c *capture) serve(h dns.Handler, started func()) error {
+	live, err := pcap.OpenLive(pcap.LiveConfig{Interface: c.iface, Port: c.port, Promiscuous: c.promiscuous})
+	if err != nil {
+		return err
+	}
+	c.live.Store(live)
+	started()
+	for {
+		p, err := live.ReadPacket()
+		if err != nil {
+			return err
+		}
+		c.packets.Add(1)
+		msgs, err := p.DNS(c.port)
+		if err != nil {
+			c.skipped.Add(1)
+			slog.Debug("Skipping captured packet", "interface", c.iface, "error", err)
+		}
+		c.queries.Add(uint64(serveCaptured(h, msgs)))
+	}
+}
+
+// captureStats reports the packets and queries observed by each capture.
+type captureStats []*capture
+
+// Collect implements metrics.Collector.
+func (cs captureStats) Collect() []metrics.Metric {
+	var ms []metrics.Metric
+	for _, c := range cs {
+		labels := map[string]string{"interface": c.iface}
+		ms = append(ms,
+			metrics.Metric{Name: "browsertunnel_capture_packets_total", Help: "Packets captured on each interface.", Type: metrics.Counter, Labels: labels, Value: float64(c.packets.Load())},
+			metrics.Metric{Name: "browsertunnel_capture_queries_total", Help: "DNS queries observed on each interface.", Type: metrics.Counter, Labels: labels, Value: float64(c.queries.Load())},
+			metrics.Metric{Name: "browsertunnel_capture_skipped_packets_total", Help: "Captured packets that couldn't be decoded.", Type: metrics.Counter, Labels: labels, Value: float64(c.skipped.Load())},
+		)
+		if live := c.live.Load(); live != nil {
+			if dropped, err := live.Dropped(); err == nil {
+				ms = append(ms, metrics.Metric{Name: "browsertunnel_capture_dropped_packets_total", Help: "Packets dropped by the kernel because the capture fell behind.", Type: metrics.Counter, Labels: labels, Value: float64(dropped)})
+			}
+		}
+	}
+	return ms
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A command is a subcommand of browsertunnel, such as serve, or a group of subcommands, such as
+// config.
+type command struct {
+	name string
+	// args is the synopsis of the arguments of the command, and summary describes it in a line.
+	args    string
+	summary string
+	// flags registers the flags of the command on fs, for completion. run registers them too,
+	// before parsing args.
+	flags func(fs *flag.FlagSet)
+	run   func(fs *flag.FlagSet, args []string)
+	// values, if set, returns the fixed set of values that the arguments of the command are
+	// taken from, for completion.
+	values func() []string
+	// commands are the subcommands of a group, which has no flags of its own.
+	commands []*command
+}
+
+var serveCommand = &command{
+	name:    "serve",
+	args:    "[flags] [topDomain...]",
+	summary: "Serve the tunnel as the authoritative DNS server of the top domains.",
+	flags:   func(fs *flag.FlagSet) { registerServeFlags(fs) },
+	run:     runServe,
+}
+
+// commands is initialized by init, since the completion and help commands refer to it.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		serveCommand,
+		{
+			name:    "send",
+			args:    "-domain <domain> [flags] [file]",
+			summary: "Send file, or stdin if omitted or -, through the tunnel, and print the message ID.",
+			flags:   func(fs *flag.FlagSet) { registerSendFlags(fs) },
+			run:     runSend,
+		},
+		{
+			name:    "connect",
+			args:    "-domain <domain> -server <address> [flags]",
+			summary: "Open a stream through a tunnel served with -maxStreams, copying stdin to it and what it sends back to stdout.",
+			flags:   func(fs *flag.FlagSet) { registerConnectFlags(fs) },
+			run:     runConnect,
+		},
+		{
+			name:    "decode",
+			args:    "-domain <domain> [flags] [file]",
+			summary: "Reassemble the messages carried by the query names in file, or stdin, and print them as lines of JSON.",
+			flags:   func(fs *flag.FlagSet) { registerDecodeFlags(fs) },
+			run:     runDecode,
+		},
+		{
+			name:    "selftest",
+			args:    "[flags]",
+			summary: "Send messages through a tunnel served on a loopback address, or a deployed one, and check that they are reassembled.",
+			flags:   func(fs *flag.FlagSet) { registerSelftestFlags(fs) },
+			run:     runSelftest,
+		},
+		{
+			name:    "bench",
+			args:    "[flags]",
+			summary: "Send synthetic traffic from concurrent clients through a tunnel, and report how much of it is reassembled and how fast.",
+			flags:   func(fs *flag.FlagSet) { registerBenchFlags(fs) },
+			run:     runBench,
+		},
+		{
+			name:    "keygen",
+			args:    "[flags]",
+			summary: "Generate an Ed25519 key pair for a client to sign its messages with.",
+			flags:   func(fs *flag.FlagSet) { registerKeygenFlags(fs) },
+			run:     runKeygen,
+		},
+		{
+			name:    "config",
+			summary: "Work with configuration files.",
+			commands: []*command{
+				{
+					name:    "validate",
+					args:    "[serve flags] [topDomain...]",
+					summary: "Check the flags of serve, the -config file and the -instance files, without serving.",
+					flags:   func(fs *flag.FlagSet) { registerServeFlags(fs) },
+					run:     runValidate,
+				},
+			},
+		},
+		serviceCommand,
+		{
+			name:    "completion",
+			args:    "bash|zsh|fish",
+			summary: "Print a script completing the commands and flags of browsertunnel in a shell.",
+			flags:   func(fs *flag.FlagSet) {},
+			run:     runCompletion,
+			values:  func() []string { return []string{"bash", "zsh", "fish"} },
+		},
+		{
+			name:    "help",
+			args:    "[command...]",
+			summary: "Show the usage of a command.",
+			flags:   func(fs *flag.FlagSet) {},
+			run:     runHelp,
+			values:  func() []string { return strings.Fields(commandNames(commands)) },
+		},
+	}
+}
+
+// lookup returns the command named by the first arguments in args, along with its path and the
+// remaining arguments, or nil if args[0] doesn't name a command.
+func lookup(args []string) (*command, []string, []string) {
+	var c *command
+	var path []string
+	cmds := commands
+	for len(args) > 0 {
+		next := find(cmds, args[0])
+		if next == nil {
+			break
+		}
+		c, cmds = next, next.commands
+		path, args = append(path, next.name), args[1:]
+		if cmds == nil {
+			break
+		}
+	}
+	return c, path, args
+}
+
+func find(cmds []*command, name string) *command {
+	for _, c := range cmds {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// flagSet returns the flag set of c, found at path, with its usage.
+func (c *command) flagSet(path []string) *flag.FlagSet {
+	name := strings.Join(path, " ")
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() { c.usage(fs.Output(), path) }
+	return fs
+}
+
+// usage writes the usage of c, found at path, to w.
+func (c *command) usage(w io.Writer, path []string) {
+	name := strings.Join(append([]string{"browsertunnel"}, path...), " ")
+	if c.commands != nil {
+		fmt.Fprintf(w, "Usage: %s <command> [flags] [arguments]\n\n%s\n\nCommands:\n", name, c.summary)
+		listCommands(w, c.commands)
+		return
+	}
+	fmt.Fprintf(w, "Usage: %s %s\n\n%s\n", name, c.args, c.summary)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	c.flags(fs)
+	if hasFlags(fs) {
+		fmt.Fprintf(w, "\nFlags:\n")
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+	}
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	n := 0
+	fs.VisitAll(func(*flag.Flag) { n++ })
+	return n > 0
+}
+
+func listCommands(w io.Writer, cmds []*command) {
+	for _, c := range cmds {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.summary)
+	}
+}
+
+// usage writes the usage of browsertunnel to w.
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: browsertunnel <command> [flags] [arguments]\n\nCommands:\n")
+	listCommands(w, commands)
+	fmt.Fprintf(w, "\nRun browsertunnel help <command> for the flags of a command. Arguments that don't start with a\ncommand are passed to serve.\n")
+}
+
+func runHelp(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage(os.Stdout)
+		return
+	}
+	c, path, rest := lookup(fs.Args())
+	if c == nil || len(rest) > 0 {
+		fatal("Unknown command", "command", strings.Join(fs.Args(), " "))
+	}
+	c.usage(os.Stdout, path)
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "-h", "-help", "--help":
+		usage(os.Stderr)
+		return
+	}
+	c, path, rest := lookup(args)
+	if c == nil {
+		// Before it had commands, browsertunnel only served the tunnel.
+		c, path, rest = serveCommand, []string{serveCommand.name}, args
+	}
+	if c.commands != nil {
+		c.usage(os.Stderr, path)
+		os.Exit(2)
+	}
+	c.run(c.flagSet(path), rest)
+}
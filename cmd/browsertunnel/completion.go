@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// commandFlags returns the names of the flags of c, with their leading dash.
+func commandFlags(c *command) []string {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	c.flags(fs)
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, "-"+f.Name) })
+	return names
+}
+
+// commandValues returns the arguments that c takes from a fixed set, if any.
+func commandValues(c *command) []string {
+	if c.values == nil {
+		return nil
+	}
+	return c.values()
+}
+
+func commandNames(cmds []*command) string {
+	var names []string
+	for _, c := range cmds {
+		names = append(names, c.name)
+	}
+	return strings.Join(names, " ")
+}
+
+// bashCompletion writes a bash completion script, which completes the commands, the flags of the
+// command after a dash, and the arguments that commands take from a fixed set, falling back to
+// file names.
+func bashCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# bash completion for browsertunnel\n_browsertunnel() {\n")
+	fmt.Fprintf(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} words= args=\n")
+	fmt.Fprintf(w, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n\t\twords=%q\n\telse\n", commandNames(commands))
+	fmt.Fprintf(w, "\t\tcase \"${COMP_WORDS[1]}\" in\n")
+	for _, c := range commands {
+		if c.commands != nil {
+			fmt.Fprintf(w, "\t\t%s)\n\t\t\tcase \"${COMP_WORDS[2]}\" in\n", c.name)
+			for _, sub := range c.commands {
+				fmt.Fprintf(w, "\t\t\t%s) words=%q args=%q ;;\n", sub.name, strings.Join(commandFlags(sub), " "), strings.Join(commandValues(sub), " "))
+			}
+			fmt.Fprintf(w, "\t\t\t*) [ \"$COMP_CWORD\" -eq 2 ] && args=%q ;;\n\t\t\tesac ;;\n", commandNames(c.commands))
+			continue
+		}
+		fmt.Fprintf(w, "\t\t%s) words=%q args=%q ;;\n", c.name, strings.Join(commandFlags(c), " "), strings.Join(commandValues(c), " "))
+	}
+	fmt.Fprintf(w, "\t\tesac\n\t\t[[ \"$cur\" == -* ]] || words=$args\n\tfi\n")
+	fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n}\n")
+	fmt.Fprintf(w, "complete -o default -F _browsertunnel browsertunnel\n")
+}
+
+// fishCompletion writes a fish completion script, describing the commands and flags with their
+// summaries and usages.
+func fishCompletion(w io.Writer) {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	}
+	fmt.Fprintf(w, "# fish completion for browsertunnel\ncomplete -c browsertunnel -f\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "complete -c browsertunnel -n __fish_use_subcommand -a %s -d %s\n", c.name, quote(c.summary))
+		cmds, cond := []*command{c}, "__fish_seen_subcommand_from "+c.name
+		if c.commands != nil {
+			for _, sub := range c.commands {
+				fmt.Fprintf(w, "complete -c browsertunnel -n %s -a %s -d %s\n", quote(cond+"; and not __fish_seen_subcommand_from "+commandNames(c.commands)), sub.name, quote(sub.summary))
+			}
+			cmds = c.commands
+		}
+		for _, sub := range cmds {
+			if values := commandValues(sub); values != nil {
+				fmt.Fprintf(w, "complete -c browsertunnel -n %s -a %s\n", quote(cond), quote(strings.Join(values, " ")))
+			}
+			fs := flag.NewFlagSet(sub.name, flag.ContinueOnError)
+			sub.flags(fs)
+			subCond := cond
+			if sub != c {
+				subCond += "; and __fish_seen_subcommand_from " + sub.name
+			}
+			fs.VisitAll(func(f *flag.Flag) {
+				// Flags other than booleans take a value, which may be a file name.
+				value := " -r -F"
+				if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+					value = ""
+				}
+				fmt.Fprintf(w, "complete -c browsertunnel -n %s -o %s%s -d %s\n", quote(subCond), f.Name, value, quote(f.Usage))
+			})
+		}
+	}
+}
+
+// runCompletion implements the completion subcommand, which prints the completion script of a
+// shell. zsh uses the bash script through bashcompinit.
+func runCompletion(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	switch fs.Arg(0) {
+	case "bash":
+		bashCompletion(os.Stdout)
+	case "zsh":
+		fmt.Println("autoload -U +X bashcompinit && bashcompinit")
+		bashCompletion(os.Stdout)
+	case "fish":
+		fishCompletion(os.Stdout)
+	default:
+		fatal("Expected a shell: bash, zsh or fish", "args", fs.Args())
+	}
+}
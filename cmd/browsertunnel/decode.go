@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/pcap"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// decodeFlags holds the flags of the decode subcommand.
+type decodeFlags struct {
+	domains        stringsFlag
+	encodings      stringsFlag
+	tenants        stringsFlag
+	maxMessageSize *int
+	qtype          *string
+	source         *string
+	hmacKey        *string
+	decryptKey     *string
+	keys           *keyFlags
+	signingKeys    stringsFlag
+	pcap           *string
+	port           *int
+}
+
+func registerDecodeFlags(fs *flag.FlagSet) *decodeFlags {
+	f := &decodeFlags{
+		maxMessageSize: fs.Int("maxMessageSize", tunnel.DefaultMaxMessageSize, "maximum encoded size (in bytes) of a message"),
+		qtype:          fs.String("qtype", "A", "type of the queries whose lines don't name one"),
+		source:         fs.String("source", "127.0.0.1", "address that the messages are reported to come from"),
+		hmacKey:        fs.String("hmacKey", "", "pre-shared key that messages are authenticated with (disabled if empty)"),
+		decryptKey:     fs.String("decryptKey", "", "hex encoded AES key that messages are encrypted with (disabled if empty)"),
+		keys:           registerKeyFlags(fs),
+		pcap:           fs.String("pcap", "", "packet capture in the pcap or pcapng format to read the queries from instead, or - for stdin"),
+		port:           fs.Int("port", 53, "port that the DNS traffic of the -pcap capture was sent to"),
+	}
+	fs.Var(&f.domains, "domain", "top domain that the queries were tunneled through (repeatable)")
+	fs.Var(&f.encodings, "encoding", "encoding of a top domain, as domain=encoding (repeatable)")
+	fs.Var(&f.tenants, "tenant", "tenant served under <tenant>.<topDomain> (repeatable)")
+	fs.Var(&f.signingKeys, "signingKey", "Ed25519 public key that messages may be signed with, as identity:hexPublicKey (repeatable)")
+	return f
+}
+
+// tunnel creates the tunnel that decode feeds the queries through. It doesn't rate limit them.
+func (f *decodeFlags) tunnel() (*tunnel.Tunnel, error) {
+	cfg := tunnel.Config{TopDomains: f.domains, MaxMessageSize: *f.maxMessageSize}
+	var err error
+	if cfg.Encodings, err = parseEncodings(f.encodings); err != nil {
+		return nil, err
+	}
+	if cfg.Tenants, err = parseTenants(f.tenants); err != nil {
+		return nil, err
+	}
+	if cfg.SigningKeys, err = parseSigningKeys(f.signingKeys); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Tenants {
+		cfg.Tenants[i].RateLimit = 0
+	}
+	if *f.hmacKey != "" {
+		cfg.HMACKey = []byte(*f.hmacKey)
+	}
+	if *f.decryptKey != "" {
+		if cfg.DecryptKey, err = hex.DecodeString(*f.decryptKey); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DecryptKeys, err = f.keys.load(); err != nil {
+		return nil, err
+	}
+	return tunnel.New(cfg)
+}
+
+// decodeQuery feeds the query for name of type qtype, received from source, to tun.
+func decodeQuery(tun *tunnel.Tunnel, name string, qtype uint16, source net.Addr) {
+	r := &dns.Msg{}
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	tun.ServeDNS(capturedWriter{source: source, receivedAt: time.Now()}, r)
+}
+
+// decodeLines feeds tun the queries named by the lines read from in.
+func decodeLines(tun *tunnel.Tunnel, in io.Reader, qtype uint16, source net.Addr) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		t := qtype
+		if len(fields) > 1 {
+			var ok bool
+			if t, ok = dns.StringToType[strings.ToUpper(fields[1])]; !ok {
+				slog.Warn("Ignoring query of unknown type", "name", fields[0], "qtype", fields[1])
+				continue
+			}
+		}
+		decodeQuery(tun, fields[0], t, source)
+	}
+	return scanner.Err()
+}
+
+// decodeCapture feeds tun the queries sent to port in the packet capture read from in.
+func decodeCapture(tun *tunnel.Tunnel, in io.Reader, port int) error {
+	r, err := pcap.NewReader(in)
+	if err != nil {
+		return err
+	}
+	var packets, queries, skipped int
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		packets++
+		msgs, err := p.DNS(port)
+		if err != nil {
+			skipped++
+			slog.Debug("Skipping packet", "time", p.Time, "error", err)
+		}
+		queries += serveCaptured(tun, msgs)
+	}
+	slog.Info("Read capture", "packets", packets, "queries", queries, "skipped", skipped)
+	return nil
+}
+
+// runDecode implements the decode subcommand, which reassembles the messages carried by query
+// names read from a file, or stdin, one per line and optionally followed by their type, or by the
+// queries of a packet capture, and writes them to stdout as lines of JSON. Partial messages left
+// once every query is read are logged.
+func runDecode(fs *flag.FlagSet, args []string) {
+	f := registerDecodeFlags(fs)
+	fs.Parse(args)
+	if len(f.domains) == 0 {
+		fatal("A -domain is required")
+	}
+	if fs.NArg() > 1 || (*f.pcap != "" && fs.NArg() > 0) {
+		fatal("Expected at most one file", "args", fs.Args())
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(*f.qtype)]
+	if !ok {
+		fatal("Invalid -qtype", "qtype", *f.qtype)
+	}
+	ip := net.ParseIP(*f.source)
+	if ip == nil {
+		fatal("Invalid -source", "source", *f.source)
+	}
+	source := &net.UDPAddr{IP: ip, Port: 53}
+	tun, err := f.tunnel()
+	if err != nil {
+		fatal("Failed to create tunnel", "error", err)
+	}
+
+	in := io.Reader(os.Stdin)
+	path := fs.Arg(0)
+	if *f.pcap != "" {
+		path = *f.pcap
+	}
+	if path != "" && path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fatal("Failed to open queries", "error", err)
+		}
+		defer file.Close()
+		in = file
+	}
+	out := sink.NewWriter(os.Stdout)
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		for msg := range tun.Messages() {
+			if err := out.Deliver(context.Background(), msg); err != nil {
+				fatal("Failed to write message", "error", err)
+			}
+		}
+	}()
+	if *f.pcap != "" {
+		err = decodeCapture(tun, in, *f.port)
+	} else {
+		err = decodeLines(tun, in, qtype, source)
+	}
+	if err != nil {
+		fatal("Failed to read queries", "error", err)
+	}
+	tun.Flush()
+	partials := tun.Partials()
+	tun.Close()
+	<-printed
+	for _, p := range partials {
+		slog.Warn("Incomplete message", "id", p.ID, "tenant", p.Tenant, "received", p.Received, "size", p.TotalSize, "fragments", p.Fragments)
+	}
+}
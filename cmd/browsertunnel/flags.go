@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// stringsFlag is a flag.Value that collects every occurrence of a repeatable flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Reset implements config.Resetter.
+func (f *stringsFlag) Reset() {
+	*f = nil
+}
+
+// secretFlag reports whether the value of the flag name is a secret, which the admin API must
+// not reveal.
+func secretFlag(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.Contains(lower, "password") || strings.Contains(lower, "token") || strings.HasSuffix(name, "Key")
+}
+
+// effectiveConfig returns the current value of every flag of fs, as reported by the admin API,
+// with secrets that are set replaced by "redacted".
+func effectiveConfig(fs *flag.FlagSet) map[string]string {
+	config := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && secretFlag(f.Name) {
+			value = "redacted"
+		}
+		config[f.Name] = value
+	})
+	return config
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/veggiedefender/browsertunnel/pkg/health"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// probes holds the state reported by the health endpoints.
+type probes struct {
+	// listeners are set once each DNS listener has started.
+	listeners map[string]*health.Flag
+	// serving is failed when the process starts shutting down, so that load balancers stop
+	// sending it traffic while partial messages drain.
+	serving health.Flag
+}
+
+func newProbes() *probes {
+	p := &probes{listeners: make(map[string]*health.Flag)}
+	p.serving.Set()
+	return p
+}
+
+// listener returns the flag of the named listener, creating it if needed.
+func (p *probes) listener(name string) *health.Flag {
+	f, ok := p.listeners[name]
+	if !ok {
+		f = &health.Flag{}
+		p.listeners[name] = f
+	}
+	return f
+}
+
+// handler returns a mux serving /healthz, which only reports whether the process is responsive,
+// and /readyz, which also reports the listeners, the sinks and the message backlog.
+func (p *probes) handler(tun *tunnel.Tunnel, sinks *swapSink) http.Handler {
+	live := &health.Checker{}
+	ready := &health.Checker{}
+	ready.Add("serving", p.serving.Check)
+	for name, f := range p.listeners {
+		ready.Add(name, f.Check)
+	}
+	ready.Add("sinks", func(ctx context.Context) error {
+		failing := sinks.Failing()
+		if len(failing) == 0 {
+			return nil
+		}
+		var errs []string
+		for name, err := range failing {
+			errs = append(errs, name+": "+err.Error())
+		}
+		sort.Strings(errs)
+		return fmt.Errorf("Sinks are failing: %s", strings.Join(errs, "; "))
+	})
+	ready.Add("backlog", func(ctx context.Context) error {
+		backlog, capacity := tun.Stats().Backlog, cap(tun.Messages())
+		if capacity > 0 && backlog >= capacity {
+			return fmt.Errorf("Message backlog is full (%d of %d)", backlog, capacity)
+		}
+		return nil
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", live)
+	mux.Handle("/readyz", ready)
+	return mux
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/config"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// An instance is a tunnel configured with -instance, served by the same listeners as the main
+// tunnel under top domains of its own, and delivering to sinks of its own.
+type instance struct {
+	name      string
+	tun       *tunnel.Tunnel
+	keys      *keyFlags
+	fanout    *sink.Fanout
+	delivered chan struct{}
+}
+
+// instanceFlags holds the flags of an -instance file.
+type instanceFlags struct {
+	name              *string
+	domains           stringsFlag
+	encodings         stringsFlag
+	tenants           stringsFlag
+	certTenants       stringsFlag
+	domainExpirations stringsFlag
+	tenantExpirations stringsFlag
+	expiration        *int
+	maxMessageSize    *int
+	hmacKey           *string
+	authTokens        stringsFlag
+	authTokenKey      *string
+	decryptKey        *string
+	keys              *keyFlags
+	signingKeys       stringsFlag
+	requireSignatures *bool
+	sinks             *sinkFlags
+}
+
+func registerInstanceFlags(fs *flag.FlagSet) *instanceFlags {
+	f := &instanceFlags{
+		name:              fs.String("name", "", "name of the instance in logs and metrics (defaults to the file name)"),
+		expiration:        fs.Int("expiration", 0, "seconds an incomplete message is retained (defaults to -expiration)"),
+		maxMessageSize:    fs.Int("maxMessageSize", 0, "maximum size of a message in bytes (defaults to -maxMessageSize)"),
+		hmacKey:           fs.String("hmacKey", "", "pre-shared key that messages must be authenticated with"),
+		authTokenKey:      fs.String("authTokenKey", "", "key that the auth tokens of fragments may be derived from"),
+		decryptKey:        fs.String("decryptKey", "", "hex encoded AES key that messages are encrypted with"),
+		keys:              registerKeyFlags(fs),
+		requireSignatures: fs.Bool("requireSignatures", false, "drop messages that aren't signed by one of the -signingKey keys"),
+		sinks:             registerSinkFlags(fs),
+	}
+	fs.Var(&f.domains, "domain", "top domain to tunnel through (repeatable)")
+	fs.Var(&f.encodings, "encoding", "encoding of a top domain, as domain=encoding (repeatable)")
+	fs.Var(&f.tenants, "tenant", "tenant, as name[:maxInFlight[:rateLimit]] (repeatable)")
+	fs.Var(&f.certTenants, "certTenant", "tenant that a TLS client certificate may send to, as identity:tenant (repeatable)")
+	fs.Var(&f.domainExpirations, "domainExpiration", "seconds an incomplete message sent through a top domain is retained, and in between checks for its expiration, as domain=expiration[:deletionInterval] (repeatable)")
+	fs.Var(&f.tenantExpirations, "tenantExpiration", "seconds an incomplete message of a tenant is retained, and in between checks for its expiration, as tenant=expiration[:deletionInterval] (repeatable)")
+	fs.Var(&f.authTokens, "authToken", "auth token that fragments may carry (repeatable)")
+	fs.Var(&f.signingKeys, "signingKey", "Ed25519 public key that messages may be signed with, as identity:hexPublicKey (repeatable)")
+	return f
+}
+
+// parseEncodings parses -encoding values, domain=encoding.
+func parseEncodings(values []string) (map[string]tunnel.Encoding, error) {
+	var encodings map[string]tunnel.Encoding
+	for _, s := range values {
+		domain, e, ok := strings.Cut(s, "=")
+		if !ok || domain == "" || e == "" {
+			return nil, fmt.Errorf("Invalid -encoding %q, expected domain=encoding", s)
+		}
+		if encodings == nil {
+			encodings = make(map[string]tunnel.Encoding)
+		}
+		encodings[domain] = tunnel.Encoding(e)
+	}
+	return encodings, nil
+}
+
+// parseExpirationPolicy parses expiration[:deletionInterval], in seconds.
+func parseExpirationPolicy(s string) (tunnel.ExpirationPolicy, error) {
+	expiration, interval, hasInterval := strings.Cut(s, ":")
+	var p tunnel.ExpirationPolicy
+	seconds, err := strconv.Atoi(expiration)
+	if err != nil || seconds < 0 {
+		return p, fmt.Errorf("Invalid expiration %q", expiration)
+	}
+	p.Expiration = time.Duration(seconds) * time.Second
+	if hasInterval {
+		if seconds, err = strconv.Atoi(interval); err != nil || seconds < 0 {
+			return p, fmt.Errorf("Invalid deletion interval %q", interval)
+		}
+		p.DeletionInterval = time.Duration(seconds) * time.Second
+	}
+	return p, nil
+}
+
+// parseDomainExpirations parses -domainExpiration values, domain=expiration[:deletionInterval].
+func parseDomainExpirations(values []string) (map[string]tunnel.ExpirationPolicy, error) {
+	var policies map[string]tunnel.ExpirationPolicy
+	for _, s := range values {
+		domain, spec, ok := strings.Cut(s, "=")
+		if !ok || domain == "" {
+			return nil, fmt.Errorf("Invalid -domainExpiration %q, expected domain=expiration[:deletionInterval]", s)
+		}
+		p, err := parseExpirationPolicy(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -domainExpiration %q: %w", s, err)
+		}
+		if policies == nil {
+			policies = make(map[string]tunnel.ExpirationPolicy)
+		}
+		policies[domain] = p
+	}
+	return policies, nil
+}
+
+// setTenantExpirations parses -tenantExpiration values, tenant=expiration[:deletionInterval], and
+// sets the expiration policies of tenants, each of which must be configured.
+func setTenantExpirations(tenants []tunnel.Tenant, values []string) error {
+	for _, s := range values {
+		name, spec, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("Invalid -tenantExpiration %q, expected tenant=expiration[:deletionInterval]", s)
+		}
+		p, err := parseExpirationPolicy(spec)
+		if err != nil {
+			return fmt.Errorf("Invalid -tenantExpiration %q: %w", s, err)
+		}
+		i := slices.IndexFunc(tenants, func(t tunnel.Tenant) bool { return strings.EqualFold(t.Name, name) })
+		if i < 0 {
+			return fmt.Errorf("Invalid -tenantExpiration %q: tenant %s is not configured", s, name)
+		}
+		tenants[i].ExpirationPolicy = p
+	}
+	return nil
+}
+
+// parseTenants parses -tenant values.
+func parseTenants(values []string) ([]tunnel.Tenant, error) {
+	var tenants []tunnel.Tenant
+	for _, s := range values {
+		t, err := tunnel.ParseTenant(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -tenant: %w", err)
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// parseSigningKeys parses -signingKey values.
+func parseSigningKeys(values []string) ([]tunnel.SigningKey, error) {
+	var keys []tunnel.SigningKey
+	for _, s := range values {
+		k, err := tunnel.ParseSigningKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -signingKey: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// loadInstance reads the file at path, and returns the name of the instance it configures, its
+// flags and the configuration of its tunnel. Settings that the file doesn't override are taken
+// from base, the configuration of the main tunnel, except for the stores, tenants, keys, API keys
+// and tenants of client certificates, which are never shared.
+func loadInstance(path string, base tunnel.Config) (string, *instanceFlags, tunnel.Config, error) {
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	f := registerInstanceFlags(fs)
+	if err := config.Load(path, fs); err != nil {
+		return "", nil, base, err
+	}
+	name := *f.name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if len(f.domains) == 0 {
+		return name, nil, base, fmt.Errorf("Instance %s requires at least one domain", name)
+	}
+
+	cfg := base
+	cfg.TopDomain, cfg.TopDomains = "", f.domains
+	cfg.Store, cfg.ReplayStore, cfg.Spool = nil, nil, nil
+	if cfg.Backpressure == tunnel.Spill {
+		cfg.Backpressure = tunnel.Block
+	}
+	cfg.HMACKey, cfg.AuthTokens, cfg.AuthTokenKey, cfg.DecryptKey, cfg.APIKeys = nil, f.authTokens, nil, nil, nil
+	cfg.RequireSignatures = *f.requireSignatures
+	if *f.expiration != 0 {
+		cfg.Expiration = time.Duration(*f.expiration) * time.Second
+	}
+	if *f.maxMessageSize != 0 {
+		cfg.MaxMessageSize = *f.maxMessageSize
+	}
+	var err error
+	if cfg.Encodings, err = parseEncodings(f.encodings); err != nil {
+		return name, nil, cfg, err
+	}
+	if cfg.CertTenants, err = tunnel.ParseCertTenants(f.certTenants); err != nil {
+		return name, nil, base, fmt.Errorf("Invalid -certTenant: %w", err)
+	}
+	if cfg.Tenants, err = parseTenants(f.tenants); err != nil {
+		return name, nil, cfg, err
+	}
+	if cfg.DomainExpirations, err = parseDomainExpirations(f.domainExpirations); err != nil {
+		return name, nil, cfg, err
+	}
+	if err := setTenantExpirations(cfg.Tenants, f.tenantExpirations); err != nil {
+		return name, nil, cfg, err
+	}
+	if cfg.SigningKeys, err = parseSigningKeys(f.signingKeys); err != nil {
+		return name, nil, cfg, err
+	}
+	if *f.hmacKey != "" {
+		cfg.HMACKey = []byte(*f.hmacKey)
+	}
+	if *f.authTokenKey != "" {
+		cfg.AuthTokenKey = []byte(*f.authTokenKey)
+	}
+	if *f.decryptKey != "" {
+		if cfg.DecryptKey, err = hex.DecodeString(*f.decryptKey); err != nil {
+			return name, nil, cfg, fmt.Errorf("Invalid decryption key of instance %s: %w", name, err)
+		}
+	}
+	if cfg.DecryptKeys, err = f.keys.load(); err != nil {
+		return name, nil, cfg, fmt.Errorf("Invalid keys of instance %s: %w", name, err)
+	}
+	return name, f, cfg, nil
+}
+
+// openInstance creates the instance configured by the file at path, as read by loadInstance.
+func openInstance(path string, base tunnel.Config, logger *slog.Logger) (*instance, error) {
+	name, f, cfg, err := loadInstance(path, base)
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.With("instance", name)
+	cfg.Logger = logger
+	sinks, err := f.sinks.sinks()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create sinks of instance %s: %w", name, err)
+	}
+	fanout, err := f.sinks.fanout(logger, sinks)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create sinks of instance %s: %w", name, err)
+	}
+	tun, err := tunnel.New(cfg)
+	if err != nil {
+		fanout.Close()
+		return nil, fmt.Errorf("Failed to create instance %s: %w", name, err)
+	}
+	return &instance{name: name, tun: tun, keys: f.keys, fanout: fanout, delivered: make(chan struct{})}, nil
+}
+
+// Collect implements metrics.Collector, labelling the metrics of the tunnel and sinks of inst
+// with its name.
+func (inst *instance) Collect() []metrics.Metric {
+	ms := append(inst.tun.Collect(), inst.fanout.Collect()...)
+	for i := range ms {
+		labels := make(map[string]string, len(ms[i].Labels)+1)
+		for k, v := range ms[i].Labels {
+			labels[k] = v
+		}
+		labels["instance"] = inst.name
+		ms[i].Labels = labels
+	}
+	return ms
+}
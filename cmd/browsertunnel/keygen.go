@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+)
+
+func registerKeygenFlags(fs *flag.FlagSet) *string {
+	return fs.String("identity", "client", "identity of the client that the public key is configured for")
+}
+
+// runKeygen implements the keygen subcommand, which generates an Ed25519 key pair for a client
+// to sign its messages with, and prints the seed of the private key, to pass to send -signKey,
+// and the public key with the identity of the client, to pass to serve -signingKey.
+func runKeygen(fs *flag.FlagSet, args []string) {
+	identity := registerKeygenFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fatal("Unexpected arguments", "args", fs.Args())
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fatal("Failed to generate a key", "error", err)
+	}
+	fmt.Printf("-signKey %s\n", hex.EncodeToString(priv.Seed()))
+	fmt.Printf("-signingKey %s:%s\n", *identity, hex.EncodeToString(pub))
+}
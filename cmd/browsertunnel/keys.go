@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// keyFlags holds the flags that load the named decryption keys of a tunnel, registered by serve
+// and -instance files.
+type keyFlags struct {
+	file    *string
+	command *string
+}
+
+func registerKeyFlags(fs *flag.FlagSet) *keyFlags {
+	return &keyFlags{
+		file:    fs.String("keyFile", "", "path of a file of named AES keys, one per line as id hexKey, for clients that send a key ID (disabled if empty)"),
+		command: fs.String("keyCommand", "", "shell command printing named AES keys in the -keyFile format, e.g. to fetch them from a KMS (disabled if empty)"),
+	}
+}
+
+// enabled reports whether named keys are loaded at all.
+func (f *keyFlags) enabled() bool {
+	return *f.file != "" || *f.command != ""
+}
+
+// load reads the keys from -keyFile, or the output of -keyCommand. It returns no keys if neither
+// is set.
+func (f *keyFlags) load() (map[string][]byte, error) {
+	var in io.Reader
+	switch {
+	case *f.file != "" && *f.command != "":
+		return nil, fmt.Errorf("-keyFile and -keyCommand can't be combined")
+	case *f.file != "":
+		file, err := os.Open(*f.file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open -keyFile: %w", err)
+		}
+		defer file.Close()
+		in = file
+	case *f.command != "":
+		cmd := exec.Command("sh", "-c", *f.command)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to run -keyCommand: %w", err)
+		}
+		in = bytes.NewReader(out)
+	default:
+		return nil, nil
+	}
+	keys, err := tunnel.ParseKeys(in)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid named keys: %w", err)
+	}
+	return keys, nil
+}
+
+// reload loads the keys again into tun, keeping its current keys if they fail to load.
+func (f *keyFlags) reload(tun *tunnel.Tunnel, logger *slog.Logger) {
+	if !f.enabled() {
+		return
+	}
+	keys, err := f.load()
+	if err == nil {
+		err = tun.SetDecryptKeys(keys)
+	}
+	if err != nil {
+		logger.Warn("Failed to reload decryption keys", "error", err)
+		return
+	}
+	logger.Info("Reloaded decryption keys", "keys", tun.DecryptKeyIDs())
+}
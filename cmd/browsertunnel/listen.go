@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/dnstap"
+	"github.com/veggiedefender/browsertunnel/pkg/doq"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+)
+
+// Protocols that DNS listeners serve.
+const (
+	protoUDP = "udp"
+	protoTCP = "tcp"
+	protoDoT = "dot"
+	protoDoQ = "doq"
+	// protoDnstap listeners receive the queries logged by resolvers over dnstap, on a Unix
+	// socket or TCP address, without answering them.
+	protoDnstap = "dnstap"
+)
+
+// defaultProtocols are the protocols of a -listen address that doesn't list any.
+var defaultProtocols = []string{protoUDP, protoTCP}
+
+// A listener serves DNS over a single protocol on a single address, and counts the queries it
+// receives.
+type listener struct {
+	protocol string
+	addr     string
+	queries  atomic.Uint64
+	// ln or pc is the socket passed by systemd that the listener serves, instead of listening on
+	// addr itself.
+	ln net.Listener
+	pc net.PacketConn
+}
+
+// parseListen parses a -listen value, address[/protocol,...], into a listener for each protocol,
+// e.g. [::]:53/udp or :853/dot,doq. Addresses without protocols are served over UDP and TCP.
+func parseListen(s string) ([]*listener, error) {
+	addr, protocols, found := strings.Cut(s, "/")
+	if addr == "" {
+		return nil, fmt.Errorf("Invalid -listen %q, expected address[/protocol,...]", s)
+	}
+	names := defaultProtocols
+	if found {
+		names = strings.Split(protocols, ",")
+	}
+	var listeners []*listener
+	for _, p := range names {
+		switch p {
+		case protoUDP, protoTCP, protoDoT, protoDoQ:
+			listeners = append(listeners, &listener{protocol: p, addr: addr})
+		default:
+			return nil, fmt.Errorf("Invalid -listen %q: unknown protocol %q, expected udp, tcp, dot or doq", s, p)
+		}
+	}
+	return listeners, nil
+}
+
+// name identifies l in health checks and metrics.
+func (l *listener) name() string {
+	return l.protocol + "/" + l.addr
+}
+
+// encrypted reports whether l needs a TLS certificate.
+func (l *listener) encrypted() bool {
+	return l.protocol == protoDoT || l.protocol == protoDoQ
+}
+
+// handler returns h wrapped so that the queries it answers are counted.
+func (l *listener) handler(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		l.queries.Add(1)
+		h.ServeDNS(w, r)
+	})
+}
+
+// serve serves h on l until the listener fails, calling started once it is listening. DoT and
+// DoQ listeners are served with tlsConfig.
+func (l *listener) serve(h dns.Handler, tlsConfig *tls.Config, started func()) error {
+	h = l.handler(h)
+	if l.ln != nil || l.pc != nil {
+		return l.activate(h, tlsConfig, started)
+	}
+	switch l.protocol {
+	case protoDoQ:
+		srv := &doq.Server{Addr: l.addr, Handler: h, TLSConfig: tlsConfig, NotifyStartedFunc: started}
+		return srv.ListenAndServe()
+	case protoDoT:
+		srv := &dns.Server{Addr: l.addr, Net: "tcp-tls", Handler: h, TLSConfig: tlsConfig, NotifyStartedFunc: started}
+		return srv.ListenAndServe()
+	case protoDnstap:
+		ln, err := listenDnstap(l.addr)
+		if err != nil {
+			return err
+		}
+		srv := &dnstap.Server{Handler: h, NotifyStartedFunc: started}
+		return srv.Serve(ln)
+	default:
+		srv := &dns.Server{Addr: l.addr, Net: l.protocol, Handler: h, NotifyStartedFunc: started}
+		return srv.ListenAndServe()
+	}
+}
+
+// activate serves h on the socket passed to l by systemd, like serve.
+func (l *listener) activate(h dns.Handler, tlsConfig *tls.Config, started func()) error {
+	switch l.protocol {
+	case protoDoQ:
+		srv := &doq.Server{Handler: h, TLSConfig: tlsConfig, NotifyStartedFunc: started}
+		return srv.Serve(l.pc)
+	case protoDoT:
+		srv := &dns.Server{Net: "tcp-tls", Listener: tls.NewListener(l.ln, tlsConfig), Handler: h, NotifyStartedFunc: started}
+		return srv.ActivateAndServe()
+	default:
+		srv := &dns.Server{Net: l.protocol, Listener: l.ln, PacketConn: l.pc, Handler: h, NotifyStartedFunc: started}
+		return srv.ActivateAndServe()
+	}
+}
+
+// loadClientCAs returns the pool of the CA certificates in the PEM bundle at path, which client
+// certificates must be issued by.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("%s holds no PEM encoded certificate", path)
+	}
+	return pool, nil
+}
+
+// listenDnstap listens on addr, which is a TCP address if it has a port, and the path of a Unix
+// socket otherwise. A socket left behind by an earlier server is replaced, and made writable by
+// the group, so that a resolver running as another user of the group can connect to it.
+func listenDnstap(addr string) (net.Listener, error) {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenerStats reports the queries received by each listener.
+type listenerStats []*listener
+
+// Collect implements metrics.Collector.
+func (ls listenerStats) Collect() []metrics.Metric {
+	var ms []metrics.Metric
+	for _, l := range ls {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_listener_queries_total",
+			Help:   "DNS queries received by each listener.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"listener": l.name(), "protocol": l.protocol},
+			Value:  float64(l.queries.Load()),
+		})
+	}
+	return ms
+}
@@ -0,0 +1,1035 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/admin"
+	"github.com/veggiedefender/browsertunnel/pkg/config"
+	"github.com/veggiedefender/browsertunnel/pkg/dashboard"
+	"github.com/veggiedefender/browsertunnel/pkg/doh"
+	"github.com/veggiedefender/browsertunnel/pkg/forward"
+	"github.com/veggiedefender/browsertunnel/pkg/geoip"
+	"github.com/veggiedefender/browsertunnel/pkg/hook"
+	"github.com/veggiedefender/browsertunnel/pkg/jsclient"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/rpc"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/store"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"google.golang.org/grpc"
+)
+
+func listenMessages(messages <-chan tunnel.Message, s sink.Sink, level slog.Level) {
+	for msg := range messages {
+		attrs := []any{"id", msg.ID, "client", msg.Source, "qtype", dns.TypeToString[msg.QueryType], "domain", msg.Domain, "tenant", msg.Tenant, "fragments", msg.Fragments}
+		if msg.ClientSubnet != nil {
+			attrs = append(attrs, "subnet", msg.ClientSubnet)
+		}
+		if msg.Binary {
+			attrs = append(attrs, "binary", len(msg.Payload))
+		} else {
+			attrs = append(attrs, "message", string(msg.Payload))
+		}
+		if msg.Session != "" {
+			attrs = append(attrs, "session", msg.Session)
+		}
+		if msg.Sequence != 0 {
+			attrs = append(attrs, "sequence", msg.Sequence)
+		}
+		if msg.Signer != "" {
+			attrs = append(attrs, "signer", msg.Signer)
+		}
+		slog.Log(context.Background(), level, "Received message", attrs...)
+		if err := s.Deliver(context.Background(), msg); err != nil {
+			slog.Warn("Failed to deliver message", "id", msg.ID, "error", err)
+		}
+	}
+}
+
+func listenExpired(expired <-chan tunnel.PartialMessage) {
+	for partial := range expired {
+		slog.Info("Expired message", "id", partial.ID, "tenant", partial.Tenant, "received", partial.Received, "total", partial.TotalSize)
+	}
+}
+
+func listenSessions(events <-chan tunnel.SessionEvent) {
+	for e := range events {
+		slog.Info("Session "+e.Type.String(), "session", e.Session, "tenant", e.Tenant, "client", e.Source, "messages", e.Messages, "bytes", e.Bytes, "duration", e.LastMessage.Sub(e.Started).Round(time.Second))
+	}
+}
+
+func listenProgress(events <-chan tunnel.ProgressEvent) {
+	for e := range events {
+		slog.Debug("Message progress", "id", e.ID, "tenant", e.Tenant, "received", e.Received, "total", e.TotalSize, "fragments", e.Fragments)
+	}
+}
+
+// writeChunks appends the chunks of each message to <dir>/<tenant>/<id>.part, which is renamed to
+// <dir>/<tenant>/<id> once the message is complete.
+func writeChunks(chunks <-chan tunnel.MessageChunk, dir string) {
+	for chunk := range chunks {
+		path := filepath.Join(dir, chunk.Tenant, chunk.ID)
+		if err := appendChunk(path+".part", chunk); err != nil {
+			slog.Warn("Failed to write chunk", "id", chunk.ID, "tenant", chunk.Tenant, "offset", chunk.Offset, "error", err)
+			continue
+		}
+		if chunk.Last {
+			if err := os.Rename(path+".part", path); err != nil {
+				slog.Warn("Failed to write chunk", "id", chunk.ID, "tenant", chunk.Tenant, "offset", chunk.Offset, "error", err)
+				continue
+			}
+			slog.Info("Received chunked message", "id", chunk.ID, "tenant", chunk.Tenant, "size", chunk.Offset+len(chunk.Data), "path", path)
+		}
+	}
+}
+
+// appendChunk appends chunk to the file at path, which the first chunk of a message truncates.
+func appendChunk(path string, chunk tunnel.MessageChunk) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if chunk.Offset == 0 {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(chunk.Data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// A strayRecord is a stray query as written to -strayQueryFile.
+type strayRecord struct {
+	Time         time.Time `json:"time"`
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	Source       string    `json:"source"`
+	ClientSubnet string    `json:"client_subnet,omitempty"`
+	Reason       string    `json:"reason"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// listenStrays writes the stray queries to w as lines of JSON, or only logs them at debug level if
+// w is nil.
+func listenStrays(strays <-chan tunnel.StrayQuery, w io.Writer) {
+	var enc *json.Encoder
+	if w != nil {
+		enc = json.NewEncoder(w)
+	}
+	for q := range strays {
+		rec := strayRecord{Time: q.Time, Name: q.Name, Type: dns.TypeToString[q.Type], Source: q.Source.String(), Reason: string(q.Reason)}
+		if rec.Type == "" {
+			rec.Type = strconv.Itoa(int(q.Type))
+		}
+		if q.ClientSubnet != nil {
+			rec.ClientSubnet = q.ClientSubnet.String()
+		}
+		if q.Err != nil {
+			rec.Error = q.Err.Error()
+		}
+		slog.Debug("Stray query", "name", rec.Name, "qtype", rec.Type, "client", rec.Source, "reason", rec.Reason, "error", rec.Error)
+		if enc == nil {
+			continue
+		}
+		if err := enc.Encode(rec); err != nil {
+			slog.Warn("Failed to write stray query", "name", rec.Name, "error", err)
+		}
+	}
+}
+
+// pruneMessages deletes the messages of db older than retention every minute.
+func pruneMessages(db *store.SQLite, retention time.Duration) {
+	for ; ; time.Sleep(time.Minute) {
+		n, err := db.Prune(context.Background(), time.Now().Add(-retention))
+		if err != nil {
+			slog.Warn("Failed to prune message database", "error", err)
+		} else if n > 0 {
+			slog.Debug("Pruned message database", "deleted", n)
+		}
+	}
+}
+
+// tunnelSettings parses the flags that can be changed while the tunnel is running.
+func tunnelSettings(rateLimit float64, rateBurst int, allowCIDRs, denyCIDRs []string, response string, ttl int, typeTTLs []string, negativeTTL int) (tunnel.Settings, error) {
+	s := tunnel.Settings{RateLimit: rateLimit, RateBurst: rateBurst}
+	var err error
+	if s.Response, err = tunnel.ParseResponse(response); err != nil {
+		return s, fmt.Errorf("Invalid -response: %w", err)
+	}
+	if ttl < 0 {
+		return s, fmt.Errorf("Invalid -ttl %d", ttl)
+	}
+	s.Response.TTL = uint32(ttl)
+	if s.Response.TTLs, err = tunnel.ParseTTLs(typeTTLs); err != nil {
+		return s, fmt.Errorf("Invalid -typeTTL: %w", err)
+	}
+	if negativeTTL < 0 {
+		return s, fmt.Errorf("Invalid -negativeTTL %d", negativeTTL)
+	}
+	s.Response.NegativeTTL = uint32(negativeTTL)
+	if s.AllowCIDRs, err = tunnel.ParseCIDRs(allowCIDRs); err != nil {
+		return s, fmt.Errorf("Invalid -allowCIDR: %w", err)
+	}
+	if s.DenyCIDRs, err = tunnel.ParseCIDRs(denyCIDRs); err != nil {
+		return s, fmt.Errorf("Invalid -denyCIDR: %w", err)
+	}
+	return s, nil
+}
+
+// runServe implements the serve subcommand, which serves the tunnel until it receives SIGTERM or an
+// interrupt.
+func runServe(fs *flag.FlagSet, args []string) {
+	serve(context.Background(), fs, args, serveHooks{})
+}
+
+// serveHooks let a service manager other than systemd, such as the Windows one, run serve.
+type serveHooks struct {
+	// handler, if set, wraps the handler of the logger, e.g. to also log to the event log.
+	handler func(slog.Handler) slog.Handler
+	// ready, if set, is called once every listener has started.
+	ready func()
+}
+
+// A server holds what serve opens and starts, from the stores of the tunnels to the listeners,
+// so that its phases can hand them on to each other, and to shutdown once it is asked to stop.
+type server struct {
+	f      *serveFlags
+	fs     *flag.FlagSet
+	loader *config.Loader
+	logger *slog.Logger
+	board  *dashboard.Dashboard
+
+	bolt     *store.Bolt
+	shared   *store.Redis
+	spool    *store.Bolt
+	queryLog *sink.QueryLog
+	messages *store.SQLite
+
+	tun       *tunnel.Tunnel
+	instances []*instance
+	// tunnels handles the queries that are observed, by captures and dnstap, which are only fed
+	// to the tunnels, and never forwarded.
+	tunnels   *dns.ServeMux
+	forwarder *forward.Forwarder
+
+	// persistent holds the sinks tied to listeners, which are kept across reloads.
+	persistent     []sink.Named
+	messageLevel   slog.Level
+	stream         *sink.Stream
+	streamListener net.Listener
+	fanout         *swapSink
+	spooler        *sink.Spooler
+	hooked         *hook.Sink
+	delivered      chan struct{}
+	alertFile      *sink.File
+	stopTracing    func(context.Context) error
+	// effective is the snapshot of the flags reported by the admin API, which snapshotConfig
+	// takes again once the flags are set again on reload.
+	effective atomic.Pointer[map[string]string]
+
+	listeners []*listener
+	captures  []*capture
+	probes    *probes
+}
+
+// serve parses the serve flags in args and serves the tunnel until it receives SIGTERM or an
+// interrupt, or ctx is done.
+func serve(ctx context.Context, fs *flag.FlagSet, args []string, hooks serveHooks) {
+	s := &server{f: registerServeFlags(fs), fs: fs}
+	f := s.f
+	fs.Parse(args)
+	if *f.configFile != "" {
+		s.loader = config.NewLoader(*f.configFile, fs)
+		if err := s.loader.Load(); err != nil {
+			fatal("Invalid configuration file", "error", err)
+		}
+	}
+	s.setupLogger(hooks)
+
+	topDomains := append(fs.Args(), f.domains...)
+	if len(topDomains) == 0 {
+		fatal("tunnel requires at least one top domain, as an argument or with -domain")
+	}
+	if err := f.check(); err != nil {
+		fatal(err.Error())
+	}
+	cfg, err := f.tunnelConfig(topDomains)
+	if err != nil {
+		fatal(err.Error())
+	}
+	s.openStores(&cfg)
+	if s.tun, err = tunnel.New(cfg); err != nil {
+		fatal("Failed to create tunnel", "error", err)
+	}
+	s.routeQueries(cfg)
+	s.startSinkListeners()
+	s.snapshotConfig()
+	if *f.otlpEndpoint != "" {
+		if s.stopTracing, err = startTracing(*f.otlpEndpoint); err != nil {
+			fatal("Invalid -otlpEndpoint", "error", err)
+		}
+	}
+	s.buildSinks()
+	s.startAdmin()
+	s.deliverMessages()
+
+	if s.listeners, err = f.listeners(); err != nil {
+		fatal(err.Error())
+	}
+	creds, err := lookupCredentials(*f.user, *f.group)
+	if err != nil {
+		fatal(err.Error())
+	}
+	s.captures = f.captureInterfaces()
+	s.startMetrics()
+	s.listenEvents()
+	s.handleReloads()
+	s.startListeners(creds, hooks)
+	s.startHTTPListeners()
+
+	stopping, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	<-stopping.Done()
+	stop()
+	s.shutdown()
+}
+
+// setupLogger sets the default logger to the one configured by the flags, which also feeds the
+// dashboard if it is enabled.
+func (s *server) setupLogger(hooks serveHooks) {
+	f := s.f
+	logger, err := newLogger(os.Stderr, *f.logLevel, *f.logFormat)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if hooks.handler != nil {
+		logger = slog.New(hooks.handler(logger.Handler()))
+	}
+	if *f.dashboardAddr != "" {
+		s.board = dashboard.New()
+		logger = slog.New(s.board.LogHandler(logger.Handler()))
+	}
+	slog.SetDefault(logger)
+	s.logger = logger
+}
+
+// openStores opens the state file, the shared store, the spill file and the query log, and sets
+// them on cfg.
+func (s *server) openStores(cfg *tunnel.Config) {
+	f := s.f
+	var err error
+	if *f.stateFile != "" {
+		s.bolt, err = store.OpenBolt(*f.stateFile)
+		if err != nil {
+			fatal("Failed to open state file", "error", err)
+		}
+		cfg.Store = s.bolt
+		cfg.ReplayStore = s.bolt
+	}
+	if *f.stateRedisAddr != "" {
+		// Partial messages outlive this server's expiration in Redis, in case the other servers
+		// expire them later, including the expirations that clients may ask for.
+		longest := cfg.Expiration
+		for _, p := range cfg.DomainExpirations {
+			longest = max(longest, p.Expiration)
+		}
+		for _, t := range cfg.Tenants {
+			longest = max(longest, t.Expiration)
+		}
+		expiration := max(longest, cfg.MaxExpiration)
+		if cfg.MaxExpiration == 0 {
+			expiration = 10 * longest
+		}
+		s.shared, err = store.OpenRedis(store.RedisConfig{Addr: *f.stateRedisAddr, Username: *f.stateRedisUser, Password: *f.stateRedisPassword, Prefix: *f.stateRedisPrefix, TTL: 2 * expiration})
+		if err != nil {
+			fatal("Failed to connect to -stateRedisAddr", "error", err)
+		}
+		cfg.Store = s.shared
+	}
+	if cfg.Backpressure == tunnel.Spill {
+		switch {
+		case *f.spillFile == *f.stateFile:
+			s.spool = s.bolt
+		default:
+			if s.spool, err = store.OpenBolt(*f.spillFile); err != nil {
+				fatal("Failed to open spill file", "error", err)
+			}
+		}
+		cfg.Spool = s.spool
+	}
+	if *f.queryLog != "" {
+		s.queryLog, err = sink.NewQueryLog(sink.QueryLogConfig{
+			File: sink.FileConfig{
+				Path:     *f.queryLog,
+				MaxSize:  *f.queryLogMaxSize,
+				MaxAge:   time.Duration(*f.queryLogMaxAge) * time.Second,
+				Compress: *f.queryLogCompress,
+			},
+			HashKey: []byte(*f.queryLogHashKey),
+		}, s.logger)
+		if err != nil {
+			fatal("Failed to open query log", "error", err)
+		}
+		// Instances log their queries to the same file.
+		cfg.QueryLog = s.queryLog
+	}
+}
+
+// routeQueries opens the instances, and routes the queries under the top domains of every tunnel
+// to it, and the others to the upstream resolvers.
+func (s *server) routeQueries(cfg tunnel.Config) {
+	f, tun := s.f, s.tun
+	s.tunnels = dns.NewServeMux()
+	served := make(map[string]string)
+	for _, topDomain := range tun.TopDomains() {
+		dns.Handle(topDomain, tun)
+		s.tunnels.Handle(topDomain, tun)
+		served[topDomain] = "the main tunnel"
+	}
+	for _, path := range f.instancePaths {
+		inst, err := openInstance(path, cfg, s.logger)
+		if err != nil {
+			fatal("Invalid -instance", "error", err)
+		}
+		for _, topDomain := range inst.tun.TopDomains() {
+			if other, ok := served[topDomain]; ok {
+				fatal("Top domain is served twice", "domain", topDomain, "instance", inst.name, "by", other)
+			}
+			dns.Handle(topDomain, inst.tun)
+			s.tunnels.Handle(topDomain, inst.tun)
+			served[topDomain] = "instance " + inst.name
+		}
+		s.instances = append(s.instances, inst)
+	}
+	if len(f.upstreams) > 0 {
+		var err error
+		s.forwarder, err = forward.New(forward.Config{Upstreams: f.upstreams, Timeout: time.Duration(*f.upstreamTimeout) * time.Second})
+		if err != nil {
+			fatal("Invalid -upstream", "error", err)
+		}
+	}
+	if s.forwarder != nil || *f.alertEntropy > 0 {
+		// Queries outside of the tunnels are inspected for alerts before they are forwarded, or
+		// failed as they would be without a handler.
+		var next dns.Handler = dns.HandlerFunc(dns.HandleFailed)
+		if s.forwarder != nil {
+			next = s.forwarder
+		}
+		dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+			tun.Inspect(r, w.RemoteAddr())
+			next.ServeDNS(w, r)
+		})
+		s.tunnels.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+			tun.Inspect(r, w.RemoteAddr())
+		})
+	}
+}
+
+// startSinkListeners creates the persistent sinks, and starts the stream, gRPC, dashboard and
+// HTTP API listeners that serve what they receive.
+func (s *server) startSinkListeners() {
+	f := s.f
+	var err error
+	s.messageLevel = slog.LevelInfo
+	switch *f.output {
+	case "log":
+	case "ndjson":
+		s.persistent = append(s.persistent, sink.Named{Name: "stdout", Sink: sink.NewWriter(os.Stdout)})
+		s.messageLevel = slog.LevelDebug
+	}
+	if *f.streamAddr != "" || *f.streamSocket != "" {
+		s.startStream()
+	}
+	if *f.grpcAddr != "" {
+		l, err := net.Listen("tcp", *f.grpcAddr)
+		if err != nil {
+			fatal("Failed to set gRPC listener", "error", err)
+		}
+		rpcServer := rpc.NewServer()
+		s.persistent = append(s.persistent, sink.Named{Name: "grpc", Sink: rpcServer})
+		gs := grpc.NewServer()
+		rpc.RegisterTunnelServer(gs, rpcServer)
+		go func() {
+			if err := gs.Serve(l); err != nil {
+				fatal("Failed to serve gRPC", "error", err)
+			}
+		}()
+	}
+	if s.board != nil {
+		s.persistent = append(s.persistent, sink.Named{Name: "dashboard", Sink: s.board})
+		go func() {
+			if err := http.ListenAndServe(*f.dashboardAddr, s.board.Handler(s.tun, *f.dashboardToken)); err != nil {
+				fatal("Failed to set dashboard listener", "error", err)
+			}
+		}()
+	}
+	api := http.NewServeMux()
+	if *f.messageDB != "" {
+		s.messages, err = store.OpenSQLite(*f.messageDB)
+		if err != nil {
+			fatal("Failed to open message database", "error", err)
+		}
+		s.persistent = append(s.persistent, sink.Named{Name: "sqlite", Sink: keepOpen{s.messages}})
+		api.Handle("/messages", s.messages)
+		if *f.messageRetention > 0 {
+			go pruneMessages(s.messages, time.Duration(*f.messageRetention)*time.Second)
+		}
+	}
+	if *f.apiAddr != "" {
+		var handler http.Handler = api
+		if *f.apiToken != "" {
+			handler = admin.RequireToken(*f.apiToken, api)
+		}
+		go func() {
+			if err := http.ListenAndServe(*f.apiAddr, handler); err != nil {
+				fatal("Failed to set API listener", "error", err)
+			}
+		}()
+	}
+}
+
+// startStream creates the stream sink, and serves it on the stream socket and listener.
+func (s *server) startStream() {
+	f := s.f
+	s.stream = sink.NewStream()
+	s.persistent = append(s.persistent, sink.Named{Name: "stream", Sink: s.stream})
+	if *f.streamSocket != "" {
+		// A socket left behind by a previous run would make listening fail.
+		if fi, err := os.Stat(*f.streamSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(*f.streamSocket)
+		}
+		var err error
+		s.streamListener, err = net.Listen("unix", *f.streamSocket)
+		if err != nil {
+			fatal("Failed to set stream socket", "error", err)
+		}
+		if err := os.Chmod(*f.streamSocket, 0660); err != nil {
+			fatal("Failed to set stream socket", "error", err)
+		}
+		go s.stream.Serve(s.streamListener)
+	}
+	if *f.streamAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/messages", s.stream)
+			if err := http.ListenAndServe(*f.streamAddr, mux); err != nil {
+				fatal("Failed to set stream listener", "error", err)
+			}
+		}()
+	}
+}
+
+// snapshotConfig takes the snapshot of the flags reported by the admin API.
+func (s *server) snapshotConfig() {
+	config := effectiveConfig(s.fs)
+	config["topDomains"] = strings.Join(s.tun.TopDomains(), ",")
+	s.effective.Store(&config)
+}
+
+// buildSinks creates the sinks configured by the flags, along with the persistent ones, and the
+// spooler and hooks that messages go through on their way to them.
+func (s *server) buildSinks() {
+	f := s.f
+	if err := f.retry.open(*f.stateFile, s.bolt); err != nil {
+		fatal("Failed to open retry files", "error", err)
+	}
+	routed, err := s.fanoutOf()
+	if err != nil {
+		fatal("Failed to create sinks", "error", err)
+	}
+	s.fanout = &swapSink{fanout: routed}
+	if *f.spoolDir != "" {
+		dir, err := store.OpenDir(*f.spoolDir, *f.spoolMaxBytes)
+		if err != nil {
+			fatal("Failed to open spool directory", "error", err)
+		}
+		s.spooler = sink.NewSpooler(s.fanout, dir, time.Duration(*f.spoolProbeInterval)*time.Second, s.logger)
+	}
+	switch {
+	case *f.wasmHook != "":
+		h, err := hook.LoadWASM(context.Background(), *f.wasmHook, time.Duration(*f.hookTimeout)*time.Second)
+		if err != nil {
+			fatal("Invalid -wasmHook", "error", err)
+		}
+		s.hooked = hook.NewSink(h, s.downstream())
+	case *f.luaHook != "":
+		h, err := hook.LoadLua(*f.luaHook, time.Duration(*f.hookTimeout)*time.Second)
+		if err != nil {
+			fatal("Invalid -luaHook", "error", err)
+		}
+		s.hooked = hook.NewSink(h, s.downstream())
+	}
+}
+
+// fanoutOf returns a Fanout delivering to the sinks configured by the flags, and the persistent
+// ones.
+func (s *server) fanoutOf() (*sink.Fanout, error) {
+	sinks, err := s.f.sinks.sinks()
+	if err == nil {
+		sinks, err = s.f.retry.apply(sinks)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.f.sinks.fanout(s.logger, append(s.persistent, sinks...))
+}
+
+// downstream returns the sink that messages are delivered to once they went through the hook, if
+// any.
+func (s *server) downstream() sink.Sink {
+	if s.spooler != nil {
+		return s.spooler
+	}
+	return s.fanout
+}
+
+// startAdmin starts the admin API, if enabled.
+func (s *server) startAdmin() {
+	f := s.f
+	if *f.adminAddr == "" {
+		return
+	}
+	adminServer, err := admin.New(s.tun, *f.adminToken, func() map[string]string { return *s.effective.Load() })
+	if err != nil {
+		fatal("Invalid -adminToken", "error", err)
+	}
+	if s.messages != nil {
+		adminServer.EnableReplay(s.messages, s.fanout)
+	}
+	adminServer.EnableSinks(s.fanout)
+	if *f.progress {
+		adminServer.EnableProgress()
+	}
+	go func() {
+		if err := http.ListenAndServe(*f.adminAddr, adminServer); err != nil {
+			fatal("Failed to set admin listener", "error", err)
+		}
+	}()
+}
+
+// deliverMessages delivers the messages of every tunnel to its sinks until it is shut down.
+func (s *server) deliverMessages() {
+	var deliver sink.Sink = s.downstream()
+	if s.hooked != nil {
+		deliver = s.hooked
+	}
+	// Messages are tagged with their location before the hook runs, so that it can use it.
+	if len(s.f.geoipDBs) > 0 {
+		db, err := geoip.Open(s.f.geoipDBs...)
+		if err != nil {
+			fatal("Invalid -geoipDB", "error", err)
+		}
+		deliver = hook.NewSink(db, deliver)
+	}
+	s.delivered = make(chan struct{})
+	go func() {
+		listenMessages(s.tun.Messages(), deliver, s.messageLevel)
+		close(s.delivered)
+	}()
+	for _, inst := range s.instances {
+		inst := inst
+		go func() {
+			listenMessages(inst.tun.Messages(), inst.fanout, s.messageLevel)
+			close(inst.delivered)
+		}()
+	}
+}
+
+// startMetrics starts the metrics listener, if enabled.
+func (s *server) startMetrics() {
+	if *s.f.metricsAddr == "" {
+		return
+	}
+	registry := &metrics.Registry{}
+	registry.Register(s.tun)
+	registry.Register(s.fanout)
+	if s.spooler != nil {
+		registry.Register(s.spooler)
+	}
+	for _, inst := range s.instances {
+		registry.Register(inst)
+	}
+	registry.Register(listenerStats(s.listeners))
+	if len(s.captures) > 0 {
+		registry.Register(captureStats(s.captures))
+	}
+	if s.forwarder != nil {
+		registry.Register(s.forwarder)
+	}
+	if s.hooked != nil {
+		registry.Register(s.hooked)
+	}
+	if s.stream != nil {
+		registry.Register(s.stream)
+	}
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		if err := http.ListenAndServe(*s.f.metricsAddr, mux); err != nil {
+			fatal("Failed to set metrics listener", "error", err)
+		}
+	}()
+}
+
+// listenEvents handles what the tunnels report besides messages: expirations, sessions, progress,
+// stray queries, alerts, chunks and streams.
+func (s *server) listenEvents() {
+	f, tun := s.f, s.tun
+	go listenExpired(tun.Expired())
+	go listenSessions(tun.Sessions())
+	if *f.progress && *f.adminAddr == "" {
+		go listenProgress(tun.Progress())
+	}
+	var strays io.Writer
+	if *f.strayQueryFile != "" {
+		file, err := os.OpenFile(*f.strayQueryFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fatal("Failed to open stray query file", "error", err)
+		}
+		strays = file
+	}
+	go listenStrays(tun.StrayQueries(), strays)
+	alertSinks, alertFile, err := f.alertSinks()
+	if err != nil {
+		fatal("Failed to open alert file", "error", err)
+	}
+	s.alertFile = alertFile
+	go sink.ForwardAlerts(tun.Alerts(), s.logger, alertSinks...)
+	if *f.chunkDir != "" {
+		go writeChunks(tun.MessageChunks(), *f.chunkDir)
+	}
+	if *f.streamForward != "" {
+		go forwardStreams(tun.StreamListener(), *f.streamForward, s.logger)
+	}
+	for _, inst := range s.instances {
+		go listenExpired(inst.tun.Expired())
+		go listenSessions(inst.tun.Sessions())
+		go listenStrays(inst.tun.StrayQueries(), strays)
+		go sink.ForwardAlerts(inst.tun.Alerts(), s.logger.With("instance", inst.name), alertSinks...)
+	}
+}
+
+// reloadKeys reloads the keys of every tunnel.
+func (s *server) reloadKeys() {
+	s.f.keys.reload(s.tun, s.logger)
+	for _, inst := range s.instances {
+		inst.keys.reload(inst.tun, s.logger.With("instance", inst.name))
+	}
+}
+
+// handleReloads reloads the keys every -keyRefresh, and the keys, then the configuration file on
+// SIGHUP.
+func (s *server) handleReloads() {
+	f := s.f
+	keysEnabled := f.keys.enabled()
+	for _, inst := range s.instances {
+		keysEnabled = keysEnabled || inst.keys.enabled()
+	}
+	if *f.keyRefresh > 0 {
+		go func() {
+			for range time.Tick(time.Duration(*f.keyRefresh) * time.Second) {
+				s.reloadKeys()
+			}
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if s.loader == nil {
+				s.reloadKeys()
+				if !keysEnabled {
+					slog.Warn("Ignoring SIGHUP without -config")
+				}
+				continue
+			}
+			if err := s.loader.Load(); err != nil {
+				slog.Warn("Failed to reload configuration", "error", err)
+				continue
+			}
+			s.reloadKeys()
+			s.reload()
+		}
+	}()
+}
+
+// reload applies the settings and sinks of the configuration file just loaded again.
+func (s *server) reload() {
+	live, err := s.f.settings()
+	if err == nil {
+		err = s.tun.Reconfigure(live)
+	}
+	for _, inst := range s.instances {
+		if err == nil {
+			err = inst.tun.Reconfigure(live)
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to reload tunnel settings", "error", err)
+		return
+	}
+	routed, err := s.fanoutOf()
+	if err != nil {
+		slog.Warn("Failed to reload sinks", "error", err)
+		return
+	}
+	if err := s.fanout.swap(routed); err != nil {
+		slog.Warn("Failed to close previous sinks", "error", err)
+	}
+	s.snapshotConfig()
+	slog.Info("Reloaded configuration", "path", *s.f.configFile)
+}
+
+// tlsConfig returns the TLS configuration of the encrypted DNS listeners, nil if there are none,
+// and the pool of the CAs that their client certificates must be issued by, if any.
+func (s *server) tlsConfig() (*tls.Config, *x509.CertPool) {
+	f := s.f
+	var clientCAs *x509.CertPool
+	if *f.clientCA != "" {
+		var err error
+		if clientCAs, err = loadClientCAs(*f.clientCA); err != nil {
+			fatal("Failed to load -clientCA", "error", err)
+		}
+	}
+	for _, l := range s.listeners {
+		if !l.encrypted() {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(*f.tlsCert, *f.tlsKey)
+		if err != nil {
+			fatal("Failed to load TLS certificate", "error", err)
+		}
+		// DoQ listeners replace the ALPN protocols with doq.
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if *f.dotALPN != "" {
+			tlsConfig.NextProtos = strings.Split(*f.dotALPN, ",")
+		}
+		if clientCAs != nil {
+			tlsConfig.ClientCAs, tlsConfig.ClientAuth = clientCAs, tls.RequireAndVerifyClientCert
+		}
+		return tlsConfig, clientCAs
+	}
+	return nil, clientCAs
+}
+
+// startListeners starts the DNS listeners, captures and the DoH listener. Privileges are dropped
+// to creds, and systemd and hooks are notified, once they have all started.
+func (s *server) startListeners(creds *credentials, hooks serveHooks) {
+	f := s.f
+	s.probes = newProbes()
+	tlsConfig, clientCAs := s.tlsConfig()
+	var starting sync.WaitGroup
+	for _, l := range s.listeners {
+		l := l
+		started := s.probes.listener(l.name())
+		handler := dns.Handler(dns.DefaultServeMux)
+		if l.protocol == protoDnstap {
+			handler = s.tunnels
+		}
+		starting.Add(1)
+		go func() {
+			if err := l.serve(handler, tlsConfig, func() { started.Set(); starting.Done() }); err != nil {
+				fatal("Failed to set DNS listener", "listener", l.name(), "error", err)
+			}
+		}()
+	}
+
+	for _, c := range s.captures {
+		c := c
+		started := s.probes.listener(c.name())
+		starting.Add(1)
+		go func() {
+			if err := c.serve(s.tunnels, func() { started.Set(); starting.Done() }); err != nil {
+				fatal("Failed to capture DNS queries", "interface", c.iface, "error", err)
+			}
+		}()
+	}
+
+	if *f.dohAddr != "" {
+		started := s.probes.listener("doh")
+		starting.Add(1)
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle(doh.Path, doh.Handler(dns.DefaultServeMux))
+			srv := &http.Server{Addr: *f.dohAddr, Handler: mux, TLSConfig: &tls.Config{}}
+			if clientCAs != nil {
+				srv.TLSConfig.ClientCAs, srv.TLSConfig.ClientAuth = clientCAs, tls.RequireAndVerifyClientCert
+			}
+			// The keypair is loaded before the listener counts as started, since privileges are
+			// dropped once every listener has, and the key may only be readable by root or lie
+			// outside the chroot.
+			if *f.tlsCert != "" {
+				cert, err := tls.LoadX509KeyPair(*f.tlsCert, *f.tlsKey)
+				if err != nil {
+					fatal("Failed to load TLS certificate", "error", err)
+				}
+				srv.TLSConfig.Certificates = []tls.Certificate{cert}
+			}
+			l, err := net.Listen("tcp", *f.dohAddr)
+			if err == nil {
+				started.Set()
+				starting.Done()
+				if *f.tlsCert != "" {
+					err = srv.ServeTLS(l, "", "")
+				} else {
+					err = srv.Serve(l)
+				}
+			}
+			if err != nil {
+				fatal("Failed to set DoH listener", "error", err)
+			}
+		}()
+	}
+
+	go func() {
+		starting.Wait()
+		if creds != nil || *f.chroot != "" {
+			if err := dropPrivileges(creds, *f.chroot); err != nil {
+				fatal("Failed to drop privileges", "error", err)
+			}
+			slog.Info("Dropped privileges", "user", *f.user, "group", *f.group, "chroot", *f.chroot)
+		}
+		sdNotify("READY=1")
+		if hooks.ready != nil {
+			hooks.ready()
+		}
+	}()
+}
+
+// startHTTPListeners starts the pprof, JavaScript client and health listeners, if enabled.
+func (s *server) startHTTPListeners() {
+	f := s.f
+	if *f.pprofEnabled {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/debug/pprof/", pprof.Index)
+			mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+			if err := http.ListenAndServe(*f.pprofAddr, mux); err != nil {
+				fatal("Failed to set pprof listener", "error", err)
+			}
+		}()
+	}
+
+	if *f.jsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle(jsclient.Path, jsclient.Handler())
+			if err := http.ListenAndServe(*f.jsAddr, mux); err != nil {
+				fatal("Failed to set JavaScript client listener", "error", err)
+			}
+		}()
+	}
+
+	if *f.healthAddr != "" {
+		handler := s.probes.handler(s.tun, s.fanout)
+		go func() {
+			if err := http.ListenAndServe(*f.healthAddr, handler); err != nil {
+				fatal("Failed to set health listener", "error", err)
+			}
+		}()
+	}
+}
+
+// shutdown keeps answering queries while partial messages complete, then flushes every assembled
+// message to the sinks, and closes what s opened.
+func (s *server) shutdown() {
+	f, tun := s.f, s.tun
+	sdNotify("STOPPING=1")
+	s.probes.serving.Fail(fmt.Errorf("Shutting down"))
+	timeout := time.Duration(*f.drainTimeout) * time.Second
+	slog.Info("Shutting down", "inFlight", tun.Stats().InFlight, "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var drained sync.WaitGroup
+	for _, inst := range s.instances {
+		inst := inst
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			if err := inst.tun.Shutdown(ctx); err != nil {
+				slog.Warn("Abandoning partial messages", "instance", inst.name, "inFlight", inst.tun.Stats().InFlight, "error", err)
+			}
+		}()
+	}
+	if err := tun.Shutdown(ctx); err != nil {
+		slog.Warn("Abandoning partial messages", "inFlight", tun.Stats().InFlight, "error", err)
+	}
+	<-s.delivered
+	drained.Wait()
+	for _, inst := range s.instances {
+		<-inst.delivered
+		if err := inst.fanout.Close(); err != nil {
+			slog.Warn("Failed to close sinks", "instance", inst.name, "error", err)
+		}
+	}
+	if s.spooler != nil {
+		s.spooler.Close()
+	}
+	if err := s.fanout.Close(); err != nil {
+		slog.Warn("Failed to close sinks", "error", err)
+	}
+	if s.queryLog != nil {
+		if err := s.queryLog.Close(); err != nil {
+			slog.Warn("Failed to close query log", "error", err)
+		}
+	}
+	if s.alertFile != nil {
+		if err := s.alertFile.Close(); err != nil {
+			slog.Warn("Failed to close alert file", "error", err)
+		}
+	}
+	f.retry.close()
+	// Closing the stream socket removes it.
+	if s.streamListener != nil {
+		s.streamListener.Close()
+	}
+	if s.shared != nil {
+		s.shared.Close()
+	}
+	if s.bolt != nil {
+		if err := s.bolt.Close(); err != nil {
+			slog.Warn("Failed to close state file", "error", err)
+		}
+	}
+	if s.spool != nil && s.spool != s.bolt {
+		if err := s.spool.Close(); err != nil {
+			slog.Warn("Failed to close spill file", "error", err)
+		}
+	}
+	if s.stopTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.stopTracing(ctx); err != nil {
+			slog.Warn("Failed to export traces", "error", err)
+		}
+	}
+	slog.Info("Shut down")
+}
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// credentials are the user and group that -user and -group switch the process to, which is only
+// supported on Unix.
+type credentials struct{}
+
+// lookupCredentials returns an error if userName or groupName is given, since switching users is
+// only supported on Unix.
+func lookupCredentials(userName, groupName string) (*credentials, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	return nil, errors.New("-user and -group are only supported on Unix")
+}
+
+// dropPrivileges returns an error if chroot is set, since it is only supported on Unix.
+func dropPrivileges(c *credentials, chroot string) error {
+	if chroot != "" {
+		return errors.New("-chroot is only supported on Unix")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credentials are the user and group that -user and -group switch the process to.
+type credentials struct {
+	uid, gid int
+	// setUID is false if only -group was given.
+	setUID bool
+}
+
+// lookupCredentials resolves userName and groupName, given as names or numeric IDs, into
+// credentials. The group defaults to the primary group of the user. It returns nil if neither
+// is given.
+func lookupCredentials(userName, groupName string) (*credentials, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	c := &credentials{gid: -1}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, numeric := strconv.Atoi(userName); err != nil && numeric == nil {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -user %q: %w", userName, err)
+		}
+		if c.uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, fmt.Errorf("Invalid -user %q: non-numeric user ID %q", userName, u.Uid)
+		}
+		if c.gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, fmt.Errorf("Invalid -user %q: non-numeric group ID %q", userName, u.Gid)
+		}
+		c.setUID = true
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, numeric := strconv.Atoi(groupName); err != nil && numeric == nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -group %q: %w", groupName, err)
+		}
+		if c.gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("Invalid -group %q: non-numeric group ID %q", groupName, g.Gid)
+		}
+	}
+	return c, nil
+}
+
+// dropPrivileges changes the root directory of the process to chroot, if set, and then switches
+// it to c, if set, dropping the supplementary groups of root. Users and groups must be looked up
+// before, since the user database may not be found under chroot.
+func dropPrivileges(c *credentials, chroot string) error {
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return fmt.Errorf("Failed to chroot to %s: %w", chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if c == nil {
+		return nil
+	}
+	// The group goes first, since changing it takes the privileges that changing the user drops.
+	if err := syscall.Setgroups([]int{c.gid}); err != nil {
+		return fmt.Errorf("Failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(c.gid); err != nil {
+		return fmt.Errorf("Failed to set group ID %d: %w", c.gid, err)
+	}
+	if c.setUID {
+		if err := syscall.Setuid(c.uid); err != nil {
+			return fmt.Errorf("Failed to set user ID %d: %w", c.uid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// keyPair returns a self-signed certificate for localhost and its key, PEM encoded.
+func keyPair(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestServeDoHLoadsKeyBeforeDroppingPrivileges(t *testing.T) {
+	certPEM, keyPEM := keyPair(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certFile, certPEM, 0o600))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	dohAddr := l.Addr().String()
+	require.Nil(t, l.Close())
+
+	// The key is a FIFO, so that it is only read once it is written to. Serve must not be ready,
+	// which is when privileges are dropped, while the DoH listener is still reading it.
+	require.Nil(t, syscall.Mkfifo(keyFile, 0o600))
+	ready := make(chan struct{})
+	loadedFirst := make(chan bool, 1)
+	go func() {
+		w, err := os.OpenFile(keyFile, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer w.Close()
+		select {
+		case <-ready:
+			loadedFirst <- false
+		case <-time.After(100 * time.Millisecond):
+			loadedFirst <- true
+		}
+		w.Write(keyPEM)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, flag.NewFlagSet("serve", flag.ContinueOnError), []string{
+			"-listen", "127.0.0.1:0/udp",
+			"-dohAddr", dohAddr,
+			"-tlsCert", certFile,
+			"-tlsKey", keyFile,
+			"-drainTimeout", "0",
+			"-logLevel", "error",
+			"tunnel.example.com",
+		}, serveHooks{ready: func() { close(ready) }})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't become ready")
+	}
+	require.True(t, <-loadedFirst, "serve was ready before the DoH key was loaded")
+	conn, err := tls.Dial("tcp", dohAddr, &tls.Config{InsecureSkipVerify: true})
+	require.Nil(t, err)
+	require.Nil(t, conn.Close())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// swapSink is a sink.Sink delivering to a fanout that can be replaced while messages are
+// flowing, so that sinks can be reconfigured without restarting.
+type swapSink struct {
+	mu     sync.RWMutex
+	fanout *sink.Fanout
+}
+
+func (s *swapSink) Deliver(ctx context.Context, msg tunnel.Message) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fanout.Deliver(ctx, msg)
+}
+
+// swap replaces the fanout, then closes the old one once its queued messages are delivered.
+func (s *swapSink) swap(fanout *sink.Fanout) error {
+	s.mu.Lock()
+	old := s.fanout
+	s.fanout = fanout
+	s.mu.Unlock()
+	return old.Close()
+}
+
+func (s *swapSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fanout.Close()
+}
+
+func (s *swapSink) Collect() []metrics.Metric {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fanout.Collect()
+}
+
+func (s *swapSink) Down() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fanout.Down()
+}
+
+func (s *swapSink) Probe(ctx context.Context, msg tunnel.Message) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fanout.Probe(ctx, msg)
+}
+
+func (s *swapSink) Replay(ctx context.Context, name string, msg tunnel.Message) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fanout.Replay(ctx, name, msg)
+}
+
+func (s *swapSink) Failing() map[string]error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fanout.Failing()
+}
+
+func (s *swapSink) Status() []sink.SinkStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fanout.Status()
+}
+
+// keepOpen hides the Close method of a sink that outlives the fanouts it is part of, such as a
+// sink tied to a listener.
+type keepOpen struct {
+	sink.Sink
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/store"
+)
+
+// retryFlags holds the flags configuring how failed deliveries to the sinks are retried, along
+// with the files they open, which are kept across reloads.
+type retryFlags struct {
+	retries        *int
+	backoff        *int
+	maxBackoff     *int
+	retryFile      *string
+	deadLetterFile *string
+
+	queues     *store.Bolt
+	ownQueues  bool
+	deadLetter *sink.File
+}
+
+func registerRetryFlags(fs *flag.FlagSet) *retryFlags {
+	return &retryFlags{
+		retries:        fs.Int("sinkRetries", 0, "times a failed delivery to a sink is retried before the message is dead-lettered (disabled if 0)"),
+		backoff:        fs.Int("sinkRetryBackoff", int(sink.DefaultRetryBackoff/time.Second), "seconds before the first retry of a failed delivery, doubling after every attempt"),
+		maxBackoff:     fs.Int("sinkRetryMaxBackoff", int(sink.DefaultRetryMaxBackoff/time.Second), "maximum seconds in between retries of a failed delivery"),
+		retryFile:      fs.String("retryFile", "", "path of a database to keep messages waiting to be retried in across restarts; may be the stateFile (in memory if empty)"),
+		deadLetterFile: fs.String("deadLetterFile", "", "path of a file to append messages to as lines of JSON once their retries are exhausted (only logged if empty)"),
+	}
+}
+
+// open opens the files named by the flags. The state file, if already open as state, is reused
+// as the retry file.
+func (f *retryFlags) open(stateFile string, state *store.Bolt) error {
+	if *f.retries <= 0 {
+		return nil
+	}
+	var err error
+	switch {
+	case *f.retryFile == "":
+	case *f.retryFile == stateFile:
+		f.queues = state
+	default:
+		if f.queues, err = store.OpenBolt(*f.retryFile); err != nil {
+			return err
+		}
+		f.ownQueues = true
+	}
+	if *f.deadLetterFile != "" {
+		if f.deadLetter, err = sink.NewFile(sink.FileConfig{Path: *f.deadLetterFile}); err != nil {
+			f.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// apply sets the retry policy of sinks, each of which gets its own queue in the retry file.
+func (f *retryFlags) apply(sinks []sink.Named) ([]sink.Named, error) {
+	if *f.retries <= 0 {
+		return sinks, nil
+	}
+	for i := range sinks {
+		policy := sink.RetryPolicy{
+			Attempts:   *f.retries + 1,
+			Backoff:    time.Duration(*f.backoff) * time.Second,
+			MaxBackoff: time.Duration(*f.maxBackoff) * time.Second,
+		}
+		if f.queues != nil {
+			queue, err := f.queues.Queue(sinks[i].Name)
+			if err != nil {
+				return nil, err
+			}
+			policy.Queue = queue
+		}
+		if f.deadLetter != nil {
+			policy.DeadLetter = f.deadLetter
+		}
+		sinks[i].Retry = policy
+	}
+	return sinks, nil
+}
+
+// close closes the files opened by open, once the sinks are closed.
+func (f *retryFlags) close() {
+	if f.ownQueues {
+		if err := f.queues.Close(); err != nil {
+			slog.Warn("Failed to close retry file", "error", err)
+		}
+	}
+	if f.deadLetter != nil {
+		if err := f.deadLetter.Close(); err != nil {
+			slog.Warn("Failed to close dead-letter file", "error", err)
+		}
+	}
+}
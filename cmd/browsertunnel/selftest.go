@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/client"
+	"github.com/veggiedefender/browsertunnel/pkg/rpc"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// selftestDomain is the top domain of the tunnel served by selftest, which is reserved for tests.
+const selftestDomain = "selftest.browsertunnel.test."
+
+// targetFlags holds the flags choosing the tunnel that selftest and bench send messages through,
+// and how they are encoded.
+type targetFlags struct {
+	domain       *string
+	server       *string
+	grpc         *string
+	qtype        *string
+	network      *string
+	version      *int
+	encoding     *string
+	ack          *bool
+	compress     *bool
+	encrypt      *bool
+	authenticate *bool
+	hmacKey      *string
+	encryptKey   *string
+}
+
+func registerTargetFlags(fs *flag.FlagSet) *targetFlags {
+	return &targetFlags{
+		domain:       fs.String("domain", "", "top domain of a deployed tunnel to test, preceded by the tenant if tenants are configured (serves one on the loopback address if empty)"),
+		server:       fs.String("server", "", "DNS server of the -domain tunnel to send queries to, e.g. 192.0.2.1:53 (defaults to the system resolver)"),
+		grpc:         fs.String("grpc", "", "address of the gRPC Tunnel service of the -domain tunnel, to receive the reassembled messages from, e.g. 192.0.2.1:9090"),
+		qtype:        fs.String("qtype", "TXT", "type of the queries, e.g. A or TXT"),
+		network:      fs.String("net", "udp", "network to serve the tunnel on, or to reach -server with: udp or tcp"),
+		version:      fs.Int("version", tunnel.Version1, "framing of the fragments: 1 or 2"),
+		encoding:     fs.String("encoding", "", "encoding of the data labels: base32, base32hex, base64url or hex (defaults to base32)"),
+		ack:          fs.Bool("ack", false, "request acknowledgements of each fragment (requires -version 2)"),
+		compress:     fs.Bool("compress", false, "gzip the messages"),
+		encrypt:      fs.Bool("encrypt", false, "encrypt the messages with a random key (not with -domain)"),
+		authenticate: fs.Bool("authenticate", false, "authenticate the messages with a random key (not with -domain)"),
+		hmacKey:      fs.String("hmacKey", "", "pre-shared key of the -domain tunnel to authenticate the messages with (disabled if empty)"),
+		encryptKey:   fs.String("encryptKey", "", "hex encoded AES key of the -domain tunnel to encrypt the messages with (disabled if empty)"),
+	}
+}
+
+// selftestFlags holds the flags of the selftest subcommand.
+type selftestFlags struct {
+	*targetFlags
+	count   *int
+	size    *int
+	timeout *int
+}
+
+func registerSelftestFlags(fs *flag.FlagSet) *selftestFlags {
+	return &selftestFlags{
+		targetFlags: registerTargetFlags(fs),
+		count:       fs.Int("count", 3, "number of messages to send"),
+		size:        fs.Int("size", 1000, "size of each message in bytes"),
+		timeout:     fs.Int("timeout", 10, "seconds that the messages may take to be reassembled"),
+	}
+}
+
+// serveLoopback serves tun over network on a random port of the loopback address, and returns the
+// address and a function stopping the server.
+func serveLoopback(tun *tunnel.Tunnel, network string) (string, func() error, error) {
+	srv := &dns.Server{Handler: tun}
+	var addr string
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return "", nil, err
+		}
+		srv.PacketConn, addr = pc, pc.LocalAddr().String()
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", nil, err
+		}
+		srv.Listener, addr = l, l.Addr().String()
+	default:
+		return "", nil, fmt.Errorf("Invalid network %q, expected udp or tcp", network)
+	}
+	go srv.ActivateAndServe()
+	return addr, srv.Shutdown, nil
+}
+
+// randomKey returns a random AES-256 key, or HMAC key.
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		fatal("Failed to generate a key", "error", err)
+	}
+	return key
+}
+
+// randomText returns size random lower case letters.
+func randomText(size int) []byte {
+	text := make([]byte, size)
+	if _, err := rand.Read(text); err != nil {
+		fatal("Failed to generate a message", "error", err)
+	}
+	for i := range text {
+		text[i] = 'a' + text[i]%26
+	}
+	return text
+}
+
+// A selftestMessage is a message reassembled by the tunnel under test.
+type selftestMessage struct {
+	id        string
+	payload   []byte
+	fragments int
+	// received is when the message was received from the tunnel.
+	received time.Time
+}
+
+// A subscribeFunc returns the messages reassembled by the tunnel under test whose ID starts with
+// prefix, until ctx is done. The returned channel is closed if the subscription fails.
+type subscribeFunc func(ctx context.Context, prefix string) (<-chan selftestMessage, error)
+
+// subscribeLoopback returns the subscribeFunc of tun, which must have a single subscriber.
+func subscribeLoopback(tun *tunnel.Tunnel) subscribeFunc {
+	return func(ctx context.Context, prefix string) (<-chan selftestMessage, error) {
+		msgs := make(chan selftestMessage)
+		go func() {
+			for {
+				select {
+				case msg := <-tun.Messages():
+					if !strings.HasPrefix(msg.ID, prefix) {
+						continue
+					}
+					select {
+					case msgs <- selftestMessage{id: msg.ID, payload: msg.Payload, fragments: msg.Fragments, received: time.Now()}:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return msgs, nil
+	}
+}
+
+// subscribeRemote returns the subscribeFunc of the gRPC Tunnel service of a deployed server.
+func subscribeRemote(tc rpc.TunnelClient) subscribeFunc {
+	return func(ctx context.Context, prefix string) (<-chan selftestMessage, error) {
+		stream, err := tc.Subscribe(ctx, &rpc.SubscribeRequest{IdPrefix: prefix})
+		if err != nil {
+			return nil, err
+		}
+		// The server sends the headers once the subscription is registered, so that no message
+		// sent after Header returns is missed.
+		if _, err := stream.Header(); err != nil {
+			return nil, err
+		}
+		msgs := make(chan selftestMessage)
+		go func() {
+			defer close(msgs)
+			for {
+				msg, err := stream.Recv()
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.Error("Subscription to -grpc failed", "error", err)
+					}
+					return
+				}
+				select {
+				case msgs <- selftestMessage{id: msg.Id, payload: msg.Payload, fragments: int(msg.Fragments), received: time.Now()}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return msgs, nil
+	}
+}
+
+// target sets up the tunnel that the messages are sent through: the -domain tunnel of a deployed
+// server, or one served on the loopback address that accepts messages of up to maxSize bytes. It
+// returns a client sending to it, the subscribeFunc of the tunnel and a function releasing it.
+func (f *targetFlags) target(maxSize int) (*client.Client, subscribeFunc, func()) {
+	qtype, ok := dns.StringToType[strings.ToUpper(*f.qtype)]
+	if !ok {
+		fatal("Invalid -qtype", "qtype", *f.qtype)
+	}
+	enc := tunnel.Encoder{LabelLen: 63, Version: *f.version, Ack: *f.ack, Encoding: tunnel.Encoding(*f.encoding), Compress: *f.compress}
+	c := &client.Client{Domain: *f.domain, Server: *f.server, Net: *f.network, QueryType: qtype}
+	if *f.domain == "" {
+		if *f.server != "" || *f.grpc != "" || *f.hmacKey != "" || *f.encryptKey != "" {
+			fatal("-server, -grpc, -hmacKey and -encryptKey require the -domain of a deployed tunnel")
+		}
+		// Hex, the widest encoding, doubles the size of a message.
+		cfg := tunnel.Config{TopDomain: selftestDomain, MaxMessageSize: max(tunnel.DefaultMaxMessageSize, 2*maxSize+1024)}
+		if *f.encoding != "" {
+			cfg.Encodings = map[string]tunnel.Encoding{selftestDomain: enc.Encoding}
+		}
+		if *f.encrypt {
+			cfg.DecryptKey = randomKey()
+			enc.EncryptKey = cfg.DecryptKey
+		}
+		if *f.authenticate {
+			cfg.HMACKey = randomKey()
+			enc.HMACKey = cfg.HMACKey
+		}
+		tun, err := tunnel.New(cfg)
+		if err != nil {
+			fatal("Failed to create tunnel", "error", err)
+		}
+		addr, shutdown, err := serveLoopback(tun, *f.network)
+		if err != nil {
+			fatal("Failed to serve tunnel", "error", err)
+		}
+		c.Domain, c.Server, c.Encoder = selftestDomain, addr, enc
+		return c, subscribeLoopback(tun), func() {
+			shutdown()
+			tun.Close()
+		}
+	}
+
+	if *f.grpc == "" {
+		fatal("A -grpc address is required to check the messages reassembled by a deployed tunnel")
+	}
+	if *f.encrypt || *f.authenticate {
+		fatal("-encrypt and -authenticate use random keys, which a deployed tunnel doesn't know; use -encryptKey and -hmacKey")
+	}
+	if *f.hmacKey != "" {
+		enc.HMACKey = []byte(*f.hmacKey)
+	}
+	if *f.encryptKey != "" {
+		key, err := hex.DecodeString(*f.encryptKey)
+		if err != nil {
+			fatal("Invalid -encryptKey", "error", err)
+		}
+		enc.EncryptKey = key
+	}
+	conn, err := grpc.Dial(*f.grpc, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		fatal("Failed to connect to -grpc", "error", err)
+	}
+	c.Encoder = enc
+	return c, subscribeRemote(rpc.NewTunnelClient(conn)), func() { conn.Close() }
+}
+
+// runSelftest implements the selftest subcommand, which sends messages with the client through a
+// tunnel, checks that each is reassembled as it was sent, and exits with an error otherwise. The
+// tunnel is served on the loopback address, unless -domain names the tunnel of a deployed server,
+// whose reassembled messages are then received from its gRPC Tunnel service.
+func runSelftest(fs *flag.FlagSet, args []string) {
+	f := registerSelftestFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fatal("Unexpected arguments", "args", fs.Args())
+	}
+	c, subscribe, release := f.target(*f.size)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*f.timeout)*time.Second)
+	defer cancel()
+	// The IDs of the messages start with a random prefix, so that only the messages of this run
+	// are received.
+	run, err := client.NewID()
+	if err != nil {
+		fatal("Failed to generate a message ID", "error", err)
+	}
+	msgs, err := subscribe(ctx, run)
+	if err != nil {
+		fatal("Failed to subscribe to the messages", "error", err)
+	}
+	start := time.Now()
+	fragments := 0
+	for i := 0; i < *f.count; i++ {
+		payload := randomText(*f.size)
+		id := fmt.Sprint(run, i)
+		if err := c.SendID(ctx, id, payload); err != nil {
+			fatal("Failed to send message", "id", id, "error", err)
+		}
+		var msg selftestMessage
+		select {
+		case msg = <-msgs:
+		case <-ctx.Done():
+		}
+		if msg.id == "" {
+			fatal("Message wasn't reassembled", "id", id)
+		}
+		if msg.id != id || !bytes.Equal(msg.payload, payload) {
+			fatal("Message was reassembled incorrectly", "id", id, "got", msg.id, "size", len(msg.payload))
+		}
+		fragments += msg.fragments
+	}
+	fmt.Printf("Reassembled %d messages of %d bytes from %d fragments in %s\n", *f.count, *f.size, fragments, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/client"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// sendFlags holds the flags of the send subcommand.
+type sendFlags struct {
+	domain       *string
+	server       *string
+	network      *string
+	id           *string
+	qtype        *string
+	delay        *int
+	timeout      *int
+	retries      *int
+	labelLen     *int
+	version      *int
+	ack          *bool
+	session      *string
+	sequence     *int
+	encoding     *string
+	checksum     *bool
+	compress     *bool
+	binary       *bool
+	hmacKey      *string
+	authToken    *string
+	authTokenKey *string
+	encryptKey   *string
+	keyID        *string
+	signKey      *string
+	expiration   *int
+	parity       *int
+	statusDelay  *int
+}
+
+func registerSendFlags(fs *flag.FlagSet) *sendFlags {
+	return &sendFlags{
+		domain:       fs.String("domain", "", "top domain of the tunnel, preceded by the tenant if tenants are configured"),
+		server:       fs.String("server", "", "DNS server to send queries to, e.g. 127.0.0.1:53 (defaults to the system resolver)"),
+		network:      fs.String("net", "udp", "network used to reach server: udp or tcp"),
+		id:           fs.String("id", "", "message ID (random if empty)"),
+		qtype:        fs.String("qtype", "TXT", "type of the queries, e.g. A or TXT"),
+		delay:        fs.Int("delay", 0, "milliseconds to wait between queries"),
+		timeout:      fs.Int("timeout", int(client.DefaultTimeout/time.Millisecond), "milliseconds to wait for each answer"),
+		retries:      fs.Int("retries", client.DefaultRetries, "times a failed query, or the fragments acknowledged as missing, are sent again"),
+		labelLen:     fs.Int("labelLen", 63, "maximum length of each label of payload"),
+		version:      fs.Int("version", tunnel.Version1, "framing of the fragments: 1, or 2 to declare the encoding in flags"),
+		ack:          fs.Bool("ack", false, "request acknowledgements of each fragment, and resend missing fragments (requires -version 2 and -server)"),
+		session:      fs.String("session", "", "label of the session the message is sent in (requires -version 2)"),
+		sequence:     fs.Int("sequence", 0, "number of the message within its session, for tunnels with ordered delivery (requires -session)"),
+		encoding:     fs.String("encoding", "", "encoding of the data labels: base32, base32hex, base64url or hex (named in each fragment with -version 2; defaults to base32)"),
+		checksum:     fs.Bool("checksum", false, "add a CRC32 label to each fragment"),
+		compress:     fs.Bool("compress", false, "gzip the message"),
+		binary:       fs.Bool("binary", false, "mark the message as binary data"),
+		hmacKey:      fs.String("hmacKey", "", "pre-shared key to authenticate the message with (disabled if empty)"),
+		authToken:    fs.String("authToken", "", "auth token to carry in every fragment (requires -version 2)"),
+		authTokenKey: fs.String("authTokenKey", "", "key to derive the auth token of every fragment from the message ID with (requires -version 2)"),
+		encryptKey:   fs.String("encryptKey", "", "hex encoded AES key to encrypt the message with (disabled if empty)"),
+		keyID:        fs.String("keyID", "", "ID of -encryptKey among the -keyFile keys of the server, sent with every fragment (requires -version 2)"),
+		signKey:      fs.String("signKey", "", "hex encoded Ed25519 private key, or seed, to sign the message with, as printed by keygen (disabled if empty)"),
+		statusDelay:  fs.Int("statusDelay", 0, "milliseconds to wait after sending unacknowledged fragments before asking the server which are missing, and sending them again (requires -server; disabled if 0)"),
+		expiration:   fs.Int("expiration", 0, "seconds the server is asked to keep the incomplete message for, instead of its -expiration, e.g. for long uploads (requires -version 2)"),
+		parity:       fs.Int("parity", 0, "send a parity fragment after every this many fragments, from which the server rebuilds one of them that is lost (requires -version 2; disabled if 0)"),
+	}
+}
+
+// runSend implements the send subcommand, which sends the contents of a file, or of stdin, through
+// a tunnel and prints the message ID.
+func runSend(fs *flag.FlagSet, args []string) {
+	f := registerSendFlags(fs)
+	fs.Parse(args)
+
+	if *f.domain == "" {
+		fatal("A -domain is required")
+	}
+	if fs.NArg() > 1 {
+		fatal("Expected at most one file", "args", fs.Args())
+	}
+	t, ok := dns.StringToType[strings.ToUpper(*f.qtype)]
+	if !ok {
+		fatal("Invalid -qtype", "qtype", *f.qtype)
+	}
+	if *f.statusDelay > 0 && *f.server == "" {
+		fatal("-statusDelay requires a -server")
+	}
+	if *f.retries == 0 {
+		*f.retries = -1
+	}
+	c := &client.Client{
+		Domain:      *f.domain,
+		Server:      *f.server,
+		Net:         *f.network,
+		QueryType:   t,
+		Delay:       time.Duration(*f.delay) * time.Millisecond,
+		Timeout:     time.Duration(*f.timeout) * time.Millisecond,
+		Retries:     *f.retries,
+		StatusDelay: time.Duration(*f.statusDelay) * time.Millisecond,
+		Encoder: tunnel.Encoder{
+			LabelLen:   *f.labelLen,
+			Version:    *f.version,
+			Ack:        *f.ack,
+			Session:    *f.session,
+			Sequence:   *f.sequence,
+			Encoding:   tunnel.Encoding(*f.encoding),
+			Checksum:   *f.checksum,
+			Compress:   *f.compress,
+			Binary:     *f.binary,
+			Expiration: time.Duration(*f.expiration) * time.Second,
+			Parity:     *f.parity,
+		},
+	}
+	if *f.hmacKey != "" {
+		c.Encoder.HMACKey = []byte(*f.hmacKey)
+	}
+	c.Encoder.AuthToken = *f.authToken
+	if *f.authTokenKey != "" {
+		c.Encoder.AuthTokenKey = []byte(*f.authTokenKey)
+	}
+	if *f.encryptKey != "" {
+		key, err := hex.DecodeString(*f.encryptKey)
+		if err != nil {
+			fatal("Invalid -encryptKey", "error", err)
+		}
+		c.Encoder.EncryptKey = key
+	}
+	c.Encoder.KeyID = *f.keyID
+	if *f.signKey != "" {
+		key, err := tunnel.ParsePrivateKey(*f.signKey)
+		if err != nil {
+			fatal("Invalid -signKey", "error", err)
+		}
+		c.Encoder.SigningKey = key
+	}
+
+	in := io.Reader(os.Stdin)
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fatal("Failed to open message", "error", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	msg, err := io.ReadAll(in)
+	if err != nil {
+		fatal("Failed to read message", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *f.id == "" {
+		if *f.id, err = client.NewID(); err != nil {
+			fatal("Failed to generate a message ID", "error", err)
+		}
+	}
+	if err := c.SendID(ctx, *f.id, msg); err != nil {
+		fatal("Failed to send message", "id", *f.id, "error", err)
+	}
+	fmt.Println(*f.id)
+}
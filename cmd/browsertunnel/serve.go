@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/store"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// serveFlags holds the flags of the serve subcommand.
+type serveFlags struct {
+	port               *int
+	listens            stringsFlag
+	captures           stringsFlag
+	capturePort        *int
+	capturePromisc     *bool
+	domains            stringsFlag
+	tenants            stringsFlag
+	domainExpirations  stringsFlag
+	tenantExpirations  stringsFlag
+	encodings          stringsFlag
+	expiration         *int
+	maxExpiration      *int
+	deletionInterval   *int
+	sessionTimeout     *int
+	sessionHeartbeat   *int
+	orderedDelivery    *bool
+	reorderTimeout     *int
+	maxStreams         *int
+	streamTimeout      *int
+	nackDelay          *int
+	streamForward      *string
+	response           *string
+	ttl                *int
+	typeTTLs           stringsFlag
+	negativeTTL        *int
+	nameservers        stringsFlag
+	upstreams          stringsFlag
+	hostmaster         *string
+	upstreamTimeout    *int
+	serial             *uint
+	acks               *bool
+	drainTimeout       *int
+	workers            *int
+	dedupWindow        *int
+	fanoutWindow       *int
+	maxMessageSize     *int
+	strict             *bool
+	maxDataLabels      *int
+	maxPartialMessages *int
+	maxBufferedBytes   *int
+	maxFragmentBytes   *int
+	chunkThreshold     *int
+	chunkDir           *string
+	progress           *bool
+	rateLimit          *float64
+	rateBurst          *int
+	allowCIDRs         stringsFlag
+	denyCIDRs          stringsFlag
+	hmacKey            *string
+	authTokens         stringsFlag
+	authTokenKey       *string
+	apiKeys            stringsFlag
+	certTenants        stringsFlag
+	clientCA           *string
+	decryptKey         *string
+	keys               *keyFlags
+	keyRefresh         *int
+	signingKeys        stringsFlag
+	requireSignatures  *bool
+	stateFile          *string
+	stateRedisAddr     *string
+	stateRedisUser     *string
+	stateRedisPassword *string
+	stateRedisPrefix   *string
+	backpressure       *string
+	spillFile          *string
+	spoolDir           *string
+	spoolMaxBytes      *int64
+	spoolProbeInterval *int
+	messageDB          *string
+	messageRetention   *int
+	strayQueryFile     *string
+	queryLog           *string
+	queryLogMaxSize    *int64
+	queryLogMaxAge     *int
+	queryLogCompress   *bool
+	queryLogHashKey    *string
+	alertWindow        *int
+	alertNewIDs        *int
+	alertClientQueries *int
+	alertEntropy       *float64
+	alertFile          *string
+	alertWebhook       *string
+	apiAddr            *string
+	apiToken           *string
+	adminAddr          *string
+	adminToken         *string
+	dashboardAddr      *string
+	dashboardToken     *string
+	pprofEnabled       *bool
+	pprofAddr          *string
+	metricsAddr        *string
+	dohAddr            *string
+	dotAddr            *string
+	dotALPN            *string
+	doqAddr            *string
+	dnstapAddr         *string
+	tlsCert            *string
+	tlsKey             *string
+	streamAddr         *string
+	streamSocket       *string
+	grpcAddr           *string
+	jsAddr             *string
+	healthAddr         *string
+	otlpEndpoint       *string
+	sinks              *sinkFlags
+	retry              *retryFlags
+	wasmHook           *string
+	luaHook            *string
+	hookTimeout        *int
+	geoipDBs           stringsFlag
+	logLevel           *string
+	logFormat          *string
+	output             *string
+	instancePaths      stringsFlag
+	configFile         *string
+	user               *string
+	group              *string
+	chroot             *string
+}
+
+func registerServeFlags(fs *flag.FlagSet) *serveFlags {
+	f := &serveFlags{
+		port:               fs.Int("port", 53, "port to serve DNS on, over both UDP and TCP, if no -listen address, -capture interface or -dnstapAddr is given"),
+		capturePort:        fs.Int("capturePort", 53, "port that the DNS queries observed with -capture are sent to"),
+		capturePromisc:     fs.Bool("capturePromiscuous", false, "put the -capture interfaces in promiscuous mode, to observe the traffic of other hosts, e.g. on a mirror port"),
+		expiration:         fs.Int("expiration", 60, "seconds an incomplete message is retained before it is deleted"),
+		maxExpiration:      fs.Int("maxExpiration", 0, "maximum seconds that clients may ask for their incomplete messages to be retained, e.g. for long uploads (defaults to 10 times -expiration)"),
+		deletionInterval:   fs.Int("deletionInterval", 5, "seconds in between checks for expired messages"),
+		sessionTimeout:     fs.Int("sessionTimeout", int(tunnel.DefaultSessionTimeout/time.Second), "seconds a client session may go without sending a message before it ends"),
+		sessionHeartbeat:   fs.Int("sessionHeartbeat", int(tunnel.DefaultSessionHeartbeat/time.Second), "seconds in between heartbeats of active client sessions"),
+		orderedDelivery:    fs.Bool("orderedDelivery", false, "deliver the messages of each session in the order of their sequence numbers"),
+		reorderTimeout:     fs.Int("reorderTimeout", 0, "seconds a message is held back for the messages sent before it with -orderedDelivery (defaults to -expiration)"),
+		maxStreams:         fs.Int("maxStreams", 0, "maximum number of byte streams opened by clients held at once, each forwarded to streamForward (disabled if 0)"),
+		streamTimeout:      fs.Int("streamTimeout", int(tunnel.DefaultStreamTimeout/time.Second), "seconds a stream may go without a query before it is closed"),
+		streamForward:      fs.String("streamForward", "", "TCP address that the streams opened by clients are connected to, e.g. localhost:22"),
+		response:           fs.String("response", "cname", "how to answer queries: cname[:target], a:address[,address...], nxdomain, nodata or stealth[:minTTL-maxTTL]"),
+		ttl:                fs.Int("ttl", 0, "TTL of answers in seconds"),
+		negativeTTL:        fs.Int("negativeTTL", 0, "TTL and minimum of the SOA record of negative answers in seconds, telling resolvers how long to cache them (defaults to the TTL of the query type; not with -response stealth)"),
+		hostmaster:         fs.String("hostmaster", "", "mailbox in the SOA record of the top domains, as a domain (defaults to hostmaster.<topDomain>)"),
+		upstreamTimeout:    fs.Int("upstreamTimeout", 2, "seconds an upstream resolver is given to answer a forwarded query"),
+		serial:             fs.Uint("serial", 1, "serial number in the SOA record of the top domains"),
+		acks:               fs.Bool("acks", false, "answer A and TXT fragment queries with an acknowledgement of what has been received"),
+		nackDelay:          fs.Int("nackDelay", int(tunnel.DefaultNackDelay/time.Second), "seconds a partial message must go without a fragment before status queries list the ranges missing from it"),
+		drainTimeout:       fs.Int("drainTimeout", 10, "seconds to wait for partial messages to complete when shutting down on SIGTERM"),
+		workers:            fs.Int("workers", 0, "goroutines reassembling messages (defaults to the number of CPUs)"),
+		dedupWindow:        fs.Int("dedupWindow", 0, "seconds after a message is delivered during which fragments with its ID are ignored (disabled if 0)"),
+		fanoutWindow:       fs.Int("fanoutWindow", 0, "seconds during which a fragment query repeated by other resolvers is counted once (defaults to 5, disabled if negative)"),
+		maxMessageSize:     fs.Int("maxMessageSize", 5000, "maximum encoded size (in bytes) of a message"),
+		strict:             fs.Bool("strict", false, "reject fragments with data outside the alphabet of their encoding or non-canonical sizes and offsets"),
+		maxDataLabels:      fs.Int("maxDataLabels", 0, "maximum number of data labels in a fragment (disabled if 0)"),
+		maxPartialMessages: fs.Int("maxPartialMessages", 0, "maximum number of partial messages held, evicting the least recently updated (disabled if 0)"),
+		maxBufferedBytes:   fs.Int("maxBufferedBytes", 0, "maximum bytes of encoded data held across all partial messages, evicting the least recently updated (disabled if 0)"),
+		maxFragmentBytes:   fs.Int("maxFragmentBytes", 0, "maximum bytes of encoded data held for a single partial message (defaults to twice maxMessageSize)"),
+		chunkThreshold:     fs.Int("chunkThreshold", 0, "encoded size above which messages are written to chunkDir as they arrive, instead of being held until they are complete (disabled if 0)"),
+		chunkDir:           fs.String("chunkDir", "", "directory to write the messages above chunkThreshold to, as <tenant>/<id>.part until they are complete"),
+		progress:           fs.Bool("progress", false, "report the bytes received of each partial message after every fragment, at /progress on the admin API if adminAddr is set, and in debug logs otherwise"),
+		rateLimit:          fs.Float64("rateLimit", 0, "queries per second accepted from a single source IP (disabled if 0)"),
+		rateBurst:          fs.Int("rateBurst", 0, "queries a single source IP may burst above rateLimit (defaults to rateLimit)"),
+		hmacKey:            fs.String("hmacKey", "", "pre-shared key that messages must be authenticated with (disabled if empty)"),
+		authTokenKey:       fs.String("authTokenKey", "", "key that the auth tokens of fragments may be derived from the message ID with (disabled if empty)"),
+		decryptKey:         fs.String("decryptKey", "", "hex encoded AES key that messages are encrypted with (disabled if empty)"),
+		keys:               registerKeyFlags(fs),
+		keyRefresh:         fs.Int("keyRefresh", 0, "seconds between reloads of -keyFile or -keyCommand, which are also reloaded on SIGHUP (disabled if 0)"),
+		requireSignatures:  fs.Bool("requireSignatures", false, "drop messages that aren't signed by one of the -signingKey keys"),
+		stateFile:          fs.String("stateFile", "", "path of a database to persist partial messages in across restarts (disabled if empty)"),
+		stateRedisAddr:     fs.String("stateRedisAddr", "", "Redis server to share partial messages through with the other servers of a cluster, e.g. localhost:6379, instead of the stateFile (disabled if empty)"),
+		stateRedisUser:     fs.String("stateRedisUser", "", "username to AUTH with stateRedisAddr"),
+		stateRedisPassword: fs.String("stateRedisPassword", "", "password to AUTH with stateRedisAddr (AUTH is disabled if empty)"),
+		stateRedisPrefix:   fs.String("stateRedisPrefix", store.DefaultRedisPrefix, "prefix of the keys of partial messages in stateRedisAddr"),
+		backpressure:       fs.String("backpressure", "block", "what to do with messages when sinks fall behind: block, drop-newest, drop-oldest or spill"),
+		spillFile:          fs.String("spillFile", "", "path of a database to spill messages to with -backpressure spill; may be the stateFile"),
+		spoolDir:           fs.String("spoolDir", "", "directory to spool messages to while every sink is down, and replay them from once one recovers (disabled if empty)"),
+		spoolMaxBytes:      fs.Int64("spoolMaxBytes", 1<<30, "bytes of disk that spooled messages may take up (unbounded if 0)"),
+		spoolProbeInterval: fs.Int("spoolProbeInterval", int(sink.DefaultProbeInterval/time.Second), "seconds in between checks of whether the sinks recovered while messages are spooled"),
+		messageDB:          fs.String("messageDB", "", "path of a SQLite database to store every message in (disabled if empty)"),
+		messageRetention:   fs.Int("messageRetention", 0, "seconds after which messages are deleted from messageDB (kept forever if 0)"),
+		strayQueryFile:     fs.String("strayQueryFile", "", "path of a file to append queries that don't match the tunnel format to as lines of JSON, to keep track of scans and misconfigured clients (only logged at debug level if empty)"),
+		queryLog:           fs.String("queryLog", "", "path of a file to append every query served by the tunnels to as lines of JSON, with its source, type and disposition, as an audit log apart from the messages (disabled if empty)"),
+		queryLogMaxSize:    fs.Int64("queryLogMaxSize", 0, "bytes after which queryLog is rotated (disabled if 0)"),
+		queryLogMaxAge:     fs.Int("queryLogMaxAge", 0, "seconds after which queryLog is rotated (disabled if 0)"),
+		queryLogCompress:   fs.Bool("queryLogCompress", false, "gzip rotated query logs"),
+		queryLogHashKey:    fs.String("queryLogHashKey", "", "key to replace the names in queryLog with their HMAC-SHA256 under, so that it doesn't hold the data they carry (names are logged as asked if empty)"),
+		alertWindow:        fs.Int("alertWindow", int(tunnel.DefaultAnomalyWindow/time.Second), "seconds over which new message IDs and the queries of each client are counted for alerts"),
+		alertNewIDs:        fs.Int("alertNewIDs", 0, "new message IDs within alertWindow above which a burst is alerted on (disabled if 0)"),
+		alertClientQueries: fs.Int("alertClientQueries", 0, "queries from a single client within alertWindow above which a spike is alerted on (disabled if 0)"),
+		alertEntropy:       fs.Float64("alertEntropy", 0, "Shannon entropy in bits per character above which a label of a query outside of the tunnels is alerted on, e.g. 3.5 to spot other tunnels (disabled if 0)"),
+		alertFile:          fs.String("alertFile", "", "path of a file to append alerts to as lines of JSON (alerts are only logged if empty)"),
+		alertWebhook:       fs.String("alertWebhook", "", "URL to POST each alert to as JSON (alerts are only logged if empty)"),
+		apiAddr:            fs.String("apiAddr", "", "address to serve the HTTP API on, e.g. localhost:8081 (disabled if empty)"),
+		apiToken:           fs.String("apiToken", "", "bearer token that requests to the HTTP API must carry (required unless apiAddr is a loopback address)"),
+		adminAddr:          fs.String("adminAddr", "", "address to serve the admin API on, e.g. localhost:8082 (disabled if empty)"),
+		adminToken:         fs.String("adminToken", "", "bearer token that requests to the admin API must carry"),
+		dashboardAddr:      fs.String("dashboardAddr", "", "address to serve the web dashboard on, e.g. localhost:8083 (disabled if empty)"),
+		dashboardToken:     fs.String("dashboardToken", "", "bearer token that the dashboard must be opened with, as /#token=<token> (required unless dashboardAddr is a loopback address)"),
+		pprofEnabled:       fs.Bool("pprof", false, "serve net/http/pprof profiles on pprofAddr"),
+		pprofAddr:          fs.String("pprofAddr", "localhost:6060", "address to serve profiles on with -pprof"),
+		metricsAddr:        fs.String("metricsAddr", "", "address to serve Prometheus metrics on, e.g. localhost:9100 (disabled if empty)"),
+		dohAddr:            fs.String("dohAddr", "", "address to serve DNS-over-HTTPS on, e.g. :443 (disabled if empty)"),
+		dotAddr:            fs.String("dotAddr", "", "address to serve DNS-over-TLS on, e.g. :853, like -listen <address>/dot (disabled if empty)"),
+		dotALPN:            fs.String("dotALPN", "dot", "comma separated ALPN protocols to advertise on the DNS-over-TLS listener"),
+		doqAddr:            fs.String("doqAddr", "", "UDP address to serve DNS-over-QUIC on, e.g. :853, like -listen <address>/doq (disabled if empty)"),
+		dnstapAddr:         fs.String("dnstapAddr", "", "Unix socket path, or TCP address, to receive the queries logged by resolvers over dnstap on, without answering them (disabled if empty)"),
+		tlsCert:            fs.String("tlsCert", "", "path to a TLS certificate for the encrypted listeners"),
+		tlsKey:             fs.String("tlsKey", "", "path to the private key of tlsCert"),
+		clientCA:           fs.String("clientCA", "", "path to a PEM bundle of CA certificates that the encrypted listeners require client certificates to be issued by (disabled if empty)"),
+		streamAddr:         fs.String("streamAddr", "", "address to stream messages over WebSocket on at /messages, e.g. localhost:8080 (disabled if empty)"),
+		streamSocket:       fs.String("streamSocket", "", "path of a Unix socket to stream messages on as length-prefixed JSON frames (disabled if empty)"),
+		grpcAddr:           fs.String("grpcAddr", "", "address to serve the gRPC Tunnel service on, e.g. localhost:9090 (disabled if empty)"),
+		jsAddr:             fs.String("jsAddr", "", "address to serve the JavaScript client on at /browsertunnel.js, e.g. :8087 (disabled if empty)"),
+		healthAddr:         fs.String("healthAddr", "", "address to serve /healthz and /readyz probes on, e.g. :8086 (disabled if empty)"),
+		otlpEndpoint:       fs.String("otlpEndpoint", "", "URL of an OTLP/HTTP collector to export traces of queries, reassembly and deliveries to, e.g. http://localhost:4318 (disabled if empty)"),
+		sinks:              registerSinkFlags(fs),
+		retry:              registerRetryFlags(fs),
+		wasmHook:           fs.String("wasmHook", "", "path of a WebAssembly module to process each message with before it is delivered (disabled if empty)"),
+		luaHook:            fs.String("luaHook", "", "path of a Lua script whose on_message(msg) processes each message before it is delivered (disabled if empty)"),
+		hookTimeout:        fs.Int("hookTimeout", 1, "seconds the hook is given to process a message"),
+		user:               fs.String("user", "", "user name or ID to switch to once the DNS listeners have started, e.g. to bind port 53 as root (disabled if empty; Unix only)"),
+		group:              fs.String("group", "", "group name or ID to switch to along with -user (defaults to the primary group of -user; Unix only)"),
+		chroot:             fs.String("chroot", "", "directory to change the root directory to once the DNS listeners have started, before switching to -user (disabled if empty; Unix only)"),
+		logLevel:           fs.String("logLevel", "info", "minimum level of logs to output: debug, info, warn or error"),
+		logFormat:          fs.String("logFormat", "text", "format of logs: text or json"),
+		output:             fs.String("output", "log", "how to output messages besides delivering them to sinks: log, or ndjson to write them to stdout as lines of JSON and only log them at debug level"),
+		configFile:         fs.String("config", "", "path of a YAML file to read settings from; flags on the command line take precedence"),
+	}
+	fs.Var(&f.captures, "capture", "network interface to observe DNS queries on passively, without answering them, e.g. eth0 or any (repeatable; Linux only)")
+	fs.Var(&f.listens, "listen", "address to serve DNS on, as address[/protocol,...] with protocols udp, tcp, dot or doq, e.g. [::]:53/udp (repeatable; defaults to udp,tcp)")
+	fs.Var(&f.domains, "domain", "top domain to tunnel through, in addition to the arguments (repeatable)")
+	fs.Var(&f.encodings, "encoding", "encoding of the fragments sent through a top domain that don't name one, as domain=encoding with encodings base32, base32hex, base64url or hex (repeatable; defaults to base32)")
+	fs.Var(&f.tenants, "tenant", "tenant served under <tenant>.<topDomain>, as name[:maxInFlight[:rateLimit]] (repeatable)")
+	fs.Var(&f.domainExpirations, "domainExpiration", "seconds an incomplete message sent through a top domain is retained, and in between checks for its expiration, overriding -expiration and -deletionInterval, as domain=expiration[:deletionInterval] (repeatable)")
+	fs.Var(&f.tenantExpirations, "tenantExpiration", "seconds an incomplete message of a tenant is retained, and in between checks for its expiration, overriding -domainExpiration, as tenant=expiration[:deletionInterval] (repeatable)")
+	fs.Var(&f.nameservers, "nameserver", "authoritative nameserver of the top domains, as name[=address,...] with the addresses of names under a top domain (repeatable)")
+	fs.Var(&f.upstreams, "upstream", "resolver to forward queries outside the top domains to, e.g. 9.9.9.9 or [2620:fe::fe]:53, tried in order (repeatable; queries are refused if not given)")
+	fs.Var(&f.allowCIDRs, "allowCIDR", "only accept queries from this network, e.g. 192.0.2.0/24 (repeatable)")
+	fs.Var(&f.denyCIDRs, "denyCIDR", "refuse queries from this network (repeatable)")
+	fs.Var(&f.typeTTLs, "typeTTL", "TTL of the answers to queries of a type, overriding -ttl, as TYPE=SECONDS, e.g. AAAA=3600 (repeatable)")
+	fs.Var(&f.authTokens, "authToken", "auth token that fragments may carry to be accepted (repeatable; disabled unless set or with -authTokenKey)")
+	fs.Var(&f.signingKeys, "signingKey", "Ed25519 public key that messages may be signed with, as identity:hexPublicKey, reported as the signer of the messages it signed (repeatable)")
+	fs.Var(&f.apiKeys, "apiKey", "auth token with quotas of its own, as name:token[:tenant[:messagesPerHour[:bytesPerDay]]] (repeatable)")
+	fs.Var(&f.certTenants, "certTenant", "tenant that the TLS client certificates with an identity, their common name or a DNS or email SAN, may send to, as identity:tenant (repeatable)")
+	fs.Var(&f.geoipDBs, "geoipDB", "path of a MaxMind database, e.g. GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb, to tag messages with the location of their resolver and client subnet (repeatable)")
+	fs.Var(&f.instancePaths, "instance", "path of a YAML file configuring another tunnel served by the same listeners, with top domains, keys, expiration and sinks of its own (repeatable)")
+	return f
+}
+
+// settings returns the settings of the tunnels that are applied again when the configuration is
+// reloaded.
+func (f *serveFlags) settings() (tunnel.Settings, error) {
+	return tunnelSettings(*f.rateLimit, *f.rateBurst, f.allowCIDRs, f.denyCIDRs, *f.response, *f.ttl, f.typeTTLs, *f.negativeTTL)
+}
+
+// tunnelConfig returns the configuration of the main tunnel, serving topDomains, without the
+// stores, which are opened by serve.
+func (f *serveFlags) tunnelConfig(topDomains []string) (tunnel.Config, error) {
+	live, err := f.settings()
+	if err != nil {
+		return tunnel.Config{}, fmt.Errorf("Invalid settings: %w", err)
+	}
+	cfg := tunnel.Config{
+		TopDomains:         topDomains,
+		Expiration:         time.Duration(*f.expiration) * time.Second,
+		MaxExpiration:      time.Duration(*f.maxExpiration) * time.Second,
+		DeletionInterval:   time.Duration(*f.deletionInterval) * time.Second,
+		Workers:            *f.workers,
+		MaxMessageSize:     *f.maxMessageSize,
+		Strict:             *f.strict,
+		MaxDataLabels:      *f.maxDataLabels,
+		MaxPartialMessages: *f.maxPartialMessages,
+		MaxBufferedBytes:   *f.maxBufferedBytes,
+		MaxFragmentBytes:   *f.maxFragmentBytes,
+		ChunkThreshold:     *f.chunkThreshold,
+		Progress:           *f.progress,
+		DedupWindow:        time.Duration(*f.dedupWindow) * time.Second,
+		FanoutWindow:       time.Duration(*f.fanoutWindow) * time.Second,
+		SessionTimeout:     time.Duration(*f.sessionTimeout) * time.Second,
+		SessionHeartbeat:   time.Duration(*f.sessionHeartbeat) * time.Second,
+		OrderedDelivery:    *f.orderedDelivery,
+		ReorderTimeout:     time.Duration(*f.reorderTimeout) * time.Second,
+		MaxStreams:         *f.maxStreams,
+		StreamTimeout:      time.Duration(*f.streamTimeout) * time.Second,
+		Acks:               *f.acks,
+		NackDelay:          time.Duration(*f.nackDelay) * time.Second,
+		RateLimit:          live.RateLimit,
+		RateBurst:          live.RateBurst,
+		AllowCIDRs:         live.AllowCIDRs,
+		DenyCIDRs:          live.DenyCIDRs,
+		Response:           live.Response,
+		Anomalies: tunnel.AnomalyConfig{
+			Window:        time.Duration(*f.alertWindow) * time.Second,
+			NewMessageIDs: *f.alertNewIDs,
+			ClientQueries: *f.alertClientQueries,
+			Entropy:       *f.alertEntropy,
+		},
+	}
+	if cfg.Encodings, err = parseEncodings(f.encodings); err != nil {
+		return cfg, err
+	}
+	if cfg.Tenants, err = parseTenants(f.tenants); err != nil {
+		return cfg, err
+	}
+	if cfg.DomainExpirations, err = parseDomainExpirations(f.domainExpirations); err != nil {
+		return cfg, err
+	}
+	if err := setTenantExpirations(cfg.Tenants, f.tenantExpirations); err != nil {
+		return cfg, err
+	}
+	for _, s := range f.nameservers {
+		ns, err := tunnel.ParseNameserver(s)
+		if err != nil {
+			return cfg, fmt.Errorf("Invalid -nameserver: %w", err)
+		}
+		cfg.Authority.Nameservers = append(cfg.Authority.Nameservers, ns)
+	}
+	if *f.serial > math.MaxUint32 {
+		return cfg, fmt.Errorf("Invalid -serial %d", *f.serial)
+	}
+	cfg.Authority.Hostmaster = *f.hostmaster
+	cfg.Authority.Serial = uint32(*f.serial)
+	if *f.hmacKey != "" {
+		cfg.HMACKey = []byte(*f.hmacKey)
+	}
+	cfg.AuthTokens = f.authTokens
+	for _, s := range f.apiKeys {
+		k, err := tunnel.ParseAPIKey(s)
+		if err != nil {
+			return cfg, fmt.Errorf("Invalid -apiKey: %w", err)
+		}
+		cfg.APIKeys = append(cfg.APIKeys, k)
+	}
+	if *f.authTokenKey != "" {
+		cfg.AuthTokenKey = []byte(*f.authTokenKey)
+	}
+	if cfg.CertTenants, err = tunnel.ParseCertTenants(f.certTenants); err != nil {
+		return cfg, fmt.Errorf("Invalid -certTenant: %w", err)
+	}
+	if *f.decryptKey != "" {
+		key, err := hex.DecodeString(*f.decryptKey)
+		if err != nil {
+			return cfg, fmt.Errorf("Invalid decryption key: %w", err)
+		}
+		cfg.DecryptKey = key
+	}
+	if cfg.DecryptKeys, err = f.keys.load(); err != nil {
+		return cfg, err
+	}
+	if cfg.SigningKeys, err = parseSigningKeys(f.signingKeys); err != nil {
+		return cfg, err
+	}
+	cfg.RequireSignatures = *f.requireSignatures
+	if cfg.Backpressure, err = tunnel.ParseBackpressure(*f.backpressure); err != nil {
+		return cfg, fmt.Errorf("Invalid -backpressure: %w", err)
+	}
+	return cfg, nil
+}
+
+// listeners returns the DNS listeners configured by -listen, -port, -dotAddr, -doqAddr and
+// -dnstapAddr. Servers that only observe queries, with -capture or -dnstapAddr, don't listen on
+// -port.
+func (f *serveFlags) listeners() ([]*listener, error) {
+	var listeners []*listener
+	for _, s := range f.listens {
+		ls, err := parseListen(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -listen: %w", err)
+		}
+		listeners = append(listeners, ls...)
+	}
+	activated, err := activatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 && len(activated) == 0 && len(f.captures) == 0 && *f.dnstapAddr == "" {
+		for _, p := range defaultProtocols {
+			listeners = append(listeners, &listener{protocol: p, addr: ":" + strconv.Itoa(*f.port)})
+		}
+	}
+	if *f.dotAddr != "" {
+		listeners = append(listeners, &listener{protocol: protoDoT, addr: *f.dotAddr})
+	}
+	if *f.doqAddr != "" {
+		listeners = append(listeners, &listener{protocol: protoDoQ, addr: *f.doqAddr})
+	}
+	if *f.dnstapAddr != "" {
+		listeners = append(listeners, &listener{protocol: protoDnstap, addr: *f.dnstapAddr})
+	}
+	return append(listeners, activated...), nil
+}
+
+// loopbackAddr reports whether addr, a host:port address to listen on, only accepts connections
+// from the local host.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// check reports the flags that tunnelConfig and listeners leave unchecked which are invalid, or
+// can't be combined.
+func (f *serveFlags) check() error {
+	if *f.output != "log" && *f.output != "ndjson" {
+		return fmt.Errorf("Invalid -output %q, expected log or ndjson", *f.output)
+	}
+	if *f.wasmHook != "" && *f.luaHook != "" {
+		return fmt.Errorf("-wasmHook and -luaHook can't be combined")
+	}
+	if *f.backpressure == tunnel.Spill.String() && *f.spillFile == "" {
+		return fmt.Errorf("-backpressure spill requires -spillFile")
+	}
+	// The dashboard and the HTTP API serve message payloads, so they may only go without a token
+	// on addresses that other hosts can't reach.
+	if *f.dashboardAddr != "" && *f.dashboardToken == "" && !loopbackAddr(*f.dashboardAddr) {
+		return fmt.Errorf("-dashboardAddr %s is not a loopback address, so it requires -dashboardToken", *f.dashboardAddr)
+	}
+	if *f.apiAddr != "" && *f.apiToken == "" && !loopbackAddr(*f.apiAddr) {
+		return fmt.Errorf("-apiAddr %s is not a loopback address, so it requires -apiToken", *f.apiAddr)
+	}
+	listeners, err := f.listeners()
+	if err != nil {
+		return err
+	}
+	encrypted := *f.dohAddr != "" && *f.tlsCert != ""
+	for _, l := range listeners {
+		if l.encrypted() && (*f.tlsCert == "" || *f.tlsKey == "") {
+			return fmt.Errorf("DNS-over-TLS and DNS-over-QUIC require -tlsCert and -tlsKey")
+		}
+		encrypted = encrypted || l.encrypted()
+	}
+	if *f.clientCA != "" && !encrypted {
+		return fmt.Errorf("-clientCA requires a DNS-over-TLS or DNS-over-QUIC listener, or -dohAddr with -tlsCert")
+	}
+	if *f.keyRefresh < 0 || (*f.keyRefresh > 0 && !f.keys.enabled()) {
+		return fmt.Errorf("-keyRefresh must not be negative, and requires -keyFile or -keyCommand")
+	}
+	if *f.queryLog == "" && (*f.queryLogMaxSize != 0 || *f.queryLogMaxAge != 0 || *f.queryLogCompress || *f.queryLogHashKey != "") {
+		return fmt.Errorf("-queryLogMaxSize, -queryLogMaxAge, -queryLogCompress and -queryLogHashKey require -queryLog")
+	}
+	if *f.alertWindow <= 0 {
+		return fmt.Errorf("-alertWindow must be positive")
+	}
+	if (*f.alertFile != "" || *f.alertWebhook != "") && !f.alertsEnabled() {
+		return fmt.Errorf("-alertFile and -alertWebhook require -alertNewIDs, -alertClientQueries or -alertEntropy")
+	}
+	if (*f.chunkThreshold > 0) != (*f.chunkDir != "") {
+		return fmt.Errorf("-chunkThreshold and -chunkDir must be set together")
+	}
+	if (*f.maxStreams > 0) != (*f.streamForward != "") {
+		return fmt.Errorf("-maxStreams and -streamForward must be set together")
+	}
+	if len(f.captures) > 0 && (*f.capturePort < 1 || *f.capturePort > math.MaxUint16) {
+		return fmt.Errorf("Invalid -capturePort %d", *f.capturePort)
+	}
+	if _, err := lookupCredentials(*f.user, *f.group); err != nil {
+		return err
+	}
+	if *f.chroot != "" {
+		if fi, err := os.Stat(*f.chroot); err != nil || !fi.IsDir() {
+			return fmt.Errorf("Invalid -chroot %q, expected a directory", *f.chroot)
+		}
+	}
+	return nil
+}
+
+// alertsEnabled reports whether any kind of alert is enabled.
+func (f *serveFlags) alertsEnabled() bool {
+	return *f.alertNewIDs > 0 || *f.alertClientQueries > 0 || *f.alertEntropy > 0
+}
+
+// alertSinks returns the sinks configured by -alertFile and -alertWebhook, and the file, if any,
+// for serve to close.
+func (f *serveFlags) alertSinks() ([]sink.AlertSink, *sink.File, error) {
+	var sinks []sink.AlertSink
+	var file *sink.File
+	if *f.alertFile != "" {
+		var err error
+		if file, err = sink.NewFile(sink.FileConfig{Path: *f.alertFile}); err != nil {
+			return nil, nil, err
+		}
+		sinks = append(sinks, file)
+	}
+	if *f.alertWebhook != "" {
+		sinks = append(sinks, &sink.Webhook{URL: *f.alertWebhook})
+	}
+	return sinks, file, nil
+}
+
+// captureInterfaces returns the captures configured by -capture.
+func (f *serveFlags) captureInterfaces() []*capture {
+	var captures []*capture
+	for _, iface := range f.captures {
+		captures = append(captures, &capture{iface: iface, port: *f.capturePort, promiscuous: *f.capturePromisc})
+	}
+	return captures
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+)
+
+// defaultServiceName is the name of the Windows service, and of its event log source, by default.
+const defaultServiceName = "browsertunnel"
+
+var serviceCommand = &command{
+	name:    "service",
+	summary: "Run the tunnel as a Windows service.",
+	commands: []*command{
+		{
+			name:    "install",
+			args:    "[flags] -- [serve flags] [topDomain...]",
+			summary: "Install a Windows service that starts automatically and serves the tunnel with the serve flags.",
+			flags:   func(fs *flag.FlagSet) { registerServiceFlags(fs) },
+			run:     runServiceInstall,
+		},
+		{
+			name:    "uninstall",
+			args:    "[flags]",
+			summary: "Remove the Windows service and its event log source.",
+			flags:   func(fs *flag.FlagSet) { registerServiceFlags(fs) },
+			run:     runServiceUninstall,
+		},
+		{
+			name:    "start",
+			args:    "[flags]",
+			summary: "Start the Windows service.",
+			flags:   func(fs *flag.FlagSet) { registerServiceFlags(fs) },
+			run:     runServiceStart,
+		},
+		{
+			name:    "stop",
+			args:    "[flags]",
+			summary: "Stop the Windows service, waiting for it to drain partial messages.",
+			flags:   func(fs *flag.FlagSet) { registerServiceStopFlags(fs) },
+			run:     runServiceStop,
+		},
+		{
+			name:    "run",
+			args:    "[flags] -- [serve flags] [topDomain...]",
+			summary: "Serve the tunnel as the Windows service, as started by the service manager.",
+			flags:   func(fs *flag.FlagSet) { registerServiceFlags(fs) },
+			run:     runServiceRun,
+		},
+	},
+}
+
+type serviceFlags struct {
+	name    *string
+	timeout *int
+}
+
+func registerServiceFlags(fs *flag.FlagSet) *serviceFlags {
+	return &serviceFlags{
+		name: fs.String("name", defaultServiceName, "name of the Windows service and of its event log source"),
+	}
+}
+
+func registerServiceStopFlags(fs *flag.FlagSet) *serviceFlags {
+	f := registerServiceFlags(fs)
+	f.timeout = fs.Int("timeout", 30, "seconds to wait for the service to stop")
+	return f
+}
+
+func runServiceInstall(fs *flag.FlagSet, args []string) {
+	f := registerServiceFlags(fs)
+	fs.Parse(args)
+	// Catch invalid serve flags now rather than when the service starts.
+	serveFlags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	serveFlags.SetOutput(io.Discard)
+	registerServeFlags(serveFlags)
+	if err := serveFlags.Parse(fs.Args()); err != nil {
+		fatal("Invalid serve flags", "error", err)
+	}
+	if err := installService(*f.name, fs.Args()); err != nil {
+		fatal("Failed to install service", "service", *f.name, "error", err)
+	}
+	fmt.Printf("Installed service %s\n", *f.name)
+}
+
+func runServiceUninstall(fs *flag.FlagSet, args []string) {
+	f := registerServiceFlags(fs)
+	fs.Parse(args)
+	if err := uninstallService(*f.name); err != nil {
+		fatal("Failed to uninstall service", "service", *f.name, "error", err)
+	}
+	fmt.Printf("Uninstalled service %s\n", *f.name)
+}
+
+func runServiceStart(fs *flag.FlagSet, args []string) {
+	f := registerServiceFlags(fs)
+	fs.Parse(args)
+	if err := startService(*f.name); err != nil {
+		fatal("Failed to start service", "service", *f.name, "error", err)
+	}
+}
+
+func runServiceStop(fs *flag.FlagSet, args []string) {
+	f := registerServiceStopFlags(fs)
+	fs.Parse(args)
+	if *f.timeout <= 0 {
+		fatal("-timeout must be positive")
+	}
+	if err := stopService(*f.name, time.Duration(*f.timeout)*time.Second); err != nil {
+		fatal("Failed to stop service", "service", *f.name, "error", err)
+	}
+}
+
+func runServiceRun(fs *flag.FlagSet, args []string) {
+	f := registerServiceFlags(fs)
+	fs.Parse(args)
+	if err := runService(*f.name, fs.Args()); err != nil {
+		fatal("Failed to run service", "service", *f.name, "error", err)
+	}
+}
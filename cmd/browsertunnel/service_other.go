@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errNotWindows is returned by the service commands, since services are only supported on
+// Windows. Elsewhere, the tunnel runs under the service manager of the system, e.g. systemd.
+var errNotWindows = errors.New("Services are only supported on Windows")
+
+func installService(name string, args []string) error { return errNotWindows }
+
+func uninstallService(name string) error { return errNotWindows }
+
+func startService(name string) error { return errNotWindows }
+
+func stopService(name string, timeout time.Duration) error { return errNotWindows }
+
+func runService(name string, args []string) error { return errNotWindows }
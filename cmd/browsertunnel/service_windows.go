@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// eventID is the ID of the events that the service logs. Sources installed with
+// InstallAsEventCreate show the message of events with IDs up to 1000 as is.
+const eventID = 1
+
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("Service %s already exists", name)
+	}
+
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: name,
+		Description: "Reassembles the messages tunneled in DNS queries to its top domains.",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run", "-name", name, "--"}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("Failed to install event log source: %w", err)
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", name)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(name); err != nil {
+		return fmt.Errorf("Failed to remove event log source: %w", err)
+	}
+	return nil
+}
+
+func startService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", name)
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+func stopService(name string, timeout time.Duration) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", name)
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for the service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runService(name string, args []string) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return errors.New("Not started by the service manager, run browsertunnel serve instead")
+	}
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	return svc.Run(name, &tunnelService{args: args, elog: elog})
+}
+
+// tunnelService serves the tunnel with the serve flags in args as a Windows service, logging to
+// elog.
+type tunnelService struct {
+	args []string
+	elog *eventlog.Log
+}
+
+// Execute implements svc.Handler. The service is reported running once every listener has
+// started, and stopping while partial messages drain.
+func (s *tunnelService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, flag.NewFlagSet("serve", flag.ExitOnError), s.args, serveHooks{
+			handler: func(h slog.Handler) slog.Handler {
+				return newEventLogHandler(s.elog, h)
+			},
+			ready: func() {
+				changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+			},
+		})
+	}()
+
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				stop()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogHandler is a slog.Handler writing records to the event log, formatted like the text
+// handler without their time, which the event log records, before passing them to next.
+type eventLogHandler struct {
+	elog *eventlog.Log
+	next slog.Handler
+	// text formats records into buf, which mu guards.
+	text slog.Handler
+	mu   *sync.Mutex
+	buf  *bytes.Buffer
+}
+
+func newEventLogHandler(elog *eventlog.Log, next slog.Handler) *eventLogHandler {
+	buf := &bytes.Buffer{}
+	text := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &eventLogHandler{elog: elog, next: next, text: text, mu: &sync.Mutex{}, buf: buf}
+}
+
+// Enabled implements slog.Handler, with the level of next.
+func (h *eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	h.buf.Reset()
+	err := h.text.Handle(ctx, r)
+	msg := h.buf.String()
+	h.mu.Unlock()
+	if err == nil {
+		switch {
+		case r.Level >= slog.LevelError:
+			h.elog.Error(eventID, msg)
+		case r.Level >= slog.LevelWarn:
+			h.elog.Warning(eventID, msg)
+		default:
+			h.elog.Info(eventID, msg)
+		}
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.next, c.text = h.next.WithAttrs(attrs), h.text.WithAttrs(attrs)
+	return &c
+}
+
+// WithGroup implements slog.Handler.
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.next, c.text = h.next.WithGroup(name), h.text.WithGroup(name)
+	return &c
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/schema"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+)
+
+// sinkFlags holds the flags configuring the sinks that messages are delivered to.
+type sinkFlags struct {
+	webhookURL      *string
+	webhookRetries  *int
+	tenantWebhooks  stringsFlag
+	rules           stringsFlag
+	jsonSchema      *string
+	quarantineSink  *string
+	sampleRate      *float64
+	sampleSinks     *string
+	sampleClients   stringsFlag
+	sinkTimeout     *int
+	perSinkTimeouts stringsFlag
+	breakerFailures *int
+	breakerCooldown *int
+	outFile         *string
+	outFileMaxSize  *int64
+	outFileMaxAge   *int
+	outFileCompress *bool
+	kafkaBrokers    *string
+	kafkaTopic      *string
+	kafkaTLS        *bool
+	kafkaSASL       *string
+	kafkaUser       *string
+	kafkaPassword   *string
+	natsAddr        *string
+	natsSubject     *string
+	natsToken       *string
+	natsUser        *string
+	natsPassword    *string
+	mqttAddr        *string
+	mqttTopic       *string
+	mqttQoS         *int
+	mqttRetain      *bool
+	mqttTLS         *bool
+	mqttClientID    *string
+	mqttUser        *string
+	mqttPassword    *string
+	redisAddr       *string
+	redisChannel    *string
+	redisUser       *string
+	redisPassword   *string
+	elasticURL      *string
+	elasticIndex    *string
+	elasticAPIKey   *string
+	elasticUser     *string
+	elasticPassword *string
+	archiveBucket   *string
+	archiveRegion   *string
+	archiveEndpoint *string
+	archiveKey      *string
+	archiveSecret   *string
+	archivePrefix   *string
+	archiveLayout   *string
+	archiveInterval *int
+	archiveMaxSize  *int64
+	slackWebhook    *string
+	discordWebhook  *string
+	chatTemplate    *string
+	chatRate        *float64
+	syslogAddr      *string
+	syslogFacility  *string
+	syslogSeverity  *string
+	rawPayloads     *bool
+	batchSize       *int
+	batchInterval   *int
+}
+
+func registerSinkFlags(fs *flag.FlagSet) *sinkFlags {
+	f := &sinkFlags{
+		webhookURL:      fs.String("webhookURL", "", "URL to POST each message to as JSON (disabled if empty)"),
+		webhookRetries:  fs.Int("webhookRetries", sink.DefaultWebhookRetries, "times a failed webhook delivery is retried"),
+		outFile:         fs.String("outFile", "", "path of a file to append each message to as a line of JSON (disabled if empty)"),
+		outFileMaxSize:  fs.Int64("outFileMaxSize", 0, "bytes after which outFile is rotated (disabled if 0)"),
+		outFileMaxAge:   fs.Int("outFileMaxAge", 0, "seconds after which outFile is rotated (disabled if 0)"),
+		outFileCompress: fs.Bool("outFileCompress", false, "gzip rotated files"),
+		kafkaBrokers:    fs.String("kafkaBrokers", "", "comma separated Kafka brokers to publish messages to (disabled if empty)"),
+		kafkaTopic:      fs.String("kafkaTopic", "browsertunnel", "Kafka topic to publish messages to"),
+		kafkaTLS:        fs.Bool("kafkaTLS", false, "connect to the Kafka brokers over TLS"),
+		kafkaSASL:       fs.String("kafkaSASL", "", "SASL mechanism to authenticate with Kafka: plain, scram-sha-256 or scram-sha-512 (disabled if empty)"),
+		kafkaUser:       fs.String("kafkaUser", "", "SASL username for Kafka"),
+		kafkaPassword:   fs.String("kafkaPassword", "", "SASL password for Kafka"),
+		natsAddr:        fs.String("natsAddr", "", "NATS server to publish messages to, e.g. localhost:4222 (disabled if empty)"),
+		natsSubject:     fs.String("natsSubject", "browsertunnel", "template of the NATS subject to publish messages to, e.g. tunnel.{{.Source}}.{{.ID}}"),
+		natsToken:       fs.String("natsToken", "", "token to authenticate with NATS"),
+		natsUser:        fs.String("natsUser", "", "username to authenticate with NATS"),
+		natsPassword:    fs.String("natsPassword", "", "password to authenticate with NATS"),
+		mqttAddr:        fs.String("mqttAddr", "", "MQTT broker to publish messages to, e.g. localhost:1883 (disabled if empty)"),
+		mqttTopic:       fs.String("mqttTopic", "browsertunnel", "template of the MQTT topic to publish messages to, e.g. tunnel/{{.Source}}/{{.ID}}"),
+		mqttQoS:         fs.Int("mqttQoS", 1, "MQTT QoS to publish messages with: 0, 1 or 2"),
+		mqttRetain:      fs.Bool("mqttRetain", false, "ask the MQTT broker to retain the last message of each topic"),
+		mqttTLS:         fs.Bool("mqttTLS", false, "connect to the MQTT broker over TLS"),
+		mqttClientID:    fs.String("mqttClientID", "", "client ID to connect to the MQTT broker with (assigned by the broker if empty)"),
+		mqttUser:        fs.String("mqttUser", "", "username to authenticate with the MQTT broker"),
+		mqttPassword:    fs.String("mqttPassword", "", "password to authenticate with the MQTT broker"),
+		redisAddr:       fs.String("redisAddr", "", "Redis server to PUBLISH messages to, e.g. localhost:6379 (disabled if empty)"),
+		redisChannel:    fs.String("redisChannel", "browsertunnel", "Redis channel to publish messages to"),
+		redisUser:       fs.String("redisUser", "", "username to AUTH with Redis"),
+		redisPassword:   fs.String("redisPassword", "", "password to AUTH with Redis (AUTH is disabled if empty)"),
+		elasticURL:      fs.String("elasticURL", "", "Elasticsearch or OpenSearch cluster to index messages into, e.g. http://localhost:9200 (disabled if empty)"),
+		elasticIndex:    fs.String("elasticIndex", "browsertunnel", "Elasticsearch index, alias or data stream to index messages into"),
+		elasticAPIKey:   fs.String("elasticAPIKey", "", "base64 encoded API key to authenticate with Elasticsearch"),
+		elasticUser:     fs.String("elasticUser", "", "username to authenticate with Elasticsearch"),
+		elasticPassword: fs.String("elasticPassword", "", "password to authenticate with Elasticsearch"),
+		archiveBucket:   fs.String("archiveBucket", "", "S3 bucket to archive messages to as gzipped newline delimited JSON objects (disabled if empty)"),
+		archiveRegion:   fs.String("archiveRegion", "us-east-1", "region of archiveBucket, or auto for Google Cloud Storage"),
+		archiveEndpoint: fs.String("archiveEndpoint", "", "URL of an S3 compatible service to archive to, e.g. https://storage.googleapis.com (Amazon S3 if empty)"),
+		archiveKey:      fs.String("archiveAccessKey", "", "access key to sign archive uploads with (AWS_ACCESS_KEY_ID if empty)"),
+		archiveSecret:   fs.String("archiveSecretKey", "", "secret key to sign archive uploads with (AWS_SECRET_ACCESS_KEY if empty)"),
+		archivePrefix:   fs.String("archivePrefix", "", "prefix of the keys of archived objects, e.g. browsertunnel/"),
+		archiveLayout:   fs.String("archiveLayout", sink.DefaultArchiveLayout, "Go time layout of the partitions messages are archived in, by the time their last fragment arrived"),
+		archiveInterval: fs.Int("archiveInterval", int(sink.DefaultArchiveInterval/time.Second), "seconds in between uploads of archived messages"),
+		archiveMaxSize:  fs.Int64("archiveMaxSize", sink.DefaultArchiveMaxSize, "bytes of JSON after which an archived object is uploaded early"),
+		slackWebhook:    fs.String("slackWebhook", "", "Slack incoming webhook to post a summary of each message to (disabled if empty)"),
+		discordWebhook:  fs.String("discordWebhook", "", "Discord webhook to post a summary of each message to (disabled if empty)"),
+		chatTemplate:    fs.String("chatTemplate", sink.DefaultChatTemplate, "template of the summaries posted to Slack and Discord, e.g. {{.Tenant}}: {{.Payload}}"),
+		chatRate:        fs.Float64("chatRate", sink.DefaultChatRate, "summaries posted to Slack and Discord per minute, beyond which messages are suppressed"),
+		syslogAddr:      fs.String("syslog", "", "syslog server to write messages to as network://host:port, or local for the local daemon (disabled if empty)"),
+		syslogFacility:  fs.String("syslogFacility", "user", "syslog facility of messages, e.g. local0"),
+		syslogSeverity:  fs.String("syslogSeverity", "info", "syslog severity of messages, e.g. notice"),
+		rawPayloads:     fs.Bool("rawPayloads", false, "POST and publish payloads to webhooks and Kafka as is, with metadata in headers, instead of as JSON"),
+		batchSize:       fs.Int("batchSize", 0, "messages delivered to webhooks, Kafka and Elasticsearch in a single request (batching is disabled if 0)"),
+		batchInterval:   fs.Int("batchInterval", int(sink.DefaultBatchInterval/time.Millisecond), "milliseconds after which an incomplete batch is delivered"),
+		jsonSchema:      fs.String("jsonSchema", "", "path of a JSON Schema that payloads must be valid JSON documents of, or be quarantined (disabled if empty)"),
+		quarantineSink:  fs.String("quarantineSink", "", "sink that messages failing validation against jsonSchema are delivered to instead, e.g. file (dropped if empty)"),
+		sampleRate:      fs.Float64("sampleRate", 0, "fraction of messages delivered to sampleSinks, e.g. 0.1 (sampling is disabled if 0)"),
+		sampleSinks:     fs.String("sampleSinks", "", "comma separated sinks that are sampled, e.g. elasticsearch,slack (all sinks if empty)"),
+		sinkTimeout:     fs.Int("sinkTimeout", 0, "milliseconds after which a delivery to a sink fails, for sinks without a perSinkTimeout (disabled if 0)"),
+		breakerFailures: fs.Int("sinkBreakerFailures", 0, "failed deliveries in a row after which a sink is skipped for sinkBreakerCooldown, failing its messages at once (disabled if 0)"),
+		breakerCooldown: fs.Int("sinkBreakerCooldown", int(sink.DefaultBreakerCooldown/time.Second), "seconds a sink is skipped for once its circuit breaker opens, before a delivery is tried again"),
+	}
+	fs.Var(&f.tenantWebhooks, "tenantWebhook", "tenant=URL to POST the tenant's messages to as JSON (repeatable)")
+	fs.Var(&f.sampleClients, "sampleClientRate", "cidr=rate fraction of the messages of clients in a network delivered to sampleSinks, e.g. 10.0.0.0/8=0.01 (repeatable)")
+	fs.Var(&f.perSinkTimeouts, "perSinkTimeout", "sink=milliseconds after which a delivery to a sink fails, e.g. webhook=2000 (repeatable)")
+	fs.Var(&f.rules, "rule", "rule routing matching messages to sinks and tagging them, e.g. 'alerts payload=(?i)password sinks=slack tag:severity=high' (repeatable)")
+	return f
+}
+
+// sinks returns the sinks enabled by the flags.
+func (f *sinkFlags) sinks() ([]sink.Named, error) {
+	var sinks []sink.Named
+	if *f.webhookURL != "" {
+		webhook := &sink.Webhook{URL: *f.webhookURL, Retries: *f.webhookRetries, Raw: *f.rawPayloads}
+		if *f.webhookRetries == 0 {
+			webhook.Retries = -1
+		}
+		sinks = append(sinks, sink.Named{Name: "webhook", Sink: f.batched("webhook", webhook)})
+	}
+	for _, tw := range f.tenantWebhooks {
+		tenant, url, ok := strings.Cut(tw, "=")
+		if !ok || tenant == "" || url == "" {
+			return nil, fmt.Errorf("Invalid -tenantWebhook %q, expected tenant=URL", tw)
+		}
+		webhook := &sink.Webhook{URL: url, Retries: *f.webhookRetries, Raw: *f.rawPayloads}
+		if *f.webhookRetries == 0 {
+			webhook.Retries = -1
+		}
+		sinks = append(sinks, sink.Named{Name: "webhook-" + tenant, Sink: f.batched("webhook-"+tenant, webhook), Tenant: strings.ToLower(tenant)})
+	}
+	if *f.outFile != "" {
+		file, err := sink.NewFile(sink.FileConfig{
+			Path:     *f.outFile,
+			MaxSize:  *f.outFileMaxSize,
+			MaxAge:   time.Duration(*f.outFileMaxAge) * time.Second,
+			Compress: *f.outFileCompress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "file", Sink: file})
+	}
+	if *f.kafkaBrokers != "" {
+		cfg := sink.KafkaConfig{
+			Brokers:       strings.Split(*f.kafkaBrokers, ","),
+			Topic:         *f.kafkaTopic,
+			SASLMechanism: *f.kafkaSASL,
+			Username:      *f.kafkaUser,
+			Password:      *f.kafkaPassword,
+			Raw:           *f.rawPayloads,
+		}
+		if *f.kafkaTLS {
+			cfg.TLS = &tls.Config{}
+		}
+		kafka, err := sink.NewKafka(cfg)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "kafka", Sink: f.batched("kafka", kafka)})
+	}
+	if *f.natsAddr != "" {
+		nats, err := sink.NewNATS(sink.NATSConfig{
+			Addr:     *f.natsAddr,
+			Subject:  *f.natsSubject,
+			Token:    *f.natsToken,
+			User:     *f.natsUser,
+			Password: *f.natsPassword,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "nats", Sink: nats})
+	}
+	if *f.mqttAddr != "" {
+		cfg := sink.MQTTConfig{
+			Addr:     *f.mqttAddr,
+			Topic:    *f.mqttTopic,
+			QoS:      *f.mqttQoS,
+			Retain:   *f.mqttRetain,
+			ClientID: *f.mqttClientID,
+			Username: *f.mqttUser,
+			Password: *f.mqttPassword,
+		}
+		if *f.mqttTLS {
+			cfg.TLS = &tls.Config{}
+		}
+		mqtt, err := sink.NewMQTT(cfg)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "mqtt", Sink: mqtt})
+	}
+	if *f.redisAddr != "" {
+		redis, err := sink.NewRedis(sink.RedisConfig{
+			Addr:     *f.redisAddr,
+			Channel:  *f.redisChannel,
+			Username: *f.redisUser,
+			Password: *f.redisPassword,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "redis", Sink: redis})
+	}
+	if *f.elasticURL != "" {
+		es, err := sink.NewElasticsearch(sink.ElasticsearchConfig{
+			URL:      *f.elasticURL,
+			Index:    *f.elasticIndex,
+			APIKey:   *f.elasticAPIKey,
+			Username: *f.elasticUser,
+			Password: *f.elasticPassword,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "elasticsearch", Sink: f.batched("elasticsearch", es)})
+	}
+	if *f.archiveBucket != "" {
+		cfg := sink.S3Config{
+			Bucket:    *f.archiveBucket,
+			Region:    *f.archiveRegion,
+			Endpoint:  *f.archiveEndpoint,
+			AccessKey: *f.archiveKey,
+			SecretKey: *f.archiveSecret,
+		}
+		if cfg.AccessKey == "" {
+			cfg.AccessKey, cfg.SecretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+			cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		s3, err := sink.NewS3(cfg)
+		if err != nil {
+			return nil, err
+		}
+		archive, err := sink.NewArchive(sink.ArchiveConfig{
+			Store:    s3,
+			Prefix:   *f.archivePrefix,
+			Layout:   *f.archiveLayout,
+			Interval: time.Duration(*f.archiveInterval) * time.Second,
+			MaxSize:  *f.archiveMaxSize,
+		}, slog.Default().With("sink", "archive"))
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "archive", Sink: archive})
+	}
+	for _, chat := range []struct{ format, url string }{{sink.ChatSlack, *f.slackWebhook}, {sink.ChatDiscord, *f.discordWebhook}} {
+		if chat.url == "" {
+			continue
+		}
+		c, err := sink.NewChat(sink.ChatConfig{URL: chat.url, Format: chat.format, Template: *f.chatTemplate, Rate: *f.chatRate})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: chat.format, Sink: c})
+	}
+	if *f.syslogAddr != "" {
+		cfg := sink.SyslogConfig{Facility: *f.syslogFacility, Severity: *f.syslogSeverity}
+		if *f.syslogAddr != "local" {
+			network, addr, ok := strings.Cut(*f.syslogAddr, "://")
+			if !ok {
+				return nil, fmt.Errorf("Syslog address %q must be of the form network://host:port", *f.syslogAddr)
+			}
+			cfg.Network, cfg.Addr = network, addr
+		}
+		syslog, err := sink.NewSyslog(cfg)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "syslog", Sink: syslog})
+	}
+	return sinks, nil
+}
+
+// fanout returns a Fanout delivering to sinks, with the rules and schema of the flags.
+func (f *sinkFlags) fanout(logger *slog.Logger, sinks []sink.Named) (*sink.Fanout, error) {
+	var rules []sink.Rule
+	for _, s := range f.rules {
+		r, err := sink.ParseRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -rule: %w", err)
+		}
+		rules = append(rules, r)
+	}
+	var s *schema.Schema
+	if *f.jsonSchema != "" {
+		var err error
+		if s, err = schema.Open(*f.jsonSchema); err != nil {
+			return nil, fmt.Errorf("Failed to load -jsonSchema: %w", err)
+		}
+	} else if *f.quarantineSink != "" {
+		return nil, fmt.Errorf("-quarantineSink requires -jsonSchema")
+	}
+	if err := f.sample(sinks); err != nil {
+		return nil, err
+	}
+	if err := f.protect(sinks); err != nil {
+		return nil, err
+	}
+	fanout := sink.NewFanout(logger, sinks...)
+	fanout.SetTimeout(time.Duration(*f.sinkTimeout) * time.Millisecond)
+	if err := fanout.SetRules(rules...); err != nil {
+		return nil, fmt.Errorf("Invalid -rule: %w", err)
+	}
+	if s != nil {
+		if err := fanout.SetSchema(s, *f.quarantineSink); err != nil {
+			return nil, fmt.Errorf("Invalid -quarantineSink: %w", err)
+		}
+	}
+	return fanout, nil
+}
+
+// sample sets the sampling of the flags on the sinks it applies to.
+func (f *sinkFlags) sample(sinks []sink.Named) error {
+	if *f.sampleRate < 0 || *f.sampleRate > 1 {
+		return fmt.Errorf("-sampleRate must be between 0 and 1")
+	}
+	sampling := sink.Sampling{Rate: *f.sampleRate}
+	for _, s := range f.sampleClients {
+		c, err := sink.ParseClientRate(s)
+		if err != nil {
+			return fmt.Errorf("Invalid -sampleClientRate: %w", err)
+		}
+		sampling.Clients = append(sampling.Clients, c)
+	}
+	names := make(map[string]bool)
+	if *f.sampleSinks != "" {
+		for _, name := range strings.Split(*f.sampleSinks, ",") {
+			names[name] = true
+		}
+	}
+	for i := range sinks {
+		if *f.sampleSinks == "" || names[sinks[i].Name] {
+			sinks[i].Sampling = sampling
+		}
+		delete(names, sinks[i].Name)
+	}
+	for name := range names {
+		return fmt.Errorf("-sampleSinks names sink %s, which is not enabled", name)
+	}
+	return nil
+}
+
+// protect sets the timeouts and circuit breaker of the flags on sinks.
+func (f *sinkFlags) protect(sinks []sink.Named) error {
+	if *f.sinkTimeout < 0 {
+		return fmt.Errorf("-sinkTimeout must not be negative")
+	}
+	if *f.breakerFailures < 0 || *f.breakerCooldown <= 0 {
+		return fmt.Errorf("-sinkBreakerFailures must not be negative, and -sinkBreakerCooldown must be positive")
+	}
+	timeouts := make(map[string]time.Duration)
+	for _, st := range f.perSinkTimeouts {
+		name, ms, ok := strings.Cut(st, "=")
+		n, err := strconv.Atoi(ms)
+		if !ok || name == "" || err != nil || n <= 0 {
+			return fmt.Errorf("Invalid -perSinkTimeout %q, expected sink=milliseconds", st)
+		}
+		timeouts[name] = time.Duration(n) * time.Millisecond
+	}
+	for i := range sinks {
+		if d, ok := timeouts[sinks[i].Name]; ok {
+			sinks[i].Timeout = d
+			delete(timeouts, sinks[i].Name)
+		}
+		if *f.breakerFailures > 0 {
+			sinks[i].Breaker = sink.BreakerPolicy{Failures: *f.breakerFailures, Cooldown: time.Duration(*f.breakerCooldown) * time.Second}
+		}
+	}
+	for name := range timeouts {
+		return fmt.Errorf("-perSinkTimeout names sink %s, which is not enabled", name)
+	}
+	return nil
+}
+
+// batched wraps s in a sink.Batcher if batching is enabled.
+func (f *sinkFlags) batched(name string, s sink.BatchSink) sink.Sink {
+	if *f.batchSize <= 0 {
+		return s
+	}
+	interval := time.Duration(*f.batchInterval) * time.Millisecond
+	return sink.NewBatcher(s, *f.batchSize, interval, slog.Default().With("sink", name))
+}
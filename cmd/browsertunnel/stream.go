@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/client"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// forwardStreams connects every stream accepted from l to addr over TCP, and copies the bytes of
+// each direction to the other until both are closed.
+func forwardStreams(l net.Listener, addr string, logger *slog.Logger) {
+	for {
+		stream, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			logger := logger.With("stream", stream.(*tunnel.Stream).ID(), "source", stream.RemoteAddr().String(), "domain", stream.LocalAddr().String())
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				logger.Warn("Failed to forward stream", "addr", addr, "error", err)
+				return
+			}
+			defer conn.Close()
+			logger.Info("Forwarding stream", "addr", addr)
+			up := make(chan int64)
+			go func() {
+				n, _ := io.Copy(conn, stream)
+				conn.(*net.TCPConn).CloseWrite()
+				up <- n
+			}()
+			down, err := io.Copy(stream, conn)
+			stream.Close()
+			logger.Info("Stream closed", "up", <-up, "down", down, "error", err)
+		}()
+	}
+}
+
+// connectFlags holds the flags of the connect subcommand.
+type connectFlags struct {
+	domain       *string
+	server       *string
+	network      *string
+	timeout      *int
+	retries      *int
+	pollInterval *int
+}
+
+func registerConnectFlags(fs *flag.FlagSet) *connectFlags {
+	return &connectFlags{
+		domain:       fs.String("domain", "", "top domain of the tunnel, preceded by the tenant if tenants are configured"),
+		server:       fs.String("server", "", "DNS server to send queries to, e.g. 127.0.0.1:53, which must pass the TXT answers of the tunnel on"),
+		network:      fs.String("net", "udp", "network used to reach server: udp or tcp"),
+		timeout:      fs.Int("timeout", int(client.DefaultTimeout/time.Millisecond), "milliseconds to wait for each answer"),
+		retries:      fs.Int("retries", client.DefaultRetries, "times a failed query is sent again before the stream fails"),
+		pollInterval: fs.Int("pollInterval", int(client.DefaultPollInterval/time.Millisecond), "milliseconds between queries while neither side has anything to send"),
+	}
+}
+
+// runConnect implements the connect subcommand, which opens a stream through a tunnel served with
+// -maxStreams, copies stdin to it, and what the tunnel sends back to stdout, until both sides are
+// closed.
+func runConnect(fs *flag.FlagSet, args []string) {
+	f := registerConnectFlags(fs)
+	fs.Parse(args)
+	if *f.domain == "" || *f.server == "" {
+		fatal("A -domain and a -server are required")
+	}
+	if fs.NArg() > 0 {
+		fatal("Unexpected arguments", "args", fs.Args())
+	}
+	if *f.retries == 0 {
+		*f.retries = -1
+	}
+	c := &client.Client{
+		Domain:       *f.domain,
+		Server:       *f.server,
+		Net:          *f.network,
+		Timeout:      time.Duration(*f.timeout) * time.Millisecond,
+		Retries:      *f.retries,
+		PollInterval: time.Duration(*f.pollInterval) * time.Millisecond,
+	}
+	stream, err := c.Dial(context.Background())
+	if err != nil {
+		fatal("Failed to open stream", "error", err)
+	}
+	go func() {
+		if _, err := io.Copy(stream, os.Stdin); err != nil {
+			fatal("Failed to send stdin", "error", err)
+		}
+		stream.CloseWrite()
+	}()
+	if _, err := io.Copy(os.Stdout, stream); err != nil {
+		fatal("Failed to receive from the stream", "error", err)
+	}
+	if err := stream.Close(); err != nil {
+		fatal("Failed to close stream", "error", err)
+	}
+}
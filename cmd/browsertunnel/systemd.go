@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// activatedListeners returns a listener for each socket passed by systemd socket activation, as
+// described in sd_listen_fds(3), or none if the process wasn't started by an activated unit.
+// Datagram sockets are served over UDP and stream sockets over TCP, unless the
+// FileDescriptorName= of their socket unit is dot or doq. The variables are only read once, and
+// are then removed from the environment so that the processes started by sinks don't inherit
+// them.
+var activatedListeners = sync.OnceValues(func() ([]*listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	var listeners []*listener
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		l, err := activatedListener(uintptr(listenFdsStart+i), name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid socket %d passed by systemd: %w", listenFdsStart+i, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+})
+
+// activatedListener returns a listener serving the socket fd, named name by its socket unit.
+func activatedListener(fd uintptr, name string) (*listener, error) {
+	f := os.NewFile(fd, name)
+	defer f.Close()
+
+	// FileListener and FilePacketConn duplicate the descriptor, and fail for sockets of the other
+	// type.
+	if ln, err := net.FileListener(f); err == nil {
+		l := &listener{protocol: protoTCP, addr: ln.Addr().String(), ln: ln}
+		if name == protoDoT {
+			l.protocol = protoDoT
+		}
+		return l, nil
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("Not a stream or datagram socket: %w", err)
+	}
+	l := &listener{protocol: protoUDP, addr: pc.LocalAddr().String(), pc: pc}
+	if name == protoDoQ {
+		l.protocol = protoDoQ
+	}
+	return l, nil
+}
+
+// sdNotify sends state, e.g. READY=1, to the service manager as described in sd_notify(3), if
+// the process was started by a unit of Type=notify. It does nothing otherwise.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	// Names starting with @ are in the abstract namespace.
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "error", err)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// startTracing exports the spans of the tunnel and sinks to the OTLP/HTTP collector at endpoint,
+// e.g. http://localhost:4318. Spans are sampled as set by the OTEL_TRACES_SAMPLER and
+// OTEL_TRACES_SAMPLER_ARG environment variables, and all of them by default. The returned
+// function flushes the spans that haven't been exported yet.
+func startTracing(endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "browsertunnel"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
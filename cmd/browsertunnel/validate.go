@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/veggiedefender/browsertunnel/pkg/config"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// runValidate implements the config validate subcommand, which checks the flags of serve and the
+// files they name as serve would, without opening stores or sinks or serving, and exits with an
+// error if they are invalid.
+func runValidate(fs *flag.FlagSet, args []string) {
+	f := registerServeFlags(fs)
+	fs.Parse(args)
+	if *f.configFile != "" {
+		if err := config.Load(*f.configFile, fs); err != nil {
+			fatal("Invalid configuration file", "error", err)
+		}
+	}
+	topDomains := append(fs.Args(), f.domains...)
+	if len(topDomains) == 0 {
+		fatal("tunnel requires at least one top domain, as an argument or with -domain")
+	}
+	if err := f.check(); err != nil {
+		fatal(err.Error())
+	}
+	cfg, err := f.tunnelConfig(topDomains)
+	if err != nil {
+		fatal(err.Error())
+	}
+	// The spool of -backpressure spill is opened when serving, not here.
+	if cfg.Backpressure == tunnel.Spill {
+		cfg.Backpressure = tunnel.Block
+	}
+	// Creating the tunnels checks the rest of their configuration.
+	served := make(map[string]string)
+	tun, err := tunnel.New(cfg)
+	if err != nil {
+		fatal("Invalid tunnel configuration", "error", err)
+	}
+	tun.Close()
+	for _, topDomain := range tun.TopDomains() {
+		served[topDomain] = "the main tunnel"
+	}
+	for _, path := range f.instancePaths {
+		name, _, instCfg, err := loadInstance(path, cfg)
+		if err == nil {
+			tun, err = tunnel.New(instCfg)
+		}
+		if err != nil {
+			fatal("Invalid -instance", "path", path, "error", err)
+		}
+		tun.Close()
+		for _, topDomain := range tun.TopDomains() {
+			if other, ok := served[topDomain]; ok {
+				fatal("Top domain is served twice", "domain", topDomain, "instance", name, "by", other)
+			}
+			served[topDomain] = "instance " + name
+		}
+	}
+	fmt.Println("Configuration is valid")
+}
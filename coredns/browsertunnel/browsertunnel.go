@@ -0,0 +1,112 @@
+// Package browsertunnel is a CoreDNS plugin serving a tunnel endpoint, so that servers already
+// running CoreDNS can reassemble messages without a separate browsertunnel daemon.
+//
+// Queries under the domains of the tunnel are answered by the tunnel, and every other query is
+// passed on to the next plugin, after being inspected for alerts. Assembled messages are logged,
+// and delivered to the configured sinks, as are alerts to theirs. See setup.go for the syntax of
+// the browsertunnel directive.
+package browsertunnel
+
+import (
+	"context"
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+const pluginName = "browsertunnel"
+
+var log = clog.NewWithPlugin(pluginName)
+
+// Browsertunnel is the plugin handler. It owns a tunnel, which is closed when CoreDNS shuts down
+// or reloads its configuration.
+type Browsertunnel struct {
+	Next plugin.Handler
+
+	tunnel *tunnel.Tunnel
+	zones  plugin.Zones
+	fanout *sink.Fanout
+	alerts []sink.AlertSink
+	wg     sync.WaitGroup
+}
+
+// newBrowsertunnel starts a tunnel configured with cfg, delivering messages to sinks, and alerts
+// to alerts.
+func newBrowsertunnel(cfg tunnel.Config, sinks []sink.Named, alerts []sink.AlertSink) (*Browsertunnel, error) {
+	tun, err := tunnel.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	bt := &Browsertunnel{
+		tunnel: tun,
+		zones:  plugin.Zones(tun.TopDomains()),
+		fanout: sink.NewFanout(nil, sinks...),
+		alerts: alerts,
+	}
+	bt.wg.Add(3)
+	go bt.listenMessages()
+	go bt.listenExpired()
+	go bt.listenAlerts()
+	return bt, nil
+}
+
+// Name implements plugin.Handler.
+func (bt *Browsertunnel) Name() string { return pluginName }
+
+// ServeDNS implements plugin.Handler. Queries under the domains of the tunnel are answered by
+// the tunnel, and others are inspected for alerts and passed on to the next plugin.
+func (bt *Browsertunnel) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r}
+	if bt.zones.Matches(state.Name()) == "" {
+		bt.tunnel.Inspect(r, w.RemoteAddr())
+		return plugin.NextOrFailure(bt.Name(), bt.Next, ctx, w, r)
+	}
+	bt.tunnel.ServeDNS(w, r)
+	return dns.RcodeSuccess, nil
+}
+
+func (bt *Browsertunnel) listenMessages() {
+	defer bt.wg.Done()
+	for msg := range bt.tunnel.Messages() {
+		if msg.Binary {
+			log.Infof("Received message %s of %d bytes of binary data from %s", msg.ID, len(msg.Payload), msg.Source)
+		} else {
+			log.Infof("Received message %s from %s: %q", msg.ID, msg.Source, msg.Payload)
+		}
+		if err := bt.fanout.Deliver(context.Background(), msg); err != nil {
+			log.Warningf("Failed to deliver message %s: %v", msg.ID, err)
+		}
+	}
+}
+
+func (bt *Browsertunnel) listenExpired() {
+	defer bt.wg.Done()
+	for partial := range bt.tunnel.Expired() {
+		log.Infof("Expired message %s after receiving %d of %d bytes", partial.ID, partial.Received, partial.TotalSize)
+	}
+}
+
+func (bt *Browsertunnel) listenAlerts() {
+	defer bt.wg.Done()
+	for alert := range bt.tunnel.Alerts() {
+		log.Warningf("Suspicious traffic: %s from %s (name %q, count %d, entropy %.2f)", alert.Kind, alert.Source, alert.Name, alert.Count, alert.Entropy)
+		for _, s := range bt.alerts {
+			if err := s.DeliverAlert(context.Background(), alert); err != nil {
+				log.Warningf("Failed to deliver %s alert: %v", alert.Kind, err)
+			}
+		}
+	}
+}
+
+// close closes the tunnel, waits for the messages it assembled to be handed to the sinks, and
+// closes them.
+func (bt *Browsertunnel) close() error {
+	bt.tunnel.Close()
+	bt.wg.Wait()
+	return bt.fanout.Close()
+}
@@ -0,0 +1,61 @@
+package browsertunnel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// chanSink delivers messages to a channel.
+type chanSink chan tunnel.Message
+
+func (s chanSink) Deliver(ctx context.Context, msg tunnel.Message) error {
+	s <- msg
+	return nil
+}
+
+func TestServeDNS(t *testing.T) {
+	messages := make(chanSink, 1)
+	bt, err := newBrowsertunnel(tunnel.Config{TopDomain: "t1.example.com", Acks: true}, []sink.Named{{Name: "test", Sink: messages}}, nil)
+	require.Nil(t, err)
+	defer bt.close()
+	bt.Next = test.ErrorHandler()
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		next  bool
+	}{
+		// A fragment carrying the whole message, which is acknowledged.
+		{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.t1.example.com.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess},
+		// The top domain itself is answered by the tunnel.
+		{name: "T1.example.com.", qtype: dns.TypeA, rcode: dns.RcodeSuccess},
+		// Other names are passed on to the next plugin.
+		{name: "www.example.com.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, next: true},
+	}
+	for i, tc := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tc.name, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := bt.ServeDNS(context.Background(), rec, req)
+		require.Equal(t, tc.rcode, rcode, tc.name)
+		require.Nil(t, err, tc.name)
+		if !tc.next {
+			require.NotNil(t, rec.Msg, tc.name)
+			require.Equal(t, tc.name, rec.Msg.Question[0].Name)
+		}
+		if i == 0 {
+			ack, err := tunnel.ParseAck(rec.Msg.Answer[0])
+			require.Nil(t, err)
+			require.True(t, ack.Complete())
+		}
+	}
+	require.Equal(t, []byte("hello world"), (<-messages).Payload)
+}
@@ -0,0 +1,476 @@
+package browsertunnel
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func init() { plugin.Register(pluginName, setup) }
+
+// options is the parsed form of a browsertunnel directive:
+//
+//	browsertunnel [DOMAIN...] {
+//	    expiration DURATION
+//	    domain_expiration DOMAIN DURATION [DELETION_INTERVAL]
+//	    tenant_expiration TENANT DURATION [DELETION_INTERVAL]
+//	    max_message_size BYTES
+//	    strict
+//	    encoding DOMAIN=ENCODING...
+//	    acks
+//	    dedup_window DURATION
+//	    hmac_key KEY
+//	    auth_token TOKEN...
+//	    auth_token_key KEY
+//	    api_key NAME:TOKEN[:TENANT[:MESSAGES_PER_HOUR[:BYTES_PER_DAY]]]...
+//	    decrypt_key HEX
+//	    tenant NAME[:MAX_IN_FLIGHT[:RATE_LIMIT]]...
+//	    cert_tenant IDENTITY:TENANT...
+//	    rate_limit QUERIES_PER_SECOND [BURST]
+//	    allow CIDR...
+//	    deny CIDR...
+//	    response cname[:TARGET]|a:ADDRESS[,ADDRESS...]|nxdomain|nodata|stealth[:MINTTL-MAXTTL]
+//	    ttl SECONDS
+//	    type_ttl TYPE=SECONDS...
+//	    negative_ttl SECONDS
+//	    webhook URL
+//	    out_file PATH
+//	    raw_payloads
+//	    query_log PATH
+//	    query_log_hash_key KEY
+//	    alert_window DURATION
+//	    alert_new_ids COUNT
+//	    alert_client_queries COUNT
+//	    alert_entropy BITS
+//	    alert_file PATH
+//	    alert_webhook URL
+//	}
+//
+// The domains default to the zones of the server block. Each property matches the flag of the
+// browsertunnel command with the same name in camelCase.
+type options struct {
+	config   tunnel.Config
+	webhooks []string
+	outFile  string
+	raw      bool
+	queryLog string
+	hashKey  string
+	// alertFile and alertWebhook are where the alerts of config.Anomalies are delivered, on top of
+	// being logged.
+	alertFile    string
+	alertWebhook string
+}
+
+func setup(c *caddy.Controller) error {
+	opts, err := parse(c)
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+	sinks, err := opts.sinks()
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+	var queryLog *sink.QueryLog
+	if opts.queryLog != "" {
+		queryLog, err = sink.NewQueryLog(sink.QueryLogConfig{File: sink.FileConfig{Path: opts.queryLog}, HashKey: []byte(opts.hashKey)}, nil)
+		if err != nil {
+			return plugin.Error(pluginName, err)
+		}
+		opts.config.QueryLog = queryLog
+	}
+	alertSinks, alertFile, err := opts.alertSinks()
+	if err != nil {
+		if queryLog != nil {
+			queryLog.Close()
+		}
+		return plugin.Error(pluginName, err)
+	}
+	bt, err := newBrowsertunnel(opts.config, sinks, alertSinks)
+	if err != nil {
+		if queryLog != nil {
+			queryLog.Close()
+		}
+		if alertFile != nil {
+			alertFile.Close()
+		}
+		return plugin.Error(pluginName, err)
+	}
+	c.OnShutdown(bt.close)
+	if queryLog != nil {
+		c.OnShutdown(queryLog.Close)
+	}
+	if alertFile != nil {
+		c.OnShutdown(alertFile.Close)
+	}
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		bt.Next = next
+		return bt
+	})
+	return nil
+}
+
+func parse(c *caddy.Controller) (options, error) {
+	var opts options
+	cfg := &opts.config
+	ttl, negativeTTL := -1, -1
+	var typeTTLs map[uint16]uint32
+	var tenantExpirations map[string]tunnel.ExpirationPolicy
+	for i := 0; c.Next(); i++ {
+		if i > 0 {
+			return opts, plugin.ErrOnce
+		}
+		domains := c.RemainingArgs()
+		if len(domains) == 0 {
+			domains = c.ServerBlockKeys
+		}
+		for _, d := range domains {
+			cfg.TopDomains = append(cfg.TopDomains, plugin.Host(d).NormalizeExact()...)
+		}
+
+		for c.NextBlock() {
+			var err error
+			switch prop := c.Val(); prop {
+			case "expiration":
+				cfg.Expiration, err = durationArg(c)
+			case "domain_expiration", "tenant_expiration":
+				name, p, err := expirationArgs(c)
+				if err != nil {
+					return opts, err
+				}
+				if prop == "domain_expiration" {
+					if cfg.DomainExpirations == nil {
+						cfg.DomainExpirations = make(map[string]tunnel.ExpirationPolicy)
+					}
+					cfg.DomainExpirations[name] = p
+				} else {
+					if tenantExpirations == nil {
+						tenantExpirations = make(map[string]tunnel.ExpirationPolicy)
+					}
+					tenantExpirations[strings.ToLower(name)] = p
+				}
+			case "max_message_size":
+				cfg.MaxMessageSize, err = intArg(c)
+			case "strict":
+				err = noArgs(c)
+				cfg.Strict = true
+			case "encoding":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.ArgErr()
+				}
+				for _, arg := range args {
+					domain, e, ok := strings.Cut(arg, "=")
+					if !ok || domain == "" || e == "" {
+						return opts, fmt.Errorf("Invalid encoding %q, expected DOMAIN=ENCODING", arg)
+					}
+					if cfg.Encodings == nil {
+						cfg.Encodings = make(map[string]tunnel.Encoding)
+					}
+					cfg.Encodings[domain] = tunnel.Encoding(e)
+				}
+			case "acks":
+				err = noArgs(c)
+				cfg.Acks = true
+			case "dedup_window":
+				cfg.DedupWindow, err = durationArg(c)
+			case "hmac_key":
+				var key string
+				key, err = stringArg(c)
+				cfg.HMACKey = []byte(key)
+			case "auth_token":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.ArgErr()
+				}
+				cfg.AuthTokens = append(cfg.AuthTokens, args...)
+			case "auth_token_key":
+				var key string
+				key, err = stringArg(c)
+				cfg.AuthTokenKey = []byte(key)
+			case "api_key":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.ArgErr()
+				}
+				for _, arg := range args {
+					k, err := tunnel.ParseAPIKey(arg)
+					if err != nil {
+						return opts, fmt.Errorf("Invalid api_key: %w", err)
+					}
+					cfg.APIKeys = append(cfg.APIKeys, k)
+				}
+			case "decrypt_key":
+				var key string
+				if key, err = stringArg(c); err == nil {
+					if cfg.DecryptKey, err = hex.DecodeString(key); err != nil {
+						err = fmt.Errorf("Invalid decrypt_key: %w", err)
+					}
+				}
+			case "tenant":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.ArgErr()
+				}
+				for _, arg := range args {
+					t, err := tunnel.ParseTenant(arg)
+					if err != nil {
+						return opts, fmt.Errorf("Invalid tenant: %w", err)
+					}
+					cfg.Tenants = append(cfg.Tenants, t)
+				}
+			case "cert_tenant":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.ArgErr()
+				}
+				certTenants, err := tunnel.ParseCertTenants(args)
+				if err != nil {
+					return opts, fmt.Errorf("Invalid cert_tenant: %w", err)
+				}
+				if cfg.CertTenants == nil {
+					cfg.CertTenants = make(map[string]string)
+				}
+				for identity, tenant := range certTenants {
+					cfg.CertTenants[identity] = tenant
+				}
+			case "rate_limit":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return opts, c.ArgErr()
+				}
+				if cfg.RateLimit, err = strconv.ParseFloat(args[0], 64); err != nil {
+					return opts, fmt.Errorf("Invalid rate_limit: %w", err)
+				}
+				if len(args) == 2 {
+					if cfg.RateBurst, err = strconv.Atoi(args[1]); err != nil {
+						return opts, fmt.Errorf("Invalid rate_limit burst: %w", err)
+					}
+				}
+			case "allow", "deny":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.ArgErr()
+				}
+				cidrs, err := tunnel.ParseCIDRs(args)
+				if err != nil {
+					return opts, fmt.Errorf("Invalid %s: %w", prop, err)
+				}
+				if prop == "allow" {
+					cfg.AllowCIDRs = append(cfg.AllowCIDRs, cidrs...)
+				} else {
+					cfg.DenyCIDRs = append(cfg.DenyCIDRs, cidrs...)
+				}
+			case "response":
+				var spec string
+				if spec, err = stringArg(c); err == nil {
+					if cfg.Response, err = tunnel.ParseResponse(spec); err != nil {
+						err = fmt.Errorf("Invalid response: %w", err)
+					}
+				}
+			case "ttl":
+				if ttl, err = intArg(c); err == nil && ttl < 0 {
+					err = fmt.Errorf("Invalid ttl %d", ttl)
+				}
+			case "type_ttl":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.ArgErr()
+				}
+				ttls, err := tunnel.ParseTTLs(args)
+				if err != nil {
+					return opts, fmt.Errorf("Invalid type_ttl: %w", err)
+				}
+				if typeTTLs == nil {
+					typeTTLs = make(map[uint16]uint32)
+				}
+				for qtype, ttl := range ttls {
+					typeTTLs[qtype] = ttl
+				}
+			case "negative_ttl":
+				if negativeTTL, err = intArg(c); err == nil && negativeTTL < 0 {
+					err = fmt.Errorf("Invalid negative_ttl %d", negativeTTL)
+				}
+			case "nameserver":
+				var arg string
+				if arg, err = stringArg(c); err == nil {
+					var ns tunnel.Nameserver
+					if ns, err = tunnel.ParseNameserver(arg); err != nil {
+						err = fmt.Errorf("Invalid nameserver: %w", err)
+					}
+					cfg.Authority.Nameservers = append(cfg.Authority.Nameservers, ns)
+				}
+			case "hostmaster":
+				cfg.Authority.Hostmaster, err = stringArg(c)
+			case "serial":
+				var arg string
+				if arg, err = stringArg(c); err == nil {
+					var serial uint64
+					if serial, err = strconv.ParseUint(arg, 10, 32); err != nil {
+						err = c.Errf("Invalid serial %q", arg)
+					}
+					cfg.Authority.Serial = uint32(serial)
+				}
+			case "webhook":
+				var url string
+				url, err = stringArg(c)
+				opts.webhooks = append(opts.webhooks, url)
+			case "out_file":
+				opts.outFile, err = stringArg(c)
+			case "raw_payloads":
+				err = noArgs(c)
+				opts.raw = true
+			case "query_log":
+				opts.queryLog, err = stringArg(c)
+			case "query_log_hash_key":
+				opts.hashKey, err = stringArg(c)
+			case "alert_window":
+				cfg.Anomalies.Window, err = durationArg(c)
+			case "alert_new_ids":
+				cfg.Anomalies.NewMessageIDs, err = intArg(c)
+			case "alert_client_queries":
+				cfg.Anomalies.ClientQueries, err = intArg(c)
+			case "alert_entropy":
+				var arg string
+				if arg, err = stringArg(c); err == nil {
+					if cfg.Anomalies.Entropy, err = strconv.ParseFloat(arg, 64); err != nil {
+						err = c.Errf("Invalid alert_entropy %q", arg)
+					}
+				}
+			case "alert_file":
+				opts.alertFile, err = stringArg(c)
+			case "alert_webhook":
+				opts.alertWebhook, err = stringArg(c)
+			default:
+				return opts, c.Errf("Unknown property %q", prop)
+			}
+			if err != nil {
+				return opts, err
+			}
+		}
+	}
+	// Tenants may be listed after their expiration.
+	for name, p := range tenantExpirations {
+		i := slices.IndexFunc(cfg.Tenants, func(t tunnel.Tenant) bool { return strings.EqualFold(t.Name, name) })
+		if i < 0 {
+			return opts, fmt.Errorf("Invalid tenant_expiration: tenant %s is not configured", name)
+		}
+		cfg.Tenants[i].ExpirationPolicy = p
+	}
+	if ttl >= 0 {
+		cfg.Response.TTL = uint32(ttl)
+	}
+	cfg.Response.TTLs = typeTTLs
+	if negativeTTL >= 0 {
+		cfg.Response.NegativeTTL = uint32(negativeTTL)
+	}
+	if opts.hashKey != "" && opts.queryLog == "" {
+		return opts, fmt.Errorf("query_log_hash_key requires query_log")
+	}
+	if a := cfg.Anomalies; (opts.alertFile != "" || opts.alertWebhook != "") && a.NewMessageIDs <= 0 && a.ClientQueries <= 0 && a.Entropy <= 0 {
+		return opts, fmt.Errorf("alert_file and alert_webhook require alert_new_ids, alert_client_queries or alert_entropy")
+	}
+	return opts, nil
+}
+
+// sinks returns the sinks that messages are delivered to.
+func (opts options) sinks() ([]sink.Named, error) {
+	var sinks []sink.Named
+	for i, url := range opts.webhooks {
+		sinks = append(sinks, sink.Named{Name: fmt.Sprintf("webhook-%d", i), Sink: &sink.Webhook{URL: url, Raw: opts.raw}})
+	}
+	if opts.outFile != "" {
+		file, err := sink.NewFile(sink.FileConfig{Path: opts.outFile})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.Named{Name: "file", Sink: file})
+	}
+	return sinks, nil
+}
+
+// alertSinks returns the sinks that alerts are delivered to, and the file, if any, for setup to
+// close.
+func (opts options) alertSinks() ([]sink.AlertSink, *sink.File, error) {
+	var sinks []sink.AlertSink
+	var file *sink.File
+	if opts.alertFile != "" {
+		var err error
+		if file, err = sink.NewFile(sink.FileConfig{Path: opts.alertFile}); err != nil {
+			return nil, nil, err
+		}
+		sinks = append(sinks, file)
+	}
+	if opts.alertWebhook != "" {
+		sinks = append(sinks, &sink.Webhook{URL: opts.alertWebhook})
+	}
+	return sinks, file, nil
+}
+
+func noArgs(c *caddy.Controller) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	return nil
+}
+
+func stringArg(c *caddy.Controller) (string, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return "", c.ArgErr()
+	}
+	return args[0], nil
+}
+
+func intArg(c *caddy.Controller) (int, error) {
+	s, err := stringArg(c)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, c.Errf("Invalid number %q", s)
+	}
+	return n, nil
+}
+
+// expirationArgs parses the arguments of domain_expiration and tenant_expiration: a domain or
+// tenant, its expiration, and optionally its deletion interval.
+func expirationArgs(c *caddy.Controller) (string, tunnel.ExpirationPolicy, error) {
+	var p tunnel.ExpirationPolicy
+	args := c.RemainingArgs()
+	if len(args) < 2 || len(args) > 3 {
+		return "", p, c.ArgErr()
+	}
+	var err error
+	if p.Expiration, err = time.ParseDuration(args[1]); err != nil {
+		return "", p, c.Errf("Invalid duration %q", args[1])
+	}
+	if len(args) == 3 {
+		if p.DeletionInterval, err = time.ParseDuration(args[2]); err != nil {
+			return "", p, c.Errf("Invalid duration %q", args[2])
+		}
+	}
+	return args[0], p, nil
+}
+
+func durationArg(c *caddy.Controller) (time.Duration, error) {
+	s, err := stringArg(c)
+	if err != nil {
+		return 0, err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, c.Errf("Invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,153 @@
+package browsertunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		keys     []string
+		expected options
+	}{
+		{
+			input:    `browsertunnel`,
+			keys:     []string{"t1.example.com:53"},
+			expected: options{config: tunnel.Config{TopDomains: []string{"t1.example.com."}}},
+		},
+		{
+			input: `browsertunnel t1.example.com T2.example.com {
+				expiration 2m
+				domain_expiration t2.example.com 10s 1s
+				tenant_expiration beta 30m
+				max_message_size 10000
+				strict
+				encoding t2.example.com=base32hex
+				acks
+				dedup_window 5m
+				hmac_key secret
+				auth_token k3y-one k3y-two
+				auth_token_key tokens
+				api_key ci:k3y-ci:alpha:100:50000
+				decrypt_key 000102030405060708090a0b0c0d0e0f
+				tenant alpha beta:10:2.5
+				cert_tenant ci.example.com:alpha
+				rate_limit 20 40
+				response nxdomain
+				ttl 30
+				type_ttl AAAA=3600 txt=0
+				negative_ttl 60
+				nameserver ns.t1.example.com=192.0.2.53
+				nameserver ns2.example.net
+				hostmaster admin.example.com
+				serial 2024
+				webhook https://example.com/hook
+				webhook https://example.org/hook
+				out_file /tmp/messages.jsonl
+				raw_payloads
+				query_log /tmp/queries.jsonl
+				query_log_hash_key pepper
+				alert_window 30s
+				alert_new_ids 100
+				alert_client_queries 500
+				alert_entropy 3.5
+				alert_file /tmp/alerts.jsonl
+				alert_webhook https://example.com/alerts
+			}`,
+			keys: []string{"example.com"},
+			expected: options{
+				config: tunnel.Config{
+					TopDomains:        []string{"t1.example.com.", "t2.example.com."},
+					Expiration:        2 * time.Minute,
+					DomainExpirations: map[string]tunnel.ExpirationPolicy{"t2.example.com": {Expiration: 10 * time.Second, DeletionInterval: time.Second}},
+					MaxMessageSize:    10000,
+					Strict:            true,
+					Encodings:         map[string]tunnel.Encoding{"t2.example.com": tunnel.EncodingBase32Hex},
+					Acks:              true,
+					DedupWindow:       5 * time.Minute,
+					HMACKey:           []byte("secret"),
+					AuthTokens:        []string{"k3y-one", "k3y-two"},
+					AuthTokenKey:      []byte("tokens"),
+					APIKeys:           []tunnel.APIKey{{Name: "ci", Token: "k3y-ci", Tenant: "alpha", MessagesPerHour: 100, BytesPerDay: 50000}},
+					DecryptKey:        []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+					Tenants:           []tunnel.Tenant{{Name: "alpha"}, {Name: "beta", MaxInFlight: 10, RateLimit: 2.5, ExpirationPolicy: tunnel.ExpirationPolicy{Expiration: 30 * time.Minute}}},
+					CertTenants:       map[string]string{"ci.example.com": "alpha"},
+					RateLimit:         20,
+					RateBurst:         40,
+					Response:          tunnel.Response{Mode: tunnel.ResponseNXDomain, TTL: 30, TTLs: map[uint16]uint32{dns.TypeAAAA: 3600, dns.TypeTXT: 0}, NegativeTTL: 60},
+					Authority: tunnel.Authority{
+						Nameservers: []tunnel.Nameserver{{Name: "ns.t1.example.com", Addresses: []net.IP{net.ParseIP("192.0.2.53")}}, {Name: "ns2.example.net"}},
+						Hostmaster:  "admin.example.com",
+						Serial:      2024,
+					},
+					Anomalies: tunnel.AnomalyConfig{Window: 30 * time.Second, NewMessageIDs: 100, ClientQueries: 500, Entropy: 3.5},
+				},
+				webhooks:     []string{"https://example.com/hook", "https://example.org/hook"},
+				outFile:      "/tmp/messages.jsonl",
+				raw:          true,
+				queryLog:     "/tmp/queries.jsonl",
+				hashKey:      "pepper",
+				alertFile:    "/tmp/alerts.jsonl",
+				alertWebhook: "https://example.com/alerts",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		c.ServerBlockKeys = test.keys
+		opts, err := parse(c)
+		require.Nil(t, err, test.input)
+		require.Equal(t, test.expected, opts, test.input)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	inputs := []string{
+		"browsertunnel {\nexpiration\n}",
+		"browsertunnel {\nexpiration soon\n}",
+		"browsertunnel {\ndomain_expiration t1.example.com\n}",
+		"browsertunnel {\ndomain_expiration t1.example.com 10s often\n}",
+		"browsertunnel {\ntenant alpha\ntenant_expiration beta 10s\n}",
+		"browsertunnel {\nmax_message_size big\n}",
+		"browsertunnel {\nacks please\n}",
+		"browsertunnel {\ndecrypt_key xyz\n}",
+		"browsertunnel {\ntenant\n}",
+		"browsertunnel {\nnameserver ns.t1.example.com=nope\n}",
+		"browsertunnel {\nserial -1\n}",
+		"browsertunnel {\nrate_limit 1 2 3\n}",
+		"browsertunnel {\nallow 10.0.0.0\n}",
+		"browsertunnel {\nresponse bogus\n}",
+		"browsertunnel {\nttl -1\n}",
+		"browsertunnel {\ntype_ttl AAAA\n}",
+		"browsertunnel {\nnegative_ttl -1\n}",
+		"browsertunnel {\ncert_tenant ci\n}",
+		"browsertunnel {\nquery_log_hash_key pepper\n}",
+		"browsertunnel {\nalert_entropy high\n}",
+		"browsertunnel {\nalert_file /tmp/alerts.jsonl\n}",
+		"browsertunnel {\nunknown\n}",
+		"browsertunnel\nbrowsertunnel",
+	}
+	for _, input := range inputs {
+		c := caddy.NewTestController("dns", input)
+		c.ServerBlockKeys = []string{"t1.example.com"}
+		_, err := parse(c)
+		require.NotNil(t, err, input)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("dns", "browsertunnel t1.example.com {\nacks\n}")
+	require.Nil(t, setup(c))
+
+	c = caddy.NewTestController("dns", "browsertunnel {\nmax_message_size -1\n}")
+	c.ServerBlockKeys = []string{"t1.example.com"}
+	require.NotNil(t, setup(c))
+}
@@ -0,0 +1,26 @@
+// Command coredns is CoreDNS with the browsertunnel plugin compiled in, along with the plugins
+// of the standard distribution.
+package main
+
+import (
+	"github.com/coredns/coredns/core/dnsserver"
+	_ "github.com/coredns/coredns/core/plugin"
+	"github.com/coredns/coredns/coremain"
+	_ "github.com/veggiedefender/browsertunnel/coredns/browsertunnel"
+)
+
+func init() {
+	// The browsertunnel plugin runs ahead of cache, so that every query reaches the tunnel
+	// instead of being answered from the cache, and after plugins such as log and acl.
+	for i, d := range dnsserver.Directives {
+		if d == "cache" {
+			dnsserver.Directives = append(dnsserver.Directives[:i], append([]string{"browsertunnel"}, dnsserver.Directives[i:]...)...)
+			return
+		}
+	}
+	dnsserver.Directives = append(dnsserver.Directives, "browsertunnel")
+}
+
+func main() {
+	coremain.Run()
+}
@@ -0,0 +1,404 @@
+// Package admin serves an HTTP API to inspect and manage a running tunnel. Every request must
+// carry the token of the server as a bearer token. Responses are JSON:
+//
+//	GET    /partials              partial messages in flight
+//	DELETE /partials/<id>         expire a partial message, with ?tenant=<name> if tenants are configured
+//	GET    /clients               counters and reassembly statistics of each source IP that queried the tunnel recently
+//	GET    /liveness              latest heartbeat of each client ID seen recently
+//	GET    /keys                  quota usage of each API key
+//	GET    /queries               queries replied to by type, top domain and response code
+//	GET    /config                effective configuration, with secrets redacted
+//	POST   /replay                deliver stored messages to a sink again, if replay is enabled
+//	GET    /sinks                 delivery counters, timeout and circuit breaker state of each sink, if enabled
+//	GET    /progress              WebSocket stream of the progress of partial messages, if enabled
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/store"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// DefaultReplayLimit is the maximum number of messages a replay request that doesn't set a limit
+// may select.
+const DefaultReplayLimit = 10000
+
+// A MessageStore queries stored messages, as implemented by store.SQLite.
+type MessageStore interface {
+	Query(ctx context.Context, q store.Query) ([]tunnel.Message, error)
+}
+
+// A Replayer delivers a message to a single sink, as implemented by sink.Fanout.
+type Replayer interface {
+	Replay(ctx context.Context, sink string, msg tunnel.Message) error
+}
+
+// A SinkReporter reports the status of the sinks of a tunnel, as implemented by sink.Fanout.
+type SinkReporter interface {
+	Status() []sink.SinkStatus
+}
+
+// A Server is an http.Handler serving the admin API of a tunnel.
+type Server struct {
+	tunnel *tunnel.Tunnel
+	token  string
+	config func() map[string]string
+
+	messages MessageStore
+	sinks    Replayer
+	status   SinkReporter
+	progress *progressHub
+}
+
+// New creates an admin API for tun, authenticated with token. config returns the effective
+// configuration reported at /config, which must not hold secrets.
+func New(tun *tunnel.Tunnel, token string, config func() map[string]string) (*Server, error) {
+	if token == "" {
+		return nil, errors.New("The admin API requires a token")
+	}
+	return &Server{tunnel: tun, token: token, config: config}, nil
+}
+
+// EnableReplay serves POST /replay, which delivers messages selected from messages to one of
+// sinks again, e.g. after an outage of the sink or to backfill a new consumer. The request is a
+// JSON object naming the sink, and selecting messages by the time their last fragment was received
+// in [since, until), as RFC 3339 timestamps, and by ids. A request must select by time or IDs, and
+// fails if it selects more than limit messages, DefaultReplayLimit by default. Messages are
+// replayed oldest first, and the response counts those replayed and those that failed.
+func (s *Server) EnableReplay(messages MessageStore, sinks Replayer) {
+	s.messages, s.sinks = messages, sinks
+}
+
+// EnableSinks serves GET /sinks, which reports the status of each sink of sinks.
+func (s *Server) EnableSinks(sinks SinkReporter) {
+	s.status = sinks
+}
+
+// partial is the JSON encoding of a tunnel.PartialMessage.
+type partial struct {
+	ID            string    `json:"id"`
+	Tenant        string    `json:"tenant,omitempty"`
+	TotalSize     int       `json:"total_size"`
+	Received      int       `json:"received"`
+	Missing       []span    `json:"missing"`
+	Fragments     int       `json:"fragments"`
+	FirstFragment time.Time `json:"first_fragment"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// span is the JSON encoding of a tunnel.Range.
+type span struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+// client is the JSON encoding of the tunnel.ClientStats of a source.
+type client struct {
+	IP        string    `json:"ip"`
+	Queries   uint64    `json:"queries"`
+	Fragments uint64    `json:"fragments"`
+	Messages  uint64    `json:"messages"`
+	Bytes     uint64    `json:"bytes"`
+	LastSeen  time.Time `json:"last_seen"`
+	// MeanFragments and MeanReassemblySeconds are the mean number of fragments of the
+	// messages assembled, and the mean time between their first and last fragments.
+	MeanFragments         float64 `json:"mean_fragments"`
+	MeanReassemblySeconds float64 `json:"mean_reassembly_seconds"`
+}
+
+// liveness is the JSON encoding of the tunnel.Liveness of a client ID.
+type liveness struct {
+	ClientID   string    `json:"client_id"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	LastSeen   time.Time `json:"last_seen"`
+	Heartbeats uint64    `json:"heartbeats"`
+	Polls      uint64    `json:"polls"`
+}
+
+// apiKey is the JSON encoding of the tunnel.APIKeyStats of a key.
+type apiKey struct {
+	Name            string    `json:"name"`
+	Tenant          string    `json:"tenant,omitempty"`
+	MessagesPerHour int       `json:"messages_per_hour"`
+	BytesPerDay     int       `json:"bytes_per_day"`
+	Messages        int       `json:"messages"`
+	Bytes           int       `json:"bytes"`
+	HourEnds        time.Time `json:"hour_ends"`
+	DayEnds         time.Time `json:"day_ends"`
+	Fragments       uint64    `json:"fragments"`
+	OverQuota       uint64    `json:"over_quota"`
+}
+
+// replayRequest is the JSON request to /replay.
+type replayRequest struct {
+	Sink  string    `json:"sink"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	IDs   []string  `json:"ids"`
+	Limit int       `json:"limit"`
+}
+
+// replayResult is the JSON response to /replay. Error is the error of the first message that
+// failed, if any.
+type replayResult struct {
+	Replayed int    `json:"replayed"`
+	Failed   int    `json:"failed"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sinkStatus is the JSON encoding of a sink.SinkStatus. The breaker fields are only set if the
+// sink has a circuit breaker.
+type sinkStatus struct {
+	Name           string     `json:"name"`
+	Delivered      uint64     `json:"delivered"`
+	Failed         uint64     `json:"failed"`
+	Queued         int        `json:"queued"`
+	TimeoutSeconds float64    `json:"timeout_seconds,omitempty"`
+	Timeouts       uint64     `json:"timeouts"`
+	Breaker        string     `json:"breaker,omitempty"`
+	OpenUntil      *time.Time `json:"open_until,omitempty"`
+	Trips          uint64     `json:"trips,omitempty"`
+	Rejected       uint64     `json:"rejected,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// queryCount is the JSON encoding of a count of tunnel.Stats.QueryCounts.
+type queryCount struct {
+	QType  string `json:"qtype"`
+	Domain string `json:"domain"`
+	Rcode  string `json:"rcode"`
+	Count  uint64 `json:"count"`
+}
+
+// RequireToken returns an http.Handler passing the requests that carry token as a bearer token on
+// to next, and answering the others with 401 Unauthorized, as the admin API does. It guards other
+// endpoints that expose messages, such as the dashboard and the message API. token must not be
+// empty.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r, token) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorized reports whether r carries token as a bearer token, and answers it with 401
+// Unauthorized otherwise.
+func authorized(w http.ResponseWriter, r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="browsertunnel"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r, s.token) {
+		return
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/partials" && r.Method == http.MethodGet:
+		s.listPartials(w)
+	case strings.HasPrefix(path, "/partials/") && r.Method == http.MethodDelete:
+		s.expire(w, strings.TrimPrefix(path, "/partials/"), r.URL.Query().Get("tenant"))
+	case path == "/clients" && r.Method == http.MethodGet:
+		s.listClients(w)
+	case path == "/liveness" && r.Method == http.MethodGet:
+		s.listLiveness(w)
+	case path == "/keys" && r.Method == http.MethodGet:
+		s.listKeys(w)
+	case path == "/queries" && r.Method == http.MethodGet:
+		s.listQueries(w)
+	case path == "/replay" && r.Method == http.MethodPost && s.messages != nil:
+		s.replay(w, r)
+	case path == "/sinks" && r.Method == http.MethodGet && s.status != nil:
+		s.listSinks(w)
+	case path == "/progress" && r.Method == http.MethodGet && s.progress != nil:
+		s.progress.ServeHTTP(w, r)
+	case path == "/config" && r.Method == http.MethodGet:
+		config := map[string]string{}
+		if s.config != nil {
+			config = s.config()
+		}
+		writeJSON(w, config)
+	case path == "/partials" || strings.HasPrefix(path, "/partials/") || path == "/clients" || path == "/liveness" || path == "/keys" || path == "/queries" || path == "/config" || path == "/replay" && s.messages != nil || path == "/sinks" && s.status != nil || path == "/progress" && s.progress != nil:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) listPartials(w http.ResponseWriter) {
+	partials := []partial{}
+	for _, p := range s.tunnel.Partials() {
+		missing := []span{}
+		for _, r := range p.Missing {
+			missing = append(missing, span{Offset: r.Offset, Length: r.Length})
+		}
+		partials = append(partials, partial{
+			ID:            p.ID,
+			Tenant:        p.Tenant,
+			TotalSize:     p.TotalSize,
+			Received:      p.Received,
+			Missing:       missing,
+			Fragments:     p.Fragments,
+			FirstFragment: p.FirstFragment,
+			ExpiresAt:     p.ExpiresAt,
+		})
+	}
+	writeJSON(w, partials)
+}
+
+func (s *Server) expire(w http.ResponseWriter, id, tenant string) {
+	if !s.tunnel.Expire(tenant, id) {
+		http.Error(w, "no such partial message", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listClients(w http.ResponseWriter) {
+	clients := []client{}
+	for ip, c := range s.tunnel.ClientStats() {
+		cl := client{IP: ip, Queries: c.Queries, Fragments: c.Fragments, Messages: c.Messages, Bytes: c.Bytes, LastSeen: c.LastSeen}
+		if c.Messages > 0 {
+			cl.MeanFragments = float64(c.MessageFragments) / float64(c.Messages)
+			cl.MeanReassemblySeconds = c.Reassembly.Seconds() / float64(c.Messages)
+		}
+		clients = append(clients, cl)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].IP < clients[j].IP })
+	writeJSON(w, clients)
+}
+
+func (s *Server) listLiveness(w http.ResponseWriter) {
+	clients := []liveness{}
+	for id, l := range s.tunnel.Liveness() {
+		c := liveness{ClientID: id, Tenant: l.Tenant, LastSeen: l.LastSeen, Heartbeats: l.Heartbeats, Polls: l.Polls}
+		if l.Source != nil {
+			c.Source = l.Source.String()
+		}
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ClientID < clients[j].ClientID })
+	writeJSON(w, clients)
+}
+
+func (s *Server) listKeys(w http.ResponseWriter) {
+	keys := []apiKey{}
+	for name, k := range s.tunnel.APIKeyStats() {
+		keys = append(keys, apiKey{
+			Name:            name,
+			Tenant:          k.Tenant,
+			MessagesPerHour: k.MessagesPerHour,
+			BytesPerDay:     k.BytesPerDay,
+			Messages:        k.Messages,
+			Bytes:           k.Bytes,
+			HourEnds:        k.HourEnds,
+			DayEnds:         k.DayEnds,
+			Fragments:       k.Fragments,
+			OverQuota:       k.OverQuota,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	writeJSON(w, keys)
+}
+
+func (s *Server) listQueries(w http.ResponseWriter) {
+	counts := s.tunnel.Stats().QueryCounts
+	queries := []queryCount{}
+	for _, key := range tunnel.SortedQueryKeys(counts) {
+		queries = append(queries, queryCount{QType: key.Type, Domain: key.TopDomain, Rcode: key.Rcode, Count: counts[key]})
+	}
+	writeJSON(w, queries)
+}
+
+func (s *Server) listSinks(w http.ResponseWriter) {
+	sinks := []sinkStatus{}
+	for _, st := range s.status.Status() {
+		ss := sinkStatus{
+			Name:           st.Name,
+			Delivered:      st.Delivered,
+			Failed:         st.Failed,
+			Queued:         st.Queued,
+			TimeoutSeconds: st.Timeout.Seconds(),
+			Timeouts:       st.Timeouts,
+			Breaker:        st.Breaker,
+			Trips:          st.Trips,
+			Rejected:       st.Rejected,
+		}
+		if !st.OpenUntil.IsZero() {
+			ss.OpenUntil = &st.OpenUntil
+		}
+		if st.LastError != nil {
+			ss.LastError = st.LastError.Error()
+		}
+		sinks = append(sinks, ss)
+	}
+	writeJSON(w, sinks)
+}
+
+func (s *Server) replay(w http.ResponseWriter, r *http.Request) {
+	var req replayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Sink == "" {
+		http.Error(w, "Replay requires a sink", http.StatusBadRequest)
+		return
+	}
+	if req.Since.IsZero() && req.Until.IsZero() && len(req.IDs) == 0 {
+		http.Error(w, "Replay requires since, until or ids", http.StatusBadRequest)
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = DefaultReplayLimit
+	}
+	messages, err := s.messages.Query(r.Context(), store.Query{Since: req.Since, Until: req.Until, IDs: req.IDs, Limit: req.Limit + 1})
+	if err != nil {
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+	if len(messages) > req.Limit {
+		http.Error(w, fmt.Sprintf("Replay selects more than %d messages", req.Limit), http.StatusBadRequest)
+		return
+	}
+	var result replayResult
+	for i := len(messages) - 1; i >= 0; i-- {
+		if err := s.sinks.Replay(r.Context(), req.Sink, messages[i]); err != nil {
+			if result.Failed == 0 {
+				result.Error = err.Error()
+			}
+			result.Failed++
+			continue
+		}
+		result.Replayed++
+	}
+	writeJSON(w, result)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,333 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/store"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"golang.org/x/net/websocket"
+)
+
+type testResponseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
+
+func request(t *testing.T, h http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServer(t *testing.T) {
+	tun, err := tunnel.New(tunnel.Config{TopDomain: "tunnel.example.com", Workers: 1})
+	require.Nil(t, err)
+	defer tun.Close()
+	s, err := New(tun, "secret", func() map[string]string { return map[string]string{"expiration": "60"} })
+	require.Nil(t, err)
+
+	// The first of two fragments of a message.
+	r := &dns.Msg{}
+	r.SetQuestion("abcdef.16.0.nbswy3dp.tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(&testResponseWriter{}, r)
+	require.Eventually(t, func() bool { return len(tun.Partials()) == 1 }, time.Second, time.Millisecond)
+
+	for _, token := range []string{"", "wrong"} {
+		rec := request(t, s, http.MethodGet, "/partials", token)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	rec := request(t, s, http.MethodGet, "/partials", "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var partials []partial
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &partials))
+	require.Len(t, partials, 1)
+	require.Equal(t, "abcdef", partials[0].ID)
+	require.Equal(t, 16, partials[0].TotalSize)
+	require.Equal(t, 8, partials[0].Received)
+	require.Equal(t, []span{{Offset: 8, Length: 8}}, partials[0].Missing)
+	require.True(t, partials[0].ExpiresAt.After(time.Now()))
+
+	rec = request(t, s, http.MethodGet, "/clients", "secret")
+	var clients []client
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &clients))
+	require.Len(t, clients, 1)
+	require.Equal(t, "192.0.2.1", clients[0].IP)
+	require.EqualValues(t, 1, clients[0].Queries)
+	require.EqualValues(t, 1, clients[0].Fragments)
+	require.Zero(t, clients[0].MeanFragments)
+
+	r = &dns.Msg{}
+	r.SetQuestion(tunnel.EncodeHeartbeat("tunnel.example.com", "c1", "x7f2"), dns.TypeTXT)
+	tun.ServeDNS(&testResponseWriter{}, r)
+	rec = request(t, s, http.MethodGet, "/liveness", "secret")
+	var live []liveness
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &live))
+	require.Len(t, live, 1)
+	require.Equal(t, "c1", live[0].ClientID)
+	require.Equal(t, "192.0.2.1", live[0].Source)
+	require.EqualValues(t, 1, live[0].Heartbeats)
+
+	r = &dns.Msg{}
+	r.SetQuestion("www.example.org.", dns.TypeA)
+	tun.ServeDNS(&testResponseWriter{}, r)
+	rec = request(t, s, http.MethodGet, "/queries", "secret")
+	var queries []queryCount
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &queries))
+	require.Equal(t, []queryCount{
+		{QType: "A", Domain: "", Rcode: "NOERROR", Count: 1},
+		{QType: "A", Domain: "tunnel.example.com.", Rcode: "NOERROR", Count: 1},
+		{QType: "TXT", Domain: "tunnel.example.com.", Rcode: "NOERROR", Count: 1},
+	}, queries)
+
+	rec = request(t, s, http.MethodGet, "/config", "secret")
+	require.JSONEq(t, `{"expiration": "60"}`, rec.Body.String())
+
+	rec = request(t, s, http.MethodDelete, "/partials/abcdef", "secret")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, "abcdef", (<-tun.Expired()).ID)
+	rec = request(t, s, http.MethodDelete, "/partials/abcdef", "secret")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = request(t, s, http.MethodPost, "/clients", "secret")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = request(t, s, http.MethodGet, "/nope", "secret")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestNewRequiresToken(t *testing.T) {
+	_, err := New(nil, "", nil)
+	require.NotNil(t, err)
+}
+
+func TestRequireToken(t *testing.T) {
+	h := RequireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	require.Equal(t, http.StatusNoContent, request(t, h, http.MethodGet, "/messages", "secret").Code)
+	for _, token := range []string{"", "wrong"} {
+		rec := request(t, h, http.MethodGet, "/messages", token)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		require.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tun, err := tunnel.New(tunnel.Config{
+		TopDomain: "tunnel.example.com",
+		Workers:   1,
+		APIKeys:   []tunnel.APIKey{{Name: "ci", Token: "k3y", MessagesPerHour: 10}, {Name: "batch", Token: "b4tch", BytesPerDay: 1000}},
+	})
+	require.Nil(t, err)
+	defer tun.Close()
+	s, err := New(tun, "secret", nil)
+	require.Nil(t, err)
+
+	r := &dns.Msg{}
+	r.SetQuestion("v2-40.k3y.abcdef.16.0.nbswy3dp.tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(&testResponseWriter{}, r)
+	require.Eventually(t, func() bool { return len(tun.Partials()) == 1 }, time.Second, time.Millisecond)
+
+	rec := request(t, s, http.MethodGet, "/keys", "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var keys []apiKey
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &keys))
+	require.Len(t, keys, 2)
+	require.Equal(t, "batch", keys[0].Name)
+	require.Equal(t, 1000, keys[0].BytesPerDay)
+	require.Equal(t, "ci", keys[1].Name)
+	require.Equal(t, 1, keys[1].Messages)
+	require.Equal(t, 8, keys[1].Bytes)
+	require.EqualValues(t, 1, keys[1].Fragments)
+	require.True(t, keys[1].HourEnds.After(time.Now()))
+
+	rec = request(t, s, http.MethodPost, "/keys", "secret")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+// replayer is a Replayer recording the IDs of the messages replayed to each sink, failing for IDs
+// in fail.
+type replayer struct {
+	ids  map[string][]string
+	fail map[string]bool
+}
+
+func (r *replayer) Replay(ctx context.Context, sink string, msg tunnel.Message) error {
+	if r.fail[msg.ID] {
+		return fmt.Errorf("failed to deliver %s", msg.ID)
+	}
+	r.ids[sink] = append(r.ids[sink], msg.ID)
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	tun, err := tunnel.New(tunnel.Config{TopDomain: "tunnel.example.com", Workers: 1})
+	require.Nil(t, err)
+	defer tun.Close()
+	s, err := New(tun, "secret", nil)
+	require.Nil(t, err)
+	rec := request(t, s, http.MethodPost, "/replay", "secret")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	db, err := store.OpenSQLite(filepath.Join(t.TempDir(), "messages.db"))
+	require.Nil(t, err)
+	defer db.Close()
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"m1", "m2", "m3", "m4"} {
+		at := start.Add(time.Duration(i) * time.Minute)
+		require.Nil(t, db.Deliver(context.Background(), tunnel.Message{ID: id, Payload: []byte(id), FirstFragment: at, LastFragment: at}))
+	}
+	sinks := &replayer{ids: map[string][]string{}, fail: map[string]bool{"m3": true}}
+	s.EnableReplay(db, sinks)
+	replay := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/replay", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Messages are replayed oldest first, and failures are counted.
+	rec = replay(`{"sink": "webhook", "since": "2020-06-01T12:01:00Z", "until": "2020-06-01T12:10:00Z"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"replayed": 2, "failed": 1, "error": "failed to deliver m3"}`, rec.Body.String())
+	require.Equal(t, []string{"m2", "m4"}, sinks.ids["webhook"])
+	rec = replay(`{"sink": "kafka", "ids": ["m1", "m4", "m9"]}`)
+	require.JSONEq(t, `{"replayed": 2, "failed": 0}`, rec.Body.String())
+	require.Equal(t, []string{"m1", "m4"}, sinks.ids["kafka"])
+
+	for _, body := range []string{
+		`{"since": "2020-06-01T12:00:00Z"}`,
+		`{"sink": "webhook"}`,
+		`{"sink": "webhook", "since": "2020-06-01T12:00:00Z", "limit": 3}`,
+		`{"sink": "webhook", "since": "yesterday"}`,
+	} {
+		rec = replay(body)
+		require.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+	rec = request(t, s, http.MethodGet, "/replay", "secret")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+// reporter is a SinkReporter reporting fixed statuses.
+type reporter []sink.SinkStatus
+
+func (r reporter) Status() []sink.SinkStatus {
+	return r
+}
+
+func TestSinks(t *testing.T) {
+	tun, err := tunnel.New(tunnel.Config{TopDomain: "tunnel.example.com", Workers: 1})
+	require.Nil(t, err)
+	defer tun.Close()
+	s, err := New(tun, "secret", nil)
+	require.Nil(t, err)
+	rec := request(t, s, http.MethodGet, "/sinks", "secret")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	openUntil := time.Date(2020, 6, 1, 12, 0, 30, 0, time.UTC)
+	s.EnableSinks(reporter{
+		{Name: "file", Delivered: 4},
+		{
+			Name: "webhook", Delivered: 2, Failed: 5, Queued: 3, Timeout: 2 * time.Second, Timeouts: 3,
+			Breaker: sink.BreakerOpen, OpenUntil: openUntil, Trips: 1, Rejected: 2, LastError: fmt.Errorf("timed out"),
+		},
+	})
+	rec = request(t, s, http.MethodGet, "/sinks", "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `[
+		{"name": "file", "delivered": 4, "failed": 0, "queued": 0, "timeouts": 0},
+		{"name": "webhook", "delivered": 2, "failed": 5, "queued": 3, "timeout_seconds": 2, "timeouts": 3,
+		 "breaker": "open", "open_until": "2020-06-01T12:00:30Z", "trips": 1, "rejected": 2, "last_error": "timed out"}
+	]`, rec.Body.String())
+	rec = request(t, s, http.MethodPost, "/sinks", "secret")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestProgress(t *testing.T) {
+	tun, err := tunnel.New(tunnel.Config{TopDomain: "tunnel.example.com", Workers: 1, Progress: true})
+	require.Nil(t, err)
+	defer tun.Close()
+	s, err := New(tun, "secret", nil)
+	require.Nil(t, err)
+
+	rec := request(t, s, http.MethodGet, "/progress", "secret")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	s.EnableProgress()
+	rec = request(t, s, http.MethodPost, "/progress", "secret")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	config, err := websocket.NewConfig(url+"/progress", server.URL)
+	require.Nil(t, err)
+	_, err = websocket.DialConfig(config)
+	require.NotNil(t, err)
+
+	config, err = websocket.NewConfig(url+"/progress?prefix=abc", server.URL)
+	require.Nil(t, err)
+	config.Header.Set("Authorization", "Bearer secret")
+	ws, err := websocket.DialConfig(config)
+	require.Nil(t, err)
+	defer ws.Close()
+	require.Eventually(t, func() bool {
+		s.progress.mu.Lock()
+		defer s.progress.mu.Unlock()
+		return len(s.progress.subscribers) == 1
+	}, time.Second, time.Millisecond)
+
+	// Messages whose ID doesn't start with the prefix aren't followed.
+	for _, name := range []string{"xyzxyz.16.0.nbswy3dp.tunnel.example.com.", "abcdef.16.0.nbswy3dp.tunnel.example.com.", "abcdef.16.8.nbswy3dp.tunnel.example.com."} {
+		r := &dns.Msg{}
+		r.SetQuestion(name, dns.TypeA)
+		tun.ServeDNS(&testResponseWriter{}, r)
+	}
+	for _, received := range []int{8, 16} {
+		var body string
+		require.Nil(t, websocket.Message.Receive(ws, &body))
+		var p progress
+		require.Nil(t, json.Unmarshal([]byte(body), &p))
+		require.Equal(t, "abcdef", p.ID)
+		require.Equal(t, received, p.Received)
+		require.Equal(t, 16, p.TotalSize)
+		require.Equal(t, received/8, p.Fragments)
+	}
+	<-tun.Messages()
+}
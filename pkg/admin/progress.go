@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"golang.org/x/net/websocket"
+)
+
+// progressBufferSize is the number of events buffered for each subscriber of /progress. Events
+// are dropped for subscribers that fall further behind.
+const progressBufferSize = 64
+
+// progress is the JSON encoding of a tunnel.ProgressEvent.
+type progress struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Received  int       `json:"received"`
+	TotalSize int       `json:"total_size"`
+	Fragments int       `json:"fragments"`
+	Time      time.Time `json:"time"`
+}
+
+// progressHub broadcasts the progress events of a tunnel to the subscribers of /progress.
+type progressHub struct {
+	mu          sync.Mutex
+	subscribers map[*progressSubscriber]struct{}
+}
+
+type progressSubscriber struct {
+	prefix string
+	tenant string
+	queue  chan []byte
+}
+
+// EnableProgress serves GET /progress, which upgrades the request to a WebSocket connection on
+// which the progress of partial messages is sent as JSON text frames, as reported on
+// tun.Progress, which must have been created with Config.Progress. The request may pass a prefix
+// query parameter to only follow messages whose ID starts with it, and a tenant query parameter
+// to only follow messages sent to that tenant. It must be called at most once, before serving
+// requests, and the server then reads every event of the tunnel until it is closed.
+func (s *Server) EnableProgress() {
+	s.progress = &progressHub{subscribers: make(map[*progressSubscriber]struct{})}
+	go s.progress.broadcast(s.tunnel.Progress())
+}
+
+// broadcast sends every event of events to the subscribers whose filters it matches, dropping it
+// for those whose buffer is full.
+func (h *progressHub) broadcast(events <-chan tunnel.ProgressEvent) {
+	for e := range events {
+		body, err := json.Marshal(progress{
+			ID:        e.ID,
+			Tenant:    e.Tenant,
+			Received:  e.Received,
+			TotalSize: e.TotalSize,
+			Fragments: e.Fragments,
+			Time:      e.Time,
+		})
+		if err != nil {
+			continue
+		}
+		h.mu.Lock()
+		for sub := range h.subscribers {
+			if !strings.HasPrefix(e.ID, sub.prefix) || sub.tenant != "" && e.Tenant != sub.tenant {
+				continue
+			}
+			select {
+			case sub.queue <- body:
+			default:
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// ServeHTTP upgrades r to a WebSocket connection and sends progress events over it until the
+// subscriber disconnects.
+func (h *progressHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sub := &progressSubscriber{prefix: query.Get("prefix"), tenant: query.Get("tenant"), queue: make(chan []byte, progressBufferSize)}
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		h.mu.Lock()
+		h.subscribers[sub] = struct{}{}
+		h.mu.Unlock()
+		defer func() {
+			h.mu.Lock()
+			delete(h.subscribers, sub)
+			h.mu.Unlock()
+		}()
+
+		// Subscribers aren't expected to send anything, but reading detects when they disconnect.
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(closed)
+		}()
+
+		for {
+			select {
+			case body := <-sub.queue:
+				if err := websocket.Message.Send(ws, string(body)); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}}.ServeHTTP(w, r)
+}
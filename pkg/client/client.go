@@ -0,0 +1,329 @@
+// Package client sends messages to a tunnel from Go programs, encoding them as DNS queries just
+// like the JavaScript client does in browsers.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+const (
+	// DefaultTimeout is how long a query waits for an answer by default.
+	DefaultTimeout = 2 * time.Second
+	// DefaultRetries is the number of times a failed query is retried by default.
+	DefaultRetries = 2
+	// DefaultPollInterval is how often idle streams poll the tunnel by default.
+	DefaultPollInterval = 200 * time.Millisecond
+	// idLen is the length of generated message IDs, as in the JavaScript client.
+	idLen = 6
+)
+
+// idAlphabet is the alphabet of generated message IDs.
+const idAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// A Client sends messages to a tunnel. The zero value is not usable; Domain must be set.
+type Client struct {
+	// Domain is the top domain of the tunnel, preceded by the tenant if tenants are configured.
+	Domain string
+
+	// Server is the address of a DNS server to send queries to directly, e.g. 127.0.0.1:53,
+	// which may be the tunnel itself or a resolver forwarding to it. Queries go through
+	// Resolver if empty.
+	Server string
+	// Net is the network used to reach Server: udp if empty, or tcp. Answers truncated over UDP
+	// are requested again over TCP.
+	Net string
+	// Resolver resolves queries if Server is empty. net.DefaultResolver is used if nil. The
+	// answers of the system resolver aren't available, so acknowledgements are ignored.
+	Resolver *net.Resolver
+
+	// Encoder encodes messages into queries. LabelLen defaults to 63. Set Encoder.Version to
+	// tunnel.Version2 and Encoder.Ack to have the tunnel acknowledge fragments, so that the
+	// fragments it reports as missing are sent again.
+	Encoder tunnel.Encoder
+	// QueryType is the type of the queries, dns.TypeTXT if zero. Acknowledgements of missing
+	// ranges are only available in answers to TXT queries.
+	QueryType uint16
+
+	// Delay is the time to wait between queries.
+	Delay time.Duration
+	// Timeout is how long each query waits for an answer. DefaultTimeout is used if 0.
+	Timeout time.Duration
+	// Retries is the number of times a failed query is retried, and the number of times the
+	// fragments acknowledged as missing are sent again. DefaultRetries is used if 0, and
+	// retries are disabled if negative.
+	Retries int
+	// StatusDelay, if set, makes SendID ask the tunnel what it is missing of a message whose
+	// fragments weren't acknowledged, StatusDelay after sending them, and send the fragments
+	// overlapping the missing ranges again, up to Retries times. It should be longer than the
+	// NackDelay of the tunnel, which must have a dedup window so that it reports the messages it
+	// delivered as complete. It requires Server.
+	StatusDelay time.Duration
+
+	// PollInterval is how often streams opened by Dial query the tunnel while neither side has
+	// anything to send. DefaultPollInterval is used if 0.
+	PollInterval time.Duration
+}
+
+// Send sends msg under a random message ID, which it returns.
+func (c *Client) Send(ctx context.Context, msg []byte) (string, error) {
+	id, err := NewID()
+	if err != nil {
+		return "", err
+	}
+	return id, c.SendID(ctx, id, msg)
+}
+
+// SendID sends msg under message ID id. It returns once every fragment was sent and, if the
+// tunnel acknowledges fragments, once the tunnel has received the whole message or the retries
+// are exhausted.
+func (c *Client) SendID(ctx context.Context, id string, msg []byte) error {
+	enc := c.Encoder
+	if enc.LabelLen == 0 {
+		enc.LabelLen = 63
+	}
+	fragments, err := enc.EncodeFragments(c.Domain, id, string(msg))
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	for _, f := range fragments {
+		total = max(total, f.Offset+f.Length)
+	}
+	pending := fragments
+	for round := 0; ; round++ {
+		var last *tunnel.Ack
+		for i, f := range pending {
+			if i > 0 && c.Delay > 0 {
+				select {
+				case <-time.After(c.Delay):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			ack, err := c.query(ctx, f.Domain)
+			if err != nil {
+				return fmt.Errorf("Failed to send fragment at offset %d: %w", f.Offset, err)
+			}
+			if ack != nil {
+				last = ack
+			}
+		}
+		if last == nil && c.StatusDelay > 0 && c.Server != "" {
+			if last, err = c.awaitStatus(ctx, id, total); err != nil {
+				return err
+			}
+		}
+		if last == nil || last.Complete() {
+			return nil
+		}
+		if round >= c.retries() {
+			return fmt.Errorf("Tunnel received %d of %d bytes of message %s", last.Received, last.Total, id)
+		}
+		pending = missingFragments(fragments, *last)
+	}
+}
+
+// Heartbeat tells the tunnel that the client identified by clientID is alive.
+func (c *Client) Heartbeat(ctx context.Context, clientID string) error {
+	nonce, err := NewID()
+	if err != nil {
+		return err
+	}
+	_, err = c.query(ctx, tunnel.EncodeHeartbeat(c.Domain, clientID, nonce))
+	return err
+}
+
+// Status asks the tunnel what it received of message id, of encoded length totalSize. The
+// acknowledgement lists the missing ranges once the message has gone without a new fragment for
+// the NackDelay of the tunnel. Status requires Server.
+func (c *Client) Status(ctx context.Context, id string, totalSize int) (tunnel.Ack, error) {
+	if c.Server == "" {
+		return tunnel.Ack{}, errors.New("Status queries require a Server")
+	}
+	nonce, err := NewID()
+	if err != nil {
+		return tunnel.Ack{}, err
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := c.ask(ctx, tunnel.EncodeStatus(c.Domain, id, totalSize, nonce), dns.TypeTXT)
+	if err != nil {
+		return tunnel.Ack{}, err
+	}
+	for _, rr := range resp.Answer {
+		if ack, err := tunnel.ParseAck(rr); err == nil {
+			return ack, nil
+		}
+	}
+	return tunnel.Ack{}, fmt.Errorf("Server responded with %s and no acknowledgement", dns.RcodeToString[resp.Rcode])
+}
+
+// awaitStatus waits c.StatusDelay and asks for the status of message id, until the tunnel
+// reports the missing ranges of the message or that it is complete, for up to c.retries() more
+// times.
+func (c *Client) awaitStatus(ctx context.Context, id string, totalSize int) (*tunnel.Ack, error) {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(c.StatusDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		ack, err := c.Status(ctx, id, totalSize)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query status of message %s: %w", id, err)
+		}
+		if ack.Nack || ack.Complete() || attempt >= c.retries() {
+			return &ack, nil
+		}
+	}
+}
+
+// missingFragments returns the fragments overlapping the ranges missing from ack. Acks list a
+// limited number of ranges, so fragments after the last listed range are included too.
+func missingFragments(fragments []tunnel.EncodedFragment, ack tunnel.Ack) []tunnel.EncodedFragment {
+	end := 0
+	if len(ack.Missing) > 0 {
+		r := ack.Missing[len(ack.Missing)-1]
+		end = r.Offset + r.Length
+	}
+	var missing []tunnel.EncodedFragment
+	for _, f := range fragments {
+		overlaps := f.Offset+f.Length > end
+		for _, r := range ack.Missing {
+			overlaps = overlaps || f.Offset < r.Offset+r.Length && r.Offset < f.Offset+f.Length
+		}
+		if overlaps {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+func (c *Client) retries() int {
+	if c.Retries == 0 {
+		return DefaultRetries
+	}
+	return max(c.Retries, 0)
+}
+
+func (c *Client) qtype() uint16 {
+	if c.QueryType == 0 {
+		return dns.TypeTXT
+	}
+	return c.QueryType
+}
+
+// query sends a single query, retrying it if it fails, and returns the acknowledgement in its
+// answer, if any.
+func (c *Client) query(ctx context.Context, domain string) (*tunnel.Ack, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	for attempt := 0; ; attempt++ {
+		qctx, cancel := context.WithTimeout(ctx, timeout)
+		var ack *tunnel.Ack
+		var err error
+		if c.Server != "" {
+			ack, err = c.exchange(qctx, domain)
+		} else {
+			err = c.resolve(qctx, domain)
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil || attempt >= c.retries() {
+			return ack, err
+		}
+	}
+}
+
+// exchange sends a query to c.Server.
+func (c *Client) exchange(ctx context.Context, domain string) (*tunnel.Ack, error) {
+	resp, err := c.ask(ctx, domain, c.qtype())
+	if err != nil {
+		return nil, err
+	}
+	// Servers answering with NXDOMAIN, e.g. in stealth mode, still received the query.
+	if resp.Rcode == dns.RcodeNameError {
+		return nil, nil
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("Server responded with %s", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range resp.Answer {
+		// Any A record parses as an acknowledgement, so A answers are only trusted if one was
+		// requested. TXT acknowledgements are recognizable by their prefix.
+		if rr.Header().Rrtype == dns.TypeA && !c.Encoder.Ack {
+			continue
+		}
+		if ack, err := tunnel.ParseAck(rr); err == nil {
+			return &ack, nil
+		}
+	}
+	return nil, nil
+}
+
+// ask sends a query for domain of type qtype to c.Server, and returns the response.
+func (c *Client) ask(ctx context.Context, domain string, qtype uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(domain), qtype)
+	// Answers repeat the long names of fragments, so they rarely fit in 512 bytes.
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	dc := &dns.Client{Net: c.Net}
+	resp, _, err := dc.ExchangeContext(ctx, req, c.Server)
+	if err == nil && resp.Truncated && dc.Net != "tcp" {
+		// The answer didn't fit in a UDP message, so the query is repeated over TCP.
+		dc.Net = "tcp"
+		resp, _, err = dc.ExchangeContext(ctx, req, c.Server)
+	}
+	return resp, err
+}
+
+// resolve looks domain up with c.Resolver. The answer doesn't matter, so lookups that fail
+// because the domain doesn't resolve still count as sent.
+func (c *Client) resolve(ctx context.Context, domain string) error {
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var err error
+	if c.qtype() == dns.TypeTXT {
+		_, err = resolver.LookupTXT(ctx, domain)
+	} else {
+		_, err = resolver.LookupHost(ctx, domain)
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
+
+// NewID returns a random message ID.
+func NewID() (string, error) {
+	id := make([]byte, idLen)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(idAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		id[i] = idAlphabet[n.Int64()]
+	}
+	return string(id), nil
+}
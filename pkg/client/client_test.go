@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// serve starts a DNS server on a random UDP port for handler, and returns its address.
+func serve(t *testing.T, handler dns.Handler) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func newTunnel(t *testing.T, cfg tunnel.Config) *tunnel.Tunnel {
+	cfg.TopDomain = "tunnel.example.com."
+	tun, err := tunnel.New(cfg)
+	require.Nil(t, err)
+	t.Cleanup(func() { tun.Close() })
+	return tun
+}
+
+func TestSend(t *testing.T) {
+	tun := newTunnel(t, tunnel.Config{})
+	c := &Client{Domain: "tunnel.example.com", Server: serve(t, tun)}
+
+	msg := strings.Repeat("hello world ", 40)
+	id, err := c.Send(context.Background(), []byte(msg))
+	require.Nil(t, err)
+	got := <-tun.Messages()
+	require.Equal(t, id, got.ID)
+	require.Equal(t, []byte(msg), got.Payload)
+}
+
+func TestHeartbeat(t *testing.T) {
+	tun := newTunnel(t, tunnel.Config{})
+	c := &Client{Domain: "tunnel.example.com", Server: serve(t, tun)}
+
+	require.Nil(t, c.Heartbeat(context.Background(), "c1"))
+	require.EqualValues(t, 1, tun.Liveness()["c1"].Heartbeats)
+}
+
+func TestSendResolver(t *testing.T) {
+	tun := newTunnel(t, tunnel.Config{})
+	addr := serve(t, tun)
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", addr)
+		},
+	}
+	c := &Client{Domain: "tunnel.example.com", Resolver: resolver, QueryType: dns.TypeA}
+
+	require.Nil(t, c.SendID(context.Background(), "2jkhm3", []byte("hello world")))
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+}
+
+// dropper drops the first query for each of the names it was given.
+type dropper struct {
+	next    dns.Handler
+	names   map[string]*int32
+	dropped int32
+}
+
+func (d *dropper) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if n, ok := d.names[r.Question[0].Name]; ok && atomic.AddInt32(n, 1) == 1 {
+		atomic.AddInt32(&d.dropped, 1)
+		return
+	}
+	d.next.ServeDNS(w, r)
+}
+
+func TestSendRetries(t *testing.T) {
+	tun := newTunnel(t, tunnel.Config{})
+	enc := tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Ack: true}
+	msg := strings.Repeat("hello world ", 40)
+	fragments, err := enc.EncodeFragments("tunnel.example.com", "2jkhm3", msg)
+	require.Nil(t, err)
+	require.True(t, len(fragments) > 2)
+
+	d := &dropper{next: tun, names: map[string]*int32{fragments[1].Domain: new(int32)}}
+	c := &Client{Domain: "tunnel.example.com", Server: serve(t, d), Encoder: enc, Timeout: 50 * time.Millisecond}
+	require.Nil(t, c.SendID(context.Background(), "2jkhm3", []byte(msg)))
+	require.Equal(t, []byte(msg), (<-tun.Messages()).Payload)
+	require.EqualValues(t, 1, atomic.LoadInt32(&d.dropped))
+
+	// Without retries, the dropped fragment is reported.
+	d = &dropper{next: tun, names: map[string]*int32{}}
+	fragments, err = enc.EncodeFragments("tunnel.example.com", "abcdef", msg)
+	require.Nil(t, err)
+	d.names[fragments[1].Domain] = new(int32)
+	c = &Client{Domain: "tunnel.example.com", Server: serve(t, d), Encoder: enc, Timeout: 50 * time.Millisecond, Retries: -1}
+	require.NotNil(t, c.SendID(context.Background(), "abcdef", []byte(msg)))
+}
+
+// swallower answers the first query for each of the names it was given without passing it on, as
+// a resolver might that loses the query on its way to the tunnel.
+type swallower struct {
+	next  dns.Handler
+	names map[string]*int32
+}
+
+func (s *swallower) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if n, ok := s.names[r.Question[0].Name]; ok && atomic.AddInt32(n, 1) == 1 {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		w.WriteMsg(m)
+		return
+	}
+	s.next.ServeDNS(w, r)
+}
+
+func TestSendStatus(t *testing.T) {
+	tun := newTunnel(t, tunnel.Config{NackDelay: 20 * time.Millisecond, DedupWindow: time.Minute})
+	msg := strings.Repeat("hello world ", 40)
+	fragments, err := tunnel.Encoder{LabelLen: 63}.EncodeFragments("tunnel.example.com", "2jkhm3", msg)
+	require.Nil(t, err)
+	require.True(t, len(fragments) > 2)
+
+	s := &swallower{next: tun, names: map[string]*int32{fragments[1].Domain: new(int32)}}
+	c := &Client{Domain: "tunnel.example.com", Server: serve(t, s), StatusDelay: 50 * time.Millisecond}
+	require.Nil(t, c.SendID(context.Background(), "2jkhm3", []byte(msg)))
+	require.Equal(t, []byte(msg), (<-tun.Messages()).Payload)
+	require.EqualValues(t, 2, atomic.LoadInt32(s.names[fragments[1].Domain]))
+
+	// Only the missing fragment was sent again.
+	require.EqualValues(t, len(fragments), tun.Stats().Fragments)
+	require.EqualValues(t, 2, tun.Stats().StatusQueries)
+}
+
+// truncator answers queries received over UDP with an empty truncated reply.
+type truncator struct {
+	next dns.Handler
+	udp  int32
+}
+
+func (tr *truncator) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		atomic.AddInt32(&tr.udp, 1)
+		m := &dns.Msg{}
+		m.SetReply(r)
+		m.Truncated = true
+		w.WriteMsg(m)
+		return
+	}
+	tr.next.ServeDNS(w, r)
+}
+
+func TestSendTruncated(t *testing.T) {
+	tun := newTunnel(t, tunnel.Config{})
+	tr := &truncator{next: tun}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	tcp := &dns.Server{Listener: l, Handler: tr}
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() { tcp.Shutdown() })
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	require.Nil(t, err)
+	udp := &dns.Server{PacketConn: pc, Handler: tr}
+	go udp.ActivateAndServe()
+	t.Cleanup(func() { udp.Shutdown() })
+
+	c := &Client{Domain: "tunnel.example.com", Server: l.Addr().String()}
+	require.Nil(t, c.SendID(context.Background(), "2jkhm3", []byte("hello world")))
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+	require.EqualValues(t, 1, atomic.LoadInt32(&tr.udp))
+}
+
+func TestMissingFragments(t *testing.T) {
+	fragments := []tunnel.EncodedFragment{
+		{Domain: "a", Range: tunnel.Range{Offset: 0, Length: 10}},
+		{Domain: "b", Range: tunnel.Range{Offset: 10, Length: 10}},
+		{Domain: "c", Range: tunnel.Range{Offset: 20, Length: 10}},
+		{Domain: "d", Range: tunnel.Range{Offset: 30, Length: 10}},
+	}
+	got := missingFragments(fragments, tunnel.Ack{Received: 20, Total: 40, Missing: []tunnel.Range{{Offset: 12, Length: 3}}})
+	require.Equal(t, []tunnel.EncodedFragment{fragments[1], fragments[2], fragments[3]}, got)
+	got = missingFragments(fragments, tunnel.Ack{Received: 30, Total: 40, Missing: []tunnel.Range{{Offset: 0, Length: 10}, {Offset: 30, Length: 10}}})
+	require.Equal(t, []tunnel.EncodedFragment{fragments[0], fragments[3]}, got)
+}
+
+func TestNewID(t *testing.T) {
+	id, err := NewID()
+	require.Nil(t, err)
+	require.Len(t, id, idLen)
+	require.Equal(t, "", strings.Trim(id, idAlphabet))
+}
+
+func TestStream(t *testing.T) {
+	tun := newTunnel(t, tunnel.Config{MaxStreams: 1})
+	c := &Client{Domain: "tunnel.example.com", Server: serve(t, tun), PollInterval: 10 * time.Millisecond}
+	l := tun.StreamListener()
+	defer l.Close()
+
+	// The tunnel answers with everything it received in upper case, once the client closes its
+	// side.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		conn.Write(bytes.ToUpper(data))
+	}()
+
+	s, err := c.Dial(context.Background())
+	require.Nil(t, err)
+	msg := strings.Repeat("hello world ", 100)
+	_, err = s.Write([]byte(msg))
+	require.Nil(t, err)
+	require.Nil(t, s.CloseWrite())
+	_, err = s.Write([]byte("more"))
+	require.Equal(t, net.ErrClosed, err)
+	got, err := io.ReadAll(s)
+	require.Nil(t, err)
+	require.Equal(t, strings.ToUpper(msg), string(got))
+	require.Nil(t, s.Close())
+	require.Eventually(t, func() bool { return tun.Stats().Streams == 0 }, time.Second, 10*time.Millisecond)
+
+	_, err = (&Client{Domain: "tunnel.example.com"}).Dial(context.Background())
+	require.NotNil(t, err)
+	_, err = (&Client{Domain: "tunnel.example.com", Server: serve(t, newTunnel(t, tunnel.Config{}))}).Dial(context.Background())
+	require.NotNil(t, err)
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// maxStreamBuffer is the maximum number of bytes buffered in each direction of a stream, as in
+// the tunnel.
+const maxStreamBuffer = 64 << 10
+
+// A Stream is the client's side of a stream through a tunnel, as described on tunnel.Stream,
+// opened by Dial. It implements net.Conn. A single query is in flight at a time: it carries the
+// bytes written that the tunnel hasn't received yet, and its answer the next bytes to be read.
+type Stream struct {
+	c      *Client
+	id     string
+	cancel context.CancelFunc
+	// wake is signaled by writes and Close, so that an idle stream queries the tunnel at once.
+	wake chan struct{}
+	// done is closed once the stream stops querying the tunnel.
+	done chan struct{}
+
+	mu sync.Mutex
+	// changed is closed, and replaced, whenever the stream changes, to wake up blocked reads and
+	// writes.
+	changed chan struct{}
+	// writeBuf holds the bytes written that the tunnel hasn't received yet, starting at sent.
+	writeBuf []byte
+	sent     int
+	// readBuf holds the bytes received that weren't read yet, and received counts every byte
+	// received.
+	readBuf  []byte
+	received int
+	// remoteFin is set once the tunnel closed its side and every byte it sent was received.
+	remoteFin bool
+	// writeClosed is set by CloseWrite and Close, and finished once the tunnel received
+	// everything written. closing is set by Close.
+	writeClosed bool
+	finished    bool
+	closing     bool
+	// acked is the number of received bytes acknowledged to the tunnel.
+	acked int
+	err   error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Dial opens a stream through the tunnel, which must be configured with tunnel.Config.MaxStreams
+// and accept its streams. ctx only bounds the query opening the stream. Streams require Server,
+// since the answers to their queries carry the bytes sent by the tunnel. Queries are retried as
+// configured by Retries, after which the stream fails.
+func (c *Client) Dial(ctx context.Context) (*Stream, error) {
+	if c.Server == "" {
+		return nil, fmt.Errorf("Streams require a server, since answers carry the data sent by the tunnel")
+	}
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	s := &Stream{c: c, id: id, cancel: cancel, wake: make(chan struct{}, 1), done: make(chan struct{}), changed: make(chan struct{})}
+	// The first query opens the stream, so that Dial fails if the tunnel refuses it.
+	if _, err := s.step(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	go s.run(runCtx)
+	return s, nil
+}
+
+// ID returns the stream ID.
+func (s *Stream) ID() string {
+	return s.id
+}
+
+// Read reads the bytes sent by the tunnel. It returns io.EOF once the tunnel closed its side and
+// every byte it sent was read.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		switch {
+		case s.closing:
+			return 0, net.ErrClosed
+		case len(s.readBuf) > 0:
+			n := copy(p, s.readBuf)
+			s.readBuf = s.readBuf[n:]
+			return n, nil
+		case s.remoteFin:
+			return 0, io.EOF
+		case s.err != nil:
+			return 0, s.err
+		}
+		if err := s.wait(s.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues p to be sent to the tunnel. It blocks while more than 64 KiB haven't been received
+// by the tunnel yet.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		switch {
+		case s.writeClosed:
+			return written, net.ErrClosed
+		case s.err != nil:
+			return written, s.err
+		}
+		if space := maxStreamBuffer - len(s.writeBuf); space > 0 {
+			n := min(space, len(p))
+			s.writeBuf = append(s.writeBuf, p[:n]...)
+			p, written = p[n:], written+n
+			s.signal()
+			continue
+		}
+		if err := s.wait(s.writeDeadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite closes the client's side of the stream, once the tunnel has received every byte
+// written, while the bytes sent by the tunnel can still be read until it closes its side too.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeClosed = true
+	s.signal()
+	return nil
+}
+
+// Close closes both sides of the stream, and waits until the tunnel has received every byte
+// written, or the stream fails.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	s.writeClosed, s.closing = true, true
+	s.signal()
+	s.mu.Unlock()
+	<-s.done
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return nil
+	}
+	return s.err
+}
+
+// LocalAddr returns the stream ID.
+func (s *Stream) LocalAddr() net.Addr {
+	return streamAddr(s.id)
+}
+
+// RemoteAddr returns the domain of the tunnel.
+func (s *Stream) RemoteAddr() net.Addr {
+	return streamAddr(dns.Fqdn(s.c.Domain))
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.notify()
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.notify()
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	s.notify()
+	return nil
+}
+
+// notify wakes up the reads and writes waiting for the stream to change. The lock of s must be
+// held.
+func (s *Stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// signal wakes up the loop querying the tunnel.
+func (s *Stream) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait releases the lock of s until the stream changes, or returns os.ErrDeadlineExceeded once
+// deadline, if set, has passed.
+func (s *Stream) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	changed := s.changed
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// run queries the tunnel until both sides are closed and everything written was received, or the
+// stream fails. It waits for PollInterval between queries that carry nothing in either
+// direction, unless the stream is written to or closed.
+func (s *Stream) run(ctx context.Context) {
+	defer close(s.done)
+	interval := s.c.PollInterval
+	if interval == 0 {
+		interval = DefaultPollInterval
+	}
+	for {
+		progress, err := s.step(ctx)
+		s.mu.Lock()
+		if err != nil && s.err == nil {
+			s.err = err
+			s.notify()
+		}
+		// Once both sides are closed, the tunnel only waits for the last bytes it sent to be
+		// acknowledged.
+		stop := s.err != nil || s.finished && (s.closing || s.remoteFin && s.acked == s.received)
+		s.mu.Unlock()
+		if stop {
+			return
+		}
+		delay := s.c.Delay
+		if !progress {
+			delay = max(delay, interval)
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+			case <-ctx.Done():
+			}
+			timer.Stop()
+		}
+	}
+}
+
+// step sends a single query, carrying as many of the bytes written as fit, and takes in its
+// answer. It reports whether any bytes were sent or received.
+func (s *Stream) step(ctx context.Context) (bool, error) {
+	nonce, err := NewID()
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	offset, ack := s.sent, s.received
+	n := min(tunnel.MaxStreamData(s.c.Domain, s.id, nonce, offset, ack), len(s.writeBuf))
+	data := append([]byte(nil), s.writeBuf[:n]...)
+	fin := s.writeClosed && n == len(s.writeBuf)
+	room := maxStreamBuffer - len(s.readBuf)
+	s.mu.Unlock()
+
+	domain, err := tunnel.EncodeStreamQuery(s.c.Domain, s.id, nonce, offset, ack, data, fin)
+	if err != nil {
+		return false, err
+	}
+	a, err := s.query(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a.Received > s.sent && a.Received <= s.sent+len(s.writeBuf) {
+		s.writeBuf = append([]byte(nil), s.writeBuf[a.Received-s.sent:]...)
+		s.sent = a.Received
+	}
+	took := 0
+	if a.Offset == s.received {
+		took = min(len(a.Data), room)
+		s.readBuf = append(s.readBuf, a.Data[:took]...)
+		s.received += took
+		s.remoteFin = s.remoteFin || a.Fin && took == len(a.Data)
+	}
+	s.finished = s.finished || fin && a.Received == offset+len(data)
+	s.acked = ack
+	s.notify()
+	return n > 0 || took > 0, nil
+}
+
+// query sends a stream query, retrying it if it fails, and returns its answer.
+func (s *Stream) query(ctx context.Context, domain string) (tunnel.StreamAnswer, error) {
+	timeout := s.c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	for attempt := 0; ; attempt++ {
+		qctx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err := s.c.ask(qctx, domain, dns.TypeTXT)
+		cancel()
+		if ctx.Err() != nil {
+			return tunnel.StreamAnswer{}, ctx.Err()
+		}
+		if err == nil {
+			if resp.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("Server responded with %s", dns.RcodeToString[resp.Rcode])
+			} else if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeTXT {
+				err = fmt.Errorf("Server responded with %d records but expected a TXT record", len(resp.Answer))
+			} else {
+				// Resets aren't retried.
+				return tunnel.ParseStreamAnswer(resp.Answer[0].(*dns.TXT).Txt)
+			}
+		}
+		if attempt >= s.c.retries() {
+			return tunnel.StreamAnswer{}, err
+		}
+	}
+}
+
+// streamAddr is the net.Addr of either end of a stream.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "dns" }
+
+func (a streamAddr) String() string { return string(a) }
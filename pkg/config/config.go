@@ -0,0 +1,238 @@
+// Package config loads configuration files that set the flags of a flag.FlagSet.
+//
+// A configuration file is a YAML mapping from flag names to values. Flag names are matched
+// case-insensitively, and nested mappings join their keys, so that
+//
+//	kafka:
+//	  brokers: broker1:9092,broker2:9092
+//	  topic: tunnel
+//
+// sets -kafkaBrokers and -kafkaTopic. Lists set a flag once per element, which is how
+// repeatable flags are given several values; for other flags, the last element wins. Values may
+// refer to environment variables as ${NAME}, or ${NAME:-default} to fall back to a default if
+// NAME is unset, so that secrets needn't be written to the file.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the configuration file at path and sets the flags of fs accordingly. Flags that
+// were already set, e.g. on the command line, take precedence and are left untouched. Keys that
+// don't name a flag in fs, values that the flag doesn't accept, and references to unset
+// environment variables are errors.
+func Load(path string, fs *flag.FlagSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := Apply(data, fs); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Apply sets the flags of fs from the configuration file data, as described on Load.
+func Apply(data []byte, fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	settings, err := parse(data, fs)
+	if err != nil {
+		return err
+	}
+	for _, st := range settings {
+		if set[st.flag.Name] {
+			continue
+		}
+		if err := st.apply(fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Resetter is a flag.Value that can be reset to its default value, such as a repeatable flag
+// whose Set appends to a list.
+type Resetter interface {
+	Reset()
+}
+
+// A Loader applies a configuration file to a FlagSet, and can apply it again after the file has
+// changed, e.g. to reload it on SIGHUP.
+type Loader struct {
+	path    string
+	fs      *flag.FlagSet
+	cmdline map[string]bool
+}
+
+// NewLoader returns a Loader applying the file at path to fs. Flags of fs that are set when
+// NewLoader is called, e.g. on the command line, take precedence over the file on every load.
+func NewLoader(path string, fs *flag.FlagSet) *Loader {
+	l := &Loader{path: path, fs: fs, cmdline: make(map[string]bool)}
+	fs.Visit(func(f *flag.Flag) {
+		l.cmdline[f.Name] = true
+	})
+	return l
+}
+
+// Load reads the file, resets the flags that the command line doesn't set to their defaults, and
+// sets them from the file as described on the package Load. Flags whose flag.Value implements
+// Resetter are reset with Reset rather than by setting their default value. If the file can't be
+// read or parsed, the flags are left untouched; if a flag rejects its value, an error is
+// returned and the remaining flags may not have been updated.
+func (l *Loader) Load() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	settings, err := parse(data, l.fs)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.path, err)
+	}
+	var resetErr error
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if l.cmdline[f.Name] {
+			return
+		}
+		if r, ok := f.Value.(Resetter); ok {
+			r.Reset()
+		} else if err := f.Value.Set(f.DefValue); err != nil && resetErr == nil {
+			resetErr = fmt.Errorf("Failed to reset %s: %w", f.Name, err)
+		}
+	})
+	if resetErr != nil {
+		return resetErr
+	}
+	for _, st := range settings {
+		if l.cmdline[st.flag.Name] {
+			continue
+		}
+		if err := st.apply(l.fs); err != nil {
+			return fmt.Errorf("%s: %w", l.path, err)
+		}
+	}
+	return nil
+}
+
+// A setting is a flag along with the values a configuration file sets it to.
+type setting struct {
+	flag   *flag.Flag
+	values []string
+	line   int
+}
+
+func (st setting) apply(fs *flag.FlagSet) error {
+	for _, v := range st.values {
+		if err := fs.Set(st.flag.Name, v); err != nil {
+			return fmt.Errorf("Invalid value for %s on line %d: %w", st.flag.Name, st.line, err)
+		}
+	}
+	return nil
+}
+
+// parse parses the configuration file data into the settings of the flags of fs, with
+// environment variables expanded.
+func parse(data []byte, fs *flag.FlagSet) ([]setting, error) {
+	var doc yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&doc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	p := parser{flags: make(map[string]*flag.Flag)}
+	fs.VisitAll(func(f *flag.Flag) {
+		p.flags[strings.ToLower(f.Name)] = f
+	})
+	if err := p.mapping("", doc.Content[0]); err != nil {
+		return nil, err
+	}
+	return p.settings, nil
+}
+
+type parser struct {
+	flags    map[string]*flag.Flag
+	settings []setting
+}
+
+func (p *parser) mapping(prefix string, node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("Expected a mapping on line %d", node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := prefix + strings.ToLower(key.Value)
+		if value.Kind == yaml.MappingNode {
+			if err := p.mapping(name, value); err != nil {
+				return err
+			}
+			continue
+		}
+		f, ok := p.flags[name]
+		if !ok {
+			return fmt.Errorf("Unknown setting %q on line %d", key.Value, key.Line)
+		}
+		if err := p.value(f, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) value(f *flag.Flag, node *yaml.Node) error {
+	var scalars []*yaml.Node
+	switch node.Kind {
+	case yaml.ScalarNode:
+		scalars = []*yaml.Node{node}
+	case yaml.SequenceNode:
+		for _, n := range node.Content {
+			if n.Kind != yaml.ScalarNode {
+				return fmt.Errorf("Expected a list of values for %s on line %d", f.Name, n.Line)
+			}
+			scalars = append(scalars, n)
+		}
+	default:
+		return fmt.Errorf("Expected a value or a list of values for %s on line %d", f.Name, node.Line)
+	}
+	st := setting{flag: f, line: node.Line}
+	for _, n := range scalars {
+		v, err := expand(n.Value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s on line %d: %w", f.Name, n.Line, err)
+		}
+		st.values = append(st.values, v)
+	}
+	p.settings = append(p.settings, st)
+	return nil
+}
+
+// expand replaces references to environment variables in s.
+func expand(s string) (string, error) {
+	var err error
+	expanded := os.Expand(s, func(name string) string {
+		name, def, hasDefault := strings.Cut(name, ":-")
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		if !hasDefault && err == nil {
+			err = fmt.Errorf("Environment variable %s is not set", name)
+		}
+		return def
+	})
+	return expanded, err
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stringsFlag collects every occurrence of a repeatable flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string     { return strings.Join(*f, ",") }
+func (f *stringsFlag) Set(v string) error { *f = append(*f, v); return nil }
+func (f *stringsFlag) Reset()             { *f = nil }
+
+type testFlags struct {
+	fs          *flag.FlagSet
+	port        *int
+	acks        *bool
+	webhookURL  *string
+	kafkaTopic  *string
+	hmacKey     *string
+	domains     stringsFlag
+	kafkaBroker stringsFlag
+}
+
+func newTestFlags() *testFlags {
+	f := &testFlags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.port = f.fs.Int("port", 53, "")
+	f.acks = f.fs.Bool("acks", false, "")
+	f.webhookURL = f.fs.String("webhookURL", "", "")
+	f.kafkaTopic = f.fs.String("kafkaTopic", "browsertunnel", "")
+	f.hmacKey = f.fs.String("hmacKey", "", "")
+	f.fs.Var(&f.domains, "domain", "")
+	f.fs.Var(&f.kafkaBroker, "kafkaBroker", "")
+	return f
+}
+
+func TestApply(t *testing.T) {
+	t.Setenv("TEST_HMAC_KEY", "s3cret")
+	f := newTestFlags()
+	require.Nil(t, f.fs.Parse([]string{"-port", "5353"}))
+
+	err := Apply([]byte(`
+port: 53
+acks: true
+domain: [t1.example.com, t2.example.org]
+webhookurl: https://example.com/${TEST_MISSING:-hook}
+kafka:
+  topic: tunnel
+  broker:
+    - broker1:9092
+hmacKey: ${TEST_HMAC_KEY}
+`), f.fs)
+	require.Nil(t, err)
+	require.Equal(t, 5353, *f.port)
+	require.True(t, *f.acks)
+	require.Equal(t, stringsFlag{"t1.example.com", "t2.example.org"}, f.domains)
+	require.Equal(t, "https://example.com/hook", *f.webhookURL)
+	require.Equal(t, "tunnel", *f.kafkaTopic)
+	require.Equal(t, stringsFlag{"broker1:9092"}, f.kafkaBroker)
+	require.Equal(t, "s3cret", *f.hmacKey)
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []string{
+		"unknown: 1",
+		"port: fifty",
+		"acks: [true, [false]]",
+		"kafka: {missing: 1}",
+		"hmacKey: ${TEST_MISSING}",
+		"- port",
+		"port: [",
+	}
+	for _, test := range tests {
+		require.NotNil(t, Apply([]byte(test), newTestFlags().fs), test)
+	}
+	require.Nil(t, Apply([]byte(""), newTestFlags().fs))
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "browsertunnel.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("port: 5300\n"), 0600))
+	f := newTestFlags()
+	require.Nil(t, Load(path, f.fs))
+	require.Equal(t, 5300, *f.port)
+
+	require.NotNil(t, Load(filepath.Join(t.TempDir(), "missing.yaml"), f.fs))
+}
+
+func TestLoader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "browsertunnel.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("port: 5300\nacks: true\ndomain: [t1.example.com]\n"), 0600))
+	f := newTestFlags()
+	require.Nil(t, f.fs.Parse([]string{"-webhookURL", "https://example.com/hook"}))
+	l := NewLoader(path, f.fs)
+	require.Nil(t, l.Load())
+	require.Equal(t, 5300, *f.port)
+	require.True(t, *f.acks)
+	require.Equal(t, stringsFlag{"t1.example.com"}, f.domains)
+
+	// Settings removed from the file revert to their defaults, and the command line still wins.
+	require.Nil(t, os.WriteFile(path, []byte("domain: [t2.example.org]\nwebhookURL: https://example.com/other\n"), 0600))
+	require.Nil(t, l.Load())
+	require.Equal(t, 53, *f.port)
+	require.False(t, *f.acks)
+	require.Equal(t, stringsFlag{"t2.example.org"}, f.domains)
+	require.Equal(t, "https://example.com/hook", *f.webhookURL)
+
+	// A file that can't be parsed leaves the flags untouched.
+	require.Nil(t, os.WriteFile(path, []byte("port: 1\nunknown: 1\n"), 0600))
+	require.NotNil(t, l.Load())
+	require.Equal(t, 53, *f.port)
+	require.Equal(t, stringsFlag{"t2.example.org"}, f.domains)
+}
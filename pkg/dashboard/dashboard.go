@@ -0,0 +1,234 @@
+// Package dashboard serves a web page showing what a tunnel is doing: the rate of queries and
+// fragments, the partial messages being reassembled, the messages delivered recently and the
+// warnings logged recently. The page polls a JSON snapshot of this state every second, so it
+// needs nothing but the binary. The snapshot holds message payloads, so it may require a bearer
+// token, which the page reads from the fragment of its URL, e.g. /#token=secret, so that it isn't
+// sent in requests or logged.
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	_ "embed" // embeds the page
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/veggiedefender/browsertunnel/pkg/admin"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// historySize is the number of recent messages and warnings kept.
+const historySize = 50
+
+// previewSize is the number of bytes of each message payload kept.
+const previewSize = 256
+
+//go:embed index.html
+var page []byte
+
+// A Dashboard records the recent messages and warnings of a tunnel. It is a sink.Sink, to be
+// added to the sinks of the tunnel, and wraps the slog.Handler of its logger with LogHandler.
+type Dashboard struct {
+	mu       sync.Mutex
+	messages []json.RawMessage
+	warnings []warning
+}
+
+// A warning is a record logged at the warning level or above.
+type warning struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs"`
+}
+
+// state is the JSON snapshot served to the page.
+type state struct {
+	Time     time.Time         `json:"time"`
+	Stats    stats             `json:"stats"`
+	Partials []partial         `json:"partials"`
+	Messages []json.RawMessage `json:"messages"`
+	Warnings []warning         `json:"warnings"`
+}
+
+// stats holds the counters of tunnel.Stats shown on the page.
+type stats struct {
+	Queries       uint64 `json:"queries"`
+	Fragments     uint64 `json:"fragments"`
+	Assembled     uint64 `json:"assembled"`
+	ParseErrors   uint64 `json:"parse_errors"`
+	Expired       uint64 `json:"expired"`
+	InFlight      int    `json:"in_flight"`
+	BufferedBytes int    `json:"buffered_bytes"`
+}
+
+// partial describes the progress of a tunnel.PartialMessage.
+type partial struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	TotalSize int       `json:"total_size"`
+	Received  int       `json:"received"`
+	Fragments int       `json:"fragments"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// New creates an empty dashboard.
+func New() *Dashboard {
+	return &Dashboard{}
+}
+
+// Deliver records msg, with its payload cut to its first bytes, as encoded by sink.Marshal.
+// Text payloads are cut between characters, so that they are still shown as text.
+func (d *Dashboard) Deliver(ctx context.Context, msg tunnel.Message) error {
+	if n := previewSize; len(msg.Payload) > n {
+		for !msg.Binary && n > 0 && !utf8.RuneStart(msg.Payload[n]) {
+			n--
+		}
+		msg.Payload = msg.Payload[:n]
+	}
+	b, err := sink.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages = appendRecent(d.messages, b)
+	return nil
+}
+
+// record records a warning.
+func (d *Dashboard) record(w warning) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.warnings = appendRecent(d.warnings, w)
+}
+
+// appendRecent appends v to s, dropping the oldest elements beyond historySize.
+func appendRecent[T any](s []T, v T) []T {
+	s = append(s, v)
+	if len(s) > historySize {
+		s = append(s[:0:0], s[len(s)-historySize:]...)
+	}
+	return s
+}
+
+// Handler returns an http.Handler serving the page at / and the state of tun at /state. If token
+// isn't empty, requests for the state must carry it as a bearer token, as checked by
+// admin.RequireToken. The page itself holds no data, so it is served to anyone.
+func (d *Dashboard) Handler(tun *tunnel.Tunnel, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(page))
+	})
+	var state http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(d.state(tun))
+		if err != nil {
+			http.Error(w, "failed to encode state", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(append(b, '\n'))
+	})
+	if token != "" {
+		state = admin.RequireToken(token, state)
+	}
+	mux.Handle("/state", state)
+	return mux
+}
+
+// state returns a snapshot of tun and of the recent messages and warnings, newest first.
+func (d *Dashboard) state(tun *tunnel.Tunnel) state {
+	s := tun.Stats()
+	st := state{
+		Time: time.Now(),
+		Stats: stats{
+			Queries:       s.Queries,
+			Fragments:     s.Fragments,
+			Assembled:     s.Assembled,
+			ParseErrors:   s.ParseErrors,
+			Expired:       s.Expired,
+			InFlight:      s.InFlight,
+			BufferedBytes: s.BufferedBytes,
+		},
+		Partials: []partial{},
+	}
+	for _, p := range tun.Partials() {
+		st.Partials = append(st.Partials, partial{ID: p.ID, Tenant: p.Tenant, TotalSize: p.TotalSize, Received: p.Received, Fragments: p.Fragments, ExpiresAt: p.ExpiresAt})
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st.Messages = make([]json.RawMessage, 0, len(d.messages))
+	for i := len(d.messages) - 1; i >= 0; i-- {
+		st.Messages = append(st.Messages, d.messages[i])
+	}
+	st.Warnings = make([]warning, 0, len(d.warnings))
+	for i := len(d.warnings) - 1; i >= 0; i-- {
+		st.Warnings = append(st.Warnings, d.warnings[i])
+	}
+	return st
+}
+
+// LogHandler returns a slog.Handler passing records to next, which also records those at the
+// warning level or above on the dashboard, even if next discards them.
+func (d *Dashboard) LogHandler(next slog.Handler) slog.Handler {
+	return &logHandler{next: next, dashboard: d}
+}
+
+type logHandler struct {
+	next      slog.Handler
+	dashboard *Dashboard
+	// attrs are the attributes added with WithAttrs, with the names of their groups as prefixes.
+	attrs []slog.Attr
+	group string
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.next.Enabled(ctx, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		w := warning{Time: r.Time, Level: r.Level.String(), Message: r.Message, Attrs: make(map[string]string)}
+		for _, a := range h.attrs {
+			w.Attrs[a.Key] = a.Value.String()
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			w.Attrs[h.group+a.Key] = a.Value.String()
+			return true
+		})
+		h.dashboard.record(w)
+	}
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	h2.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, slog.Attr{Key: h.group + a.Key, Value: a.Value})
+	}
+	return &h2
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	h2.group = h.group + name + "."
+	return &h2
+}
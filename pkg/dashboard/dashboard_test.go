@@ -0,0 +1,104 @@
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestDeliver(t *testing.T) {
+	d := New()
+	for i := 0; i < historySize+5; i++ {
+		require.Nil(t, d.Deliver(context.Background(), tunnel.Message{ID: fmt.Sprint(i), Payload: []byte("hello")}))
+	}
+	require.Len(t, d.messages, historySize)
+	require.Contains(t, string(d.messages[0]), `"id":"5"`)
+
+	// Long text payloads are cut between characters.
+	require.Nil(t, d.Deliver(context.Background(), tunnel.Message{ID: "long", Payload: []byte(strings.Repeat("é", previewSize))}))
+	var record struct {
+		Payload string `json:"payload"`
+		Binary  bool   `json:"binary"`
+	}
+	require.Nil(t, json.Unmarshal(d.messages[historySize-1], &record))
+	require.False(t, record.Binary)
+	require.Equal(t, strings.Repeat("é", previewSize/2), record.Payload)
+}
+
+func TestLogHandler(t *testing.T) {
+	d := New()
+	var buf bytes.Buffer
+	logger := slog.New(d.LogHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})))
+
+	logger.Info("Received fragment")
+	logger.With("client", "192.0.2.1").WithGroup("fragment").Warn("Dropping fragment", "reason", "size")
+	logger.Error("Failed to deliver message")
+
+	require.Len(t, d.warnings, 2)
+	require.Equal(t, "Dropping fragment", d.warnings[0].Message)
+	require.Equal(t, "WARN", d.warnings[0].Level)
+	require.Equal(t, map[string]string{"client": "192.0.2.1", "fragment.reason": "size"}, d.warnings[0].Attrs)
+	require.Equal(t, "Failed to deliver message", d.warnings[1].Message)
+
+	// Warnings are recorded even though the underlying handler only logs errors.
+	require.NotContains(t, buf.String(), "Dropping fragment")
+	require.Contains(t, buf.String(), "Failed to deliver message")
+}
+
+func TestHandler(t *testing.T) {
+	tun, err := tunnel.New(tunnel.Config{TopDomain: "tunnel.example.com"})
+	require.Nil(t, err)
+	defer tun.Close()
+	d := New()
+	require.Nil(t, d.Deliver(context.Background(), tunnel.Message{ID: "first", Payload: []byte("hello")}))
+	require.Nil(t, d.Deliver(context.Background(), tunnel.Message{ID: "second", Payload: []byte("world")}))
+	h := d.Handler(tun, "")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "<title>browsertunnel</title>")
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/state", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var st struct {
+		Stats    stats             `json:"stats"`
+		Partials []partial         `json:"partials"`
+		Messages []json.RawMessage `json:"messages"`
+		Warnings []warning         `json:"warnings"`
+	}
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &st))
+	require.NotNil(t, st.Partials)
+	require.Len(t, st.Messages, 2)
+	require.Contains(t, string(st.Messages[0]), `"id":"second"`)
+	require.NotNil(t, st.Warnings)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/nope", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// With a token, the page is still served, but the state requires it.
+	h = d.Handler(tun, "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/state", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	req := httptest.NewRequest(http.MethodGet, "/state", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"id":"second"`)
+}
@@ -0,0 +1,366 @@
+// Package dnstap receives the DNS messages that resolvers and servers such as Unbound, BIND and
+// CoreDNS log in the dnstap format over Frame Streams sockets, as described at
+// https://dnstap.info, and serves the queries they carry to a dns.Handler without answering them.
+package dnstap
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// handshakeTimeout is how long a sender may take to start its stream once it has connected.
+const handshakeTimeout = 5 * time.Second
+
+// MessageType is the type of a logged DNS message, which tells which of the parties it was sent
+// between logged it.
+type MessageType int
+
+// Types of logged messages. Queries have odd types and responses even ones.
+const (
+	AuthQuery         MessageType = 1
+	AuthResponse      MessageType = 2
+	ResolverQuery     MessageType = 3
+	ResolverResponse  MessageType = 4
+	ClientQuery       MessageType = 5
+	ClientResponse    MessageType = 6
+	ForwarderQuery    MessageType = 7
+	ForwarderResponse MessageType = 8
+	StubQuery         MessageType = 9
+	StubResponse      MessageType = 10
+	ToolQuery         MessageType = 11
+	ToolResponse      MessageType = 12
+	UpdateQuery       MessageType = 13
+	UpdateResponse    MessageType = 14
+)
+
+// SocketProtocol is the transport protocol that a logged message was sent over.
+type SocketProtocol int
+
+// Protocols of logged messages.
+const (
+	UDP         SocketProtocol = 1
+	TCP         SocketProtocol = 2
+	DoT         SocketProtocol = 3
+	DoH         SocketProtocol = 4
+	DNSCryptUDP SocketProtocol = 5
+	DNSCryptTCP SocketProtocol = 6
+	DoQ         SocketProtocol = 7
+)
+
+// A Message is a DNS message logged in the dnstap format. The query address and port are those
+// of the party that sent the query, and the response address and port those of the party that
+// answered it.
+type Message struct {
+	Type            MessageType
+	Protocol        SocketProtocol
+	QueryAddress    net.IP
+	QueryPort       int
+	ResponseAddress net.IP
+	ResponsePort    int
+	QueryTime       time.Time
+	ResponseTime    time.Time
+	QueryMessage    []byte
+	ResponseMessage []byte
+}
+
+// Fields of the dnstap protobuf messages.
+const (
+	fieldDnstapMessage = 14
+	fieldDnstapType    = 15
+
+	dnstapTypeMessage = 1
+
+	fieldType             = 1
+	fieldProtocol         = 3
+	fieldQueryAddress     = 4
+	fieldResponseAddress  = 5
+	fieldQueryPort        = 6
+	fieldResponsePort     = 7
+	fieldQueryTimeSec     = 8
+	fieldQueryTimeNsec    = 9
+	fieldQueryMessage     = 10
+	fieldResponseTimeSec  = 12
+	fieldResponseTimeNsec = 13
+	fieldResponseMessage  = 14
+)
+
+// Unmarshal decodes a dnstap.Dnstap protobuf message. It returns nil for the frames of other
+// types than MESSAGE.
+func Unmarshal(frame []byte) (*Message, error) {
+	var typ uint64
+	var message []byte
+	err := consumeFields(frame, func(num protowire.Number, v uint64, b []byte) {
+		switch num {
+		case fieldDnstapType:
+			typ = v
+		case fieldDnstapMessage:
+			message = b
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if typ != dnstapTypeMessage {
+		return nil, nil
+	}
+	if message == nil {
+		return nil, errors.New("Dnstap frame holds no message")
+	}
+	m := &Message{}
+	var querySec, queryNsec, responseSec, responseNsec uint64
+	err = consumeFields(message, func(num protowire.Number, v uint64, b []byte) {
+		switch num {
+		case fieldType:
+			m.Type = MessageType(v)
+		case fieldProtocol:
+			m.Protocol = SocketProtocol(v)
+		case fieldQueryAddress:
+			m.QueryAddress = net.IP(b)
+		case fieldResponseAddress:
+			m.ResponseAddress = net.IP(b)
+		case fieldQueryPort:
+			m.QueryPort = int(v)
+		case fieldResponsePort:
+			m.ResponsePort = int(v)
+		case fieldQueryTimeSec:
+			querySec = v
+		case fieldQueryTimeNsec:
+			queryNsec = v
+		case fieldResponseTimeSec:
+			responseSec = v
+		case fieldResponseTimeNsec:
+			responseNsec = v
+		case fieldQueryMessage:
+			m.QueryMessage = b
+		case fieldResponseMessage:
+			m.ResponseMessage = b
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if querySec != 0 {
+		m.QueryTime = time.Unix(int64(querySec), int64(queryNsec)).UTC()
+	}
+	if responseSec != 0 {
+		m.ResponseTime = time.Unix(int64(responseSec), int64(responseNsec)).UTC()
+	}
+	return m, nil
+}
+
+// consumeFields calls field with the number and value of each field of the protobuf message b,
+// with v holding varint and fixed values, and b bytes values.
+func consumeFields(b []byte, field func(num protowire.Number, v uint64, b []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var bytes []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		field(num, v, bytes)
+		b = b[n:]
+	}
+	return nil
+}
+
+// Query returns the query that m logs, along with when it was sent and where from. Responses
+// that don't hold the query yield the question of the response.
+func (m *Message) Query() (*dns.Msg, time.Time, net.Addr, error) {
+	wire, at := m.QueryMessage, m.QueryTime
+	if wire == nil {
+		wire, at = m.ResponseMessage, m.ResponseTime
+	}
+	if wire == nil {
+		return nil, time.Time{}, nil, errors.New("Dnstap message holds no DNS message")
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(wire); err != nil {
+		return nil, time.Time{}, nil, fmt.Errorf("Malformed DNS message: %w", err)
+	}
+	msg.Response = false
+	return msg, at, m.addr(m.QueryAddress, m.QueryPort), nil
+}
+
+// addr returns the address of a party to m, which is only a *net.UDPAddr for messages sent over
+// UDP, so that handlers don't truncate their answers to others.
+func (m *Message) addr(ip net.IP, port int) net.Addr {
+	if m.Protocol == UDP || m.Protocol == DNSCryptUDP {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// A Server receives dnstap streams, and serves the queries that they log to Handler. The answers
+// of Handler are discarded.
+type Server struct {
+	// Handler is served the queries. dns.DefaultServeMux is used if nil.
+	Handler dns.Handler
+	// NotifyStartedFunc, if set, is called once the server is accepting streams.
+	NotifyStartedFunc func()
+
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// Serve serves the streams of the connections accepted by l until Shutdown is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.listener = l
+	s.conns = make(map[net.Conn]struct{})
+	s.lock.Unlock()
+	if s.NotifyStartedFunc != nil {
+		s.NotifyStartedFunc()
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.serveConn(conn); err != nil {
+				slog.Debug("Closing dnstap stream", "sender", conn.RemoteAddr(), "error", err)
+			}
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Shutdown stops accepting streams, and closes the open ones.
+func (s *Server) Shutdown() error {
+	s.lock.Lock()
+	s.closed = true
+	l := s.listener
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// serveConn serves the queries logged by the stream of conn until it stops.
+func (s *Server) serveConn(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	bidirectional, err := handshake(conn)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	handler := s.Handler
+	if handler == nil {
+		handler = dns.DefaultServeMux
+	}
+	for {
+		frame, c, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			if c.typ != controlStop {
+				return fmt.Errorf("Unexpected control frame %d", c.typ)
+			}
+			if bidirectional {
+				return writeControl(conn, controlFinish, "")
+			}
+			return nil
+		}
+		m, err := Unmarshal(frame)
+		if err == nil && m != nil {
+			err = s.serveMessage(handler, m)
+		}
+		if err != nil {
+			slog.Debug("Skipping dnstap frame", "sender", conn.RemoteAddr(), "error", err)
+		}
+	}
+}
+
+// serveMessage serves the query logged by m to handler.
+func (s *Server) serveMessage(handler dns.Handler, m *Message) error {
+	req, at, source, err := m.Query()
+	if err != nil {
+		return err
+	}
+	if len(req.Question) == 0 {
+		return nil
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	handler.ServeDNS(&responseWriter{localAddr: m.addr(m.ResponseAddress, m.ResponsePort), remoteAddr: source, receivedAt: at}, req)
+	return nil
+}
+
+// responseWriter is the dns.ResponseWriter of a logged query, which discards the answer. It
+// reports the query as received when it was logged, through the ReceivedAt method that
+// tunnel.CapturedResponseWriter describes.
+type responseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	receivedAt time.Time
+}
+
+func (w *responseWriter) LocalAddr() net.Addr         { return w.localAddr }
+func (w *responseWriter) RemoteAddr() net.Addr        { return w.remoteAddr }
+func (w *responseWriter) WriteMsg(m *dns.Msg) error   { return nil }
+func (w *responseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *responseWriter) Close() error                { return nil }
+func (w *responseWriter) TsigStatus() error           { return nil }
+func (w *responseWriter) TsigTimersOnly(bool)         {}
+func (w *responseWriter) Hijack()                     {}
+func (w *responseWriter) ReceivedAt() time.Time       { return w.receivedAt }
@@ -0,0 +1,168 @@
+package dnstap
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// frame returns a dnstap.Dnstap message logging the DNS message of the type, sent at the time
+// from 192.0.2.1:5353 to 192.0.2.53:53.
+func frame(t *testing.T, typ MessageType, protocol SocketProtocol, name string, at time.Time) []byte {
+	m := &dns.Msg{}
+	m.SetQuestion(name, dns.TypeA)
+	if typ%2 == 0 {
+		m.Response = true
+	}
+	wire, err := m.Pack()
+	require.Nil(t, err)
+	sec, nsec := fieldQueryTimeSec, fieldQueryTimeNsec
+	msg := fieldQueryMessage
+	if typ%2 == 0 {
+		sec, nsec, msg = fieldResponseTimeSec, fieldResponseTimeNsec, fieldResponseMessage
+	}
+	var b []byte
+	b = protowire.AppendTag(b, fieldType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(typ))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, fieldProtocol, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(protocol))
+	b = protowire.AppendTag(b, fieldQueryAddress, protowire.BytesType)
+	b = protowire.AppendBytes(b, net.IPv4(192, 0, 2, 1).To4())
+	b = protowire.AppendTag(b, fieldResponseAddress, protowire.BytesType)
+	b = protowire.AppendBytes(b, net.IPv4(192, 0, 2, 53).To4())
+	b = protowire.AppendTag(b, fieldQueryPort, protowire.VarintType)
+	b = protowire.AppendVarint(b, 5353)
+	b = protowire.AppendTag(b, fieldResponsePort, protowire.VarintType)
+	b = protowire.AppendVarint(b, 53)
+	b = protowire.AppendTag(b, protowire.Number(sec), protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(at.Unix()))
+	b = protowire.AppendTag(b, protowire.Number(nsec), protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, uint32(at.Nanosecond()))
+	b = protowire.AppendTag(b, protowire.Number(msg), protowire.BytesType)
+	b = protowire.AppendBytes(b, wire)
+
+	var d []byte
+	d = protowire.AppendTag(d, 1, protowire.BytesType)
+	d = protowire.AppendBytes(d, []byte("resolver"))
+	d = protowire.AppendTag(d, fieldDnstapMessage, protowire.BytesType)
+	d = protowire.AppendBytes(d, b)
+	d = protowire.AppendTag(d, fieldDnstapType, protowire.VarintType)
+	return protowire.AppendVarint(d, dnstapTypeMessage)
+}
+
+func TestUnmarshal(t *testing.T) {
+	at := time.Date(2020, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	m, err := Unmarshal(frame(t, ClientQuery, UDP, "one.example.com.", at))
+	require.Nil(t, err)
+	require.Equal(t, ClientQuery, m.Type)
+	require.Equal(t, UDP, m.Protocol)
+	require.Equal(t, at, m.QueryTime)
+	require.True(t, m.ResponseTime.IsZero())
+	require.Equal(t, 5353, m.QueryPort)
+	require.Equal(t, 53, m.ResponsePort)
+	q, qAt, source, err := m.Query()
+	require.Nil(t, err)
+	require.Equal(t, "one.example.com.", q.Question[0].Name)
+	require.Equal(t, at, qAt)
+	require.Equal(t, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 5353}, source)
+
+	// Responses yield their question, and messages over TCP have TCP addresses.
+	m, err = Unmarshal(frame(t, ResolverResponse, TCP, "two.example.com.", at))
+	require.Nil(t, err)
+	require.Equal(t, at, m.ResponseTime)
+	q, qAt, source, err = m.Query()
+	require.Nil(t, err)
+	require.False(t, q.Response)
+	require.Equal(t, "two.example.com.", q.Question[0].Name)
+	require.Equal(t, at, qAt)
+	require.IsType(t, &net.TCPAddr{}, source)
+
+	// Frames of other types are skipped.
+	m, err = Unmarshal(protowire.AppendVarint(protowire.AppendTag(nil, fieldDnstapType, protowire.VarintType), 2))
+	require.Nil(t, err)
+	require.Nil(t, m)
+
+	_, err = Unmarshal([]byte{0xff})
+	require.NotNil(t, err)
+	_, err = Unmarshal(protowire.AppendVarint(protowire.AppendTag(nil, fieldDnstapType, protowire.VarintType), dnstapTypeMessage))
+	require.NotNil(t, err)
+}
+
+// testHandler records the queries it is served.
+type testHandler chan *servedQuery
+
+// servedQuery is a query served to a testHandler.
+type servedQuery struct {
+	name       string
+	remoteAddr net.Addr
+	receivedAt time.Time
+}
+
+func (h testHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	h <- &servedQuery{name: r.Question[0].Name, remoteAddr: w.RemoteAddr(), receivedAt: w.(interface{ ReceivedAt() time.Time }).ReceivedAt()}
+	w.WriteMsg(new(dns.Msg).SetReply(r))
+}
+
+// serve starts a server for h on a random port, and returns its address.
+func serve(t *testing.T, h dns.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	started := make(chan struct{})
+	srv := &Server{Handler: h, NotifyStartedFunc: func() { close(started) }}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Shutdown() })
+	<-started
+	return l.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	at := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, bidirectional := range []bool{true, false} {
+		h := make(testHandler, 10)
+		conn, err := net.Dial("tcp", serve(t, h))
+		require.Nil(t, err)
+		defer conn.Close()
+
+		if bidirectional {
+			require.Nil(t, writeControl(conn, controlReady, ContentType))
+			_, c, err := readFrame(conn)
+			require.Nil(t, err)
+			require.Equal(t, uint32(controlAccept), c.typ)
+			require.Equal(t, []string{ContentType}, c.contentTypes)
+		}
+		require.Nil(t, writeControl(conn, controlStart, ContentType))
+		var b bytes.Buffer
+		b.Write(dataFrame(frame(t, ClientQuery, UDP, "one.example.com.", at)))
+		b.Write(dataFrame([]byte("not a dnstap message")))
+		b.Write(dataFrame(frame(t, ClientResponse, UDP, "two.example.com.", at.Add(time.Second))))
+		_, err = conn.Write(b.Bytes())
+		require.Nil(t, err)
+		require.Nil(t, writeControl(conn, controlStop, ""))
+
+		q := <-h
+		require.Equal(t, "one.example.com.", q.name)
+		require.Equal(t, "192.0.2.1:5353", q.remoteAddr.String())
+		require.Equal(t, at, q.receivedAt)
+		q = <-h
+		require.Equal(t, "two.example.com.", q.name)
+		require.Equal(t, at.Add(time.Second), q.receivedAt)
+
+		if bidirectional {
+			_, c, err := readFrame(conn)
+			require.Nil(t, err)
+			require.Equal(t, uint32(controlFinish), c.typ)
+		}
+		// The server closes the connection once the stream stops.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+	}
+}
@@ -0,0 +1,136 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ContentType is the content type of Frame Streams carrying dnstap messages.
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// maxFrameSize is the largest frame accepted, which comfortably holds a dnstap message with a
+// query and a response of 64 KiB each.
+const maxFrameSize = 1 << 18
+
+// Types of Frame Streams control frames, and the field of their content types.
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	fieldContentType = 0x01
+)
+
+// errStopped is returned by readFrame for the STOP control frame, which ends a stream.
+var errStopped = errors.New("Stream stopped")
+
+// A control is a Frame Streams control frame.
+type control struct {
+	typ          uint32
+	contentTypes []string
+}
+
+// readFrame reads a frame from r, returning either a data frame or a control frame.
+func readFrame(r io.Reader) ([]byte, *control, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, nil, err
+	}
+	if length != 0 {
+		if length > maxFrameSize {
+			return nil, nil, fmt.Errorf("Frame of %d bytes exceeds the maximum of %d", length, maxFrameSize)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, nil, err
+		}
+		return data, nil, nil
+	}
+	// A length of 0 escapes a control frame, prefixed with its own length.
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, nil, err
+	}
+	if length < 4 || length > maxFrameSize {
+		return nil, nil, fmt.Errorf("Invalid control frame length %d", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, err
+	}
+	c := &control{typ: binary.BigEndian.Uint32(b[0:4])}
+	for b = b[4:]; len(b) > 0; {
+		if len(b) < 8 {
+			return nil, nil, errors.New("Truncated control frame field")
+		}
+		field, n := binary.BigEndian.Uint32(b[0:4]), binary.BigEndian.Uint32(b[4:8])
+		if uint32(len(b)-8) < n {
+			return nil, nil, errors.New("Truncated control frame field")
+		}
+		if field == fieldContentType {
+			c.contentTypes = append(c.contentTypes, string(b[8:8+n]))
+		}
+		b = b[8+n:]
+	}
+	return nil, c, nil
+}
+
+// writeControl writes a control frame of the type to w, with the content type if it isn't empty.
+func writeControl(w io.Writer, typ uint32, contentType string) error {
+	body := binary.BigEndian.AppendUint32(nil, typ)
+	if contentType != "" {
+		body = binary.BigEndian.AppendUint32(body, fieldContentType)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(contentType)))
+		body = append(body, contentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	_, err := w.Write(append(frame, body...))
+	return err
+}
+
+// accepts reports whether c offers the dnstap content type, or none, which allows any.
+func (c *control) accepts() bool {
+	if len(c.contentTypes) == 0 {
+		return true
+	}
+	for _, t := range c.contentTypes {
+		if t == ContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// handshake reads the start of a stream from rw. Bidirectional streams start with READY, which
+// is answered with ACCEPT, before START, while unidirectional ones start with START. It returns
+// whether the stream is bidirectional, in which case STOP must be answered with FINISH.
+func handshake(rw io.ReadWriter) (bool, error) {
+	_, c, err := readFrame(rw)
+	if err != nil {
+		return false, err
+	}
+	bidirectional := false
+	if c != nil && c.typ == controlReady {
+		if !c.accepts() {
+			return false, fmt.Errorf("Unsupported content types %q", c.contentTypes)
+		}
+		if err := writeControl(rw, controlAccept, ContentType); err != nil {
+			return false, err
+		}
+		bidirectional = true
+		if _, c, err = readFrame(rw); err != nil {
+			return false, err
+		}
+	}
+	if c == nil || c.typ != controlStart {
+		return false, errors.New("Stream doesn't begin with START")
+	}
+	if !c.accepts() {
+		return false, fmt.Errorf("Unsupported content types %q", c.contentTypes)
+	}
+	return bidirectional, nil
+}
@@ -0,0 +1,57 @@
+package dnstap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func dataFrame(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+func TestHandshake(t *testing.T) {
+	tests := map[string]struct {
+		frames        [][]byte
+		bidirectional bool
+		ok            bool
+	}{
+		"bidirectional":      {frames: [][]byte{controlFrame(controlReady, ContentType), controlFrame(controlStart, ContentType)}, bidirectional: true, ok: true},
+		"unidirectional":     {frames: [][]byte{controlFrame(controlStart, ContentType)}, ok: true},
+		"any content type":   {frames: [][]byte{controlFrame(controlStart, "")}, ok: true},
+		"other content type": {frames: [][]byte{controlFrame(controlReady, "protobuf:other")}},
+		"other start type":   {frames: [][]byte{controlFrame(controlStart, "protobuf:other")}},
+		"data before start":  {frames: [][]byte{dataFrame([]byte("data"))}},
+		"stop before start":  {frames: [][]byte{controlFrame(controlStop, "")}},
+		"truncated":          {frames: [][]byte{controlFrame(controlStart, ContentType)[:10]}},
+		"oversized control":  {frames: [][]byte{{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}}},
+		"truncated field":    {frames: [][]byte{{0, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0, controlStart, 0, 0, 0, fieldContentType}}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			in := &bytes.Buffer{}
+			for _, f := range test.frames {
+				in.Write(f)
+			}
+			bidirectional, err := handshake(&readWriter{Buffer: in, w: &bytes.Buffer{}})
+			require.Equal(t, test.ok, err == nil, err)
+			require.Equal(t, test.bidirectional, bidirectional)
+		})
+	}
+}
+
+// readWriter reads from its Buffer, and writes to w.
+type readWriter struct {
+	*bytes.Buffer
+	w *bytes.Buffer
+}
+
+func (rw *readWriter) Write(b []byte) (int, error) { return rw.w.Write(b) }
+
+func controlFrame(typ uint32, contentType string) []byte {
+	var b bytes.Buffer
+	writeControl(&b, typ, contentType)
+	return b.Bytes()
+}
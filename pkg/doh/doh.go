@@ -0,0 +1,121 @@
+// Package doh serves a dns.Handler over DNS-over-HTTPS, as described in RFC 8484.
+package doh
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// Path is the conventional path of a DoH endpoint.
+const Path = "/dns-query"
+
+// contentType is the media type of DNS messages in wire format.
+const contentType = "application/dns-message"
+
+// maxMessageSize is the largest DNS message accepted in a request body.
+const maxMessageSize = 65535
+
+// Handler returns an http.Handler that answers DoH requests with h. Both GET requests carrying a
+// base64url encoded message in the dns query parameter and POST requests carrying a message in
+// the body are supported.
+func Handler(h dns.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wire []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != contentType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil || len(wire) == 0 {
+			http.Error(w, "malformed DNS message", http.StatusBadRequest)
+			return
+		}
+
+		req := &dns.Msg{}
+		if err := req.Unpack(wire); err != nil {
+			http.Error(w, "malformed DNS message", http.StatusBadRequest)
+			return
+		}
+
+		rw := &responseWriter{remoteAddr: remoteAddr(r), localAddr: localAddr(r), tls: r.TLS}
+		h.ServeDNS(rw, req)
+		if rw.msg == nil {
+			http.Error(w, "no response", http.StatusInternalServerError)
+			return
+		}
+		resp, err := rw.msg.Pack()
+		if err != nil {
+			slog.Warn("Failed to pack DoH response", "client", r.RemoteAddr, "error", err)
+			http.Error(w, "failed to pack response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "max-age=0")
+		if _, err := w.Write(resp); err != nil {
+			slog.Warn("Failed to write DoH response", "client", r.RemoteAddr, "error", err)
+		}
+	})
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+func localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// responseWriter is a dns.ResponseWriter that captures the response so that it can be written to
+// the HTTP response. It implements dns.ConnectionStater with the TLS state of the request, if it
+// was received over TLS.
+type responseWriter struct {
+	msg        *dns.Msg
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	tls        *tls.ConnectionState
+}
+
+func (w *responseWriter) LocalAddr() net.Addr                   { return w.localAddr }
+func (w *responseWriter) RemoteAddr() net.Addr                  { return w.remoteAddr }
+func (w *responseWriter) ConnectionState() *tls.ConnectionState { return w.tls }
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	m := &dns.Msg{}
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *responseWriter) Close() error        { return nil }
+func (w *responseWriter) TsigStatus() error   { return nil }
+func (w *responseWriter) TsigTimersOnly(bool) {}
+func (w *responseWriter) Hijack()             {}
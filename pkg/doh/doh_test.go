@@ -0,0 +1,102 @@
+package doh
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func echoHandler() dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		m.Answer = []dns.RR{
+			&dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{w.RemoteAddr().String()},
+			},
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(Handler(echoHandler()))
+	defer srv.Close()
+
+	req := &dns.Msg{}
+	req.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeTXT)
+	req.Id = 0
+	wire, err := req.Pack()
+	require.Nil(t, err)
+
+	get, err := http.Get(srv.URL + Path + "?dns=" + base64.RawURLEncoding.EncodeToString(wire))
+	require.Nil(t, err)
+	post, err := http.Post(srv.URL+Path, contentType, bytes.NewReader(wire))
+	require.Nil(t, err)
+
+	for _, resp := range []*http.Response{get, post} {
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, contentType, resp.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+
+		m := &dns.Msg{}
+		require.Nil(t, m.Unpack(body))
+		require.Len(t, m.Answer, 1)
+		require.Contains(t, m.Answer[0].(*dns.TXT).Txt[0], "127.0.0.1")
+	}
+}
+
+func TestHandlerRejectsMalformed(t *testing.T) {
+	srv := httptest.NewServer(Handler(echoHandler()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + Path + "?dns=notdns")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+Path, "text/plain", bytes.NewReader([]byte("hello")))
+	require.Nil(t, err)
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+Path, nil)
+	require.Nil(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestHandlerConnectionState(t *testing.T) {
+	var states []*tls.ConnectionState
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		states = append(states, w.(dns.ConnectionStater).ConnectionState())
+		echoHandler().ServeDNS(w, r)
+	})
+	plain := httptest.NewServer(Handler(h))
+	defer plain.Close()
+	encrypted := httptest.NewTLSServer(Handler(h))
+	defer encrypted.Close()
+
+	req := &dns.Msg{}
+	req.SetQuestion("tunnel.example.com.", dns.TypeTXT)
+	wire, err := req.Pack()
+	require.Nil(t, err)
+	for _, srv := range []*httptest.Server{plain, encrypted} {
+		resp, err := srv.Client().Post(srv.URL+Path, contentType, bytes.NewReader(wire))
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	require.Len(t, states, 2)
+	require.Nil(t, states[0])
+	require.True(t, states[1].HandshakeComplete)
+}
@@ -0,0 +1,230 @@
+// Package doq serves a dns.Handler over DNS-over-QUIC, as described in RFC 9250.
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the application protocol negotiated by DoQ clients and servers.
+const ALPN = "doq"
+
+// Error codes that DoQ connections are closed with.
+const (
+	errNoError       quic.ApplicationErrorCode = 0x0
+	errProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+// DefaultIdleTimeout is how long a connection without any open stream is kept open by default.
+const DefaultIdleTimeout = 30 * time.Second
+
+// readTimeout is how long a client may take to send its query once it has opened a stream.
+const readTimeout = 5 * time.Second
+
+// A Server answers DNS queries received over QUIC with Handler. Each query is read from its own
+// bidirectional stream, as a message prefixed with its length, and answered on the same stream.
+type Server struct {
+	// Addr is the UDP address to listen on, e.g. :853.
+	Addr string
+	// Handler answers queries. dns.DefaultServeMux is used if nil.
+	Handler dns.Handler
+	// TLSConfig holds the certificate of the server. Its NextProtos are replaced with ALPN.
+	TLSConfig *tls.Config
+	// IdleTimeout is how long a connection without any open stream is kept open.
+	// DefaultIdleTimeout is used if 0.
+	IdleTimeout time.Duration
+	// NotifyStartedFunc, if set, is called once the server is listening.
+	NotifyStartedFunc func()
+
+	lock     sync.Mutex
+	listener *quic.Listener
+	closed   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conns    sync.WaitGroup
+}
+
+// ListenAndServe listens on s.Addr and serves connections until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	return s.Serve(pc)
+}
+
+// Serve serves connections received on pc until Shutdown is called.
+func (s *Server) Serve(pc net.PacketConn) error {
+	if s.TLSConfig == nil || len(s.TLSConfig.Certificates) == 0 && s.TLSConfig.GetCertificate == nil {
+		return errors.New("DNS-over-QUIC requires a TLS certificate")
+	}
+	tlsConfig := s.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{ALPN}
+	idleTimeout := s.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	l, err := quic.Listen(pc, tlsConfig, &quic.Config{MaxIdleTimeout: idleTimeout})
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.lock.Unlock()
+	if s.NotifyStartedFunc != nil {
+		s.NotifyStartedFunc()
+	}
+
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.conns.Add(1)
+		go s.serveConn(s.ctx, conn)
+	}
+}
+
+// Shutdown stops accepting connections, and closes the open ones once their queries are answered.
+func (s *Server) Shutdown() error {
+	s.lock.Lock()
+	s.closed = true
+	l := s.listener
+	s.lock.Unlock()
+	var err error
+	if l != nil {
+		err = l.Close()
+		s.cancel()
+	}
+	s.conns.Wait()
+	return err
+}
+
+// serveConn answers the queries of conn until the client closes it or ctx is done.
+func (s *Server) serveConn(ctx context.Context, conn quic.Connection) {
+	defer s.conns.Done()
+	var streams sync.WaitGroup
+	defer streams.Wait()
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			conn.CloseWithError(errNoError, "")
+			return
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			if err := s.serveStream(conn, stream); err != nil {
+				slog.Debug("Closing DoQ connection", "client", conn.RemoteAddr(), "error", err)
+				conn.CloseWithError(errProtocolError, err.Error())
+				return
+			}
+			stream.Close()
+		}()
+	}
+}
+
+// serveStream answers the query on stream. It returns an error if the client violated the
+// protocol, in which case the connection must be closed.
+func (s *Server) serveStream(conn quic.Connection, stream quic.Stream) error {
+	stream.SetReadDeadline(time.Now().Add(readTimeout))
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return fmt.Errorf("Failed to read query length: %w", err)
+	}
+	wire := make([]byte, length)
+	if _, err := io.ReadFull(stream, wire); err != nil {
+		return fmt.Errorf("Failed to read query: %w", err)
+	}
+	req := &dns.Msg{}
+	if err := req.Unpack(wire); err != nil {
+		return fmt.Errorf("Malformed query: %w", err)
+	}
+	// The stream identifies the query, so its ID must be 0.
+	if req.Id != 0 {
+		return fmt.Errorf("Query has non-zero ID %d", req.Id)
+	}
+
+	state := conn.ConnectionState().TLS
+	w := &responseWriter{stream: stream, localAddr: quicAddr{conn.LocalAddr()}, remoteAddr: quicAddr{conn.RemoteAddr()}, tls: &state}
+	handler := s.Handler
+	if handler == nil {
+		handler = dns.DefaultServeMux
+	}
+	handler.ServeDNS(w, req)
+	return nil
+}
+
+// quicAddr is a network address of a QUIC connection. It isn't a *net.UDPAddr, so that handlers
+// don't mistake queries for plain DNS over UDP and truncate their answers, which RFC 9250
+// forbids.
+type quicAddr struct {
+	net.Addr
+}
+
+func (a quicAddr) Network() string { return "quic" }
+
+// responseWriter is a dns.ResponseWriter writing the response to a query to its stream. It
+// implements dns.ConnectionStater with the TLS state of the connection.
+type responseWriter struct {
+	stream     quic.Stream
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	tls        *tls.ConnectionState
+}
+
+func (w *responseWriter) LocalAddr() net.Addr                   { return w.localAddr }
+func (w *responseWriter) RemoteAddr() net.Addr                  { return w.remoteAddr }
+func (w *responseWriter) ConnectionState() *tls.ConnectionState { return w.tls }
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	m.Id = 0
+	wire, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(wire)
+	return err
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if len(b) > dns.MaxMsgSize {
+		return 0, fmt.Errorf("Response of %d bytes is too large", len(b))
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	if _, err := w.stream.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *responseWriter) Close() error        { return w.stream.Close() }
+func (w *responseWriter) TsigStatus() error   { return nil }
+func (w *responseWriter) TsigTimersOnly(bool) {}
+func (w *responseWriter) Hijack()             {}
@@ -0,0 +1,141 @@
+package doq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSigned returns a TLS configuration with a self-signed certificate for localhost.
+func selfSigned(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// serve starts a DoQ server for handler on a random port, and returns its address.
+func serve(t *testing.T, handler dns.Handler) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	started := make(chan struct{})
+	srv := &Server{Handler: handler, TLSConfig: selfSigned(t), NotifyStartedFunc: func() { close(started) }}
+	go srv.Serve(pc)
+	t.Cleanup(func() {
+		srv.Shutdown()
+		pc.Close()
+	})
+	<-started
+	return pc.LocalAddr().String()
+}
+
+func dial(t *testing.T, addr string) quic.Connection {
+	conn, err := quic.DialAddr(context.Background(), addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPN}}, nil)
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	return conn
+}
+
+// exchange sends req on a new stream of conn and reads the response.
+func exchange(conn quic.Connection, req *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	wire, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if err := binary.Write(stream, binary.BigEndian, uint16(len(wire))); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(wire); err != nil {
+		return nil, err
+	}
+	stream.Close()
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	wire = make([]byte, length)
+	if _, err := io.ReadFull(stream, wire); err != nil {
+		return nil, err
+	}
+	resp := &dns.Msg{}
+	return resp, resp.Unpack(wire)
+}
+
+func TestServer(t *testing.T) {
+	remotes := make(chan net.Addr, 2)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		remotes <- w.RemoteAddr()
+		m := &dns.Msg{}
+		m.SetReply(r)
+		m.Answer = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"pong"}}}
+		w.WriteMsg(m)
+	})
+	conn := dial(t, serve(t, handler))
+
+	// Several queries can be sent on the same connection, each on its own stream.
+	for _, name := range []string{"one.example.com.", "two.example.com."} {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeTXT)
+		req.Id = 0
+		resp, err := exchange(conn, req)
+		require.Nil(t, err)
+		require.EqualValues(t, 0, resp.Id)
+		require.Equal(t, name, resp.Question[0].Name)
+		require.Equal(t, []string{"pong"}, resp.Answer[0].(*dns.TXT).Txt)
+	}
+	remote := <-remotes
+	require.Equal(t, "quic", remote.Network())
+	_, isUDP := remote.(*net.UDPAddr)
+	require.False(t, isUDP)
+	host, _, err := net.SplitHostPort(remote.String())
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1", host)
+}
+
+func TestServerNonZeroID(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		t.Error("Query with a non-zero ID was answered")
+	})
+	conn := dial(t, serve(t, handler))
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 1234
+	_, err := exchange(conn, req)
+	require.NotNil(t, err)
+	var appErr *quic.ApplicationError
+	require.ErrorAs(t, err, &appErr)
+	require.EqualValues(t, errProtocolError, appErr.ErrorCode)
+}
+
+func TestServerRequiresCertificate(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+	srv := &Server{}
+	require.NotNil(t, srv.Serve(pc))
+}
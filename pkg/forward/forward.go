@@ -0,0 +1,111 @@
+// Package forward relays DNS queries to upstream resolvers, so that a tunnel server can answer
+// names outside of its top domains like an ordinary resolver.
+package forward
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+)
+
+// DefaultTimeout is how long an upstream is given to answer a query by default.
+const DefaultTimeout = 2 * time.Second
+
+// Config configures a Forwarder.
+type Config struct {
+	// Upstreams are the addresses of the resolvers queries are forwarded to, e.g. 9.9.9.9 or
+	// [2620:fe::fe]:53. They are tried in order until one answers. Port 53 is used if the
+	// address has none.
+	Upstreams []string
+	// Timeout is how long each upstream is given to answer a query. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// A Forwarder is a dns.Handler answering queries with the answers of its upstreams, which are
+// relayed unchanged. Queries received over UDP are forwarded over UDP, so that truncated answers
+// make the client retry over TCP, and queries received over any other transport are forwarded
+// over TCP. Queries that no upstream answers get SERVFAIL.
+type Forwarder struct {
+	upstreams []string
+	udp       *dns.Client
+	tcp       *dns.Client
+
+	forwarded uint64
+	failed    uint64
+}
+
+// New creates a forwarder.
+func New(cfg Config) (*Forwarder, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, fmt.Errorf("Forwarding requires at least one upstream")
+	}
+	if cfg.Timeout < 0 {
+		return nil, fmt.Errorf("Timeout must not be negative")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	f := &Forwarder{
+		udp: &dns.Client{Net: "udp", Timeout: cfg.Timeout},
+		tcp: &dns.Client{Net: "tcp", Timeout: cfg.Timeout},
+	}
+	for _, upstream := range cfg.Upstreams {
+		addr, err := upstreamAddr(upstream)
+		if err != nil {
+			return nil, err
+		}
+		f.upstreams = append(f.upstreams, addr)
+	}
+	return f, nil
+}
+
+// upstreamAddr returns the address of upstream with port 53 if it has no port.
+func upstreamAddr(upstream string) (string, error) {
+	if _, _, err := net.SplitHostPort(upstream); err == nil {
+		return upstream, nil
+	}
+	if net.ParseIP(upstream) == nil {
+		return "", fmt.Errorf("Invalid upstream %q, expected an IP address with an optional port", upstream)
+	}
+	return net.JoinHostPort(upstream, "53"), nil
+}
+
+// ServeDNS implements dns.Handler.
+func (f *Forwarder) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	client := f.tcp
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		client = f.udp
+	}
+	for _, upstream := range f.upstreams {
+		resp, _, err := client.Exchange(r, upstream)
+		if err != nil {
+			slog.Warn("Failed to forward query", "upstream", upstream, "error", err)
+			continue
+		}
+		atomic.AddUint64(&f.forwarded, 1)
+		if err := w.WriteMsg(resp); err != nil {
+			slog.Warn("Failed to write forwarded response", "client", w.RemoteAddr(), "error", err)
+		}
+		return
+	}
+
+	atomic.AddUint64(&f.failed, 1)
+	m := &dns.Msg{}
+	m.SetRcode(r, dns.RcodeServerFailure)
+	if err := w.WriteMsg(m); err != nil {
+		slog.Warn("Failed to write response", "client", w.RemoteAddr(), "error", err)
+	}
+}
+
+// Collect implements metrics.Collector.
+func (f *Forwarder) Collect() []metrics.Metric {
+	return []metrics.Metric{
+		{Name: "browsertunnel_forwarded_total", Help: "Queries answered by an upstream resolver.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&f.forwarded))},
+		{Name: "browsertunnel_forward_failures_total", Help: "Queries that no upstream resolver answered.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&f.failed))},
+	}
+}
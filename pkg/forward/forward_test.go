@@ -0,0 +1,112 @@
+package forward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type testResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
+
+// serveUpstream starts a resolver on 127.0.0.1 over UDP and TCP, answering A queries with the
+// network they were received over in a TXT record, and returns its address.
+func serveUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	require.Nil(t, err)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{w.RemoteAddr().Network()},
+		}}
+		w.WriteMsg(m)
+	})
+	for _, srv := range []*dns.Server{{Listener: l, Handler: handler}, {PacketConn: pc, Handler: handler}} {
+		srv := srv
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		t.Cleanup(func() { srv.Shutdown() })
+		<-started
+	}
+	return l.Addr().String()
+}
+
+func TestForwarder(t *testing.T) {
+	upstream := serveUpstream(t)
+	// The first upstream refuses connections, so queries fall back to the second.
+	f, err := New(Config{Upstreams: []string{"127.0.0.1:1", upstream}, Timeout: time.Second})
+	require.Nil(t, err)
+
+	tests := []struct {
+		remote  net.Addr
+		network string
+	}{
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}, "udp"},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}, "tcp"},
+	}
+	for _, test := range tests {
+		w := &testResponseWriter{remote: test.remote}
+		r := &dns.Msg{}
+		r.SetQuestion("www.example.com.", dns.TypeA)
+		f.ServeDNS(w, r)
+		require.Equal(t, r.Id, w.msg.Id)
+		require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+		require.Equal(t, []string{test.network}, w.msg.Answer[0].(*dns.TXT).Txt)
+	}
+	require.EqualValues(t, 2, f.Collect()[0].Value)
+	require.EqualValues(t, 0, f.Collect()[1].Value)
+}
+
+func TestForwarderFailure(t *testing.T) {
+	f, err := New(Config{Upstreams: []string{"127.0.0.1:1"}, Timeout: time.Second})
+	require.Nil(t, err)
+
+	w := &testResponseWriter{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}}
+	r := &dns.Msg{}
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	f.ServeDNS(w, r)
+	require.Equal(t, dns.RcodeServerFailure, w.msg.Rcode)
+	require.EqualValues(t, 1, f.Collect()[1].Value)
+}
+
+func TestNew(t *testing.T) {
+	f, err := New(Config{Upstreams: []string{"9.9.9.9", "2620:fe::fe", "[2620:fe::9]:5353"}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"9.9.9.9:53", "[2620:fe::fe]:53", "[2620:fe::9]:5353"}, f.upstreams)
+
+	_, err = New(Config{})
+	require.NotNil(t, err)
+	_, err = New(Config{Upstreams: []string{"resolver.example.com"}})
+	require.NotNil(t, err)
+	_, err = New(Config{Upstreams: []string{"9.9.9.9"}, Timeout: -1})
+	require.NotNil(t, err)
+}
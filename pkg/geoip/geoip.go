@@ -0,0 +1,128 @@
+// Package geoip annotates messages with the country and autonomous system of the resolver that
+// sent them, and of the client subnet it was resolved on behalf of, looked up in MaxMind
+// databases such as GeoLite2 Country and GeoLite2 ASN.
+package geoip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// record holds the fields of a database record that messages are annotated with. Country and
+// City databases hold the country, and ASN databases the autonomous system.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN          uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// A Location is what the databases know of an IP address. Fields are empty if unknown.
+type Location struct {
+	// Country is the ISO 3166-1 code of the country, e.g. NL.
+	Country string
+	// ASN is the number of the autonomous system, and Organization the name of its operator.
+	ASN          uint
+	Organization string
+}
+
+// A DB looks IP addresses up in one or more MaxMind databases. It implements hook.Hook, tagging
+// each message with the location of its source as resolver_country, resolver_asn and
+// resolver_org, and with the location of its client subnet, if any, as subnet_country, subnet_asn
+// and subnet_org. Tags are only added for the fields that are known.
+type DB struct {
+	readers []*maxminddb.Reader
+}
+
+// Open opens the databases at paths. Databases listed first take precedence for the fields they
+// know.
+func Open(paths ...string) (*DB, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("No GeoIP database given")
+	}
+	db := &DB{}
+	for _, path := range paths {
+		r, err := maxminddb.Open(path)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Lookup returns the location of ip.
+func (db *DB) Lookup(ip net.IP) (Location, error) {
+	var loc Location
+	for _, r := range db.readers {
+		var rec record
+		if err := r.Lookup(ip, &rec); err != nil {
+			return loc, err
+		}
+		if loc.Country == "" {
+			loc.Country = rec.Country.ISOCode
+		}
+		if loc.ASN == 0 {
+			loc.ASN, loc.Organization = rec.ASN, rec.Organization
+		}
+	}
+	return loc, nil
+}
+
+// Process implements hook.Hook. It never drops messages.
+func (db *DB) Process(ctx context.Context, msg tunnel.Message) (tunnel.Message, bool, error) {
+	tags := make(map[string]string, len(msg.Tags)+6)
+	for k, v := range msg.Tags {
+		tags[k] = v
+	}
+	if msg.Source != nil {
+		if err := db.tag(tags, "resolver_", msg.Source); err != nil {
+			return msg, false, err
+		}
+	}
+	if msg.ClientSubnet != nil {
+		if err := db.tag(tags, "subnet_", msg.ClientSubnet.IP); err != nil {
+			return msg, false, err
+		}
+	}
+	if len(tags) > 0 {
+		msg.Tags = tags
+	}
+	return msg, true, nil
+}
+
+// tag adds the location of ip to tags, with prefix before the name of each tag.
+func (db *DB) tag(tags map[string]string, prefix string, ip net.IP) error {
+	loc, err := db.Lookup(ip)
+	if err != nil {
+		return err
+	}
+	if loc.Country != "" {
+		tags[prefix+"country"] = loc.Country
+	}
+	if loc.ASN != 0 {
+		tags[prefix+"asn"] = strconv.FormatUint(uint64(loc.ASN), 10)
+	}
+	if loc.Organization != "" {
+		tags[prefix+"org"] = loc.Organization
+	}
+	return nil
+}
+
+// Close closes the databases.
+func (db *DB) Close() error {
+	var err error
+	for _, r := range db.readers {
+		if cerr := r.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package geoip
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// testdata/test.mmdb maps 192.0.2.0/24 to NL and AS64496, 198.51.100.0/24 to JP and AS64500, and
+// 2001:db8::/32 to DE and AS64511.
+const testDB = "testdata/test.mmdb"
+
+func TestLookup(t *testing.T) {
+	db, err := Open(testDB)
+	require.Nil(t, err)
+	defer db.Close()
+
+	tests := []struct {
+		ip       string
+		location Location
+	}{
+		{ip: "192.0.2.1", location: Location{Country: "NL", ASN: 64496, Organization: "Example Resolvers"}},
+		{ip: "2001:db8::53", location: Location{Country: "DE", ASN: 64511, Organization: "Example IPv6"}},
+		{ip: "203.0.113.1", location: Location{}},
+	}
+	for _, test := range tests {
+		loc, err := db.Lookup(net.ParseIP(test.ip))
+		require.Nil(t, err)
+		require.Equal(t, test.location, loc, test.ip)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	db, err := Open(testDB)
+	require.Nil(t, err)
+	defer db.Close()
+
+	_, subnet, err := net.ParseCIDR("198.51.100.0/24")
+	require.Nil(t, err)
+	msg := tunnel.Message{
+		ID:           "2jkhm3",
+		Source:       net.ParseIP("192.0.2.1"),
+		ClientSubnet: subnet,
+		Tags:         map[string]string{"hook": "lua"},
+	}
+	got, ok, err := db.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, map[string]string{
+		"hook":             "lua",
+		"resolver_country": "NL",
+		"resolver_asn":     "64496",
+		"resolver_org":     "Example Resolvers",
+		"subnet_country":   "JP",
+		"subnet_asn":       "64500",
+		"subnet_org":       "Example Access",
+	}, got.Tags)
+	// The tags of the original message are left alone.
+	require.Len(t, msg.Tags, 1)
+
+	got, ok, err = db.Process(context.Background(), tunnel.Message{ID: "2jkhm3", Source: net.ParseIP("203.0.113.1")})
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Nil(t, got.Tags)
+}
+
+func TestOpenInvalid(t *testing.T) {
+	_, err := Open()
+	require.NotNil(t, err)
+	_, err = Open("testdata/missing.mmdb")
+	require.NotNil(t, err)
+	_, err = Open("geoip.go")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,156 @@
+// Package health serves liveness and readiness probes, such as Kubernetes' /healthz and /readyz.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long a Checker waits for each check before reporting it as failed.
+const DefaultTimeout = 2 * time.Second
+
+// A Check reports whether a component is healthy. It returns an error describing the problem if
+// it isn't.
+type Check func(ctx context.Context) error
+
+// A Checker is an http.Handler that runs a set of checks on every request. It responds with 200
+// OK if they all pass, or 503 Service Unavailable if any of them fails, along with a JSON object
+// reporting the result of each check:
+//
+//	{"status": "fail", "checks": {"dns/udp": "ok", "sink/webhook": "connection refused"}}
+type Checker struct {
+	// Timeout defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	checks map[string]Check
+}
+
+// response is the JSON body written by a Checker.
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Add registers check under name, replacing any check with the same name.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checks == nil {
+		c.checks = make(map[string]Check)
+	}
+	c.checks[name] = check
+}
+
+// Run runs every check in parallel, and returns the error of each one that failed, keyed by name.
+func (c *Checker) Run(ctx context.Context) map[string]error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c.mu.Lock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.Unlock()
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			done := make(chan error, 1)
+			go func() { done <- check(ctx) }()
+			select {
+			case errs[i] = <-done:
+			case <-ctx.Done():
+				errs[i] = fmt.Errorf("Check timed out: %w", ctx.Err())
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	failed := make(map[string]error)
+	for i, err := range errs {
+		if err != nil {
+			failed[names[i]] = err
+		}
+	}
+	return failed
+}
+
+// ServeHTTP implements http.Handler.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	failed := c.Run(r.Context())
+
+	c.mu.Lock()
+	resp := response{Status: "ok", Checks: make(map[string]string, len(c.checks))}
+	for name := range c.checks {
+		resp.Checks[name] = "ok"
+	}
+	c.mu.Unlock()
+	for name, err := range failed {
+		resp.Status = "fail"
+		resp.Checks[name] = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if len(failed) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Warn("Failed to write health response", "client", r.RemoteAddr, "error", err)
+	}
+}
+
+// A Flag is a Check that fails until it is set, such as whether a listener has started. The zero
+// value is unset.
+type Flag struct {
+	mu  sync.Mutex
+	set bool
+	err error
+}
+
+// Set marks the flag as healthy.
+func (f *Flag) Set() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set, f.err = true, nil
+}
+
+// Fail marks the flag as unhealthy because of err.
+func (f *Flag) Fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set, f.err = false, err
+}
+
+// Check implements Check.
+func (f *Flag) Check(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if !f.set {
+		return fmt.Errorf("Not started")
+	}
+	return nil
+}
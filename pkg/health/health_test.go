@@ -0,0 +1,58 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, c *Checker) (int, response) {
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var resp response
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	return w.Code, resp
+}
+
+func TestChecker(t *testing.T) {
+	c := &Checker{}
+	code, resp := get(t, c)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, response{Status: "ok", Checks: map[string]string{}}, resp)
+
+	var listener Flag
+	c.Add("dns/udp", listener.Check)
+	c.Add("backlog", func(ctx context.Context) error { return nil })
+	code, resp = get(t, c)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, response{Status: "fail", Checks: map[string]string{"dns/udp": "Not started", "backlog": "ok"}}, resp)
+
+	listener.Set()
+	code, _ = get(t, c)
+	require.Equal(t, http.StatusOK, code)
+
+	listener.Fail(fmt.Errorf("address already in use"))
+	code, resp = get(t, c)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "address already in use", resp.Checks["dns/udp"])
+}
+
+func TestCheckerTimeout(t *testing.T) {
+	c := &Checker{Timeout: 10 * time.Millisecond}
+	block := make(chan struct{})
+	defer close(block)
+	c.Add("slow", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+	failed := c.Run(context.Background())
+	require.Len(t, failed, 1)
+	require.ErrorIs(t, failed["slow"], context.DeadlineExceeded)
+}
@@ -0,0 +1,112 @@
+// Package hook runs operator supplied code on each message assembled by a tunnel before it is
+// delivered to sinks. A hook can transform a message, e.g. to decrypt or parse its payload,
+// enrich it with tags, or reject it.
+package hook
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// A Hook processes a message before it is delivered. It returns the message to deliver, which may
+// have been modified, or false to drop it.
+type Hook interface {
+	Process(ctx context.Context, msg tunnel.Message) (tunnel.Message, bool, error)
+}
+
+// A Sink is a sink.Sink that passes each message through a hook before delivering it to another
+// sink. Messages that the hook drops, or fails to process, aren't delivered.
+type Sink struct {
+	hook    Hook
+	next    sink.Sink
+	dropped uint64
+	failed  uint64
+}
+
+// NewSink returns a Sink delivering the messages processed by h to next.
+func NewSink(h Hook, next sink.Sink) *Sink {
+	return &Sink{hook: h, next: next}
+}
+
+// Deliver implements sink.Sink.
+func (s *Sink) Deliver(ctx context.Context, msg tunnel.Message) error {
+	msg, ok, err := s.hook.Process(ctx, msg)
+	if err != nil {
+		atomic.AddUint64(&s.failed, 1)
+		return fmt.Errorf("Hook failed: %w", err)
+	}
+	if !ok {
+		atomic.AddUint64(&s.dropped, 1)
+		return nil
+	}
+	return s.next.Deliver(ctx, msg)
+}
+
+// Collect implements metrics.Collector.
+func (s *Sink) Collect() []metrics.Metric {
+	return []metrics.Metric{
+		{Name: "browsertunnel_hook_dropped_total", Help: "Messages dropped by the hook.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&s.dropped))},
+		{Name: "browsertunnel_hook_failures_total", Help: "Messages that the hook failed to process.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&s.failed))},
+	}
+}
+
+// result is the JSON verdict of a hook on a message. Fields that are omitted leave the message
+// unchanged.
+type result struct {
+	// Drop drops the message.
+	Drop bool `json:"drop"`
+	// Payload replaces the payload of the message. It is encoded in base64 if Binary is true.
+	Payload *string `json:"payload"`
+	// Binary marks the message as binary or text.
+	Binary *bool `json:"binary"`
+	// Tags are added to the tags of the message.
+	Tags map[string]string `json:"tags"`
+}
+
+// apply returns msg modified by the JSON result b, or false if it must be dropped.
+func apply(msg tunnel.Message, b []byte) (tunnel.Message, bool, error) {
+	var r result
+	if err := json.Unmarshal(b, &r); err != nil {
+		return msg, false, fmt.Errorf("Invalid result: %w", err)
+	}
+	if r.Drop {
+		return msg, false, nil
+	}
+	if r.Binary != nil {
+		msg.Binary = *r.Binary
+	}
+	if r.Payload != nil {
+		msg.Payload = []byte(*r.Payload)
+		if r.Binary != nil && *r.Binary {
+			payload, err := base64.StdEncoding.DecodeString(*r.Payload)
+			if err != nil {
+				return msg, false, fmt.Errorf("Invalid binary payload: %w", err)
+			}
+			msg.Payload = payload
+		}
+	}
+	msg.Tags = addTags(msg.Tags, r.Tags)
+	return msg, true, nil
+}
+
+// addTags returns a copy of tags with extra added, or tags itself if there is nothing to add.
+func addTags(tags, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return tags
+	}
+	merged := make(map[string]string, len(tags)+len(extra))
+	for k, v := range tags {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,86 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestApply(t *testing.T) {
+	msg := tunnel.Message{ID: "2jkhm3", Payload: []byte("hello world"), Tags: map[string]string{"a": "1"}}
+	tests := []struct {
+		result  string
+		ok      bool
+		payload string
+		binary  bool
+		tags    map[string]string
+	}{
+		{`{}`, true, "hello world", false, map[string]string{"a": "1"}},
+		{`{"drop": true}`, false, "", false, nil},
+		{`{"payload": "HELLO"}`, true, "HELLO", false, map[string]string{"a": "1"}},
+		{`{"payload": "/wA=", "binary": true}`, true, "\xff\x00", true, map[string]string{"a": "1"}},
+		{`{"binary": true}`, true, "hello world", true, map[string]string{"a": "1"}},
+		{`{"tags": {"a": "2", "b": "3"}}`, true, "hello world", false, map[string]string{"a": "2", "b": "3"}},
+	}
+	for _, test := range tests {
+		out, ok, err := apply(msg, []byte(test.result))
+		require.Nil(t, err, test.result)
+		require.Equal(t, test.ok, ok, test.result)
+		if ok {
+			require.Equal(t, test.payload, string(out.Payload), test.result)
+			require.Equal(t, test.binary, out.Binary, test.result)
+			require.Equal(t, test.tags, out.Tags, test.result)
+		}
+	}
+	// The tags of the original message aren't modified.
+	require.Equal(t, map[string]string{"a": "1"}, msg.Tags)
+
+	for _, result := range []string{`nope`, `{"payload": "!", "binary": true}`} {
+		_, _, err := apply(msg, []byte(result))
+		require.NotNil(t, err, result)
+	}
+}
+
+type hookFunc func(msg tunnel.Message) (tunnel.Message, bool, error)
+
+func (f hookFunc) Process(ctx context.Context, msg tunnel.Message) (tunnel.Message, bool, error) {
+	return f(msg)
+}
+
+type recordingSink struct {
+	messages []tunnel.Message
+}
+
+func (s *recordingSink) Deliver(ctx context.Context, msg tunnel.Message) error {
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	next := &recordingSink{}
+	s := NewSink(hookFunc(func(msg tunnel.Message) (tunnel.Message, bool, error) {
+		switch msg.ID {
+		case "drop":
+			return msg, false, nil
+		case "fail":
+			return msg, false, errors.New("boom")
+		}
+		msg.Payload = []byte("processed")
+		return msg, true, nil
+	}), next)
+
+	require.Nil(t, s.Deliver(context.Background(), tunnel.Message{ID: "keep"}))
+	require.Nil(t, s.Deliver(context.Background(), tunnel.Message{ID: "drop"}))
+	require.NotNil(t, s.Deliver(context.Background(), tunnel.Message{ID: "fail"}))
+	require.Len(t, next.messages, 1)
+	require.Equal(t, "processed", string(next.messages[0].Payload))
+
+	values := map[string]float64{}
+	for _, m := range s.Collect() {
+		values[m.Name] = m.Value
+	}
+	require.Equal(t, map[string]float64{"browsertunnel_hook_dropped_total": 1, "browsertunnel_hook_failures_total": 1}, values)
+}
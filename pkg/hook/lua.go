@@ -0,0 +1,160 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// A Lua is a Hook running a Lua script, which must define a global function on_message(msg). msg
+// is a table with the fields of the message in the JSON format delivered by the sinks, except
+// that payload holds the payload as is, even if it is binary, and tags is always a table.
+// on_message returns false to drop the message, a table to deliver instead of msg, or nothing to
+// deliver msg, which it may have modified. Only changes to the payload, binary and tags fields are
+// delivered.
+type Lua struct {
+	timeout time.Duration
+
+	mu        sync.Mutex
+	state     *lua.LState
+	onMessage lua.LValue
+}
+
+// LoadLua runs the script at path, giving on_message timeout to process each message, or
+// DefaultTimeout if timeout is 0.
+func LoadLua(path string, timeout time.Duration) (*Lua, error) {
+	return newLua(func(state *lua.LState) error { return state.DoFile(path) }, timeout)
+}
+
+// NewLua runs the script source, giving on_message timeout to process each message, or
+// DefaultTimeout if timeout is 0.
+func NewLua(source string, timeout time.Duration) (*Lua, error) {
+	return newLua(func(state *lua.LState) error { return state.DoString(source) }, timeout)
+}
+
+func newLua(load func(*lua.LState) error, timeout time.Duration) (*Lua, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	l := &Lua{timeout: timeout, state: lua.NewState()}
+	if err := load(l.state); err != nil {
+		l.state.Close()
+		return nil, err
+	}
+	l.onMessage = l.state.GetGlobal("on_message")
+	if l.onMessage.Type() != lua.LTFunction {
+		l.state.Close()
+		return nil, errors.New("The script doesn't define on_message")
+	}
+	return l, nil
+}
+
+// Process implements Hook.
+func (l *Lua) Process(ctx context.Context, msg tunnel.Message) (tunnel.Message, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state.SetContext(ctx)
+	defer l.state.RemoveContext()
+
+	table := l.table(msg)
+	if err := l.state.CallByParam(lua.P{Fn: l.onMessage, NRet: 1, Protect: true}, table); err != nil {
+		return msg, false, err
+	}
+	ret := l.state.Get(-1)
+	l.state.Pop(1)
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+	case lua.LBool:
+		if !ret {
+			return msg, false, nil
+		}
+	case *lua.LTable:
+		table = ret
+	default:
+		return msg, false, fmt.Errorf("on_message returned a %s", ret.Type())
+	}
+	return fromTable(msg, table)
+}
+
+// table returns msg as a Lua table.
+func (l *Lua) table(msg tunnel.Message) *lua.LTable {
+	t := l.state.NewTable()
+	t.RawSetString("id", lua.LString(msg.ID))
+	t.RawSetString("payload", lua.LString(msg.Payload))
+	t.RawSetString("binary", lua.LBool(msg.Binary))
+	t.RawSetString("signer", lua.LString(msg.Signer))
+	if msg.Source != nil {
+		t.RawSetString("source", lua.LString(msg.Source.String()))
+	}
+	if msg.ClientSubnet != nil {
+		t.RawSetString("client_subnet", lua.LString(msg.ClientSubnet.String()))
+	}
+	t.RawSetString("qtype", lua.LString(dns.TypeToString[msg.QueryType]))
+	t.RawSetString("domain", lua.LString(msg.Domain))
+	t.RawSetString("tenant", lua.LString(msg.Tenant))
+	t.RawSetString("session", lua.LString(msg.Session))
+	t.RawSetString("sequence", lua.LNumber(msg.Sequence))
+	t.RawSetString("fragments", lua.LNumber(msg.Fragments))
+	t.RawSetString("first_fragment", lua.LString(msg.FirstFragment.Format(time.RFC3339Nano)))
+	t.RawSetString("last_fragment", lua.LString(msg.LastFragment.Format(time.RFC3339Nano)))
+	tags := l.state.NewTable()
+	for k, v := range msg.Tags {
+		tags.RawSetString(k, lua.LString(v))
+	}
+	t.RawSetString("tags", tags)
+	return t
+}
+
+// fromTable returns msg with the payload, binary and tags fields of t.
+func fromTable(msg tunnel.Message, t *lua.LTable) (tunnel.Message, bool, error) {
+	switch payload := t.RawGetString("payload").(type) {
+	case lua.LString:
+		msg.Payload = []byte(payload)
+	case *lua.LNilType:
+		msg.Payload = nil
+	default:
+		return msg, false, fmt.Errorf("Invalid payload of type %s", payload.Type())
+	}
+	msg.Binary = lua.LVAsBool(t.RawGetString("binary"))
+
+	switch tags := t.RawGetString("tags").(type) {
+	case *lua.LTable:
+		var err error
+		msg.Tags = make(map[string]string)
+		tags.ForEach(func(k, v lua.LValue) {
+			if k.Type() != lua.LTString || (v.Type() != lua.LTString && v.Type() != lua.LTNumber) {
+				err = fmt.Errorf("Invalid tag %s = %s", k, v)
+				return
+			}
+			msg.Tags[k.String()] = v.String()
+		})
+		if err != nil {
+			return msg, false, err
+		}
+		if len(msg.Tags) == 0 {
+			msg.Tags = nil
+		}
+	case *lua.LNilType:
+		msg.Tags = nil
+	default:
+		return msg, false, fmt.Errorf("Invalid tags of type %s", tags.Type())
+	}
+	return msg, true, nil
+}
+
+// Close releases the script.
+func (l *Lua) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state.Close()
+	return nil
+}
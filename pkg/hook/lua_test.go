@@ -0,0 +1,80 @@
+package hook
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+const testScript = `
+function on_message(msg)
+  if msg.id == "drop" then
+    return false
+  elseif msg.id == "loop" then
+    while true do end
+  elseif msg.id == "fail" then
+    error("boom")
+  elseif msg.id == "replace" then
+    return {payload = "replaced"}
+  end
+  msg.payload = string.upper(msg.payload)
+  msg.tags.source = msg.source .. " " .. msg.qtype
+  msg.tags.fragments = msg.fragments
+end
+`
+
+func TestLua(t *testing.T) {
+	l, err := NewLua(testScript, 50*time.Millisecond)
+	require.Nil(t, err)
+	defer l.Close()
+
+	msg := tunnel.Message{ID: "2jkhm3", Payload: []byte("hello world"), Source: net.ParseIP("192.0.2.1"), QueryType: dns.TypeA, Fragments: 2}
+	out, ok, err := l.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "HELLO WORLD", string(out.Payload))
+	require.Equal(t, map[string]string{"source": "192.0.2.1 A", "fragments": "2"}, out.Tags)
+
+	msg.ID = "replace"
+	out, ok, err = l.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "replaced", string(out.Payload))
+	require.Nil(t, out.Tags)
+
+	msg.ID = "drop"
+	_, ok, err = l.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// Failing and looping scripts fail the message, but not the next ones.
+	msg.ID = "fail"
+	_, _, err = l.Process(context.Background(), msg)
+	require.ErrorContains(t, err, "boom")
+	msg.ID = "loop"
+	_, _, err = l.Process(context.Background(), msg)
+	require.NotNil(t, err)
+	msg.ID = "2jkhm3"
+	out, ok, err = l.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "HELLO WORLD", string(out.Payload))
+}
+
+func TestLuaInvalid(t *testing.T) {
+	_, err := NewLua("this isn't lua", 0)
+	require.NotNil(t, err)
+	_, err = NewLua("x = 1", 0)
+	require.EqualError(t, err, "The script doesn't define on_message")
+
+	l, err := NewLua(`function on_message(msg) return 42 end`, 0)
+	require.Nil(t, err)
+	defer l.Close()
+	_, _, err = l.Process(context.Background(), tunnel.Message{})
+	require.EqualError(t, err, "on_message returned a number")
+}
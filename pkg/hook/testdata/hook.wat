@@ -0,0 +1,25 @@
+;; The WASM hook used by the tests; hook.wasm is this module in the binary format. Depending on
+;; the first character of the message ID, it drops the message (x), traps (e), leaves the message
+;; unchanged (u), or replaces its payload and tags it.
+(module
+  (memory (export "memory") 1)
+  (global $heap (mut i32) (i32.const 1024))
+  (data (i32.const 0) "{\"payload\":\"enriched\",\"tags\":{\"hook\":\"wasm\"}}")
+  (data (i32.const 64) "{\"drop\":true}")
+
+  (func (export "alloc") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $heap))
+    (global.set $heap (i32.add (global.get $heap) (local.get $size)))
+    (local.get $ptr))
+
+  ;; The message starts with {"id":", followed by its ID.
+  (func (export "on_message") (param $ptr i32) (param $len i32) (result i64)
+    (if (i32.eq (i32.load8_u offset=7 (local.get $ptr)) (i32.const 120))
+      (then (return (i64.const 274877906957)))) ;; 64<<32 | 13
+    (if (i32.eq (i32.load8_u offset=7 (local.get $ptr)) (i32.const 101))
+      (then unreachable))
+    (if (i32.eq (i32.load8_u offset=7 (local.get $ptr)) (i32.const 117))
+      (then (return (i64.const 0))))
+    ;; The result is at address 0, so its length is all there is to return.
+    (i64.const 45)))
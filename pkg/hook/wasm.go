@@ -0,0 +1,206 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// DefaultTimeout is the time a hook is given to process a message by default.
+const DefaultTimeout = time.Second
+
+// A WASM is a Hook running a WebAssembly module, which may import WASI. The module must export
+// its memory and two functions:
+//
+//	alloc(size i32) i32          returns the address of size bytes of memory for the message
+//	on_message(ptr, len i32) i64 processes the message written at ptr
+//
+// The message is written as JSON, in the format delivered by the sinks. on_message returns the
+// address of its JSON result in the high 32 bits and its length in the low 32 bits, or 0 to
+// deliver the message unchanged. The result is an object with any of the fields:
+//
+//	{"drop": true}                 drops the message
+//	{"payload": "...", "binary": b} replaces the payload, which is in base64 if binary is true
+//	{"tags": {"key": "value"}}     tags the message
+//
+// If the module exports free(ptr, len i32), it is called on the message and on the result once
+// they have been read. If processing a message fails, the module is instantiated again, so that
+// its state can't be left corrupted.
+type WASM struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	module   api.Module
+}
+
+// LoadWASM compiles the module at path, giving it timeout to process each message, or
+// DefaultTimeout if timeout is 0.
+func LoadWASM(ctx context.Context, path string, timeout time.Duration) (*WASM, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewWASM(ctx, code, timeout)
+}
+
+// NewWASM compiles the module code, giving it timeout to process each message, or
+// DefaultTimeout if timeout is 0.
+func NewWASM(ctx context.Context, code []byte, timeout time.Duration) (*WASM, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	w := &WASM{
+		timeout: timeout,
+		// Closing the module when the context is done stops modules that run for too long.
+		runtime: wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true)),
+	}
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, w.runtime); err != nil {
+		w.runtime.Close(ctx)
+		return nil, err
+	}
+	var err error
+	if w.compiled, err = w.runtime.CompileModule(ctx, code); err != nil {
+		w.runtime.Close(ctx)
+		return nil, err
+	}
+	for _, export := range []struct {
+		name            string
+		params, results []api.ValueType
+	}{
+		{"alloc", []api.ValueType{api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}},
+		{"on_message", []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}},
+	} {
+		def, ok := w.compiled.ExportedFunctions()[export.name]
+		if !ok {
+			w.runtime.Close(ctx)
+			return nil, fmt.Errorf("The module doesn't export %s", export.name)
+		}
+		if !equalTypes(def.ParamTypes(), export.params) || !equalTypes(def.ResultTypes(), export.results) {
+			w.runtime.Close(ctx)
+			return nil, fmt.Errorf("The module exports %s with the wrong signature", export.name)
+		}
+	}
+	if err := w.instantiate(ctx); err != nil {
+		w.runtime.Close(ctx)
+		return nil, err
+	}
+	return w, nil
+}
+
+func equalTypes(a, b []api.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// instantiate replaces the module instance with a new one.
+func (w *WASM) instantiate(ctx context.Context) error {
+	if w.module != nil {
+		w.module.Close(ctx)
+		w.module = nil
+	}
+	// Reactor modules, e.g. those built by TinyGo or with WASI, initialize themselves in
+	// _initialize rather than _start.
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize").WithStderr(os.Stderr)
+	module, err := w.runtime.InstantiateModule(ctx, w.compiled, config)
+	if err != nil {
+		return err
+	}
+	if module.Memory() == nil {
+		module.Close(ctx)
+		return errors.New("The module doesn't export its memory")
+	}
+	w.module = module
+	return nil
+}
+
+// Process implements Hook.
+func (w *WASM) Process(ctx context.Context, msg tunnel.Message) (tunnel.Message, bool, error) {
+	input, err := sink.Marshal(msg)
+	if err != nil {
+		return msg, false, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.module == nil {
+		if err := w.instantiate(ctx); err != nil {
+			return msg, false, err
+		}
+	}
+	output, err := w.call(ctx, input)
+	if err != nil {
+		// The module may have been closed, or left in an inconsistent state, so start afresh. If
+		// that fails, the next message tries again.
+		w.instantiate(context.Background())
+		return msg, false, err
+	}
+	if output == nil {
+		return msg, true, nil
+	}
+	return apply(msg, output)
+}
+
+// call passes input to on_message and returns a copy of its result, or nil if it returned none.
+func (w *WASM) call(ctx context.Context, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	memory := w.module.Memory()
+	results, err := w.module.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(results[0])
+	if !memory.Write(ptr, input) {
+		return nil, fmt.Errorf("alloc returned %d bytes out of memory at %#x", len(input), ptr)
+	}
+	if results, err = w.module.ExportedFunction("on_message").Call(ctx, uint64(ptr), uint64(len(input))); err != nil {
+		return nil, err
+	}
+	if err := w.free(ctx, ptr, uint32(len(input))); err != nil {
+		return nil, err
+	}
+	if results[0] == 0 {
+		return nil, nil
+	}
+	resultPtr, resultLen := uint32(results[0]>>32), uint32(results[0])
+	output, ok := memory.Read(resultPtr, resultLen)
+	if !ok {
+		return nil, fmt.Errorf("on_message returned %d bytes out of memory at %#x", resultLen, resultPtr)
+	}
+	output = append([]byte(nil), output...)
+	return output, w.free(ctx, resultPtr, resultLen)
+}
+
+// free calls the free function of the module, if it exports one.
+func (w *WASM) free(ctx context.Context, ptr, size uint32) error {
+	free := w.module.ExportedFunction("free")
+	if free == nil {
+		return nil
+	}
+	_, err := free.Call(ctx, uint64(ptr), uint64(size))
+	return err
+}
+
+// Close releases the module.
+func (w *WASM) Close() error {
+	return w.runtime.Close(context.Background())
+}
@@ -0,0 +1,52 @@
+package hook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestWASM(t *testing.T) {
+	w, err := LoadWASM(context.Background(), "testdata/hook.wasm", 0)
+	require.Nil(t, err)
+	defer w.Close()
+
+	msg := tunnel.Message{ID: "2jkhm3", Payload: []byte("hello world")}
+	out, ok, err := w.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "enriched", string(out.Payload))
+	require.Equal(t, map[string]string{"hook": "wasm"}, out.Tags)
+
+	msg.ID = "unchanged"
+	out, ok, err = w.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, msg, out)
+
+	msg.ID = "xyz"
+	_, ok, err = w.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// A trap fails the message, but not the next ones.
+	msg.ID = "error"
+	_, _, err = w.Process(context.Background(), msg)
+	require.NotNil(t, err)
+	msg.ID = "2jkhm3"
+	out, ok, err = w.Process(context.Background(), msg)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "enriched", string(out.Payload))
+}
+
+func TestWASMInvalid(t *testing.T) {
+	_, err := NewWASM(context.Background(), []byte("not wasm"), 0)
+	require.NotNil(t, err)
+
+	// A module without exports.
+	_, err = NewWASM(context.Background(), []byte("\x00asm\x01\x00\x00\x00"), 0)
+	require.EqualError(t, err, "The module doesn't export alloc")
+}
@@ -0,0 +1,602 @@
+/*
+ * browsertunnel.js sends messages to a browsertunnel server through DNS queries.
+ *
+ *   <script src="browsertunnel.js" data-domain="t1.example.com"></script>
+ *   <script>browsertunnel.send('hello world')</script>
+ *
+ * By default, each query is made by adding a dns-prefetch link to the page, which works in any
+ * browser but gives no feedback. With the resolver option set to the URL of a DNS-over-HTTPS
+ * resolver supporting the JSON API (e.g. https://cloudflare-dns.com/dns-query), queries are made
+ * with fetch instead: failed requests are retried, fragments request acknowledgements, and
+ * fragments the server reports as missing are transmitted again.
+ *
+ * Messages are encoded exactly as by tunnel.Encoder in the Go package. Strings are sent as UTF-8
+ * text, and ArrayBuffers and typed arrays as binary messages. browsertunnel.heartbeat(clientId)
+ * tells the server that the client is still alive, e.g. when called with setInterval, and
+ * browsertunnel.receive(clientId, seq) polls the server through resolver for the messages queued
+ * with tunnel.Send, carried in the addresses of A or AAAA answers.
+ */
+(function (global) {
+  'use strict'
+
+  const MAX_LABEL_LEN = 63
+  const MAX_NAME_LEN = 253
+  const ALPHABET = 'abcdefghijklmnopqrstuvwxyz234567'
+  const BASE32HEX_ALPHABET = '0123456789abcdefghijklmnopqrstuv'
+  const ID_ALPHABET = '0123456789abcdefghijklmnopqrstuvwxyz'
+
+  // Flags of version 2 framing, matching tunnel.Flags.
+  const FLAG_COMPRESSED = 0x01
+  const FLAG_BINARY = 0x04
+  const FLAG_ACK = 0x08
+  const FLAG_SESSION = 0x10
+  const FLAG_SEQUENCE = 0x20
+  const FLAG_TOKEN = 0x40
+  const FLAG_ENCODING = 0x80
+  const FLAG_EXPIRATION = 0x200
+  const FLAG_PARITY = 0x400
+
+  const script = global.document && global.document.currentScript
+
+  const defaults = {
+    // domain is the top domain of the tunnel, or of the tenant, e.g. alpha.t1.example.com.
+    domain: script ? script.dataset.domain : undefined,
+    // labelLength is the maximum length of each label of payload.
+    labelLength: MAX_LABEL_LEN,
+    // delay is the number of milliseconds to wait between queries.
+    delay: 200,
+    // checksum adds a CRC32 label to each fragment.
+    checksum: false,
+    // compress gzips the message with CompressionStream before sending it.
+    compress: false,
+    // resolver is the URL of a DNS-over-HTTPS JSON API to send queries through, instead of
+    // dns-prefetch links.
+    resolver: undefined,
+    // retries is the number of times a failed request, or a fragment reported as missing, is sent
+    // again through resolver.
+    retries: 3,
+    // id is the message ID, generated at random if not set.
+    id: undefined,
+    // session, if set, is a label grouping the messages sent within a session, e.g. a page load,
+    // so that the server can report when the session starts and ends.
+    session: undefined,
+    // sequence, if set, numbers the message within its session, starting from 1, so that servers
+    // with ordered delivery deliver the session's messages in the order they were sent.
+    sequence: undefined,
+    // authToken, if set, is carried by every fragment, for servers that require one of their auth
+    // tokens before accepting fragments.
+    authToken: undefined,
+    // encoding, if set, is the encoding of the data labels, named in every fragment: base32,
+    // base32hex, base64url or hex. Fragments are encoded with base32 otherwise.
+    encoding: undefined,
+    // expiration, if set, is the number of seconds that the server is asked to keep the partial
+    // message for after each fragment, e.g. for long uploads over slow resolvers, instead of its
+    // own expiration.
+    expiration: undefined,
+    // parity, if set, follows every parity fragments with a parity fragment, from which the server
+    // rebuilds any one of them that never arrives, so that fewer fragments are sent again over
+    // lossy resolvers. It requires the standard codec.
+    parity: undefined,
+    // pollType is the type of the queries made by receive: AAAA, whose answers carry 16 bytes of
+    // a message, or A for resolvers that only answer those, carrying 4.
+    pollType: 'AAAA',
+    // codec lays out the labels of each fragment after its framing, matching tunnel.Codec: a
+    // function of the message ID, the encoded message and { labelLength, space, checksum }
+    // returning the fragments as { labels, offset, length }, or null if space is too small. The
+    // server must be configured with the same codec for the top domain.
+    codec: standardCodec,
+  }
+
+  function base32Encode(bytes, alphabet = ALPHABET, pad = true) {
+    let out = ''
+    let buffer = 0
+    let bits = 0
+    for (const b of bytes) {
+      buffer = (buffer << 8) | b
+      bits += 8
+      while (bits >= 5) {
+        out += alphabet[(buffer >>> (bits - 5)) & 31]
+        bits -= 5
+      }
+    }
+    if (bits > 0) {
+      out += alphabet[(buffer << (5 - bits)) & 31]
+    }
+    while (pad && out.length % 8 !== 0) {
+      out += '0'
+    }
+    return out
+  }
+
+  function base64urlEncode(bytes) {
+    let binary = ''
+    for (const b of bytes) {
+      binary += String.fromCharCode(b)
+    }
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+  }
+
+  // alphabets list the characters of each encoding, which parity fragments are computed over.
+  const alphabets = {
+    base32: ALPHABET + '0',
+    base32hex: BASE32HEX_ALPHABET,
+    base64url: 'ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_',
+    hex: '0123456789abcdef',
+  }
+
+  // encoders implement the encodings of data labels, matching tunnel.Encoding.
+  const encoders = {
+    base32: (bytes) => base32Encode(bytes),
+    base32hex: (bytes) => base32Encode(bytes, BASE32HEX_ALPHABET, false),
+    base64url: base64urlEncode,
+    hex: (bytes) => Array.from(bytes, (b) => b.toString(16).padStart(2, '0')).join(''),
+  }
+
+  let crcTable
+  function crc32(str) {
+    if (!crcTable) {
+      crcTable = []
+      for (let n = 0; n < 256; n++) {
+        let c = n
+        for (let k = 0; k < 8; k++) {
+          c = c & 1 ? 0xedb88320 ^ (c >>> 1) : c >>> 1
+        }
+        crcTable.push(c >>> 0)
+      }
+    }
+    let crc = 0xffffffff
+    for (let i = 0; i < str.length; i++) {
+      crc = crcTable[(crc ^ str.charCodeAt(i)) & 0xff] ^ (crc >>> 8)
+    }
+    return (crc ^ 0xffffffff) >>> 0
+  }
+
+  function checksumLabel(data) {
+    return 'crc-' + crc32(data).toString(16).padStart(8, '0')
+  }
+
+  function generateId(length) {
+    let id = ''
+    for (let i = 0; i < length; i++) {
+      id += ID_ALPHABET[Math.floor(Math.random() * ID_ALPHABET.length)]
+    }
+    return id
+  }
+
+  function versionLabel(flags) {
+    return 'v2-' + flags.toString(16).padStart(flags > 0xff ? 4 : 2, '0')
+  }
+
+  // standardCodec lays out fragments as the message ID, the length of the encoded message, the
+  // offset of the fragment, an optional checksum label and the data labels, matching
+  // tunnel.StandardCodec.
+  function standardCodec(id, encoded, options) {
+    const checksumLen = options.checksum ? checksumLabel('').length + 1 : 0
+    // The header of the final fragment is the longest, since its offset has the most digits.
+    const longestHeader = `${id}.${encoded.length}.${encoded.length - 1}.`
+    if (options.space - longestHeader.length - checksumLen < 1) {
+      return null
+    }
+
+    const fragments = []
+    for (let offset = 0; offset < encoded.length;) {
+      let header = `${id}.${encoded.length}.${offset}.`
+      let space = options.space - header.length - checksumLen + 1
+      const labels = []
+      let written = 0
+      while (offset + written < encoded.length && space > 1) {
+        const size = Math.min(options.labelLength, space - 1, encoded.length - offset - written)
+        labels.push(encoded.substring(offset + written, offset + written + size))
+        written += size
+        space -= size + 1
+      }
+      if (options.checksum) {
+        header += checksumLabel(encoded.substring(offset, offset + written)) + '.'
+      }
+      fragments.push({ labels: header + labels.join('.'), offset: offset, length: written })
+      offset += written
+    }
+    return fragments
+  }
+
+  // parityDigits returns the number of digits that total is written with in base.
+  function parityDigits(total, base) {
+    let digits = 1
+    for (let n = total; n >= base; n = Math.floor(n / base)) {
+      digits++
+    }
+    return digits
+  }
+
+  function formatDigits(alphabet, n, digits) {
+    let out = ''
+    for (let i = 0; i < digits; i++) {
+      out = alphabet[n % alphabet.length] + out
+      n = Math.floor(n / alphabet.length)
+    }
+    return out
+  }
+
+  // addParity follows every k fragments laid out by standardCodec with their parity fragment,
+  // matching tunnel.Encoder.Parity. It returns null if a parity fragment doesn't fit in space.
+  function addParity(id, encoded, coded, k, alphabet, options) {
+    const digits = parityDigits(encoded.length, alphabet.length)
+    const fragments = []
+    for (let start = 0; start < coded.length; start += k) {
+      const group = coded.slice(start, start + k)
+      const length = group.reduce((n, f) => n + f.length, 0)
+      let data = formatDigits(alphabet, length, digits) + formatDigits(alphabet, group.length, digits)
+      for (let i = 0; i < Math.max(...group.map(f => f.length)); i++) {
+        let sum = 0
+        for (const f of group) {
+          if (i < f.length) {
+            sum += alphabet.indexOf(encoded[f.offset + i])
+          }
+        }
+        data += alphabet[sum % alphabet.length]
+      }
+
+      const offset = encoded.length + group[0].offset
+      let header = `${id}.${encoded.length}.${offset}.`
+      if (options.checksum) {
+        header += checksumLabel(data) + '.'
+      }
+      const labels = []
+      for (let i = 0; i < data.length; i += options.labelLength) {
+        labels.push(data.substring(i, i + options.labelLength))
+      }
+      const parity = { labels: header + labels.join('.'), offset, length: data.length }
+      if (parity.labels.length > options.space) {
+        return null
+      }
+      fragments.push(...group, parity)
+    }
+    return fragments
+  }
+
+  // encodeQueries splits the bytes of a message into the domains of its fragments. Each fragment
+  // is returned with the offset and length of the encoded data it carries. Messages are framed as
+  // version 2 if any flag is set, and as version 1 otherwise.
+  function encodeQueries(domain, id, bytes, options) {
+    options = Object.assign({}, defaults, options)
+    domain = domain.replace(/\.$/, '')
+    const labelLength = options.labelLength
+    if (!id || id.includes('.') || id.length > MAX_LABEL_LEN) {
+      throw new Error(`Message ID ${id} must be a single non-empty label`)
+    }
+    if (labelLength <= 0 || labelLength > MAX_LABEL_LEN) {
+      throw new Error(`Label length must be between 1 and ${MAX_LABEL_LEN}, got ${labelLength}`)
+    }
+    if (bytes.length === 0) {
+      throw new Error('Cannot encode an empty message')
+    }
+
+    let flags = options.flags || 0
+    if (options.session) {
+      if (options.session.includes('.') || options.session.length > MAX_LABEL_LEN) {
+        throw new Error(`Session ${options.session} must be a single label`)
+      }
+      flags |= FLAG_SESSION
+    }
+    if (options.sequence) {
+      if (!options.session) {
+        throw new Error('Sequence numbers require a session')
+      }
+      if (!Number.isInteger(options.sequence) || options.sequence < 0) {
+        throw new Error(`Sequence number ${options.sequence} is not positive`)
+      }
+      flags |= FLAG_SEQUENCE
+    }
+    if (options.authToken) {
+      if (options.authToken.includes('.') || options.authToken.length > MAX_LABEL_LEN) {
+        throw new Error(`Auth token ${options.authToken} must be a single label`)
+      }
+      flags |= FLAG_TOKEN
+    }
+    if (options.encoding) {
+      if (!encoders[options.encoding]) {
+        throw new Error(`Unknown encoding ${options.encoding}`)
+      }
+      flags |= FLAG_ENCODING
+    }
+    if (options.expiration) {
+      if (!(options.expiration > 0)) {
+        throw new Error(`Expiration ${options.expiration} is not positive`)
+      }
+      flags |= FLAG_EXPIRATION
+    }
+    if (options.parity) {
+      if (!Number.isInteger(options.parity) || options.parity < 0) {
+        throw new Error(`Parity group size ${options.parity} is not positive`)
+      }
+      if (options.codec !== standardCodec) {
+        throw new Error('Parity fragments can only be laid out by the standard codec')
+      }
+      flags |= FLAG_PARITY
+    }
+    let prefix = flags ? versionLabel(flags) + '.' : ''
+    if (options.session) {
+      prefix += options.session + '.'
+    }
+    if (options.sequence) {
+      prefix += options.sequence + '.'
+    }
+    if (options.authToken) {
+      prefix += options.authToken + '.'
+    }
+    if (options.encoding) {
+      prefix += options.encoding + '.'
+    }
+    if (options.expiration) {
+      prefix += Math.ceil(options.expiration) + '.'
+    }
+    const encoded = encoders[options.encoding || 'base32'](bytes)
+    // The labels laid out by the codec sit between the framing and the top domain.
+    const codecOptions = {
+      labelLength: labelLength,
+      space: MAX_NAME_LEN - prefix.length - domain.length - 1,
+      checksum: options.checksum,
+    }
+    let coded
+    if (options.parity) {
+      // Parity fragments are longer than the fragments of their group, which leave them room.
+      const alphabet = alphabets[options.encoding || 'base32']
+      const header = 2 * parityDigits(encoded.length, alphabet.length)
+      const reserve = String(2 * encoded.length).length + header + Math.ceil(header / labelLength)
+      coded = standardCodec(id, encoded, Object.assign({}, codecOptions, { space: codecOptions.space - reserve }))
+      coded = coded && addParity(id, encoded, coded, options.parity, alphabet, codecOptions)
+    } else {
+      coded = options.codec(id, encoded, codecOptions)
+    }
+    if (!coded) {
+      throw new Error(`Top domain ${domain} leaves no room for payload`)
+    }
+    return coded.map(f => ({ query: `${prefix}${f.labels}.${domain}`, offset: f.offset, length: f.length }))
+  }
+
+  async function toBytes(data, options) {
+    let flags = 0
+    let bytes
+    if (typeof data === 'string') {
+      bytes = new TextEncoder().encode(data)
+    } else if (data instanceof ArrayBuffer) {
+      bytes = new Uint8Array(data)
+      flags |= FLAG_BINARY
+    } else if (ArrayBuffer.isView(data)) {
+      bytes = new Uint8Array(data.buffer, data.byteOffset, data.byteLength)
+      flags |= FLAG_BINARY
+    } else {
+      throw new Error('Messages must be strings, ArrayBuffers or typed arrays')
+    }
+    if (options.compress) {
+      const stream = new Blob([bytes]).stream().pipeThrough(new CompressionStream('gzip'))
+      bytes = new Uint8Array(await new Response(stream).arrayBuffer())
+      flags |= FLAG_COMPRESSED
+    }
+    return { bytes, flags }
+  }
+
+  const sleep = (duration) => new Promise(resolve => setTimeout(resolve, duration))
+
+  function prefetch(query) {
+    const link = global.document.createElement('link')
+    link.rel = 'dns-prefetch'
+    link.href = 'https://' + query
+    global.document.head.appendChild(link)
+  }
+
+  // parseAck parses the strings of a TXT answer acknowledging a fragment, in the format of
+  // tunnel.ParseAck. It returns null if the answer isn't an acknowledgement.
+  function parseAck(txt) {
+    if (txt.length === 0 || !txt[0].startsWith('ack.')) {
+      return null
+    }
+    const [received, total] = txt[0].substring(4).split('.').map(Number)
+    const missing = txt.slice(1).map(r => {
+      const [offset, length] = r.split('.').map(Number)
+      return { offset, length }
+    })
+    return { received, total, missing }
+  }
+
+  // resolve makes a TXT query through a DNS-over-HTTPS JSON API, retrying failed requests with
+  // exponential backoff, and returns the acknowledgement in the answer, if any.
+  async function resolve(query, options) {
+    let backoff = options.delay
+    for (let attempt = 0; ; attempt++) {
+      try {
+        const url = `${options.resolver}?name=${encodeURIComponent(query)}&type=TXT`
+        const resp = await fetch(url, { headers: { accept: 'application/dns-json' } })
+        if (!resp.ok) {
+          throw new Error(`Resolver responded with ${resp.status}`)
+        }
+        const body = await resp.json()
+        for (const answer of body.Answer || []) {
+          const txt = (answer.data.match(/"(?:[^"\\]|\\.)*"/g) || [answer.data]).map(s => s.replace(/^"|"$/g, ''))
+          const ack = parseAck(txt)
+          if (ack) {
+            return ack
+          }
+        }
+        return null
+      } catch (err) {
+        if (attempt >= options.retries) {
+          throw err
+        }
+        await sleep(backoff)
+        backoff *= 2
+      }
+    }
+  }
+
+  // pollQuery returns the domain queried to poll for the chunk of message seq at offset, or for its
+  // 'seq' or 'size' in place of the offset, matching tunnel.EncodePoll, tunnel.EncodeSeqPoll and
+  // tunnel.EncodeSizePoll.
+  function pollQuery(domain, clientId, seq, offset) {
+    if (!clientId || clientId.includes('.') || clientId.length > MAX_LABEL_LEN) {
+      throw new Error(`Client ID ${clientId} must be a single non-empty label`)
+    }
+    return `poll-${generateId(6)}.${clientId}.${seq}.${offset}.${domain.replace(/\.$/, '')}`
+  }
+
+  // parseAddress returns the bytes of an IPv4 or IPv6 address as written in the answers of the
+  // JSON API, e.g. 192.0.2.1, 2001:db8::1 or ::ffff:192.0.2.1.
+  function parseAddress(address) {
+    if (!address.includes(':')) {
+      return Uint8Array.from(address.split('.').map(Number))
+    }
+    const words = part => part ? part.split(':').flatMap(w => {
+      if (!w.includes('.')) {
+        return [parseInt(w, 16)]
+      }
+      const b = w.split('.').map(Number)
+      return [(b[0] << 8) | b[1], (b[2] << 8) | b[3]]
+    }) : []
+    const halves = address.split('::')
+    let all = words(halves[0])
+    if (halves.length > 1) {
+      const tail = words(halves[1])
+      all = all.concat(new Array(8 - all.length - tail.length).fill(0), tail)
+    }
+    const bytes = new Uint8Array(16)
+    all.forEach((w, i) => {
+      bytes[2 * i] = w >> 8
+      bytes[2 * i + 1] = w & 0xff
+    })
+    return bytes
+  }
+
+  // resolveAddress makes a query of options.pollType through a DNS-over-HTTPS JSON API, retrying
+  // failed requests with exponential backoff, and returns the bytes of the address in the answer,
+  // or null if there is none.
+  async function resolveAddress(query, options) {
+    const type = options.pollType === 'A' ? 1 : 28
+    let backoff = options.delay
+    for (let attempt = 0; ; attempt++) {
+      try {
+        const url = `${options.resolver}?name=${encodeURIComponent(query)}&type=${options.pollType}`
+        const resp = await fetch(url, { headers: { accept: 'application/dns-json' } })
+        if (!resp.ok) {
+          throw new Error(`Resolver responded with ${resp.status}`)
+        }
+        const body = await resp.json()
+        const answer = (body.Answer || []).find(a => a.type === type)
+        if (!answer) {
+          return null
+        }
+        const bytes = parseAddress(answer.data)
+        // Some resolvers write IPv4-mapped IPv6 addresses in dotted form.
+        if (type === 28 && bytes.length === 4) {
+          return Uint8Array.from([0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, ...bytes])
+        }
+        return bytes
+      } catch (err) {
+        if (attempt >= options.retries) {
+          throw err
+        }
+        await sleep(backoff)
+        backoff *= 2
+      }
+    }
+  }
+
+  // receive polls the tunnel for the first message queued for clientId from seq on, and resolves
+  // to { seq, data } with the message and its seq, or to null if nothing is queued. Polling for a
+  // seq acknowledges the messages before it, so the next call should ask for seq + 1. Sequence
+  // numbers start at 1.
+  async function receive(clientId, seq, options) {
+    options = Object.assign({}, defaults, options)
+    if (!options.domain || !options.resolver) {
+      throw new Error('The domain of the tunnel and a resolver are required')
+    }
+    const number = bytes => ((bytes[0] << 24) | (bytes[1] << 16) | (bytes[2] << 8) | bytes[3]) >>> 0
+    let size = await resolveAddress(pollQuery(options.domain, clientId, seq, 'size'), options)
+    if (!size) {
+      const next = await resolveAddress(pollQuery(options.domain, clientId, seq, 'seq'), options)
+      if (!next) {
+        return null
+      }
+      seq = number(next)
+      size = await resolveAddress(pollQuery(options.domain, clientId, seq, 'size'), options)
+      if (!size) {
+        return null
+      }
+    }
+    const data = new Uint8Array(number(size))
+    for (let offset = 0; offset < data.length;) {
+      const chunk = await resolveAddress(pollQuery(options.domain, clientId, seq, offset), options)
+      if (!chunk) {
+        throw new Error(`Message ${seq} is no longer queued`)
+      }
+      data.set(chunk.subarray(0, data.length - offset), offset)
+      offset += chunk.length
+      await sleep(options.delay)
+    }
+    return { seq, data }
+  }
+
+  // send encodes data and transmits it to the tunnel, resolving to the message ID once every
+  // query was made.
+  async function send(data, options) {
+    options = Object.assign({}, defaults, options)
+    if (!options.domain) {
+      throw new Error('The domain of the tunnel is required')
+    }
+    const id = options.id || generateId(6)
+    const message = await toBytes(data, options)
+    let flags = message.flags
+    if (options.resolver) {
+      flags |= FLAG_ACK
+    }
+    const fragments = encodeQueries(options.domain, id, message.bytes, Object.assign({}, options, { flags }))
+
+    if (!options.resolver) {
+      for (const fragment of fragments) {
+        prefetch(fragment.query)
+        await sleep(options.delay)
+      }
+      return id
+    }
+
+    let pending = fragments
+    for (let round = 0; ; round++) {
+      let ack = null
+      for (const fragment of pending) {
+        ack = (await resolve(fragment.query, options)) || ack
+        await sleep(options.delay)
+      }
+      if (!ack || ack.received >= ack.total || round >= options.retries) {
+        return id
+      }
+      // Resend the fragments overlapping the missing ranges. Acknowledgements list at most a few
+      // ranges, so everything after the last one is resent too.
+      const last = ack.missing.length ? ack.missing[ack.missing.length - 1] : { offset: 0, length: 0 }
+      pending = fragments.filter(f => f.offset + f.length > last.offset + last.length ||
+        ack.missing.some(r => f.offset < r.offset + r.length && r.offset < f.offset + f.length))
+    }
+  }
+
+  // heartbeatQuery returns the domain queried to send a heartbeat, matching tunnel.EncodeHeartbeat.
+  function heartbeatQuery(domain, clientId) {
+    if (!clientId || clientId.includes('.') || clientId.length > MAX_LABEL_LEN) {
+      throw new Error(`Client ID ${clientId} must be a single non-empty label`)
+    }
+    return `hb-${generateId(6)}.${clientId}.${domain.replace(/\.$/, '')}`
+  }
+
+  // heartbeat sends a single heartbeat for clientId, resolving once the query was made.
+  async function heartbeat(clientId, options) {
+    options = Object.assign({}, defaults, options)
+    if (!options.domain) {
+      throw new Error('The domain of the tunnel is required')
+    }
+    const query = heartbeatQuery(options.domain, clientId)
+    if (options.resolver) {
+      await resolve(query, options)
+    } else {
+      prefetch(query)
+    }
+  }
+
+  global.browsertunnel = { send, heartbeat, heartbeatQuery, receive, pollQuery, parseAddress, encodeQueries, standardCodec, base32Encode, parseAck, defaults }
+})(typeof window !== 'undefined' ? window : globalThis)
@@ -0,0 +1,38 @@
+// Package jsclient bundles browsertunnel.js, the JavaScript client that sends messages to a
+// tunnel from a web page.
+package jsclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed" // embeds the script
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// Path is the path the script is conventionally served at.
+const Path = "/browsertunnel.js"
+
+// Script is the source of browsertunnel.js.
+//
+//go:embed browsertunnel.js
+var Script []byte
+
+// etag identifies the version of Script, so that browsers can revalidate cached copies.
+var etag = func() string {
+	sum := sha256.Sum256(Script)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}()
+
+// Handler serves Script at any path. It can be loaded from any origin, so that pages can load it
+// from the tunnel's server with a single script tag.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "browsertunnel.js", time.Time{}, bytes.NewReader(Script))
+	})
+}
@@ -0,0 +1,193 @@
+package jsclient
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, Path, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, Script, w.Body.Bytes())
+
+	req := httptest.NewRequest(http.MethodGet, Path, nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotModified, w.Code)
+}
+
+// TestEncodeQueries checks that the script fragments messages exactly like tunnel.Encoder. It
+// needs node to run the script.
+func TestEncodeQueries(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+
+	tests := []struct {
+		domain  string
+		msg     string
+		enc     tunnel.Encoder
+		options string
+	}{
+		{domain: "tunnel.example.com", msg: "hello world", enc: tunnel.Encoder{LabelLen: 63}, options: `{}`},
+		{domain: "t.co", msg: strings.Repeat("x", 2000), enc: tunnel.Encoder{LabelLen: 63}, options: `{}`},
+		{domain: strings.Repeat(strings.Repeat("a", 60)+".", 3) + "example.com", msg: strings.Repeat("y", 500), enc: tunnel.Encoder{LabelLen: 63}, options: `{}`},
+		{domain: "tunnel.example.com", msg: strings.Repeat("z", 300), enc: tunnel.Encoder{LabelLen: 10, Checksum: true}, options: `{"labelLength": 10, "checksum": true}`},
+		{domain: "tunnel.example.com", msg: "\x00\xff\x80binary", enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Binary: true, Ack: true}, options: `{"flags": 12}`},
+		{domain: "tunnel.example.com", msg: strings.Repeat("s", 300), enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Session: "k3x9q2"}, options: `{"session": "k3x9q2"}`},
+		{domain: "tunnel.example.com", msg: "hello world", enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Session: "k3x9q2", Sequence: 17}, options: `{"session": "k3x9q2", "sequence": 17}`},
+		{domain: "tunnel.example.com", msg: "hello world", enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Session: "k3x9q2", AuthToken: "k3y-one"}, options: `{"session": "k3x9q2", "authToken": "k3y-one"}`},
+		{domain: "tunnel.example.com", msg: "\x00\xff\x80binary", enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Checksum: true, Encoding: tunnel.EncodingBase32Hex}, options: `{"checksum": true, "encoding": "base32hex"}`},
+		{domain: "tunnel.example.com", msg: strings.Repeat("\xfb\xff?", 100), enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Checksum: true, Encoding: tunnel.EncodingBase64URL}, options: `{"checksum": true, "encoding": "base64url"}`},
+		{domain: "tunnel.example.com", msg: "\x00\xff\x80binary", enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Encoding: tunnel.EncodingHex}, options: `{"encoding": "hex"}`},
+		{domain: "tunnel.example.com", msg: strings.Repeat("u", 300), enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Session: "k3x9q2", Expiration: 10 * time.Minute}, options: `{"session": "k3x9q2", "expiration": 600}`},
+		{domain: "tunnel.example.com", msg: strings.Repeat("p", 700), enc: tunnel.Encoder{LabelLen: 63, Version: tunnel.Version2, Parity: 3}, options: `{"parity": 3}`},
+		{domain: "tunnel.example.com", msg: strings.Repeat("\xfb\xff?", 100), enc: tunnel.Encoder{LabelLen: 20, Version: tunnel.Version2, Checksum: true, Encoding: tunnel.EncodingBase64URL, Parity: 2}, options: `{"labelLength": 20, "checksum": true, "encoding": "base64url", "parity": 2}`},
+	}
+	for _, test := range tests {
+		want, err := test.enc.Encode(test.domain, "2jkhm3", test.msg)
+		require.Nil(t, err)
+
+		bytes, err := json.Marshal([]byte(test.msg))
+		require.Nil(t, err)
+		program := string(Script) + `
+			const bytes = Uint8Array.from(Buffer.from(` + string(bytes) + `, 'base64'))
+			const fragments = browsertunnel.encodeQueries(` + "`" + test.domain + "`" + `, '2jkhm3', bytes, ` + test.options + `)
+			console.log(JSON.stringify(fragments.map(f => f.query + '.')))
+		`
+		out, err := exec.Command(node, "-e", program).Output()
+		require.Nil(t, err)
+		var got []string
+		require.Nil(t, json.Unmarshal(out, &got))
+		require.Equal(t, want, got, test.domain)
+	}
+}
+
+// TestHeartbeatQuery checks that the script encodes heartbeats like tunnel.EncodeHeartbeat. It
+// needs node to run the script.
+func TestHeartbeatQuery(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+
+	program := string(Script) + `
+		console.log(browsertunnel.heartbeatQuery('tunnel.example.com.', 'c1'))
+	`
+	out, err := exec.Command(node, "-e", program).Output()
+	require.Nil(t, err)
+	labels := strings.Split(strings.TrimSpace(string(out)), ".")
+	require.Len(t, labels, 5)
+	want := tunnel.EncodeHeartbeat("tunnel.example.com", "c1", strings.TrimPrefix(labels[0], "hb-"))
+	require.Equal(t, want, strings.TrimSpace(string(out))+".")
+}
+
+// queryRecorder is a dns.ResponseWriter keeping the reply.
+type queryRecorder struct {
+	msg *dns.Msg
+}
+
+func (w *queryRecorder) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *queryRecorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+}
+
+func (w *queryRecorder) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *queryRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (w *queryRecorder) Close() error                { return nil }
+func (w *queryRecorder) TsigStatus() error           { return nil }
+func (w *queryRecorder) TsigTimersOnly(bool)         {}
+func (w *queryRecorder) Hijack()                     {}
+
+// jsonAPI serves the queries made by the script to tun, answering them in the format of the DNS
+// JSON API.
+func jsonAPI(tun *tunnel.Tunnel) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &dns.Msg{}
+		req.SetQuestion(dns.Fqdn(r.URL.Query().Get("name")), dns.StringToType[r.URL.Query().Get("type")])
+		rec := &queryRecorder{}
+		tun.ServeDNS(rec, req)
+		type answer struct {
+			Type uint16 `json:"type"`
+			Data string `json:"data"`
+		}
+		var body struct {
+			Answer []answer
+		}
+		for _, rr := range rec.msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				body.Answer = append(body.Answer, answer{dns.TypeA, rr.A.String()})
+			case *dns.AAAA:
+				body.Answer = append(body.Answer, answer{dns.TypeAAAA, rr.AAAA.String()})
+			}
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// TestReceive checks that the script receives the messages queued by tunnel.Send through address
+// polls. It needs node to run the script.
+func TestReceive(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	tun, err := tunnel.New(tunnel.Config{TopDomain: "tunnel.example.com"})
+	require.Nil(t, err)
+	defer tun.Close()
+	server := httptest.NewServer(jsonAPI(tun))
+	defer server.Close()
+
+	msg := strings.Repeat("downstream ", 4)
+	_, err = tun.Send("c1", []byte("acknowledged"))
+	require.Nil(t, err)
+	_, err = tun.Send("c1", []byte(msg))
+	require.Nil(t, err)
+
+	for _, pollType := range []string{"A", "AAAA"} {
+		program := string(Script) + `
+			const options = { domain: 'tunnel.example.com', resolver: '` + server.URL + `', pollType: '` + pollType + `', delay: 0 }
+			browsertunnel.receive('c1', 2, options).then(r => console.log(JSON.stringify({ seq: r.seq, data: Buffer.from(r.data).toString() })))
+		`
+		out, err := exec.Command(node, "-e", program).Output()
+		require.Nil(t, err)
+		var got struct {
+			Seq  int
+			Data string
+		}
+		require.Nil(t, json.Unmarshal(out, &got))
+		require.Equal(t, 2, got.Seq, pollType)
+		require.Equal(t, msg, got.Data, pollType)
+	}
+
+	// Once every message is acknowledged, nothing is received.
+	program := string(Script) + `
+		browsertunnel.receive('c1', 3, { domain: 'tunnel.example.com', resolver: '` + server.URL + `', delay: 0 }).then(r => console.log(JSON.stringify(r)))
+	`
+	out, err := exec.Command(node, "-e", program).Output()
+	require.Nil(t, err)
+	require.Equal(t, "null", strings.TrimSpace(string(out)))
+}
@@ -0,0 +1,188 @@
+// Package metrics exposes counters, gauges and histograms over HTTP in the Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Type is the kind of a metric.
+type Type string
+
+// Metric types understood by Prometheus.
+const (
+	Counter   Type = "counter"
+	Gauge     Type = "gauge"
+	Histogram Type = "histogram"
+)
+
+// A Metric is a single sample. Metrics that share a name must share a Help and Type, and are
+// distinguished by their Labels and Suffix.
+type Metric struct {
+	Name string
+	// Suffix is appended to Name in the sample, e.g. _bucket, _sum or _count for the samples of
+	// a histogram.
+	Suffix string
+	Help   string
+	Type   Type
+	Labels map[string]string
+	Value  float64
+}
+
+// A Collector produces samples each time metrics are scraped.
+type Collector interface {
+	Collect() []Metric
+}
+
+// CollectorFunc adapts a function to a Collector.
+type CollectorFunc func() []Metric
+
+// Collect calls f.
+func (f CollectorFunc) Collect() []Metric {
+	return f()
+}
+
+// A Registry is an http.Handler that serves the metrics of every registered Collector.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// Register adds c to the metrics served by r.
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Gather collects the metrics of every registered Collector.
+func (r *Registry) Gather() []Metric {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	var metrics []Metric
+	for _, c := range collectors {
+		metrics = append(metrics, c.Collect()...)
+	}
+	return metrics
+}
+
+// ServeHTTP writes the gathered metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := Write(w, r.Gather()); err != nil {
+		log.Println(err)
+	}
+}
+
+// Write writes metrics to w in the Prometheus text format. Samples with the same name are grouped
+// under a single HELP and TYPE line, in the order the names first appear.
+func Write(w io.Writer, metrics []Metric) error {
+	var names []string
+	byName := make(map[string][]Metric)
+	for _, m := range metrics {
+		if _, ok := byName[m.Name]; !ok {
+			names = append(names, m.Name)
+		}
+		byName[m.Name] = append(byName[m.Name], m)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		samples := byName[name]
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(samples[0].Help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, samples[0].Type)
+		for _, m := range samples {
+			fmt.Fprintf(bw, "%s%s%s %s\n", name, m.Suffix, formatLabels(m.Labels), strconv.FormatFloat(m.Value, 'g', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, k, labelEscaper.Replace(labels[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// A Distribution counts observations in cumulative buckets, to be exported as a histogram. It is
+// safe for concurrent use.
+type Distribution struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewDistribution returns a Distribution whose buckets have the given upper bounds, which must be
+// sorted in increasing order.
+func NewDistribution(bounds ...float64) *Distribution {
+	return &Distribution{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe adds v to the distribution.
+func (d *Distribution) Observe(v float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, bound := range d.bounds {
+		if v <= bound {
+			d.counts[i]++
+		}
+	}
+	d.sum += v
+	d.count++
+}
+
+// Count returns the number of observations and their sum.
+func (d *Distribution) Count() (uint64, float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count, d.sum
+}
+
+// Metrics returns the samples of the histogram named name: one per bucket, the sum and the count
+// of the observations.
+func (d *Distribution) Metrics(name, help string, labels map[string]string) []Metric {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	withLe := func(le string) map[string]string {
+		l := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			l[k] = v
+		}
+		l["le"] = le
+		return l
+	}
+	ms := make([]Metric, 0, len(d.bounds)+3)
+	for i, bound := range d.bounds {
+		ms = append(ms, Metric{Name: name, Suffix: "_bucket", Help: help, Type: Histogram, Labels: withLe(strconv.FormatFloat(bound, 'g', -1, 64)), Value: float64(d.counts[i])})
+	}
+	return append(ms,
+		Metric{Name: name, Suffix: "_bucket", Help: help, Type: Histogram, Labels: withLe("+Inf"), Value: float64(d.count)},
+		Metric{Name: name, Suffix: "_sum", Help: help, Type: Histogram, Labels: labels, Value: d.sum},
+		Metric{Name: name, Suffix: "_count", Help: help, Type: Histogram, Labels: labels, Value: float64(d.count)},
+	)
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	metrics := []Metric{
+		{Name: "queries_total", Help: "Queries received.", Type: Counter, Value: 3},
+		{Name: "dropped_total", Help: "Messages dropped.", Type: Counter, Labels: map[string]string{"reason": "auth"}, Value: 1},
+		{Name: "dropped_total", Help: "Messages dropped.", Type: Counter, Labels: map[string]string{"reason": `a"b`, "sink": "x"}, Value: 2.5},
+	}
+	var buf bytes.Buffer
+	require.Nil(t, Write(&buf, metrics))
+
+	expected := `# HELP queries_total Queries received.
+# TYPE queries_total counter
+queries_total 3
+# HELP dropped_total Messages dropped.
+# TYPE dropped_total counter
+dropped_total{reason="auth"} 1
+dropped_total{reason="a\"b",sink="x"} 2.5
+`
+	require.Equal(t, expected, buf.String())
+}
+
+func TestDistribution(t *testing.T) {
+	d := NewDistribution(1, 2.5)
+	for _, v := range []float64{0.5, 1, 2, 10} {
+		d.Observe(v)
+	}
+	count, sum := d.Count()
+	require.EqualValues(t, 4, count)
+	require.Equal(t, 13.5, sum)
+
+	var buf bytes.Buffer
+	require.Nil(t, Write(&buf, d.Metrics("duration_seconds", "Durations.", map[string]string{"sink": "x"})))
+	expected := `# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="1",sink="x"} 2
+duration_seconds_bucket{le="2.5",sink="x"} 3
+duration_seconds_bucket{le="+Inf",sink="x"} 4
+duration_seconds_sum{sink="x"} 13.5
+duration_seconds_count{sink="x"} 4
+`
+	require.Equal(t, expected, buf.String())
+}
+
+func TestRegistry(t *testing.T) {
+	var r Registry
+	r.Register(CollectorFunc(func() []Metric {
+		return []Metric{{Name: "in_flight", Help: "Fragment lists in memory.", Type: Gauge, Value: 7}}
+	}))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(w.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(body), "in_flight 7\n")
+	require.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+}
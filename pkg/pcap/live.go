@@ -0,0 +1,57 @@
+package pcap
+
+import "golang.org/x/net/bpf"
+
+// A LiveConfig configures a live capture.
+type LiveConfig struct {
+	// Interface is the name of the network interface to capture on, e.g. eth0. Every interface is
+	// captured if it is empty or any.
+	Interface string
+	// Port, if set, has the kernel drop the packets other than those sent over UDP or TCP from or
+	// to Port, so that they aren't copied to the capture.
+	Port int
+	// Promiscuous captures the packets addressed to other hosts too, as seen on a mirror port or
+	// a network tap. It requires an Interface.
+	Promiscuous bool
+}
+
+// snapLen is how many bytes of a packet the port filter keeps, which is more than any IP packet
+// holds.
+const snapLen = 1 << 18
+
+// portFilter returns a BPF program for packets which start with their IP header, accepting
+// those sent over UDP or TCP from or to port, as well as IPv6 packets whose transport header
+// follows extension headers. Other IPv6 packets are dropped if they are ICMPv6, and accepted
+// otherwise, and IPv4 fragments other than the first are dropped.
+func portFilter(port int) []bpf.Instruction {
+	const accept, drop = 22, 23
+	p := uint32(port)
+	return []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Off: 0, Size: 1},
+		/* 1 */ bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x40, SkipFalse: 13 - 3},
+		// IPv4: the protocol, the fragment offset and the ports after the header.
+		/* 3 */ bpf.LoadAbsolute{Off: 9, Size: 1},
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: protoUDP, SkipTrue: 6 - 5},
+		/* 5 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: protoTCP, SkipFalse: drop - 6},
+		/* 6 */ bpf.LoadAbsolute{Off: 6, Size: 2},
+		/* 7 */ bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: drop - 8},
+		/* 8 */ bpf.LoadMemShift{Off: 0},
+		/* 9 */ bpf.LoadIndirect{Off: 0, Size: 2},
+		/* 10 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: p, SkipTrue: accept - 11},
+		/* 11 */ bpf.LoadIndirect{Off: 2, Size: 2},
+		/* 12 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: p, SkipTrue: accept - 13, SkipFalse: drop - 13},
+		// IPv6: the next header and the ports after the fixed header.
+		/* 13 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x60, SkipFalse: drop - 14},
+		/* 14 */ bpf.LoadAbsolute{Off: 6, Size: 1},
+		/* 15 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: protoUDP, SkipTrue: 18 - 16},
+		/* 16 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: protoTCP, SkipTrue: 18 - 17},
+		/* 17 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 58, SkipTrue: drop - 18, SkipFalse: accept - 18},
+		/* 18 */ bpf.LoadAbsolute{Off: 40, Size: 2},
+		/* 19 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: p, SkipTrue: accept - 20},
+		/* 20 */ bpf.LoadAbsolute{Off: 42, Size: 2},
+		/* 21 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: p, SkipTrue: accept - 22, SkipFalse: drop - 22},
+		/* accept */ bpf.RetConstant{Val: snapLen},
+		/* drop */ bpf.RetConstant{Val: 0},
+	}
+}
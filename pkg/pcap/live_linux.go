@@ -0,0 +1,161 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// A LiveCapture captures the packets of a network interface as they are sent and received,
+// through a Linux packet socket. Packets start with their IP header, whatever the link layer of
+// the interface, and are read with the LinkTypeRaw link type.
+type LiveCapture struct {
+	file *os.File
+	conn syscall.RawConn
+	buf  []byte
+	// loopback holds the indices of loopback interfaces, whose outgoing packets are received once
+	// more as incoming packets.
+	loopback map[int]bool
+	// dropped counts the packets dropped by the kernel because the capture fell behind.
+	dropped atomic.Uint64
+	closed  atomic.Bool
+}
+
+// OpenLive starts capturing packets as configured by cfg, which requires CAP_NET_RAW.
+func OpenLive(cfg LiveConfig) (*LiveCapture, error) {
+	ifindex := 0
+	if cfg.Interface != "" && cfg.Interface != "any" {
+		ifc, err := net.InterfaceByName(cfg.Interface)
+		if err != nil {
+			return nil, err
+		}
+		ifindex = ifc.Index
+	} else if cfg.Promiscuous {
+		return nil, errors.New("Promiscuous captures require an interface")
+	}
+	ifcs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	loopback := make(map[int]bool)
+	for _, ifc := range ifcs {
+		if ifc.Flags&net.FlagLoopback != 0 {
+			loopback[ifc.Index] = true
+		}
+	}
+
+	proto := int(htons(unix.ETH_P_ALL))
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open packet socket: %w", err)
+	}
+	// The filter is attached before binding, so that no other packets are queued.
+	if cfg.Port != 0 {
+		if err := attachFilter(fd, portFilter(cfg.Port)); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed to bind packet socket to %q: %w", cfg.Interface, err)
+	}
+	if cfg.Promiscuous {
+		mreq := &unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_PROMISC}
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("Failed to enable promiscuous mode on %q: %w", cfg.Interface, err)
+		}
+	}
+	// Reads through the runtime's poller are interrupted by Close.
+	file := os.NewFile(uintptr(fd), "packet socket")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &LiveCapture{file: file, conn: conn, buf: make([]byte, snapLen), loopback: loopback}, nil
+}
+
+// attachFilter assembles prog and attaches it to the socket fd.
+func attachFilter(fd int, prog []bpf.Instruction) error {
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		return err
+	}
+	filter := make([]unix.SockFilter, len(raw))
+	for i, ins := range raw {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	fprog := &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, fprog); err != nil {
+		return fmt.Errorf("Failed to attach packet filter: %w", err)
+	}
+	return nil
+}
+
+// ReadPacket returns the next packet captured, blocking until there is one. It returns
+// os.ErrClosed once c is closed.
+func (c *LiveCapture) ReadPacket() (Packet, error) {
+	for {
+		var n int
+		var from unix.Sockaddr
+		var recvErr error
+		err := c.conn.Read(func(fd uintptr) bool {
+			n, from, recvErr = unix.Recvfrom(int(fd), c.buf, 0)
+			return recvErr != unix.EAGAIN
+		})
+		if err == nil {
+			err = recvErr
+		}
+		if err != nil {
+			if c.closed.Load() {
+				return Packet{}, os.ErrClosed
+			}
+			return Packet{}, err
+		}
+		at := time.Now()
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING && c.loopback[ll.Ifindex] {
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, c.buf[:n])
+		return Packet{Time: at, LinkType: LinkTypeRaw, Data: data, Length: n}, nil
+	}
+}
+
+// Dropped returns how many packets the kernel has dropped since c was opened, because they
+// arrived faster than they were read.
+func (c *LiveCapture) Dropped() (uint64, error) {
+	var stats *unix.TpacketStats
+	var statsErr error
+	err := c.conn.Control(func(fd uintptr) {
+		stats, statsErr = unix.GetsockoptTpacketStats(int(fd), unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	})
+	if err == nil {
+		err = statsErr
+	}
+	if err != nil {
+		return c.dropped.Load(), err
+	}
+	// Reading the statistics resets them.
+	return c.dropped.Add(uint64(stats.Drops)), nil
+}
+
+// Close stops the capture, interrupting ReadPacket.
+func (c *LiveCapture) Close() error {
+	c.closed.Store(true)
+	return c.file.Close()
+}
+
+// htons converts a 16 bit integer to network byte order.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,60 @@
+package pcap
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveCapture(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+
+	c, err := OpenLive(LiveConfig{Interface: "lo", Port: port})
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("packet sockets require CAP_NET_RAW")
+	}
+	require.Nil(t, err)
+	// Other traffic on the loopback interface is filtered out by the kernel.
+	other, err := net.Dial("udp", "127.0.0.1:9")
+	require.Nil(t, err)
+	defer other.Close()
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	before := time.Now()
+	other.Write([]byte("not dns"))
+	conn.Write(query(t, "live.example.com."))
+
+	p, err := c.ReadPacket()
+	require.Nil(t, err)
+	require.False(t, p.Time.Before(before))
+	msgs, err := p.DNS(port)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "live.example.com.", msgs[0].Msg.Question[0].Name)
+	require.Equal(t, conn.LocalAddr().String(), msgs[0].Source.String())
+	dropped, err := c.Dropped()
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), dropped)
+
+	// The query is received once, although the loopback interface sees it leave too.
+	done := make(chan error)
+	go func() {
+		_, err := c.ReadPacket()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Unexpected packet: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Nil(t, c.Close())
+	require.ErrorIs(t, <-done, os.ErrClosed)
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package pcap
+
+import "errors"
+
+// A LiveCapture captures the packets of a network interface. Live captures are only supported
+// on Linux.
+type LiveCapture struct{}
+
+// OpenLive returns an error, since live captures are only supported on Linux.
+func OpenLive(cfg LiveConfig) (*LiveCapture, error) {
+	return nil, errors.New("Live captures are only supported on Linux")
+}
+
+// ReadPacket returns an error.
+func (c *LiveCapture) ReadPacket() (Packet, error) {
+	return Packet{}, errors.New("Live captures are only supported on Linux")
+}
+
+// Dropped returns an error.
+func (c *LiveCapture) Dropped() (uint64, error) {
+	return 0, errors.New("Live captures are only supported on Linux")
+}
+
+// Close does nothing.
+func (c *LiveCapture) Close() error {
+	return nil
+}
@@ -0,0 +1,48 @@
+package pcap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+)
+
+func TestPortFilter(t *testing.T) {
+	q := []byte("query")
+	icmp6 := ipv6Packet(58, make([]byte, 8))
+	icmp6[6] = 58
+	tests := map[string]struct {
+		packet []byte
+		accept bool
+	}{
+		"udp to port":        {ipv4Packet(protoUDP, 0, udp(5353, 53, q)), true},
+		"udp from port":      {ipv4Packet(protoUDP, 0, udp(53, 5353, q)), true},
+		"tcp to port":        {ipv4Packet(protoTCP, 0, tcp(5353, 53, q)), true},
+		"other port":         {ipv4Packet(protoUDP, 0, udp(5353, 443, q)), false},
+		"other protocol":     {ipv4Packet(1, 0, udp(5353, 53, q)), false},
+		"first fragment":     {ipv4Packet(protoUDP, 0x2000, udp(5353, 53, q)), true},
+		"later fragment":     {ipv4Packet(protoUDP, 0x0010, udp(5353, 53, q)), false},
+		"ipv6 udp to port":   {ipv6Fixed(protoUDP, udp(5353, 53, q)), true},
+		"ipv6 tcp from port": {ipv6Fixed(protoTCP, tcp(53, 5353, q)), true},
+		"ipv6 other port":    {ipv6Fixed(protoUDP, udp(5353, 443, q)), false},
+		"ipv6 extension":     {ipv6Packet(protoUDP, udp(5353, 443, q)), true},
+		"icmpv6":             {icmp6, false},
+		"other version":      {[]byte{5 << 4, 0, 0, 0}, false},
+	}
+	vm, err := bpf.NewVM(portFilter(53))
+	require.Nil(t, err)
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			n, err := vm.Run(test.packet)
+			require.Nil(t, err)
+			require.Equal(t, test.accept, n > 0)
+		})
+	}
+}
+
+// ipv6Fixed returns an IPv6 packet without extension headers.
+func ipv6Fixed(proto byte, payload []byte) []byte {
+	b := ipv6Packet(proto, payload)
+	b[6] = proto
+	return append(b[:40], b[48:]...)
+}
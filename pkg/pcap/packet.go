@@ -0,0 +1,232 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LinkType is the type of the link layer header of captured packets, as registered at
+// https://www.tcpdump.org/linktypes.html.
+type LinkType uint16
+
+// Link types of the packets that DNS messages are decoded from.
+const (
+	// LinkTypeNull and LinkTypeLoop are the loopback interfaces of BSDs, whose packets start
+	// with the address family in host and network byte order.
+	LinkTypeNull      LinkType = 0
+	LinkTypeEthernet  LinkType = 1
+	LinkTypeRaw       LinkType = 101
+	LinkTypeLoop      LinkType = 108
+	LinkTypeLinuxSLL  LinkType = 113
+	LinkTypeIPv4      LinkType = 228
+	LinkTypeIPv6      LinkType = 229
+	LinkTypeLinuxSLL2 LinkType = 276
+)
+
+// EtherTypes of the frames that DNS messages are decoded from, and of the VLAN tags they may
+// carry.
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	etherTypeVLAN2 = 0x9100
+)
+
+// IP protocol numbers, and IPv6 extension headers.
+const (
+	protoHopByHop = 0
+	protoTCP      = 6
+	protoUDP      = 17
+	protoRouting  = 43
+	protoFragment = 44
+	protoAH       = 51
+	protoDestOpts = 60
+)
+
+// A Message is a DNS message carried by a captured packet.
+type Message struct {
+	// Time is when the packet was captured.
+	Time time.Time
+	// Source and Destination are the addresses that the message was sent from and to, as a
+	// *net.UDPAddr or *net.TCPAddr.
+	Source      net.Addr
+	Destination net.Addr
+	Msg         *dns.Msg
+}
+
+// DNS returns the DNS messages carried by p over UDP or TCP, from or to port. UDP datagrams
+// carry a single message. TCP segments are decoded on their own, without reassembling streams,
+// so that only the messages held whole by a segment are returned; queries are small enough that
+// their segments almost always are. Packets that aren't sent from or to port, IP fragments and
+// packets of other protocols carry no messages, while truncated headers and messages that can't
+// be unpacked are errors.
+func (p Packet) DNS(port int) ([]Message, error) {
+	src, dst, proto, payload, err := p.ip()
+	if err != nil || payload == nil {
+		return nil, err
+	}
+	var srcPort, dstPort int
+	switch proto {
+	case protoUDP:
+		if len(payload) < 8 {
+			return nil, errors.New("Truncated UDP header")
+		}
+		srcPort, dstPort = int(binary.BigEndian.Uint16(payload[0:2])), int(binary.BigEndian.Uint16(payload[2:4]))
+		if n := int(binary.BigEndian.Uint16(payload[4:6])); n >= 8 && n < len(payload) {
+			payload = payload[:n]
+		}
+		payload = payload[8:]
+	case protoTCP:
+		if len(payload) < 20 {
+			return nil, errors.New("Truncated TCP header")
+		}
+		srcPort, dstPort = int(binary.BigEndian.Uint16(payload[0:2])), int(binary.BigEndian.Uint16(payload[2:4]))
+		n := int(payload[12]>>4) * 4
+		if n < 20 || n > len(payload) {
+			return nil, errors.New("Truncated TCP header")
+		}
+		payload = payload[n:]
+	default:
+		return nil, nil
+	}
+	if srcPort != port && dstPort != port {
+		return nil, nil
+	}
+	m := Message{Time: p.Time}
+	if proto == protoUDP {
+		m.Source, m.Destination = &net.UDPAddr{IP: src, Port: srcPort}, &net.UDPAddr{IP: dst, Port: dstPort}
+		msg := &dns.Msg{}
+		if err := msg.Unpack(payload); err != nil {
+			return nil, fmt.Errorf("Invalid DNS message: %w", err)
+		}
+		m.Msg = msg
+		return []Message{m}, nil
+	}
+	m.Source, m.Destination = &net.TCPAddr{IP: src, Port: srcPort}, &net.TCPAddr{IP: dst, Port: dstPort}
+	// Each message over TCP is prefixed with its length.
+	var msgs []Message
+	for len(payload) >= 2 {
+		n := int(binary.BigEndian.Uint16(payload[0:2]))
+		if len(payload) < 2+n {
+			break
+		}
+		msg := &dns.Msg{}
+		if err := msg.Unpack(payload[2 : 2+n]); err != nil {
+			return msgs, fmt.Errorf("Invalid DNS message: %w", err)
+		}
+		m.Msg = msg
+		msgs = append(msgs, m)
+		payload = payload[2+n:]
+	}
+	return msgs, nil
+}
+
+// ip strips the link layer and IP headers of p, and returns its addresses, the protocol that its
+// payload is carried with, and the payload, which is nil for packets that aren't IP, or are IP
+// fragments.
+func (p Packet) ip() (src, dst net.IP, proto byte, payload []byte, err error) {
+	data := p.Data
+	var etherType uint16
+	switch p.LinkType {
+	case LinkTypeNull, LinkTypeLoop:
+		// The address families of IPv6 differ between systems, so the version of the IP header
+		// is looked at instead.
+		if len(data) < 4 {
+			return nil, nil, 0, nil, errors.New("Truncated loopback header")
+		}
+		data = data[4:]
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, nil, 0, nil, errors.New("Truncated Ethernet header")
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ || etherType == etherTypeVLAN2 {
+			if len(data) < 4 {
+				return nil, nil, 0, nil, errors.New("Truncated VLAN tag")
+			}
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, nil, 0, nil, errors.New("Truncated Linux cooked header")
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case LinkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil, nil, 0, nil, errors.New("Truncated Linux cooked header")
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+	default:
+		return nil, nil, 0, nil, fmt.Errorf("Unsupported link type %d", p.LinkType)
+	}
+	if etherType != 0 && etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil, nil, 0, nil, nil
+	}
+	if len(data) == 0 {
+		return nil, nil, 0, nil, errors.New("Truncated IP header")
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return ipv4(data)
+	case 6:
+		return ipv6(data)
+	}
+	return nil, nil, 0, nil, fmt.Errorf("Unknown IP version %d", data[0]>>4)
+}
+
+func ipv4(data []byte) (src, dst net.IP, proto byte, payload []byte, err error) {
+	n := int(data[0]&0x0f) * 4
+	if len(data) < 20 || n < 20 || len(data) < n {
+		return nil, nil, 0, nil, errors.New("Truncated IPv4 header")
+	}
+	// Frames may be padded beyond the end of the packet.
+	if total := int(binary.BigEndian.Uint16(data[2:4])); total >= n && total < len(data) {
+		data = data[:total]
+	}
+	// Fragments other than the first don't start with a transport header, and the first one
+	// doesn't hold the whole message.
+	if flags := binary.BigEndian.Uint16(data[6:8]); flags&0x3fff != 0 {
+		return nil, nil, 0, nil, nil
+	}
+	return net.IP(data[12:16]), net.IP(data[16:20]), data[9], data[n:], nil
+}
+
+func ipv6(data []byte) (src, dst net.IP, proto byte, payload []byte, err error) {
+	if len(data) < 40 {
+		return nil, nil, 0, nil, errors.New("Truncated IPv6 header")
+	}
+	if n := int(binary.BigEndian.Uint16(data[4:6])); n != 0 && 40+n < len(data) {
+		data = data[:40+n]
+	}
+	src, dst, proto, payload = net.IP(data[8:24]), net.IP(data[24:40]), data[6], data[40:]
+	for {
+		var n int
+		switch proto {
+		case protoHopByHop, protoRouting, protoDestOpts:
+			if len(payload) < 2 {
+				return nil, nil, 0, nil, errors.New("Truncated IPv6 extension header")
+			}
+			n = (int(payload[1]) + 1) * 8
+		case protoAH:
+			if len(payload) < 2 {
+				return nil, nil, 0, nil, errors.New("Truncated IPv6 extension header")
+			}
+			n = (int(payload[1]) + 2) * 4
+		case protoFragment:
+			return nil, nil, 0, nil, nil
+		default:
+			return src, dst, proto, payload, nil
+		}
+		if len(payload) < n {
+			return nil, nil, 0, nil, errors.New("Truncated IPv6 extension header")
+		}
+		proto, payload = payload[0], payload[n:]
+	}
+}
@@ -0,0 +1,152 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	client  = net.ParseIP("192.0.2.1").To4()
+	server  = net.ParseIP("192.0.2.53").To4()
+	client6 = net.ParseIP("2001:db8::1")
+	server6 = net.ParseIP("2001:db8::53")
+)
+
+func query(t *testing.T, name string) []byte {
+	m := &dns.Msg{}
+	m.SetQuestion(name, dns.TypeA)
+	b, err := m.Pack()
+	require.Nil(t, err)
+	return b
+}
+
+func udp(srcPort, dstPort int, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+len(payload)))
+	return append(b, payload...)
+}
+
+// tcp returns a TCP segment carrying the messages, each prefixed with its length.
+func tcp(srcPort, dstPort int, msgs ...[]byte) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	b[12] = 5 << 4
+	for _, m := range msgs {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(m)))
+		b = append(b, m...)
+	}
+	return b
+}
+
+func ipv4Packet(proto byte, flags uint16, payload []byte) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	b[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(b[2:4], uint16(20+len(payload)))
+	binary.BigEndian.PutUint16(b[6:8], flags)
+	b[9] = proto
+	copy(b[12:16], client)
+	copy(b[16:20], server)
+	return append(b, payload...)
+}
+
+// ipv6Packet returns an IPv6 packet whose payload follows a hop-by-hop options header.
+func ipv6Packet(proto byte, payload []byte) []byte {
+	b := make([]byte, 48, 48+len(payload))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+len(payload)))
+	b[6] = protoHopByHop
+	copy(b[8:24], client6)
+	copy(b[24:40], server6)
+	b[40] = proto
+	return append(b, payload...)
+}
+
+func ethernet(etherType uint16, payload []byte) []byte {
+	b := make([]byte, 14, 14+len(payload))
+	binary.BigEndian.PutUint16(b[12:14], etherType)
+	return append(b, payload...)
+}
+
+func TestDNS(t *testing.T) {
+	q1, q2 := query(t, "one.example.com."), query(t, "two.example.com.")
+	ip := ipv4Packet(protoUDP, 0, udp(5353, 53, q1))
+	at := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	vlan := append([]byte{0, 1, 0x08, 0x00}, ip...)
+	sll := append(make([]byte, 14), 0x08, 0x00)
+	sll2 := append([]byte{0x08, 0x00}, make([]byte, 18)...)
+	tests := map[string]struct {
+		packet Packet
+		names  []string
+		tcp    bool
+		ipv6   bool
+	}{
+		"ethernet":        {packet: Packet{LinkType: LinkTypeEthernet, Data: ethernet(etherTypeIPv4, ip)}, names: []string{"one.example.com."}},
+		"padded frame":    {packet: Packet{LinkType: LinkTypeEthernet, Data: append(ethernet(etherTypeIPv4, ip), 0, 0, 0, 0)}, names: []string{"one.example.com."}},
+		"vlan":            {packet: Packet{LinkType: LinkTypeEthernet, Data: ethernet(etherTypeVLAN, vlan)}, names: []string{"one.example.com."}},
+		"raw":             {packet: Packet{LinkType: LinkTypeRaw, Data: ip}, names: []string{"one.example.com."}},
+		"loopback":        {packet: Packet{LinkType: LinkTypeNull, Data: append([]byte{2, 0, 0, 0}, ip...)}, names: []string{"one.example.com."}},
+		"linux cooked":    {packet: Packet{LinkType: LinkTypeLinuxSLL, Data: append(sll, ip...)}, names: []string{"one.example.com."}},
+		"linux cooked v2": {packet: Packet{LinkType: LinkTypeLinuxSLL2, Data: append(sll2, ip...)}, names: []string{"one.example.com."}},
+		"from the port":   {packet: Packet{LinkType: LinkTypeRaw, Data: ipv4Packet(protoUDP, 0, udp(53, 5353, q1))}, names: []string{"one.example.com."}},
+		"ipv6":            {packet: Packet{LinkType: LinkTypeIPv6, Data: ipv6Packet(protoUDP, udp(5353, 53, q1))}, names: []string{"one.example.com."}, ipv6: true},
+		"tcp":             {packet: Packet{LinkType: LinkTypeIPv4, Data: ipv4Packet(protoTCP, 0, tcp(5353, 53, q1, q2))}, names: []string{"one.example.com.", "two.example.com."}, tcp: true},
+		"partial tcp":     {packet: Packet{LinkType: LinkTypeIPv4, Data: ipv4Packet(protoTCP, 0, tcp(5353, 53, q1, q2)[:20+2+len(q1)+5])}, names: []string{"one.example.com."}, tcp: true},
+		"empty tcp":       {packet: Packet{LinkType: LinkTypeIPv4, Data: ipv4Packet(protoTCP, 0, tcp(5353, 53))}},
+		"other port":      {packet: Packet{LinkType: LinkTypeRaw, Data: ipv4Packet(protoUDP, 0, udp(5353, 5300, q1))}},
+		"other protocol":  {packet: Packet{LinkType: LinkTypeRaw, Data: ipv4Packet(1, 0, udp(5353, 53, q1))}},
+		"fragment":        {packet: Packet{LinkType: LinkTypeRaw, Data: ipv4Packet(protoUDP, 0x2000, udp(5353, 53, q1))}},
+		"ipv6 fragment":   {packet: Packet{LinkType: LinkTypeIPv6, Data: ipv6Packet(protoFragment, udp(5353, 53, q1))}},
+		"other ethertype": {packet: Packet{LinkType: LinkTypeEthernet, Data: ethernet(0x0806, make([]byte, 28))}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.packet.Time = at
+			msgs, err := test.packet.DNS(53)
+			require.Nil(t, err)
+			require.Len(t, msgs, len(test.names))
+			for i, m := range msgs {
+				require.Equal(t, at, m.Time)
+				require.Equal(t, test.names[i], m.Msg.Question[0].Name)
+				src, dst := client, server
+				if test.ipv6 {
+					src, dst = client6, server6
+				}
+				if test.tcp {
+					require.Equal(t, &net.TCPAddr{IP: src, Port: 5353}, m.Source)
+					require.Equal(t, &net.TCPAddr{IP: dst, Port: 53}, m.Destination)
+				} else {
+					require.IsType(t, &net.UDPAddr{}, m.Source)
+					require.True(t, m.Source.(*net.UDPAddr).IP.Equal(src))
+					require.True(t, m.Destination.(*net.UDPAddr).IP.Equal(dst))
+				}
+			}
+		})
+	}
+}
+
+func TestDNSErrors(t *testing.T) {
+	tests := map[string]Packet{
+		"truncated ethernet": {LinkType: LinkTypeEthernet, Data: make([]byte, 10)},
+		"truncated ipv4":     {LinkType: LinkTypeRaw, Data: ipv4Packet(protoUDP, 0, nil)[:12]},
+		"truncated udp":      {LinkType: LinkTypeRaw, Data: ipv4Packet(protoUDP, 0, []byte{0, 53})},
+		"truncated tcp":      {LinkType: LinkTypeRaw, Data: ipv4Packet(protoTCP, 0, make([]byte, 10))},
+		"unknown version":    {LinkType: LinkTypeRaw, Data: []byte{5 << 4, 0, 0, 0}},
+		"unsupported link":   {LinkType: 147, Data: make([]byte, 40)},
+		"invalid message":    {LinkType: LinkTypeRaw, Data: ipv4Packet(protoUDP, 0, udp(5353, 53, []byte("not dns")))},
+		"empty":              {LinkType: LinkTypeRaw},
+	}
+	for name, p := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := p.DNS(53)
+			require.NotNil(t, err)
+		})
+	}
+}
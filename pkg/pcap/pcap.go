@@ -0,0 +1,314 @@
+// Package pcap reads packet captures in the pcap and pcapng formats written by tcpdump,
+// Wireshark and most other capture tools, captures packets live on Linux, and decodes the DNS
+// messages carried by the packets. It needs neither libpcap nor cgo.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// MaxPacketSize is the largest packet that a Reader accepts. Captures are rarely taken with a
+// snapshot length over 256 KiB, so larger records are assumed to be corrupt.
+const MaxPacketSize = 1 << 20
+
+// Magic numbers of pcap files, and types of pcapng blocks.
+const (
+	magicMicros = 0xa1b2c3d4
+	magicNanos  = 0xa1b23c4d
+
+	blockSection          = 0x0a0d0d0a
+	blockInterface        = 0x00000001
+	blockPacketObsolete   = 0x00000002
+	blockSimplePacket     = 0x00000003
+	blockEnhancedPacket   = 0x00000006
+	sectionByteOrderMagic = 0x1a2b3c4d
+)
+
+// Options of pcapng interface description blocks.
+const (
+	optEndOfOpt  = 0
+	optTSResol   = 9
+	optTSOffset  = 14
+	defaultUnits = 1000000
+)
+
+// A Packet is a packet read from a capture.
+type Packet struct {
+	// Time is when the packet was captured. It is zero for the simple packet blocks of pcapng,
+	// which carry no timestamp.
+	Time time.Time
+	// LinkType is the type of the link layer header that Data starts with.
+	LinkType LinkType
+	// Data holds the captured bytes of the packet, and Length is the length of the packet on the
+	// wire, which is larger than len(Data) if the packet was cut to the snapshot length.
+	Data   []byte
+	Length int
+}
+
+// iface is an interface described by a pcapng section.
+type iface struct {
+	linkType LinkType
+	snapLen  uint32
+	// units is how many units of a timestamp make a second, and offset is added to timestamps.
+	units  uint64
+	offset int64
+}
+
+// A Reader reads the packets of a capture in the pcap or pcapng format, which it tells apart by
+// the first bytes of the capture.
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+	// linkType and nanos describe the packets of a pcap file.
+	linkType LinkType
+	nanos    bool
+	// ifaces are the interfaces of the current section of a pcapng file.
+	ifaces []iface
+}
+
+// NewReader returns a Reader reading a capture from r, after reading its header.
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReader(r)}
+	var magic [4]byte
+	if _, err := io.ReadFull(pr.r, magic[:]); err != nil {
+		return nil, fmt.Errorf("Failed to read capture header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(magic[:]) == blockSection {
+		pr.ng = true
+		if err := pr.readSection(); err != nil {
+			return nil, err
+		}
+		return pr, nil
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic[:]) {
+		case magicMicros:
+			pr.order = order
+		case magicNanos:
+			pr.order, pr.nanos = order, true
+		}
+	}
+	if pr.order == nil {
+		return nil, fmt.Errorf("Unknown capture format with magic number %x", magic)
+	}
+	var hdr [20]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("Failed to read capture header: %w", unexpected(err))
+	}
+	if major := pr.order.Uint16(hdr[0:2]); major != 2 {
+		return nil, fmt.Errorf("Unsupported pcap version %d", major)
+	}
+	// The upper bits of the link type tell whether packets end with a frame check sequence.
+	pr.linkType = LinkType(pr.order.Uint32(hdr[16:20]) & 0xffff)
+	return pr, nil
+}
+
+// ReadPacket returns the next packet of the capture, or io.EOF at the end of the capture.
+func (r *Reader) ReadPacket() (Packet, error) {
+	if r.ng {
+		return r.readBlockPacket()
+	}
+	var hdr [16]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return Packet{}, io.EOF
+		}
+		return Packet{}, fmt.Errorf("Failed to read packet header: %w", unexpected(err))
+	}
+	sec, frac := int64(r.order.Uint32(hdr[0:4])), int64(r.order.Uint32(hdr[4:8]))
+	if !r.nanos {
+		frac *= int64(time.Microsecond)
+	}
+	captured, length := r.order.Uint32(hdr[8:12]), r.order.Uint32(hdr[12:16])
+	if captured > MaxPacketSize {
+		return Packet{}, fmt.Errorf("Packet of %d bytes exceeds the maximum of %d", captured, MaxPacketSize)
+	}
+	data := make([]byte, captured)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Packet{}, fmt.Errorf("Failed to read packet: %w", unexpected(err))
+	}
+	return Packet{Time: time.Unix(sec, frac).UTC(), LinkType: r.linkType, Data: data, Length: int(length)}, nil
+}
+
+// readBlockPacket reads pcapng blocks until one holds a packet.
+func (r *Reader) readBlockPacket() (Packet, error) {
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return Packet{}, io.EOF
+			}
+			return Packet{}, fmt.Errorf("Failed to read block header: %w", unexpected(err))
+		}
+		blockType := r.order.Uint32(hdr[:])
+		if blockType == blockSection {
+			if err := r.readSection(); err != nil {
+				return Packet{}, err
+			}
+			continue
+		}
+		body, err := r.readBlockBody()
+		if err != nil {
+			return Packet{}, err
+		}
+		switch blockType {
+		case blockInterface:
+			if err := r.addInterface(body); err != nil {
+				return Packet{}, err
+			}
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				return Packet{}, errors.New("Enhanced packet block is too short")
+			}
+			return r.packet(r.order.Uint32(body[0:4]), r.order.Uint32(body[4:8]), r.order.Uint32(body[8:12]), body[12:])
+		case blockPacketObsolete:
+			if len(body) < 20 {
+				return Packet{}, errors.New("Packet block is too short")
+			}
+			return r.packet(uint32(r.order.Uint16(body[0:2])), r.order.Uint32(body[4:8]), r.order.Uint32(body[8:12]), body[12:])
+		case blockSimplePacket:
+			if len(body) < 4 {
+				return Packet{}, errors.New("Simple packet block is too short")
+			}
+			if len(r.ifaces) == 0 {
+				return Packet{}, errors.New("Simple packet block precedes the interface description")
+			}
+			length := r.order.Uint32(body[0:4])
+			captured := uint32(len(body) - 4)
+			if length < captured {
+				captured = length
+			}
+			if snap := r.ifaces[0].snapLen; snap != 0 && snap < captured {
+				captured = snap
+			}
+			return Packet{LinkType: r.ifaces[0].linkType, Data: body[4 : 4+captured], Length: int(length)}, nil
+		}
+		// Other blocks, such as name resolution and statistics blocks, are skipped.
+	}
+}
+
+// readSection reads a pcapng section header block, whose block type has been read, and forgets
+// the interfaces of the previous section.
+func (r *Reader) readSection() error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return fmt.Errorf("Failed to read section header: %w", unexpected(err))
+	}
+	switch uint32(sectionByteOrderMagic) {
+	case binary.LittleEndian.Uint32(hdr[4:8]):
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[4:8]):
+		r.order = binary.BigEndian
+	default:
+		return fmt.Errorf("Invalid byte-order magic %x in section header", hdr[4:8])
+	}
+	total := r.order.Uint32(hdr[0:4])
+	if total < 28 || total%4 != 0 || total > MaxPacketSize {
+		return fmt.Errorf("Invalid section header length %d", total)
+	}
+	// The rest of the body holds the version, section length and options, followed by the
+	// trailing length, none of which are needed.
+	if _, err := r.r.Discard(int(total) - 12); err != nil {
+		return fmt.Errorf("Failed to read section header: %w", unexpected(err))
+	}
+	r.ifaces = nil
+	return nil
+}
+
+// readBlockBody reads the length, body and trailing length of a pcapng block, whose type has been
+// read.
+func (r *Reader) readBlockBody() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("Failed to read block header: %w", unexpected(err))
+	}
+	total := r.order.Uint32(hdr[:])
+	if total < 12 || total%4 != 0 || total > MaxPacketSize {
+		return nil, fmt.Errorf("Invalid block length %d", total)
+	}
+	block := make([]byte, total-8)
+	if _, err := io.ReadFull(r.r, block); err != nil {
+		return nil, fmt.Errorf("Failed to read block: %w", unexpected(err))
+	}
+	if trailer := r.order.Uint32(block[len(block)-4:]); trailer != total {
+		return nil, fmt.Errorf("Block length %d doesn't match its trailing length %d", total, trailer)
+	}
+	return block[:len(block)-4], nil
+}
+
+// addInterface adds the interface described by the body of an interface description block.
+func (r *Reader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return errors.New("Interface description block is too short")
+	}
+	ifc := iface{linkType: LinkType(r.order.Uint16(body[0:2])), snapLen: r.order.Uint32(body[4:8]), units: defaultUnits}
+	for opts := body[8:]; len(opts) >= 4; {
+		code, n := r.order.Uint16(opts[0:2]), int(r.order.Uint16(opts[2:4]))
+		if code == optEndOfOpt || len(opts) < 4+n {
+			break
+		}
+		value := opts[4 : 4+n]
+		switch {
+		case code == optTSResol && n == 1:
+			// The resolution is a negative power of 2 if the high bit is set, and of 10 otherwise.
+			exp := value[0] & 0x7f
+			base := uint64(10)
+			if value[0]&0x80 != 0 {
+				base = 2
+			}
+			units := uint64(1)
+			for i := byte(0); i < exp; i++ {
+				hi, lo := bits.Mul64(units, base)
+				if hi != 0 {
+					return fmt.Errorf("Unsupported timestamp resolution %#x", value[0])
+				}
+				units = lo
+			}
+			ifc.units = units
+		case code == optTSOffset && n == 8:
+			ifc.offset = int64(r.order.Uint64(value))
+		}
+		// Option values are padded to 32 bits.
+		next := 4 + (n+3)&^3
+		if next > len(opts) {
+			break
+		}
+		opts = opts[next:]
+	}
+	r.ifaces = append(r.ifaces, ifc)
+	return nil
+}
+
+// packet returns the packet of an enhanced or obsolete packet block, given the interface, the
+// halves of the timestamp and the rest of the block.
+func (r *Reader) packet(id, tsHigh, tsLow uint32, rest []byte) (Packet, error) {
+	if int(id) >= len(r.ifaces) {
+		return Packet{}, fmt.Errorf("Packet of undescribed interface %d", id)
+	}
+	ifc := r.ifaces[id]
+	captured, length := r.order.Uint32(rest[0:4]), r.order.Uint32(rest[4:8])
+	if uint64(captured) > uint64(len(rest)-8) {
+		return Packet{}, fmt.Errorf("Packet of %d bytes exceeds its block", captured)
+	}
+	ts := uint64(tsHigh)<<32 | uint64(tsLow)
+	sec, frac := ts/ifc.units, ts%ifc.units
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, ifc.units)
+	t := time.Unix(int64(sec)+ifc.offset, int64(nsec)).UTC()
+	return Packet{Time: t, LinkType: ifc.linkType, Data: rest[8 : 8+captured], Length: int(length)}, nil
+}
+
+// unexpected reports the end of a capture in the middle of a header or packet as such.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pcapFile returns a pcap file of the packets, with the byte order, timestamp precision and link
+// type given.
+func pcapFile(order binary.ByteOrder, nanos bool, linkType LinkType, times []time.Time, packets [][]byte) []byte {
+	var b bytes.Buffer
+	magic := uint32(magicMicros)
+	if nanos {
+		magic = magicNanos
+	}
+	binary.Write(&b, order, []uint32{magic})
+	binary.Write(&b, order, []uint16{2, 4})
+	binary.Write(&b, order, []uint32{0, 0, 65535, uint32(linkType)})
+	for i, p := range packets {
+		frac := uint32(times[i].Nanosecond())
+		if !nanos {
+			frac /= 1000
+		}
+		binary.Write(&b, order, []uint32{uint32(times[i].Unix()), frac, uint32(len(p)), uint32(len(p) + 10)})
+		b.Write(p)
+	}
+	return b.Bytes()
+}
+
+// block returns a pcapng block of the type and body, padded to 32 bits.
+func block(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	var b bytes.Buffer
+	binary.Write(&b, order, []uint32{blockType, uint32(len(body) + 12)})
+	b.Write(body)
+	binary.Write(&b, order, []uint32{uint32(len(body) + 12)})
+	return b.Bytes()
+}
+
+func sectionBlock(order binary.ByteOrder) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, order, []uint32{sectionByteOrderMagic})
+	binary.Write(&b, order, []uint16{1, 0})
+	binary.Write(&b, order, []int64{-1})
+	return block(order, blockSection, b.Bytes())
+}
+
+// interfaceBlock returns an interface description block, with the if_tsresol option if tsresol
+// isn't 0.
+func interfaceBlock(order binary.ByteOrder, linkType LinkType, tsresol byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, order, []uint16{uint16(linkType), 0})
+	binary.Write(&b, order, []uint32{0})
+	if tsresol != 0 {
+		binary.Write(&b, order, []uint16{optTSResol, 1})
+		b.Write([]byte{tsresol, 0, 0, 0})
+		binary.Write(&b, order, []uint16{optEndOfOpt, 0})
+	}
+	return block(order, blockInterface, b.Bytes())
+}
+
+func enhancedBlock(order binary.ByteOrder, id uint32, ts uint64, data []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, order, []uint32{id, uint32(ts >> 32), uint32(ts), uint32(len(data)), uint32(len(data))})
+	b.Write(data)
+	return block(order, blockEnhancedPacket, b.Bytes())
+}
+
+func readAll(t *testing.T, capture []byte) []Packet {
+	r, err := NewReader(bytes.NewReader(capture))
+	require.Nil(t, err)
+	var packets []Packet
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			return packets
+		}
+		require.Nil(t, err)
+		packets = append(packets, p)
+	}
+}
+
+func TestReadPcap(t *testing.T) {
+	times := []time.Time{time.Date(2020, 6, 1, 12, 0, 0, 123456789, time.UTC), time.Date(2020, 6, 1, 12, 0, 1, 0, time.UTC)}
+	packets := [][]byte{[]byte("first"), []byte("second packet")}
+	tests := map[string]struct {
+		order binary.ByteOrder
+		nanos bool
+		times []time.Time
+	}{
+		"little endian": {binary.LittleEndian, false, []time.Time{times[0].Truncate(time.Microsecond), times[1]}},
+		"big endian":    {binary.BigEndian, false, []time.Time{times[0].Truncate(time.Microsecond), times[1]}},
+		"nanoseconds":   {binary.LittleEndian, true, times},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := readAll(t, pcapFile(test.order, test.nanos, LinkTypeEthernet, times, packets))
+			require.Len(t, got, 2)
+			for i, p := range got {
+				require.Equal(t, test.times[i], p.Time)
+				require.Equal(t, LinkTypeEthernet, p.LinkType)
+				require.Equal(t, packets[i], p.Data)
+				require.Equal(t, len(packets[i])+10, p.Length)
+			}
+		})
+	}
+}
+
+func TestReadPcapNG(t *testing.T) {
+	for name, order := range map[string]binary.ByteOrder{"little endian": binary.LittleEndian, "big endian": binary.BigEndian} {
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			b.Write(sectionBlock(order))
+			b.Write(interfaceBlock(order, LinkTypeEthernet, 0))
+			b.Write(interfaceBlock(order, LinkTypeRaw, 9))
+			// Name resolution blocks are skipped.
+			b.Write(block(order, 4, []byte{0, 0, 0, 0}))
+			b.Write(enhancedBlock(order, 0, 1591012800123456, []byte("first")))
+			b.Write(enhancedBlock(order, 1, 1591012801000000001, []byte("second")))
+			var spb bytes.Buffer
+			binary.Write(&spb, order, []uint32{5})
+			spb.Write([]byte("third"))
+			b.Write(block(order, blockSimplePacket, spb.Bytes()))
+			// A new section has interfaces of its own.
+			b.Write(sectionBlock(order))
+			b.Write(interfaceBlock(order, LinkTypeLinuxSLL, 0x80|10))
+			b.Write(enhancedBlock(order, 0, 1024*1591012802+512, []byte("fourth")))
+
+			got := readAll(t, b.Bytes())
+			require.Len(t, got, 4)
+			require.Equal(t, Packet{Time: time.Date(2020, 6, 1, 12, 0, 0, 123456000, time.UTC), LinkType: LinkTypeEthernet, Data: []byte("first"), Length: 5}, got[0])
+			require.Equal(t, Packet{Time: time.Date(2020, 6, 1, 12, 0, 1, 1, time.UTC), LinkType: LinkTypeRaw, Data: []byte("second"), Length: 6}, got[1])
+			require.Equal(t, Packet{LinkType: LinkTypeEthernet, Data: []byte("third"), Length: 5}, got[2])
+			require.Equal(t, Packet{Time: time.Date(2020, 6, 1, 12, 0, 2, 5e8, time.UTC), LinkType: LinkTypeLinuxSLL, Data: []byte("fourth"), Length: 6}, got[3])
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	le := binary.LittleEndian
+	valid := pcapFile(le, false, LinkTypeEthernet, []time.Time{time.Unix(0, 0)}, [][]byte{[]byte("packet")})
+	oversized := pcapFile(le, false, LinkTypeEthernet, nil, nil)
+	oversized = append(oversized, make([]byte, 16)...)
+	le.PutUint32(oversized[24+8:], MaxPacketSize+1)
+	var undescribed bytes.Buffer
+	undescribed.Write(sectionBlock(le))
+	undescribed.Write(enhancedBlock(le, 0, 0, []byte("packet")))
+	var mismatched bytes.Buffer
+	mismatched.Write(sectionBlock(le))
+	bad := interfaceBlock(le, LinkTypeEthernet, 0)
+	le.PutUint32(bad[len(bad)-4:], 0)
+	mismatched.Write(bad)
+
+	tests := map[string][]byte{
+		"truncated packet":     valid[:len(valid)-1],
+		"truncated header":     valid[:len(valid)-7],
+		"oversized packet":     oversized,
+		"undescribed":          undescribed.Bytes(),
+		"mismatched length":    mismatched.Bytes(),
+		"truncated block":      sectionBlock(le)[:20],
+		"unknown magic number": []byte("not a capture at all"),
+		"unsupported version":  append([]byte{0xd4, 0xc3, 0xb2, 0xa1, 3, 0}, make([]byte, 18)...),
+		"empty":                nil,
+	}
+	for name, capture := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(capture))
+			if err == nil {
+				for err == nil {
+					_, err = r.ReadPacket()
+				}
+			}
+			require.NotNil(t, err)
+			require.NotEqual(t, io.EOF, err)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Package rpc serves messages received by a tunnel to gRPC clients, using the Tunnel service
+// defined in tunnel.proto.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tunnel.proto
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// subscriberBufferSize is the number of messages buffered for each subscriber before Deliver
+// blocks.
+const subscriberBufferSize = 64
+
+// A Server implements the Tunnel service. It is also a sink.Sink, and sends each message it is
+// delivered to every subscriber whose filter it matches. Unlike sink.Stream, it doesn't drop
+// messages for subscribers that fall behind: Deliver blocks until every subscriber has room for
+// the message, so that slow consumers exert backpressure.
+type Server struct {
+	UnimplementedTunnelServer
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	prefix string
+	tenant string
+	queue  chan *Message
+	done   <-chan struct{}
+}
+
+// NewServer returns a Server with no subscribers.
+func NewServer() *Server {
+	return &Server{subscribers: make(map[*subscriber]struct{})}
+}
+
+// Deliver sends msg to every subscriber whose filter it matches. It returns ctx's error if ctx is
+// done before every subscriber has room for msg.
+func (s *Server) Deliver(ctx context.Context, msg tunnel.Message) error {
+	pb := toProto(msg)
+
+	s.mu.Lock()
+	var subs []*subscriber
+	for sub := range s.subscribers {
+		if strings.HasPrefix(msg.ID, sub.prefix) && (sub.tenant == "" || msg.Tenant == sub.tenant) {
+			subs = append(subs, sub)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.queue <- pb:
+		case <-sub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Subscribers returns the number of connected subscribers.
+func (s *Server) Subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+// Subscribe implements TunnelServer. It sends the response headers once the subscriber is
+// registered, so that clients can wait for them with Header before sending the messages they
+// expect through the tunnel.
+func (s *Server) Subscribe(req *SubscribeRequest, stream Tunnel_SubscribeServer) error {
+	ctx := stream.Context()
+	sub := &subscriber{prefix: req.IdPrefix, tenant: req.Tenant, queue: make(chan *Message, subscriberBufferSize), done: ctx.Done()}
+
+	s.mu.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, sub)
+		s.mu.Unlock()
+	}()
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case msg := <-sub.queue:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func toProto(msg tunnel.Message) *Message {
+	pb := &Message{
+		Id:            msg.ID,
+		Payload:       msg.Payload,
+		QueryType:     dns.TypeToString[msg.QueryType],
+		Domain:        msg.Domain,
+		Tenant:        msg.Tenant,
+		Fragments:     int32(msg.Fragments),
+		FirstFragment: timestamppb.New(msg.FirstFragment),
+		LastFragment:  timestamppb.New(msg.LastFragment),
+	}
+	if msg.Source != nil {
+		pb.Source = msg.Source.String()
+	}
+	if msg.ClientSubnet != nil {
+		pb.ClientSubnet = msg.ClientSubnet.String()
+	}
+	return pb
+}
@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestSubscribe(t *testing.T) {
+	l := bufconn.Listen(1 << 20)
+	srv := NewServer()
+	gs := grpc.NewServer()
+	RegisterTunnelServer(gs, srv)
+	go gs.Serve(l)
+	defer gs.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.Nil(t, err)
+	defer conn.Close()
+	client := NewTunnelClient(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all, err := client.Subscribe(ctx, &SubscribeRequest{})
+	require.Nil(t, err)
+	filtered, err := client.Subscribe(ctx, &SubscribeRequest{IdPrefix: "ab"})
+	require.Nil(t, err)
+	_, err = all.Header()
+	require.Nil(t, err)
+	_, err = filtered.Header()
+	require.Nil(t, err)
+	require.Equal(t, 2, srv.Subscribers())
+
+	first := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	one := tunnel.Message{ID: "xy1", Payload: []byte("one"), Source: net.ParseIP("192.0.2.1"), QueryType: dns.TypeA, Fragments: 1, FirstFragment: first, LastFragment: first}
+	_, subnet, _ := net.ParseCIDR("198.51.100.0/24")
+	two := tunnel.Message{ID: "ab2", Payload: []byte("two"), Source: net.ParseIP("192.0.2.1"), ClientSubnet: subnet, QueryType: dns.TypeTXT, Fragments: 3, FirstFragment: first, LastFragment: first.Add(time.Second)}
+	require.Nil(t, srv.Deliver(context.Background(), one))
+	require.Nil(t, srv.Deliver(context.Background(), two))
+
+	got, err := all.Recv()
+	require.Nil(t, err)
+	require.Equal(t, "xy1", got.Id)
+	require.Equal(t, []byte("one"), got.Payload)
+	require.Equal(t, "192.0.2.1", got.Source)
+	require.Equal(t, "", got.ClientSubnet)
+	require.Equal(t, "A", got.QueryType)
+	got, err = all.Recv()
+	require.Nil(t, err)
+	require.Equal(t, "ab2", got.Id)
+
+	got, err = filtered.Recv()
+	require.Nil(t, err)
+	require.Equal(t, "ab2", got.Id)
+	require.Equal(t, "TXT", got.QueryType)
+	require.EqualValues(t, 3, got.Fragments)
+	require.Equal(t, "198.51.100.0/24", got.ClientSubnet)
+	require.Equal(t, first.Add(time.Second), got.LastFragment.AsTime())
+
+	cancel()
+	require.Eventually(t, func() bool { return srv.Subscribers() == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestDeliverBackpressure(t *testing.T) {
+	srv := NewServer()
+	done := make(chan struct{})
+	sub := &subscriber{queue: make(chan *Message, 1), done: done}
+	srv.subscribers[sub] = struct{}{}
+
+	require.Nil(t, srv.Deliver(context.Background(), tunnel.Message{ID: "m1"}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, srv.Deliver(ctx, tunnel.Message{ID: "m2"}))
+
+	// Messages aren't held up by subscribers that have disconnected.
+	close(done)
+	require.Nil(t, srv.Deliver(context.Background(), tunnel.Message{ID: "m3"}))
+}
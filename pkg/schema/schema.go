@@ -0,0 +1,602 @@
+// Package schema validates JSON documents, such as the payloads of messages, against a JSON Schema.
+//
+// It implements the validation keywords of JSON Schema draft 2020-12 that constrain the structure
+// of a document: type, enum, const, the numeric keywords (minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum and multipleOf), minLength, maxLength and pattern, the array keywords (items,
+// prefixItems, minItems, maxItems and uniqueItems), the object keywords (properties,
+// patternProperties, additionalProperties, required, minProperties and maxProperties), allOf,
+// anyOf, oneOf and not, and $ref to the schema itself or its $defs or definitions. Other keywords,
+// including format, are ignored, as the specification requires of keywords a validator doesn't
+// know.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Schema is a compiled JSON Schema. It is safe for concurrent use.
+type Schema struct {
+	root *node
+}
+
+// A ValidationError is the reason a document is invalid.
+type ValidationError struct {
+	// Path is the JSON pointer of the invalid value in the document, e.g. /items/0, or empty for
+	// the document itself.
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// node is a compiled schema or subschema.
+type node struct {
+	// valid is set for the boolean schemas true and false, which accept or reject everything, and
+	// nil for the others.
+	valid *bool
+	ref   *node
+
+	types    []string
+	enum     []any
+	constant any
+	hasConst bool
+
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	prefixItems          []*node
+	items                *node
+	minItems, maxItems   *int
+	uniqueItems          bool
+	properties           map[string]*node
+	patternProperties    []patternProperty
+	additionalProperties *node
+	required             []string
+	minProps, maxProps   *int
+
+	allOf, anyOf, oneOf []*node
+	not                 *node
+}
+
+type patternProperty struct {
+	pattern *regexp.Regexp
+	schema  *node
+}
+
+// Open reads and compiles the schema in the file at path.
+func Open(path string) (*Schema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Compile(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Compile compiles the JSON Schema b.
+func Compile(b []byte) (*Schema, error) {
+	var doc any
+	if err := decode(b, &doc); err != nil {
+		return nil, err
+	}
+	c := &compiler{nodes: make(map[string]*node)}
+	root, err := c.compile(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range c.refs {
+		target, ok := c.nodes[r.pointer]
+		if !ok {
+			return nil, fmt.Errorf("%s: $ref %q doesn't name a schema", r.from, "#"+r.pointer)
+		}
+		r.node.ref = target
+	}
+	return &Schema{root: root}, nil
+}
+
+// Validate returns a ValidationError if v, a value decoded by encoding/json into an interface
+// value, isn't valid.
+func (s *Schema) Validate(v any) error {
+	return s.root.validate(v, "", 0)
+}
+
+// ValidateJSON returns a ValidationError if the JSON document b isn't valid, or another error if
+// it isn't JSON.
+func (s *Schema) ValidateJSON(b []byte) error {
+	var v any
+	if err := decode(b, &v); err != nil {
+		return err
+	}
+	return s.Validate(v)
+}
+
+// decode decodes the single JSON value in b into v.
+func decode(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("Invalid JSON: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("Invalid JSON: unexpected data after the top-level value")
+	}
+	return nil
+}
+
+// compiler compiles the subschemas of a document, keyed by their JSON pointer so that $ref can
+// be resolved once they are all compiled.
+type compiler struct {
+	nodes map[string]*node
+	refs  []ref
+}
+
+type ref struct {
+	node    *node
+	from    string
+	pointer string
+}
+
+func (c *compiler) compile(v any, ptr string) (*node, error) {
+	n := &node{}
+	c.nodes[ptr] = n
+	if b, ok := v.(bool); ok {
+		n.valid = &b
+		return n, nil
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object or a boolean", where(ptr))
+	}
+	var err error
+	sub := func(key string) (*node, error) {
+		if v, ok := obj[key]; ok {
+			return c.compile(v, ptr+"/"+key)
+		}
+		return nil, nil
+	}
+	subs := func(key string) ([]*node, error) {
+		v, ok := obj[key]
+		if !ok {
+			return nil, nil
+		}
+		arr, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be an array", where(ptr), key)
+		}
+		var nodes []*node
+		for i, s := range arr {
+			n, err := c.compile(s, ptr+"/"+key+"/"+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, n)
+		}
+		return nodes, nil
+	}
+	subMap := func(key string) (map[string]*node, error) {
+		v, ok := obj[key]
+		if !ok {
+			return nil, nil
+		}
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be an object", where(ptr), key)
+		}
+		nodes := make(map[string]*node, len(m))
+		for name, s := range m {
+			n, err := c.compile(s, ptr+"/"+key+"/"+escape(name))
+			if err != nil {
+				return nil, err
+			}
+			nodes[name] = n
+		}
+		return nodes, nil
+	}
+	number := func(key string) (*float64, error) {
+		v, ok := obj[key]
+		if !ok {
+			return nil, nil
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a number", where(ptr), key)
+		}
+		return &f, nil
+	}
+	count := func(key string) (*int, error) {
+		f, err := number(key)
+		if err != nil || f == nil {
+			return nil, err
+		}
+		if *f < 0 || *f != math.Trunc(*f) {
+			return nil, fmt.Errorf("%s: %s must be a non-negative integer", where(ptr), key)
+		}
+		i := int(*f)
+		return &i, nil
+	}
+	pattern := func(key string, s string) (*regexp.Regexp, error) {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s: %w", where(ptr), key, err)
+		}
+		return re, nil
+	}
+
+	if r, ok := obj["$ref"]; ok {
+		s, ok := r.(string)
+		if !ok || !strings.HasPrefix(s, "#") {
+			return nil, fmt.Errorf("%s: only $ref to the schema itself, e.g. #/$defs/name, are supported", where(ptr))
+		}
+		pointer, err := url.PathUnescape(s[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid $ref: %w", where(ptr), err)
+		}
+		c.refs = append(c.refs, ref{node: n, from: where(ptr), pointer: pointer})
+	}
+	// Definitions are compiled even if nothing refers to them, so that they are validated.
+	if _, err = subMap("$defs"); err != nil {
+		return nil, err
+	}
+	if _, err = subMap("definitions"); err != nil {
+		return nil, err
+	}
+
+	switch t := obj["type"].(type) {
+	case nil:
+	case string:
+		n.types = []string{t}
+	case []any:
+		for _, v := range t {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: type must be a string or an array of strings", where(ptr))
+			}
+			n.types = append(n.types, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s: type must be a string or an array of strings", where(ptr))
+	}
+	for _, t := range n.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, fmt.Errorf("%s: unknown type %q", where(ptr), t)
+		}
+	}
+	if e, ok := obj["enum"]; ok {
+		if n.enum, ok = e.([]any); !ok {
+			return nil, fmt.Errorf("%s: enum must be an array", where(ptr))
+		}
+	}
+	n.constant, n.hasConst = obj["const"]
+
+	for key, dst := range map[string]**float64{"minimum": &n.minimum, "maximum": &n.maximum, "exclusiveMinimum": &n.exclusiveMinimum, "exclusiveMaximum": &n.exclusiveMaximum, "multipleOf": &n.multipleOf} {
+		if *dst, err = number(key); err != nil {
+			return nil, err
+		}
+	}
+	if n.multipleOf != nil && *n.multipleOf <= 0 {
+		return nil, fmt.Errorf("%s: multipleOf must be greater than 0", where(ptr))
+	}
+	for key, dst := range map[string]**int{"minLength": &n.minLength, "maxLength": &n.maxLength, "minItems": &n.minItems, "maxItems": &n.maxItems, "minProperties": &n.minProps, "maxProperties": &n.maxProps} {
+		if *dst, err = count(key); err != nil {
+			return nil, err
+		}
+	}
+	if p, ok := obj["pattern"]; ok {
+		s, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: pattern must be a string", where(ptr))
+		}
+		if n.pattern, err = pattern("pattern", s); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.prefixItems, err = subs("prefixItems"); err != nil {
+		return nil, err
+	}
+	if n.items, err = sub("items"); err != nil {
+		return nil, err
+	}
+	if u, ok := obj["uniqueItems"]; ok {
+		if n.uniqueItems, ok = u.(bool); !ok {
+			return nil, fmt.Errorf("%s: uniqueItems must be a boolean", where(ptr))
+		}
+	}
+	if n.properties, err = subMap("properties"); err != nil {
+		return nil, err
+	}
+	patterns, err := subMap("patternProperties")
+	if err != nil {
+		return nil, err
+	}
+	for p, s := range patterns {
+		re, err := pattern("patternProperties", p)
+		if err != nil {
+			return nil, err
+		}
+		n.patternProperties = append(n.patternProperties, patternProperty{pattern: re, schema: s})
+	}
+	if n.additionalProperties, err = sub("additionalProperties"); err != nil {
+		return nil, err
+	}
+	if r, ok := obj["required"]; ok {
+		arr, ok := r.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: required must be an array of strings", where(ptr))
+		}
+		for _, v := range arr {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: required must be an array of strings", where(ptr))
+			}
+			n.required = append(n.required, s)
+		}
+	}
+
+	if n.allOf, err = subs("allOf"); err != nil {
+		return nil, err
+	}
+	if n.anyOf, err = subs("anyOf"); err != nil {
+		return nil, err
+	}
+	if n.oneOf, err = subs("oneOf"); err != nil {
+		return nil, err
+	}
+	if n.not, err = sub("not"); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// where describes the location of the subschema at ptr in errors.
+func where(ptr string) string {
+	if ptr == "" {
+		return "Schema"
+	}
+	return "Schema at " + ptr
+}
+
+// escape escapes name as a reference token of a JSON pointer.
+func escape(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// maxDepth bounds the nesting of $ref that validate follows, so that schemas referring to
+// themselves without consuming the document fail rather than overflowing the stack.
+const maxDepth = 256
+
+func (n *node) validate(v any, path string, depth int) error {
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+	if n.valid != nil {
+		if !*n.valid {
+			return fail("No value is allowed")
+		}
+		return nil
+	}
+	if n.ref != nil {
+		if depth >= maxDepth {
+			return fail("$ref is nested too deeply")
+		}
+		if err := n.ref.validate(v, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	if len(n.types) > 0 {
+		found := false
+		for _, t := range n.types {
+			found = found || hasType(v, t)
+		}
+		if !found {
+			return fail("Expected %s but got %s", strings.Join(n.types, " or "), typeOf(v))
+		}
+	}
+	if n.enum != nil {
+		found := false
+		for _, e := range n.enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			return fail("Value is not one of the values of enum")
+		}
+	}
+	if n.hasConst && !reflect.DeepEqual(n.constant, v) {
+		return fail("Value is not the value of const")
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if n.minimum != nil && v < *n.minimum {
+			return fail("%v is less than the minimum of %v", v, *n.minimum)
+		}
+		if n.maximum != nil && v > *n.maximum {
+			return fail("%v is greater than the maximum of %v", v, *n.maximum)
+		}
+		if n.exclusiveMinimum != nil && v <= *n.exclusiveMinimum {
+			return fail("%v is not greater than %v", v, *n.exclusiveMinimum)
+		}
+		if n.exclusiveMaximum != nil && v >= *n.exclusiveMaximum {
+			return fail("%v is not less than %v", v, *n.exclusiveMaximum)
+		}
+		if n.multipleOf != nil {
+			if q := v / *n.multipleOf; q != math.Trunc(q) {
+				return fail("%v is not a multiple of %v", v, *n.multipleOf)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n.minLength != nil && length < *n.minLength {
+			return fail("String is shorter than %d characters", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			return fail("String is longer than %d characters", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(v) {
+			return fail("String doesn't match %s", n.pattern)
+		}
+	case []any:
+		if n.minItems != nil && len(v) < *n.minItems {
+			return fail("Array has fewer than %d items", *n.minItems)
+		}
+		if n.maxItems != nil && len(v) > *n.maxItems {
+			return fail("Array has more than %d items", *n.maxItems)
+		}
+		if n.uniqueItems {
+			for i := range v {
+				for j := 0; j < i; j++ {
+					if reflect.DeepEqual(v[i], v[j]) {
+						return fail("Items %d and %d are equal", j, i)
+					}
+				}
+			}
+		}
+		for i, item := range v {
+			s := n.items
+			if i < len(n.prefixItems) {
+				s = n.prefixItems[i]
+			}
+			if s == nil {
+				continue
+			}
+			if err := s.validate(item, path+"/"+strconv.Itoa(i), depth); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		if n.minProps != nil && len(v) < *n.minProps {
+			return fail("Object has fewer than %d properties", *n.minProps)
+		}
+		if n.maxProps != nil && len(v) > *n.maxProps {
+			return fail("Object has more than %d properties", *n.maxProps)
+		}
+		for _, name := range n.required {
+			if _, ok := v[name]; !ok {
+				return fail("Missing required property %q", name)
+			}
+		}
+		// Properties are validated in order, so that the same document always fails with the same
+		// error.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p := path + "/" + escape(name)
+			s, matched := n.properties[name]
+			if matched {
+				if err := s.validate(v[name], p, depth); err != nil {
+					return err
+				}
+			}
+			for _, pp := range n.patternProperties {
+				if !pp.pattern.MatchString(name) {
+					continue
+				}
+				matched = true
+				if err := pp.schema.validate(v[name], p, depth); err != nil {
+					return err
+				}
+			}
+			if !matched && n.additionalProperties != nil {
+				if n.additionalProperties.valid != nil && !*n.additionalProperties.valid {
+					return fail("Property %q is not allowed", name)
+				}
+				if err := n.additionalProperties.validate(v[name], p, depth); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, s := range n.allOf {
+		if err := s.validate(v, path, depth); err != nil {
+			return err
+		}
+	}
+	if len(n.anyOf) > 0 {
+		var first error
+		for _, s := range n.anyOf {
+			err := s.validate(v, path, depth)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return fail("Value doesn't match any schema of anyOf, e.g. %v", first)
+		}
+	}
+	if len(n.oneOf) > 0 {
+		matches := 0
+		for _, s := range n.oneOf {
+			if s.validate(v, path, depth) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("Value matches %d schemas of oneOf rather than exactly one", matches)
+		}
+	}
+	if n.not != nil && n.not.validate(v, path, depth) == nil {
+		return fail("Value matches the schema of not")
+	}
+	return nil
+}
+
+// hasType reports whether v, as decoded by encoding/json, is of the JSON Schema type t.
+func hasType(v any, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case float64:
+		return t == "number" || t == "integer" && v == math.Trunc(v) && !math.IsInf(v, 0)
+	case string:
+		return t == "string"
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	}
+	return false
+}
+
+// typeOf returns the JSON Schema type of v.
+func typeOf(v any) string {
+	for _, t := range []string{"null", "boolean", "integer", "number", "string", "array", "object"} {
+		if hasType(v, t) {
+			return t
+		}
+	}
+	return fmt.Sprintf("%T", v)
+}
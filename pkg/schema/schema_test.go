@@ -0,0 +1,104 @@
+package schema
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const event = `{
+	"type": "object",
+	"required": ["event", "ts"],
+	"properties": {
+		"event": {"enum": ["click", "view"]},
+		"ts": {"type": "integer", "minimum": 0},
+		"user": {"$ref": "#/$defs/user"},
+		"labels": {"type": "array", "items": {"type": "string", "maxLength": 8}, "uniqueItems": true}
+	},
+	"patternProperties": {"^x-": {"type": "string"}},
+	"additionalProperties": false,
+	"$defs": {
+		"user": {
+			"type": "object",
+			"properties": {"id": {"type": "string", "pattern": "^u[0-9]+$"}, "age": {"type": ["integer", "null"]}},
+			"oneOf": [{"required": ["id"]}, {"required": ["email"]}]
+		}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	s, err := Compile([]byte(event))
+	require.Nil(t, err)
+	tests := []struct {
+		doc   string
+		fails bool
+		path  string
+	}{
+		{doc: `{"event": "click", "ts": 1}`},
+		{doc: `{"event": "view", "ts": 2.0, "user": {"id": "u1", "age": null}, "labels": ["a", "b"], "x-trace": "t"}`},
+		{doc: `{"event": "click"}`, fails: true},
+		{doc: `{"event": "scroll", "ts": 1}`, fails: true, path: "/event"},
+		{doc: `{"event": "click", "ts": 1.5}`, fails: true, path: "/ts"},
+		{doc: `{"event": "click", "ts": -1}`, fails: true, path: "/ts"},
+		{doc: `{"event": "click", "ts": 1, "other": 1}`, fails: true},
+		{doc: `{"event": "click", "ts": 1, "x-trace": 1}`, fails: true, path: "/x-trace"},
+		{doc: `{"event": "click", "ts": 1, "labels": ["a", "a"]}`, fails: true, path: "/labels"},
+		{doc: `{"event": "click", "ts": 1, "labels": ["toolonglabel"]}`, fails: true, path: "/labels/0"},
+		{doc: `{"event": "click", "ts": 1, "user": {"id": "x1"}}`, fails: true, path: "/user/id"},
+		{doc: `{"event": "click", "ts": 1, "user": {"id": "u1", "email": "a@example.com"}}`, fails: true, path: "/user"},
+		{doc: `{"event": "click", "ts": 1, "user": {"age": 3}}`, fails: true, path: "/user"},
+		{doc: `[]`, fails: true},
+	}
+	for _, test := range tests {
+		err := s.ValidateJSON([]byte(test.doc))
+		if !test.fails {
+			require.Nil(t, err, test.doc)
+			continue
+		}
+		var verr *ValidationError
+		require.ErrorAs(t, err, &verr, test.doc)
+		require.Equal(t, test.path, verr.Path, test.doc)
+	}
+}
+
+func TestValidateJSON(t *testing.T) {
+	s, err := Compile([]byte(`{"type": "object"}`))
+	require.Nil(t, err)
+	var verr *ValidationError
+	// Documents that aren't JSON fail, but not with a ValidationError.
+	for _, doc := range []string{``, `{`, `{} {}`, `hello`} {
+		err := s.ValidateJSON([]byte(doc))
+		require.NotNil(t, err, doc)
+		require.False(t, errors.As(err, &verr), doc)
+	}
+	require.Nil(t, s.ValidateJSON([]byte(` {"a": 1} `)))
+	require.EqualError(t, s.ValidateJSON([]byte(`"a"`)), "Expected object but got string")
+
+	// Schemas may refer to themselves.
+	s, err = Compile([]byte(`{"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#"}}}}`))
+	require.Nil(t, err)
+	require.Nil(t, s.ValidateJSON([]byte(`{"children": [{"children": []}]}`)))
+	require.EqualError(t, s.ValidateJSON([]byte(`{"children": [{"children": [1]}]}`)), "/children/0/children/0: Expected object but got integer")
+	s, err = Compile([]byte(`{"$ref": "#"}`))
+	require.Nil(t, err)
+	require.NotNil(t, s.ValidateJSON([]byte(`{}`)))
+}
+
+func TestCompileInvalid(t *testing.T) {
+	for _, schema := range []string{
+		`1`,
+		`{"type": "float"}`,
+		`{"type": 1}`,
+		`{"minLength": -1}`,
+		`{"multipleOf": 0}`,
+		`{"pattern": "("}`,
+		`{"properties": {"a": 1}}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"$ref": "https://example.com/schema.json"}`,
+		`{"$defs": {"a": {"type": "float"}}}`,
+	} {
+		_, err := Compile([]byte(schema))
+		require.NotNil(t, err, schema)
+	}
+}
@@ -0,0 +1,82 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// An AlertSink receives the alerts raised by a tunnel, which are kept apart from the messages
+// delivered by a Sink.
+type AlertSink interface {
+	DeliverAlert(ctx context.Context, alert tunnel.Alert) error
+}
+
+// alertRecord is the JSON representation of an alert:
+//
+//	{"kind":"entropy","time":"2024-01-01T00:00:00Z","source":"192.0.2.1","name":"...","entropy":4.2}
+type alertRecord struct {
+	Kind    tunnel.AlertKind `json:"kind"`
+	Time    time.Time        `json:"time"`
+	Source  string           `json:"source,omitempty"`
+	Name    string           `json:"name,omitempty"`
+	Count   int              `json:"count,omitempty"`
+	Entropy float64          `json:"entropy,omitempty"`
+}
+
+// MarshalAlert returns the JSON representation of alert.
+func MarshalAlert(alert tunnel.Alert) ([]byte, error) {
+	rec := alertRecord{
+		Kind:    alert.Kind,
+		Time:    alert.Time.UTC(),
+		Name:    alert.Name,
+		Count:   alert.Count,
+		Entropy: alert.Entropy,
+	}
+	if alert.Source != nil {
+		rec.Source = alert.Source.String()
+	}
+	return json.Marshal(rec)
+}
+
+// DeliverAlert appends alert to the file as a line of JSON, rotating it first if it is due.
+func (fs *File) DeliverAlert(ctx context.Context, alert tunnel.Alert) error {
+	line, err := MarshalAlert(alert)
+	if err != nil {
+		return err
+	}
+	return fs.WriteLine(line)
+}
+
+// DeliverAlert POSTs alert to the webhook as JSON, retrying like Deliver. Raw is ignored, since
+// alerts have no payload.
+func (wh *Webhook) DeliverAlert(ctx context.Context, alert tunnel.Alert) error {
+	body, err := MarshalAlert(alert)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return wh.send(ctx, body, header)
+}
+
+// ForwardAlerts delivers every alert received from alerts to each of sinks in turn until alerts is
+// closed, such as by tunnel.Tunnel.Close. Alerts are also logged as warnings to logger, or
+// slog.Default() if it is nil, as are failed deliveries.
+func ForwardAlerts(alerts <-chan tunnel.Alert, logger *slog.Logger, sinks ...AlertSink) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	for alert := range alerts {
+		logger.Warn("Suspicious traffic", "kind", alert.Kind, "source", alert.Source, "name", alert.Name, "count", alert.Count, "entropy", alert.Entropy)
+		for _, s := range sinks {
+			if err := s.DeliverAlert(context.Background(), alert); err != nil {
+				logger.Warn("Failed to deliver alert", "kind", alert.Kind, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package sink
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+var testAlert = tunnel.Alert{
+	Kind:    tunnel.AlertEntropy,
+	Time:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	Source:  net.ParseIP("192.0.2.1"),
+	Name:    "k2x9q7vz4m1p8r3t.example.org.",
+	Entropy: 4,
+}
+
+func TestMarshalAlert(t *testing.T) {
+	b, err := MarshalAlert(testAlert)
+	require.Nil(t, err)
+	require.JSONEq(t, `{
+		"kind": "entropy",
+		"time": "2024-01-01T00:00:00Z",
+		"source": "192.0.2.1",
+		"name": "k2x9q7vz4m1p8r3t.example.org.",
+		"entropy": 4
+	}`, string(b))
+
+	b, err = MarshalAlert(tunnel.Alert{Kind: tunnel.AlertIDBurst, Time: testAlert.Time, Count: 101})
+	require.Nil(t, err)
+	require.JSONEq(t, `{"kind": "id_burst", "time": "2024-01-01T00:00:00Z", "count": 101}`, string(b))
+}
+
+func TestForwardAlerts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.ndjson")
+	file, err := NewFile(FileConfig{Path: path})
+	require.Nil(t, err)
+
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	alerts := make(chan tunnel.Alert, 1)
+	alerts <- testAlert
+	close(alerts)
+	ForwardAlerts(alerts, nil, file, &Webhook{URL: server.URL})
+	require.Nil(t, file.Close())
+
+	expected, err := MarshalAlert(testAlert)
+	require.Nil(t, err)
+	require.Equal(t, []string{string(expected)}, readLines(t, path))
+	require.Equal(t, string(expected), <-bodies)
+
+	// Failed deliveries are only logged.
+	require.NotNil(t, file.DeliverAlert(context.Background(), testAlert))
+}
@@ -0,0 +1,226 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// Defaults of an ArchiveConfig.
+const (
+	// DefaultArchiveLayout partitions objects by the hour, as year/month/day/hour.
+	DefaultArchiveLayout = "2006/01/02/15"
+	// DefaultArchiveInterval is how often archived messages are uploaded by default.
+	DefaultArchiveInterval = 5 * time.Minute
+	// DefaultArchiveMaxSize is the number of bytes of JSON after which an object is uploaded
+	// early by default.
+	DefaultArchiveMaxSize = 64 << 20
+)
+
+// ArchiveConfig configures an Archive.
+type ArchiveConfig struct {
+	// Store is where objects are uploaded, e.g. an S3.
+	Store ObjectStore
+	// Prefix is prepended to the key of every object, e.g. "browsertunnel/".
+	Prefix string
+	// Layout is the time layout of the partition each message is archived in, formatted with the
+	// time its last fragment arrived, in UTC. DefaultArchiveLayout is used if empty.
+	Layout string
+	// Interval is how often archived messages are uploaded. DefaultArchiveInterval is used if 0.
+	Interval time.Duration
+	// MaxSize is the number of bytes of JSON after which an object is uploaded without waiting
+	// for the interval. DefaultArchiveMaxSize is used if 0.
+	MaxSize int64
+}
+
+// An Archive batches messages into gzipped objects of newline delimited JSON, uploaded to an
+// ObjectStore for long-term retention and analysis with tools such as Athena or BigQuery. Each
+// object holds the messages of one partition, e.g. an hour, received within an interval, and is
+// stored as <prefix><partition>/<timestamp>.ndjson.gz, where timestamp is when its first
+// message was archived.
+//
+// Deliver returns once a message is added to an object, so failed uploads are logged and counted
+// by the Archive rather than reported to the caller. They are retried at every interval for as
+// long as the Archive runs.
+type Archive struct {
+	cfg    ArchiveConfig
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu      sync.Mutex
+	objects map[string]*archiveObject
+	failed  []*archiveObject
+	closed  bool
+	cancel  chan struct{}
+	wg      sync.WaitGroup
+
+	pending  atomic.Int64
+	uploaded uint64
+	messages uint64
+	errors   uint64
+}
+
+// An archiveObject is an object being written, or waiting to be uploaded.
+type archiveObject struct {
+	key      string
+	buf      bytes.Buffer
+	gz       *gzip.Writer
+	size     int64
+	messages int
+}
+
+// NewArchive returns an Archive uploading to the store described by cfg. Errors are logged to
+// logger, or slog.Default() if it is nil.
+func NewArchive(cfg ArchiveConfig, logger *slog.Logger) (*Archive, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("Archive sink requires an object store")
+	}
+	if cfg.Interval < 0 || cfg.MaxSize < 0 {
+		return nil, fmt.Errorf("Archive sink declares negative interval %s or maximum size %d", cfg.Interval, cfg.MaxSize)
+	}
+	if cfg.Layout == "" {
+		cfg.Layout = DefaultArchiveLayout
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultArchiveInterval
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultArchiveMaxSize
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	a := &Archive{cfg: cfg, logger: logger, now: time.Now, objects: make(map[string]*archiveObject), cancel: make(chan struct{})}
+	a.wg.Add(1)
+	go a.run()
+	return a, nil
+}
+
+// Deliver adds msg to the object of its partition, and uploads the object if it reached the
+// maximum size.
+func (a *Archive) Deliver(ctx context.Context, msg tunnel.Message) error {
+	line, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return fmt.Errorf("Archive sink is closed")
+	}
+	at := msg.LastFragment
+	if at.IsZero() {
+		at = a.now()
+	}
+	partition := at.UTC().Format(a.cfg.Layout)
+	obj := a.objects[partition]
+	if obj == nil {
+		obj = &archiveObject{key: a.cfg.Prefix + partition + "/" + a.now().UTC().Format(rotatedTimeFormat) + ".ndjson.gz"}
+		obj.gz = gzip.NewWriter(&obj.buf)
+		a.objects[partition] = obj
+	}
+	obj.gz.Write(line)
+	obj.size += int64(len(line))
+	obj.messages++
+	a.pending.Add(1)
+	full := obj.size >= a.cfg.MaxSize
+	if full {
+		delete(a.objects, partition)
+	}
+	a.mu.Unlock()
+
+	if full {
+		a.upload(ctx, obj)
+	}
+	return nil
+}
+
+// run uploads the archived messages every interval, until the Archive is closed.
+func (a *Archive) run() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-a.cancel:
+			return
+		}
+	}
+}
+
+// flush uploads every object being written, and retries those that failed to upload.
+func (a *Archive) flush() {
+	a.mu.Lock()
+	objects := a.failed
+	for _, obj := range a.objects {
+		objects = append(objects, obj)
+	}
+	a.objects = make(map[string]*archiveObject)
+	a.failed = nil
+	a.mu.Unlock()
+
+	for _, obj := range objects {
+		a.upload(context.Background(), obj)
+	}
+}
+
+// upload uploads obj, and keeps it to be retried if that fails.
+func (a *Archive) upload(ctx context.Context, obj *archiveObject) {
+	if obj.gz != nil {
+		obj.gz.Close()
+		obj.gz = nil
+	}
+	if err := a.cfg.Store.Put(ctx, obj.key, "application/gzip", obj.buf.Bytes()); err != nil {
+		atomic.AddUint64(&a.errors, 1)
+		a.logger.Warn("Failed to upload archive", "key", obj.key, "messages", obj.messages, "error", err)
+		a.mu.Lock()
+		a.failed = append(a.failed, obj)
+		a.mu.Unlock()
+		return
+	}
+	atomic.AddUint64(&a.uploaded, 1)
+	atomic.AddUint64(&a.messages, uint64(obj.messages))
+	a.pending.Add(-int64(obj.messages))
+}
+
+// Close uploads the archived messages, and returns an error if any of them couldn't be
+// uploaded.
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.mu.Unlock()
+	close(a.cancel)
+	a.wg.Wait()
+
+	a.flush()
+	if n := a.pending.Load(); n > 0 {
+		return fmt.Errorf("Failed to upload %d archived messages", n)
+	}
+	return nil
+}
+
+// Collect implements metrics.Collector.
+func (a *Archive) Collect() []metrics.Metric {
+	return []metrics.Metric{
+		{Name: "browsertunnel_sink_archive_objects_total", Help: "Objects uploaded by an archive sink.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&a.uploaded))},
+		{Name: "browsertunnel_sink_archived_messages_total", Help: "Messages uploaded by an archive sink.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&a.messages))},
+		{Name: "browsertunnel_sink_archive_errors_total", Help: "Failed uploads of an archive sink.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&a.errors))},
+		{Name: "browsertunnel_sink_archive_pending", Help: "Messages waiting to be uploaded by an archive sink.", Type: metrics.Gauge, Value: float64(a.pending.Load())},
+	}
+}
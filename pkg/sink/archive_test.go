@@ -0,0 +1,126 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// memoryStore is an ObjectStore keeping objects in memory, failing while fail is set.
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	fail    bool
+}
+
+func (s *memoryStore) Put(ctx context.Context, key, contentType string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return fmt.Errorf("failed to put %s", key)
+	}
+	if s.objects == nil {
+		s.objects = make(map[string][]byte)
+	}
+	s.objects[key] = append([]byte(nil), body...)
+	return nil
+}
+
+// ids returns the IDs of the messages in each object, keyed by the directory of the object.
+func (s *memoryStore) ids(t *testing.T) map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make(map[string][]string)
+	for key, body := range s.objects {
+		require.Regexp(t, `/\d{8}T\d{6}\.\d{9}\.ndjson\.gz$`, key)
+		dir := key[:len(key)-len("/20200601T120000.000000000.ndjson.gz")]
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		require.Nil(t, err)
+		lines := bufio.NewScanner(gz)
+		for lines.Scan() {
+			var r record
+			require.Nil(t, json.Unmarshal(lines.Bytes(), &r))
+			ids[dir] = append(ids[dir], r.ID)
+		}
+		sort.Strings(ids[dir])
+	}
+	return ids
+}
+
+func archiveMessage(id string, at time.Time) tunnel.Message {
+	msg := testMessage
+	msg.ID, msg.LastFragment = id, at
+	return msg
+}
+
+func TestArchive(t *testing.T) {
+	store := &memoryStore{}
+	a, err := NewArchive(ArchiveConfig{Store: store, Prefix: "bt/", Interval: time.Hour}, nil)
+	require.Nil(t, err)
+	noon := time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC)
+	for _, msg := range []tunnel.Message{
+		archiveMessage("m1", noon),
+		archiveMessage("m2", noon.Add(time.Hour)),
+		archiveMessage("m3", noon.Add(time.Minute)),
+	} {
+		require.Nil(t, a.Deliver(context.Background(), msg))
+	}
+	require.Empty(t, store.objects)
+	require.Nil(t, a.Close())
+
+	// Messages are partitioned by the hour their last fragment arrived.
+	require.Equal(t, map[string][]string{
+		"bt/2020/06/01/12": {"m1", "m3"},
+		"bt/2020/06/01/13": {"m2"},
+	}, store.ids(t))
+	require.NotNil(t, a.Deliver(context.Background(), archiveMessage("m4", noon)))
+}
+
+func TestArchiveMaxSize(t *testing.T) {
+	store := &memoryStore{}
+	a, err := NewArchive(ArchiveConfig{Store: store, Layout: "2006-01-02", Interval: time.Hour, MaxSize: 1}, nil)
+	require.Nil(t, err)
+	defer a.Close()
+	require.Nil(t, a.Deliver(context.Background(), archiveMessage("m1", testMessage.LastFragment)))
+	require.Equal(t, map[string][]string{"2020-06-01": {"m1"}}, store.ids(t))
+}
+
+func TestArchiveRetry(t *testing.T) {
+	store := &memoryStore{fail: true}
+	a, err := NewArchive(ArchiveConfig{Store: store, Interval: 5 * time.Millisecond}, nil)
+	require.Nil(t, err)
+	require.Nil(t, a.Deliver(context.Background(), archiveMessage("m1", testMessage.LastFragment)))
+	require.Eventually(t, func() bool { return a.Collect()[2].Value >= 2 }, time.Second, time.Millisecond)
+	require.Equal(t, float64(1), a.Collect()[3].Value)
+
+	// Failed objects are retried until they are uploaded.
+	store.mu.Lock()
+	store.fail = false
+	store.mu.Unlock()
+	require.Eventually(t, func() bool { return a.Collect()[0].Value == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, map[string][]string{"2020/06/01/12": {"m1"}}, store.ids(t))
+	require.Nil(t, a.Close())
+
+	store.fail = true
+	a, err = NewArchive(ArchiveConfig{Store: store}, nil)
+	require.Nil(t, err)
+	require.Nil(t, a.Deliver(context.Background(), archiveMessage("m2", testMessage.LastFragment)))
+	require.NotNil(t, a.Close())
+}
+
+func TestNewArchiveErrors(t *testing.T) {
+	_, err := NewArchive(ArchiveConfig{}, nil)
+	require.NotNil(t, err)
+	_, err = NewArchive(ArchiveConfig{Store: &memoryStore{}, Interval: -time.Second}, nil)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,157 @@
+package sink
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// Defaults of the size and interval of a Batcher.
+const (
+	DefaultBatchSize     = 100
+	DefaultBatchInterval = time.Second
+)
+
+// A BatchSink is a Sink that can deliver several messages at once, e.g. in a single request, as
+// implemented by Webhook and Kafka.
+type BatchSink interface {
+	Sink
+	// DeliverBatch delivers msgs, and returns nil once all of them have been accepted.
+	DeliverBatch(ctx context.Context, msgs []tunnel.Message) error
+}
+
+// A Batcher is a Sink that collects messages into batches, and delivers each batch to a
+// BatchSink in a single call once it holds size messages, or interval after its first message
+// arrived, whichever comes first. Sinks that can't deliver batches receive their messages one at
+// a time.
+//
+// Deliver returns as soon as the message is added to a batch, so failed batches are logged and
+// counted by the Batcher rather than reported to the caller: a Fanout neither retries nor spools
+// them, and only the retries of the sink itself, such as Webhook.Retries, apply.
+type Batcher struct {
+	sink     Sink
+	size     int
+	interval time.Duration
+	logger   *slog.Logger
+
+	in     chan tunnel.Message
+	done   chan struct{}
+	closed sync.Once
+
+	pending  atomic.Int64
+	batches  uint64
+	messages uint64
+	failed   uint64
+}
+
+// NewBatcher returns a Batcher delivering batches of at most size messages to s, every interval
+// at the latest. They default to DefaultBatchSize and DefaultBatchInterval, and errors are logged
+// to logger, or slog.Default() if it is nil.
+func NewBatcher(s Sink, size int, interval time.Duration, logger *slog.Logger) *Batcher {
+	if size == 0 {
+		size = DefaultBatchSize
+	}
+	if interval == 0 {
+		interval = DefaultBatchInterval
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	b := &Batcher{sink: s, size: size, interval: interval, logger: logger, in: make(chan tunnel.Message, size), done: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+// Deliver adds msg to the current batch. It blocks while a full batch is being delivered, and
+// returns ctx's error if ctx is done first. Deliver must not be called after Close.
+func (b *Batcher) Deliver(ctx context.Context, msg tunnel.Message) error {
+	select {
+	case b.in <- msg:
+		b.pending.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run collects batches and delivers them until the Batcher is closed, and then delivers the
+// last one.
+func (b *Batcher) run() {
+	defer close(b.done)
+	var batch []tunnel.Message
+	timer := time.NewTimer(b.interval)
+	timer.Stop()
+	for {
+		select {
+		case msg, ok := <-b.in:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				timer.Reset(b.interval)
+			}
+			if len(batch) < b.size {
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+		b.flush(batch)
+		batch = nil
+	}
+}
+
+// flush delivers batch, if it isn't empty.
+func (b *Batcher) flush(batch []tunnel.Message) {
+	if len(batch) == 0 {
+		return
+	}
+	defer b.pending.Add(-int64(len(batch)))
+	atomic.AddUint64(&b.batches, 1)
+	atomic.AddUint64(&b.messages, uint64(len(batch)))
+	ctx := context.Background()
+	if bs, ok := b.sink.(BatchSink); ok {
+		if err := bs.DeliverBatch(ctx, batch); err != nil {
+			atomic.AddUint64(&b.failed, uint64(len(batch)))
+			b.logger.Warn("Failed to deliver batch", "messages", len(batch), "first", batch[0].ID, "error", err)
+		}
+		return
+	}
+	for _, msg := range batch {
+		if err := b.sink.Deliver(ctx, msg); err != nil {
+			atomic.AddUint64(&b.failed, 1)
+			b.logger.Warn("Failed to deliver message", "id", msg.ID, "error", err)
+		}
+	}
+}
+
+// Close delivers the current batch, then closes the sink if it implements io.Closer.
+func (b *Batcher) Close() error {
+	b.closed.Do(func() {
+		close(b.in)
+		<-b.done
+	})
+	if c, ok := b.sink.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Collect implements metrics.Collector.
+func (b *Batcher) Collect() []metrics.Metric {
+	return []metrics.Metric{
+		{Name: "browsertunnel_sink_batches_total", Help: "Batches of messages delivered by a sink.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&b.batches))},
+		{Name: "browsertunnel_sink_batched_messages_total", Help: "Messages delivered by a sink in batches.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&b.messages))},
+		{Name: "browsertunnel_sink_batch_errors_total", Help: "Messages of the batches a sink failed to deliver.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&b.failed))},
+		{Name: "browsertunnel_sink_batch_pending", Help: "Messages waiting for their batch to be delivered by a sink.", Type: metrics.Gauge, Value: float64(b.pending.Load())},
+	}
+}
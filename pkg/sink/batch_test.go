@@ -0,0 +1,163 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// batchRecorder is a BatchSink that records the IDs of each batch it delivers, failing batches
+// containing IDs in fail.
+type batchRecorder struct {
+	recorder
+	batches [][]string
+}
+
+func (r *batchRecorder) DeliverBatch(ctx context.Context, msgs []tunnel.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []string
+	for _, msg := range msgs {
+		if r.fail[msg.ID] {
+			return fmt.Errorf("failed to deliver %s", msg.ID)
+		}
+		ids = append(ids, msg.ID)
+	}
+	r.batches = append(r.batches, ids)
+	return nil
+}
+
+func (r *batchRecorder) delivered() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.batches...)
+}
+
+func deliverIDs(t *testing.T, s Sink, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		require.Nil(t, s.Deliver(context.Background(), tunnel.Message{ID: id}))
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	r := &batchRecorder{recorder: recorder{fail: map[string]bool{"m6": true}}}
+	b := NewBatcher(r, 2, time.Hour, nil)
+
+	// Full batches are delivered at once.
+	deliverIDs(t, b, "m1", "m2", "m3", "m4")
+	require.Eventually(t, func() bool { return len(r.delivered()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, [][]string{{"m1", "m2"}, {"m3", "m4"}}, r.delivered())
+
+	// The incomplete batch is delivered when the Batcher is closed.
+	deliverIDs(t, b, "m5")
+	require.Nil(t, b.Close())
+	require.Equal(t, [][]string{{"m1", "m2"}, {"m3", "m4"}, {"m5"}}, r.delivered())
+	require.True(t, r.closed)
+
+	values := map[string]float64{}
+	for _, m := range b.Collect() {
+		values[m.Name] = m.Value
+	}
+	require.Equal(t, map[string]float64{
+		"browsertunnel_sink_batches_total":          3,
+		"browsertunnel_sink_batched_messages_total": 5,
+		"browsertunnel_sink_batch_errors_total":     0,
+		"browsertunnel_sink_batch_pending":          0,
+	}, values)
+}
+
+func TestBatcherInterval(t *testing.T) {
+	r := &batchRecorder{recorder: recorder{fail: map[string]bool{"m2": true}}}
+	b := NewBatcher(r, 100, 10*time.Millisecond, nil)
+	defer b.Close()
+
+	// Incomplete batches are delivered once the interval passed since their first message.
+	deliverIDs(t, b, "m1")
+	require.Eventually(t, func() bool { return len(r.delivered()) == 1 }, time.Second, time.Millisecond)
+	deliverIDs(t, b, "m2", "m3")
+	require.Eventually(t, func() bool { return b.Collect()[2].Value == 2 }, time.Second, time.Millisecond)
+	deliverIDs(t, b, "m4")
+	require.Eventually(t, func() bool { return len(r.delivered()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, [][]string{{"m1"}, {"m4"}}, r.delivered())
+}
+
+func TestBatcherFallback(t *testing.T) {
+	// Sinks that can't deliver batches receive their messages one at a time.
+	r := &recorder{fail: map[string]bool{"m2": true}}
+	b := NewBatcher(r, 3, time.Hour, nil)
+	deliverIDs(t, b, "m1", "m2", "m3")
+	require.Nil(t, b.Close())
+	require.Equal(t, []string{"m1", "m3"}, r.ids)
+	require.Equal(t, float64(1), b.Collect()[2].Value)
+}
+
+func TestFanoutBatcher(t *testing.T) {
+	b := NewBatcher(&batchRecorder{}, 0, 0, nil)
+	f := NewFanout(nil, Named{Name: "batched", Sink: b})
+	deliverIDs(t, f, "m1")
+	require.Nil(t, f.Close())
+
+	found := false
+	for _, m := range f.Collect() {
+		if m.Name == "browsertunnel_sink_batched_messages_total" {
+			require.Equal(t, map[string]string{"sink": "batched"}, m.Labels)
+			require.Equal(t, float64(1), m.Value)
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestWebhookBatch(t *testing.T) {
+	var mu sync.Mutex
+	var requests [][]map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		var got []map[string]interface{}
+		require.Nil(t, json.Unmarshal(body, &got))
+		mu.Lock()
+		requests = append(requests, got)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	second := testMessage
+	second.ID = "i42ftq"
+	wh := &Webhook{URL: srv.URL}
+	require.Nil(t, wh.DeliverBatch(context.Background(), []tunnel.Message{testMessage, second}))
+	require.Len(t, requests, 1)
+	require.Len(t, requests[0], 2)
+	require.Equal(t, "2jkhm3", requests[0][0]["id"])
+	require.Equal(t, "i42ftq", requests[0][1]["id"])
+	require.Equal(t, "hello world", requests[0][1]["payload"])
+}
+
+func TestWebhookBatchRaw(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ids = append(ids, r.Header.Get("Browsertunnel-Id"))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	// Raw payloads are POSTed one per request.
+	second := testMessage
+	second.ID = "i42ftq"
+	wh := &Webhook{URL: srv.URL, Raw: true}
+	require.Nil(t, wh.DeliverBatch(context.Background(), []tunnel.Message{testMessage, second}))
+	require.Equal(t, []string{"2jkhm3", "i42ftq"}, ids)
+}
@@ -0,0 +1,159 @@
+package sink
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBreakerCooldown is the default value of BreakerPolicy.Cooldown.
+const DefaultBreakerCooldown = 30 * time.Second
+
+// ErrBreakerOpen is the error of the deliveries to a sink that a Fanout doesn't attempt while the
+// circuit breaker of the sink is open.
+var ErrBreakerOpen = errors.New("Circuit breaker of the sink is open")
+
+// A BreakerPolicy makes a Fanout stop delivering to a sink that keeps failing for a while, so that
+// messages fail at once instead of waiting on the sink, e.g. a webhook that times out, and its
+// queue doesn't fill up and hold up the other sinks. Once Failures deliveries in a row failed, the
+// breaker opens and deliveries fail with ErrBreakerOpen for Cooldown. The next delivery is then
+// attempted: the breaker closes if it succeeds, and opens again for Cooldown if it fails. Sinks
+// with a RetryPolicy keep their messages in the retry queue while the breaker is open, without
+// counting attempts.
+type BreakerPolicy struct {
+	// Failures is the number of failed deliveries in a row that open the breaker. The breaker is
+	// disabled if it is 0.
+	Failures int
+	// Cooldown is how long the breaker stays open, DefaultBreakerCooldown if 0.
+	Cooldown time.Duration
+}
+
+// Breaker states, as reported by SinkStatus.Breaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// A breaker is the circuit breaker of a sink of a Fanout. It is only updated by the goroutine of
+// the sink, but read by Collect and Status.
+type breaker struct {
+	policy BreakerPolicy
+	mu     sync.Mutex
+	// failures counts the deliveries that failed in a row.
+	failures int
+	// openUntil is when the breaker lets a delivery through again after it opened, or zero while
+	// it is closed.
+	openUntil time.Time
+	// trips counts the times the breaker opened, and rejected the deliveries failed while open.
+	trips    uint64
+	rejected uint64
+}
+
+// wait returns how long the breaker stays open, or 0 if a delivery may be attempted now.
+func (b *breaker) wait(now time.Time) time.Duration {
+	if b.policy.Failures <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() || !now.Before(b.openUntil) {
+		return 0
+	}
+	return b.openUntil.Sub(now)
+}
+
+// allow returns ErrBreakerOpen, and counts the delivery as rejected, if the breaker is open.
+func (b *breaker) allow(now time.Time) error {
+	if b.wait(now) > 0 {
+		atomic.AddUint64(&b.rejected, 1)
+		return ErrBreakerOpen
+	}
+	return nil
+}
+
+// record records the outcome of a delivery, and reports whether its failure opened the breaker.
+func (b *breaker) record(err error, now time.Time) bool {
+	if b.policy.Failures <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return false
+	}
+	b.failures++
+	// A failed delivery after the cooldown opens the breaker again at once.
+	if !b.openUntil.IsZero() || b.failures >= b.policy.Failures {
+		b.openUntil = now.Add(b.policy.Cooldown)
+		atomic.AddUint64(&b.trips, 1)
+		return true
+	}
+	return false
+}
+
+// state returns the state of the breaker, and until when it is open.
+func (b *breaker) state(now time.Time) (string, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return BreakerClosed, time.Time{}
+	case now.Before(b.openUntil):
+		return BreakerOpen, b.openUntil
+	default:
+		return BreakerHalfOpen, b.openUntil
+	}
+}
+
+// SinkStatus describes the deliveries to a sink of a Fanout.
+type SinkStatus struct {
+	Name string
+	// Delivered and Failed count the messages delivered and those that failed, and Queued the
+	// messages waiting in the queue and the retry queue of the sink.
+	Delivered uint64
+	Failed    uint64
+	Queued    int
+	// Timeout bounds each delivery, if set, and Timeouts counts the deliveries that ran out of
+	// time.
+	Timeout  time.Duration
+	Timeouts uint64
+	// Breaker is the state of the circuit breaker of the sink, or empty if it has none, and
+	// OpenUntil when it lets a delivery through again if it is open. Trips counts the times it
+	// opened, and Rejected the deliveries that failed because it was open.
+	Breaker   string
+	OpenUntil time.Time
+	Trips     uint64
+	Rejected  uint64
+	// LastError is the error of the most recent delivery, if it failed.
+	LastError error
+}
+
+// Status returns the status of every sink of f, in the order they were given to NewFanout.
+func (f *Fanout) Status() []SinkStatus {
+	now := time.Now()
+	statuses := make([]SinkStatus, 0, len(f.outputs))
+	for _, out := range f.outputs {
+		s := SinkStatus{
+			Name:      out.Name,
+			Delivered: atomic.LoadUint64(&out.delivered),
+			Failed:    atomic.LoadUint64(&out.failed),
+			Queued:    len(out.queue) + int(out.queued.Load()),
+			Timeout:   f.timeoutOf(out),
+			Timeouts:  atomic.LoadUint64(&out.timeouts),
+		}
+		if out.Breaker.Failures > 0 {
+			s.Breaker, s.OpenUntil = out.breaker.state(now)
+			s.Trips = atomic.LoadUint64(&out.breaker.trips)
+			s.Rejected = atomic.LoadUint64(&out.breaker.rejected)
+		}
+		if err := out.lastErr.Load(); err != nil {
+			s.LastError = *err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestFanoutTimeout(t *testing.T) {
+	r := &recorder{}
+	f := NewFanout(nil,
+		Named{Name: "hanging", Sink: &hanger{}},
+		Named{Name: "own", Sink: &hanger{}, Timeout: 5 * time.Millisecond},
+		Named{Name: "r", Sink: r},
+	)
+	f.SetTimeout(10 * time.Millisecond)
+
+	// Both hanging sinks give up on the delivery instead of holding up their queue.
+	for _, name := range []string{"hanging", "own"} {
+		err := f.Replay(context.Background(), name, tunnel.Message{ID: "m1"})
+		require.ErrorIs(t, err, context.DeadlineExceeded, name)
+	}
+	require.Nil(t, f.Replay(context.Background(), "r", tunnel.Message{ID: "m1"}))
+	require.Nil(t, f.Close())
+
+	timeouts := map[string]float64{}
+	for _, m := range f.Collect() {
+		if m.Name == "browsertunnel_sink_timeouts_total" {
+			timeouts[m.Labels["sink"]] = m.Value
+		}
+	}
+	require.Equal(t, map[string]float64{"hanging": 1, "own": 1, "r": 0}, timeouts)
+	status := f.Status()
+	require.Equal(t, 10*time.Millisecond, status[0].Timeout)
+	require.Equal(t, 5*time.Millisecond, status[1].Timeout)
+	require.Equal(t, uint64(1), status[2].Delivered)
+}
+
+func TestFanoutBreaker(t *testing.T) {
+	s := &flaky{failures: map[string]int{"m1": -1, "m2": -1, "m4": 1}}
+	f := NewFanout(nil, Named{Name: "s", Sink: s, Breaker: BreakerPolicy{Failures: 2, Cooldown: 50 * time.Millisecond}})
+	defer f.Close()
+
+	// Two failures in a row open the breaker, which then fails deliveries without calling the
+	// sink.
+	require.NotNil(t, f.Replay(context.Background(), "s", tunnel.Message{ID: "m1"}))
+	require.Equal(t, BreakerClosed, f.Status()[0].Breaker)
+	require.NotNil(t, f.Replay(context.Background(), "s", tunnel.Message{ID: "m2"}))
+	require.Equal(t, ErrBreakerOpen, f.Replay(context.Background(), "s", tunnel.Message{ID: "m3"}))
+	require.Empty(t, s.ids())
+
+	status := f.Status()[0]
+	require.Equal(t, BreakerOpen, status.Breaker)
+	require.False(t, status.OpenUntil.IsZero())
+	require.Equal(t, uint64(1), status.Trips)
+	require.Equal(t, uint64(1), status.Rejected)
+	require.EqualError(t, status.LastError, "failed to deliver m2")
+
+	// After the cooldown, a failed delivery opens it again at once, and a successful one closes it.
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, BreakerHalfOpen, f.Status()[0].Breaker)
+	require.NotNil(t, f.Replay(context.Background(), "s", tunnel.Message{ID: "m4"}))
+	require.Equal(t, ErrBreakerOpen, f.Replay(context.Background(), "s", tunnel.Message{ID: "m4"}))
+	time.Sleep(60 * time.Millisecond)
+	require.Nil(t, f.Replay(context.Background(), "s", tunnel.Message{ID: "m4"}))
+	require.Equal(t, []string{"m4"}, s.ids())
+
+	values := map[string]float64{}
+	for _, m := range f.Collect() {
+		values[m.Name] = m.Value
+	}
+	require.Equal(t, float64(0), values["browsertunnel_sink_breaker_open"])
+	require.Equal(t, float64(2), values["browsertunnel_sink_breaker_trips_total"])
+	require.Equal(t, float64(2), values["browsertunnel_sink_breaker_rejected_total"])
+	require.Equal(t, BreakerClosed, f.Status()[0].Breaker)
+}
+
+func TestFanoutBreakerRetry(t *testing.T) {
+	s := &flaky{failures: map[string]int{"m1": 2}}
+	f := NewFanout(nil, Named{
+		Name:    "s",
+		Sink:    s,
+		Retry:   RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+		Breaker: BreakerPolicy{Failures: 1, Cooldown: 20 * time.Millisecond},
+	})
+
+	// Messages wait in the retry queue while the breaker is open, without using up their
+	// attempts.
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m1"}))
+	require.Eventually(t, func() bool { return f.Status()[0].Breaker == BreakerOpen }, time.Second, time.Millisecond)
+	require.Equal(t, ErrBreakerOpen, f.Replay(context.Background(), "s", tunnel.Message{ID: "m2"}))
+	require.Eventually(t, func() bool { return len(s.ids()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, []string{"m1", "m2"}, s.ids())
+	require.Nil(t, f.Close())
+
+	status := f.Status()[0]
+	require.Equal(t, uint64(2), status.Trips)
+	require.Equal(t, uint64(0), status.Rejected)
+	require.Equal(t, uint64(0), status.Failed)
+}
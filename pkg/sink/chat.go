@@ -0,0 +1,259 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// Formats of the incoming webhooks of chat services.
+const (
+	ChatSlack   = "slack"
+	ChatDiscord = "discord"
+)
+
+// Defaults of a ChatConfig.
+const (
+	// DefaultChatTemplate summarizes a message on a single line.
+	DefaultChatTemplate = "Message {{.ID}} from {{.Source}} ({{.Fragments}} fragments): {{.Payload}}"
+	// DefaultChatRate is the number of messages posted per minute by default, which stays well
+	// below the limits of Slack and Discord.
+	DefaultChatRate = 20
+	// DefaultChatBurst is the number of messages posted at once by default.
+	DefaultChatBurst = 5
+)
+
+// chatMaxLen is the length in characters that posts are cut to: the limit of Discord, and the
+// length after which Slack truncates messages.
+var chatMaxLen = map[string]int{ChatSlack: 4000, ChatDiscord: 2000}
+
+// slackEscaper escapes the characters that Slack interprets as mentions and links.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// ChatConfig configures a Chat.
+type ChatConfig struct {
+	// URL is the incoming webhook of a Slack or Discord channel.
+	URL string
+	// Format is ChatSlack or ChatDiscord. It is detected from the host of URL if empty.
+	Format string
+	// Template is a text/template for the text posted for each message. It is executed with a
+	// ChatData. DefaultChatTemplate is used if empty.
+	Template string
+	// Rate is the number of messages posted per minute, in bursts of up to Burst messages.
+	// Messages beyond them are suppressed, and counted in the next post. They default to
+	// DefaultChatRate and DefaultChatBurst.
+	Rate  float64
+	Burst int
+	// Client is used to make requests. http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+// ChatData is the data a chat template is executed with. Payload is encoded in base64 for binary
+// messages, and for Slack, every field is escaped so that messages can't mention users or
+// channels.
+type ChatData struct {
+	ID        string
+	Payload   string
+	Binary    bool
+	Source    string
+	QueryType string
+	Domain    string
+	Tenant    string
+	Fragments int
+	Tags      map[string]string
+}
+
+// A Chat posts a summary of each message to the incoming webhook of a Slack or Discord channel,
+// for detection use cases with few messages. Posts are rate limited to stay clear of the limits
+// of the services, and are paused for as long as a service asks when it answers 429 Too Many
+// Requests.
+type Chat struct {
+	cfg  ChatConfig
+	text *template.Template
+	now  func() time.Time
+
+	mu          sync.Mutex
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	// suppressed counts the messages suppressed since the last post.
+	suppressed int
+
+	posted          uint64
+	suppressedTotal uint64
+}
+
+// NewChat returns a Chat posting to the webhook described by cfg.
+func NewChat(cfg ChatConfig) (*Chat, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("Chat sink requires a webhook URL")
+	}
+	if cfg.Format == "" {
+		switch {
+		case strings.Contains(cfg.URL, "://hooks.slack.com/"):
+			cfg.Format = ChatSlack
+		case strings.Contains(cfg.URL, "://discord.com/"), strings.Contains(cfg.URL, "://discordapp.com/"):
+			cfg.Format = ChatDiscord
+		default:
+			return nil, fmt.Errorf("Can't tell whether %s is a Slack or Discord webhook", cfg.URL)
+		}
+	}
+	if _, ok := chatMaxLen[cfg.Format]; !ok {
+		return nil, fmt.Errorf("Unknown chat format %q", cfg.Format)
+	}
+	if cfg.Template == "" {
+		cfg.Template = DefaultChatTemplate
+	}
+	if cfg.Rate == 0 {
+		cfg.Rate = DefaultChatRate
+	}
+	if cfg.Burst == 0 {
+		cfg.Burst = DefaultChatBurst
+	}
+	if cfg.Rate < 0 || cfg.Burst < 0 {
+		return nil, fmt.Errorf("Chat sink declares negative rate %g or burst %d", cfg.Rate, cfg.Burst)
+	}
+	text, err := template.New("chat").Option("missingkey=error").Parse(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &Chat{cfg: cfg, text: text, now: time.Now, tokens: float64(cfg.Burst)}, nil
+}
+
+// Deliver posts a summary of msg, unless the rate limit is exceeded, in which case msg is
+// suppressed and nil is returned.
+func (c *Chat) Deliver(ctx context.Context, msg tunnel.Message) error {
+	text, err := c.textFor(msg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.allow(c.now()) {
+		c.suppressed++
+		atomic.AddUint64(&c.suppressedTotal, 1)
+		return nil
+	}
+	if c.suppressed > 0 {
+		text = fmt.Sprintf("%s\n(%d more messages were suppressed by rate limiting)", text, c.suppressed)
+	}
+	if err := c.post(ctx, text); err != nil {
+		return err
+	}
+	c.suppressed = 0
+	atomic.AddUint64(&c.posted, 1)
+	return nil
+}
+
+// allow takes a token from the bucket, and reports whether one was available and posts aren't
+// paused. The lock of c must be held.
+func (c *Chat) allow(now time.Time) bool {
+	if !c.last.IsZero() {
+		c.tokens = min(c.tokens+now.Sub(c.last).Minutes()*c.cfg.Rate, float64(c.cfg.Burst))
+	}
+	c.last = now
+	if now.Before(c.pausedUntil) || c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+func (c *Chat) textFor(msg tunnel.Message) (string, error) {
+	escape := func(s string) string { return s }
+	if c.cfg.Format == ChatSlack {
+		escape = slackEscaper.Replace
+	}
+	data := ChatData{
+		ID:        escape(msg.ID),
+		Payload:   escape(string(msg.Payload)),
+		Binary:    msg.Binary,
+		QueryType: dns.TypeToString[msg.QueryType],
+		Domain:    escape(msg.Domain),
+		Tenant:    escape(msg.Tenant),
+		Fragments: msg.Fragments,
+		Tags:      make(map[string]string, len(msg.Tags)),
+	}
+	if msg.Binary || !utf8.Valid(msg.Payload) {
+		data.Payload = base64.StdEncoding.EncodeToString(msg.Payload)
+		data.Binary = true
+	}
+	if msg.Source != nil {
+		data.Source = msg.Source.String()
+	}
+	for k, v := range msg.Tags {
+		data.Tags[escape(k)] = escape(v)
+	}
+	var buf strings.Builder
+	if err := c.text.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	text := buf.String()
+	if n := chatMaxLen[c.cfg.Format]; utf8.RuneCountInString(text) > n {
+		text = string([]rune(text)[:n-1]) + "…"
+	}
+	return text, nil
+}
+
+// post makes a single request posting text. Mentions are disabled on Discord, since messages
+// are sent by untrusted clients.
+func (c *Chat) post(ctx context.Context, text string) error {
+	var body interface{} = map[string]string{"text": text}
+	if c.cfg.Format == ChatDiscord {
+		body = map[string]interface{}{"content": text, "allowed_mentions": map[string][]string{"parse": {}}}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := c.cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		pause := time.Minute
+		if s, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && s > 0 {
+			pause = time.Duration(s * float64(time.Second))
+		}
+		c.pausedUntil = c.now().Add(pause)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Chat webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Collect implements metrics.Collector.
+func (c *Chat) Collect() []metrics.Metric {
+	return []metrics.Metric{
+		{Name: "browsertunnel_sink_chat_posted_total", Help: "Messages posted to a chat webhook.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&c.posted))},
+		{Name: "browsertunnel_sink_chat_suppressed_total", Help: "Messages not posted to a chat webhook because of rate limiting.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&c.suppressedTotal))},
+	}
+}
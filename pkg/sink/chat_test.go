@@ -0,0 +1,132 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChat records the body of each post, and answers them with status.
+func fakeChat(t *testing.T, status int) (*httptest.Server, *[]map[string]interface{}) {
+	var posts []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		var post map[string]interface{}
+		require.Nil(t, json.Unmarshal(body, &post))
+		posts = append(posts, post)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(status)
+	}))
+	return srv, &posts
+}
+
+func TestChat(t *testing.T) {
+	msg := testMessage
+	msg.Payload = []byte("<!channel> @everyone")
+	tests := []struct {
+		format string
+		post   map[string]interface{}
+	}{
+		{format: ChatSlack, post: map[string]interface{}{"text": "2jkhm3 from 192.0.2.1: &lt;!channel&gt; @everyone"}},
+		{format: ChatDiscord, post: map[string]interface{}{
+			"content":          "2jkhm3 from 192.0.2.1: <!channel> @everyone",
+			"allowed_mentions": map[string]interface{}{"parse": []interface{}{}},
+		}},
+	}
+	for _, test := range tests {
+		srv, posts := fakeChat(t, http.StatusNoContent)
+		c, err := NewChat(ChatConfig{URL: srv.URL, Format: test.format, Template: "{{.ID}} from {{.Source}}: {{.Payload}}"})
+		require.Nil(t, err)
+		require.Nil(t, c.Deliver(context.Background(), msg))
+		require.Equal(t, []map[string]interface{}{test.post}, *posts, test.format)
+		srv.Close()
+	}
+}
+
+func TestChatRateLimit(t *testing.T) {
+	srv, posts := fakeChat(t, http.StatusOK)
+	defer srv.Close()
+	c, err := NewChat(ChatConfig{URL: srv.URL, Format: ChatSlack, Template: "{{.ID}}", Rate: 1, Burst: 2})
+	require.Nil(t, err)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	for _, id := range []string{"m1", "m2", "m3", "m4"} {
+		msg := testMessage
+		msg.ID = id
+		require.Nil(t, c.Deliver(context.Background(), msg))
+	}
+	// A token is refilled every minute, and suppressed messages are counted in the next post.
+	now = now.Add(time.Minute)
+	msg := testMessage
+	msg.ID = "m5"
+	require.Nil(t, c.Deliver(context.Background(), msg))
+
+	var texts []string
+	for _, post := range *posts {
+		texts = append(texts, post["text"].(string))
+	}
+	require.Equal(t, []string{"m1", "m2", "m5\n(2 more messages were suppressed by rate limiting)"}, texts)
+	require.Equal(t, float64(3), c.Collect()[0].Value)
+	require.Equal(t, float64(2), c.Collect()[1].Value)
+}
+
+func TestChatTooManyRequests(t *testing.T) {
+	srv, posts := fakeChat(t, http.StatusTooManyRequests)
+	defer srv.Close()
+	c, err := NewChat(ChatConfig{URL: srv.URL, Format: ChatDiscord})
+	require.Nil(t, err)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	// Posts are paused for as long as the service asks.
+	require.NotNil(t, c.Deliver(context.Background(), testMessage))
+	require.Nil(t, c.Deliver(context.Background(), testMessage))
+	now = now.Add(31 * time.Second)
+	require.NotNil(t, c.Deliver(context.Background(), testMessage))
+	require.Len(t, *posts, 2)
+}
+
+func TestChatTruncates(t *testing.T) {
+	srv, posts := fakeChat(t, http.StatusOK)
+	defer srv.Close()
+	msg := testMessage
+	msg.Payload = []byte(strings.Repeat("é", 3000))
+	c, err := NewChat(ChatConfig{URL: srv.URL, Format: ChatDiscord, Template: "{{.Payload}}"})
+	require.Nil(t, err)
+	require.Nil(t, c.Deliver(context.Background(), msg))
+	require.Equal(t, strings.Repeat("é", 1999)+"…", (*posts)[0]["content"])
+}
+
+func TestNewChat(t *testing.T) {
+	tests := []struct {
+		cfg    ChatConfig
+		format string
+	}{
+		{cfg: ChatConfig{URL: "https://hooks.slack.com/services/T0/B0/x"}, format: ChatSlack},
+		{cfg: ChatConfig{URL: "https://discord.com/api/webhooks/1/x"}, format: ChatDiscord},
+		{cfg: ChatConfig{URL: "https://chat.example.com/hook", Format: ChatSlack}, format: ChatSlack},
+		{cfg: ChatConfig{URL: "https://chat.example.com/hook"}},
+		{cfg: ChatConfig{URL: "https://chat.example.com/hook", Format: "teams"}},
+		{cfg: ChatConfig{URL: "https://hooks.slack.com/services/T0/B0/x", Template: "{{.ID"}},
+		{cfg: ChatConfig{URL: "https://hooks.slack.com/services/T0/B0/x", Rate: -1}},
+		{cfg: ChatConfig{}},
+	}
+	for _, test := range tests {
+		c, err := NewChat(test.cfg)
+		if test.format == "" {
+			require.NotNil(t, err, test.cfg)
+			continue
+		}
+		require.Nil(t, err, test.cfg)
+		require.Equal(t, test.format, c.cfg.Format)
+	}
+}
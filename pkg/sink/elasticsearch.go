@@ -0,0 +1,173 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// ElasticsearchConfig configures an Elasticsearch.
+type ElasticsearchConfig struct {
+	// URL is the address of the cluster, e.g. http://localhost:9200.
+	URL string
+	// Index is the index, alias or data stream messages are indexed into.
+	Index string
+	// APIKey, or Username and Password, authenticate with the cluster if not empty. APIKey is the
+	// base64 encoded id:key of the key, as shown by Kibana.
+	APIKey   string
+	Username string
+	Password string
+	// Client is used to make requests. http.DefaultClient is used if nil.
+	Client *http.Client
+	// Retries and Backoff control how failed requests, and documents rejected because the cluster
+	// is overloaded, are retried, like those of a Webhook.
+	Retries int
+	Backoff time.Duration
+}
+
+// An Elasticsearch indexes each message into an index of an Elasticsearch or OpenSearch cluster
+// through the bulk API, so that messages are searchable in Kibana or OpenSearch Dashboards as
+// soon as they arrive. Documents are the JSON encoding of Marshal, with the time of the last
+// fragment added as @timestamp, and are created with IDs chosen by the cluster since message IDs
+// may be reused.
+type Elasticsearch struct {
+	cfg ElasticsearchConfig
+	url string
+}
+
+// NewElasticsearch returns an Elasticsearch indexing into the cluster described by cfg.
+func NewElasticsearch(cfg ElasticsearchConfig) (*Elasticsearch, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Elasticsearch URL %q must be an http or https URL", cfg.URL)
+	}
+	if cfg.Index == "" || cfg.Index == "." || cfg.Index == ".." || cfg.Index != strings.ToLower(cfg.Index) ||
+		strings.ContainsAny(cfg.Index, `\/*?"<>| ,#:`) || strings.ContainsAny(cfg.Index[:1], "-_+") {
+		return nil, fmt.Errorf("Invalid Elasticsearch index %q", cfg.Index)
+	}
+	return &Elasticsearch{cfg: cfg, url: strings.TrimSuffix(cfg.URL, "/") + "/_bulk"}, nil
+}
+
+// Deliver indexes msg, returning once the cluster has accepted it.
+func (es *Elasticsearch) Deliver(ctx context.Context, msg tunnel.Message) error {
+	return es.DeliverBatch(ctx, []tunnel.Message{msg})
+}
+
+// DeliverBatch indexes msgs with a single bulk request. Documents rejected with 429 Too Many
+// Requests or a server error are retried with exponential backoff, while other rejections are
+// returned once the rest of msgs have been indexed.
+func (es *Elasticsearch) DeliverBatch(ctx context.Context, msgs []tunnel.Message) error {
+	action, err := json.Marshal(map[string]interface{}{"create": map[string]string{"_index": es.cfg.Index}})
+	if err != nil {
+		return err
+	}
+	docs := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		doc, err := Marshal(msg)
+		if err != nil {
+			return err
+		}
+		timestamp, err := json.Marshal(msg.LastFragment)
+		if err != nil {
+			return err
+		}
+		line := append(append([]byte(nil), action...), '\n')
+		line = append(append(append(line, `{"@timestamp":`...), timestamp...), ',')
+		docs[i] = append(append(line, doc[1:]...), '\n')
+	}
+
+	var rejected error
+	err = withRetries(ctx, es.cfg.Retries, es.cfg.Backoff, func() (bool, error) {
+		var retry bool
+		docs, retry, err = es.bulk(ctx, docs, &rejected)
+		return retry, err
+	})
+	return errors.Join(err, rejected)
+}
+
+// bulkResponse is the part of a response of the bulk API that tells which documents failed.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk makes a single bulk request creating docs, which are each an action and a document. It
+// returns the documents worth retrying and whether to retry them, and joins the error of
+// documents that were rejected for good to rejected.
+func (es *Elasticsearch) bulk(ctx context.Context, docs [][]byte, rejected *error) ([][]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, es.url, bytes.NewReader(bytes.Join(docs, nil)))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if es.cfg.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+es.cfg.APIKey)
+	} else if es.cfg.Username != "" {
+		req.SetBasicAuth(es.cfg.Username, es.cfg.Password)
+	}
+
+	client := es.cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return docs, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return docs, retry, fmt.Errorf("Elasticsearch responded with %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, false, fmt.Errorf("Invalid response from Elasticsearch: %w", err)
+	}
+	if !result.Errors {
+		return nil, false, nil
+	}
+	if len(result.Items) != len(docs) {
+		return nil, false, fmt.Errorf("Elasticsearch answered %d documents with %d results", len(docs), len(result.Items))
+	}
+
+	var remaining [][]byte
+	var retryReason, rejectReason json.RawMessage
+	nRejected := 0
+	for i, item := range result.Items {
+		for _, r := range item {
+			switch {
+			case r.Status >= 200 && r.Status < 300:
+			case r.Status >= 500 || r.Status == http.StatusTooManyRequests:
+				remaining = append(remaining, docs[i])
+				retryReason = r.Error
+			default:
+				nRejected++
+				rejectReason = r.Error
+			}
+		}
+	}
+	if nRejected > 0 {
+		*rejected = errors.Join(*rejected, fmt.Errorf("Elasticsearch rejected %d documents: %s", nRejected, rejectReason))
+	}
+	if len(remaining) > 0 {
+		return remaining, true, fmt.Errorf("Elasticsearch failed to index %d documents: %s", len(remaining), retryReason)
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,111 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// fakeElasticsearch records the documents of each bulk request, and answers the nth document of
+// each request with the nth status of statuses, or 201 Created.
+func fakeElasticsearch(t *testing.T, statuses ...[]int) (*httptest.Server, *[][]map[string]interface{}) {
+	var requests [][]map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/_bulk", r.URL.Path)
+		require.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		require.Equal(t, "ApiKey a2V5", r.Header.Get("Authorization"))
+		var docs []map[string]interface{}
+		lines := bufio.NewScanner(r.Body)
+		for lines.Scan() {
+			require.JSONEq(t, `{"create":{"_index":"messages"}}`, lines.Text())
+			require.True(t, lines.Scan())
+			var doc map[string]interface{}
+			require.Nil(t, json.Unmarshal(lines.Bytes(), &doc))
+			docs = append(docs, doc)
+		}
+		var items []string
+		failed := false
+		for i := range docs {
+			status := http.StatusCreated
+			if len(requests) < len(statuses) && i < len(statuses[len(requests)]) {
+				status = statuses[len(requests)][i]
+			}
+			failed = failed || status >= 300
+			items = append(items, fmt.Sprintf(`{"create":{"status":%d,"error":{"type":"error_%d"}}}`, status, status))
+		}
+		requests = append(requests, docs)
+		fmt.Fprintf(w, `{"errors":%t,"items":[%s]}`, failed, strings.Join(items, ","))
+	}))
+	return srv, &requests
+}
+
+func TestElasticsearch(t *testing.T) {
+	srv, requests := fakeElasticsearch(t)
+	defer srv.Close()
+	es, err := NewElasticsearch(ElasticsearchConfig{URL: srv.URL + "/", Index: "messages", APIKey: "a2V5"})
+	require.Nil(t, err)
+
+	second := testMessage
+	second.ID = "i42ftq"
+	require.Nil(t, es.Deliver(context.Background(), testMessage))
+	require.Nil(t, es.DeliverBatch(context.Background(), []tunnel.Message{testMessage, second}))
+	require.Len(t, *requests, 2)
+	doc := (*requests)[0][0]
+	require.Equal(t, "2jkhm3", doc["id"])
+	require.Equal(t, "hello world", doc["payload"])
+	require.Equal(t, testMessage.LastFragment.Format(time.RFC3339Nano), doc["@timestamp"])
+	require.Equal(t, "i42ftq", (*requests)[1][1]["id"])
+}
+
+func TestElasticsearchPartialFailure(t *testing.T) {
+	srv, requests := fakeElasticsearch(t, []int{429, 400, 201}, []int{503})
+	defer srv.Close()
+	es, err := NewElasticsearch(ElasticsearchConfig{URL: srv.URL, Index: "messages", APIKey: "a2V5", Backoff: time.Millisecond})
+	require.Nil(t, err)
+
+	var msgs []tunnel.Message
+	for _, id := range []string{"m1", "m2", "m3"} {
+		msgs = append(msgs, tunnel.Message{ID: id})
+	}
+	// Only the documents rejected because the cluster is overloaded are retried, and the
+	// documents rejected for good are reported once they are.
+	err = es.DeliverBatch(context.Background(), msgs)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "rejected 1 documents")
+	require.Contains(t, err.Error(), "error_400")
+	require.Len(t, *requests, 3)
+	require.Len(t, (*requests)[1], 1)
+	require.Equal(t, "m1", (*requests)[2][0]["id"])
+}
+
+func TestNewElasticsearch(t *testing.T) {
+	tests := []struct {
+		cfg   ElasticsearchConfig
+		fails bool
+	}{
+		{cfg: ElasticsearchConfig{URL: "http://localhost:9200", Index: "browsertunnel"}},
+		{cfg: ElasticsearchConfig{URL: "https://es.example.com/prefix/", Index: "logs-browsertunnel-default"}},
+		{cfg: ElasticsearchConfig{URL: "localhost:9200", Index: "browsertunnel"}, fails: true},
+		{cfg: ElasticsearchConfig{URL: "http://localhost:9200"}, fails: true},
+		{cfg: ElasticsearchConfig{URL: "http://localhost:9200", Index: "Messages"}, fails: true},
+		{cfg: ElasticsearchConfig{URL: "http://localhost:9200", Index: "_messages"}, fails: true},
+		{cfg: ElasticsearchConfig{URL: "http://localhost:9200", Index: "a/b"}, fails: true},
+	}
+	for _, test := range tests {
+		_, err := NewElasticsearch(test.cfg)
+		if test.fails {
+			require.NotNil(t, err, test.cfg)
+		} else {
+			require.Nil(t, err, test.cfg)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/schema"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer returns the tracer of the browsertunnel.deliver span created for each delivery to a sink
+// of a Fanout, as a child of the span in Message.SpanContext.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/veggiedefender/browsertunnel/pkg/sink")
+}
+
+// fanoutQueueSize is the number of messages queued for each sink of a Fanout before Deliver
+// blocks.
+const fanoutQueueSize = 64
+
+// Named is a Sink with a name that identifies it in logs and metrics.
+type Named struct {
+	Name string
+	Sink Sink
+	// Tenant, if not empty, restricts the sink to messages sent to this tenant.
+	Tenant string
+	// Retry, if its Attempts are set, retries the deliveries that fail.
+	Retry RetryPolicy
+	// Sampling, if its Rate or Clients are set, delivers only a fraction of the messages to the
+	// sink.
+	Sampling Sampling
+	// Timeout, if set, bounds each attempt to deliver a message to the sink, overriding the
+	// timeout of Fanout.SetTimeout. The sink must give up on the delivery once its context is done.
+	Timeout time.Duration
+	// Breaker, if its Failures are set, stops delivering to the sink for a while once it keeps
+	// failing.
+	Breaker BreakerPolicy
+}
+
+// A Fanout is a Sink that delivers every message to several sinks in parallel, except those
+// restricted to another tenant or that its rules or schema route elsewhere. Each sink has its
+// own queue and goroutine, so that a slow or failing sink doesn't hold up the others. Delivery
+// errors are logged and counted per sink rather than returned, and the message is given up on
+// unless the sink has a RetryPolicy.
+type Fanout struct {
+	outputs []*output
+	logger  *slog.Logger
+	wg      sync.WaitGroup
+	// ctx is the parent of the contexts of deliveries, which cancel cancels when Shutdown gives up
+	// on them.
+	ctx    context.Context
+	cancel context.CancelFunc
+	rules  []*ruleState
+	// routed holds the names of the sinks named by rules.
+	routed map[string]bool
+	// schema, if not nil, validates messages, and those that fail are quarantined.
+	schema      *schema.Schema
+	quarantine  string
+	quarantined uint64
+	// timeout bounds the deliveries to the sinks without a Timeout, if set.
+	timeout time.Duration
+}
+
+type output struct {
+	Named
+	queue     chan delivery
+	delivered uint64
+	failed    uint64
+	// sampledOut counts the messages not delivered because of sampling.
+	sampledOut uint64
+	// retried counts the attempts to deliver a message from the retry queue, deadLettered the
+	// messages given up on after retries, and queued the messages in the retry queue.
+	retried      uint64
+	deadLettered uint64
+	queued       atomic.Int64
+	// timeouts counts the attempts that ran out of time.
+	timeouts uint64
+	breaker  breaker
+	// lastErr holds the error of the most recent delivery, or nil if it succeeded.
+	lastErr atomic.Pointer[error]
+}
+
+// NewFanout returns a Fanout delivering to sinks. Errors are logged to logger, or slog.Default()
+// if it is nil.
+func NewFanout(logger *slog.Logger, sinks ...Named) *Fanout {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	f := &Fanout{logger: logger}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	for _, s := range sinks {
+		out := &output{Named: s, queue: make(chan delivery, fanoutQueueSize)}
+		if out.Breaker.Failures > 0 && out.Breaker.Cooldown == 0 {
+			out.Breaker.Cooldown = DefaultBreakerCooldown
+		}
+		out.breaker.policy = out.Breaker
+		if out.Retry.Attempts > 1 {
+			if out.Retry.Backoff == 0 {
+				out.Retry.Backoff = DefaultRetryBackoff
+			}
+			if out.Retry.MaxBackoff == 0 {
+				out.Retry.MaxBackoff = DefaultRetryMaxBackoff
+			}
+			if out.Retry.Queue == nil {
+				out.Retry.Queue = &memoryQueue{}
+			}
+			if n, err := out.Retry.Queue.Len(); err != nil {
+				logger.Warn("Failed to read retry queue", "sink", s.Name, "error", err)
+			} else {
+				out.queued.Store(int64(n))
+			}
+		}
+		f.outputs = append(f.outputs, out)
+		f.wg.Add(1)
+		go f.run(out)
+	}
+	return f
+}
+
+// SetTimeout bounds each attempt to deliver a message to the sinks that have no Timeout of their
+// own, so that a sink that hangs fails instead of holding up its queue. It must be called before
+// messages are delivered.
+func (f *Fanout) SetTimeout(d time.Duration) {
+	f.timeout = d
+}
+
+// timeoutOf returns the timeout of the deliveries to out, or 0 if they have none.
+func (f *Fanout) timeoutOf(out *output) time.Duration {
+	if out.Timeout > 0 {
+		return out.Timeout
+	}
+	return f.timeout
+}
+
+// Deliver queues msg for every sink. It blocks while the queue of any sink is full, and returns
+// ctx's error if ctx is done first. Deliver must not be called after Close.
+func (f *Fanout) Deliver(ctx context.Context, msg tunnel.Message) error {
+	msg, sinks := f.route(msg)
+	for _, out := range f.outputs {
+		if !f.receives(out, msg, sinks) {
+			continue
+		}
+		msg, ok := out.sample(msg)
+		if !ok {
+			continue
+		}
+		select {
+		case out.queue <- delivery{msg: msg}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// A delivery is a message queued for a sink. If result is set, the error of the first attempt to
+// deliver the message is sent on it.
+type delivery struct {
+	msg    tunnel.Message
+	result chan<- error
+}
+
+// Down reports whether the most recent delivery of every sink failed.
+func (f *Fanout) Down() bool {
+	for _, out := range f.outputs {
+		if out.lastErr.Load() == nil {
+			return false
+		}
+	}
+	return len(f.outputs) > 0
+}
+
+// Probe delivers msg like Deliver, but waits for every sink to attempt it, and returns nil if any
+// of them delivered it, so that callers can tell whether the sinks that were Down recovered.
+// Otherwise, it returns the error of the first sink.
+func (f *Fanout) Probe(ctx context.Context, msg tunnel.Message) error {
+	results := make(chan error, len(f.outputs))
+	queued := 0
+	msg, sinks := f.route(msg)
+	for _, out := range f.outputs {
+		if !f.receives(out, msg, sinks) {
+			continue
+		}
+		msg, ok := out.sample(msg)
+		if !ok {
+			continue
+		}
+		select {
+		case out.queue <- delivery{msg: msg, result: results}:
+			queued++
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var firstErr error
+	for i := 0; i < queued; i++ {
+		select {
+		case err := <-results:
+			if err == nil {
+				return nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return firstErr
+}
+
+// Replay delivers msg to the sink of f named name only, e.g. to catch up after an outage of the
+// sink, and waits for the first attempt to deliver it. Rules, the schema and sampling don't apply
+// to replayed messages, but sinks restricted to a tenant only accept the messages of the tenant.
+// It returns the error of the attempt, or an error if f has no such sink.
+func (f *Fanout) Replay(ctx context.Context, name string, msg tunnel.Message) error {
+	for _, out := range f.outputs {
+		if out.Name != name {
+			continue
+		}
+		if out.Tenant != "" && out.Tenant != msg.Tenant {
+			return fmt.Errorf("Sink %s only receives messages of tenant %s", name, out.Tenant)
+		}
+		result := make(chan error, 1)
+		select {
+		case out.queue <- delivery{msg: msg, result: result}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case err := <-result:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fmt.Errorf("Sink %s is not enabled", name)
+}
+
+// Close waits for queued messages to be delivered, then closes every sink that implements
+// io.Closer. Messages waiting to be retried are given up on, unless their retry queue is
+// persistent. It returns the first error from closing a sink.
+func (f *Fanout) Close() error {
+	return f.Shutdown(context.Background())
+}
+
+// Shutdown closes f like Close, but only waits for queued messages to be delivered until ctx is
+// done. The deliveries in progress are then canceled, and the messages still queued fail, or are
+// retried and given up on like those waiting to be retried. If ctx is done first, Shutdown returns
+// its error once the sinks are closed, and the first error from closing a sink otherwise.
+func (f *Fanout) Shutdown(ctx context.Context) error {
+	defer f.cancel()
+	for _, out := range f.outputs {
+		close(out.queue)
+	}
+	drained := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(drained)
+	}()
+	var ctxErr error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+		f.cancel()
+		<-drained
+	}
+
+	var firstErr error
+	for _, out := range f.outputs {
+		if c, ok := out.Sink.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if ctxErr != nil {
+		return ctxErr
+	}
+	return firstErr
+}
+
+// Failing returns the error of each sink whose most recent delivery failed, keyed by name.
+func (f *Fanout) Failing() map[string]error {
+	failing := make(map[string]error)
+	for _, out := range f.outputs {
+		if err := out.lastErr.Load(); err != nil {
+			failing[out.Name] = *err
+		}
+	}
+	return failing
+}
+
+// Collect implements metrics.Collector.
+func (f *Fanout) Collect() []metrics.Metric {
+	var ms []metrics.Metric
+	for _, out := range f.outputs {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_sink_delivered_total",
+			Help:   "Messages delivered by a sink.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"sink": out.Name},
+			Value:  float64(atomic.LoadUint64(&out.delivered)),
+		})
+	}
+	for _, out := range f.outputs {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_sink_errors_total",
+			Help:   "Messages a sink failed to deliver.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"sink": out.Name},
+			Value:  float64(atomic.LoadUint64(&out.failed)),
+		})
+	}
+	for _, out := range f.outputs {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_sink_queue",
+			Help:   "Messages waiting to be delivered by a sink.",
+			Type:   metrics.Gauge,
+			Labels: map[string]string{"sink": out.Name},
+			Value:  float64(len(out.queue)),
+		})
+	}
+	for _, out := range f.outputs {
+		if out.Retry.Attempts < 2 {
+			continue
+		}
+		labels := map[string]string{"sink": out.Name}
+		ms = append(ms,
+			metrics.Metric{Name: "browsertunnel_sink_retries_total", Help: "Deliveries retried by a sink.", Type: metrics.Counter, Labels: labels, Value: float64(atomic.LoadUint64(&out.retried))},
+			metrics.Metric{Name: "browsertunnel_sink_dead_lettered_total", Help: "Messages a sink gave up on after retrying.", Type: metrics.Counter, Labels: labels, Value: float64(atomic.LoadUint64(&out.deadLettered))},
+			metrics.Metric{Name: "browsertunnel_sink_retry_queue", Help: "Messages waiting for a sink to recover.", Type: metrics.Gauge, Labels: labels, Value: float64(out.queued.Load())},
+		)
+	}
+	for _, out := range f.outputs {
+		if f.timeoutOf(out) <= 0 {
+			continue
+		}
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_sink_timeouts_total",
+			Help:   "Deliveries of a sink that timed out.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"sink": out.Name},
+			Value:  float64(atomic.LoadUint64(&out.timeouts)),
+		})
+	}
+	now := time.Now()
+	for _, out := range f.outputs {
+		if out.Breaker.Failures <= 0 {
+			continue
+		}
+		labels := map[string]string{"sink": out.Name}
+		open := 0.0
+		if state, _ := out.breaker.state(now); state != BreakerClosed {
+			open = 1
+		}
+		ms = append(ms,
+			metrics.Metric{Name: "browsertunnel_sink_breaker_open", Help: "Whether the circuit breaker of a sink is open.", Type: metrics.Gauge, Labels: labels, Value: open},
+			metrics.Metric{Name: "browsertunnel_sink_breaker_trips_total", Help: "Times the circuit breaker of a sink opened.", Type: metrics.Counter, Labels: labels, Value: float64(atomic.LoadUint64(&out.breaker.trips))},
+			metrics.Metric{Name: "browsertunnel_sink_breaker_rejected_total", Help: "Deliveries of a sink that failed because its circuit breaker was open.", Type: metrics.Counter, Labels: labels, Value: float64(atomic.LoadUint64(&out.breaker.rejected))},
+		)
+	}
+	for _, out := range f.outputs {
+		if !out.Sampling.enabled() {
+			continue
+		}
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_sink_sampled_out_total",
+			Help:   "Messages not delivered to a sink because of sampling.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"sink": out.Name},
+			Value:  float64(atomic.LoadUint64(&out.sampledOut)),
+		})
+	}
+	for _, out := range f.outputs {
+		var c metrics.Collector
+		switch s := out.Sink.(type) {
+		case *Batcher:
+			c = s
+		case *Archive:
+			c = s
+		case *Chat:
+			c = s
+		default:
+			continue
+		}
+		for _, m := range c.Collect() {
+			m.Labels = map[string]string{"sink": out.Name}
+			ms = append(ms, m)
+		}
+	}
+	for _, r := range f.rules {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_sink_rule_matches_total",
+			Help:   "Messages matched by a routing rule.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"rule": r.Name},
+			Value:  float64(atomic.LoadUint64(&r.matched)),
+		})
+	}
+	if f.schema != nil {
+		ms = append(ms, metrics.Metric{Name: "browsertunnel_sink_quarantined_total", Help: "Messages quarantined because they failed validation against the schema.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&f.quarantined))})
+	}
+	return ms
+}
+
+func (f *Fanout) run(out *output) {
+	defer f.wg.Done()
+	if out.Retry.Attempts > 1 {
+		f.runRetrying(out)
+		return
+	}
+	for d := range out.queue {
+		err := f.attempt(out, d.msg)
+		if err != nil {
+			atomic.AddUint64(&out.failed, 1)
+			// Messages rejected by the breaker are only counted, so that an outage isn't logged
+			// for every message.
+			if !errors.Is(err, ErrBreakerOpen) {
+				f.logger.Warn("Failed to deliver message", "sink", out.Name, "id", d.msg.ID, "error", err)
+			}
+		}
+		d.reply(err)
+	}
+}
+
+// reply reports the outcome of the first attempt to deliver d, if requested.
+func (d delivery) reply(err error) {
+	if d.result != nil {
+		d.result <- err
+	}
+}
+
+// attempt delivers msg to the sink of out once, and records the outcome. It fails with
+// ErrBreakerOpen without calling the sink while its breaker is open, keeping the error of the
+// delivery that opened it as the last one.
+func (f *Fanout) attempt(out *output, msg tunnel.Message) error {
+	// Once Shutdown gives up on delivering, the messages still queued aren't attempted.
+	if err := f.ctx.Err(); err != nil {
+		return err
+	}
+	if err := out.breaker.allow(time.Now()); err != nil {
+		return err
+	}
+	ctx, span := tracer().Start(trace.ContextWithSpanContext(f.ctx, msg.SpanContext), "browsertunnel.deliver",
+		trace.WithAttributes(tunnel.MessageIDAttribute(msg.ID), attribute.String("browsertunnel.sink", out.Name)))
+	defer span.End()
+	timeout := f.timeoutOf(out)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := out.Sink.Deliver(ctx, msg)
+	if err != nil && timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		atomic.AddUint64(&out.timeouts, 1)
+		err = fmt.Errorf("Delivery timed out after %s: %w", timeout, err)
+	}
+	if out.breaker.record(err, time.Now()) {
+		f.logger.Warn("Circuit breaker opened, not delivering to sink", "sink", out.Name, "cooldown", out.Breaker.Cooldown, "error", err)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		out.lastErr.Store(&err)
+		return err
+	}
+	atomic.AddUint64(&out.delivered, 1)
+	out.lastErr.Store(nil)
+	return nil
+}
@@ -0,0 +1,206 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recorder is a Sink that records the IDs of delivered messages, failing for IDs in fail.
+type recorder struct {
+	mu     sync.Mutex
+	ids    []string
+	fail   map[string]bool
+	closed bool
+}
+
+func (r *recorder) Deliver(ctx context.Context, msg tunnel.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail[msg.ID] {
+		return fmt.Errorf("failed to deliver %s", msg.ID)
+	}
+	r.ids = append(r.ids, msg.ID)
+	return nil
+}
+
+func (r *recorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestFanout(t *testing.T) {
+	a := &recorder{}
+	b := &recorder{fail: map[string]bool{"m2": true}}
+	f := NewFanout(nil, Named{Name: "a", Sink: a}, Named{Name: "b", Sink: b})
+
+	for _, id := range []string{"m1", "m2", "m3"} {
+		require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: id}))
+	}
+	require.Nil(t, f.Close())
+
+	require.Equal(t, []string{"m1", "m2", "m3"}, a.ids)
+	require.Equal(t, []string{"m1", "m3"}, b.ids)
+	require.Empty(t, f.Failing())
+	require.True(t, a.closed)
+	require.True(t, b.closed)
+
+	values := map[string]float64{}
+	for _, m := range f.Collect() {
+		values[m.Name+"/"+m.Labels["sink"]] = m.Value
+	}
+	require.Equal(t, map[string]float64{
+		"browsertunnel_sink_delivered_total/a": 3,
+		"browsertunnel_sink_delivered_total/b": 2,
+		"browsertunnel_sink_errors_total/a":    0,
+		"browsertunnel_sink_errors_total/b":    1,
+		"browsertunnel_sink_queue/a":           0,
+		"browsertunnel_sink_queue/b":           0,
+	}, values)
+}
+
+func TestFanoutFailing(t *testing.T) {
+	r := &recorder{fail: map[string]bool{"m2": true}}
+	f := NewFanout(nil, Named{Name: "r", Sink: r})
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m2"}))
+	require.Nil(t, f.Close())
+	require.Equal(t, map[string]error{"r": fmt.Errorf("failed to deliver m2")}, f.Failing())
+}
+
+func TestFanoutTenant(t *testing.T) {
+	all := &recorder{}
+	alpha := &recorder{}
+	f := NewFanout(nil, Named{Name: "all", Sink: all}, Named{Name: "alpha", Sink: alpha, Tenant: "alpha"})
+
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m1", Tenant: "alpha"}))
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m2", Tenant: "beta"}))
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m3"}))
+	require.Nil(t, f.Close())
+
+	require.Equal(t, []string{"m1", "m2", "m3"}, all.ids)
+	require.Equal(t, []string{"m1"}, alpha.ids)
+}
+
+func TestFanoutReplay(t *testing.T) {
+	all := &recorder{fail: map[string]bool{"m2": true}}
+	alpha := &recorder{}
+	sampled := &recorder{}
+	f := NewFanout(nil, Named{Name: "all", Sink: all}, Named{Name: "alpha", Sink: alpha, Tenant: "alpha"}, Named{Name: "sampled", Sink: sampled, Sampling: Sampling{Clients: []ClientRate{{Network: &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}}}})
+	defer f.Close()
+
+	// Replayed messages are only delivered to the chosen sink, even if sampling would skip them.
+	require.Nil(t, f.Replay(context.Background(), "sampled", tunnel.Message{ID: "m1", Source: net.IPv4(192, 0, 2, 1)}))
+	require.Equal(t, []string{"m1"}, sampled.ids)
+	require.Empty(t, all.ids)
+	require.EqualError(t, f.Replay(context.Background(), "all", tunnel.Message{ID: "m2"}), "failed to deliver m2")
+	require.NotNil(t, f.Replay(context.Background(), "alpha", tunnel.Message{ID: "m3", Tenant: "beta"}))
+	require.Nil(t, f.Replay(context.Background(), "alpha", tunnel.Message{ID: "m4", Tenant: "alpha"}))
+	require.Equal(t, []string{"m4"}, alpha.ids)
+	require.NotNil(t, f.Replay(context.Background(), "missing", tunnel.Message{ID: "m5"}))
+}
+
+// blocker is a Sink that blocks until release is closed.
+type blocker struct {
+	release chan struct{}
+}
+
+func (b *blocker) Deliver(ctx context.Context, msg tunnel.Message) error {
+	<-b.release
+	return nil
+}
+
+func TestFanoutBackpressure(t *testing.T) {
+	b := &blocker{release: make(chan struct{})}
+	f := NewFanout(nil, Named{Name: "slow", Sink: b})
+
+	// One message is taken by the sink's goroutine, and the rest fill its queue.
+	for i := 0; i <= fanoutQueueSize; i++ {
+		require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m"}))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, f.Deliver(ctx, tunnel.Message{ID: "m"}))
+
+	close(b.release)
+	require.Nil(t, f.Close())
+}
+
+// hanger is a Sink that blocks until its context is done.
+type hanger struct {
+	closed bool
+}
+
+func (h *hanger) Deliver(ctx context.Context, msg tunnel.Message) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (h *hanger) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestFanoutShutdown(t *testing.T) {
+	h := &hanger{}
+	r := &recorder{}
+	f := NewFanout(nil, Named{Name: "hanging", Sink: h}, Named{Name: "r", Sink: r})
+	for _, id := range []string{"m1", "m2", "m3"} {
+		require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: id}))
+	}
+
+	// The hanging delivery is canceled once the deadline passes, and the messages queued after it
+	// aren't attempted, but the sinks are closed all the same.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, f.Shutdown(ctx))
+	require.True(t, h.closed)
+	require.True(t, r.closed)
+	require.Equal(t, []string{"m1", "m2", "m3"}, r.ids)
+	require.Equal(t, map[string]error{"hanging": context.Canceled}, f.Failing())
+	for _, m := range f.Collect() {
+		if m.Name == "browsertunnel_sink_errors_total" && m.Labels["sink"] == "hanging" {
+			require.Equal(t, float64(3), m.Value)
+		}
+	}
+}
+
+var _ metrics.Collector = &Fanout{}
+
+func TestFanoutTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	_, parent := provider.Tracer("test").Start(context.Background(), "browsertunnel.reassemble")
+	f := NewFanout(nil, Named{Name: "a", Sink: &recorder{}}, Named{Name: "b", Sink: &recorder{fail: map[string]bool{"m1": true}}})
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m1", SpanContext: parent.SpanContext()}))
+	require.Nil(t, f.Close())
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	for _, s := range spans {
+		require.Equal(t, "browsertunnel.deliver", s.Name)
+		require.Equal(t, parent.SpanContext().SpanID(), s.Parent.SpanID())
+		require.Contains(t, s.Attributes, tunnel.MessageIDAttribute("m1"))
+		if slices.Contains(s.Attributes, attribute.String("browsertunnel.sink", "b")) {
+			require.Equal(t, codes.Error, s.Status.Code)
+		} else {
+			require.Equal(t, codes.Unset, s.Status.Code)
+		}
+	}
+}
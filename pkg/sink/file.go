@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// rotatedTimeFormat is the format of the timestamp appended to the names of rotated files. It
+// sorts lexically in the order the files were rotated.
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// FileConfig configures a File.
+type FileConfig struct {
+	// Path is the file messages are appended to. It is created if it doesn't exist.
+	Path string
+	// MaxSize is the size in bytes after which the file is rotated. The file is never rotated for
+	// its size if 0.
+	MaxSize int64
+	// MaxAge is how long a file is written to before it is rotated. The file is never rotated for
+	// its age if 0.
+	MaxAge time.Duration
+	// Compress is whether rotated files are compressed with gzip.
+	Compress bool
+}
+
+// A File appends each message to a file as a line of JSON. When the file grows past its maximum
+// size or age, it is renamed to Path.<timestamp>, optionally compressed, and a new file is
+// started at Path.
+type File struct {
+	cfg    FileConfig
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+}
+
+// NewFile opens the file described by cfg for appending.
+func NewFile(cfg FileConfig) (*File, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("File sink requires a path")
+	}
+	if cfg.MaxSize < 0 || cfg.MaxAge < 0 {
+		return nil, fmt.Errorf("File sink declares negative maximum size %d or age %s", cfg.MaxSize, cfg.MaxAge)
+	}
+	fs := &File{cfg: cfg, now: time.Now}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Deliver appends msg to the file, rotating it first if it is due.
+func (fs *File) Deliver(ctx context.Context, msg tunnel.Message) error {
+	line, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return fs.WriteLine(line)
+}
+
+// WriteLine appends line, followed by a newline, to the file, rotating it first if it is due.
+// It lets other records than messages, such as those of a QueryLog, share the rotation of File.
+func (fs *File) WriteLine(line []byte) error {
+	line = append(line, '\n')
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.f == nil {
+		return fmt.Errorf("File sink %s is closed", fs.cfg.Path)
+	}
+	if fs.due(int64(len(line))) {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.f.Write(line)
+	fs.size += int64(n)
+	return err
+}
+
+// Close closes the file.
+func (fs *File) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.f == nil {
+		return nil
+	}
+	err := fs.f.Close()
+	fs.f = nil
+	return err
+}
+
+func (fs *File) open() error {
+	f, err := os.OpenFile(fs.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fs.f = f
+	fs.size = info.Size()
+	fs.opened = fs.now()
+	return nil
+}
+
+// due reports whether the file must be rotated before n more bytes are written to it. A file is
+// never rotated while empty, so that a single line larger than MaxSize is still written.
+func (fs *File) due(n int64) bool {
+	if fs.size == 0 {
+		return false
+	}
+	if fs.cfg.MaxSize > 0 && fs.size+n > fs.cfg.MaxSize {
+		return true
+	}
+	return fs.cfg.MaxAge > 0 && fs.now().Sub(fs.opened) >= fs.cfg.MaxAge
+}
+
+func (fs *File) rotate() error {
+	if err := fs.f.Close(); err != nil {
+		return err
+	}
+	fs.f = nil
+	rotated := fs.cfg.Path + "." + fs.now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(fs.cfg.Path, rotated); err != nil {
+		return err
+	}
+	if err := fs.open(); err != nil {
+		return err
+	}
+	if fs.cfg.Compress {
+		return compressFile(rotated)
+	}
+	return nil
+}
+
+// compressFile replaces path with a gzip compressed copy named path.gz.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readLines(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		require.Nil(t, err)
+		r = zr
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Nil(t, scanner.Err())
+	return lines
+}
+
+func rotatedFiles(t *testing.T, path string) []string {
+	matches, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	sort.Strings(matches)
+	return matches
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.ndjson")
+	fs, err := NewFile(FileConfig{Path: path})
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, fs.Deliver(context.Background(), testMessage))
+	}
+	require.Nil(t, fs.Close())
+	require.NotNil(t, fs.Deliver(context.Background(), testMessage))
+
+	expected, err := Marshal(testMessage)
+	require.Nil(t, err)
+	lines := readLines(t, path)
+	require.Equal(t, []string{string(expected), string(expected), string(expected)}, lines)
+	require.Empty(t, rotatedFiles(t, path))
+
+	// Reopening appends to the existing file.
+	fs, err = NewFile(FileConfig{Path: path})
+	require.Nil(t, err)
+	require.Nil(t, fs.Deliver(context.Background(), testMessage))
+	require.Nil(t, fs.Close())
+	require.Len(t, readLines(t, path), 4)
+}
+
+func TestFileRotateSize(t *testing.T) {
+	line, err := Marshal(testMessage)
+	require.Nil(t, err)
+
+	for _, compress := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "messages.ndjson")
+		fs, err := NewFile(FileConfig{Path: path, MaxSize: int64(2*len(line) + 2), Compress: compress})
+		require.Nil(t, err)
+		for i := 0; i < 5; i++ {
+			require.Nil(t, fs.Deliver(context.Background(), testMessage))
+		}
+		require.Nil(t, fs.Close())
+
+		rotated := rotatedFiles(t, path)
+		require.Len(t, rotated, 2)
+		for _, r := range rotated {
+			require.Equal(t, compress, strings.HasSuffix(r, ".gz"))
+			require.Len(t, readLines(t, r), 2)
+		}
+		require.Len(t, readLines(t, path), 1)
+	}
+}
+
+func TestFileRotateAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.ndjson")
+	fs, err := NewFile(FileConfig{Path: path, MaxAge: time.Hour})
+	require.Nil(t, err)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	fs.now = func() time.Time { return now }
+	fs.opened = now
+
+	require.Nil(t, fs.Deliver(context.Background(), testMessage))
+	now = now.Add(59 * time.Minute)
+	require.Nil(t, fs.Deliver(context.Background(), testMessage))
+	require.Empty(t, rotatedFiles(t, path))
+
+	now = now.Add(time.Minute)
+	require.Nil(t, fs.Deliver(context.Background(), testMessage))
+	require.Nil(t, fs.Close())
+	require.Equal(t, []string{path + ".20200601T130000.000000000"}, rotatedFiles(t, path))
+	require.Len(t, readLines(t, path+".20200601T130000.000000000"), 2)
+	require.Len(t, readLines(t, path), 1)
+}
+
+func TestNewFileErrors(t *testing.T) {
+	_, err := NewFile(FileConfig{})
+	require.NotNil(t, err)
+	_, err = NewFile(FileConfig{Path: filepath.Join(t.TempDir(), "x"), MaxSize: -1})
+	require.NotNil(t, err)
+	_, err = NewFile(FileConfig{Path: filepath.Join(t.TempDir(), "missing", "x")})
+	require.NotNil(t, err)
+}
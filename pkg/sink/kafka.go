@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// KafkaConfig configures a Kafka.
+type KafkaConfig struct {
+	// Brokers are the addresses of the brokers used to bootstrap the connection.
+	Brokers []string
+	// Topic is the topic messages are published to.
+	Topic string
+	// TLS is used to connect to the brokers if not nil.
+	TLS *tls.Config
+	// SASLMechanism is the SASL mechanism used to authenticate with Username and Password: plain,
+	// scram-sha-256 or scram-sha-512. SASL is disabled if empty.
+	SASLMechanism string
+	Username      string
+	Password      string
+	// Raw publishes the payload of each message as is, rather than as JSON, with its metadata in
+	// Browsertunnel-* record headers.
+	Raw bool
+}
+
+// A Kafka publishes each message to a Kafka topic, keyed by the message ID.
+type Kafka struct {
+	w   *kafka.Writer
+	raw bool
+}
+
+// NewKafka returns a Kafka that publishes to the topic described by cfg. Connections to the
+// brokers are made lazily as messages are delivered.
+func NewKafka(cfg KafkaConfig) (*Kafka, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("Kafka sink requires at least one broker")
+	}
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("Kafka sink requires a topic")
+	}
+	mechanism, err := saslMechanism(cfg.SASLMechanism, cfg.Username, cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &Kafka{w: &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		Transport:    &kafka.Transport{TLS: cfg.TLS, SASL: mechanism},
+	}, raw: cfg.Raw}, nil
+}
+
+// Deliver publishes msg, returning once it has been acknowledged by every in-sync replica.
+func (k *Kafka) Deliver(ctx context.Context, msg tunnel.Message) error {
+	record, err := k.record(msg)
+	if err != nil {
+		return err
+	}
+	return k.w.WriteMessages(ctx, record)
+}
+
+// DeliverBatch publishes msgs in a single write, returning once all of them have been
+// acknowledged.
+func (k *Kafka) DeliverBatch(ctx context.Context, msgs []tunnel.Message) error {
+	records := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		record, err := k.record(msg)
+		if err != nil {
+			return err
+		}
+		records[i] = record
+	}
+	return k.w.WriteMessages(ctx, records...)
+}
+
+// record returns the Kafka record publishing msg.
+func (k *Kafka) record(msg tunnel.Message) (kafka.Message, error) {
+	record := kafka.Message{Key: []byte(msg.ID)}
+	if !k.raw {
+		value, err := Marshal(msg)
+		record.Value = value
+		return record, err
+	}
+	record.Value = msg.Payload
+	for _, h := range rawHeaders(msg) {
+		record.Headers = append(record.Headers, kafka.Header{Key: h.key, Value: []byte(h.value)})
+	}
+	return record, nil
+}
+
+// Close flushes pending messages and closes the connections to the brokers.
+func (k *Kafka) Close() error {
+	return k.w.Close()
+}
+
+func saslMechanism(name, username, password string) (sasl.Mechanism, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("Unknown SASL mechanism %q", name)
+	}
+}
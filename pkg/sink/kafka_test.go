@@ -0,0 +1,50 @@
+package sink
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKafka(t *testing.T) {
+	tests := []struct {
+		cfg   KafkaConfig
+		fails bool
+	}{
+		{cfg: KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "messages"}},
+		{cfg: KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "messages", SASLMechanism: "plain", Username: "u", Password: "p"}},
+		{cfg: KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "messages", SASLMechanism: "SCRAM-SHA-512", Username: "u", Password: "p"}},
+		{cfg: KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "messages", SASLMechanism: "gssapi"}, fails: true},
+		{cfg: KafkaConfig{Topic: "messages"}, fails: true},
+		{cfg: KafkaConfig{Brokers: []string{"localhost:9092"}}, fails: true},
+	}
+	for _, test := range tests {
+		k, err := NewKafka(test.cfg)
+		if test.fails {
+			require.NotNil(t, err)
+			continue
+		}
+		require.Nil(t, err)
+		require.Equal(t, test.cfg.Topic, k.w.Topic)
+		require.Nil(t, k.Close())
+	}
+}
+
+func TestKafkaRecord(t *testing.T) {
+	k, err := NewKafka(KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "messages"})
+	require.Nil(t, err)
+	defer k.Close()
+	record, err := k.record(testMessage)
+	require.Nil(t, err)
+	require.Equal(t, []byte("2jkhm3"), record.Key)
+	require.Contains(t, string(record.Value), `"payload":"hello world"`)
+	require.Empty(t, record.Headers)
+
+	k.raw = true
+	record, err = k.record(testMessage)
+	require.Nil(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Contains(t, record.Headers, kafka.Header{Key: "Browsertunnel-Id", Value: []byte("2jkhm3")})
+	require.Contains(t, record.Headers, kafka.Header{Key: "Browsertunnel-Binary", Value: []byte("false")})
+}
@@ -0,0 +1,294 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// topicReplacer replaces the characters that are not allowed within an MQTT topic level.
+var topicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_", "\x00", "_")
+
+// MQTT control packet types, in the high nibble of the fixed header.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttDisconnect = 14
+)
+
+// mqttConnackErrors describes the return codes of a refused MQTT 3.1.1 connection.
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// MQTTConfig configures an MQTT.
+type MQTTConfig struct {
+	// Addr is the host:port of the broker.
+	Addr string
+	// Topic is a text/template for the topic each message is published to. It is executed with a
+	// SubjectData, e.g. "tunnel/{{.Source}}/{{.ID}}".
+	Topic string
+	// QoS is the MQTT quality of service messages are published with: 0 (at most once), 1 (at
+	// least once) or 2 (exactly once).
+	QoS int
+	// Retain asks the broker to keep the last message of each topic for new subscribers.
+	Retain bool
+	// TLS is used to connect to the broker if not nil.
+	TLS *tls.Config
+	// ClientID identifies the connection to the broker, which assigns one if empty.
+	ClientID string
+	// Username and Password authenticate with the broker if not empty.
+	Username string
+	Password string
+}
+
+// An MQTT publishes each message as JSON to a topic of an MQTT 3.1.1 broker, such as Mosquitto.
+type MQTT struct {
+	cfg   MQTTConfig
+	topic *template.Template
+
+	mu       sync.Mutex
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+// NewMQTT returns an MQTT that publishes to the broker described by cfg. The connection is made
+// lazily as messages are delivered, and remade if publishing fails.
+func NewMQTT(cfg MQTTConfig) (*MQTT, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("MQTT sink requires an address")
+	}
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("MQTT sink requires a topic")
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("MQTT QoS must be 0, 1 or 2, not %d", cfg.QoS)
+	}
+	topic, err := template.New("topic").Option("missingkey=error").Parse(cfg.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return &MQTT{cfg: cfg, topic: topic}, nil
+}
+
+// Deliver publishes msg, returning once the broker has acknowledged it, or as soon as it is sent
+// with QoS 0.
+func (m *MQTT) Deliver(ctx context.Context, msg tunnel.Message) error {
+	topic, err := m.topicFor(msg)
+	if err != nil {
+		return err
+	}
+	body, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		if err := m.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if err := m.publish(ctx, topic, body); err != nil {
+		m.conn.Close()
+		m.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (m *MQTT) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		return nil
+	}
+	m.conn.Write(mqttPacket(mqttDisconnect<<4, nil))
+	err := m.conn.Close()
+	m.conn = nil
+	return err
+}
+
+func (m *MQTT) topicFor(msg tunnel.Message) (string, error) {
+	var buf bytes.Buffer
+	if err := m.topic.Execute(&buf, subjectData(msg, topicReplacer)); err != nil {
+		return "", err
+	}
+	topic := buf.String()
+	if topic == "" || len(topic) > 0xffff || strings.ContainsAny(topic, "+#\x00") || !utf8.ValidString(topic) {
+		return "", fmt.Errorf("Invalid MQTT topic %q", topic)
+	}
+	return topic, nil
+}
+
+func (m *MQTT) connect(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if m.cfg.TLS != nil {
+		d := tls.Dialer{Config: m.cfg.TLS}
+		conn, err = d.DialContext(ctx, "tcp", m.cfg.Addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", m.cfg.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	m.r = bufio.NewReader(conn)
+	setDeadline(ctx, conn)
+
+	// The variable header names protocol level 4 (MQTT 3.1.1), sets the flags of the credentials
+	// and a clean session, and disables keep alive.
+	flags := byte(0x02)
+	if m.cfg.Username != "" {
+		flags |= 0x80
+	}
+	if m.cfg.Password != "" {
+		flags |= 0x40
+	}
+	body := append(mqttString(nil, "MQTT"), 4, flags, 0, 0)
+	body = mqttString(body, m.cfg.ClientID)
+	if m.cfg.Username != "" {
+		body = mqttString(body, m.cfg.Username)
+	}
+	if m.cfg.Password != "" {
+		body = mqttString(body, m.cfg.Password)
+	}
+	_, err = conn.Write(mqttPacket(mqttConnect<<4, body))
+	if err == nil {
+		var ack []byte
+		if ack, err = m.await(mqttConnack, 0); err == nil && ack[1] != 0 {
+			err = fmt.Errorf("MQTT broker refused the connection: %s", mqttConnackErrors[ack[1]])
+		}
+	}
+	if err != nil {
+		conn.Close()
+		m.conn = nil
+		return err
+	}
+	return nil
+}
+
+// publish sends a PUBLISH, and waits for the acknowledgements its QoS calls for.
+func (m *MQTT) publish(ctx context.Context, topic string, payload []byte) error {
+	setDeadline(ctx, m.conn)
+	header := byte(mqttPublish<<4 | m.cfg.QoS<<1)
+	if m.cfg.Retain {
+		header |= 0x01
+	}
+	body := mqttString(nil, topic)
+	var id uint16
+	if m.cfg.QoS > 0 {
+		m.packetID++
+		if m.packetID == 0 {
+			m.packetID = 1
+		}
+		id = m.packetID
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	if _, err := m.conn.Write(mqttPacket(header, append(body, payload...))); err != nil {
+		return err
+	}
+	switch m.cfg.QoS {
+	case 1:
+		_, err := m.await(mqttPuback, id)
+		return err
+	case 2:
+		if _, err := m.await(mqttPubrec, id); err != nil {
+			return err
+		}
+		if _, err := m.conn.Write(mqttPacket(mqttPubrel<<4|0x02, binary.BigEndian.AppendUint16(nil, id))); err != nil {
+			return err
+		}
+		_, err := m.await(mqttPubcomp, id)
+		return err
+	}
+	return nil
+}
+
+// await reads packets until one of type kind arrives, and returns its body. Acknowledgements are
+// only accepted for packet id.
+func (m *MQTT) await(kind byte, id uint16) ([]byte, error) {
+	for {
+		header, err := m.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		var length, shift int
+		for {
+			b, err := m.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length |= int(b&0x7f) << shift
+			if b&0x80 == 0 {
+				break
+			}
+			if shift += 7; shift > 21 {
+				return nil, fmt.Errorf("Malformed MQTT packet length")
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(m.r, body); err != nil {
+			return nil, err
+		}
+		if header>>4 != kind {
+			continue
+		}
+		if len(body) < 2 {
+			return nil, fmt.Errorf("Malformed MQTT packet of type %d", kind)
+		}
+		if kind != mqttConnack && binary.BigEndian.Uint16(body) != id {
+			continue
+		}
+		return body, nil
+	}
+}
+
+// mqttPacket returns the packet with the given fixed header byte and body.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttString appends s to b as a length-prefixed MQTT string.
+func mqttString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+}
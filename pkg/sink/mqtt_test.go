@@ -0,0 +1,131 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mqttPub struct {
+	topic  string
+	qos    int
+	retain bool
+	body   string
+}
+
+// fakeMQTT accepts a single connection, answers its CONNECT with the return code, acknowledges
+// every PUBLISH according to its QoS, and sends each published message on pubs.
+func fakeMQTT(t *testing.T, code byte) (string, <-chan mqttPub) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	pubs := make(chan mqttPub, 16)
+	go func() {
+		defer l.Close()
+		defer close(pubs)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			header, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return
+			}
+			body := make([]byte, length)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			switch header >> 4 {
+			case mqttConnect:
+				conn.Write([]byte{mqttConnack << 4, 2, 0, code})
+			case mqttPublish:
+				n := int(binary.BigEndian.Uint16(body))
+				pub := mqttPub{topic: string(body[2 : 2+n]), qos: int(header>>1) & 3, retain: header&1 == 1}
+				body = body[2+n:]
+				if pub.qos > 0 {
+					id := body[:2]
+					body = body[2:]
+					if pub.qos == 1 {
+						conn.Write([]byte{mqttPuback << 4, 2, id[0], id[1]})
+					} else {
+						conn.Write([]byte{mqttPubrec << 4, 2, id[0], id[1]})
+					}
+				}
+				pub.body = string(body)
+				pubs <- pub
+			case mqttPubrel:
+				conn.Write([]byte{mqttPubcomp << 4, 2, body[0], body[1]})
+			}
+		}
+	}()
+	return l.Addr().String(), pubs
+}
+
+func TestMQTT(t *testing.T) {
+	body, err := Marshal(testMessage)
+	require.Nil(t, err)
+	for _, qos := range []int{0, 1, 2} {
+		addr, pubs := fakeMQTT(t, 0)
+		m, err := NewMQTT(MQTTConfig{Addr: addr, Topic: "tunnel/{{.Source}}/{{.ID}}", QoS: qos, Retain: qos == 2, Username: "u", Password: "p"})
+		require.Nil(t, err)
+		for i := 0; i < 2; i++ {
+			require.Nil(t, m.Deliver(context.Background(), testMessage))
+			require.Equal(t, mqttPub{topic: "tunnel/192.0.2.1/2jkhm3", qos: qos, retain: qos == 2, body: string(body)}, <-pubs)
+		}
+		require.Nil(t, m.Close())
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	addr, _ := fakeMQTT(t, 5)
+	m, err := NewMQTT(MQTTConfig{Addr: addr, Topic: "tunnel", QoS: 1})
+	require.Nil(t, err)
+	err = m.Deliver(context.Background(), testMessage)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "not authorized")
+	require.Nil(t, m.Close())
+}
+
+func TestMQTTTopic(t *testing.T) {
+	tests := []struct {
+		topic  string
+		output string
+		fails  bool
+	}{
+		{topic: "tunnel", output: "tunnel"},
+		{topic: "tunnel/{{.QueryType}}/{{.ID}}", output: "tunnel/A/2jkhm3"},
+		{topic: "tunnel/{{.Domain}}", output: "tunnel/t1.example.com"},
+		{topic: "tunnel/{{.Missing}}", fails: true},
+		{topic: "tunnel/+", fails: true},
+		{topic: "tunnel/#", fails: true},
+	}
+	for _, test := range tests {
+		m, err := NewMQTT(MQTTConfig{Addr: "localhost:1883", Topic: test.topic})
+		require.Nil(t, err)
+		got, err := m.topicFor(testMessage)
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+			require.Equal(t, test.output, got)
+		}
+	}
+
+	_, err := NewMQTT(MQTTConfig{Addr: "localhost:1883", Topic: "{{.ID"})
+	require.NotNil(t, err)
+	_, err = NewMQTT(MQTTConfig{Topic: "tunnel"})
+	require.NotNil(t, err)
+	_, err = NewMQTT(MQTTConfig{Addr: "localhost:1883", Topic: "tunnel", QoS: 3})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,213 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// subjectReplacer replaces the characters that are not allowed within a NATS subject token.
+var subjectReplacer = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_", ":", "_")
+
+// NATSConfig configures a NATS.
+type NATSConfig struct {
+	// Addr is the host:port of the NATS server.
+	Addr string
+	// Subject is a text/template for the subject each message is published to. It is executed
+	// with a SubjectData, e.g. "tunnel.{{.Source}}.{{.ID}}".
+	Subject string
+	// Token, or User and Password, authenticate with the server if not empty.
+	Token    string
+	User     string
+	Password string
+}
+
+// SubjectData is the data a NATS subject or MQTT topic template is executed with. Characters that
+// are not allowed in a subject token or topic level, such as the dots in an IPv4 address within a
+// NATS subject, are replaced with underscores.
+type SubjectData struct {
+	ID        string
+	Source    string
+	QueryType string
+	// Domain is the top domain the message arrived through, without the trailing dot.
+	Domain string
+	// Tenant is the tenant the message was sent to, if tenants are configured.
+	Tenant string
+}
+
+// A NATS publishes each message as JSON to a NATS subject.
+type NATS struct {
+	cfg     NATSConfig
+	subject *template.Template
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewNATS returns a NATS that publishes to the server described by cfg. The connection is made
+// lazily as messages are delivered, and remade if publishing fails.
+func NewNATS(cfg NATSConfig) (*NATS, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("NATS sink requires an address")
+	}
+	if cfg.Subject == "" {
+		return nil, fmt.Errorf("NATS sink requires a subject")
+	}
+	subject, err := template.New("subject").Option("missingkey=error").Parse(cfg.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return &NATS{cfg: cfg, subject: subject}, nil
+}
+
+// Deliver publishes msg, returning once the server has processed it.
+func (n *NATS) Deliver(ctx context.Context, msg tunnel.Message) error {
+	subject, err := n.subjectFor(msg)
+	if err != nil {
+		return err
+	}
+	body, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if err := n.publish(ctx, subject, body); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server.
+func (n *NATS) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
+
+// subjectData returns the SubjectData of msg, with the characters replaced by r.
+func subjectData(msg tunnel.Message, r *strings.Replacer) SubjectData {
+	data := SubjectData{
+		ID:        r.Replace(msg.ID),
+		QueryType: dns.TypeToString[msg.QueryType],
+		Domain:    r.Replace(strings.TrimSuffix(msg.Domain, ".")),
+		Tenant:    r.Replace(msg.Tenant),
+	}
+	if msg.Source != nil {
+		data.Source = r.Replace(msg.Source.String())
+	}
+	return data
+}
+
+func (n *NATS) subjectFor(msg tunnel.Message) (string, error) {
+	var buf bytes.Buffer
+	if err := n.subject.Execute(&buf, subjectData(msg, subjectReplacer)); err != nil {
+		return "", err
+	}
+	subject := buf.String()
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") || strings.Contains(subject, "..") ||
+		strings.HasPrefix(subject, ".") || strings.HasSuffix(subject, ".") {
+		return "", fmt.Errorf("Invalid NATS subject %q", subject)
+	}
+	return subject, nil
+}
+
+func (n *NATS) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	n.conn = conn
+	n.r = bufio.NewReader(conn)
+	setDeadline(ctx, conn)
+
+	line, err := n.readLine()
+	if err == nil && !strings.HasPrefix(line, "INFO ") {
+		err = fmt.Errorf("Unexpected greeting from NATS server: %q", line)
+	}
+	if err == nil {
+		options, _ := json.Marshal(map[string]interface{}{
+			"verbose":      false,
+			"pedantic":     false,
+			"name":         "browsertunnel",
+			"lang":         "go",
+			"auth_token":   n.cfg.Token,
+			"user":         n.cfg.User,
+			"pass":         n.cfg.Password,
+			"tls_required": false,
+		})
+		_, err = fmt.Fprintf(conn, "CONNECT %s\r\n", options)
+	}
+	if err != nil {
+		conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+// publish sends a PUB followed by a PING, and waits for the PONG so that errors reported by the
+// server, such as an authorization violation, are returned.
+func (n *NATS) publish(ctx context.Context, subject string, body []byte) error {
+	setDeadline(ctx, n.conn)
+	req := fmt.Sprintf("PUB %s %d\r\n", subject, len(body))
+	if _, err := n.conn.Write(append(append([]byte(req), body...), "\r\nPING\r\n"...)); err != nil {
+		return err
+	}
+	for {
+		line, err := n.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server responded with %s", line)
+		}
+	}
+}
+
+func (n *NATS) readLine() (string, error) {
+	line, err := n.r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+}
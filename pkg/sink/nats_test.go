@@ -0,0 +1,107 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type natsPub struct {
+	subject string
+	body    string
+}
+
+// fakeNATS accepts a single connection, answers every PING with reply, and sends each
+// published message on pubs.
+func fakeNATS(t *testing.T, reply string) (string, <-chan natsPub) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	pubs := make(chan natsPub, 16)
+	go func() {
+		defer l.Close()
+		defer close(pubs)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "PUB":
+				size, _ := strconv.Atoi(fields[2])
+				body := make([]byte, size+2)
+				if _, err := io.ReadFull(r, body); err != nil {
+					return
+				}
+				pubs <- natsPub{subject: fields[1], body: string(body[:size])}
+			case "PING":
+				conn.Write([]byte("PING\r\n" + reply + "\r\n"))
+			}
+		}
+	}()
+	return l.Addr().String(), pubs
+}
+
+func TestNATS(t *testing.T) {
+	addr, pubs := fakeNATS(t, "PONG")
+	n, err := NewNATS(NATSConfig{Addr: addr, Subject: "tunnel.{{.Source}}.{{.ID}}"})
+	require.Nil(t, err)
+	defer n.Close()
+
+	require.Nil(t, n.Deliver(context.Background(), testMessage))
+	body, err := Marshal(testMessage)
+	require.Nil(t, err)
+	require.Equal(t, natsPub{subject: "tunnel.192_0_2_1.2jkhm3", body: string(body)}, <-pubs)
+}
+
+func TestNATSError(t *testing.T) {
+	addr, _ := fakeNATS(t, "-ERR 'Permissions Violation for Publish to tunnel'")
+	n, err := NewNATS(NATSConfig{Addr: addr, Subject: "tunnel"})
+	require.Nil(t, err)
+	require.NotNil(t, n.Deliver(context.Background(), testMessage))
+	require.Nil(t, n.Close())
+}
+
+func TestNATSSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		output  string
+		fails   bool
+	}{
+		{subject: "tunnel", output: "tunnel"},
+		{subject: "tunnel.{{.QueryType}}.{{.ID}}", output: "tunnel.A.2jkhm3"},
+		{subject: "tunnel.{{.Domain}}", output: "tunnel.t1_example_com"},
+		{subject: "tunnel.{{.Missing}}", fails: true},
+		{subject: "tunnel.{{.ID}}.", fails: true},
+		{subject: "tunnel {{.ID}}", fails: true},
+	}
+	for _, test := range tests {
+		n, err := NewNATS(NATSConfig{Addr: "localhost:4222", Subject: test.subject})
+		require.Nil(t, err)
+		got, err := n.subjectFor(testMessage)
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+			require.Equal(t, test.output, got)
+		}
+	}
+
+	_, err := NewNATS(NATSConfig{Addr: "localhost:4222", Subject: "{{.ID"})
+	require.NotNil(t, err)
+	_, err = NewNATS(NATSConfig{Subject: "tunnel"})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,57 @@
+package sink
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/veggiedefender/browsertunnel/pkg/schema"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// SchemaErrorTag is the tag that messages failing validation against the schema of a Fanout are
+// quarantined with. It holds the validation error.
+const SchemaErrorTag = "schema_error"
+
+// SetSchema makes f validate the payload of every message as a JSON document against s. Valid
+// messages are routed as usual, except that only rules naming it route them to the quarantine
+// sink. Invalid ones, including payloads that aren't JSON, are tagged with SchemaErrorTag and
+// delivered only to the quarantine sink, or dropped if quarantine is empty. The quarantine sink
+// must be a sink of f, and SetSchema must be called before messages are delivered.
+func (f *Fanout) SetSchema(s *schema.Schema, quarantine string) error {
+	if quarantine != "" {
+		found := false
+		for _, out := range f.outputs {
+			found = found || out.Name == quarantine
+		}
+		if !found {
+			return fmt.Errorf("Quarantine sink %s is not enabled", quarantine)
+		}
+	}
+	f.schema, f.quarantine = s, quarantine
+	return nil
+}
+
+// validate returns msg tagged with its validation error, and the sinks it is routed to, if it
+// fails validation against the schema of f. Otherwise, it returns msg and nil.
+func (f *Fanout) validate(msg tunnel.Message) (tunnel.Message, map[string]bool) {
+	if f.schema == nil {
+		return msg, nil
+	}
+	err := f.schema.ValidateJSON(msg.Payload)
+	if err == nil {
+		return msg, nil
+	}
+	atomic.AddUint64(&f.quarantined, 1)
+	f.logger.Debug("Quarantining message that failed validation", "id", msg.ID, "error", err)
+	tags := make(map[string]string, len(msg.Tags)+1)
+	for k, v := range msg.Tags {
+		tags[k] = v
+	}
+	tags[SchemaErrorTag] = err.Error()
+	msg.Tags = tags
+	sinks := make(map[string]bool)
+	if f.quarantine != "" {
+		sinks[f.quarantine] = true
+	}
+	return msg, sinks
+}
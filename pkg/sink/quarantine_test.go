@@ -0,0 +1,49 @@
+package sink
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/schema"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestFanoutSchema(t *testing.T) {
+	s, err := schema.Compile([]byte(`{"type": "object", "required": ["event"]}`))
+	require.Nil(t, err)
+	bulk, alerts, quarantine := &recorder{}, &recorder{}, &tagRecorder{}
+	f := NewFanout(nil, Named{Name: "bulk", Sink: bulk}, Named{Name: "alerts", Sink: alerts}, Named{Name: "quarantine", Sink: quarantine})
+	require.Nil(t, f.SetRules(Rule{Name: "secrets", Payload: regexp.MustCompile("password"), Sinks: []string{"alerts"}}))
+	require.Nil(t, f.SetSchema(s, "quarantine"))
+	for _, msg := range []tunnel.Message{
+		{ID: "m1", Payload: []byte(`{"event": "click"}`)},
+		{ID: "m2", Payload: []byte(`{"password": "hunter2"}`), Tags: map[string]string{"source": "test"}},
+		{ID: "m3", Payload: []byte(`not json`)},
+		{ID: "m4", Payload: []byte(`{"event": "password"}`)},
+	} {
+		require.Nil(t, f.Deliver(context.Background(), msg))
+	}
+	require.Nil(t, f.Close())
+
+	// Invalid messages are only delivered to the quarantine sink, and rules don't apply to them.
+	require.Equal(t, []string{"m1"}, bulk.ids)
+	require.Equal(t, []string{"m4"}, alerts.ids)
+	require.Equal(t, []string{"m2", "m3"}, quarantine.ids)
+	require.Equal(t, map[string]string{"source": "test", SchemaErrorTag: `Missing required property "event"`}, quarantine.tags[0])
+	require.Contains(t, quarantine.tags[1][SchemaErrorTag], "Invalid JSON")
+	for _, m := range f.Collect() {
+		if m.Name == "browsertunnel_sink_quarantined_total" {
+			require.Equal(t, float64(2), m.Value)
+		}
+	}
+
+	// Without a quarantine sink, invalid messages are dropped.
+	f = NewFanout(nil, Named{Name: "bulk", Sink: bulk})
+	require.Nil(t, f.SetSchema(s, ""))
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m5", Payload: []byte(`{}`)}))
+	require.Nil(t, f.Close())
+	require.Equal(t, []string{"m1"}, bulk.ids)
+	require.NotNil(t, f.SetSchema(s, "missing"))
+}
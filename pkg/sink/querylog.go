@@ -0,0 +1,116 @@
+package sink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// QueryLogConfig configures a QueryLog.
+type QueryLogConfig struct {
+	// File is where queries are appended, and how the file is rotated.
+	File FileConfig
+	// HashKey, if set, replaces each query name with its HMAC-SHA256 under HashKey, in hex, so
+	// that the log doesn't hold the data carried by the queries while the queries of a name can
+	// still be told apart. Names are hashed in lower case, so that resolvers that randomize their
+	// case don't spread one name over several hashes.
+	HashKey []byte
+}
+
+// A QueryLog is a tunnel.QueryLogger that appends every query to a file as a line of JSON, apart
+// from the messages delivered by sinks, as an audit trail of what reached the tunnel:
+//
+//	{"time":"2024-01-01T00:00:00Z","source":"192.0.2.1","qname":"...","qtype":"A","disposition":"fragment","rcode":"NOERROR"}
+//
+// LogQuery can't return errors, so failed writes are logged and counted.
+type QueryLog struct {
+	file    *File
+	key     []byte
+	logger  *slog.Logger
+	written atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// queryLogLine is the JSON record of a query.
+type queryLogLine struct {
+	Time        time.Time          `json:"time"`
+	Source      string             `json:"source,omitempty"`
+	Name        string             `json:"qname"`
+	Type        string             `json:"qtype"`
+	Tenant      string             `json:"tenant,omitempty"`
+	Disposition tunnel.Disposition `json:"disposition"`
+	Rcode       string             `json:"rcode,omitempty"`
+}
+
+// NewQueryLog opens the file described by cfg for appending queries. Errors are logged to logger,
+// or slog.Default() if it is nil.
+func NewQueryLog(cfg QueryLogConfig, logger *slog.Logger) (*QueryLog, error) {
+	file, err := NewFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &QueryLog{file: file, key: cfg.HashKey, logger: logger}, nil
+}
+
+// LogQuery implements tunnel.QueryLogger.
+func (l *QueryLog) LogQuery(rec tunnel.QueryRecord) {
+	line := queryLogLine{
+		Time:        rec.Time.UTC(),
+		Name:        rec.Name,
+		Type:        dns.Type(rec.Type).String(),
+		Tenant:      rec.Tenant,
+		Disposition: rec.Disposition,
+	}
+	if rec.Source != nil {
+		line.Source = rec.Source.String()
+	}
+	if len(l.key) > 0 {
+		line.Name = l.hash(rec.Name)
+	}
+	if rec.Rcode >= 0 {
+		line.Rcode = dns.RcodeToString[rec.Rcode]
+	}
+	b, err := json.Marshal(line)
+	if err == nil {
+		err = l.file.WriteLine(b)
+	}
+	if err != nil {
+		l.errors.Add(1)
+		l.logger.Warn("Failed to write query log", "path", l.file.cfg.Path, "error", err)
+		return
+	}
+	l.written.Add(1)
+}
+
+// hash returns the HMAC-SHA256 of name in lower case under the key of l, in hex.
+func (l *QueryLog) hash(name string) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(strings.ToLower(name)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Written returns the number of queries written to the log.
+func (l *QueryLog) Written() uint64 {
+	return l.written.Load()
+}
+
+// Errors returns the number of queries that couldn't be written to the log.
+func (l *QueryLog) Errors() uint64 {
+	return l.errors.Load()
+}
+
+// Close closes the file.
+func (l *QueryLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,69 @@
+package sink
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.ndjson")
+	l, err := NewQueryLog(QueryLogConfig{File: FileConfig{Path: path}}, nil)
+	require.Nil(t, err)
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.LogQuery(tunnel.QueryRecord{Time: at, Source: net.IPv4(192, 0, 2, 1), Name: "2jkhm3.24.0.nbswy3dpeb3w.Tunnel.example.com.", Type: dns.TypeA, Tenant: "alpha", Disposition: tunnel.DispositionFragment, Rcode: dns.RcodeSuccess})
+	l.LogQuery(tunnel.QueryRecord{Time: at, Name: "tunnel.example.com.", Type: dns.TypeSOA, Disposition: tunnel.DispositionDenied, Rcode: dns.RcodeRefused})
+	l.LogQuery(tunnel.QueryRecord{Time: at, Name: "tunnel.example.com.", Type: dns.TypeA, Disposition: tunnel.DispositionFragment, Rcode: -1})
+	require.Nil(t, l.Close())
+	require.Equal(t, uint64(3), l.Written())
+
+	require.Equal(t, []string{
+		`{"time":"2024-01-01T00:00:00Z","source":"192.0.2.1","qname":"2jkhm3.24.0.nbswy3dpeb3w.Tunnel.example.com.","qtype":"A","tenant":"alpha","disposition":"fragment","rcode":"NOERROR"}`,
+		`{"time":"2024-01-01T00:00:00Z","qname":"tunnel.example.com.","qtype":"SOA","disposition":"denied","rcode":"REFUSED"}`,
+		`{"time":"2024-01-01T00:00:00Z","qname":"tunnel.example.com.","qtype":"A","disposition":"fragment"}`,
+	}, readLines(t, path))
+
+	// Writes after Close fail, and are counted.
+	l.LogQuery(tunnel.QueryRecord{Time: at, Name: "tunnel.example.com.", Type: dns.TypeA})
+	require.Equal(t, uint64(1), l.Errors())
+}
+
+func TestQueryLogHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.ndjson")
+	l, err := NewQueryLog(QueryLogConfig{File: FileConfig{Path: path}, HashKey: []byte("secret")}, nil)
+	require.Nil(t, err)
+	l.LogQuery(tunnel.QueryRecord{Name: "2jkhm3.24.0.nbswy3dpeb3w.Tunnel.example.com.", Type: dns.TypeA})
+	l.LogQuery(tunnel.QueryRecord{Name: "2JKHM3.24.0.NBSWY3DPEB3W.tunnel.example.com.", Type: dns.TypeA})
+	l.LogQuery(tunnel.QueryRecord{Name: "abcdef.24.0.nbswy3dpeb3w.tunnel.example.com.", Type: dns.TypeA})
+	require.Nil(t, l.Close())
+
+	var names []string
+	for _, line := range readLines(t, path) {
+		var rec struct {
+			Name string `json:"qname"`
+		}
+		require.Nil(t, json.Unmarshal([]byte(line), &rec))
+		require.Len(t, rec.Name, 64)
+		names = append(names, rec.Name)
+	}
+	require.Equal(t, names[0], names[1])
+	require.NotEqual(t, names[0], names[2])
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.ndjson")
+	l, err := NewQueryLog(QueryLogConfig{File: FileConfig{Path: path, MaxSize: 100}}, nil)
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		l.LogQuery(tunnel.QueryRecord{Name: "tunnel.example.com.", Type: dns.TypeA, Disposition: tunnel.DispositionFragment})
+	}
+	require.Nil(t, l.Close())
+	require.Len(t, readLines(t, path), 1)
+	require.Len(t, rotatedFiles(t, path), 2)
+}
@@ -0,0 +1,140 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// RedisConfig configures a Redis.
+type RedisConfig struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// Channel is the channel messages are published to.
+	Channel string
+	// Username and Password are used to AUTH with the server if Password is not empty. Username
+	// may be empty for servers without ACLs.
+	Username string
+	Password string
+}
+
+// A Redis PUBLISHes each message as JSON to a Redis channel.
+type Redis struct {
+	cfg RedisConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedis returns a Redis that publishes to the channel described by cfg. The connection is made
+// lazily as messages are delivered, and remade if a command fails.
+func NewRedis(cfg RedisConfig) (*Redis, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("Redis sink requires an address")
+	}
+	if cfg.Channel == "" {
+		return nil, fmt.Errorf("Redis sink requires a channel")
+	}
+	return &Redis{cfg: cfg}, nil
+}
+
+// Deliver publishes msg. Publishing succeeds even if no clients are subscribed to the channel.
+func (rs *Redis) Deliver(ctx context.Context, msg tunnel.Message) error {
+	body, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.conn == nil {
+		if err := rs.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if _, err := rs.do(ctx, "PUBLISH", []byte(rs.cfg.Channel), body); err != nil {
+		rs.conn.Close()
+		rs.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server.
+func (rs *Redis) Close() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.conn == nil {
+		return nil
+	}
+	err := rs.conn.Close()
+	rs.conn = nil
+	return err
+}
+
+func (rs *Redis) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", rs.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	rs.conn = conn
+	rs.r = bufio.NewReader(conn)
+	if rs.cfg.Password == "" {
+		return nil
+	}
+
+	args := [][]byte{[]byte(rs.cfg.Password)}
+	if rs.cfg.Username != "" {
+		args = append([][]byte{[]byte(rs.cfg.Username)}, args...)
+	}
+	if _, err := rs.do(ctx, "AUTH", args...); err != nil {
+		conn.Close()
+		rs.conn = nil
+		return err
+	}
+	return nil
+}
+
+// do sends a command in the RESP protocol and returns its reply, which must be a simple string or
+// an integer.
+func (rs *Redis) do(ctx context.Context, cmd string, args ...[]byte) (string, error) {
+	setDeadline(ctx, rs.conn)
+
+	var req []byte
+	req = append(req, fmt.Sprintf("*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)...)
+	for _, arg := range args {
+		req = append(req, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		req = append(req, arg...)
+		req = append(req, "\r\n"...)
+	}
+	if _, err := rs.conn.Write(req); err != nil {
+		return "", err
+	}
+
+	line, err := rs.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("Empty reply to Redis %s", cmd)
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("Redis %s failed: %s", cmd, line[1:])
+	default:
+		return "", fmt.Errorf("Unexpected reply to Redis %s: %q", cmd, line)
+	}
+}
@@ -0,0 +1,97 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis accepts a single connection and answers each command with the next reply, sending
+// the arguments of each command on commands.
+func fakeRedis(t *testing.T, replies ...string) (string, <-chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	commands := make(chan []string, len(replies))
+	go func() {
+		defer l.Close()
+		defer close(commands)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for _, reply := range replies {
+			cmd, err := readCommand(r)
+			if err != nil {
+				return
+			}
+			commands <- cmd
+			conn.Write([]byte(reply + "\r\n"))
+		}
+	}()
+	return l.Addr().String(), commands
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(arg[:size])
+	}
+	return cmd, nil
+}
+
+func TestRedis(t *testing.T) {
+	addr, commands := fakeRedis(t, "+OK", ":2", ":0")
+	rs, err := NewRedis(RedisConfig{Addr: addr, Channel: "messages", Password: "hunter2"})
+	require.Nil(t, err)
+	defer rs.Close()
+
+	require.Nil(t, rs.Deliver(context.Background(), testMessage))
+	require.Nil(t, rs.Deliver(context.Background(), testMessage))
+
+	body, err := Marshal(testMessage)
+	require.Nil(t, err)
+	require.Equal(t, []string{"AUTH", "hunter2"}, <-commands)
+	require.Equal(t, []string{"PUBLISH", "messages", string(body)}, <-commands)
+	require.Equal(t, []string{"PUBLISH", "messages", string(body)}, <-commands)
+}
+
+func TestRedisErrors(t *testing.T) {
+	addr, _ := fakeRedis(t, "-WRONGPASS invalid username-password pair")
+	rs, err := NewRedis(RedisConfig{Addr: addr, Channel: "messages", Username: "u", Password: "p"})
+	require.Nil(t, err)
+	require.NotNil(t, rs.Deliver(context.Background(), testMessage))
+	require.Nil(t, rs.Close())
+
+	_, err = NewRedis(RedisConfig{Channel: "messages"})
+	require.NotNil(t, err)
+	_, err = NewRedis(RedisConfig{Addr: addr})
+	require.NotNil(t, err)
+}
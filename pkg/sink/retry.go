@@ -0,0 +1,213 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// Default values of RetryPolicy.Backoff and RetryPolicy.MaxBackoff.
+const (
+	DefaultRetryBackoff    = time.Second
+	DefaultRetryMaxBackoff = 5 * time.Minute
+)
+
+// errFanoutClosed is the error that the messages still waiting in an in-memory retry queue are
+// given up on with when their Fanout is closed.
+var errFanoutClosed = errors.New("Fanout was closed before the message could be delivered")
+
+// errQueued is the outcome reported to probes of a message queued behind the messages waiting to
+// be retried, which hasn't been attempted.
+var errQueued = errors.New("Message is queued behind messages waiting to be retried")
+
+// A RetryPolicy makes a Fanout retry the failed deliveries to a sink, so that messages are
+// delivered at least once even if the sink is unavailable for a while. A failed message waits in
+// a queue along with the messages that arrive after it, and the oldest message of the queue is
+// retried with exponential backoff until it is delivered or it runs out of attempts, so that the
+// sink still receives messages in order.
+type RetryPolicy struct {
+	// Attempts is the number of times delivery of a message is attempted before it is given up
+	// on. Retries are disabled if it is less than 2.
+	Attempts int
+	// Backoff is the delay before the first retry, which doubles after every failed attempt up to
+	// MaxBackoff. They default to DefaultRetryBackoff and DefaultRetryMaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Queue holds the messages waiting to be delivered. Defaults to a queue in memory, whose
+	// messages are given up on when the Fanout is closed. Messages left in a persistent queue,
+	// such as a store.BoltQueue, are retried by the next Fanout using it, with their attempts
+	// counted afresh.
+	Queue tunnel.Spool
+	// DeadLetter, if set, receives the messages given up on, e.g. a File, with the tags
+	// dead_letter_sink, dead_letter_error and dead_letter_attempts added. Otherwise they are only
+	// logged. The Fanout doesn't close it.
+	DeadLetter Sink
+}
+
+// backoff returns the delay before retrying a message that failed attempts times.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempts && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxBackoff)
+}
+
+// A memoryQueue is a tunnel.Spool held in memory.
+type memoryQueue struct {
+	messages []tunnel.Message
+}
+
+func (q *memoryQueue) Push(msg tunnel.Message) error {
+	q.messages = append(q.messages, msg)
+	return nil
+}
+
+func (q *memoryQueue) Peek() (tunnel.Message, bool, error) {
+	if len(q.messages) == 0 {
+		return tunnel.Message{}, false, nil
+	}
+	return q.messages[0], true, nil
+}
+
+func (q *memoryQueue) Pop() error {
+	if len(q.messages) > 0 {
+		q.messages[0] = tunnel.Message{}
+		q.messages = q.messages[1:]
+	}
+	return nil
+}
+
+func (q *memoryQueue) Len() (int, error) {
+	return len(q.messages), nil
+}
+
+// runRetrying delivers the messages queued for out according to its retry policy, until the
+// queue is closed.
+func (f *Fanout) runRetrying(out *output) {
+	policy := out.Retry
+	// attempts counts the failed attempts to deliver the oldest message of the retry queue.
+	attempts := 0
+	var due <-chan time.Time
+	if out.queued.Load() > 0 {
+		due = time.After(0)
+	}
+	for {
+		select {
+		case d, ok := <-out.queue:
+			if !ok {
+				f.abandon(out, attempts)
+				return
+			}
+			msg := d.msg
+			// Messages only skip the retry queue while it is empty, so that they stay in order.
+			tried := 0
+			if out.breaker.wait(time.Now()) > 0 {
+				// The message waits for the breaker to close along with those already queued.
+				d.reply(ErrBreakerOpen)
+			} else if out.queued.Load() == 0 {
+				err := f.attempt(out, msg)
+				d.reply(err)
+				if err == nil {
+					continue
+				}
+				tried = 1
+				f.logger.Warn("Failed to deliver message, retrying", "sink", out.Name, "id", msg.ID, "attempt", tried, "error", err)
+			} else {
+				d.reply(errQueued)
+			}
+			if err := policy.Queue.Push(msg); err != nil {
+				f.deadLetter(out, msg, err, tried)
+				continue
+			}
+			if out.queued.Add(1) == 1 {
+				attempts = tried
+				due = time.After(policy.backoff(attempts))
+			}
+		case <-due:
+			// Retrying after Shutdown gave up would only give up on the message early.
+			if f.ctx.Err() != nil {
+				due = nil
+				continue
+			}
+			// While the breaker is open, the oldest message waits for it without using up attempts.
+			if wait := out.breaker.wait(time.Now()); wait > 0 {
+				due = time.After(wait)
+				continue
+			}
+			msg, ok, err := policy.Queue.Peek()
+			if err != nil {
+				f.logger.Warn("Failed to read retry queue", "sink", out.Name, "error", err)
+				due = time.After(policy.MaxBackoff)
+				continue
+			}
+			if !ok {
+				out.queued.Store(0)
+				due = nil
+				continue
+			}
+			atomic.AddUint64(&out.retried, 1)
+			err = f.attempt(out, msg)
+			if err != nil {
+				attempts++
+				if attempts < policy.Attempts {
+					f.logger.Warn("Failed to deliver message, retrying", "sink", out.Name, "id", msg.ID, "attempt", attempts, "error", err)
+					due = time.After(policy.backoff(attempts))
+					continue
+				}
+				f.deadLetter(out, msg, err, attempts)
+			}
+			if err := policy.Queue.Pop(); err != nil {
+				f.logger.Warn("Failed to remove message from retry queue", "sink", out.Name, "id", msg.ID, "error", err)
+			}
+			attempts = 0
+			due = nil
+			if out.queued.Add(-1) > 0 {
+				due = time.After(0)
+			}
+		}
+	}
+}
+
+// abandon gives up on the messages left in the retry queue of out when its Fanout is closed, if
+// the queue is in memory, the oldest of which failed attempts times. Messages in persistent
+// queues are kept for the next Fanout.
+func (f *Fanout) abandon(out *output, attempts int) {
+	q, ok := out.Retry.Queue.(*memoryQueue)
+	if !ok {
+		return
+	}
+	for i, msg := range q.messages {
+		if i > 0 {
+			attempts = 0
+		}
+		f.deadLetter(out, msg, errFanoutClosed, attempts)
+	}
+	q.messages = nil
+	out.queued.Store(0)
+}
+
+// deadLetter gives up on delivering msg to out after attempts failed with err.
+func (f *Fanout) deadLetter(out *output, msg tunnel.Message, err error, attempts int) {
+	atomic.AddUint64(&out.failed, 1)
+	atomic.AddUint64(&out.deadLettered, 1)
+	f.logger.Warn("Giving up on message", "sink", out.Name, "id", msg.ID, "attempts", attempts, "error", err)
+	if out.Retry.DeadLetter == nil {
+		return
+	}
+	tags := make(map[string]string, len(msg.Tags)+3)
+	for k, v := range msg.Tags {
+		tags[k] = v
+	}
+	tags["dead_letter_sink"] = out.Name
+	tags["dead_letter_error"] = err.Error()
+	tags["dead_letter_attempts"] = strconv.Itoa(attempts)
+	msg.Tags = tags
+	if err := out.Retry.DeadLetter.Deliver(context.Background(), msg); err != nil {
+		f.logger.Warn("Failed to write dead letter", "sink", out.Name, "id", msg.ID, "error", err)
+	}
+}
@@ -0,0 +1,128 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// flaky is a Sink that fails to deliver each message as many times as given in failures, or
+// forever if negative, and records the messages it delivers.
+type flaky struct {
+	mu       sync.Mutex
+	failures map[string]int
+	messages []tunnel.Message
+}
+
+func (s *flaky) Deliver(ctx context.Context, msg tunnel.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.failures[msg.ID]; n != 0 {
+		s.failures[msg.ID] = n - 1
+		return fmt.Errorf("failed to deliver %s", msg.ID)
+	}
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+func (s *flaky) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for _, msg := range s.messages {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+// persistentQueue is a queue that a Fanout doesn't know to be in memory.
+type persistentQueue struct {
+	memoryQueue
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	for attempts, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		require.Equal(t, want, p.backoff(attempts), attempts)
+	}
+}
+
+func TestFanoutRetry(t *testing.T) {
+	s := &flaky{failures: map[string]int{"m1": 2}}
+	f := NewFanout(nil, Named{Name: "s", Sink: s, Retry: RetryPolicy{Attempts: 3, Backoff: time.Millisecond}})
+
+	// Messages wait behind the message being retried.
+	for _, id := range []string{"m1", "m2"} {
+		require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: id}))
+	}
+	require.Eventually(t, func() bool { return len(s.ids()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, []string{"m1", "m2"}, s.ids())
+	require.Empty(t, f.Failing())
+	require.Nil(t, f.Close())
+
+	values := map[string]float64{}
+	for _, m := range f.Collect() {
+		values[m.Name] = m.Value
+	}
+	require.Equal(t, float64(2), values["browsertunnel_sink_delivered_total"])
+	require.Equal(t, float64(0), values["browsertunnel_sink_errors_total"])
+	require.Equal(t, float64(3), values["browsertunnel_sink_retries_total"])
+	require.Equal(t, float64(0), values["browsertunnel_sink_dead_lettered_total"])
+	require.Equal(t, float64(0), values["browsertunnel_sink_retry_queue"])
+}
+
+func TestFanoutDeadLetter(t *testing.T) {
+	s := &flaky{failures: map[string]int{"m1": -1}}
+	dead := &flaky{}
+	f := NewFanout(nil, Named{Name: "s", Sink: s, Retry: RetryPolicy{Attempts: 3, Backoff: time.Millisecond, DeadLetter: dead}})
+
+	for _, id := range []string{"m1", "m2"} {
+		require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: id, Tags: map[string]string{"hook": "lua"}}))
+	}
+	require.Eventually(t, func() bool { return len(s.ids()) == 1 }, time.Second, time.Millisecond)
+	require.Nil(t, f.Close())
+
+	require.Equal(t, []string{"m2"}, s.ids())
+	require.Len(t, dead.messages, 1)
+	require.Equal(t, "m1", dead.messages[0].ID)
+	require.Equal(t, map[string]string{
+		"hook":                 "lua",
+		"dead_letter_sink":     "s",
+		"dead_letter_error":    "failed to deliver m1",
+		"dead_letter_attempts": "3",
+	}, dead.messages[0].Tags)
+	require.Equal(t, map[string]string{"hook": "lua"}, s.messages[0].Tags)
+}
+
+func TestFanoutRetryClose(t *testing.T) {
+	// Messages waiting in memory are given up on when the fanout is closed.
+	s := &flaky{failures: map[string]int{"m1": -1}}
+	dead := &flaky{}
+	f := NewFanout(nil, Named{Name: "s", Sink: s, Retry: RetryPolicy{Attempts: 3, Backoff: time.Hour, DeadLetter: dead}})
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m1"}))
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m2"}))
+	require.Nil(t, f.Close())
+	require.Empty(t, s.ids())
+	require.Equal(t, []string{"m1", "m2"}, dead.ids())
+
+	// Those in a persistent queue are delivered by the next fanout using it.
+	queue := &persistentQueue{}
+	f = NewFanout(nil, Named{Name: "s", Sink: s, Retry: RetryPolicy{Attempts: 3, Backoff: time.Hour, Queue: queue}})
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m1"}))
+	require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: "m3"}))
+	require.Nil(t, f.Close())
+	n, err := queue.Len()
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+
+	s.failures["m1"] = 0
+	f = NewFanout(nil, Named{Name: "s", Sink: s, Retry: RetryPolicy{Attempts: 3, Backoff: time.Hour, Queue: queue}})
+	require.Eventually(t, func() bool { return len(s.ids()) == 2 }, time.Second, time.Millisecond)
+	require.Nil(t, f.Close())
+	require.Equal(t, []string{"m1", "m3"}, s.ids())
+}
@@ -0,0 +1,187 @@
+package sink
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// A Rule matches messages, to route them to specific sinks of a Fanout and tag them. A message
+// matches a rule if it passes every condition that is set.
+type Rule struct {
+	// Name identifies the rule in metrics.
+	Name string
+
+	// Payload, if not nil, must match the payload.
+	Payload *regexp.Regexp
+	// Tenant, if not empty, must be the tenant the message was sent to.
+	Tenant string
+	// Sources, if not empty, must contain the address the message came from.
+	Sources []*net.IPNet
+	// MinSize and MaxSize, if not 0, bound the size of the payload in bytes.
+	MinSize int
+	MaxSize int
+
+	// Sinks are the names of the sinks that matching messages are routed to.
+	Sinks []string
+	// Tags are added to the tags of matching messages.
+	Tags map[string]string
+}
+
+// ParseRule parses a rule as passed on the command line: its name followed by space separated
+// key=value conditions and actions, e.g.
+//
+//	alerts payload=(?i)password tenant=alpha source=10.0.0.0/8 sinks=slack,archive tag:severity=high
+//
+// The keys are payload, tenant, source, minSize, maxSize, sinks and tag:NAME. Sources and sinks
+// are comma separated, and source and tag may be repeated. Payload patterns can't contain
+// spaces, which can be matched with \s or \x20 instead.
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Rule{}, fmt.Errorf("Rule must have a name")
+	}
+	r := Rule{Name: fields[0]}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Rule{}, fmt.Errorf("Invalid condition %q in rule %s, expected key=value", field, r.Name)
+		}
+		var err error
+		switch {
+		case key == "payload":
+			r.Payload, err = regexp.Compile(value)
+		case key == "tenant":
+			r.Tenant = value
+		case key == "source":
+			for _, cidr := range strings.Split(value, ",") {
+				var ipNet *net.IPNet
+				if _, ipNet, err = net.ParseCIDR(cidr); err != nil {
+					break
+				}
+				r.Sources = append(r.Sources, ipNet)
+			}
+		case key == "minSize":
+			r.MinSize, err = strconv.Atoi(value)
+		case key == "maxSize":
+			r.MaxSize, err = strconv.Atoi(value)
+		case key == "sinks":
+			r.Sinks = append(r.Sinks, strings.Split(value, ",")...)
+		case strings.HasPrefix(key, "tag:") && len(key) > len("tag:"):
+			if r.Tags == nil {
+				r.Tags = make(map[string]string)
+			}
+			r.Tags[strings.TrimPrefix(key, "tag:")] = value
+		default:
+			return Rule{}, fmt.Errorf("Unknown key %q in rule %s", key, r.Name)
+		}
+		if err != nil {
+			return Rule{}, fmt.Errorf("Invalid %s in rule %s: %w", key, r.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// matches reports whether msg passes every condition of r.
+func (r *Rule) matches(msg tunnel.Message) bool {
+	if r.Tenant != "" && !strings.EqualFold(r.Tenant, msg.Tenant) {
+		return false
+	}
+	if r.MinSize != 0 && len(msg.Payload) < r.MinSize || r.MaxSize != 0 && len(msg.Payload) > r.MaxSize {
+		return false
+	}
+	if len(r.Sources) > 0 {
+		found := false
+		for _, ipNet := range r.Sources {
+			found = found || msg.Source != nil && ipNet.Contains(msg.Source)
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.Payload == nil || r.Payload.Match(msg.Payload)
+}
+
+// ruleState is a Rule of a Fanout, with its counter.
+type ruleState struct {
+	Rule
+	matched uint64
+}
+
+// SetRules makes f route messages with rules. Messages that match rules naming sinks are delivered
+// only to those sinks. Other messages are delivered to the sinks that no rule names, the way they
+// are without rules. Every matching rule adds its tags. The sinks must be sinks of f, and
+// SetRules must be called before messages are delivered.
+func (f *Fanout) SetRules(rules ...Rule) error {
+	names := make(map[string]bool, len(f.outputs))
+	for _, out := range f.outputs {
+		names[out.Name] = true
+	}
+	f.rules, f.routed = nil, make(map[string]bool)
+	for _, r := range rules {
+		if r.Name == "" {
+			return fmt.Errorf("Rules must have a name")
+		}
+		if r.MinSize < 0 || r.MaxSize < 0 {
+			return fmt.Errorf("Sizes of rule %s must not be negative", r.Name)
+		}
+		for _, name := range r.Sinks {
+			if !names[name] {
+				return fmt.Errorf("Rule %s routes to sink %s, which is not enabled", r.Name, name)
+			}
+			f.routed[name] = true
+		}
+		f.rules = append(f.rules, &ruleState{Rule: r})
+	}
+	return nil
+}
+
+// route applies the schema and the rules to msg. It returns msg with the tags of the matching
+// rules, and the names of the sinks they route it to, or nil if they don't. Messages that fail
+// validation are only routed to the quarantine sink, without applying the rules.
+func (f *Fanout) route(msg tunnel.Message) (tunnel.Message, map[string]bool) {
+	if msg, sinks := f.validate(msg); sinks != nil {
+		return msg, sinks
+	}
+	var sinks map[string]bool
+	tagged := false
+	for _, r := range f.rules {
+		if !r.matches(msg) {
+			continue
+		}
+		atomic.AddUint64(&r.matched, 1)
+		for _, name := range r.Sinks {
+			if sinks == nil {
+				sinks = make(map[string]bool)
+			}
+			sinks[name] = true
+		}
+		if len(r.Tags) > 0 && !tagged {
+			tags := make(map[string]string, len(msg.Tags)+len(r.Tags))
+			for k, v := range msg.Tags {
+				tags[k] = v
+			}
+			msg.Tags, tagged = tags, true
+		}
+		for k, v := range r.Tags {
+			msg.Tags[k] = v
+		}
+	}
+	return msg, sinks
+}
+
+// receives reports whether out receives msg, which the rules routed to sinks.
+func (f *Fanout) receives(out *output, msg tunnel.Message, sinks map[string]bool) bool {
+	if out.Tenant != "" && out.Tenant != msg.Tenant {
+		return false
+	}
+	if sinks != nil {
+		return sinks[out.Name]
+	}
+	return !f.routed[out.Name] && (f.schema == nil || out.Name != f.quarantine)
+}
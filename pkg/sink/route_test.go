@@ -0,0 +1,125 @@
+package sink
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestParseRule(t *testing.T) {
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	_, docNet, _ := net.ParseCIDR("192.0.2.0/24")
+	tests := []struct {
+		input  string
+		fails  bool
+		output Rule
+	}{
+		{input: "all", output: Rule{Name: "all"}},
+		{
+			input: "alerts payload=(?i)pass\\x20word tenant=alpha source=10.0.0.0/8,192.0.2.0/24 minSize=1 maxSize=100 sinks=slack,archive tag:severity=high",
+			output: Rule{
+				Name:    "alerts",
+				Payload: regexp.MustCompile(`(?i)pass\x20word`),
+				Tenant:  "alpha",
+				Sources: []*net.IPNet{tenNet, docNet},
+				MinSize: 1,
+				MaxSize: 100,
+				Sinks:   []string{"slack", "archive"},
+				Tags:    map[string]string{"severity": "high"},
+			},
+		},
+		{input: "", fails: true},
+		{input: "bad payload", fails: true},
+		{input: "bad payload=(", fails: true},
+		{input: "bad source=10.0.0.0", fails: true},
+		{input: "bad minSize=x", fails: true},
+		{input: "bad tag:=x", fails: true},
+		{input: "bad color=red", fails: true},
+	}
+	for _, test := range tests {
+		got, err := ParseRule(test.input)
+		if test.fails {
+			require.NotNil(t, err, test.input)
+			continue
+		}
+		require.Nil(t, err, test.input)
+		require.Equal(t, test.output, got, test.input)
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	_, docNet, _ := net.ParseCIDR("192.0.2.0/24")
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		rule    Rule
+		matches bool
+	}{
+		{rule: Rule{}, matches: true},
+		{rule: Rule{Payload: regexp.MustCompile("wor")}, matches: true},
+		{rule: Rule{Payload: regexp.MustCompile("^world")}},
+		{rule: Rule{Tenant: "Alpha"}, matches: true},
+		{rule: Rule{Tenant: "beta"}},
+		{rule: Rule{Sources: []*net.IPNet{tenNet, docNet}}, matches: true},
+		{rule: Rule{Sources: []*net.IPNet{tenNet}}},
+		{rule: Rule{MinSize: 11, MaxSize: 11}, matches: true},
+		{rule: Rule{MinSize: 12}},
+		{rule: Rule{MaxSize: 10}},
+	}
+	msg := testMessage
+	msg.Tenant = "alpha"
+	for _, test := range tests {
+		require.Equal(t, test.matches, test.rule.matches(msg), test.rule)
+	}
+}
+
+func TestFanoutRules(t *testing.T) {
+	bulk, alerts, archive := &recorder{}, &recorder{}, &tagRecorder{}
+	f := NewFanout(nil, Named{Name: "bulk", Sink: bulk}, Named{Name: "alerts", Sink: alerts}, Named{Name: "archive", Sink: archive})
+	require.Nil(t, f.SetRules(
+		Rule{Name: "secrets", Payload: regexp.MustCompile("password"), Sinks: []string{"alerts", "archive"}, Tags: map[string]string{"severity": "high"}},
+		Rule{Name: "large", MinSize: 100, Sinks: []string{"archive"}},
+		Rule{Name: "tagged", Payload: regexp.MustCompile("tag"), Tags: map[string]string{"tagged": "yes"}},
+	))
+	for _, msg := range []tunnel.Message{
+		{ID: "m1", Payload: []byte("hello")},
+		{ID: "m2", Payload: []byte("my password"), Tags: map[string]string{"source": "test"}},
+		{ID: "m3", Payload: make([]byte, 100)},
+		{ID: "m4", Payload: []byte("tag me")},
+	} {
+		require.Nil(t, f.Deliver(context.Background(), msg))
+	}
+	require.Nil(t, f.Close())
+
+	// Messages that no rule routes are delivered to the sinks that no rule names.
+	require.Equal(t, []string{"m1", "m4"}, bulk.ids)
+	require.Equal(t, []string{"m2"}, alerts.ids)
+	require.Equal(t, []string{"m2", "m3"}, archive.ids)
+	require.Equal(t, map[string]string{"source": "test", "severity": "high"}, archive.tags[0])
+	matches := map[string]float64{}
+	for _, m := range f.Collect() {
+		if m.Name == "browsertunnel_sink_rule_matches_total" {
+			matches[m.Labels["rule"]] = m.Value
+		}
+	}
+	require.Equal(t, map[string]float64{"secrets": 1, "large": 1, "tagged": 1}, matches)
+
+	f = NewFanout(nil, Named{Name: "bulk", Sink: bulk})
+	defer f.Close()
+	require.NotNil(t, f.SetRules(Rule{Name: "missing", Sinks: []string{"archive"}}))
+	require.NotNil(t, f.SetRules(Rule{Sinks: []string{"bulk"}}))
+}
+
+// tagRecorder is a recorder that also records the tags of delivered messages.
+type tagRecorder struct {
+	recorder
+	tags []map[string]string
+}
+
+func (r *tagRecorder) Deliver(ctx context.Context, msg tunnel.Message) error {
+	r.tags = append(r.tags, msg.Tags)
+	return r.recorder.Deliver(ctx, msg)
+}
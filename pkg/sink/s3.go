@@ -0,0 +1,167 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An ObjectStore stores objects by key, as implemented by S3.
+type ObjectStore interface {
+	// Put stores body under key, replacing any object already stored there.
+	Put(ctx context.Context, key, contentType string, body []byte) error
+}
+
+// S3Config configures an S3.
+type S3Config struct {
+	// Bucket is the bucket objects are stored in.
+	Bucket string
+	// Region is the region of the bucket, e.g. us-east-1, or auto for Google Cloud Storage.
+	Region string
+	// Endpoint is the URL of an S3 compatible service, e.g. https://storage.googleapis.com for
+	// Google Cloud Storage or http://localhost:9000 for MinIO, which addresses buckets in the
+	// path of requests. Buckets of Amazon S3 in Region are addressed by host name if empty.
+	Endpoint string
+	// AccessKey and SecretKey sign requests, along with SessionToken for temporary credentials.
+	// Google Cloud Storage accepts the HMAC keys of a service account.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client is used to make requests. http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+// An S3 stores objects in a bucket of Amazon S3 or of an S3 compatible service, such as Google
+// Cloud Storage or MinIO, with requests signed with AWS Signature Version 4.
+type S3 struct {
+	cfg  S3Config
+	base *url.URL
+	now  func() time.Time
+}
+
+// NewS3 returns an S3 storing objects in the bucket described by cfg.
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 requires a bucket")
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("S3 requires a region")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("S3 requires an access key and a secret key")
+	}
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com", cfg.Bucket, cfg.Region)
+	if cfg.Endpoint != "" {
+		endpoint = strings.TrimSuffix(cfg.Endpoint, "/") + "/" + cfg.Bucket
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("S3 endpoint %q must be an http or https URL", cfg.Endpoint)
+	}
+	return &S3{cfg: cfg, base: base, now: time.Now}, nil
+}
+
+// Put uploads body to key with a single PUT request.
+func (s *S3) Put(ctx context.Context, key, contentType string, body []byte) error {
+	u := *s.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(key, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, "s3", s.now())
+
+	client := s.cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("S3 responded to PUT %s with %s: %s", key, resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+// signV4 signs req with AWS Signature Version 4, covering its host and every header already set
+// on it. payloadHash is the hex encoded SHA-256 of the body.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// uriEncode percent-encodes every byte of the path s other than slashes and the unreserved
+// characters of RFC 3986, as Signature Version 4 requires.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', strings.IndexByte("-._~/", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// SampleRateTag is the tag holding the rate that a message delivered to a sampled sink was sampled
+// at, so that consumers can scale counts back up to the true volume.
+const SampleRateTag = "sample_rate"
+
+// A Sampling delivers only a fraction of the messages to a sink of a Fanout, e.g. to keep the
+// volume sent to an expensive sink down. Which messages are sampled is decided by a hash of their
+// tenant, ID and first fragment time, so that sinks sampled at the same rate receive the same
+// messages, including when they are retried or replayed.
+type Sampling struct {
+	// Rate is the fraction of messages delivered, between 0 and 1. It is 1 if 0.
+	Rate float64
+	// Clients overrides Rate for the messages of clients in specific networks, the first of which
+	// that contains the client applies. The client of a message is the address of its
+	// ClientSubnet, if the resolver forwarded it, and otherwise its Source.
+	Clients []ClientRate
+}
+
+// A ClientRate is the sampling rate of the clients in a network.
+type ClientRate struct {
+	Network *net.IPNet
+	// Rate is the fraction of messages delivered, between 0 and 1. No messages are delivered if
+	// it is 0.
+	Rate float64
+}
+
+// ParseClientRate parses a client rate as passed on the command line: cidr=rate, e.g.
+// 10.0.0.0/8=0.01.
+func ParseClientRate(s string) (ClientRate, error) {
+	cidr, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return ClientRate{}, fmt.Errorf("Invalid client rate %q, expected cidr=rate", s)
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ClientRate{}, fmt.Errorf("Invalid network of client rate %q: %w", s, err)
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return ClientRate{}, fmt.Errorf("Invalid rate of client rate %q, expected a number between 0 and 1", s)
+	}
+	return ClientRate{Network: network, Rate: rate}, nil
+}
+
+// enabled reports whether s delivers fewer than all messages.
+func (s Sampling) enabled() bool {
+	return s.Rate > 0 && s.Rate < 1 || len(s.Clients) > 0
+}
+
+// rate returns the rate that msg is sampled at.
+func (s Sampling) rate(msg tunnel.Message) float64 {
+	client := msg.Source
+	if msg.ClientSubnet != nil {
+		client = msg.ClientSubnet.IP
+	}
+	for _, c := range s.Clients {
+		if client != nil && c.Network.Contains(client) {
+			return c.Rate
+		}
+	}
+	if s.Rate == 0 {
+		return 1
+	}
+	return s.Rate
+}
+
+// sample reports whether msg is sampled, and returns it tagged with the rate it was sampled at if
+// that is less than 1.
+func (s Sampling) sample(msg tunnel.Message) (tunnel.Message, bool) {
+	if !s.enabled() {
+		return msg, true
+	}
+	rate := s.rate(msg)
+	if rate >= 1 {
+		return msg, true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(msg.Tenant))
+	h.Write([]byte{0})
+	h.Write([]byte(msg.ID))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(msg.FirstFragment.UnixNano())))
+	// FNV doesn't mix the bits of short inputs well, so the hash is finalized like MurmurHash3's
+	// before its top 53 bits are taken as a uniformly distributed float64 in [0, 1).
+	x := h.Sum64()
+	x = (x ^ x>>33) * 0xff51afd7ed558ccd
+	x = (x ^ x>>33) * 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	if float64(x>>11)/(1<<53) >= rate {
+		return msg, false
+	}
+	tags := make(map[string]string, len(msg.Tags)+1)
+	for k, v := range msg.Tags {
+		tags[k] = v
+	}
+	tags[SampleRateTag] = strconv.FormatFloat(rate, 'g', -1, 64)
+	msg.Tags = tags
+	return msg, true
+}
+
+// sample applies the sampling of out to msg, counting the messages it doesn't deliver.
+func (out *output) sample(msg tunnel.Message) (tunnel.Message, bool) {
+	msg, ok := out.Sampling.sample(msg)
+	if !ok {
+		atomic.AddUint64(&out.sampledOut, 1)
+	}
+	return msg, ok
+}
@@ -0,0 +1,86 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestParseClientRate(t *testing.T) {
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		input  string
+		fails  bool
+		output ClientRate
+	}{
+		{input: "10.0.0.0/8=0.5", output: ClientRate{Network: tenNet, Rate: 0.5}},
+		{input: "10.1.2.3/8=0", output: ClientRate{Network: tenNet}},
+		{input: "10.0.0.0/8", fails: true},
+		{input: "10.0.0.0=0.5", fails: true},
+		{input: "10.0.0.0/8=x", fails: true},
+		{input: "10.0.0.0/8=1.5", fails: true},
+	}
+	for _, test := range tests {
+		got, err := ParseClientRate(test.input)
+		if test.fails {
+			require.NotNil(t, err, test.input)
+			continue
+		}
+		require.Nil(t, err, test.input)
+		require.Equal(t, test.output, got, test.input)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	_, clientNet, _ := net.ParseCIDR("192.0.2.0/24")
+	s := Sampling{Rate: 0.25, Clients: []ClientRate{{Network: tenNet, Rate: 0}, {Network: clientNet, Rate: 1}}}
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		msg := tunnel.Message{ID: fmt.Sprintf("m%d", i), Source: net.IPv4(198, 51, 100, 1), FirstFragment: start}
+		got, ok := s.sample(msg)
+		if ok {
+			sampled++
+			require.Equal(t, "0.25", got.Tags[SampleRateTag])
+			require.Nil(t, msg.Tags)
+		}
+		// The same message is always sampled the same way.
+		_, again := s.sample(msg)
+		require.Equal(t, ok, again)
+	}
+	require.InDelta(t, 1000, sampled, 100)
+
+	// Clients are matched by their subnet, if the resolver forwarded it, and otherwise by source.
+	_, ok := s.sample(tunnel.Message{ID: "m1", Source: net.IPv4(10, 0, 0, 1)})
+	require.False(t, ok)
+	got, ok := s.sample(tunnel.Message{ID: "m1", Source: net.IPv4(10, 0, 0, 1), ClientSubnet: clientNet})
+	require.True(t, ok)
+	require.Nil(t, got.Tags)
+	require.False(t, Sampling{}.enabled())
+	require.False(t, Sampling{Rate: 1}.enabled())
+}
+
+func TestFanoutSampling(t *testing.T) {
+	all, sampled := &recorder{}, &recorder{}
+	f := NewFanout(nil, Named{Name: "all", Sink: all}, Named{Name: "sampled", Sink: sampled, Sampling: Sampling{Rate: 0.5}})
+	for i := 0; i < 100; i++ {
+		require.Nil(t, f.Deliver(context.Background(), tunnel.Message{ID: fmt.Sprintf("m%d", i)}))
+	}
+	require.Nil(t, f.Close())
+	require.Len(t, all.ids, 100)
+	require.Greater(t, len(sampled.ids), 25)
+	require.Less(t, len(sampled.ids), 75)
+	values := map[string]float64{}
+	for _, m := range f.Collect() {
+		if m.Name == "browsertunnel_sink_sampled_out_total" {
+			values[m.Labels["sink"]] = m.Value
+		}
+	}
+	require.Equal(t, map[string]float64{"sampled": float64(100 - len(sampled.ids))}, values)
+}
@@ -0,0 +1,115 @@
+// Package sink forwards messages assembled by a tunnel to external systems.
+package sink
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// A Sink delivers messages to an external system. Deliver may be retried by the caller, and
+// should return once the message has been accepted or ctx is done.
+type Sink interface {
+	Deliver(ctx context.Context, msg tunnel.Message) error
+}
+
+// record is the JSON representation of a tunnel.Message shared by every sink.
+type record struct {
+	ID            string            `json:"id"`
+	Payload       string            `json:"payload"`
+	Binary        bool              `json:"binary,omitempty"`
+	Signer        string            `json:"signer,omitempty"`
+	Source        string            `json:"source"`
+	ClientSubnet  string            `json:"client_subnet,omitempty"`
+	QueryType     string            `json:"qtype"`
+	Domain        string            `json:"domain"`
+	Tenant        string            `json:"tenant,omitempty"`
+	Session       string            `json:"session,omitempty"`
+	Sequence      int               `json:"sequence,omitempty"`
+	Fragments     int               `json:"fragments"`
+	FirstFragment time.Time         `json:"first_fragment"`
+	LastFragment  time.Time         `json:"last_fragment"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// Marshal encodes msg as JSON. The payload of binary messages, and of text messages that aren't
+// valid UTF-8, is encoded in base64 and the record is marked with "binary": true, since JSON
+// strings can't carry arbitrary bytes.
+func Marshal(msg tunnel.Message) ([]byte, error) {
+	r := record{
+		ID:            msg.ID,
+		Payload:       string(msg.Payload),
+		Signer:        msg.Signer,
+		QueryType:     dns.TypeToString[msg.QueryType],
+		Domain:        msg.Domain,
+		Tenant:        msg.Tenant,
+		Session:       msg.Session,
+		Sequence:      msg.Sequence,
+		Fragments:     msg.Fragments,
+		FirstFragment: msg.FirstFragment,
+		LastFragment:  msg.LastFragment,
+		Tags:          msg.Tags,
+	}
+	if msg.Binary || !utf8.Valid(msg.Payload) {
+		r.Payload = base64.StdEncoding.EncodeToString(msg.Payload)
+		r.Binary = true
+	}
+	if msg.Source != nil {
+		r.Source = msg.Source.String()
+	}
+	if msg.ClientSubnet != nil {
+		r.ClientSubnet = msg.ClientSubnet.String()
+	}
+	return json.Marshal(r)
+}
+
+// A header is a piece of message metadata, delivered alongside a raw payload.
+type header struct {
+	key   string
+	value string
+}
+
+// rawHeaders returns the metadata of msg, for sinks that deliver its raw payload rather than JSON.
+func rawHeaders(msg tunnel.Message) []header {
+	headers := []header{
+		{"Browsertunnel-Id", msg.ID},
+		{"Browsertunnel-Qtype", dns.TypeToString[msg.QueryType]},
+		{"Browsertunnel-Domain", msg.Domain},
+		{"Browsertunnel-Fragments", strconv.Itoa(msg.Fragments)},
+		{"Browsertunnel-Binary", strconv.FormatBool(msg.Binary)},
+	}
+	if msg.Source != nil {
+		headers = append(headers, header{"Browsertunnel-Source", msg.Source.String()})
+	}
+	if msg.ClientSubnet != nil {
+		headers = append(headers, header{"Browsertunnel-Client-Subnet", msg.ClientSubnet.String()})
+	}
+	if msg.Tenant != "" {
+		headers = append(headers, header{"Browsertunnel-Tenant", msg.Tenant})
+	}
+	if msg.Session != "" {
+		headers = append(headers, header{"Browsertunnel-Session", msg.Session})
+	}
+	if msg.Sequence != 0 {
+		headers = append(headers, header{"Browsertunnel-Sequence", strconv.Itoa(msg.Sequence)})
+	}
+	if msg.Signer != "" {
+		headers = append(headers, header{"Browsertunnel-Signer", msg.Signer})
+	}
+	keys := make([]string, 0, len(msg.Tags))
+	for k := range msg.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		headers = append(headers, header{"Browsertunnel-Tag-" + k, msg.Tags[k]})
+	}
+	return headers
+}
@@ -0,0 +1,173 @@
+package sink
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// DefaultProbeInterval is how often a Spooler checks whether its sinks recovered by default.
+const DefaultProbeInterval = 10 * time.Second
+
+// A Prober is a Sink that can tell when it is down, and find out whether it recovered by
+// delivering a message synchronously, as implemented by Fanout.
+type Prober interface {
+	Sink
+	// Down reports whether the sink is failing.
+	Down() bool
+	// Probe delivers msg, and returns nil once it has been delivered.
+	Probe(ctx context.Context, msg tunnel.Message) error
+}
+
+// A Spooler is a Sink that delivers messages to a Prober, such as a Fanout, for as long as it is
+// up. Once it is Down, messages are appended to a spool instead, e.g. a store.Dir, and the oldest
+// of them is probed every probe interval until it is delivered, after which the spooled messages
+// are replayed in order. New messages wait in the spool until it is empty, so that they are
+// delivered in order too.
+type Spooler struct {
+	sink     Prober
+	spool    tunnel.Spool
+	interval time.Duration
+	logger   *slog.Logger
+
+	// mu serializes the use of spool, and the choice between spooling and delivering directly.
+	mu      sync.Mutex
+	spooled atomic.Int64
+	wake    chan struct{}
+	// ctx is the context of replays, which cancel cancels when the Spooler is closed.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	closed   sync.Once
+	total    uint64
+	replayed uint64
+	dropped  uint64
+}
+
+// NewSpooler returns a Spooler delivering to s, and spooling to spool while s is down. Messages
+// left in spool, e.g. by a previous run, are replayed. The interval defaults to
+// DefaultProbeInterval, and errors are logged to logger, or slog.Default() if it is nil.
+func NewSpooler(s Prober, spool tunnel.Spool, interval time.Duration, logger *slog.Logger) *Spooler {
+	if interval == 0 {
+		interval = DefaultProbeInterval
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sp := &Spooler{sink: s, spool: spool, interval: interval, logger: logger, wake: make(chan struct{}, 1)}
+	sp.ctx, sp.cancel = context.WithCancel(context.Background())
+	if n, err := spool.Len(); err != nil {
+		logger.Warn("Failed to read spool", "error", err)
+	} else {
+		sp.spooled.Store(int64(n))
+	}
+	sp.wg.Add(1)
+	go sp.replay()
+	return sp
+}
+
+// Deliver delivers msg to the sink, or appends it to the spool if the sink is down or messages
+// are waiting in the spool. It only returns an error if the spool is full or fails.
+func (sp *Spooler) Deliver(ctx context.Context, msg tunnel.Message) error {
+	sp.mu.Lock()
+	if sp.spooled.Load() == 0 && !sp.sink.Down() {
+		sp.mu.Unlock()
+		return sp.sink.Deliver(ctx, msg)
+	}
+	defer sp.mu.Unlock()
+	if err := sp.spool.Push(msg); err != nil {
+		atomic.AddUint64(&sp.dropped, 1)
+		sp.logger.Warn("Dropping message, failed to spool it", "id", msg.ID, "error", err)
+		return err
+	}
+	atomic.AddUint64(&sp.total, 1)
+	if sp.spooled.Add(1) == 1 {
+		sp.logger.Warn("Sinks are down, spooling messages")
+		select {
+		case sp.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// replay delivers the spooled messages once the sink is up, until the Spooler is closed.
+func (sp *Spooler) replay() {
+	defer sp.wg.Done()
+	for {
+		if sp.spooled.Load() == 0 {
+			select {
+			case <-sp.wake:
+				continue
+			case <-sp.ctx.Done():
+				return
+			}
+		}
+		if !sp.replayOldest() {
+			select {
+			case <-time.After(sp.interval):
+			case <-sp.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// replayOldest delivers the oldest spooled message, probing the sink if it is down. It reports
+// whether the message was delivered.
+func (sp *Spooler) replayOldest() bool {
+	sp.mu.Lock()
+	msg, ok, err := sp.spool.Peek()
+	sp.mu.Unlock()
+	if err != nil {
+		sp.logger.Warn("Failed to read spool", "error", err)
+		return false
+	}
+	if !ok {
+		sp.spooled.Store(0)
+		return true
+	}
+	if sp.sink.Down() {
+		err = sp.sink.Probe(sp.ctx, msg)
+	} else {
+		err = sp.sink.Deliver(sp.ctx, msg)
+	}
+	if err != nil {
+		return false
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if err := sp.spool.Pop(); err != nil {
+		sp.logger.Warn("Failed to remove message from spool", "id", msg.ID, "error", err)
+	}
+	atomic.AddUint64(&sp.replayed, 1)
+	if sp.spooled.Add(-1) == 0 {
+		sp.logger.Info("Sinks recovered, replayed spooled messages")
+	}
+	return true
+}
+
+// Close stops replaying spooled messages, which are left in the spool. It doesn't close the sink
+// or the spool.
+func (sp *Spooler) Close() error {
+	sp.closed.Do(func() {
+		sp.cancel()
+		sp.wg.Wait()
+	})
+	return nil
+}
+
+// Collect implements metrics.Collector.
+func (sp *Spooler) Collect() []metrics.Metric {
+	return []metrics.Metric{
+		{Name: "browsertunnel_sink_spooled_total", Help: "Messages spooled because every sink was down.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&sp.total))},
+		{Name: "browsertunnel_sink_replayed_total", Help: "Spooled messages replayed once the sinks recovered.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&sp.replayed))},
+		{Name: "browsertunnel_sink_spool_dropped_total", Help: "Messages dropped because they couldn't be spooled.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&sp.dropped))},
+		{Name: "browsertunnel_sink_spooled", Help: "Messages waiting in the spool for the sinks to recover.", Type: metrics.Gauge, Value: float64(sp.spooled.Load())},
+	}
+}
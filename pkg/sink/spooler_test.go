@@ -0,0 +1,84 @@
+package sink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestFanoutDown(t *testing.T) {
+	a := &recorder{fail: map[string]bool{"m1": true, "m2": true}}
+	b := &recorder{fail: map[string]bool{"m1": true}}
+	f := NewFanout(nil, Named{Name: "a", Sink: a}, Named{Name: "b", Sink: b})
+	defer f.Close()
+	require.False(t, f.Down())
+
+	require.NotNil(t, f.Probe(context.Background(), tunnel.Message{ID: "m1"}))
+	require.True(t, f.Down())
+	// A message delivered by any sink is enough for the fanout to be up.
+	require.Nil(t, f.Probe(context.Background(), tunnel.Message{ID: "m2"}))
+	require.False(t, f.Down())
+	require.Equal(t, []string{"m2"}, b.ids)
+}
+
+func TestSpooler(t *testing.T) {
+	s := &flaky{failures: map[string]int{"m1": -1}}
+	f := NewFanout(nil, Named{Name: "s", Sink: s})
+	defer f.Close()
+	spool := &memoryQueue{}
+	sp := NewSpooler(f, spool, time.Millisecond, nil)
+
+	// Once the sink is down, messages are spooled rather than delivered.
+	require.Nil(t, sp.Deliver(context.Background(), tunnel.Message{ID: "m1"}))
+	require.Eventually(t, f.Down, time.Second, time.Millisecond)
+	s.mu.Lock()
+	s.failures["m2"] = 3
+	s.mu.Unlock()
+	for _, id := range []string{"m2", "m3"} {
+		require.Nil(t, sp.Deliver(context.Background(), tunnel.Message{ID: id}))
+	}
+
+	// The oldest message is probed until the sink recovers, and the rest are then replayed in
+	// order, ahead of new messages.
+	require.Eventually(t, func() bool { return len(s.ids()) == 2 }, time.Second, time.Millisecond)
+	require.Nil(t, sp.Deliver(context.Background(), tunnel.Message{ID: "m4"}))
+	require.Eventually(t, func() bool { return len(s.ids()) == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, []string{"m2", "m3", "m4"}, s.ids())
+	require.Nil(t, sp.Close())
+
+	values := map[string]float64{}
+	for _, m := range sp.Collect() {
+		values[m.Name] = m.Value
+	}
+	require.Equal(t, map[string]float64{
+		"browsertunnel_sink_spooled_total":       2,
+		"browsertunnel_sink_replayed_total":      2,
+		"browsertunnel_sink_spool_dropped_total": 0,
+		"browsertunnel_sink_spooled":             0,
+	}, values)
+}
+
+func TestSpoolerClose(t *testing.T) {
+	s := &flaky{failures: map[string]int{"m1": -1, "m2": -1}}
+	f := NewFanout(nil, Named{Name: "s", Sink: s})
+	spool := &memoryQueue{}
+	sp := NewSpooler(f, spool, time.Hour, nil)
+	require.Nil(t, sp.Deliver(context.Background(), tunnel.Message{ID: "m1"}))
+	require.Eventually(t, f.Down, time.Second, time.Millisecond)
+	require.Nil(t, sp.Deliver(context.Background(), tunnel.Message{ID: "m2"}))
+	require.Nil(t, sp.Close())
+	require.Nil(t, f.Close())
+
+	// Spooled messages are kept for the next spooler, which replays them.
+	require.Len(t, spool.messages, 1)
+	s.failures["m2"] = 0
+	f = NewFanout(nil, Named{Name: "s", Sink: s})
+	defer f.Close()
+	sp = NewSpooler(f, spool, time.Hour, nil)
+	defer sp.Close()
+	require.Eventually(t, func() bool { return len(s.ids()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, []string{"m2"}, s.ids())
+}
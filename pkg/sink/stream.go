@@ -0,0 +1,154 @@
+package sink
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"golang.org/x/net/websocket"
+)
+
+// streamBufferSize is the number of messages buffered for each subscriber of a Stream. Messages
+// are dropped for subscribers that fall further behind.
+const streamBufferSize = 64
+
+// A Stream is a Sink that broadcasts messages to subscribers as they are delivered. It is an
+// http.Handler that upgrades requests to WebSocket connections, on which each message is sent as
+// a JSON text frame. WebSocket subscribers may pass a prefix query parameter to only receive
+// messages whose ID starts with it, and a tenant query parameter to only receive messages sent to
+// that tenant. Colocated processes can also subscribe through a Unix socket served by Serve.
+// Subscribers that connect later don't receive messages that were delivered before they
+// connected.
+type Stream struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	dropped     uint64
+}
+
+type subscriber struct {
+	prefix string
+	tenant string
+	queue  chan []byte
+}
+
+// matches reports whether msg passes the subscriber's filters.
+func (sub *subscriber) matches(msg tunnel.Message) bool {
+	return strings.HasPrefix(msg.ID, sub.prefix) && (sub.tenant == "" || msg.Tenant == sub.tenant)
+}
+
+// NewStream returns a Stream with no subscribers.
+func NewStream() *Stream {
+	return &Stream{subscribers: make(map[*subscriber]struct{})}
+}
+
+// Deliver sends msg to every subscriber whose filter it matches. It never blocks: if a
+// subscriber's buffer is full, the message is dropped for that subscriber.
+func (s *Stream) Deliver(ctx context.Context, msg tunnel.Message) error {
+	body, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.subscribers {
+		if !sub.matches(msg) {
+			continue
+		}
+		select {
+		case sub.queue <- body:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+	return nil
+}
+
+// Subscribers returns the number of connected subscribers.
+func (s *Stream) Subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+// Dropped returns the number of messages dropped because a subscriber fell behind.
+func (s *Stream) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Collect implements metrics.Collector.
+func (s *Stream) Collect() []metrics.Metric {
+	return []metrics.Metric{
+		{Name: "browsertunnel_stream_subscribers", Help: "Connected WebSocket and socket subscribers.", Type: metrics.Gauge, Value: float64(s.Subscribers())},
+		{Name: "browsertunnel_stream_dropped_total", Help: "Messages dropped because a stream subscriber fell behind.", Type: metrics.Counter, Value: float64(s.Dropped())},
+	}
+}
+
+// ServeHTTP upgrades r to a WebSocket connection and streams messages over it until the
+// subscriber disconnects. Connections are accepted from any origin.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sub := &subscriber{prefix: query.Get("prefix"), tenant: query.Get("tenant"), queue: make(chan []byte, streamBufferSize)}
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		s.serve(ws, sub, func(body []byte) error { return websocket.Message.Send(ws, string(body)) })
+	}}.ServeHTTP(w, r)
+}
+
+// Serve accepts connections on l, typically a Unix socket, and streams every message to each of
+// them as a frame of its length, as a 4 byte big-endian integer, followed by its JSON encoding.
+// It returns once l is closed.
+func (s *Stream) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		sub := &subscriber{queue: make(chan []byte, streamBufferSize)}
+		go s.serve(conn, sub, func(body []byte) error {
+			frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(body)), uint32(len(body)))
+			_, err := conn.Write(append(frame, body...))
+			return err
+		})
+	}
+}
+
+// serve registers sub and sends it messages over conn with send until it disconnects.
+func (s *Stream) serve(conn io.ReadWriteCloser, sub *subscriber, send func([]byte) error) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, sub)
+		s.mu.Unlock()
+	}()
+
+	// Subscribers aren't expected to send anything, but reading detects when they disconnect.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case body := <-sub.queue:
+			if err := send(body); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
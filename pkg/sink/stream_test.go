@@ -0,0 +1,108 @@
+package sink
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	"golang.org/x/net/websocket"
+)
+
+func subscribe(t *testing.T, srv *httptest.Server, s *Stream, query string) *websocket.Conn {
+	before := s.Subscribers()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/" + query
+	ws, err := websocket.Dial(url, "", srv.URL)
+	require.Nil(t, err)
+	require.Eventually(t, func() bool { return s.Subscribers() == before+1 }, 5*time.Second, time.Millisecond)
+	return ws
+}
+
+func receive(t *testing.T, ws *websocket.Conn) string {
+	var body string
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.Nil(t, websocket.Message.Receive(ws, &body))
+	return body
+}
+
+func TestStream(t *testing.T) {
+	s := NewStream()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	all := subscribe(t, srv, s, "")
+	filtered := subscribe(t, srv, s, "?prefix=ab")
+	tenant := subscribe(t, srv, s, "?tenant=alpha")
+
+	one := testMessage
+	one.ID = "xy1"
+	one.Tenant = "alpha"
+	two := testMessage
+	two.ID = "ab2"
+	require.Nil(t, s.Deliver(context.Background(), one))
+	require.Nil(t, s.Deliver(context.Background(), two))
+
+	for _, expected := range []tunnel.Message{one, two} {
+		body, err := Marshal(expected)
+		require.Nil(t, err)
+		require.Equal(t, string(body), receive(t, all))
+	}
+	body, err := Marshal(two)
+	require.Nil(t, err)
+	require.Equal(t, string(body), receive(t, filtered))
+	body, err = Marshal(one)
+	require.Nil(t, err)
+	require.Equal(t, string(body), receive(t, tenant))
+
+	all.Close()
+	filtered.Close()
+	tenant.Close()
+	require.Eventually(t, func() bool { return s.Subscribers() == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestStreamDropsForSlowSubscribers(t *testing.T) {
+	s := NewStream()
+	sub := &subscriber{queue: make(chan []byte, streamBufferSize)}
+	s.subscribers[sub] = struct{}{}
+
+	for i := 0; i < streamBufferSize+3; i++ {
+		require.Nil(t, s.Deliver(context.Background(), testMessage))
+	}
+	require.Len(t, sub.queue, streamBufferSize)
+	require.EqualValues(t, 3, s.Dropped())
+}
+
+func TestStreamSocket(t *testing.T) {
+	s := NewStream()
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "stream.sock"))
+	require.Nil(t, err)
+	served := make(chan error)
+	go func() { served <- s.Serve(l) }()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	require.Nil(t, err)
+	require.Eventually(t, func() bool { return s.Subscribers() == 1 }, 5*time.Second, time.Millisecond)
+	require.Nil(t, s.Deliver(context.Background(), testMessage))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var size uint32
+	require.Nil(t, binary.Read(conn, binary.BigEndian, &size))
+	body := make([]byte, size)
+	_, err = io.ReadFull(conn, body)
+	require.Nil(t, err)
+	expected, err := Marshal(testMessage)
+	require.Nil(t, err)
+	require.Equal(t, expected, body)
+
+	conn.Close()
+	require.Eventually(t, func() bool { return s.Subscribers() == 0 }, 5*time.Second, time.Millisecond)
+	l.Close()
+	require.NotNil(t, <-served)
+}
@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// The facilities and severities of RFC 5424, section 6.2.1, by name.
+var (
+	facilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron",
+		"authpriv", "ftp", "ntp", "audit", "alert", "clock",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+)
+
+// localSyslogPaths are the unix sockets tried, in order, when no syslog address is configured.
+var localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogConfig configures a Syslog.
+type SyslogConfig struct {
+	// Network is the network of Addr: udp, tcp, unix or unixgram. The local syslog daemon is used
+	// if both Network and Addr are empty.
+	Network string
+	Addr    string
+	// Facility and Severity name the facility and severity of every record, e.g. local0 and info.
+	// They default to user and info.
+	Facility string
+	Severity string
+	// AppName identifies the application in every record. It defaults to the executable name.
+	AppName string
+	// Hostname identifies the host in every record. It defaults to os.Hostname.
+	Hostname string
+}
+
+// A Syslog writes each message as JSON to syslog, in the format described by RFC 5424. The ID of
+// the message is used as the record's MSGID. Stream connections use octet counting framing, as
+// described in RFC 6587.
+type Syslog struct {
+	network  string
+	addr     string
+	pri      int
+	appName  string
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslog returns a Syslog that writes to the server described by cfg. The connection is made
+// lazily as messages are delivered, and remade if a write fails.
+func NewSyslog(cfg SyslogConfig) (*Syslog, error) {
+	facility, err := syslogCode(facilities, cfg.Facility, "user")
+	if err != nil {
+		return nil, fmt.Errorf("Unknown syslog facility %q", cfg.Facility)
+	}
+	severity, err := syslogCode(severities, cfg.Severity, "info")
+	if err != nil {
+		return nil, fmt.Errorf("Unknown syslog severity %q", cfg.Severity)
+	}
+	if (cfg.Network == "") != (cfg.Addr == "") {
+		return nil, fmt.Errorf("Syslog sink requires both a network and an address, or neither")
+	}
+
+	s := &Syslog{
+		network:  cfg.Network,
+		addr:     cfg.Addr,
+		pri:      facility*8 + severity,
+		appName:  cfg.AppName,
+		hostname: cfg.Hostname,
+	}
+	if s.appName == "" {
+		s.appName = filepath.Base(os.Args[0])
+	}
+	if s.hostname == "" {
+		if s.hostname, err = os.Hostname(); err != nil {
+			s.hostname = "-"
+		}
+	}
+	return s, nil
+}
+
+// Deliver writes msg to syslog.
+func (s *Syslog) Deliver(ctx context.Context, msg tunnel.Message) error {
+	body, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+	record := s.format(time.Now(), msg.ID, body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if s.conn, err = s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	} else {
+		s.conn.SetWriteDeadline(time.Time{})
+	}
+	if s.stream() {
+		record = append([]byte(fmt.Sprintf("%d ", len(record))), record...)
+	}
+	if _, err := s.conn.Write(record); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the syslog server.
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// format returns an RFC 5424 record with the given MSGID and message.
+func (s *Syslog) format(t time.Time, msgID string, msg []byte) []byte {
+	if msgID == "" {
+		msgID = "-"
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ",
+		s.pri, t.UTC().Format(time.RFC3339Nano), s.hostname, s.appName, os.Getpid(), msgID)
+	return append([]byte(header), msg...)
+}
+
+func (s *Syslog) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	if s.addr != "" {
+		return d.DialContext(ctx, s.network, s.addr)
+	}
+	for _, path := range localSyslogPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := d.DialContext(ctx, network, path); err == nil {
+				s.network = network
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Failed to connect to the local syslog daemon")
+}
+
+func (s *Syslog) stream() bool {
+	return s.network == "tcp" || s.network == "tcp4" || s.network == "tcp6" || s.network == "unix"
+}
+
+func syslogCode(names []string, name, def string) (int, error) {
+	if name == "" {
+		name = def
+	}
+	for i, n := range names {
+		if n == strings.ToLower(name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown name %q", name)
+}
@@ -0,0 +1,86 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogFormat(t *testing.T) {
+	s, err := NewSyslog(SyslogConfig{Facility: "local0", Severity: "notice", AppName: "bt", Hostname: "host"})
+	require.Nil(t, err)
+	record := s.format(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC), "2jkhm3", []byte(`{"id":"2jkhm3"}`))
+	expected := fmt.Sprintf(`<133>1 2020-06-01T12:00:00Z host bt %d 2jkhm3 - {"id":"2jkhm3"}`, os.Getpid())
+	require.Equal(t, expected, string(record))
+}
+
+func TestNewSyslogErrors(t *testing.T) {
+	tests := []SyslogConfig{
+		{Facility: "local8"},
+		{Severity: "loud"},
+		{Network: "udp"},
+		{Addr: "localhost:514"},
+	}
+	for _, cfg := range tests {
+		_, err := NewSyslog(cfg)
+		require.NotNil(t, err)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+
+	s, err := NewSyslog(SyslogConfig{Network: "udp", Addr: pc.LocalAddr().String(), Hostname: "host"})
+	require.Nil(t, err)
+	defer s.Close()
+	require.Nil(t, s.Deliver(context.Background(), testMessage))
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	require.Nil(t, err)
+	body, err := Marshal(testMessage)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:n]), "<14>1 "))
+	require.True(t, strings.HasSuffix(string(buf[:n]), " 2jkhm3 - "+string(body)))
+}
+
+func TestSyslogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	s, err := NewSyslog(SyslogConfig{Network: "tcp", Addr: l.Addr().String(), Hostname: "host"})
+	require.Nil(t, err)
+	defer s.Close()
+	require.Nil(t, s.Deliver(context.Background(), testMessage))
+	require.Nil(t, s.Deliver(context.Background(), testMessage))
+
+	conn, err := l.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		length, err := r.ReadString(' ')
+		require.Nil(t, err)
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		require.Nil(t, err)
+		record := make([]byte, n)
+		_, err = io.ReadFull(r, record)
+		require.Nil(t, err)
+		require.True(t, strings.HasPrefix(string(record), "<14>1 "))
+		require.True(t, strings.HasSuffix(string(record), "}"))
+	}
+}
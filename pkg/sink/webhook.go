@@ -0,0 +1,161 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+const (
+	// DefaultWebhookRetries is the number of times a failed delivery is retried by default.
+	DefaultWebhookRetries = 3
+	// DefaultWebhookBackoff is the delay before the first retry by default. It doubles after
+	// every failed attempt.
+	DefaultWebhookBackoff = 500 * time.Millisecond
+)
+
+// A Webhook POSTs each message to a URL, as JSON unless Raw is set.
+type Webhook struct {
+	// URL is the address messages are POSTed to.
+	URL string
+	// Client is used to make requests. http.DefaultClient is used if nil.
+	Client *http.Client
+	// Retries is the number of times a failed delivery is retried. DefaultWebhookRetries is used
+	// if 0, and retries are disabled if negative.
+	Retries int
+	// Backoff is the delay before the first retry, which doubles after every failed attempt.
+	// DefaultWebhookBackoff is used if 0.
+	Backoff time.Duration
+	// Raw POSTs the payload of each message as is, rather than as JSON, with its metadata in
+	// Browsertunnel-* headers. The content type is application/octet-stream for binary messages
+	// and text/plain otherwise.
+	Raw bool
+}
+
+// Deliver POSTs msg to the webhook, retrying with exponential backoff until it is accepted with
+// a 2xx status, the retries are exhausted, or ctx is done. Client errors other than 429 Too Many
+// Requests are not retried.
+func (wh *Webhook) Deliver(ctx context.Context, msg tunnel.Message) error {
+	body, header, err := wh.encode(msg)
+	if err != nil {
+		return err
+	}
+	return wh.send(ctx, body, header)
+}
+
+// DeliverBatch POSTs msgs to the webhook in a single request, as a JSON array of the records
+// Marshal encodes them to, retrying like Deliver. Raw webhooks can't carry several payloads in
+// one request, so they deliver each message in turn.
+func (wh *Webhook) DeliverBatch(ctx context.Context, msgs []tunnel.Message) error {
+	if wh.Raw {
+		for _, msg := range msgs {
+			if err := wh.Deliver(ctx, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	records := make([]json.RawMessage, len(msgs))
+	for i, msg := range msgs {
+		record, err := Marshal(msg)
+		if err != nil {
+			return err
+		}
+		records[i] = record
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return wh.send(ctx, body, header)
+}
+
+// send POSTs body with exponential backoff, as described by Deliver.
+func (wh *Webhook) send(ctx context.Context, body []byte, header http.Header) error {
+	return withRetries(ctx, wh.Retries, wh.Backoff, func() (bool, error) {
+		return wh.post(ctx, body, header)
+	})
+}
+
+// withRetries calls attempt until it succeeds, it reports that its failure isn't worth retrying,
+// or the retries are exhausted, waiting for an exponential backoff in between. retries and
+// backoff default to DefaultWebhookRetries and DefaultWebhookBackoff if 0, and retries are
+// disabled if negative.
+func withRetries(ctx context.Context, retries int, backoff time.Duration, attempt func() (bool, error)) error {
+	if retries == 0 {
+		retries = DefaultWebhookRetries
+	}
+	if backoff == 0 {
+		backoff = DefaultWebhookBackoff
+	}
+
+	for n := 0; ; n++ {
+		retry, err := attempt()
+		if err == nil {
+			return nil
+		}
+		if !retry || n >= retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// encode returns the body and headers of the requests delivering msg.
+func (wh *Webhook) encode(msg tunnel.Message) ([]byte, http.Header, error) {
+	header := make(http.Header)
+	if !wh.Raw {
+		body, err := Marshal(msg)
+		header.Set("Content-Type", "application/json")
+		return body, header, err
+	}
+	for _, h := range rawHeaders(msg) {
+		header.Set(h.key, h.value)
+	}
+	if msg.Binary {
+		header.Set("Content-Type", "application/octet-stream")
+	} else {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	return msg.Payload, header, nil
+}
+
+// post makes a single delivery attempt, and reports whether a failure is worth retrying.
+func (wh *Webhook) post(ctx context.Context, body []byte, header http.Header) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header = header.Clone()
+
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("Webhook %s responded with %s", wh.URL, resp.Status)
+}
@@ -0,0 +1,171 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+var testMessage = tunnel.Message{
+	ID:            "2jkhm3",
+	Payload:       []byte("hello world"),
+	Source:        net.ParseIP("192.0.2.1"),
+	QueryType:     dns.TypeA,
+	Domain:        "t1.example.com.",
+	Fragments:     2,
+	FirstFragment: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+	LastFragment:  time.Date(2020, 6, 1, 12, 0, 1, 0, time.UTC),
+}
+
+func TestMarshal(t *testing.T) {
+	b, err := Marshal(testMessage)
+	require.Nil(t, err)
+	require.JSONEq(t, `{
+		"id": "2jkhm3",
+		"payload": "hello world",
+		"source": "192.0.2.1",
+		"qtype": "A",
+		"domain": "t1.example.com.",
+		"fragments": 2,
+		"first_fragment": "2020-06-01T12:00:00Z",
+		"last_fragment": "2020-06-01T12:00:01Z"
+	}`, string(b))
+}
+
+func TestMarshalClientSubnet(t *testing.T) {
+	msg := testMessage
+	_, msg.ClientSubnet, _ = net.ParseCIDR("198.51.100.0/24")
+	b, err := Marshal(msg)
+	require.Nil(t, err)
+	var got map[string]interface{}
+	require.Nil(t, json.Unmarshal(b, &got))
+	require.Equal(t, "198.51.100.0/24", got["client_subnet"])
+}
+
+func TestMarshalSigner(t *testing.T) {
+	msg := testMessage
+	msg.Signer = "alice"
+	b, err := Marshal(msg)
+	require.Nil(t, err)
+	var got map[string]interface{}
+	require.Nil(t, json.Unmarshal(b, &got))
+	require.Equal(t, "alice", got["signer"])
+}
+
+func TestMarshalTags(t *testing.T) {
+	msg := testMessage
+	msg.Tags = map[string]string{"user": "alice"}
+	b, err := Marshal(msg)
+	require.Nil(t, err)
+	var got map[string]interface{}
+	require.Nil(t, json.Unmarshal(b, &got))
+	require.Equal(t, map[string]interface{}{"user": "alice"}, got["tags"])
+}
+
+func TestMarshalBinary(t *testing.T) {
+	msg := testMessage
+	msg.Payload = []byte{0xff, 0x00}
+	msg.Binary = true
+	b, err := Marshal(msg)
+	require.Nil(t, err)
+	var got map[string]interface{}
+	require.Nil(t, json.Unmarshal(b, &got))
+	require.Equal(t, "/wA=", got["payload"])
+	require.Equal(t, true, got["binary"])
+
+	// Text that isn't valid UTF-8 can't be carried by a JSON string either.
+	msg.Payload = []byte("caf\xe9")
+	msg.Binary = false
+	b, err = Marshal(msg)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(b, &got))
+	require.Equal(t, "Y2Fm6Q==", got["payload"])
+	require.Equal(t, true, got["binary"])
+}
+
+func TestWebhook(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		var got map[string]interface{}
+		require.Nil(t, json.Unmarshal(body, &got))
+		require.Equal(t, "hello world", got["payload"])
+	}))
+	defer srv.Close()
+
+	wh := &Webhook{URL: srv.URL, Backoff: time.Millisecond}
+	require.Nil(t, wh.Deliver(context.Background(), testMessage))
+	require.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+}
+
+func TestWebhookRaw(t *testing.T) {
+	msg := testMessage
+	msg.Payload = []byte{0xff, 0x00}
+	msg.Binary = true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/octet-stream", r.Header.Get("Content-Type"))
+		require.Equal(t, "2jkhm3", r.Header.Get("Browsertunnel-Id"))
+		require.Equal(t, "192.0.2.1", r.Header.Get("Browsertunnel-Source"))
+		require.Equal(t, "true", r.Header.Get("Browsertunnel-Binary"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, msg.Payload, body)
+	}))
+	defer srv.Close()
+
+	wh := &Webhook{URL: srv.URL, Raw: true}
+	require.Nil(t, wh.Deliver(context.Background(), msg))
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	tests := []struct {
+		status   int
+		retries  int
+		attempts int32
+	}{
+		{status: http.StatusInternalServerError, retries: 2, attempts: 3},
+		{status: http.StatusInternalServerError, retries: -1, attempts: 1},
+		{status: http.StatusTooManyRequests, retries: 1, attempts: 2},
+		{status: http.StatusBadRequest, retries: 3, attempts: 1},
+	}
+	for _, test := range tests {
+		var attempts int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(test.status)
+		}))
+
+		wh := &Webhook{URL: srv.URL, Retries: test.retries, Backoff: time.Millisecond}
+		require.NotNil(t, wh.Deliver(context.Background(), testMessage))
+		require.Equal(t, test.attempts, atomic.LoadInt32(&attempts))
+		srv.Close()
+	}
+}
+
+func TestWebhookCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wh := &Webhook{URL: srv.URL, Backoff: time.Hour}
+	require.NotNil(t, wh.Deliver(ctx, testMessage))
+}
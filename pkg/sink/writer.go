@@ -0,0 +1,33 @@
+package sink
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// A Writer writes each message to an io.Writer as a line of JSON, e.g. to os.Stdout so that it
+// can be piped into jq.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Deliver writes msg as a single line.
+func (wr *Writer) Deliver(ctx context.Context, msg tunnel.Message) error {
+	line, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	_, err = wr.w.Write(append(line, '\n'))
+	return err
+}
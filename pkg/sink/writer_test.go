@@ -0,0 +1,20 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.Nil(t, w.Deliver(context.Background(), testMessage))
+	require.Nil(t, w.Deliver(context.Background(), testMessage))
+	line, err := Marshal(testMessage)
+	require.Nil(t, err)
+	require.Equal(t, strings.Repeat(string(line)+"\n", 2), buf.String())
+}
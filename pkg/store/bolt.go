@@ -0,0 +1,294 @@
+// Package store persists tunnel state to disk.
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	fragmentsBucket = []byte("fragments")
+	spoolBucket     = []byte("spool")
+	deliveredBucket = []byte("delivered")
+)
+
+// queuePrefix starts the names of the buckets of queues.
+const queuePrefix = "queue."
+
+// A Bolt is a tunnel.FragmentStore, a tunnel.ReplayStore and a tunnel.Spool backed by a BoltDB
+// file. Each fragment is stored under the key [<tenant>.]<id>\x00<offset>, so that the fragments
+// of a message are adjacent, and delivered messages under [<tenant>.]<id>. Spilled messages are
+// stored under increasing sequence numbers, as are the messages of each Queue.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// boltFragment is the value stored for each fragment.
+type boltFragment struct {
+	Version    int          `json:"version,omitempty"`
+	Flags      tunnel.Flags `json:"flags,omitempty"`
+	Session    string       `json:"session,omitempty"`
+	Sequence   int          `json:"sequence,omitempty"`
+	Encoding   string       `json:"encoding,omitempty"`
+	KeyID      string       `json:"key_id,omitempty"`
+	Expiration int          `json:"expiration,omitempty"`
+	TotalSize  int          `json:"total_size"`
+	Data       string       `json:"data"`
+	ReceivedAt time.Time    `json:"received_at"`
+}
+
+// OpenBolt opens the BoltDB file at path, creating it if it doesn't exist.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{fragmentsBucket, spoolBucket, deliveredBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+// Put implements tunnel.FragmentStore.
+func (b *Bolt) Put(f tunnel.Fragment) error {
+	value, err := json.Marshal(boltFragment{Version: f.Version, Flags: f.Flags, Session: f.Session, Sequence: f.Sequence, Encoding: string(f.Encoding), KeyID: f.KeyID, Expiration: f.Expiration, TotalSize: f.TotalSize, Data: f.Data, ReceivedAt: f.ReceivedAt})
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fragmentsBucket).Put(fragmentKey(messageKey(f.Tenant, f.ID), f.Offset), value)
+	})
+}
+
+// Delete implements tunnel.FragmentStore.
+func (b *Bolt) Delete(tenant, id string) error {
+	prefix := append([]byte(messageKey(tenant, id)), 0)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(fragmentsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Load implements tunnel.FragmentStore.
+func (b *Bolt) Load() ([]tunnel.Fragment, error) {
+	var fragments []tunnel.Fragment
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(fragmentsBucket).ForEach(func(k, v []byte) error {
+			key, offset, err := parseFragmentKey(k)
+			if err != nil {
+				return err
+			}
+			tenant, id, ok := strings.Cut(key, ".")
+			if !ok {
+				tenant, id = "", key
+			}
+			var bf boltFragment
+			if err := json.Unmarshal(v, &bf); err != nil {
+				return err
+			}
+			fragments = append(fragments, tunnel.Fragment{
+				ID:         id,
+				Tenant:     tenant,
+				Version:    bf.Version,
+				Flags:      bf.Flags,
+				Session:    bf.Session,
+				Sequence:   bf.Sequence,
+				Encoding:   tunnel.Encoding(bf.Encoding),
+				KeyID:      bf.KeyID,
+				Expiration: bf.Expiration,
+				TotalSize:  bf.TotalSize,
+				Offset:     offset,
+				Data:       bf.Data,
+				ReceivedAt: bf.ReceivedAt,
+			})
+			return nil
+		})
+	})
+	return fragments, err
+}
+
+// PutDelivered implements tunnel.ReplayStore.
+func (b *Bolt) PutDelivered(d tunnel.Delivered) error {
+	value, err := d.Until.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveredBucket).Put([]byte(messageKey(d.Tenant, d.ID)), value)
+	})
+}
+
+// DeleteDelivered implements tunnel.ReplayStore.
+func (b *Bolt) DeleteDelivered(tenant, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveredBucket).Delete([]byte(messageKey(tenant, id)))
+	})
+}
+
+// LoadDelivered implements tunnel.ReplayStore.
+func (b *Bolt) LoadDelivered() ([]tunnel.Delivered, error) {
+	var records []tunnel.Delivered
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveredBucket).ForEach(func(k, v []byte) error {
+			tenant, id, ok := strings.Cut(string(k), ".")
+			if !ok {
+				tenant, id = "", string(k)
+			}
+			d := tunnel.Delivered{ID: id, Tenant: tenant}
+			if err := d.Until.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			records = append(records, d)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Push implements tunnel.Spool.
+func (b *Bolt) Push(msg tunnel.Message) error {
+	return b.spool().Push(msg)
+}
+
+// Peek implements tunnel.Spool.
+func (b *Bolt) Peek() (tunnel.Message, bool, error) {
+	return b.spool().Peek()
+}
+
+// Pop implements tunnel.Spool.
+func (b *Bolt) Pop() error {
+	return b.spool().Pop()
+}
+
+// Len implements tunnel.Spool.
+func (b *Bolt) Len() (int, error) {
+	return b.spool().Len()
+}
+
+func (b *Bolt) spool() *BoltQueue {
+	return &BoltQueue{db: b.db, bucket: spoolBucket}
+}
+
+// Queue returns the queue called name, creating it if it doesn't exist. Queues are spools kept
+// apart from the one implemented by b, e.g. for the messages waiting to be retried by each sink.
+func (b *Bolt) Queue(name string) (*BoltQueue, error) {
+	bucket := []byte(queuePrefix + name)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltQueue{db: b.db, bucket: bucket}, nil
+}
+
+// A BoltQueue is a tunnel.Spool stored in a bucket of a Bolt, under increasing sequence numbers.
+// It is only valid until the Bolt is closed.
+type BoltQueue struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// Push implements tunnel.Spool.
+func (q *BoltQueue) Push(msg tunnel.Message) error {
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(q.bucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, value)
+	})
+}
+
+// Peek implements tunnel.Spool.
+func (q *BoltQueue) Peek() (tunnel.Message, bool, error) {
+	var msg tunnel.Message
+	var ok bool
+	err := q.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(q.bucket).Cursor().First()
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &msg)
+	})
+	return msg, ok, err
+}
+
+// Pop implements tunnel.Spool.
+func (q *BoltQueue) Pop() error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(q.bucket).Cursor()
+		if k, _ := c.First(); k == nil {
+			return nil
+		}
+		return c.Delete()
+	})
+}
+
+// Len implements tunnel.Spool.
+func (q *BoltQueue) Len() (int, error) {
+	var n int
+	err := q.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(q.bucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Close closes the database.
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// messageKey identifies the message id of tenant. Labels never contain dots, so the keys of
+// different tenants can't collide.
+func messageKey(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + "." + id
+}
+
+func fragmentKey(id string, offset int) []byte {
+	key := make([]byte, len(id)+1+8)
+	copy(key, id)
+	binary.BigEndian.PutUint64(key[len(id)+1:], uint64(offset))
+	return key
+}
+
+func parseFragmentKey(key []byte) (string, int, error) {
+	if len(key) < 9 || key[len(key)-9] != 0 {
+		return "", 0, fmt.Errorf("Malformed fragment key %q", key)
+	}
+	return string(key[:len(key)-9]), int(binary.BigEndian.Uint64(key[len(key)-8:])), nil
+}
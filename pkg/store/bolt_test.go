@@ -0,0 +1,149 @@
+package store
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fragments.db")
+	b, err := OpenBolt(path)
+	require.Nil(t, err)
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	fragments := []tunnel.Fragment{
+		{ID: "a", TotalSize: 24, Offset: 0, Data: "nbswy3dp", ReceivedAt: now},
+		{ID: "a", TotalSize: 24, Offset: 300, Data: "eb3w64tm", ReceivedAt: now.Add(time.Second)},
+		{ID: "ab", Version: tunnel.Version2, Flags: tunnel.FlagBinary | tunnel.FlagSession | tunnel.FlagSequence, Session: "tab1", Sequence: 3, TotalSize: 8, Offset: 0, Data: "mq000000", ReceivedAt: now},
+		{ID: "a", Tenant: "t1", Version: tunnel.Version2, Flags: tunnel.FlagEncoding, Encoding: tunnel.EncodingHex, TotalSize: 8, Offset: 0, Data: "68656c6c", ReceivedAt: now},
+	}
+	for _, f := range fragments {
+		require.Nil(t, b.Put(f))
+	}
+	replaced := fragments[1]
+	replaced.ReceivedAt = now.Add(time.Minute)
+	require.Nil(t, b.Put(replaced))
+	require.Nil(t, b.Close())
+
+	b, err = OpenBolt(path)
+	require.Nil(t, err)
+	defer b.Close()
+	got, err := b.Load()
+	require.Nil(t, err)
+	require.Equal(t, []tunnel.Fragment{fragments[0], replaced, fragments[2], fragments[3]}, got)
+
+	require.Nil(t, b.Delete("", "a"))
+	got, err = b.Load()
+	require.Nil(t, err)
+	require.Equal(t, []tunnel.Fragment{fragments[2], fragments[3]}, got)
+	require.Nil(t, b.Delete("t1", "a"))
+	got, err = b.Load()
+	require.Nil(t, err)
+	require.Equal(t, []tunnel.Fragment{fragments[2]}, got)
+	require.Nil(t, b.Delete("", "missing"))
+}
+
+func TestBoltSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.db")
+	b, err := OpenBolt(path)
+	require.Nil(t, err)
+
+	_, ok, err := b.Peek()
+	require.Nil(t, err)
+	require.False(t, ok)
+	require.Nil(t, b.Pop())
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	messages := []tunnel.Message{
+		{ID: "a", Payload: []byte("hello"), Source: net.ParseIP("192.0.2.1"), Domain: "t1.example.com.", Fragments: 1, FirstFragment: now, LastFragment: now},
+		{ID: "b", Payload: []byte("world"), Tenant: "alpha", Fragments: 2, FirstFragment: now, LastFragment: now.Add(time.Second)},
+	}
+	for _, msg := range messages {
+		require.Nil(t, b.Push(msg))
+	}
+	require.Nil(t, b.Close())
+
+	b, err = OpenBolt(path)
+	require.Nil(t, err)
+	defer b.Close()
+	n, err := b.Len()
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	for _, want := range messages {
+		got, ok, err := b.Peek()
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.Equal(t, want, got)
+		require.Nil(t, b.Pop())
+	}
+	n, err = b.Len()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestBoltQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	b, err := OpenBolt(path)
+	require.Nil(t, err)
+
+	webhook, err := b.Queue("webhook")
+	require.Nil(t, err)
+	require.Nil(t, webhook.Push(tunnel.Message{ID: "a", Payload: []byte("hello")}))
+	require.Nil(t, b.Close())
+
+	b, err = OpenBolt(path)
+	require.Nil(t, err)
+	defer b.Close()
+	webhook, err = b.Queue("webhook")
+	require.Nil(t, err)
+	kafka, err := b.Queue("kafka")
+	require.Nil(t, err)
+
+	// Queues are kept apart from each other and from the spool.
+	for _, spool := range []tunnel.Spool{b, kafka} {
+		n, err := spool.Len()
+		require.Nil(t, err)
+		require.Zero(t, n)
+	}
+	got, ok, err := webhook.Peek()
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "a", got.ID)
+	require.Nil(t, webhook.Pop())
+	_, ok, err = webhook.Peek()
+	require.Nil(t, err)
+	require.False(t, ok)
+}
+
+func TestBoltDelivered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delivered.db")
+	b, err := OpenBolt(path)
+	require.Nil(t, err)
+
+	until := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	records := []tunnel.Delivered{
+		{ID: "a", Until: until},
+		{ID: "a", Tenant: "t1", Until: until.Add(time.Minute)},
+	}
+	for _, d := range records {
+		require.Nil(t, b.PutDelivered(d))
+	}
+	require.Nil(t, b.Close())
+
+	b, err = OpenBolt(path)
+	require.Nil(t, err)
+	defer b.Close()
+	got, err := b.LoadDelivered()
+	require.Nil(t, err)
+	require.Equal(t, records, got)
+
+	require.Nil(t, b.DeleteDelivered("t1", "a"))
+	got, err = b.LoadDelivered()
+	require.Nil(t, err)
+	require.Equal(t, records[:1], got)
+}
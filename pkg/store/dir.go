@@ -0,0 +1,147 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// dirSuffix ends the names of the files of a Dir.
+const dirSuffix = ".json"
+
+// A Dir is a tunnel.Spool that keeps each message in a file of a directory, named after
+// increasing sequence numbers, e.g. 00000000000000000042.json. It bounds the disk usage of the
+// messages it holds.
+type Dir struct {
+	path     string
+	maxBytes int64
+
+	mu    sync.Mutex
+	files []dirFile
+	size  int64
+	next  uint64
+}
+
+// A dirFile is a message held in a Dir.
+type dirFile struct {
+	seq  uint64
+	size int64
+}
+
+// OpenDir opens the spool in the directory at path, creating it if it doesn't exist. Messages
+// left in it, e.g. by a previous run, are kept. Push fails once the messages would take up more
+// than maxBytes of disk, unless maxBytes is 0.
+func OpenDir(path string, maxBytes int64) (*Dir, error) {
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("Maximum spool size %d must not be negative", maxBytes)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dir{path: path, maxBytes: maxBytes}
+	for _, e := range entries {
+		name := e.Name()
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, dirSuffix), 10, 64)
+		if e.IsDir() || !strings.HasSuffix(name, dirSuffix) || err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		d.files = append(d.files, dirFile{seq: seq, size: info.Size()})
+		d.size += info.Size()
+		d.next = max(d.next, seq+1)
+	}
+	sort.Slice(d.files, func(i, j int) bool { return d.files[i].seq < d.files[j].seq })
+	return d, nil
+}
+
+func (d *Dir) file(seq uint64) string {
+	return filepath.Join(d.path, fmt.Sprintf("%020d%s", seq, dirSuffix))
+}
+
+// Push implements tunnel.Spool. The message is written to a temporary file first, so that a
+// crash never leaves a partial message behind.
+func (d *Dir) Push(msg tunnel.Message) error {
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	size := int64(len(value))
+	if d.maxBytes > 0 && d.size+size > d.maxBytes {
+		return fmt.Errorf("Spool %s is full: %d of %d bytes used", d.path, d.size, d.maxBytes)
+	}
+	path := d.file(d.next)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, value, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d.files = append(d.files, dirFile{seq: d.next, size: size})
+	d.size += size
+	d.next++
+	return nil
+}
+
+// Peek implements tunnel.Spool.
+func (d *Dir) Peek() (tunnel.Message, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var msg tunnel.Message
+	if len(d.files) == 0 {
+		return msg, false, nil
+	}
+	value, err := os.ReadFile(d.file(d.files[0].seq))
+	if err != nil {
+		return msg, false, err
+	}
+	return msg, true, json.Unmarshal(value, &msg)
+}
+
+// Pop implements tunnel.Spool.
+func (d *Dir) Pop() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.files) == 0 {
+		return nil
+	}
+	f := d.files[0]
+	if err := os.Remove(d.file(f.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.files = d.files[1:]
+	d.size -= f.size
+	return nil
+}
+
+// Len implements tunnel.Spool.
+func (d *Dir) Len() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.files), nil
+}
+
+// Size returns the number of bytes taken up by the messages in d.
+func (d *Dir) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func TestDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	d, err := OpenDir(path, 0)
+	require.Nil(t, err)
+
+	_, ok, err := d.Peek()
+	require.Nil(t, err)
+	require.False(t, ok)
+	require.Nil(t, d.Pop())
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	messages := []tunnel.Message{
+		{ID: "a", Payload: []byte("hello"), Domain: "t1.example.com.", Fragments: 1, FirstFragment: now, LastFragment: now},
+		{ID: "b", Payload: []byte("world"), Tenant: "alpha", Fragments: 2, FirstFragment: now, LastFragment: now.Add(time.Second)},
+	}
+	for _, msg := range messages {
+		require.Nil(t, d.Push(msg))
+	}
+	// Files that don't hold messages are ignored.
+	require.Nil(t, os.WriteFile(filepath.Join(path, "notes.txt"), []byte("x"), 0600))
+
+	d, err = OpenDir(path, 0)
+	require.Nil(t, err)
+	n, err := d.Len()
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	for _, want := range messages {
+		got, ok, err := d.Peek()
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.Equal(t, want, got)
+		require.Nil(t, d.Pop())
+	}
+	require.Zero(t, d.Size())
+
+	// Sequence numbers continue where the previous run left off.
+	require.Nil(t, d.Push(messages[0]))
+	_, err = os.Stat(filepath.Join(path, "00000000000000000002.json"))
+	require.Nil(t, err)
+}
+
+func TestDirMaxBytes(t *testing.T) {
+	d, err := OpenDir(t.TempDir(), 300)
+	require.Nil(t, err)
+	msg := tunnel.Message{ID: "a", Payload: []byte("hello")}
+	require.Nil(t, d.Push(msg))
+	size := d.Size()
+	require.True(t, size > 150 && size <= 300, "message takes up %d bytes", size)
+	require.NotNil(t, d.Push(msg))
+
+	// Room is made by popping messages.
+	require.Nil(t, d.Pop())
+	require.Nil(t, d.Push(msg))
+
+	_, err = OpenDir(t.TempDir(), -1)
+	require.NotNil(t, err)
+}
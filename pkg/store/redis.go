@@ -0,0 +1,336 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// Defaults of RedisConfig.
+const (
+	DefaultRedisPrefix  = "browsertunnel:"
+	DefaultRedisTTL     = 10 * time.Minute
+	DefaultRedisTimeout = time.Second
+)
+
+// RedisConfig configures a Redis.
+type RedisConfig struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// Username and Password are used to AUTH with the server if Password is not empty. Username
+	// may be empty for servers without ACLs.
+	Username string
+	Password string
+	// Prefix starts every key, so that several tunnels can share a server. Defaults to
+	// DefaultRedisPrefix.
+	Prefix string
+	// TTL is how long the fragments of a message are kept after the last of them is put, and how
+	// long a claim on a message lasts. It should exceed the expiration of the tunnels, so that
+	// fragments outlive their partial messages. Defaults to DefaultRedisTTL.
+	TTL time.Duration
+	// Timeout bounds each round trip to the server. Defaults to DefaultRedisTimeout.
+	Timeout time.Duration
+}
+
+// A Redis is a tunnel.SharedFragmentStore backed by a Redis server, which lets the servers of a
+// cluster reassemble messages whose fragments were spread across them. The fragments of each
+// message are kept in a hash under <prefix>fragments:[<tenant>.]<id>, keyed by their offset,
+// and claims under <prefix>claimed:[<tenant>.]<id>. Both expire after RedisConfig.TTL.
+type Redis struct {
+	cfg RedisConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// OpenRedis connects to the Redis server described by cfg. The connection is remade if a command
+// fails.
+func OpenRedis(cfg RedisConfig) (*Redis, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("Redis store requires an address")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = DefaultRedisPrefix
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultRedisTTL
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultRedisTimeout
+	}
+	rs := &Redis{cfg: cfg}
+	if _, err := rs.do(command("PING")); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Put implements tunnel.FragmentStore.
+func (rs *Redis) Put(f tunnel.Fragment) error {
+	value, err := json.Marshal(boltFragment{Version: f.Version, Flags: f.Flags, Session: f.Session, Sequence: f.Sequence, Encoding: string(f.Encoding), KeyID: f.KeyID, Expiration: f.Expiration, TotalSize: f.TotalSize, Data: f.Data, ReceivedAt: f.ReceivedAt})
+	if err != nil {
+		return err
+	}
+	key := rs.fragmentsKey(f.Tenant, f.ID)
+	_, err = rs.do(
+		command("HSET", key, strconv.Itoa(f.Offset), string(value)),
+		command("PEXPIRE", key, strconv.FormatInt(rs.cfg.TTL.Milliseconds(), 10)),
+	)
+	return err
+}
+
+// Delete implements tunnel.FragmentStore.
+func (rs *Redis) Delete(tenant, id string) error {
+	_, err := rs.do(command("DEL", rs.fragmentsKey(tenant, id)))
+	return err
+}
+
+// Load implements tunnel.FragmentStore. It returns the fragments of every message in the store,
+// including those put by other servers.
+func (rs *Redis) Load() ([]tunnel.Fragment, error) {
+	prefix := rs.cfg.Prefix + "fragments:"
+	var fragments []tunnel.Fragment
+	cursor := "0"
+	for {
+		replies, err := rs.do(command("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", "100"))
+		if err != nil {
+			return nil, err
+		}
+		page, ok := replies[0].([]any)
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("Unexpected reply to Redis SCAN: %v", replies[0])
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]any)
+		for _, k := range keys {
+			key, _ := k.([]byte)
+			tenant, id, ok := strings.Cut(strings.TrimPrefix(string(key), prefix), ".")
+			if !ok {
+				tenant, id = "", strings.TrimPrefix(string(key), prefix)
+			}
+			fs, err := rs.Fragments(tenant, id)
+			if err != nil {
+				return nil, err
+			}
+			fragments = append(fragments, fs...)
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return fragments, nil
+		}
+	}
+}
+
+// Fragments implements tunnel.SharedFragmentStore.
+func (rs *Redis) Fragments(tenant, id string) ([]tunnel.Fragment, error) {
+	replies, err := rs.do(command("HGETALL", rs.fragmentsKey(tenant, id)))
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := replies[0].([]any)
+	var fragments []tunnel.Fragment
+	for i := 0; i+1 < len(fields); i += 2 {
+		field, _ := fields[i].([]byte)
+		value, _ := fields[i+1].([]byte)
+		offset, err := strconv.Atoi(string(field))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid offset %q of message %s in Redis", field, id)
+		}
+		var bf boltFragment
+		if err := json.Unmarshal(value, &bf); err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, tunnel.Fragment{
+			ID:         id,
+			Tenant:     tenant,
+			Version:    bf.Version,
+			Flags:      bf.Flags,
+			Session:    bf.Session,
+			Sequence:   bf.Sequence,
+			Encoding:   tunnel.Encoding(bf.Encoding),
+			KeyID:      bf.KeyID,
+			Expiration: bf.Expiration,
+			TotalSize:  bf.TotalSize,
+			Offset:     offset,
+			Data:       bf.Data,
+			ReceivedAt: bf.ReceivedAt,
+		})
+	}
+	return fragments, nil
+}
+
+// Claim implements tunnel.SharedFragmentStore.
+func (rs *Redis) Claim(tenant, id string) (bool, error) {
+	replies, err := rs.do(command("SET", rs.cfg.Prefix+"claimed:"+messageKey(tenant, id), "1", "NX", "PX", strconv.FormatInt(rs.cfg.TTL.Milliseconds(), 10)))
+	if err != nil {
+		return false, err
+	}
+	return replies[0] != nil, nil
+}
+
+// Close closes the connection to the server.
+func (rs *Redis) Close() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.conn == nil {
+		return nil
+	}
+	err := rs.conn.Close()
+	rs.conn = nil
+	return err
+}
+
+func (rs *Redis) fragmentsKey(tenant, id string) string {
+	return rs.cfg.Prefix + "fragments:" + messageKey(tenant, id)
+}
+
+// command returns the arguments of a Redis command.
+func command(args ...string) [][]byte {
+	cmd := make([][]byte, len(args))
+	for i, arg := range args {
+		cmd[i] = []byte(arg)
+	}
+	return cmd
+}
+
+// escapeGlob escapes the characters of s that are special in the patterns of SCAN MATCH.
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+// redisError is an error reply of the server, after which the connection remains usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// do sends the commands in a pipeline in the RESP protocol, connecting first if needed, and
+// returns their replies, which are strings, []byte for bulk strings, int64, []any or nil. The
+// connection is closed if a command fails for other reasons than an error reply.
+func (rs *Redis) do(cmds ...[][]byte) ([]any, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.conn == nil {
+		if err := rs.connect(); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := rs.roundTrip(cmds...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		rs.conn.Close()
+		rs.conn = nil
+	}
+	return replies, err
+}
+
+func (rs *Redis) connect() error {
+	conn, err := net.DialTimeout("tcp", rs.cfg.Addr, rs.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	rs.conn = conn
+	rs.r = bufio.NewReader(conn)
+	if rs.cfg.Password == "" {
+		return nil
+	}
+	auth := command("AUTH", rs.cfg.Password)
+	if rs.cfg.Username != "" {
+		auth = command("AUTH", rs.cfg.Username, rs.cfg.Password)
+	}
+	if _, err := rs.roundTrip(auth); err != nil {
+		conn.Close()
+		rs.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (rs *Redis) roundTrip(cmds ...[][]byte) ([]any, error) {
+	rs.conn.SetDeadline(time.Now().Add(rs.cfg.Timeout))
+	var req []byte
+	for _, cmd := range cmds {
+		req = append(req, "*"+strconv.Itoa(len(cmd))+"\r\n"...)
+		for _, arg := range cmd {
+			req = append(req, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+			req = append(req, arg...)
+			req = append(req, "\r\n"...)
+		}
+	}
+	if _, err := rs.conn.Write(req); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	var failed error
+	for i, cmd := range cmds {
+		reply, err := rs.readReply()
+		var rerr redisError
+		if errors.As(err, &rerr) {
+			if failed == nil {
+				failed = fmt.Errorf("Redis %s failed: %w", cmd[0], err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, failed
+}
+
+func (rs *Redis) readReply() (any, error) {
+	line, err := rs.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("Empty reply from Redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rs.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elems := make([]any, n)
+		for i := range elems {
+			if elems[i], err = rs.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	default:
+		return nil, fmt.Errorf("Unexpected reply from Redis: %q", line)
+	}
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+// fakeRedis is a Redis server keeping hashes and strings in memory, implementing the commands
+// that Redis sends, without expiry.
+type fakeRedis struct {
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	strings  map[string]string
+	password string
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	fr := &fakeRedis{hashes: make(map[string]map[string]string), strings: make(map[string]string), password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr, l.Addr().String()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := fr.password == ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:size])
+		}
+		fr.mu.Lock()
+		fr.commands = append(fr.commands, args[0])
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			authed = args[len(args)-1] == fr.password
+			reply = "+OK"
+			if !authed {
+				reply = "-WRONGPASS invalid password"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required"
+		default:
+			reply = fr.do(args)
+		}
+		fr.mu.Unlock()
+		conn.Write([]byte(reply + "\r\n"))
+	}
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s", len(s), s)
+}
+
+func (fr *fakeRedis) do(args []string) string {
+	switch args[0] {
+	case "PING":
+		return "+PONG"
+	case "HSET":
+		if fr.hashes[args[1]] == nil {
+			fr.hashes[args[1]] = make(map[string]string)
+		}
+		fr.hashes[args[1]][args[2]] = args[3]
+		return ":1"
+	case "PEXPIRE":
+		return ":1"
+	case "DEL":
+		delete(fr.hashes, args[1])
+		delete(fr.strings, args[1])
+		return ":1"
+	case "HGETALL":
+		var fields []string
+		for k, v := range fr.hashes[args[1]] {
+			fields = append(fields, bulk(k), bulk(v))
+		}
+		if len(fields) == 0 {
+			return "*0"
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(fields), strings.Join(fields, "\r\n"))
+	case "SET":
+		if _, ok := fr.strings[args[1]]; ok {
+			return "$-1"
+		}
+		fr.strings[args[1]] = args[2]
+		return "+OK"
+	case "SCAN":
+		// Keys are returned one per page, to exercise the cursor.
+		var keys []string
+		for k := range fr.hashes {
+			if ok, _ := path.Match(args[3], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		i, _ := strconv.Atoi(args[1])
+		if i >= len(keys) {
+			return "*2\r\n" + bulk("0") + "\r\n*0"
+		}
+		next := strconv.Itoa(i + 1)
+		if i+1 == len(keys) {
+			next = "0"
+		}
+		return "*2\r\n" + bulk(next) + "\r\n*1\r\n" + bulk(keys[i])
+	default:
+		return "-ERR unknown command " + args[0]
+	}
+}
+
+func TestRedis(t *testing.T) {
+	fr, addr := newFakeRedis(t, "secret")
+	_, err := OpenRedis(RedisConfig{Addr: addr, Password: "wrong"})
+	require.NotNil(t, err)
+	rs, err := OpenRedis(RedisConfig{Addr: addr, Password: "secret", Prefix: "bt:"})
+	require.Nil(t, err)
+	defer rs.Close()
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	fragments := []tunnel.Fragment{
+		{ID: "a", TotalSize: 24, Offset: 0, Data: "nbswy3dp", ReceivedAt: now},
+		{ID: "a", TotalSize: 24, Offset: 8, Data: "eb3w64tm", ReceivedAt: now.Add(time.Second)},
+		{ID: "a", Tenant: "t1", Version: tunnel.Version2, Flags: tunnel.FlagEncoding, Encoding: tunnel.EncodingHex, TotalSize: 8, Offset: 0, Data: "68656c6c", ReceivedAt: now},
+	}
+	for _, f := range fragments {
+		require.Nil(t, rs.Put(f))
+	}
+	got, err := rs.Fragments("", "a")
+	require.Nil(t, err)
+	sort.Slice(got, func(i, j int) bool { return got[i].Offset < got[j].Offset })
+	require.Equal(t, fragments[:2], got)
+	got, err = rs.Load()
+	require.Nil(t, err)
+	require.ElementsMatch(t, fragments, got)
+	require.Contains(t, fr.hashes, "bt:fragments:t1.a")
+
+	claimed, err := rs.Claim("", "a")
+	require.Nil(t, err)
+	require.True(t, claimed)
+	claimed, err = rs.Claim("", "a")
+	require.Nil(t, err)
+	require.False(t, claimed)
+	require.Nil(t, rs.Delete("", "a"))
+	got, err = rs.Fragments("", "a")
+	require.Nil(t, err)
+	require.Empty(t, got)
+
+	// Error replies are returned without dropping the connection.
+	_, err = rs.do(command("NOPE"))
+	require.EqualError(t, err, "Redis NOPE failed: ERR unknown command NOPE")
+	got, err = rs.Fragments("t1", "a")
+	require.Nil(t, err)
+	require.Equal(t, fragments[2:], got)
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	auths := 0
+	for _, cmd := range fr.commands {
+		if cmd == "AUTH" {
+			auths++
+		}
+	}
+	require.Equal(t, 2, auths)
+}
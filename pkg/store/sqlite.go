@@ -0,0 +1,247 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veggiedefender/browsertunnel/pkg/sink"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+	_ "modernc.org/sqlite" // registers the sqlite driver
+)
+
+// DefaultQueryLimit is the maximum number of messages returned by a query that doesn't set a
+// limit.
+const DefaultQueryLimit = 100
+
+const schema = `
+CREATE TABLE IF NOT EXISTS messages (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	id TEXT NOT NULL,
+	payload BLOB NOT NULL,
+	source TEXT NOT NULL,
+	qtype INTEGER NOT NULL,
+	fragments INTEGER NOT NULL,
+	first_fragment INTEGER NOT NULL,
+	last_fragment INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_id ON messages (id);
+CREATE INDEX IF NOT EXISTS messages_source ON messages (source);
+CREATE INDEX IF NOT EXISTS messages_last_fragment ON messages (last_fragment);
+`
+
+// migrations are applied in order to databases created before their columns were added. Each
+// fails harmlessly with a duplicate column error once applied.
+var migrations = []string{
+	`ALTER TABLE messages ADD COLUMN binary INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE messages ADD COLUMN domain TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN tags TEXT NOT NULL DEFAULT ''`,
+}
+
+// A SQLite is a sink.Sink that stores every message in a SQLite database, so that messages can be
+// queried after the fact. It is also an http.Handler serving queries as JSON.
+type SQLite struct {
+	db *sql.DB
+}
+
+// A Query selects stored messages. Zero fields don't restrict the results.
+type Query struct {
+	// Since and Until select messages whose last fragment was received in [Since, Until).
+	Since time.Time
+	Until time.Time
+	// ID selects messages with this ID, and IDs messages with any of these IDs.
+	ID  string
+	IDs []string
+	// Source selects messages received from this IP address.
+	Source net.IP
+	// Limit is the maximum number of messages returned. Defaults to DefaultQueryLimit.
+	Limit int
+}
+
+// OpenSQLite opens the SQLite database at path, creating it if it doesn't exist.
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only supports a single writer, so serialize access rather than fail with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, m := range migrations {
+		if _, err := db.Exec(m); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &SQLite{db: db}, nil
+}
+
+// Deliver stores msg.
+func (s *SQLite) Deliver(ctx context.Context, msg tunnel.Message) error {
+	source := ""
+	if msg.Source != nil {
+		source = msg.Source.String()
+	}
+	tags := ""
+	if len(msg.Tags) > 0 {
+		b, err := json.Marshal(msg.Tags)
+		if err != nil {
+			return err
+		}
+		tags = string(b)
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO messages (id, payload, binary, source, qtype, domain, tenant, tags, fragments, first_fragment, last_fragment) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.ID, msg.Payload, msg.Binary, source, msg.QueryType, msg.Domain, msg.Tenant, tags, msg.Fragments, msg.FirstFragment.UnixNano(), msg.LastFragment.UnixNano())
+	return err
+}
+
+// Query returns the stored messages selected by q, most recent first.
+func (s *SQLite) Query(ctx context.Context, q Query) ([]tunnel.Message, error) {
+	var where []string
+	var args []interface{}
+	if !q.Since.IsZero() {
+		where = append(where, "last_fragment >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "last_fragment < ?")
+		args = append(args, q.Until.UnixNano())
+	}
+	if q.ID != "" {
+		where = append(where, "id = ?")
+		args = append(args, q.ID)
+	}
+	if len(q.IDs) > 0 {
+		where = append(where, "id IN (?"+strings.Repeat(", ?", len(q.IDs)-1)+")")
+		for _, id := range q.IDs {
+			args = append(args, id)
+		}
+	}
+	if q.Source != nil {
+		where = append(where, "source = ?")
+		args = append(args, q.Source.String())
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultQueryLimit
+	}
+
+	stmt := "SELECT id, payload, binary, source, qtype, domain, tenant, tags, fragments, first_fragment, last_fragment FROM messages"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY last_fragment DESC, seq DESC LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []tunnel.Message
+	for rows.Next() {
+		var msg tunnel.Message
+		var source, tags string
+		var first, last int64
+		if err := rows.Scan(&msg.ID, &msg.Payload, &msg.Binary, &source, &msg.QueryType, &msg.Domain, &msg.Tenant, &tags, &msg.Fragments, &first, &last); err != nil {
+			return nil, err
+		}
+		if tags != "" {
+			if err := json.Unmarshal([]byte(tags), &msg.Tags); err != nil {
+				return nil, fmt.Errorf("Invalid tags of stored message %s: %w", msg.ID, err)
+			}
+		}
+		msg.Source = net.ParseIP(source)
+		msg.FirstFragment = time.Unix(0, first).UTC()
+		msg.LastFragment = time.Unix(0, last).UTC()
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// ServeHTTP answers a query with a JSON array of messages, each encoded as by sink.Marshal. The
+// query parameters since and until (RFC 3339 timestamps), id, source and limit correspond to the
+// fields of Query.
+func (s *SQLite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := s.Query(r.Context(), q)
+	if err != nil {
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, msg := range messages {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		b, err := sink.Marshal(msg)
+		if err != nil {
+			http.Error(w, "failed to encode messages", http.StatusInternalServerError)
+			return
+		}
+		buf.Write(b)
+	}
+	buf.WriteString("]\n")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// Prune deletes the stored messages whose last fragment was received before t, and returns how
+// many it deleted.
+func (s *SQLite) Prune(ctx context.Context, t time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM messages WHERE last_fragment < ?`, t.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Close closes the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+func parseQuery(r *http.Request) (Query, error) {
+	values := r.URL.Query()
+	q := Query{ID: values.Get("id")}
+	var err error
+	if v := values.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return Query{}, fmt.Errorf("Invalid since: %v", err)
+		}
+	}
+	if v := values.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return Query{}, fmt.Errorf("Invalid until: %v", err)
+		}
+	}
+	if v := values.Get("source"); v != "" {
+		if q.Source = net.ParseIP(v); q.Source == nil {
+			return Query{}, fmt.Errorf("Invalid source %q", v)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return Query{}, fmt.Errorf("Invalid limit %q", v)
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/tunnel"
+)
+
+func testMessages() []tunnel.Message {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	var messages []tunnel.Message
+	for i, id := range []string{"m1", "m2", "m3", "m1"} {
+		source := "192.0.2.1"
+		if i%2 == 1 {
+			source = "2001:db8::1"
+		}
+		at := start.Add(time.Duration(i) * time.Minute)
+		msg := tunnel.Message{
+			ID:            id,
+			Payload:       []byte("payload " + id),
+			Binary:        i == 2,
+			Source:        net.ParseIP(source),
+			QueryType:     dns.TypeA,
+			Domain:        "tunnel.example.com.",
+			Fragments:     i + 1,
+			FirstFragment: at.Add(-time.Second),
+			LastFragment:  at,
+		}
+		if i == 1 {
+			msg.Tenant = "alpha"
+			msg.Tags = map[string]string{"severity": "high"}
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func openTestSQLite(t *testing.T) *SQLite {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "messages.db"))
+	require.Nil(t, err)
+	for _, msg := range testMessages() {
+		require.Nil(t, s.Deliver(context.Background(), msg))
+	}
+	return s
+}
+
+func TestSQLiteQuery(t *testing.T) {
+	s := openTestSQLite(t)
+	defer s.Close()
+	messages := testMessages()
+	start := messages[0].LastFragment
+
+	tests := []struct {
+		query  Query
+		output []tunnel.Message
+	}{
+		{query: Query{}, output: []tunnel.Message{messages[3], messages[2], messages[1], messages[0]}},
+		{query: Query{Limit: 2}, output: []tunnel.Message{messages[3], messages[2]}},
+		{query: Query{ID: "m1"}, output: []tunnel.Message{messages[3], messages[0]}},
+		{query: Query{Source: net.ParseIP("2001:db8::1")}, output: []tunnel.Message{messages[3], messages[1]}},
+		{query: Query{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, output: []tunnel.Message{messages[2], messages[1]}},
+		{query: Query{ID: "m4"}, output: nil},
+		{query: Query{IDs: []string{"m2", "m3", "m4"}}, output: []tunnel.Message{messages[2], messages[1]}},
+	}
+	for _, test := range tests {
+		got, err := s.Query(context.Background(), test.query)
+		require.Nil(t, err)
+		require.Equal(t, len(test.output), len(got))
+		for i := range got {
+			require.Equal(t, test.output[i].ID, got[i].ID)
+			require.Equal(t, test.output[i].Payload, got[i].Payload)
+			require.Equal(t, test.output[i].Binary, got[i].Binary)
+			require.True(t, test.output[i].Source.Equal(got[i].Source))
+			require.Equal(t, test.output[i].Fragments, got[i].Fragments)
+			require.Equal(t, test.output[i].Domain, got[i].Domain)
+			require.Equal(t, test.output[i].Tenant, got[i].Tenant)
+			require.Equal(t, test.output[i].Tags, got[i].Tags)
+			require.True(t, test.output[i].LastFragment.Equal(got[i].LastFragment))
+		}
+	}
+}
+
+func TestSQLitePrune(t *testing.T) {
+	s := openTestSQLite(t)
+	defer s.Close()
+	messages := testMessages()
+	n, err := s.Prune(context.Background(), messages[2].LastFragment)
+	require.Nil(t, err)
+	require.EqualValues(t, 2, n)
+	got, err := s.Query(context.Background(), Query{})
+	require.Nil(t, err)
+	require.Len(t, got, 2)
+	require.Equal(t, "m3", got[1].ID)
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	db, err := sql.Open("sqlite", path)
+	require.Nil(t, err)
+	_, err = db.Exec(`CREATE TABLE messages (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		source TEXT NOT NULL,
+		qtype INTEGER NOT NULL,
+		fragments INTEGER NOT NULL,
+		first_fragment INTEGER NOT NULL,
+		last_fragment INTEGER NOT NULL
+	)`)
+	require.Nil(t, err)
+	_, err = db.Exec(`INSERT INTO messages (id, payload, source, qtype, fragments, first_fragment, last_fragment) VALUES ('old', 'text', '', 1, 1, 0, 0)`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	for i := 0; i < 2; i++ {
+		s, err := OpenSQLite(path)
+		require.Nil(t, err)
+		got, err := s.Query(context.Background(), Query{ID: "old"})
+		require.Nil(t, err)
+		require.Len(t, got, 1)
+		require.Equal(t, []byte("text"), got[0].Payload)
+		require.False(t, got[0].Binary)
+		require.Nil(t, s.Close())
+	}
+}
+
+func TestSQLiteHTTP(t *testing.T) {
+	s := openTestSQLite(t)
+	defer s.Close()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/messages?id=m1&since=2020-06-01T12:01:00Z&source=2001:db8::1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var got []map[string]interface{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	require.Equal(t, "payload m1", got[0]["payload"])
+	require.Equal(t, "2020-06-01T12:03:00Z", got[0]["last_fragment"])
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/messages?id=none", nil))
+	require.Equal(t, "[]\n", w.Body.String())
+
+	for _, query := range []string{"since=yesterday", "source=nope", "limit=-1"} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/messages?"+query, nil))
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	}
+}
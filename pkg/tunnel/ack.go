@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// With Config.Acks, answers to A and TXT queries carrying a fragment acknowledge what the tunnel
+// has received of the fragment's message, so that clients that can read answers (for example
+// through DNS-over-HTTPS) can retransmit lost fragments:
+//
+//   - An A answer is the address r1.r0.t1.t0, where r1r0 and t1t0 are the big-endian number of
+//     encoded bytes received and the total size of the message.
+//   - A TXT answer's first string is "ack.<received>.<total>", followed by a "<offset>.<length>"
+//     string for each of the first maxAckRanges missing ranges of the message.
+//
+// Once a message is complete, received equals total. Fragments that can't be parsed are answered
+// as usual. Status queries are answered in the same format, or as negative acknowledgements
+// starting with "nack.", as described on statusPrefix.
+const ackPrefix = "ack."
+
+const (
+	// maxAckRanges is the maximum number of missing ranges listed in a TXT acknowledgement.
+	maxAckRanges = 16
+	// ackTimeout is how long ServeDNS waits for a fragment to be processed before answering
+	// without an acknowledgement.
+	ackTimeout = time.Second
+)
+
+// An Ack acknowledges the parts of a message received by the tunnel.
+type Ack struct {
+	// Received is the number of encoded bytes received.
+	Received int
+	// Total is the encoded size of the message.
+	Total int
+	// Missing lists ranges that have not been received. It is only included in TXT
+	// acknowledgements, and may be truncated.
+	Missing []Range
+	// Nack is set on negative acknowledgements, which answer status queries once their message
+	// has been idle for Config.NackDelay. Their Missing lists every missing range, up to
+	// maxNackRanges.
+	Nack bool
+}
+
+// Complete reports whether the whole message has been received.
+func (a Ack) Complete() bool {
+	return a.Received >= a.Total
+}
+
+// ParseAck parses the answer to a fragment query made to a tunnel with Config.Acks.
+func ParseAck(rr dns.RR) (Ack, error) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip := rr.A.To4()
+		if ip == nil {
+			return Ack{}, fmt.Errorf("Malformed A acknowledgement %s", rr.A)
+		}
+		return Ack{Received: int(ip[0])<<8 | int(ip[1]), Total: int(ip[2])<<8 | int(ip[3])}, nil
+	case *dns.TXT:
+		if len(rr.Txt) == 0 {
+			return Ack{}, fmt.Errorf("TXT answer is not an acknowledgement")
+		}
+		counts, nack := strings.CutPrefix(rr.Txt[0], nackPrefix)
+		if !nack {
+			var ok bool
+			if counts, ok = strings.CutPrefix(rr.Txt[0], ackPrefix); !ok {
+				return Ack{}, fmt.Errorf("TXT answer is not an acknowledgement")
+			}
+		}
+		received, total, err := parsePair(counts)
+		if err != nil {
+			return Ack{}, err
+		}
+		ack := Ack{Received: received, Total: total, Nack: nack}
+		for _, s := range rr.Txt[1:] {
+			offset, length, err := parsePair(s)
+			if err != nil {
+				return Ack{}, err
+			}
+			ack.Missing = append(ack.Missing, Range{Offset: offset, Length: length})
+		}
+		return ack, nil
+	default:
+		return Ack{}, fmt.Errorf("Unexpected %s acknowledgement", dns.TypeToString[rr.Header().Rrtype])
+	}
+}
+
+func parsePair(s string) (int, int, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Malformed acknowledgement %q", s)
+	}
+	a, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return a, b, nil
+}
+
+// ack acknowledges the fragments received so far.
+func (fl fragmentList) ack() Ack {
+	missing := fl.missing()
+	received := fl.totalSize
+	for _, gap := range missing {
+		received -= gap.Length
+	}
+	return Ack{Received: received, Total: fl.totalSize, Missing: missing}
+}
+
+// rr encodes the acknowledgement as an answer to a query for name of type qtype.
+func (a Ack) rr(name string, qtype uint16, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+	if qtype == dns.TypeA {
+		received, total := min(a.Received, 0xffff), min(a.Total, 0xffff)
+		return &dns.A{Hdr: hdr, A: net.IPv4(byte(received>>8), byte(received), byte(total>>8), byte(total))}
+	}
+	prefix, ranges := ackPrefix, maxAckRanges
+	if a.Nack {
+		prefix, ranges = nackPrefix, maxNackRanges
+	}
+	txt := []string{fmt.Sprintf("%s%d.%d", prefix, a.Received, a.Total)}
+	for i, gap := range a.Missing {
+		if i == ranges {
+			break
+		}
+		txt = append(txt, fmt.Sprintf("%d.%d", gap.Offset, gap.Length))
+	}
+	return &dns.TXT{Hdr: hdr, Txt: txt}
+}
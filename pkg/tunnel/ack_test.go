@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func ackServer(t *testing.T, tun *Tunnel, domain string, qtype uint16) Ack {
+	req := &dns.Msg{}
+	req.SetQuestion(domain, qtype)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+
+	require.Len(t, w.msg.Answer, 1)
+	ack, err := ParseAck(w.msg.Answer[0])
+	require.Nil(t, err)
+	return ack
+}
+
+func TestAcks(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Acks: true})
+	defer tun.Close()
+
+	ack := ackServer(t, tun, "2jkhm3.24.5.3dpeb3w.tunnel.example.com.", dns.TypeTXT)
+	require.Equal(t, Ack{Received: 7, Total: 24, Missing: []Range{{Offset: 0, Length: 5}, {Offset: 12, Length: 12}}}, ack)
+	require.False(t, ack.Complete())
+
+	ack = ackServer(t, tun, "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com.", dns.TypeA)
+	require.Equal(t, Ack{Received: 12, Total: 24}, ack)
+
+	ack = ackServer(t, tun, "2jkhm3.24.12.64tmmq000000.tunnel.example.com.", dns.TypeTXT)
+	require.Equal(t, Ack{Received: 24, Total: 24}, ack)
+	require.True(t, ack.Complete())
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+
+	// Queries that don't carry a parsable fragment are answered as usual.
+	req := &dns.Msg{}
+	req.SetQuestion("2jkhm3.FAIL.0.nbswy3dp.tunnel.example.com.", dns.TypeA)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+	require.IsType(t, &dns.CNAME{}, w.msg.Answer[0])
+}
+
+func TestParseAck(t *testing.T) {
+	hdr := dns.RR_Header{Name: "x.tunnel.example.com.", Class: dns.ClassINET}
+	tests := []struct {
+		rr     dns.RR
+		output Ack
+		fails  bool
+	}{
+		{rr: &dns.A{Hdr: hdr, A: net.IPv4(0x12, 0x34, 0x13, 0x88)}, output: Ack{Received: 0x1234, Total: 5000}},
+		{rr: &dns.TXT{Hdr: hdr, Txt: []string{"ack.3.10", "3.7"}}, output: Ack{Received: 3, Total: 10, Missing: []Range{{Offset: 3, Length: 7}}}},
+		{rr: &dns.TXT{Hdr: hdr, Txt: []string{"nack.3.10", "0.2", "5.2"}}, output: Ack{Received: 3, Total: 10, Missing: []Range{{Offset: 0, Length: 2}, {Offset: 5, Length: 2}}, Nack: true}},
+		{rr: &dns.TXT{Hdr: hdr, Txt: []string{""}}, fails: true},
+		{rr: &dns.TXT{Hdr: hdr, Txt: []string{"ack.3"}}, fails: true},
+		{rr: &dns.TXT{Hdr: hdr, Txt: []string{"ack.3.10", "x.7"}}, fails: true},
+		{rr: &dns.CNAME{Hdr: hdr, Target: "blackhole-1.iana.org."}, fails: true},
+	}
+	for _, test := range tests {
+		got, err := ParseAck(test.rr)
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+			require.Equal(t, test.output, got)
+		}
+	}
+}
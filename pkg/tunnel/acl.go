@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"net"
+)
+
+// An acl decides which source networks may query the tunnel.
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// permits reports whether ip may query the tunnel. Addresses in a denied network are never
+// permitted. If any networks are allowed, only addresses in them are permitted.
+func (a acl) permits(ip net.IP) bool {
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceIP returns the IP address of addr, or nil if it has none.
+func sourceIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.ParseIP(addr.String())
+	}
+	return net.ParseIP(host)
+}
+
+// ParseCIDRs parses networks in CIDR notation, such as 192.0.2.0/24 or 2001:db8::/32, for use in
+// Config.AllowCIDRs and Config.DenyCIDRs.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
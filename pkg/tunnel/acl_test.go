@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACL(t *testing.T) {
+	allow, err := ParseCIDRs([]string{"192.0.2.0/24", "2001:db8::/32"})
+	require.Nil(t, err)
+	deny, err := ParseCIDRs([]string{"192.0.2.128/25"})
+	require.Nil(t, err)
+
+	tests := []struct {
+		acl    acl
+		ip     string
+		output bool
+	}{
+		{acl: acl{}, ip: "198.51.100.1", output: true},
+		{acl: acl{allow: allow}, ip: "192.0.2.1", output: true},
+		{acl: acl{allow: allow}, ip: "2001:db8::1", output: true},
+		{acl: acl{allow: allow}, ip: "198.51.100.1", output: false},
+		{acl: acl{allow: allow, deny: deny}, ip: "192.0.2.200", output: false},
+		{acl: acl{deny: deny}, ip: "192.0.2.200", output: false},
+		{acl: acl{deny: deny}, ip: "192.0.2.1", output: true},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.output, test.acl.permits(net.ParseIP(test.ip)), test.ip)
+	}
+
+	_, err = ParseCIDRs([]string{"192.0.2.1"})
+	require.NotNil(t, err)
+}
+
+func TestSourceIP(t *testing.T) {
+	require.Equal(t, "192.0.2.1", sourceIP(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}).String())
+	require.Equal(t, "2001:db8::1", sourceIP(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}).String())
+	require.Nil(t, sourceIP(nil))
+}
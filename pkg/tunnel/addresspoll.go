@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Clients that can't make TXT queries, such as browsers resolving names through the system
+// resolver, can poll for downstream messages with A or AAAA queries instead. The answer to such a
+// poll is a single address carrying 4 (A) or 16 (AAAA) bytes of message seq starting at offset,
+// padded with zeros past its end. Since an address has no room for the header of a TXT answer,
+// the offset label of the poll can instead be
+//
+//	poll-<nonce>.<clientID>.<seq>.seq.<topDomain>
+//	poll-<nonce>.<clientID>.<seq>.size.<topDomain>
+//
+// whose answers carry a big-endian uint32 in their first 4 bytes: the seq of the first message
+// queued from seq on, and the total length of message seq. A client polls for the size of seq,
+// and if there is no answer, for the seq to move on to, then for the chunks of the message at
+// offsets 0, 4, 8 and so on. Polls that aren't answered with an address, because nothing is
+// queued or message seq isn't queued anymore, get an answer without records. As with TXT polls,
+// polling for a seq acknowledges every message before it, and TXT polls for a seq or size are
+// answered like those for offset 0.
+const (
+	pollSeqLabel  = "seq"
+	pollSizeLabel = "size"
+)
+
+// A pollKind tells what a poll asks for.
+type pollKind int
+
+const (
+	// pollChunk polls for the chunk at an offset.
+	pollChunk pollKind = iota
+	// pollSeq polls for the seq of the first message queued.
+	pollSeq
+	// pollSize polls for the total length of a message.
+	pollSize
+)
+
+// EncodeSeqPoll returns the domain a client identified by clientID queries with A or AAAA to
+// learn the seq of the first downstream message queued from seq on.
+func EncodeSeqPoll(topDomain, clientID, nonce string, seq int) string {
+	return fmt.Sprintf("%s%s.%s.%d.%s.%s", pollPrefix, nonce, clientID, seq, pollSeqLabel, dns.Fqdn(topDomain))
+}
+
+// EncodeSizePoll returns the domain a client identified by clientID queries with A or AAAA to
+// learn the total length of downstream message seq.
+func EncodeSizePoll(topDomain, clientID, nonce string, seq int) string {
+	return fmt.Sprintf("%s%s.%s.%d.%s.%s", pollPrefix, nonce, clientID, seq, pollSizeLabel, dns.Fqdn(topDomain))
+}
+
+// ParseAddressNumber returns the number carried by rr, the A or AAAA record answering a seq or
+// size poll.
+func ParseAddressNumber(rr dns.RR) (int, error) {
+	b, err := addressBytes(rr)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// ParseAddressChunk returns the bytes of a message carried by rr, the A or AAAA record answering
+// the poll for its chunk at offset, given its total length.
+func ParseAddressChunk(rr dns.RR, offset, total int) ([]byte, error) {
+	b, err := addressBytes(rr)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset >= total {
+		return nil, fmt.Errorf("Offset %d is outside of a message of %d bytes", offset, total)
+	}
+	return b[:min(len(b), total-offset)], nil
+}
+
+// addressBytes returns the 4 bytes of the address of an A record, or the 16 bytes of that of an
+// AAAA record. The latter are taken as they are even if they look like an IPv4-mapped address.
+func addressBytes(rr dns.RR) ([]byte, error) {
+	var b net.IP
+	switch rr := rr.(type) {
+	case *dns.A:
+		b = rr.A.To4()
+	case *dns.AAAA:
+		b = rr.AAAA.To16()
+	case nil:
+		return nil, fmt.Errorf("Poll has no answer")
+	default:
+		return nil, fmt.Errorf("Poll answer is a %s record, not an address", dns.Type(rr.Header().Rrtype))
+	}
+	if b == nil {
+		return nil, fmt.Errorf("Invalid poll answer address")
+	}
+	return b, nil
+}
+
+// pollAddress returns the address answering p, a poll of type qtype, A or AAAA, acknowledging
+// every message before p.seq. It returns nil if the poll has no answer.
+func (tun *Tunnel) pollAddress(p poll, qtype uint16) net.IP {
+	c, ok := tun.nextChunk(p)
+	if !ok {
+		return nil
+	}
+	size := net.IPv4len
+	if qtype == dns.TypeAAAA {
+		size = net.IPv6len
+	}
+	b := make([]byte, size)
+	switch {
+	case p.kind == pollSeq:
+		binary.BigEndian.PutUint32(b, uint32(c.Seq))
+	case c.Seq != p.seq:
+		return nil
+	case p.kind == pollSize:
+		binary.BigEndian.PutUint32(b, uint32(c.Total))
+	case c.Offset != p.offset || c.Offset >= c.Total:
+		return nil
+	default:
+		copy(b, c.Data)
+	}
+	return net.IP(b)
+}
+
+// addressRR returns the record of type qtype, A or AAAA, answering name with ip.
+func addressRR(name string, qtype uint16, ttl uint32, ip net.IP) dns.RR {
+	hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+	if qtype == dns.TypeA {
+		return &dns.A{Hdr: hdr, A: ip}
+	}
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// pollAddressServer polls tun for name with a query of type qtype through ServeDNS, and returns
+// the address record in the answer, or nil if there is none.
+func pollAddressServer(t *testing.T, tun *Tunnel, name string, qtype uint16) dns.RR {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+
+	require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+	if len(w.msg.Answer) == 0 {
+		return nil
+	}
+	require.Len(t, w.msg.Answer, 1)
+	require.Equal(t, qtype, w.msg.Answer[0].Header().Rrtype)
+	return w.msg.Answer[0]
+}
+
+func TestParsePollKinds(t *testing.T) {
+	p, isPoll, err := parsePoll("tunnel.example.com.", "poll-x7f2.c1.3.seq.tunnel.example.com.")
+	require.Nil(t, err)
+	require.True(t, isPoll)
+	require.Equal(t, poll{clientID: "c1", seq: 3, kind: pollSeq}, p)
+
+	p, _, err = parsePoll("tunnel.example.com.", EncodeSizePoll("tunnel.example.com", "c1", "x7f2", 3))
+	require.Nil(t, err)
+	require.Equal(t, poll{clientID: "c1", seq: 3, kind: pollSize}, p)
+
+	_, _, err = parsePoll("tunnel.example.com.", "poll-x7f2.c1.-1.seq.tunnel.example.com.")
+	require.NotNil(t, err)
+}
+
+func TestAddressPoll(t *testing.T) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+
+		require.Nil(t, pollAddressServer(t, tun, EncodeSeqPoll("tunnel.example.com", "c1", "n0nce", 0), qtype))
+
+		long := bytes.Repeat([]byte("downstream "), 5)
+		_, err := tun.Send("c1", long)
+		require.Nil(t, err)
+		_, err = tun.Send("c1", []byte("second"))
+		require.Nil(t, err)
+
+		// A client that doesn't know where the queue starts learns it from a seq poll.
+		require.Nil(t, pollAddressServer(t, tun, EncodeSizePoll("tunnel.example.com", "c1", "n0nce", 0), qtype))
+		seq, err := ParseAddressNumber(pollAddressServer(t, tun, EncodeSeqPoll("tunnel.example.com", "c1", "n0nce", 0), qtype))
+		require.Nil(t, err)
+		require.Equal(t, 1, seq)
+
+		for i, expected := range [][]byte{long, []byte("second")} {
+			seq := i + 1
+			total, err := ParseAddressNumber(pollAddressServer(t, tun, EncodeSizePoll("tunnel.example.com", "c1", "n0nce", seq), qtype))
+			require.Nil(t, err)
+			require.Equal(t, len(expected), total)
+
+			var got []byte
+			for len(got) < total {
+				rr := pollAddressServer(t, tun, EncodePoll("tunnel.example.com", "c1", "n0nce", seq, len(got)), qtype)
+				data, err := ParseAddressChunk(rr, len(got), total)
+				require.Nil(t, err)
+				got = append(got, data...)
+			}
+			require.Equal(t, expected, got)
+			require.Nil(t, pollAddressServer(t, tun, EncodePoll("tunnel.example.com", "c1", "n0nce", seq, total), qtype))
+		}
+
+		// Polling for seq 3 acknowledges both messages.
+		require.Nil(t, pollAddressServer(t, tun, EncodeSeqPoll("tunnel.example.com", "c1", "n0nce", 3), qtype))
+		require.Nil(t, pollAddressServer(t, tun, EncodePoll("tunnel.example.com", "c1", "n0nce", 2, 0), qtype))
+		tun.Close()
+	}
+}
+
+func TestAddressPollTXT(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+	_, err := tun.Send("c1", []byte("hello"))
+	require.Nil(t, err)
+
+	// TXT polls for a size are answered with the chunk at offset 0.
+	req := &dns.Msg{}
+	req.SetQuestion(EncodeSizePoll("tunnel.example.com", "c1", "n0nce", 1), dns.TypeTXT)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+	chunk, ok, err := ParseChunk(w.msg.Answer[0].(*dns.TXT).Txt)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, Chunk{Seq: 1, Offset: 0, Total: 5, Data: []byte("hello")}, chunk)
+}
+
+func TestParseAddressChunk(t *testing.T) {
+	// AAAA answers carry 16 bytes even when they look like IPv4-mapped addresses.
+	mapped := &dns.AAAA{AAAA: net.ParseIP("::ffff:192.0.2.1")}
+	data, err := ParseAddressChunk(mapped, 0, 16)
+	require.Nil(t, err)
+	require.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1}, data)
+
+	data, err = ParseAddressChunk(&dns.A{A: net.IPv4(1, 2, 3, 4)}, 8, 10)
+	require.Nil(t, err)
+	require.Equal(t, []byte{1, 2}, data)
+
+	_, err = ParseAddressChunk(&dns.A{A: net.IPv4(1, 2, 3, 4)}, 10, 10)
+	require.NotNil(t, err)
+	_, err = ParseAddressNumber(&dns.TXT{Hdr: dns.RR_Header{Rrtype: dns.TypeTXT}})
+	require.NotNil(t, err)
+}
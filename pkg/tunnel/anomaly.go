@@ -0,0 +1,203 @@
+package tunnel
+
+import (
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultAnomalyWindow is the default value of AnomalyConfig.Window.
+const DefaultAnomalyWindow = time.Minute
+
+// DefaultEntropyLabelLength is the default value of AnomalyConfig.EntropyLabelLength.
+const DefaultEntropyLabelLength = 16
+
+// An AlertKind tells which pattern an Alert reports.
+type AlertKind string
+
+// Kinds of Alert.
+const (
+	// AlertIDBurst reports more new message IDs within a window than AnomalyConfig.NewMessageIDs,
+	// e.g. a flood of bogus fragments, or a client gone haywire.
+	AlertIDBurst AlertKind = "id_burst"
+	// AlertClientSpike reports more queries from a client within a window than
+	// AnomalyConfig.ClientQueries.
+	AlertClientSpike AlertKind = "client_spike"
+	// AlertEntropy reports a query passed to Inspect, for a domain outside of the tunnel, with a
+	// label more random than AnomalyConfig.Entropy, as those of another tunnel would be.
+	AlertEntropy AlertKind = "entropy"
+)
+
+// AnomalyConfig configures the detection of suspicious traffic patterns, which are reported on
+// Alerts, e.g. to run the server as a sensor. Each kind of alert is disabled while its threshold
+// is 0.
+type AnomalyConfig struct {
+	// Window is the interval over which new message IDs and the queries of each client are
+	// counted. Each pattern is reported at most once per window. Defaults to
+	// DefaultAnomalyWindow.
+	Window time.Duration
+	// NewMessageIDs is the number of new message IDs within a window above which an
+	// AlertIDBurst is raised.
+	NewMessageIDs int
+	// ClientQueries is the number of queries from a single client within a window above which an
+	// AlertClientSpike is raised.
+	ClientQueries int
+	// Entropy is the Shannon entropy, in bits per character, above which a label of a query passed
+	// to Inspect raises an AlertEntropy. It can't exceed the base 2 logarithm of the length of the
+	// label: random base32 labels have around 3.6 bits per character at 16 characters and 4.5 at 52,
+	// while words rarely exceed 3.3.
+	Entropy float64
+	// EntropyLabelLength is the length of the shortest labels whose entropy is measured, since
+	// short labels can't have much of it. Defaults to DefaultEntropyLabelLength.
+	EntropyLabelLength int
+}
+
+// An Alert reports a suspicious traffic pattern detected as configured by Config.Anomalies.
+type Alert struct {
+	Kind AlertKind
+	// Time is when the pattern was detected.
+	Time time.Time
+	// Source is the address of the client, for AlertClientSpike and AlertEntropy.
+	Source net.IP
+	// Name is the query with the random label, for AlertEntropy.
+	Name string
+	// Count is the number of new message IDs, for AlertIDBurst, or of queries of the client, for
+	// AlertClientSpike, within the window so far.
+	Count int
+	// Entropy is the entropy of the most random label of Name, in bits per character, for
+	// AlertEntropy.
+	Entropy float64
+}
+
+// Alerts returns the channel on which the alerts of Config.Anomalies are reported. Like errors,
+// they are dropped if nobody is reading from the channel. The channel is closed by Close.
+func (tun *Tunnel) Alerts() <-chan Alert {
+	return tun.alerts
+}
+
+// countAlert counts an alert of kind in Stats.
+func (tun *Tunnel) countAlert(kind AlertKind) {
+	switch kind {
+	case AlertIDBurst:
+		atomic.AddUint64(&tun.stats.IDBursts, 1)
+	case AlertClientSpike:
+		atomic.AddUint64(&tun.stats.ClientSpikes, 1)
+	case AlertEntropy:
+		atomic.AddUint64(&tun.stats.EntropyAlerts, 1)
+	}
+}
+
+// notifyAlert counts a and reports it without blocking.
+func (tun *Tunnel) notifyAlert(a Alert) {
+	tun.countAlert(a.Kind)
+	select {
+	case tun.alerts <- a:
+	default:
+	}
+}
+
+// Inspect checks r, a query from addr outside the top domains of the tunnel, for the patterns of
+// Config.Anomalies that don't need the tunnel to parse it, e.g. before it is forwarded to upstream
+// resolvers.
+func (tun *Tunnel) Inspect(r *dns.Msg, addr net.Addr) {
+	if tun.anomalies.cfg.Entropy <= 0 || len(r.Question) == 0 {
+		return
+	}
+	tun.inspectEntropy(r.Question[0].Name, sourceIP(addr), tun.clock.Now())
+}
+
+// inspectEntropy raises an AlertEntropy if name has a label more random than allowed.
+func (tun *Tunnel) inspectEntropy(name string, source net.IP, now time.Time) {
+	if e := tun.anomalies.maxEntropy(name); e > tun.anomalies.cfg.Entropy {
+		tun.notifyAlert(Alert{Kind: AlertEntropy, Time: now, Source: source, Name: name, Entropy: e})
+	}
+}
+
+// A detector counts the events the alerts of an AnomalyConfig are raised on, over fixed windows.
+type detector struct {
+	cfg AnomalyConfig
+
+	mu    sync.Mutex
+	start time.Time
+	ids   int
+	// clients counts the queries of each client within the window.
+	clients map[string]int
+}
+
+// newDetector returns a detector for cfg, with its defaults set.
+func newDetector(cfg AnomalyConfig) *detector {
+	if cfg.Window == 0 {
+		cfg.Window = DefaultAnomalyWindow
+	}
+	if cfg.EntropyLabelLength == 0 {
+		cfg.EntropyLabelLength = DefaultEntropyLabelLength
+	}
+	return &detector{cfg: cfg, clients: make(map[string]int)}
+}
+
+// roll starts a new window if the current one is over by now. The lock of d must be held.
+func (d *detector) roll(now time.Time) {
+	if now.Sub(d.start) >= d.cfg.Window || now.Before(d.start) {
+		d.start = now
+		d.ids = 0
+		clear(d.clients)
+	}
+}
+
+// newID counts a new message ID, and returns the alert to raise if it is one too many.
+func (d *detector) newID(now time.Time) (Alert, bool) {
+	if d.cfg.NewMessageIDs <= 0 {
+		return Alert{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roll(now)
+	d.ids++
+	return Alert{Kind: AlertIDBurst, Time: now, Count: d.ids}, d.ids == d.cfg.NewMessageIDs+1
+}
+
+// query counts a query from client, and returns the alert to raise if it is one too many.
+func (d *detector) query(client string, source net.IP, now time.Time) (Alert, bool) {
+	if d.cfg.ClientQueries <= 0 {
+		return Alert{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roll(now)
+	d.clients[client]++
+	n := d.clients[client]
+	return Alert{Kind: AlertClientSpike, Time: now, Source: source, Count: n}, n == d.cfg.ClientQueries+1
+}
+
+// maxEntropy returns the entropy of the most random label of name that is long enough to be
+// measured, or 0 if there is none.
+func (d *detector) maxEntropy(name string) float64 {
+	var most float64
+	for _, label := range strings.Split(strings.ToLower(name), ".") {
+		if len(label) >= d.cfg.EntropyLabelLength {
+			most = max(most, entropy(label))
+		}
+	}
+	return most
+}
+
+// entropy returns the Shannon entropy of the bytes of s, in bits per byte.
+func entropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var h float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(s))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
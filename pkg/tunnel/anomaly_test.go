@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntropy(t *testing.T) {
+	require.Equal(t, 0.0, entropy("aaaaaaaa"))
+	require.Equal(t, 1.0, entropy("abababab"))
+	require.Equal(t, 4.0, entropy("0123456789abcdef"))
+
+	d := newDetector(AnomalyConfig{})
+	require.Equal(t, 0.0, d.maxEntropy("0123456789abcde.example.com."))
+	require.Equal(t, 4.0, d.maxEntropy("www.0123456789ABCDEF.example.com."))
+}
+
+func TestAnomalyBursts(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Clock: clock, Anomalies: AnomalyConfig{
+		Window:        time.Minute,
+		NewMessageIDs: 2,
+		ClientQueries: 4,
+	}})
+	defer tun.Close()
+
+	send := func(id string) {
+		r := &dns.Msg{}
+		r.SetQuestion(fmt.Sprintf("%s.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", id), dns.TypeA)
+		tun.ServeDNS(&testResponseWriter{}, r)
+	}
+	for _, id := range []string{"aaaaaa", "bbbbbb", "bbbbbb", "cccccc", "dddddd"} {
+		send(id)
+	}
+	// The third new ID and the fifth query each raise a single alert, in no particular order since
+	// fragments may be recorded after the query is answered.
+	alerts := make(map[AlertKind]Alert)
+	for i := 0; i < 2; i++ {
+		a := <-tun.Alerts()
+		alerts[a.Kind] = a
+	}
+	require.Equal(t, Alert{Kind: AlertIDBurst, Time: clock.Now(), Count: 3}, alerts[AlertIDBurst])
+	require.Equal(t, Alert{Kind: AlertClientSpike, Time: clock.Now(), Source: net.IPv4(192, 0, 2, 1), Count: 5}, alerts[AlertClientSpike])
+	require.Len(t, tun.Alerts(), 0)
+
+	// Counts start over with the next window.
+	clock.Advance(time.Minute)
+	for _, id := range []string{"eeeeee", "ffffff", "gggggg"} {
+		send(id)
+	}
+	require.Equal(t, AlertIDBurst, (<-tun.Alerts()).Kind)
+	require.Len(t, tun.Alerts(), 0)
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(2), stats.IDBursts)
+	require.Equal(t, uint64(1), stats.ClientSpikes)
+}
+
+func TestInspect(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Anomalies: AnomalyConfig{Entropy: 3.5}})
+	defer tun.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	for _, name := range []string{"www.example.org.", "documentationsite.example.org.", "k2x9q7vz4m1p8r3t.example.org."} {
+		r := &dns.Msg{}
+		r.SetQuestion(name, dns.TypeA)
+		tun.Inspect(r, addr)
+	}
+
+	alert := <-tun.Alerts()
+	require.Equal(t, AlertEntropy, alert.Kind)
+	require.Equal(t, "k2x9q7vz4m1p8r3t.example.org.", alert.Name)
+	require.Equal(t, "192.0.2.1", alert.Source.String())
+	require.Equal(t, 4.0, alert.Entropy)
+	require.Len(t, tun.Alerts(), 0)
+	require.Equal(t, uint64(1), tun.Stats().EntropyAlerts)
+}
+
+func TestAnomalyConfigInvalid(t *testing.T) {
+	_, err := New(Config{TopDomain: "tunnel.example.com.", Anomalies: AnomalyConfig{Entropy: -1}})
+	require.NotNil(t, err)
+}
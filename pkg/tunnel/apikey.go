@@ -0,0 +1,180 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An APIKey is an auth token issued to a single client or project, with quotas of its own.
+// Fragments carrying the token of a key are accepted like those carrying one of Config.AuthTokens,
+// and count against the key's quotas, so that a leaked or misbehaving key can't use up a tenant.
+type APIKey struct {
+	// Name identifies the key in stats and logs, which never report the token itself.
+	Name string
+	// Token is the auth token carried by the fragments sent with the key. It is matched
+	// case-insensitively.
+	Token string
+	// Tenant, if set, is the only tenant that fragments carrying the key are accepted for.
+	Tenant string
+
+	// MessagesPerHour is the maximum number of messages started with the key in each hour, and
+	// BytesPerDay the maximum number of bytes of encoded data sent with it in each day, in UTC.
+	// Fragments beyond them are dropped and counted in APIKeyStats.OverQuota. Zero means no
+	// limit.
+	MessagesPerHour int
+	BytesPerDay     int
+}
+
+// APIKeyStats holds the counters and the quota usage of a single API key.
+type APIKeyStats struct {
+	// Tenant, MessagesPerHour and BytesPerDay are as configured on the APIKey.
+	Tenant          string
+	MessagesPerHour int
+	BytesPerDay     int
+
+	// Messages is the number of messages started with the key in the current hour, and Bytes the
+	// number of bytes sent with it in the current day. They are reset at HourEnds and DayEnds.
+	Messages int
+	Bytes    int
+	HourEnds time.Time
+	DayEnds  time.Time
+
+	// Fragments counts fragments accepted with the key.
+	Fragments uint64
+	// OverQuota counts fragments dropped because the key exceeded its quotas.
+	OverQuota uint64
+}
+
+// ParseAPIKey parses an API key as passed on the command line:
+// name:token[:tenant[:messagesPerHour[:bytesPerDay]]].
+func ParseAPIKey(s string) (APIKey, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) < 2 || len(fields) > 5 {
+		return APIKey{}, fmt.Errorf("API key has %d fields but expected 2 to 5", len(fields))
+	}
+	k := APIKey{Name: fields[0], Token: fields[1]}
+	if len(fields) > 2 {
+		k.Tenant = fields[2]
+	}
+	var err error
+	if len(fields) > 3 && fields[3] != "" {
+		if k.MessagesPerHour, err = strconv.Atoi(fields[3]); err != nil {
+			return APIKey{}, fmt.Errorf("Invalid messages per hour in API key %s: %w", k.Name, err)
+		}
+	}
+	if len(fields) > 4 && fields[4] != "" {
+		if k.BytesPerDay, err = strconv.Atoi(fields[4]); err != nil {
+			return APIKey{}, fmt.Errorf("Invalid bytes per day in API key %s: %w", k.Name, err)
+		}
+	}
+	return k, nil
+}
+
+// apiKeyState is the state the tunnel keeps for a configured API key.
+type apiKeyState struct {
+	APIKey
+
+	mu sync.Mutex
+	// hour and day are the starts of the current windows of the quotas, and messages and bytes
+	// the usage within them.
+	hour     time.Time
+	day      time.Time
+	messages int
+	bytes    int
+
+	fragments atomic.Uint64
+	overQuota atomic.Uint64
+}
+
+// newAPIKeys validates keys, whose tenants must be configured, and returns their state.
+func newAPIKeys(keys []APIKey, tenants map[string]*tenantState) ([]*apiKeyState, error) {
+	var states []*apiKeyState
+	names, tokens := make(map[string]bool), make(map[string]bool)
+	for _, k := range keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("API keys must have a name")
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("API key %s is configured more than once", k.Name)
+		}
+		if k.Token == "" || strings.Contains(k.Token, ".") || len(k.Token) > maxLabelLen {
+			return nil, fmt.Errorf("Token of API key %s must be a single non-empty label", k.Name)
+		}
+		k.Token = strings.ToLower(k.Token)
+		if tokens[k.Token] {
+			return nil, fmt.Errorf("Token of API key %s is shared with another key", k.Name)
+		}
+		k.Tenant = strings.ToLower(k.Tenant)
+		if _, ok := tenants[k.Tenant]; k.Tenant != "" && !ok {
+			return nil, fmt.Errorf("API key %s is for tenant %s, which is not configured", k.Name, k.Tenant)
+		}
+		if k.MessagesPerHour < 0 || k.BytesPerDay < 0 {
+			return nil, fmt.Errorf("Quotas of API key %s must not be negative", k.Name)
+		}
+		names[k.Name], tokens[k.Token] = true, true
+		states = append(states, &apiKeyState{APIKey: k})
+	}
+	return states, nil
+}
+
+// roll starts new windows of the quotas if the current ones ended by now. The lock of k must be
+// held.
+func (k *apiKeyState) roll(now time.Time) {
+	now = now.UTC()
+	if hour := now.Truncate(time.Hour); !hour.Equal(k.hour) {
+		k.hour, k.messages = hour, 0
+	}
+	if day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC); !day.Equal(k.day) {
+		k.day, k.bytes = day, 0
+	}
+}
+
+// admit counts a fragment of size bytes sent with the key, which starts a new message if start is
+// set, unless that would exceed the key's quotas, in which case it returns an error.
+func (k *apiKeyState) admit(start bool, size int, now time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.roll(now)
+	if start && k.MessagesPerHour > 0 && k.messages >= k.MessagesPerHour {
+		k.overQuota.Add(1)
+		return fmt.Errorf("API key %s already started %d messages this hour", k.Name, k.messages)
+	}
+	if k.BytesPerDay > 0 && k.bytes+size > k.BytesPerDay {
+		k.overQuota.Add(1)
+		return fmt.Errorf("API key %s already sent %d of %d bytes today", k.Name, k.bytes, k.BytesPerDay)
+	}
+	if start {
+		k.messages++
+	}
+	k.bytes += size
+	k.fragments.Add(1)
+	return nil
+}
+
+// APIKeyStats returns a snapshot of the counters and quota usage of each configured API key,
+// keyed by name.
+func (tun *Tunnel) APIKeyStats() map[string]APIKeyStats {
+	now := tun.clock.Now()
+	stats := make(map[string]APIKeyStats, len(tun.authTokens.keys))
+	for _, k := range tun.authTokens.keys {
+		k.mu.Lock()
+		k.roll(now)
+		stats[k.Name] = APIKeyStats{
+			Tenant:          k.Tenant,
+			MessagesPerHour: k.MessagesPerHour,
+			BytesPerDay:     k.BytesPerDay,
+			Messages:        k.messages,
+			Bytes:           k.bytes,
+			HourEnds:        k.hour.Add(time.Hour),
+			DayEnds:         k.day.AddDate(0, 0, 1),
+			Fragments:       k.fragments.Load(),
+			OverQuota:       k.overQuota.Load(),
+		}
+		k.mu.Unlock()
+	}
+	return stats
+}
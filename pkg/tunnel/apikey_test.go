@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAPIKey(t *testing.T) {
+	tests := []struct {
+		input  string
+		fails  bool
+		output APIKey
+	}{
+		{input: "ci:k3y", output: APIKey{Name: "ci", Token: "k3y"}},
+		{input: "ci:k3y:alpha", output: APIKey{Name: "ci", Token: "k3y", Tenant: "alpha"}},
+		{input: "ci:k3y:alpha:100:5000", output: APIKey{Name: "ci", Token: "k3y", Tenant: "alpha", MessagesPerHour: 100, BytesPerDay: 5000}},
+		{input: "ci:k3y::100", output: APIKey{Name: "ci", Token: "k3y", MessagesPerHour: 100}},
+		{input: "ci:k3y:::5000", output: APIKey{Name: "ci", Token: "k3y", BytesPerDay: 5000}},
+		{input: "ci", fails: true},
+		{input: "ci:k3y:alpha:FAIL", fails: true},
+		{input: "ci:k3y:alpha:1:FAIL", fails: true},
+		{input: "ci:k3y:alpha:1:2:3", fails: true},
+	}
+	for _, test := range tests {
+		got, err := ParseAPIKey(test.input)
+		if test.fails {
+			require.NotNil(t, err, test.input)
+		} else {
+			require.Nil(t, err, test.input)
+		}
+		require.Equal(t, test.output, got, test.input)
+	}
+}
+
+func TestNewAPIKeys(t *testing.T) {
+	tenants, err := newTenants([]Tenant{{Name: "alpha"}})
+	require.Nil(t, err)
+	tests := []struct {
+		keys  []APIKey
+		fails bool
+	}{
+		{keys: []APIKey{{Name: "a", Token: "k1"}, {Name: "b", Token: "K2", Tenant: "Alpha", MessagesPerHour: 1}}},
+		{keys: []APIKey{{Token: "k1"}}, fails: true},
+		{keys: []APIKey{{Name: "a", Token: "k1"}, {Name: "a", Token: "k2"}}, fails: true},
+		{keys: []APIKey{{Name: "a", Token: "k1"}, {Name: "b", Token: "K1"}}, fails: true},
+		{keys: []APIKey{{Name: "a", Token: "k.1"}}, fails: true},
+		{keys: []APIKey{{Name: "a", Token: "k1", Tenant: "beta"}}, fails: true},
+		{keys: []APIKey{{Name: "a", Token: "k1", BytesPerDay: -1}}, fails: true},
+	}
+	for _, test := range tests {
+		states, err := newAPIKeys(test.keys, tenants)
+		if test.fails {
+			require.NotNil(t, err)
+			continue
+		}
+		require.Nil(t, err)
+		require.Len(t, states, len(test.keys))
+	}
+}
+
+func TestAPIKeyQuotas(t *testing.T) {
+	k := &apiKeyState{APIKey: APIKey{Name: "ci", MessagesPerHour: 2, BytesPerDay: 100}}
+	now := time.Date(2020, 6, 1, 22, 30, 0, 0, time.UTC)
+
+	require.Nil(t, k.admit(true, 10, now))
+	require.Nil(t, k.admit(false, 10, now))
+	require.Nil(t, k.admit(true, 10, now))
+	// Fragments of messages already started are still admitted once the hourly quota is used up.
+	require.NotNil(t, k.admit(true, 10, now))
+	require.Nil(t, k.admit(false, 70, now))
+	require.NotNil(t, k.admit(false, 1, now))
+	require.Equal(t, uint64(2), k.overQuota.Load())
+
+	// The hourly quota is reset first, and the daily one at midnight UTC.
+	require.Nil(t, k.admit(true, 0, now.Add(30*time.Minute)))
+	require.NotNil(t, k.admit(false, 1, now.Add(30*time.Minute)))
+	require.Nil(t, k.admit(false, 100, now.Add(90*time.Minute)))
+	require.Equal(t, uint64(6), k.fragments.Load())
+}
+
+func TestAPIKeys(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain:  "tunnel.example.com.",
+		Tenants:    []Tenant{{Name: "alpha"}, {Name: "beta"}},
+		AuthTokens: []string{"shared"},
+		APIKeys: []APIKey{
+			{Name: "alpha-ci", Token: "k3y-alpha", Tenant: "alpha", MessagesPerHour: 1},
+			{Name: "any", Token: "k3y-any", BytesPerDay: 100},
+		},
+	})
+	defer tun.Close()
+	send := func(domain, token, id, msg string) {
+		t.Helper()
+		domains, err := Encoder{LabelLen: 63, Version: Version2, AuthToken: token}.Encode(domain, id, msg)
+		require.Nil(t, err)
+		for _, d := range domains {
+			tun.domains <- query{name: d, receivedAt: time.Now()}
+		}
+	}
+
+	// Keys limited to a tenant aren't accepted for others.
+	send("beta.tunnel.example.com.", "k3y-alpha", "2jkhm3", "forged")
+	send("alpha.tunnel.example.com.", "k3y-alpha", "i42ftq", "hello")
+	require.Equal(t, "hello", string((<-tun.Messages()).Payload))
+	send("alpha.tunnel.example.com.", "k3y-alpha", "x7f2aa", "over quota")
+	send("beta.tunnel.example.com.", "k3y-any", "m4v9rt", strings.Repeat("a", 100))
+	send("beta.tunnel.example.com.", "shared", "q8wz3n", "world")
+	require.Equal(t, "world", string((<-tun.Messages()).Payload))
+
+	stats := tun.APIKeyStats()
+	require.Equal(t, 1, stats["alpha-ci"].Messages)
+	require.Equal(t, uint64(1), stats["alpha-ci"].OverQuota)
+	require.Equal(t, "alpha", stats["alpha-ci"].Tenant)
+	require.True(t, stats["alpha-ci"].HourEnds.After(time.Now()))
+	require.Equal(t, uint64(1), stats["any"].OverQuota)
+	require.Zero(t, stats["any"].Bytes)
+	require.Equal(t, uint64(1), tun.Stats().Unauthorized)
+	require.Zero(t, tun.Stats().InFlight)
+}
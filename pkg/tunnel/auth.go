@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// tagSize is the size of the HMAC-SHA256 tag appended to authenticated messages.
+const tagSize = sha256.Size
+
+// sign appends the HMAC-SHA256 tag of payload under key to payload.
+func sign(key []byte, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(payload)
+}
+
+// verify checks the HMAC-SHA256 tag at the end of msg under key, and returns msg without the tag.
+func verify(key []byte, msg []byte) ([]byte, error) {
+	if len(msg) < tagSize {
+		return nil, fmt.Errorf("Message of %d bytes is too short to carry an authentication tag", len(msg))
+	}
+	payload, tag := msg[:len(msg)-tagSize], msg[len(msg)-tagSize:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(tag, mac.Sum(nil)) {
+		return nil, fmt.Errorf("Message has an invalid authentication tag")
+	}
+	return payload, nil
+}
+
+// tokenSize is the number of bytes of the HMAC-SHA256 of a message ID that make up the auth token
+// derived from it.
+const tokenSize = 10
+
+// DeriveAuthToken returns the auth token of the message id under key, for tunnels configured with
+// the same AuthTokenKey: the first 10 bytes of the HMAC-SHA256 of id, in hexadecimal.
+func DeriveAuthToken(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:tokenSize])
+}
+
+// authTokens checks the auth tokens carried by fragments, as configured by Config.AuthTokens,
+// Config.AuthTokenKey and Config.APIKeys. The zero value accepts every fragment.
+type authTokens struct {
+	tokens []string
+	key    []byte
+	keys   []*apiKeyState
+}
+
+// newAuthTokens validates tokens, which are matched case-insensitively like the rest of the
+// domain, and the API keys, whose tenants must be configured.
+func newAuthTokens(tokens []string, key []byte, keys []APIKey, tenants map[string]*tenantState) (authTokens, error) {
+	states, err := newAPIKeys(keys, tenants)
+	if err != nil {
+		return authTokens{}, err
+	}
+	a := authTokens{key: key, keys: states}
+	for _, token := range tokens {
+		if token == "" || strings.Contains(token, ".") || len(token) > maxLabelLen {
+			return authTokens{}, fmt.Errorf("Auth token %q must be a single non-empty label", token)
+		}
+		a.tokens = append(a.tokens, strings.ToLower(token))
+	}
+	return a, nil
+}
+
+// required reports whether fragments must carry an auth token.
+func (a authTokens) required() bool {
+	return len(a.tokens) > 0 || a.key != nil || len(a.keys) > 0
+}
+
+// check returns an error unless fg, sent to tenant, carries a valid auth token, if one is
+// required. If the token is that of an API key, the key is returned.
+func (a authTokens) check(fg fragment, tenant string) (*apiKeyState, error) {
+	if !a.required() {
+		return nil, nil
+	}
+	if fg.framing.flags&FlagToken == 0 {
+		return nil, fmt.Errorf("Fragment carries no auth token")
+	}
+	token := []byte(fg.framing.token)
+	valid := a.key != nil && hmac.Equal(token, []byte(DeriveAuthToken(a.key, fg.id)))
+	for _, t := range a.tokens {
+		valid = subtle.ConstantTimeCompare(token, []byte(t)) == 1 || valid
+	}
+	var key *apiKeyState
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(token, []byte(k.Token)) == 1 {
+			key = k
+		}
+	}
+	switch {
+	case key != nil && key.Tenant != "" && key.Tenant != tenant:
+		return nil, fmt.Errorf("Fragment carries the auth token of API key %s, which is not valid for tenant %q", key.Name, tenant)
+	case key == nil && !valid:
+		return nil, fmt.Errorf("Fragment carries an invalid auth token")
+	}
+	return key, nil
+}
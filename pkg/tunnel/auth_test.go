@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("secret")
+	signed := sign(key, []byte("hello world"))
+	require.Len(t, signed, len("hello world")+tagSize)
+
+	payload, err := verify(key, signed)
+	require.Nil(t, err)
+	require.Equal(t, []byte("hello world"), payload)
+
+	_, err = verify([]byte("wrong"), signed)
+	require.NotNil(t, err)
+
+	signed[0] ^= 1
+	_, err = verify(key, signed)
+	require.NotNil(t, err)
+
+	_, err = verify(key, []byte("short"))
+	require.NotNil(t, err)
+}
+
+func TestAuthTokens(t *testing.T) {
+	rules := parseRules{maxMessageSize: DefaultMaxMessageSize}
+	fg, err := parseDomain("tunnel.example.com.", "v2-40.k3y.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", rules)
+	require.Nil(t, err)
+	require.Equal(t, framing{version: Version2, flags: FlagToken, token: "k3y"}, fg.framing)
+	_, err = parseDomain("tunnel.example.com.", "v2-40.tunnel.example.com.", rules)
+	require.NotNil(t, err)
+
+	key := []byte("secret")
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", AuthTokens: []string{"K3y-One"}, AuthTokenKey: key})
+	defer tun.Close()
+
+	missing, err := EncodeMessage("tunnel.example.com.", "2jkhm3", "forged", 63)
+	require.Nil(t, err)
+	wrong, err := Encoder{LabelLen: 63, Version: Version2, AuthToken: "guess"}.Encode("tunnel.example.com.", "i42ftq", "forged")
+	require.Nil(t, err)
+	wrongKey, err := Encoder{LabelLen: 63, Version: Version2, AuthTokenKey: []byte("wrong")}.Encode("tunnel.example.com.", "q8wz3n", "forged")
+	require.Nil(t, err)
+	static, err := Encoder{LabelLen: 63, Version: Version2, AuthToken: "k3y-one"}.Encode("tunnel.example.com.", "x7f2aa", strings.Repeat("a", 300))
+	require.Nil(t, err)
+	require.Greater(t, len(static), 1)
+	derived, err := Encoder{LabelLen: 63, Version: Version2, AuthTokenKey: key}.Encode("tunnel.example.com.", "m4v9rt", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, "v2-40."+DeriveAuthToken(key, "m4v9rt")+".", derived[0][:len("v2-40.")+2*tokenSize+1])
+
+	for _, domain := range append(append(append(missing, wrong...), wrongKey...), static...) {
+		tun.domains <- query{name: domain}
+	}
+	require.Equal(t, strings.Repeat("a", 300), string((<-tun.Messages()).Payload))
+	for _, domain := range derived {
+		tun.domains <- query{name: domain}
+	}
+	require.Equal(t, "hello world", string((<-tun.Messages()).Payload))
+	// Fragments without a valid token never start a partial message.
+	stats := tun.Stats()
+	require.Equal(t, uint64(3), stats.Unauthorized)
+	require.Zero(t, stats.InFlight)
+
+	_, err = New(Config{TopDomain: "tunnel.example.com.", AuthTokens: []string{"a.b"}})
+	require.NotNil(t, err)
+}
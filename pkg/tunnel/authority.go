@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Timers of the SOA records of the top domains, in seconds. The tunnel has no secondaries, so
+// they only matter to resolvers that validate them.
+const (
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 86400
+)
+
+// An Authority describes the zones of the top domains, so that the tunnel answers SOA and NS
+// queries like the authoritative server it is delegated to. Some resolvers check the apex of a
+// delegated zone before they forward anything else to it.
+type Authority struct {
+	// Nameservers are the authoritative servers of every top domain, which should match the NS
+	// records delegating them, e.g. t1ns.example.com. NS queries for a top domain are answered
+	// with their names, with the addresses of those under a top domain as glue, and A and AAAA
+	// queries for them with their addresses. Without nameservers, NS queries are answered with
+	// no records, and the SOA record names the top domain itself as the primary server.
+	Nameservers []Nameserver
+	// Hostmaster is the mailbox of the person responsible for the zones, written as a domain,
+	// e.g. hostmaster.example.com. Defaults to hostmaster.<top domain>.
+	Hostmaster string
+	// Serial is the serial number of the zones. Defaults to 1.
+	Serial uint32
+}
+
+// A Nameserver is an authoritative server of the top domains.
+type Nameserver struct {
+	Name      string
+	Addresses []net.IP
+}
+
+// ParseNameserver parses a nameserver as passed on the command line: name[=address,...].
+func ParseNameserver(s string) (Nameserver, error) {
+	name, addrs, _ := strings.Cut(s, "=")
+	ns := Nameserver{Name: name}
+	if addrs == "" {
+		return ns, nil
+	}
+	for _, addr := range strings.Split(addrs, ",") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return Nameserver{}, fmt.Errorf("Invalid address %q of nameserver %q", addr, name)
+		}
+		ns.Addresses = append(ns.Addresses, ip)
+	}
+	return ns, nil
+}
+
+// validate checks a and fills in defaults.
+func (a *Authority) validate() error {
+	a.Nameservers = append([]Nameserver(nil), a.Nameservers...)
+	for i, ns := range a.Nameservers {
+		ns.Name = dns.Fqdn(strings.ToLower(ns.Name))
+		if _, ok := dns.IsDomainName(ns.Name); !ok || ns.Name == "." {
+			return fmt.Errorf("Invalid nameserver %q", ns.Name)
+		}
+		a.Nameservers[i] = ns
+	}
+	if a.Hostmaster != "" {
+		a.Hostmaster = dns.Fqdn(a.Hostmaster)
+		if _, ok := dns.IsDomainName(a.Hostmaster); !ok {
+			return fmt.Errorf("Invalid hostmaster %q", a.Hostmaster)
+		}
+	}
+	if a.Serial == 0 {
+		a.Serial = 1
+	}
+	return nil
+}
+
+// zoneOf returns the most specific top domain that name is, or is a subdomain of, or false if
+// there is none.
+func (tun *Tunnel) zoneOf(name string) (string, bool) {
+	for _, top := range tun.topDomains {
+		if name == top {
+			return top, true
+		}
+	}
+	return tun.topDomainOf(name)
+}
+
+// soa returns the SOA record of zone.
+func (a *Authority) soa(zone string, ttl uint32) *dns.SOA {
+	mname := zone
+	if len(a.Nameservers) > 0 {
+		mname = a.Nameservers[0].Name
+	}
+	mbox := a.Hostmaster
+	if mbox == "" {
+		mbox = "hostmaster." + zone
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      mname,
+		Mbox:    mbox,
+		Serial:  a.Serial,
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		// The minimum is the TTL of negative answers, which are no more cacheable than others.
+		Minttl: ttl,
+	}
+}
+
+// addresses returns the address records of ns for qtype, owned by domain.
+func (ns Nameserver) addresses(domain string, qtype uint16, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range ns.Addresses {
+		hdr := dns.RR_Header{Name: domain, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+		if ip4 := ip.To4(); ip4 != nil && qtype == dns.TypeA {
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && qtype == dns.TypeAAAA {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+// answer fills m, a reply to a query for domain (in lower case, name) of type qtype, if it is
+// answered from the zone rather than by the tunnel: SOA and NS queries, and queries for the
+// nameservers under a top domain. It reports whether it did. The reply is then completed by
+// complete, like those of the tunnel.
+func (a *Authority) answer(m *dns.Msg, zone, domain, name string, qtype uint16, ttl uint32) bool {
+	for _, ns := range a.Nameservers {
+		if ns.Name != name {
+			continue
+		}
+		if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+			m.Answer = ns.addresses(domain, qtype, ttl)
+		}
+		return true
+	}
+
+	switch {
+	case qtype == dns.TypeSOA && name == zone:
+		m.Answer = []dns.RR{a.soa(zone, ttl)}
+	case qtype == dns.TypeNS && name == zone && len(a.Nameservers) > 0:
+		for _, ns := range a.Nameservers {
+			hdr := dns.RR_Header{Name: domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl}
+			m.Answer = append(m.Answer, &dns.NS{Hdr: hdr, Ns: ns.Name})
+			if dns.IsSubDomain(zone, ns.Name) {
+				m.Extra = append(m.Extra, ns.addresses(ns.Name, dns.TypeA, ttl)...)
+				m.Extra = append(m.Extra, ns.addresses(ns.Name, dns.TypeAAAA, ttl)...)
+			}
+		}
+	case qtype == dns.TypeSOA || qtype == dns.TypeNS:
+	default:
+		return false
+	}
+	return true
+}
+
+// complete marks m, a reply to a query under zone, as authoritative. Negative replies carry the
+// SOA record of the zone, so that resolvers know how long to cache them.
+func (a *Authority) complete(m *dns.Msg, zone string, ttl uint32) {
+	m.Authoritative = true
+	if len(m.Answer) == 0 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		m.Ns = []dns.RR{a.soa(zone, ttl)}
+	}
+}
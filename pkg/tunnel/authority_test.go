@@ -0,0 +1,132 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNameserver(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Nameserver
+		err      bool
+	}{
+		{"ns1.example.com", Nameserver{Name: "ns1.example.com"}, false},
+		{"ns.tunnel.example.com=192.0.2.53", Nameserver{Name: "ns.tunnel.example.com", Addresses: []net.IP{net.ParseIP("192.0.2.53")}}, false},
+		{"ns.tunnel.example.com=192.0.2.53,2001:db8::53", Nameserver{Name: "ns.tunnel.example.com", Addresses: []net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53")}}, false},
+		{"ns.tunnel.example.com=nope", Nameserver{}, true},
+	}
+	for _, test := range tests {
+		ns, err := ParseNameserver(test.input)
+		if test.err {
+			require.NotNil(t, err, test.input)
+			continue
+		}
+		require.Nil(t, err, test.input)
+		require.Equal(t, test.expected, ns, test.input)
+	}
+}
+
+func TestAuthorityValidate(t *testing.T) {
+	_, err := New(Config{TopDomain: "tunnel.example.com", Authority: Authority{Nameservers: []Nameserver{{Name: ""}}}})
+	require.NotNil(t, err)
+	_, err = New(Config{TopDomain: "tunnel.example.com", Authority: Authority{Hostmaster: "bad..name"}})
+	require.NotNil(t, err)
+}
+
+func TestAuthority(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain: "tunnel.example.com",
+		Authority: Authority{Nameservers: []Nameserver{
+			{Name: "NS.tunnel.example.com", Addresses: []net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53")}},
+			{Name: "ns2.example.net"},
+		}},
+		Response: Response{TTL: 30},
+	})
+	defer tun.Close()
+
+	ask := func(name string, qtype uint16) *dns.Msg {
+		w := &testResponseWriter{}
+		r := &dns.Msg{}
+		r.SetQuestion(name, qtype)
+		tun.ServeDNS(w, r)
+		require.True(t, w.msg.Authoritative, name)
+		return w.msg
+	}
+
+	// The SOA of the apex names the first nameserver as the primary server.
+	m := ask("Tunnel.Example.com.", dns.TypeSOA)
+	require.Len(t, m.Answer, 1)
+	soa := m.Answer[0].(*dns.SOA)
+	require.Equal(t, "tunnel.example.com.", soa.Hdr.Name)
+	require.Equal(t, "ns.tunnel.example.com.", soa.Ns)
+	require.Equal(t, "hostmaster.tunnel.example.com.", soa.Mbox)
+	require.EqualValues(t, 1, soa.Serial)
+	require.EqualValues(t, 30, soa.Minttl)
+
+	// NS queries list every nameserver, with glue for those under the top domain.
+	m = ask("tunnel.example.com.", dns.TypeNS)
+	require.Len(t, m.Answer, 2)
+	require.Equal(t, "ns.tunnel.example.com.", m.Answer[0].(*dns.NS).Ns)
+	require.Equal(t, "ns2.example.net.", m.Answer[1].(*dns.NS).Ns)
+	require.Len(t, m.Extra, 2)
+	require.Equal(t, "192.0.2.53", m.Extra[0].(*dns.A).A.String())
+	require.Equal(t, "2001:db8::53", m.Extra[1].(*dns.AAAA).AAAA.String())
+
+	// Nameservers under the top domain resolve to their addresses, not to tunnel responses.
+	m = ask("ns.tunnel.example.com.", dns.TypeA)
+	require.Len(t, m.Answer, 1)
+	require.Equal(t, "192.0.2.53", m.Answer[0].(*dns.A).A.String())
+	m = ask("ns.tunnel.example.com.", dns.TypeMX)
+	require.Empty(t, m.Answer)
+	require.IsType(t, &dns.SOA{}, m.Ns[0])
+
+	// SOA and NS queries below the apex have no records, and replies without an answer carry
+	// the SOA of the zone.
+	for _, qtype := range []uint16{dns.TypeSOA, dns.TypeNS} {
+		m = ask("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", qtype)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Empty(t, m.Answer)
+		require.Len(t, m.Ns, 1)
+		require.Equal(t, "tunnel.example.com.", m.Ns[0].Header().Name)
+	}
+
+	// Tunnel queries are answered as usual, authoritatively.
+	m = ask("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA)
+	require.IsType(t, &dns.CNAME{}, m.Answer[0])
+	require.Empty(t, m.Ns)
+	require.Equal(t, "hello world", string((<-tun.Messages()).Payload))
+}
+
+func TestAuthorityNegative(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain: "tunnel.example.com",
+		Authority: Authority{Hostmaster: "admin.example.com", Serial: 2024},
+		Response:  Response{Mode: ResponseNXDomain},
+	})
+	defer tun.Close()
+
+	// Without nameservers, the SOA names the top domain itself, and NS queries get NODATA.
+	w := &testResponseWriter{}
+	r := &dns.Msg{}
+	r.SetQuestion("tunnel.example.com.", dns.TypeNS)
+	tun.ServeDNS(w, r)
+	require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+	require.Empty(t, w.msg.Answer)
+	soa := w.msg.Ns[0].(*dns.SOA)
+	require.Equal(t, "tunnel.example.com.", soa.Ns)
+	require.Equal(t, "admin.example.com.", soa.Mbox)
+	require.EqualValues(t, 2024, soa.Serial)
+
+	// NXDOMAIN answers carry the SOA, so that resolvers can cache them.
+	w = &testResponseWriter{}
+	r.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(w, r)
+	require.Equal(t, dns.RcodeNameError, w.msg.Rcode)
+	require.True(t, w.msg.Authoritative)
+	require.IsType(t, &dns.SOA{}, w.msg.Ns[0])
+	<-tun.Messages()
+}
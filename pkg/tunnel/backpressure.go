@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// A Backpressure policy decides what happens to an assembled message when the Messages channel
+// is full because messages aren't read as fast as they are assembled.
+type Backpressure int
+
+const (
+	// Block waits until there is room for the message. Reassembly of the messages handled by the
+	// same worker stalls in the meantime, and answers to acknowledged queries are delayed.
+	Block Backpressure = iota
+	// DropNewest drops the message.
+	DropNewest
+	// DropOldest drops the oldest message waiting in the channel to make room for the message.
+	DropOldest
+	// Spill appends the message to the Spool configured on the tunnel. Spilled messages are
+	// delivered through the channel in order as soon as there is room, and survive a restart.
+	Spill
+)
+
+// backpressureNames are the names of the policies, as accepted by ParseBackpressure.
+var backpressureNames = map[Backpressure]string{
+	Block:      "block",
+	DropNewest: "drop-newest",
+	DropOldest: "drop-oldest",
+	Spill:      "spill",
+}
+
+// ParseBackpressure parses a policy as passed on the command line: block, drop-newest,
+// drop-oldest or spill.
+func ParseBackpressure(s string) (Backpressure, error) {
+	for b, name := range backpressureNames {
+		if s == name {
+			return b, nil
+		}
+	}
+	return Block, fmt.Errorf("Unknown backpressure policy %q", s)
+}
+
+func (b Backpressure) String() string {
+	if name, ok := backpressureNames[b]; ok {
+		return name
+	}
+	return fmt.Sprintf("Backpressure(%d)", int(b))
+}
+
+// A Spool holds the messages spilled by the Spill policy until there is room for them in the
+// Messages channel, e.g. in a file. Methods are called by several goroutines, but never at the
+// same time.
+type Spool interface {
+	// Push appends msg to the spool.
+	Push(msg Message) error
+	// Peek returns the oldest message in the spool, or false if it is empty.
+	Peek() (Message, bool, error)
+	// Pop removes the oldest message from the spool.
+	Pop() error
+	// Len returns the number of messages in the spool.
+	Len() (int, error)
+}
+
+// deliver sends an assembled message on the Messages channel according to the backpressure
+// policy.
+func (tun *Tunnel) deliver(msg Message) {
+	switch tun.backpressure {
+	case DropNewest:
+		select {
+		case tun.messages <- msg:
+		default:
+			tun.overflow(msg)
+		}
+	case DropOldest:
+		for {
+			select {
+			case tun.messages <- msg:
+				return
+			default:
+			}
+			select {
+			case old := <-tun.messages:
+				tun.overflow(old)
+			default:
+			}
+		}
+	case Spill:
+		tun.spill(msg)
+	default:
+		select {
+		case tun.messages <- msg:
+		case <-tun.ctx.Done():
+		}
+	}
+}
+
+// overflow records that msg was dropped because the Messages channel was full.
+func (tun *Tunnel) overflow(msg Message) {
+	atomic.AddUint64(&tun.stats.Overflowed, 1)
+	err := fmt.Errorf("Message backlog is full")
+	tun.logger.Warn("Dropping message", "id", msg.ID, "class", classBackpressure, "error", err)
+	tun.notifyError(TunnelError{Category: ErrBackpressure, ID: msg.ID, Tenant: msg.Tenant, Source: msg.Source, Err: err})
+}
+
+// spill sends msg on the Messages channel, or appends it to the spool if the channel is full or
+// older messages are already spooled, so that messages are delivered in order.
+func (tun *Tunnel) spill(msg Message) {
+	tun.spoolLock.Lock()
+	defer tun.spoolLock.Unlock()
+	if tun.spooled.Load() == 0 {
+		select {
+		case tun.messages <- msg:
+			return
+		default:
+		}
+	}
+	if err := tun.spool.Push(msg); err != nil {
+		tun.logger.Warn("Failed to spill message", "id", msg.ID, "error", err)
+		tun.overflow(msg)
+		return
+	}
+	atomic.AddUint64(&tun.stats.Spilled, 1)
+	tun.spooled.Add(1)
+	select {
+	case tun.unspool <- struct{}{}:
+	default:
+	}
+}
+
+// unspoolMessages delivers spooled messages through the Messages channel, oldest first, until the
+// tunnel is closed. A message is only removed from the spool once it has been sent.
+func (tun *Tunnel) unspoolMessages() {
+	defer tun.wg.Done()
+	for {
+		tun.spoolLock.Lock()
+		msg, ok, err := tun.spool.Peek()
+		tun.spoolLock.Unlock()
+		if err != nil {
+			tun.logger.Warn("Failed to read spilled message", "error", err)
+			ok = false
+		}
+		if !ok {
+			select {
+			case <-tun.unspool:
+				continue
+			case <-tun.ctx.Done():
+				return
+			}
+		}
+		select {
+		case tun.messages <- msg:
+		case <-tun.ctx.Done():
+			return
+		}
+		tun.spoolLock.Lock()
+		if err := tun.spool.Pop(); err != nil {
+			tun.logger.Warn("Failed to remove spilled message", "id", msg.ID, "error", err)
+		}
+		tun.spooled.Add(-1)
+		tun.spoolLock.Unlock()
+	}
+}
@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memSpool is a Spool held in memory.
+type memSpool struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (s *memSpool) Push(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+func (s *memSpool) Peek() (Message, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) == 0 {
+		return Message{}, false, nil
+	}
+	return s.messages[0], true, nil
+}
+
+func (s *memSpool) Pop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) > 0 {
+		s.messages = s.messages[1:]
+	}
+	return nil
+}
+
+func (s *memSpool) Len() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages), nil
+}
+
+func TestParseBackpressure(t *testing.T) {
+	for _, b := range []Backpressure{Block, DropNewest, DropOldest, Spill} {
+		got, err := ParseBackpressure(b.String())
+		require.Nil(t, err)
+		require.Equal(t, b, got)
+	}
+	_, err := ParseBackpressure("FAIL")
+	require.NotNil(t, err)
+}
+
+// sendMessages sends count single-fragment messages with IDs m0, m1, and so on.
+func sendMessages(t *testing.T, tun *Tunnel, count int) {
+	for i := 0; i < count; i++ {
+		domains, err := EncodeMessage("tunnel.example.com.", fmt.Sprintf("m%d", i), "hello world", 63)
+		require.Nil(t, err)
+		require.Len(t, domains, 1)
+		tun.domains <- query{name: domains[0]}
+	}
+}
+
+// waitAssembled waits until the tunnel has assembled count messages.
+func waitAssembled(t *testing.T, tun *Tunnel, count int) {
+	require.Eventually(t, func() bool {
+		return tun.Stats().Assembled == uint64(count)
+	}, time.Second, time.Millisecond)
+}
+
+func TestBackpressureDrop(t *testing.T) {
+	tests := []struct {
+		backpressure Backpressure
+		first        string
+		last         string
+	}{
+		{backpressure: DropNewest, first: "m0", last: "m255"},
+		{backpressure: DropOldest, first: "m2", last: "m257"},
+	}
+	for _, test := range tests {
+		tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Backpressure: test.backpressure})
+		capacity := cap(tun.messages)
+		sendMessages(t, tun, capacity+2)
+		waitAssembled(t, tun, capacity+2)
+
+		require.Equal(t, uint64(2), tun.Stats().Overflowed)
+		require.Equal(t, test.first, (<-tun.Messages()).ID)
+		for i := 1; i < capacity-1; i++ {
+			<-tun.Messages()
+		}
+		require.Equal(t, test.last, (<-tun.Messages()).ID)
+		tun.Close()
+	}
+}
+
+func TestBackpressureSpill(t *testing.T) {
+	_, err := New(Config{TopDomain: "tunnel.example.com.", Backpressure: Spill})
+	require.NotNil(t, err)
+
+	spool := &memSpool{}
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Backpressure: Spill, Spool: spool})
+	capacity := cap(tun.messages)
+	sendMessages(t, tun, capacity+2)
+	waitAssembled(t, tun, capacity+2)
+	stats := tun.Stats()
+	require.Equal(t, uint64(2), stats.Spilled)
+	require.Equal(t, 2, stats.Spooled)
+
+	// Spilled messages follow the others in order.
+	for i := 0; i < capacity+2; i++ {
+		require.Equal(t, fmt.Sprintf("m%d", i), (<-tun.Messages()).ID)
+	}
+	require.Eventually(t, func() bool {
+		return tun.Stats().Spooled == 0
+	}, time.Second, time.Millisecond)
+	tun.Close()
+
+	// Messages left in the spool are delivered after a restart.
+	require.Nil(t, spool.Push(Message{ID: "left"}))
+	tun = newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Backpressure: Spill, Spool: spool})
+	defer tun.Close()
+	require.Equal(t, "left", (<-tun.Messages()).ID)
+}
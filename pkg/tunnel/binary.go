@@ -0,0 +1,18 @@
+package tunnel
+
+import "bytes"
+
+// binaryMarker starts every message that its client marked as binary, before the message is
+// compressed. The byte 0xff never appears in UTF-8 text, so marked messages can be recognized
+// without a flag, and unmarked messages keep decoding as before.
+var binaryMarker = []byte{0xff}
+
+// isBinary reports whether payload was marked as binary.
+func isBinary(payload []byte) bool {
+	return bytes.HasPrefix(payload, binaryMarker)
+}
+
+// markBinary prefixes payload with binaryMarker.
+func markBinary(payload []byte) []byte {
+	return append(append([]byte(nil), binaryMarker...), payload...)
+}
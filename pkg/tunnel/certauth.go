@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// newCertTenants validates the identities of Config.CertTenants and returns them with their
+// tenants in lower case.
+func newCertTenants(certTenants map[string]string, tenants map[string]*tenantState) (map[string]string, error) {
+	if len(certTenants) == 0 {
+		return nil, nil
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("CertTenants requires Tenants")
+	}
+	states := make(map[string]string, len(certTenants))
+	for identity, tenant := range certTenants {
+		if identity == "" {
+			return nil, fmt.Errorf("Client certificate identities must not be empty")
+		}
+		tenant = strings.ToLower(tenant)
+		if _, ok := tenants[tenant]; !ok {
+			return nil, fmt.Errorf("Client certificate %s is for tenant %s, which is not configured", identity, tenant)
+		}
+		states[identity] = tenant
+	}
+	return states, nil
+}
+
+// ParseCertTenants parses the tenants of client certificates as passed on the command line,
+// IDENTITY:TENANT, into Config.CertTenants.
+func ParseCertTenants(specs []string) (map[string]string, error) {
+	certTenants := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		// Identities are more likely to hold colons than tenants, which are labels.
+		i := strings.LastIndexByte(spec, ':')
+		if i <= 0 || i == len(spec)-1 {
+			return nil, fmt.Errorf("Invalid client certificate tenant %q, expected IDENTITY:TENANT", spec)
+		}
+		certTenants[spec[:i]] = spec[i+1:]
+	}
+	return certTenants, nil
+}
+
+// certIdentities returns the identities of cert that Config.CertTenants is matched against: its
+// subject common name, and its DNS and email SANs.
+func certIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	return append(identities, cert.EmailAddresses...)
+}
+
+// certPermits reports whether the client certificate that w was received with, if any, may send
+// queries to tenant, as configured by Config.CertTenants. Queries received without a client
+// certificate are left to the listener, which requires one if it must. It returns the first
+// identity of the certificate, if any.
+func (tun *Tunnel) certPermits(w dns.ResponseWriter, tenant *tenantState) (string, bool) {
+	if len(tun.certTenants) == 0 || tenant == nil {
+		return "", true
+	}
+	cs, ok := w.(dns.ConnectionStater)
+	if !ok {
+		return "", true
+	}
+	state := cs.ConnectionState()
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", true
+	}
+	identities := certIdentities(state.PeerCertificates[0])
+	for _, identity := range identities {
+		if tun.certTenants[identity] == tenant.Name {
+			return identity, true
+		}
+	}
+	if len(identities) == 0 {
+		return "", false
+	}
+	return identities[0], false
+}
@@ -0,0 +1,81 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// tlsResponseWriter is a testResponseWriter for queries received over TLS with a client
+// certificate, if cert is set.
+type tlsResponseWriter struct {
+	testResponseWriter
+	cert *x509.Certificate
+}
+
+func (w *tlsResponseWriter) ConnectionState() *tls.ConnectionState {
+	state := &tls.ConnectionState{HandshakeComplete: true}
+	if w.cert != nil {
+		state.PeerCertificates = []*x509.Certificate{w.cert}
+	}
+	return state
+}
+
+func TestCertTenants(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain:   "tunnel.example.com",
+		Tenants:     []Tenant{{Name: "alpha"}, {Name: "beta"}},
+		CertTenants: map[string]string{"ci": "Alpha", "batch.example.net": "beta"},
+	})
+	defer tun.Close()
+
+	ci := &x509.Certificate{Subject: pkix.Name{CommonName: "ci"}}
+	batch := &x509.Certificate{Subject: pkix.Name{CommonName: "Batch"}, DNSNames: []string{"batch.example.net"}}
+	stranger := &x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}}
+	tests := []struct {
+		tenant string
+		cert   *x509.Certificate
+		rcode  int
+	}{
+		{"alpha", ci, dns.RcodeSuccess},
+		{"beta", ci, dns.RcodeRefused},
+		{"beta", batch, dns.RcodeSuccess},
+		{"alpha", stranger, dns.RcodeRefused},
+		// Queries without a client certificate are left to the listener.
+		{"beta", nil, dns.RcodeSuccess},
+	}
+	for _, test := range tests {
+		w := &tlsResponseWriter{cert: test.cert}
+		r := &dns.Msg{}
+		r.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000."+test.tenant+".tunnel.example.com.", dns.TypeA)
+		tun.ServeDNS(w, r)
+		require.Equal(t, test.rcode, w.msg.Rcode, test.tenant)
+	}
+	// Over plain DNS, queries carry no certificate.
+	w := &testResponseWriter{}
+	r := &dns.Msg{}
+	r.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.beta.tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(w, r)
+	require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+	require.EqualValues(t, 2, tun.Stats().CertDenied)
+
+	_, err := New(Config{TopDomain: "tunnel.example.com", CertTenants: map[string]string{"ci": "alpha"}})
+	require.NotNil(t, err)
+	_, err = New(Config{TopDomain: "tunnel.example.com", Tenants: []Tenant{{Name: "alpha"}}, CertTenants: map[string]string{"ci": "gamma"}})
+	require.NotNil(t, err)
+}
+
+func TestParseCertTenants(t *testing.T) {
+	certTenants, err := ParseCertTenants([]string{"ci:alpha", "urn:example:batch:beta"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"ci": "alpha", "urn:example:batch": "beta"}, certTenants)
+
+	for _, spec := range []string{"ci", ":alpha", "ci:"} {
+		_, err := ParseCertTenants([]string{spec})
+		require.NotNil(t, err, spec)
+	}
+}
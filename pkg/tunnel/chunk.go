@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+// A MessageChunk is a contiguous piece of a message larger than Config.ChunkThreshold. Such
+// messages aren't held until they are complete and delivered on Messages: instead, as soon as a
+// prefix of the message longer than what was emitted so far has been received, its remaining
+// bytes are emitted as a chunk on MessageChunks, and the fragments they were decoded from are
+// discarded. The chunks of a message are emitted in order, and the last one is marked as such. A
+// message that expires, or is evicted, before its last chunk is reported on Expired like any other
+// partial message.
+//
+// Authenticating, verifying, decrypting or decompressing a message requires all of it, so only
+// messages framed as Version2 or later without FlagCompressed or FlagEncrypted are emitted as
+// chunks, and the others are delivered whole.
+type MessageChunk struct {
+	// ID is the message ID chosen by the client, and Tenant the name of the tenant the message
+	// was sent to, if tenants are configured.
+	ID     string
+	Tenant string
+	// Offset is the offset of Data within the decoded message.
+	Offset int
+	Data   []byte
+	// Binary reports whether the client marked the message as binary data rather than text.
+	Binary bool
+	// Source is the IP address that the last fragment of the chunk was received from.
+	Source net.IP
+	// Last is set on the chunk that completes the message.
+	Last bool
+}
+
+// MessageChunks returns the channel on which the chunks of messages larger than
+// Config.ChunkThreshold are emitted. It must be read from while ChunkThreshold is set, since the
+// fragments of a message wait for its chunks to be read. The channel is closed by Close.
+func (tun *Tunnel) MessageChunks() <-chan MessageChunk {
+	return tun.chunks
+}
+
+// chunked reports whether the message of fl is emitted as chunks.
+func (tun *Tunnel) chunked(fl *fragmentList) bool {
+	return tun.chunkThreshold > 0 && fl.totalSize > tun.chunkThreshold &&
+		fl.framing.version >= Version2 && fl.framing.flags&(FlagCompressed|FlagEncrypted) == 0
+}
+
+// emitChunk emits the bytes of the message of fl received beyond what was emitted so far as a
+// chunk, if any, and discards the fragments they were decoded from. The lock of the shard of fl
+// must be held. It reports whether the message is complete.
+func (tun *Tunnel) emitChunk(fl *fragmentList, source net.IP) (bool, error) {
+	c, err := codecOf(fl.framing.encoding)
+	if err != nil {
+		return false, err
+	}
+	before, emitted := fl.size, fl.emitted
+	encoded, err := fl.takePrefix(c.block)
+	tun.bufferedBytes.Add(int64(fl.size - before))
+	if err != nil || encoded == nil {
+		return false, err
+	}
+	data := make([]byte, c.enc.DecodedLen(len(encoded)))
+	n, err := c.enc.Decode(data, encoded)
+	if err != nil {
+		return false, err
+	}
+	complete := fl.emitted == fl.totalSize
+	chunk := MessageChunk{
+		ID:     fl.id,
+		Tenant: fl.tenant,
+		Offset: c.enc.DecodedLen(emitted),
+		Data:   data[:n],
+		Binary: fl.framing.flags&FlagBinary != 0,
+		Source: source,
+		Last:   complete,
+	}
+	select {
+	case tun.chunks <- chunk:
+	case <-tun.ctx.Done():
+	}
+	return complete, nil
+}
+
+// takePrefix returns the encoded bytes received after those emitted so far and before the first
+// byte missing, rounded down to a whole number of blocks of block characters unless they end the
+// message, and discards the fragments that end within them. It returns nil if there are none.
+func (fl *fragmentList) takePrefix(block int) ([]byte, error) {
+	end := 0
+	if len(fl.covered) > 0 && fl.covered[0].Offset == 0 {
+		end = min(fl.covered[0].Length, fl.totalSize)
+	}
+	if end < fl.totalSize {
+		end -= end % block
+	}
+	if end <= fl.emitted {
+		return nil, nil
+	}
+	encoded := make([]byte, end-fl.emitted)
+	// As in assemble, fragments are visited in order of offset, so that the bytes before written
+	// were already written by the fragments before.
+	written := fl.emitted
+	for _, f := range fl.sortedFragments() {
+		start, stop := max(f.offset, fl.emitted), min(f.offset+len(f.data), end)
+		for pos := start; pos < stop; pos++ {
+			if pos < written && encoded[pos-fl.emitted] != f.data[pos-f.offset] {
+				return nil, fmt.Errorf("Fragments overlap with inconsistent data at offset %d", pos)
+			}
+			encoded[pos-fl.emitted] = f.data[pos-f.offset]
+		}
+		written = max(written, stop)
+	}
+	for offset, f := range fl.fragments {
+		if f.offset+len(f.data) <= end {
+			delete(fl.fragments, offset)
+			fl.size -= len(f.data)
+			fl.discarded++
+		}
+	}
+	fl.emitted = end
+	return encoded, nil
+}
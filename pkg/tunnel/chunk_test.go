@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTakePrefix(t *testing.T) {
+	fl := newFragmentList(20,
+		fragment{offset: 0, data: "abcdefghij"},
+		fragment{offset: 14, data: "opqrst"},
+	)
+	encoded, err := fl.takePrefix(4)
+	require.Nil(t, err)
+	require.Equal(t, "abcdefgh", string(encoded))
+	// The fragment ending after the prefix is kept for the rest of its data.
+	require.Len(t, fl.fragments, 2)
+
+	encoded, err = fl.takePrefix(4)
+	require.Nil(t, err)
+	require.Nil(t, encoded)
+
+	fl.put(fragment{offset: 10, data: "klmn"})
+	encoded, err = fl.takePrefix(4)
+	require.Nil(t, err)
+	require.Equal(t, "ijklmnopqrst", string(encoded))
+	require.Empty(t, fl.fragments)
+	require.Equal(t, 0, fl.size)
+	require.Equal(t, 3, fl.discarded)
+	require.True(t, fl.complete())
+
+	fl = newFragmentList(8, fragment{offset: 0, data: "abcd"}, fragment{offset: 2, data: "xxyy"})
+	_, err = fl.takePrefix(4)
+	require.NotNil(t, err)
+}
+
+func TestMessageChunks(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", MaxMessageSize: 10000, MaxFragmentBytes: 400, ChunkThreshold: 200})
+	defer tun.Close()
+
+	msg := strings.Repeat("a long upload, larger than the buffer of a single message. ", 40)
+	domains, err := Encoder{LabelLen: 63, Version: Version2, Binary: true}.Encode("tunnel.example.com.", "c4h7nk", msg)
+	require.Nil(t, err)
+	require.Greater(t, len(domains), 10)
+
+	// Nothing is emitted until the start of the message arrives.
+	domains[0], domains[1] = domains[1], domains[0]
+	var got []byte
+	for i, domain := range domains {
+		tun.domains <- query{name: domain}
+		if i == 0 {
+			continue
+		}
+		chunk := <-tun.MessageChunks()
+		require.Equal(t, "c4h7nk", chunk.ID)
+		require.True(t, chunk.Binary)
+		require.Equal(t, len(got), chunk.Offset)
+		require.Equal(t, i == len(domains)-1, chunk.Last)
+		got = append(got, chunk.Data...)
+	}
+	require.Equal(t, msg, string(got))
+	stats := tun.Stats()
+	require.Equal(t, uint64(1), stats.Assembled)
+	require.Equal(t, 0, stats.InFlight)
+	require.Equal(t, 0, stats.BufferedBytes)
+	require.Empty(t, tun.Messages())
+
+	// Messages that are compressed aren't emitted as chunks, so they are held whole, and exceed
+	// MaxFragmentBytes.
+	var numbers strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&numbers, "%d ", i*7919%10007)
+	}
+	domains, err = Encoder{LabelLen: 63, Version: Version2, Compress: true}.Encode("tunnel.example.com.", "p9x2mq", numbers.String())
+	require.Nil(t, err)
+	require.Greater(t, len(domains), 2)
+	for _, domain := range domains {
+		tun.domains <- query{name: domain}
+	}
+	tun.Flush()
+	require.NotZero(t, tun.Stats().Oversized)
+	require.Empty(t, tun.MessageChunks())
+
+	_, err = New(Config{TopDomain: "tunnel.example.com.", ChunkThreshold: 200, HMACKey: []byte("secret")})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// clientIdle is how long the counters of a client are kept after its last query.
+const clientIdle = 10 * time.Minute
+
+// ClientStats holds the counters of a single source IP. This is usually the recursive resolver
+// of the clients rather than a client itself.
+type ClientStats struct {
+	// Queries counts queries received from the source, including refused ones.
+	Queries uint64
+	// Fragments counts fragments from the source parsed successfully, except for repeats of
+	// queries received from other sources within Config.FanoutWindow.
+	Fragments uint64
+	// Messages counts messages whose final fragment was received from the source, and Bytes
+	// the size of their payloads.
+	Messages uint64
+	Bytes    uint64
+	// MessageFragments counts the fragments of those messages, and Reassembly adds up the time
+	// between the first and last fragment of each, so that their means can be tuned with the
+	// fragment size and the expiration.
+	MessageFragments uint64
+	Reassembly       time.Duration
+	// LastSeen is when the last query was received from the source.
+	LastSeen time.Time
+}
+
+// A clientTracker holds the counters of the sources that queried the tunnel recently, keyed by
+// IP address.
+type clientTracker struct {
+	mu      sync.Mutex
+	clients map[string]*ClientStats
+}
+
+func newClientTracker() *clientTracker {
+	return &clientTracker{clients: make(map[string]*ClientStats)}
+}
+
+// update applies fn to the counters of ip.
+func (c *clientTracker) update(ip string, fn func(*ClientStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.clients[ip]
+	if !ok {
+		s = &ClientStats{}
+		c.clients[ip] = s
+	}
+	fn(s)
+}
+
+// prune forgets the clients that haven't queried the tunnel for clientIdle.
+func (c *clientTracker) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ip, s := range c.clients {
+		if now.Sub(s.LastSeen) > clientIdle {
+			delete(c.clients, ip)
+		}
+	}
+}
+
+// ClientStats returns a snapshot of the counters of each source that queried the tunnel in the
+// last 10 minutes, keyed by IP address.
+func (tun *Tunnel) ClientStats() map[string]ClientStats {
+	tun.clients.mu.Lock()
+	defer tun.clients.mu.Unlock()
+
+	stats := make(map[string]ClientStats, len(tun.clients.clients))
+	for ip, s := range tun.clients.clients {
+		stats[ip] = *s
+	}
+	return stats
+}
@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientStats(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com"})
+	defer tun.Close()
+
+	for _, name := range []string{
+		"2jkhm3.FAIL.0.nbswy3dp.tunnel.example.com.",
+		"tunnel.example.com.",
+		"2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+	} {
+		r := &dns.Msg{}
+		r.SetQuestion(name, dns.TypeA)
+		tun.ServeDNS(&testResponseWriter{}, r)
+	}
+	// The single worker handles queries in order, so the others were handled by now.
+	<-tun.Messages()
+
+	stats := tun.ClientStats()
+	require.Len(t, stats, 1)
+	client := stats["192.0.2.1"]
+	require.EqualValues(t, 3, client.Queries)
+	require.EqualValues(t, 1, client.Fragments)
+	require.EqualValues(t, 1, client.Messages)
+	require.EqualValues(t, len("hello world"), client.Bytes)
+	require.EqualValues(t, 1, client.MessageFragments)
+	require.Less(t, client.Reassembly, time.Second)
+	require.WithinDuration(t, time.Now(), client.LastSeen, time.Second)
+
+	// Clients are forgotten once they have been idle for a while.
+	tun.clients.prune(time.Now().Add(clientIdle / 2))
+	require.Len(t, tun.ClientStats(), 1)
+	tun.clients.prune(time.Now().Add(2 * clientIdle))
+	require.Empty(t, tun.ClientStats())
+}
@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the tunnel the time, and ticks the sweeps that expire partial messages, dedup
+// entries, idle clients and sessions. Config.Clock replaces the system clock with another,
+// such as a ManualClock, so that expiration can be tested without waiting for it.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a Ticker delivering the time every d, as time.NewTicker does.
+	NewTicker(d time.Duration) Ticker
+}
+
+// A Ticker delivers the time at intervals on the channel returned by C, until it is stopped.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock is the Clock of package time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// A ManualClock is a Clock whose time only changes when it is advanced, firing the tickers that
+// are due. Its zero value is not usable; create one with NewManualClock.
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+// NewManualClock returns a ManualClock set to now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now implements Clock.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker implements Clock. The ticker first fires once the clock is advanced by d.
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("tunnel: non-positive interval for ManualClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTicker{clock: c, c: make(chan time.Time, 1), interval: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, and fires the tickers that are due in the meantime.
+// Like those of package time, tickers drop the ticks that their receiver isn't ready for, so a
+// ticker due several times fires once.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to now, and fires the tickers that are due by then. Moving the clock
+// backwards fires none.
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+	for _, t := range c.tickers {
+		if t.next.After(now) {
+			continue
+		}
+		for !t.next.After(now) {
+			t.next = t.next.Add(t.interval)
+		}
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
+
+// Tickers returns the number of tickers of c that are not stopped, so that tests can wait for
+// the tunnel to start its sweeps before advancing c.
+func (c *ManualClock) Tickers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tickers)
+}
+
+type manualTicker struct {
+	clock    *ManualClock
+	c        chan time.Time
+	interval time.Duration
+	// next is the time the ticker is next due, guarded by the mutex of clock.
+	next time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
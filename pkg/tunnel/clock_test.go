@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	ticker := clock.NewTicker(time.Second)
+	require.Equal(t, 1, clock.Tickers())
+
+	clock.Advance(999 * time.Millisecond)
+	require.Len(t, ticker.C(), 0)
+	clock.Advance(time.Millisecond)
+	require.Equal(t, start.Add(time.Second), <-ticker.C())
+
+	// Ticks that aren't received are dropped.
+	clock.Advance(5 * time.Second)
+	require.Equal(t, start.Add(6*time.Second), <-ticker.C())
+	require.Len(t, ticker.C(), 0)
+	clock.Advance(500 * time.Millisecond)
+	require.Len(t, ticker.C(), 0)
+	clock.Advance(500 * time.Millisecond)
+	require.Len(t, ticker.C(), 1)
+	<-ticker.C()
+
+	clock.Set(start)
+	require.Equal(t, start, clock.Now())
+	require.Len(t, ticker.C(), 0)
+
+	ticker.Stop()
+	require.Equal(t, 0, clock.Tickers())
+	clock.Advance(time.Hour)
+	require.Len(t, ticker.C(), 0)
+}
+
+func TestClockExpiration(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Expiration: time.Minute, Clock: clock})
+	defer tun.Close()
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.Flush()
+	partials := tun.Partials()
+	require.Len(t, partials, 1)
+	require.Equal(t, clock.Now().Add(time.Minute), partials[0].ExpiresAt)
+
+	clock.Advance(time.Minute)
+	tun.Sweep()
+	require.Len(t, tun.Partials(), 1)
+
+	clock.Advance(time.Second)
+	tun.Sweep()
+	require.Empty(t, tun.Partials())
+	require.Equal(t, "2jkhm3", (<-tun.Expired()).ID)
+}
+
+func TestClockDeletionInterval(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Expiration: time.Minute, DeletionInterval: 10 * time.Second, Clock: clock})
+	defer tun.Close()
+	require.Eventually(t, func() bool { return clock.Tickers() == 1 }, time.Second, time.Millisecond)
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.Flush()
+
+	// The background sweep runs as the clock passes each DeletionInterval.
+	clock.Advance(2 * time.Minute)
+	require.Equal(t, "2jkhm3", (<-tun.Expired()).ID)
+	require.Empty(t, tun.Partials())
+}
+
+func TestClockDedupWindow(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", DedupWindow: time.Minute, Clock: clock})
+	defer tun.Close()
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com."}
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+
+	// Within the window, retries are recognized as replays of the delivered message.
+	clock.Advance(time.Minute - time.Second)
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com."}
+	tun.Flush()
+	require.Equal(t, uint64(1), tun.Stats().Replayed)
+	require.Empty(t, tun.Partials())
+
+	// Once it passes, they start a new partial message.
+	clock.Advance(2 * time.Second)
+	tun.Sweep()
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com."}
+	tun.Flush()
+	require.Equal(t, uint64(1), tun.Stats().Replayed)
+	require.Len(t, tun.Partials(), 1)
+}
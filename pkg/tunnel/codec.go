@@ -0,0 +1,228 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoRoom is returned by Codec.Encode when the space left by the framing and the top domain
+// doesn't fit a fragment carrying at least one byte of data.
+var ErrNoRoom = errors.New("No room for payload")
+
+// A Codec lays out the fields of a fragment in the labels of its domain, in between the labels of
+// its framing and its top domain: the ID of its message, the length of the encoded message, the
+// offset of the data carried by the fragment, and the data itself, along with whatever else the
+// codec needs to recover it, such as checksums. Encoder.Codec encodes fragments with a Codec, and
+// Config.Codecs decodes those sent through a top domain with the same one. StandardCodec, used if
+// none is set, is the layout of the JavaScript client.
+//
+// The tunnel validates what a Codec decodes against the declared length of the message and the
+// limits of Config, so a Codec only needs to reject fragments that it can't parse.
+type Codec interface {
+	// Encode splits data, a whole message encoded with opts.Encoding, into the fragments of
+	// message id.
+	Encode(id, data string, opts CodecOptions) ([]CodedFragment, error)
+	// Decode parses labels, those of a fragment after its framing in lower case. asked holds the
+	// same labels in the case they were asked in for case-sensitive encodings, whose data must be
+	// decoded as is, and is labels otherwise.
+	Decode(labels, asked []string, opts CodecOptions) (DecodedFragment, error)
+}
+
+// CodecOptions are the parameters a Codec encodes or decodes a fragment with.
+type CodecOptions struct {
+	// Encoding is the encoding of the data, EncodingBase32 if empty.
+	Encoding Encoding
+	// LabelLen is the maximum length of each label of data, and Space that of the labels of each
+	// fragment joined with dots, when encoding. The codec returns ErrNoRoom if Space is too small.
+	LabelLen int
+	Space    int
+	// Checksum asks the codec to protect the data of each fragment, e.g. with a CRC32 label as
+	// Encoder.Checksum does, when encoding.
+	Checksum bool
+	// Strict only accepts fragments in the canonical form that the codec produces, as described on
+	// Config.Strict, when decoding.
+	Strict bool
+	// Parity accepts the offsets of parity fragments, which follow the end of the message as
+	// described on FlagParity, when decoding.
+	Parity bool
+}
+
+// A CodedFragment is a fragment laid out by Codec.Encode.
+type CodedFragment struct {
+	// Labels are the labels of the fragment, joined with dots, without the framing and top domain.
+	Labels string
+	// Range is the range of the encoded message carried by the fragment.
+	Range
+}
+
+// A DecodedFragment holds the fields of a fragment parsed by Codec.Decode.
+type DecodedFragment struct {
+	// ID is the ID of the message of the fragment.
+	ID string
+	// Total is the length of the encoded message.
+	Total int
+	// Offset is that of Data in the encoded message.
+	Offset int
+	// Data is the encoded data carried by the fragment, and DataLabels the number of labels it was
+	// carried in, as bounded by Config.MaxDataLabels.
+	Data       string
+	DataLabels int
+}
+
+// StandardCodec lays out each fragment as the ID of its message, the length of the encoded
+// message, the offset of the fragment, an optional checksum label, and the data labels, e.g.
+// 2jkhm3.24.0.nbswy3dpeb3w64tmmq000000. Its decoding doesn't allocate beyond the data of the
+// fragment.
+type StandardCodec struct{}
+
+// Encode implements Codec.
+func (StandardCodec) Encode(id, data string, opts CodecOptions) ([]CodedFragment, error) {
+	checksumLen := 0
+	if opts.Checksum {
+		checksumLen = len(checksumLabel("")) + 1
+	}
+
+	// The header of the final fragment is the longest, since its offset has the most digits. If
+	// it doesn't leave room for at least one byte of payload, no fragment would.
+	longestHeader := fmt.Sprintf("%s.%d.%d.", id, len(data), len(data)-1)
+	if opts.Space-len(longestHeader)-checksumLen < 1 {
+		return nil, ErrNoRoom
+	}
+
+	var fragments []CodedFragment
+	for offset := 0; offset < len(data); {
+		header := fmt.Sprintf("%s.%d.%d.", id, len(data), offset)
+		space := opts.Space - len(header) - checksumLen + 1
+
+		var labels []string
+		written := 0
+		for offset+written < len(data) && space > 1 {
+			size := min(opts.LabelLen, space-1, len(data)-offset-written)
+			labels = append(labels, data[offset+written:offset+written+size])
+			written += size
+			space -= size + 1
+		}
+		if opts.Checksum {
+			header += checksumLabel(data[offset:offset+written]) + "."
+		}
+		fragments = append(fragments, CodedFragment{
+			Labels: header + strings.Join(labels, "."),
+			Range:  Range{Offset: offset, Length: written},
+		})
+		offset += written
+	}
+	return fragments, nil
+}
+
+// Decode implements Codec.
+func (StandardCodec) Decode(labels, asked []string, opts CodecOptions) (DecodedFragment, error) {
+	c, err := codecOf(opts.Encoding)
+	if err != nil {
+		return DecodedFragment{}, parseErrorf(reasonVersion, "%w", err)
+	}
+	return decodeStandard(labels, asked, c, parseRules{maxMessageSize: math.MaxInt, strict: opts.Strict, parity: opts.Parity})
+}
+
+// decodeStandard decodes labels as StandardCodec does, with the codec of their encoding. The
+// fields are checked against rules as soon as they are parsed, so that fragments are rejected for
+// the first field that is wrong.
+func decodeStandard(labels, asked []string, c *codec, rules parseRules) (DecodedFragment, error) {
+	if len(labels) < 4 {
+		return DecodedFragment{}, parseErrorf(reasonLabels, "Domain has %d labels but expected at least 4", len(labels))
+	}
+	totalSize, err := rules.parseNumber(reasonSize, "size", labels[1])
+	if err != nil {
+		return DecodedFragment{}, err
+	}
+	if err := rules.checkSize(totalSize); err != nil {
+		return DecodedFragment{}, err
+	}
+	offset, err := rules.parseNumber(reasonOffset, "offset", labels[2])
+	if err != nil {
+		return DecodedFragment{}, err
+	}
+	if err := rules.checkOffset(offset, totalSize); err != nil {
+		return DecodedFragment{}, err
+	}
+
+	dataLabels := asked[3:]
+	var checksum string
+	if c.isChecksum(labels[3]) {
+		if len(labels) < 5 {
+			return DecodedFragment{}, parseErrorf(reasonChecksum, "Domain has a checksum but no data")
+		}
+		checksum, dataLabels = labels[3], asked[4:]
+	}
+	if err := rules.checkDataLabels(len(dataLabels)); err != nil {
+		return DecodedFragment{}, err
+	}
+	data, err := joinData(dataLabels, c, rules.strict, checksum, offset)
+	if err != nil {
+		return DecodedFragment{}, err
+	}
+	return DecodedFragment{ID: labels[0], Total: totalSize, Offset: offset, Data: data, DataLabels: len(dataLabels)}, nil
+}
+
+// normalizeCodecs validates the top domains of Config.Codecs, and keys the codecs by normalized
+// top domain, each of which must be one of topDomains.
+func normalizeCodecs(codecs map[string]Codec, topDomains []string) (map[string]Codec, error) {
+	normalized := make(map[string]Codec, len(codecs))
+	for domain, cd := range codecs {
+		d := dns.Fqdn(strings.ToLower(domain))
+		found := false
+		for _, top := range topDomains {
+			found = found || top == d
+		}
+		if !found {
+			return nil, fmt.Errorf("Codec is configured for %s, which is not a top domain", domain)
+		}
+		if cd == nil {
+			return nil, fmt.Errorf("Codec of %s is nil", domain)
+		}
+		normalized[d] = cd
+	}
+	return normalized, nil
+}
+
+// decodeFragment decodes labels with the codec of rules, StandardCodec if it is nil, and c, the
+// codec of their encoding. StandardCodec is called directly, so that its decoding doesn't
+// allocate. Other codecs are passed copies of the labels, which callers split on their stack, have
+// their errors that aren't parseErrors reported as malformed labels, and what they decode checked
+// against rules.
+func decodeFragment(labels, asked []string, c *codec, encoding Encoding, rules parseRules) (DecodedFragment, error) {
+	switch rules.codec.(type) {
+	case nil, StandardCodec:
+		return decodeStandard(labels, asked, c, rules)
+	}
+	d, err := rules.codec.Decode(slices.Clone(labels), slices.Clone(asked), CodecOptions{Encoding: encoding, Strict: rules.strict, Parity: rules.parity})
+	if err != nil {
+		var pe *parseError
+		if !errors.As(err, &pe) {
+			err = &parseError{reason: reasonLabels, err: err}
+		}
+		return DecodedFragment{}, err
+	}
+	if d.ID == "" {
+		return DecodedFragment{}, parseErrorf(reasonLabels, "Fragment has no message ID")
+	}
+	if err := rules.checkSize(d.Total); err != nil {
+		return DecodedFragment{}, err
+	}
+	if err := rules.checkOffset(d.Offset, d.Total); err != nil {
+		return DecodedFragment{}, err
+	}
+	if err := rules.checkDataLabels(d.DataLabels); err != nil {
+		return DecodedFragment{}, err
+	}
+	if rules.strict {
+		if err := c.checkAlphabet(d.Data); err != nil {
+			return DecodedFragment{}, err
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fixedCodec lays out fragments with a fixed-width header label of 6 hex digits of length and 6 of
+// offset, followed by the message ID and a single data label.
+type fixedCodec struct{}
+
+func (fixedCodec) Encode(id, data string, opts CodecOptions) ([]CodedFragment, error) {
+	size := min(opts.LabelLen, opts.Space-len(id)-len("000000000000.."))
+	if size < 1 {
+		return nil, ErrNoRoom
+	}
+	var fragments []CodedFragment
+	for offset := 0; offset < len(data); offset += size {
+		n := min(size, len(data)-offset)
+		fragments = append(fragments, CodedFragment{
+			Labels: fmt.Sprintf("%06x%06x.%s.%s", len(data), offset, id, data[offset:offset+n]),
+			Range:  Range{Offset: offset, Length: n},
+		})
+	}
+	return fragments, nil
+}
+
+func (fixedCodec) Decode(labels, asked []string, opts CodecOptions) (DecodedFragment, error) {
+	if len(labels) != 3 || len(labels[0]) != 12 {
+		return DecodedFragment{}, fmt.Errorf("Fragment isn't laid out by fixedCodec")
+	}
+	total, err := strconv.ParseInt(labels[0][:6], 16, 32)
+	if err != nil {
+		return DecodedFragment{}, err
+	}
+	offset, err := strconv.ParseInt(labels[0][6:], 16, 32)
+	if err != nil {
+		return DecodedFragment{}, err
+	}
+	return DecodedFragment{ID: labels[1], Total: int(total), Offset: int(offset), Data: asked[2], DataLabels: 1}, nil
+}
+
+func TestCodec(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain:  "tunnel.example.com.",
+		TopDomains: []string{"fixed.example.com"},
+		Codecs:     map[string]Codec{"FIXED.example.com": fixedCodec{}},
+		Strict:     true,
+	})
+	defer tun.Close()
+
+	msg := strings.Repeat("hello world? ", 40)
+	tests := []struct {
+		domain string
+		enc    Encoder
+	}{
+		{domain: "tunnel.example.com.", enc: Encoder{LabelLen: 63, Checksum: true}},
+		{domain: "tunnel.example.com.", enc: Encoder{LabelLen: 63, Codec: StandardCodec{}}},
+		{domain: "fixed.example.com.", enc: Encoder{LabelLen: 63, Codec: fixedCodec{}}},
+		{domain: "fixed.example.com.", enc: Encoder{LabelLen: 40, Version: Version2, Session: "tab1", Encoding: EncodingBase64URL, Codec: fixedCodec{}}},
+	}
+	for _, test := range tests {
+		domains, err := test.enc.Encode(test.domain, "2jkhm3", msg)
+		require.Nil(t, err)
+		for _, d := range domains {
+			tun.domains <- query{name: strings.ToLower(d), asked: d}
+		}
+		require.Equal(t, msg, string((<-tun.Messages()).Payload), test.domain)
+	}
+
+	long := strings.Repeat(strings.Repeat("a", 60)+".", 4)
+	_, err := Encoder{LabelLen: 63, Codec: fixedCodec{}}.Encode(long, "2jkhm3", msg)
+	require.EqualError(t, err, "Top domain "+long+" leaves no room for payload")
+}
+
+func TestCodecErrors(t *testing.T) {
+	rules := parseRules{maxMessageSize: 100, strict: true, codec: fixedCodec{}}
+	tests := []struct {
+		domain string
+		reason string
+	}{
+		// Errors of the codec itself are reported as malformed labels.
+		{"2jkhm3.24.0.nbswy3dp.tunnel.example.com.", reasonLabels},
+		{"00000000000x.2jkhm3.nbswy3dp.tunnel.example.com.", reasonLabels},
+		// What the codec decodes is held to the same rules as fragments of StandardCodec.
+		{"001000000000.2jkhm3.nbswy3dp.tunnel.example.com.", reasonSize},
+		{"000018000018.2jkhm3.nbswy3dp.tunnel.example.com.", reasonOffset},
+		{"000018000014.2jkhm3.nbswy3dp.tunnel.example.com.", reasonOffset},
+		{"000018000000.2jkhm3.nbswy!dp.tunnel.example.com.", reasonAlphabet},
+	}
+	for _, test := range tests {
+		_, err := parseDomain("tunnel.example.com.", test.domain, rules)
+		require.NotNil(t, err, test.domain)
+		require.Equal(t, test.reason, parseErrorReason(err), test.domain)
+	}
+
+	_, err := New(Config{TopDomain: "tunnel.example.com.", Codecs: map[string]Codec{"other.example.com": fixedCodec{}}})
+	require.NotNil(t, err)
+}
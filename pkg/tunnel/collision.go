@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Message IDs are picked at random by clients, so two unrelated clients occasionally send
+// messages with the same ID at the same time. Fragments that declare a different length than the
+// partial message of their ID belong to such a colliding message, and are kept in a fragment list
+// of their own, under the key of the partial message followed by collisionSeparator and the
+// length, rather than being merged into a corrupted message. Both messages are delivered with
+// the ID they were sent with. Fragment stores know colliding messages by the ID in their key.
+
+// collisionSeparator separates the ID of a colliding message from its length. Names are escaped
+// by package dns, so it never appears in an ID.
+const collisionSeparator = "\x00"
+
+// collisionKey returns the key of the fragment list of the message of length totalSize that
+// collided with the message under key.
+func collisionKey(key string, totalSize int) string {
+	return key + collisionSeparator + strconv.Itoa(totalSize)
+}
+
+// messageID returns the ID of the message known as id to fragment stores.
+func messageID(id string) string {
+	id, _, _ = strings.Cut(id, collisionSeparator)
+	return id
+}
+
+// listFor returns the key of the fragment list in sh, whose lock must be held, that a fragment of
+// length totalSize of the message under key belongs to. The list doesn't exist yet if the
+// fragment is the first of its message.
+func listFor(sh *shard, key string, totalSize int) string {
+	fgList, ok := sh.lists[key]
+	switch {
+	case ok && fgList.totalSize != totalSize:
+		return collisionKey(key, totalSize)
+	case !ok:
+		// The message under key may have been completed, or expired, before the one that
+		// collided with it.
+		if alt := collisionKey(key, totalSize); sh.lists[alt] != nil {
+			return alt
+		}
+	}
+	return key
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// gzipMagic starts every gzip stream. Text payloads never start with it, since 0x8b is not a
+// valid first byte of a UTF-8 character, so compressed payloads can be recognized without a flag.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isCompressed reports whether payload is a gzip stream.
+func isCompressed(payload []byte) bool {
+	return bytes.HasPrefix(payload, gzipMagic)
+}
+
+// compress gzips payload.
+func compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress gunzips payload, failing if the result would be larger than maxSize bytes.
+func decompress(payload []byte, maxSize int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	msg, err := ioutil.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > maxSize {
+		return nil, fmt.Errorf("Decompressed message is larger than %d bytes", maxSize)
+	}
+	return msg, nil
+}
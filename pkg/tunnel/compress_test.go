@@ -0,0 +1,27 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	msg := []byte(strings.Repeat(`{"key":"value"},`, 100))
+	compressed, err := compress(msg)
+	require.Nil(t, err)
+	require.True(t, isCompressed(compressed))
+	require.True(t, len(compressed) < len(msg))
+	require.False(t, isCompressed(msg))
+
+	got, err := decompress(compressed, len(msg))
+	require.Nil(t, err)
+	require.Equal(t, msg, got)
+
+	_, err = decompress(compressed, len(msg)-1)
+	require.NotNil(t, err)
+
+	_, err = decompress(append([]byte{}, gzipMagic...), len(msg))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// newAEAD returns an AES-GCM cipher for key, which must be 16, 24 or 32 bytes long.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals plaintext with AES-GCM under key. The random nonce is prepended to the
+// ciphertext.
+func encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt opens a message sealed by encrypt.
+func decrypt(aead cipher.AEAD, msg []byte) ([]byte, error) {
+	if len(msg) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("Message of %d bytes is too short to be encrypted", len(msg))
+	}
+	nonce, ciphertext := msg[:aead.NonceSize()], msg[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt message: %s", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,36 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	aead, err := newAEAD(key)
+	require.Nil(t, err)
+
+	sealed, err := encrypt(key, []byte("hello world"))
+	require.Nil(t, err)
+	require.NotContains(t, string(sealed), "hello world")
+
+	plaintext, err := decrypt(aead, sealed)
+	require.Nil(t, err)
+	require.Equal(t, []byte("hello world"), plaintext)
+
+	again, err := encrypt(key, []byte("hello world"))
+	require.Nil(t, err)
+	require.NotEqual(t, sealed, again)
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = decrypt(aead, sealed)
+	require.NotNil(t, err)
+
+	_, err = decrypt(aead, []byte("short"))
+	require.NotNil(t, err)
+
+	_, err = newAEAD([]byte("not a valid key"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,183 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Downstream messages are delivered to clients that poll the tunnel with TXT queries for domains
+// of the form
+//
+//	poll-<nonce>.<clientID>.<seq>.<offset>.<topDomain>
+//
+// The nonce is chosen randomly by the client so that resolvers never answer a poll from their
+// cache. The answer is a TXT record whose first string is "<seq>.<offset>.<total>" and whose
+// second string is the base64 encoded chunk of message seq starting at offset, or an empty TXT
+// record if nothing is queued for the client. Polling for a seq acknowledges every message before
+// it, which is then deleted from the queue. A client starts by polling for seq 0, and moves on to
+// seq+1 once it has received total bytes of message seq. Polls of type A or AAAA are answered with
+// addresses instead, as described in addresspoll.go.
+const pollPrefix = "poll-"
+
+const (
+	// downstreamChunkSize is the number of message bytes carried by each poll response. Its
+	// base64 encoding fits in a single 255 byte TXT string.
+	downstreamChunkSize = 180
+	// maxQueuedMessages is the maximum number of downstream messages queued for a single client.
+	maxQueuedMessages = 64
+)
+
+// A Chunk is a piece of a downstream message, as carried in the answer to a poll.
+type Chunk struct {
+	Seq    int
+	Offset int
+	Total  int
+	Data   []byte
+}
+
+type outbox struct {
+	nextSeq int
+	queue   []outMessage
+}
+
+type outMessage struct {
+	seq  int
+	data []byte
+}
+
+type poll struct {
+	clientID string
+	seq      int
+	offset   int
+	kind     pollKind
+}
+
+// Send queues msg for delivery to the client identified by clientID, and returns the sequence
+// number assigned to it. Sequence numbers start at 1 for each client. The message is delivered in
+// chunks as the client polls for it. Client IDs are case-insensitive.
+func (tun *Tunnel) Send(clientID string, msg []byte) (int, error) {
+	if clientID == "" || strings.Contains(clientID, ".") {
+		return 0, fmt.Errorf("Client ID %q must be a single non-empty label", clientID)
+	}
+	// Polls are parsed in lower case.
+	clientID = strings.ToLower(clientID)
+
+	tun.outboxesLock.Lock()
+	defer tun.outboxesLock.Unlock()
+
+	ob, ok := tun.outboxes[clientID]
+	if !ok {
+		ob = &outbox{nextSeq: 1}
+		tun.outboxes[clientID] = ob
+	}
+	if len(ob.queue) >= maxQueuedMessages {
+		return 0, fmt.Errorf("Client %s already has %d queued messages", clientID, len(ob.queue))
+	}
+	seq := ob.nextSeq
+	ob.nextSeq++
+	ob.queue = append(ob.queue, outMessage{seq: seq, data: msg})
+	return seq, nil
+}
+
+// EncodePoll returns the domain a client identified by clientID queries to poll for the chunk of
+// downstream message seq starting at offset.
+func EncodePoll(topDomain, clientID, nonce string, seq, offset int) string {
+	return fmt.Sprintf("%s%s.%s.%d.%d.%s", pollPrefix, nonce, clientID, seq, offset, dns.Fqdn(topDomain))
+}
+
+// ParseChunk parses the strings of a TXT answer to a poll. It returns false if the answer is empty
+// because nothing is queued for the client.
+func ParseChunk(txt []string) (Chunk, bool, error) {
+	if len(txt) == 0 || (len(txt) == 1 && txt[0] == "") {
+		return Chunk{}, false, nil
+	}
+	if len(txt) != 2 {
+		return Chunk{}, false, fmt.Errorf("Poll answer has %d strings but expected 2", len(txt))
+	}
+	header := strings.Split(txt[0], ".")
+	if len(header) != 3 {
+		return Chunk{}, false, fmt.Errorf("Malformed poll answer header %q", txt[0])
+	}
+	var fields [3]int
+	for i, h := range header {
+		n, err := strconv.Atoi(h)
+		if err != nil {
+			return Chunk{}, false, err
+		}
+		fields[i] = n
+	}
+	data, err := base64.StdEncoding.DecodeString(txt[1])
+	if err != nil {
+		return Chunk{}, false, err
+	}
+	return Chunk{Seq: fields[0], Offset: fields[1], Total: fields[2], Data: data}, true, nil
+}
+
+// parsePoll parses a poll domain. It returns false if domain is not a poll.
+func parsePoll(topDomain string, domain string) (poll, bool, error) {
+	under, ok := underDomain(domain, topDomain)
+	if !ok || !strings.HasPrefix(under, pollPrefix) {
+		return poll{}, false, nil
+	}
+	labels := strings.Split(under, ".")
+	if len(labels) != 4 {
+		return poll{}, true, fmt.Errorf("Poll has %d labels but expected 4", len(labels))
+	}
+	seq, err := strconv.Atoi(labels[2])
+	if err != nil {
+		return poll{}, true, err
+	}
+	p := poll{clientID: labels[1], seq: seq}
+	switch labels[3] {
+	case pollSeqLabel:
+		p.kind = pollSeq
+	case pollSizeLabel:
+		p.kind = pollSize
+	default:
+		if p.offset, err = strconv.Atoi(labels[3]); err != nil {
+			return poll{}, true, err
+		}
+	}
+	if seq < 0 || p.offset < 0 {
+		return poll{}, true, fmt.Errorf("Poll declares negative seq %d or offset %d", seq, p.offset)
+	}
+	return p, true, nil
+}
+
+// nextChunk returns the chunk answering p, acknowledging every message before p.seq. It returns
+// false if nothing is queued.
+func (tun *Tunnel) nextChunk(p poll) (Chunk, bool) {
+	tun.outboxesLock.Lock()
+	defer tun.outboxesLock.Unlock()
+
+	ob, ok := tun.outboxes[p.clientID]
+	if !ok {
+		return Chunk{}, false
+	}
+	for len(ob.queue) > 0 && ob.queue[0].seq < p.seq {
+		ob.queue = ob.queue[1:]
+	}
+	if len(ob.queue) == 0 {
+		return Chunk{}, false
+	}
+
+	head := ob.queue[0]
+	offset := p.offset
+	if head.seq != p.seq || offset > len(head.data) {
+		offset = 0
+	}
+	end := min(offset+downstreamChunkSize, len(head.data))
+	return Chunk{Seq: head.seq, Offset: offset, Total: len(head.data), Data: head.data[offset:end]}, true
+}
+
+// txt encodes the chunk as the strings of a TXT record.
+func (c Chunk) txt() []string {
+	return []string{
+		fmt.Sprintf("%d.%d.%d", c.Seq, c.Offset, c.Total),
+		base64.StdEncoding.EncodeToString(c.Data),
+	}
+}
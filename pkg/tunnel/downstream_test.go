@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePoll(t *testing.T) {
+	tests := []struct {
+		domain string
+		isPoll bool
+		fails  bool
+		output poll
+	}{
+		{
+			domain: "poll-x7f2.c1.3.180.tunnel.example.com.",
+			isPoll: true,
+			output: poll{clientID: "c1", seq: 3, offset: 180},
+		},
+		{
+			domain: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+			isPoll: false,
+		},
+		{
+			domain: "poll-x7f2.c1.3.tunnel.example.com.",
+			isPoll: true,
+			fails:  true,
+		},
+		{
+			domain: "poll-x7f2.c1.3.-1.tunnel.example.com.",
+			isPoll: true,
+			fails:  true,
+		},
+		{
+			domain: "poll-x7f2.c1.FAIL.0.tunnel.example.com.",
+			isPoll: true,
+			fails:  true,
+		},
+	}
+	for _, test := range tests {
+		got, isPoll, err := parsePoll("tunnel.example.com.", test.domain)
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+		}
+		require.Equal(t, test.isPoll, isPoll)
+		require.Equal(t, test.output, got)
+	}
+}
+
+// pollServer polls tun through ServeDNS and returns the chunk in the answer.
+func pollServer(t *testing.T, tun *Tunnel, clientID string, seq, offset int) (Chunk, bool) {
+	req := &dns.Msg{}
+	req.SetQuestion(EncodePoll("tunnel.example.com", clientID, "n0nce", seq, offset), dns.TypeTXT)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+
+	require.Len(t, w.msg.Answer, 1)
+	chunk, ok, err := ParseChunk(w.msg.Answer[0].(*dns.TXT).Txt)
+	require.Nil(t, err)
+	return chunk, ok
+}
+
+func TestDownstream(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	_, ok := pollServer(t, tun, "c1", 0, 0)
+	require.False(t, ok)
+
+	long := bytes.Repeat([]byte("downstream "), 50)
+	seq, err := tun.Send("c1", long)
+	require.Nil(t, err)
+	require.Equal(t, 1, seq)
+	seq, err = tun.Send("c1", []byte("second"))
+	require.Nil(t, err)
+	require.Equal(t, 2, seq)
+
+	var got []byte
+	next := 0
+	for {
+		chunk, ok := pollServer(t, tun, "c1", 1, next)
+		require.True(t, ok)
+		require.Equal(t, 1, chunk.Seq)
+		require.Equal(t, next, chunk.Offset)
+		got = append(got, chunk.Data...)
+		next += len(chunk.Data)
+		if next >= chunk.Total {
+			break
+		}
+	}
+	require.Equal(t, long, got)
+
+	chunk, ok := pollServer(t, tun, "c1", 2, 0)
+	require.True(t, ok)
+	require.Equal(t, Chunk{Seq: 2, Offset: 0, Total: 6, Data: []byte("second")}, chunk)
+
+	_, ok = pollServer(t, tun, "c1", 3, 0)
+	require.False(t, ok)
+	_, ok = pollServer(t, tun, "c2", 0, 0)
+	require.False(t, ok)
+}
+
+func TestSendQueueLimit(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	for i := 0; i < maxQueuedMessages; i++ {
+		_, err := tun.Send("c1", []byte("msg"))
+		require.Nil(t, err)
+	}
+	_, err := tun.Send("c1", []byte("msg"))
+	require.NotNil(t, err)
+	_, err = tun.Send("a.b", []byte("msg"))
+	require.NotNil(t, err)
+}
+
+func TestDownstreamMixedCase(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	_, err := tun.Send("Client1", []byte("hello"))
+	require.Nil(t, err)
+
+	req := &dns.Msg{}
+	req.SetQuestion("PoLl-X7f2.cLiEnT1.1.0.tUnNeL.eXaMpLe.CoM.", dns.TypeTXT)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+	require.Len(t, w.msg.Answer, 1)
+	chunk, ok, err := ParseChunk(w.msg.Answer[0].(*dns.TXT).Txt)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), chunk.Data)
+}
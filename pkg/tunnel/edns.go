@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP payload size advertised in responses to EDNS0 queries. It is the size
+// recommended by DNS Flag Day 2020, which avoids fragmentation on virtually every path.
+const ednsUDPSize = 1232
+
+// clientSubnet returns the network of the EDNS Client Subnet option of opt, or nil if opt is nil,
+// carries no such option, or the client asked for its address not to be disclosed by sending a
+// source prefix length of 0.
+func clientSubnet(opt *dns.OPT) *net.IPNet {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok || ecs.SourceNetmask == 0 {
+			continue
+		}
+		bits := 128
+		if ecs.Family == 1 {
+			bits = 32
+		}
+		if int(ecs.SourceNetmask) > bits {
+			return nil
+		}
+		mask := net.CIDRMask(int(ecs.SourceNetmask), bits)
+		ip := ecs.Address.Mask(mask)
+		if ip == nil {
+			return nil
+		}
+		return &net.IPNet{IP: ip, Mask: mask}
+	}
+	return nil
+}
+
+// udpSize returns the largest reply that a request with the OPT record opt, or without one if opt
+// is nil, may be sent over UDP.
+func udpSize(opt *dns.OPT) int {
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	return int(min(max(opt.UDPSize(), dns.MinMsgSize), ednsUDPSize))
+}
+
+// setEDNS adds an OPT record to the reply m if the request carried one, as required by RFC 6891.
+// A Client Subnet option is echoed with a scope prefix length of 0, since answers are the same
+// for every subnet. Replies to requests for an EDNS version other than 0 are marked BADVERS.
+func setEDNS(m *dns.Msg, opt *dns.OPT) {
+	if opt == nil {
+		return
+	}
+	reply := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	reply.SetUDPSize(ednsUDPSize)
+	reply.SetDo(opt.Do())
+	if opt.Version() != 0 {
+		m.Rcode = dns.RcodeBadVers
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			reply.Option = append(reply.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        ecs.Family,
+				SourceNetmask: ecs.SourceNetmask,
+				SourceScope:   0,
+				Address:       ecs.Address,
+			})
+		}
+	}
+	m.Extra = append(m.Extra, reply)
+}
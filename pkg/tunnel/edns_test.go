@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// ecsQuery returns a query for name with an EDNS Client Subnet option for addr/netmask.
+func ecsQuery(name string, addr string, netmask uint8) *dns.Msg {
+	r := &dns.Msg{}
+	r.SetQuestion(name, dns.TypeTXT)
+	r.SetEdns0(4096, false)
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: netmask, Address: net.ParseIP(addr)}
+	if ecs.Address.To4() == nil {
+		ecs.Family = 2
+	}
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, ecs)
+	return r
+}
+
+func TestClientSubnet(t *testing.T) {
+	tests := []struct {
+		addr     string
+		netmask  uint8
+		expected string
+	}{
+		{"198.51.100.7", 24, "198.51.100.0/24"},
+		{"198.51.100.7", 32, "198.51.100.7/32"},
+		{"2001:db8:1234:5678::1", 56, "2001:db8:1234:5600::/56"},
+		{"198.51.100.7", 0, ""},
+		{"198.51.100.7", 33, ""},
+	}
+	for _, test := range tests {
+		subnet := clientSubnet(ecsQuery("example.com.", test.addr, test.netmask).IsEdns0())
+		if test.expected == "" {
+			require.Nil(t, subnet, test.addr)
+		} else {
+			require.Equal(t, test.expected, subnet.String(), test.addr)
+		}
+	}
+	require.Nil(t, clientSubnet(nil))
+}
+
+func TestEDNS(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com"})
+	defer tun.Close()
+
+	// Queries without EDNS0 get replies without an OPT record.
+	w := &testResponseWriter{}
+	r := &dns.Msg{}
+	r.SetQuestion("tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(w, r)
+	require.Nil(t, w.msg.IsEdns0())
+
+	// The client subnet is attached to the message, and echoed with a scope of 0.
+	w = &testResponseWriter{}
+	tun.ServeDNS(w, ecsQuery("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", "198.51.100.7", 24))
+	opt := w.msg.IsEdns0()
+	require.NotNil(t, opt)
+	require.EqualValues(t, ednsUDPSize, opt.UDPSize())
+	require.Len(t, opt.Option, 1)
+	ecs := opt.Option[0].(*dns.EDNS0_SUBNET)
+	require.EqualValues(t, 24, ecs.SourceNetmask)
+	require.EqualValues(t, 0, ecs.SourceScope)
+	msg := <-tun.Messages()
+	require.Equal(t, "198.51.100.0/24", msg.ClientSubnet.String())
+	require.Equal(t, "192.0.2.1", msg.Source.String())
+
+	// Unsupported EDNS versions are answered with BADVERS, and the fragment is ignored.
+	w = &testResponseWriter{}
+	r = &dns.Msg{}
+	r.SetQuestion("abcdef.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeTXT)
+	r.SetEdns0(4096, false)
+	r.IsEdns0().SetVersion(1)
+	tun.ServeDNS(w, r)
+	require.Equal(t, dns.RcodeBadVers, w.msg.Rcode)
+	require.Empty(t, w.msg.Answer)
+	_, err := w.msg.Pack()
+	require.Nil(t, err)
+	require.EqualValues(t, 1, tun.Stats().Fragments)
+}
+
+// tcpResponseWriter is a testResponseWriter for queries received over TCP.
+type tcpResponseWriter struct {
+	testResponseWriter
+}
+
+func (w *tcpResponseWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+}
+
+func TestTruncate(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com"})
+	defer tun.Close()
+
+	large := func(r *dns.Msg) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		for i := 0; i < 10; i++ {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{strings.Repeat("x", 200)},
+			})
+		}
+		return m
+	}
+
+	tests := []struct {
+		w         dns.ResponseWriter
+		udpSize   uint16
+		truncated bool
+		answers   int
+	}{
+		// Without EDNS0, UDP replies are limited to 512 bytes.
+		{w: &testResponseWriter{}, truncated: true, answers: 2},
+		// With EDNS0, to the advertised size, but no more than ednsUDPSize.
+		{w: &testResponseWriter{}, udpSize: 1500, truncated: true, answers: 5},
+		{w: &testResponseWriter{}, udpSize: 65535, truncated: true, answers: 5},
+		// TCP replies are never truncated.
+		{w: &tcpResponseWriter{}, truncated: false, answers: 10},
+	}
+	for i, test := range tests {
+		r := &dns.Msg{}
+		r.SetQuestion("tunnel.example.com.", dns.TypeTXT)
+		if test.udpSize != 0 {
+			r.SetEdns0(test.udpSize, false)
+		}
+		m := large(r)
+		tun.reply(test.w, r, m)
+		require.Equal(t, test.truncated, m.Truncated, i)
+		require.Len(t, m.Answer, test.answers, i)
+		b, err := m.Pack()
+		require.Nil(t, err)
+		if test.truncated {
+			require.LessOrEqual(t, len(b), udpSize(r.IsEdns0()), i)
+		}
+	}
+	require.EqualValues(t, 3, tun.Stats().Truncated)
+}
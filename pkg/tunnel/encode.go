@@ -0,0 +1,325 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxLabelLen is the maximum length of a single DNS label.
+	maxLabelLen = 63
+	// maxNameLen is the maximum length of a domain name in presentation format, excluding the
+	// trailing dot.
+	maxNameLen = 253
+)
+
+// An Encoder encodes messages into the sequence of domains that a tunnel reassembles back into
+// the message. The zero value is not usable; LabelLen must be set.
+type Encoder struct {
+	// LabelLen is the maximum length of each label of payload. Resolvers drop names with labels
+	// longer than 63 bytes, so LabelLen may not exceed 63.
+	LabelLen int
+
+	// Version is the framing of the fragments, Version1 if zero. Fragments framed as Version2
+	// declare in flags how the message was encoded, instead of leaving the tunnel to recognize it.
+	Version int
+
+	// Ack requests that the tunnel answer each fragment with an acknowledgement, even if it isn't
+	// configured with Acks. It requires Version2.
+	Ack bool
+
+	// Session, if set, labels the message with the session of the client that sent it, as
+	// described on Tunnel.Sessions. It must be a single label, and requires Version2.
+	Session string
+
+	// Sequence, if set, numbers the message within its session, so that tunnels configured with
+	// OrderedDelivery deliver the session's messages in the order they were sent. Clients number
+	// the messages of a session from 1. It requires Session.
+	Sequence int
+
+	// AuthToken, if set, is the auth token carried by every fragment, for tunnels configured with
+	// it in AuthTokens. AuthTokenKey instead derives the token from the message ID, for tunnels
+	// configured with the same AuthTokenKey. Either requires Version2.
+	AuthToken    string
+	AuthTokenKey []byte
+
+	// Encoding is the encoding of the data labels, EncodingBase32 if empty. Version2 fragments name
+	// it in a label, while Version1 fragments rely on the tunnel being configured with the same
+	// encoding for the top domain in Config.Encodings.
+	Encoding Encoding
+
+	// Checksum adds a CRC32 label to each fragment, so that the tunnel can detect and drop
+	// fragments that were mangled in transit.
+	Checksum bool
+
+	// Codec lays out the fields of each fragment after its framing, StandardCodec if nil. Fragments
+	// don't name their codec, so the tunnel must be configured with the same one for the top
+	// domain in Config.Codecs.
+	Codec Codec
+
+	// Binary marks the message as binary data, so that the tunnel reports it as such instead of
+	// treating it as text.
+	Binary bool
+
+	// Compress gzips the message before it is encrypted. Tunnels recognize and decompress gzip
+	// compressed messages automatically.
+	Compress bool
+
+	// EncryptKey, if set, encrypts the message with AES-GCM under EncryptKey, for tunnels
+	// configured with the same DecryptKey.
+	EncryptKey []byte
+	// KeyID, if set, names EncryptKey among the DecryptKeys of the tunnel, in a label of every
+	// fragment. It requires Version2 and EncryptKey.
+	KeyID string
+
+	// Expiration, if set, asks the tunnel to hold the partial message for Expiration after each
+	// fragment, rather than for its Config.Expiration, up to its Config.MaxExpiration. It is
+	// rounded up to whole seconds, and requires Version2.
+	Expiration time.Duration
+
+	// Parity, if set, follows every Parity fragments with a parity fragment, from which the tunnel
+	// rebuilds any one of them that never arrives, so that messages sent over lossy resolver
+	// paths need fewer fragments sent again. It requires Version2 and StandardCodec, and takes a
+	// few bytes of room from each fragment.
+	Parity int
+
+	// HMACKey, if set, appends an HMAC-SHA256 tag of the (possibly encrypted) message to the
+	// message, for tunnels configured with the same key.
+	HMACKey []byte
+
+	// SigningKey, if set, appends an Ed25519 signature of the (possibly encrypted) message to the
+	// message before its HMAC tag, for tunnels configured with the public key in SigningKeys.
+	SigningKey ed25519.PrivateKey
+}
+
+// EncodeMessage encodes msg into the sequence of domains that a tunnel listening on topDomain
+// reassembles back into msg, splitting the payload into labels of at most labelLen bytes. It is
+// shorthand for Encoder{LabelLen: labelLen}.Encode(topDomain, id, msg).
+func EncodeMessage(topDomain, id, msg string, labelLen int) ([]string, error) {
+	return Encoder{LabelLen: labelLen}.Encode(topDomain, id, msg)
+}
+
+// Encode encodes msg into the sequence of domains that a tunnel listening on topDomain
+// reassembles back into msg. It is the inverse of the decoding done by the tunnel, and produces
+// the same queries as the javascript client.
+//
+// The id argument identifies the message and must be a single label. The payload is split into
+// labels of at most LabelLen bytes, and into as many domains as necessary to keep each domain name
+// within 253 bytes. An error is returned if topDomain is too long to leave room for any payload.
+func (enc Encoder) Encode(topDomain, id, msg string) ([]string, error) {
+	fragments, err := enc.EncodeFragments(topDomain, id, msg)
+	if err != nil {
+		return nil, err
+	}
+	domains := make([]string, len(fragments))
+	for i, f := range fragments {
+		domains[i] = f.Domain
+	}
+	return domains, nil
+}
+
+// An EncodedFragment is a domain produced by an Encoder, along with the range of the encoded
+// message it carries, as reported in Ack.Missing. The ranges of parity fragments start past the
+// end of the message, as described on FlagParity.
+type EncodedFragment struct {
+	Domain string
+	Range
+}
+
+// EncodeFragments is like Encode, but also returns the range of the encoded message carried by
+// each domain, so that the fragments a tunnel reports as missing can be sent again.
+func (enc Encoder) EncodeFragments(topDomain, id, msg string) ([]EncodedFragment, error) {
+	if id == "" || strings.Contains(id, ".") || len(id) > maxLabelLen {
+		return nil, fmt.Errorf("Message ID %q must be a single non-empty label", id)
+	}
+	if enc.LabelLen <= 0 || enc.LabelLen > maxLabelLen {
+		return nil, fmt.Errorf("Label length must be between 1 and %d, got %d", maxLabelLen, enc.LabelLen)
+	}
+	if msg == "" {
+		return nil, fmt.Errorf("Cannot encode an empty message")
+	}
+	fr, err := enc.framing()
+	if err != nil {
+		return nil, err
+	}
+	if enc.AuthTokenKey != nil {
+		fr.token = DeriveAuthToken(enc.AuthTokenKey, id)
+	}
+
+	topDomain = dns.Fqdn(topDomain)
+	for _, label := range dns.SplitDomainName(topDomain) {
+		if len(label) > maxLabelLen {
+			return nil, fmt.Errorf("Top domain %s has a label longer than %d bytes", topDomain, maxLabelLen)
+		}
+	}
+	payload := []byte(msg)
+	if enc.Binary && fr.version < Version2 {
+		payload = markBinary(payload)
+	}
+	if enc.Compress {
+		payload, err = compress(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if enc.EncryptKey != nil {
+		payload, err = encrypt(enc.EncryptKey, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if enc.SigningKey != nil {
+		payload = signMessage(enc.SigningKey, payload)
+	}
+	if enc.HMACKey != nil {
+		payload = sign(enc.HMACKey, payload)
+	}
+	c, err := codecOf(enc.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	encoded := c.enc.EncodeToString(payload)
+
+	cd := enc.Codec
+	if cd == nil {
+		cd = StandardCodec{}
+	}
+	// The labels laid out by the codec sit between the framing and the top domain, which the
+	// name must fit along with.
+	prefix := fr.prefix()
+	opts := CodecOptions{
+		Encoding: enc.Encoding,
+		LabelLen: enc.LabelLen,
+		Space:    maxNameLen - len(prefix) - len(topDomain),
+		Checksum: enc.Checksum,
+	}
+	var coded []CodedFragment
+	if enc.Parity > 0 {
+		if _, ok := cd.(StandardCodec); !ok {
+			return nil, fmt.Errorf("Parity fragments can only be laid out by StandardCodec")
+		}
+		// Parity fragments are longer than the fragments of their group, which leave them room.
+		reserved := opts
+		reserved.Space -= parityReserve(len(encoded), c, enc.LabelLen)
+		coded, err = cd.Encode(id, encoded, reserved)
+		if err == nil {
+			coded, err = addParity(id, encoded, coded, enc.Parity, c, opts)
+		}
+	} else {
+		coded, err = cd.Encode(id, encoded, opts)
+	}
+	if errors.Is(err, ErrNoRoom) {
+		return nil, fmt.Errorf("Top domain %s leaves no room for payload", topDomain)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fragments := make([]EncodedFragment, len(coded))
+	for i, f := range coded {
+		fragments[i] = EncodedFragment{Domain: prefix + f.Labels + "." + topDomain, Range: f.Range}
+	}
+	return fragments, nil
+}
+
+// framing returns the framing of the fragments encoded by enc.
+func (enc Encoder) framing() (framing, error) {
+	switch enc.Version {
+	case 0, Version1:
+		if enc.Ack {
+			return framing{}, fmt.Errorf("Acknowledgements can only be requested with version %d framing", Version2)
+		}
+		if enc.Session != "" || enc.Sequence != 0 {
+			return framing{}, fmt.Errorf("Sessions require version %d framing", Version2)
+		}
+		if enc.AuthToken != "" || enc.AuthTokenKey != nil {
+			return framing{}, fmt.Errorf("Auth tokens require version %d framing", Version2)
+		}
+		if enc.KeyID != "" {
+			return framing{}, fmt.Errorf("Key IDs require version %d framing", Version2)
+		}
+		if enc.Expiration != 0 {
+			return framing{}, fmt.Errorf("Expirations require version %d framing", Version2)
+		}
+		if enc.Parity != 0 {
+			return framing{}, fmt.Errorf("Parity fragments require version %d framing", Version2)
+		}
+		return framing{}, nil
+	case Version2:
+	default:
+		return framing{}, fmt.Errorf("Unsupported protocol version %d", enc.Version)
+	}
+	fr := framing{version: Version2}
+	if enc.Compress {
+		fr.flags |= FlagCompressed
+	}
+	if enc.EncryptKey != nil {
+		fr.flags |= FlagEncrypted
+	}
+	if enc.Binary {
+		fr.flags |= FlagBinary
+	}
+	if enc.Ack {
+		fr.flags |= FlagAck
+	}
+	if enc.Session != "" {
+		if strings.Contains(enc.Session, ".") || len(enc.Session) > maxLabelLen {
+			return framing{}, fmt.Errorf("Session %q must be a single label", enc.Session)
+		}
+		fr.flags |= FlagSession
+		fr.session = enc.Session
+	}
+	if enc.Sequence != 0 {
+		if enc.Session == "" {
+			return framing{}, fmt.Errorf("Sequence numbers require a session")
+		}
+		if enc.Sequence < 0 {
+			return framing{}, fmt.Errorf("Sequence number %d is not positive", enc.Sequence)
+		}
+		fr.flags |= FlagSequence
+		fr.seq = enc.Sequence
+	}
+	if enc.AuthToken != "" || enc.AuthTokenKey != nil {
+		if enc.AuthToken != "" && enc.AuthTokenKey != nil {
+			return framing{}, fmt.Errorf("Auth token and auth token key are mutually exclusive")
+		}
+		if strings.Contains(enc.AuthToken, ".") || len(enc.AuthToken) > maxLabelLen {
+			return framing{}, fmt.Errorf("Auth token %q must be a single label", enc.AuthToken)
+		}
+		fr.flags |= FlagToken
+		fr.token = enc.AuthToken
+	}
+	if enc.Encoding != "" {
+		fr.flags |= FlagEncoding
+		fr.encoding = enc.Encoding
+	}
+	if enc.KeyID != "" {
+		if enc.EncryptKey == nil {
+			return framing{}, fmt.Errorf("Key ID %q requires an encryption key", enc.KeyID)
+		}
+		if strings.Contains(enc.KeyID, ".") || len(enc.KeyID) > maxLabelLen {
+			return framing{}, fmt.Errorf("Key ID %q must be a single label", enc.KeyID)
+		}
+		fr.flags |= FlagKey
+		fr.keyID = strings.ToLower(enc.KeyID)
+	}
+	if enc.Expiration != 0 {
+		if enc.Expiration < 0 {
+			return framing{}, fmt.Errorf("Expiration %s is not positive", enc.Expiration)
+		}
+		fr.flags |= FlagExpiration
+		fr.expiration = int((enc.Expiration + time.Second - 1) / time.Second)
+	}
+	if enc.Parity != 0 {
+		if enc.Parity < 0 {
+			return framing{}, fmt.Errorf("Parity group size %d is not positive", enc.Parity)
+		}
+		fr.flags |= FlagParity
+	}
+	return fr, nil
+}
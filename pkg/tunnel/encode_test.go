@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeMessage(t *testing.T) {
+	tests := []struct {
+		topDomain   string
+		id          string
+		msg         string
+		maxLabelLen int
+		fails       bool
+		output      []string
+	}{
+		{
+			topDomain:   "tunnel.example.com",
+			id:          "2jkhm3",
+			msg:         "hello world",
+			maxLabelLen: 63,
+			output:      []string{"2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."},
+		},
+		{
+			topDomain:   "tunnel.example.com.",
+			id:          "2jkhm3",
+			msg:         "hello world",
+			maxLabelLen: 10,
+			output:      []string{"2jkhm3.24.0.nbswy3dpeb.3w64tmmq00.0000.tunnel.example.com."},
+		},
+		{
+			topDomain:   "tunnel.example.com.",
+			id:          "",
+			msg:         "hello world",
+			maxLabelLen: 63,
+			fails:       true,
+		},
+		{
+			topDomain:   "tunnel.example.com.",
+			id:          "a.b",
+			msg:         "hello world",
+			maxLabelLen: 63,
+			fails:       true,
+		},
+		{
+			topDomain:   "tunnel.example.com.",
+			id:          "2jkhm3",
+			msg:         "",
+			maxLabelLen: 63,
+			fails:       true,
+		},
+		{
+			topDomain:   "tunnel.example.com.",
+			id:          "2jkhm3",
+			msg:         "hello world",
+			maxLabelLen: 0,
+			fails:       true,
+		},
+		{
+			topDomain:   "tunnel.example.com.",
+			id:          "2jkhm3",
+			msg:         "hello world",
+			maxLabelLen: 64,
+			fails:       true,
+		},
+		{
+			topDomain:   strings.Repeat("a", 64) + ".example.com.",
+			id:          "2jkhm3",
+			msg:         "hello world",
+			maxLabelLen: 63,
+			fails:       true,
+		},
+		{
+			topDomain:   strings.Repeat(strings.Repeat("a", 60)+".", 4),
+			id:          "2jkhm3",
+			msg:         "hello world",
+			maxLabelLen: 63,
+			fails:       true,
+		},
+	}
+	for _, test := range tests {
+		got, err := EncodeMessage(test.topDomain, test.id, test.msg, test.maxLabelLen)
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+		}
+		require.Equal(t, test.output, got)
+	}
+}
+
+func TestEncodeMessageLimits(t *testing.T) {
+	topDomains := []string{
+		"t.co.",
+		"tunnel.example.com.",
+		strings.Repeat(strings.Repeat("a", 60)+".", 3) + "example.com.",
+	}
+	for _, topDomain := range topDomains {
+		domains, err := EncodeMessage(topDomain, "i42ftq", strings.Repeat("x", 2000), 63)
+		require.Nil(t, err)
+		for _, domain := range domains {
+			require.True(t, len(domain)-1 <= maxNameLen, "domain %s is too long", domain)
+			for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+				require.True(t, len(label) <= maxLabelLen, "label %s is too long", label)
+			}
+			_, err := parseDomain(topDomain, domain, parseRules{maxMessageSize: 5000})
+			require.Nil(t, err)
+		}
+	}
+}
+
+func TestEncodeMessageRoundTrip(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	msg := strings.Repeat("It is at work everywhere, functioning smoothly at times. ", 20)
+	domains, err := EncodeMessage("tunnel.example.com.", "i42ftq", msg, 63)
+	require.Nil(t, err)
+	require.True(t, len(domains) > 1)
+
+	for _, domain := range domains {
+		tun.domains <- query{name: domain}
+	}
+	require.Equal(t, []byte(msg), (<-tun.Messages()).Payload)
+}
+
+func TestEncoderBinary(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	payload := string([]byte{0x00, 0xff, 0x1f, 0x8b, 0x80, 'h', 'i'})
+	tests := []struct {
+		enc    Encoder
+		binary bool
+	}{
+		{enc: Encoder{LabelLen: 63}},
+		{enc: Encoder{LabelLen: 63, Binary: true}, binary: true},
+		{enc: Encoder{LabelLen: 63, Binary: true, Compress: true}, binary: true},
+	}
+	for _, test := range tests {
+		domains, err := test.enc.Encode("tunnel.example.com.", "2jkhm3", payload)
+		require.Nil(t, err)
+		for _, domain := range domains {
+			tun.domains <- query{name: domain}
+		}
+		msg := <-tun.Messages()
+		require.Equal(t, []byte(payload), msg.Payload)
+		require.Equal(t, test.binary, msg.Binary)
+	}
+}
+
+func TestEncoderChecksum(t *testing.T) {
+	enc := Encoder{LabelLen: 63, Checksum: true}
+	domains, err := enc.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, []string{"2jkhm3.24.0.crc-48c3fd0d.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}, domains)
+
+	domains, err = enc.Encode("tunnel.example.com.", "i42ftq", strings.Repeat("x", 2000))
+	require.Nil(t, err)
+	for _, domain := range domains {
+		require.True(t, len(domain)-1 <= maxNameLen, "domain %s is too long", domain)
+		_, err := parseDomain("tunnel.example.com.", domain, parseRules{maxMessageSize: 5000})
+		require.Nil(t, err)
+	}
+}
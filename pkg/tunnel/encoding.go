@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// An Encoding is the alphabet that the data labels of fragments are encoded with. Fragments framed
+// with FlagEncoding name their encoding in a label, and other fragments are encoded with the
+// encoding configured for their top domain in Config.Encodings, or EncodingBase32 by default.
+type Encoding string
+
+// Encodings of data labels.
+const (
+	// EncodingBase32 is base32 with the lower case alphabet a-z2-7, padded with zeroes, as produced
+	// by the JavaScript client.
+	EncodingBase32 Encoding = "base32"
+	// EncodingBase32Hex is the base32 encoding with the extended hex alphabet of RFC 4648, 0-9a-v,
+	// without padding.
+	EncodingBase32Hex Encoding = "base32hex"
+	// EncodingBase64URL is the URL-safe base64 encoding of RFC 4648, without padding. It is case
+	// sensitive, so it only survives resolvers that preserve the case of names, which rules out
+	// those that randomize it (DNS 0x20).
+	EncodingBase64URL Encoding = "base64url"
+	// EncodingHex is hexadecimal, in either case.
+	EncodingHex Encoding = "hex"
+)
+
+// A labelCodec encodes and decodes data, as implemented by base32.Encoding and base64.Encoding.
+type labelCodec interface {
+	EncodeToString(src []byte) string
+	DecodedLen(n int) int
+	Decode(dst, src []byte) (int, error)
+}
+
+// A codec implements an Encoding.
+type codec struct {
+	enc labelCodec
+	// alphabet lists the characters of encoded data, as checked by strict parse rules, and inAlphabet
+	// indexes them by byte.
+	alphabet   string
+	inAlphabet [256]bool
+	// caseSensitive is set for encodings whose data labels must be decoded in the case they were
+	// sent in, rather than in lower case.
+	caseSensitive bool
+	// block is the number of characters that encode a whole number of bytes, so that encoded data
+	// can be decoded a block at a time.
+	block int
+}
+
+// hexCodec adapts package hex to the interface of the other codecs.
+type hexCodec struct{}
+
+func (hexCodec) EncodeToString(src []byte) string { return hex.EncodeToString(src) }
+
+func (hexCodec) DecodedLen(n int) int { return hex.DecodedLen(n) }
+
+func (hexCodec) Decode(dst, src []byte) (int, error) { return hex.Decode(dst, src) }
+
+var codecs = map[Encoding]*codec{
+	EncodingBase32:    newCodec(decoder, "abcdefghijklmnopqrstuvwxyz234567"+"0", false, 8),
+	EncodingBase32Hex: newCodec(base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding), "0123456789abcdefghijklmnopqrstuv", false, 8),
+	EncodingBase64URL: newCodec(base64.RawURLEncoding, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_", true, 4),
+	EncodingHex:       newCodec(hexCodec{}, "0123456789abcdef", false, 2),
+}
+
+func newCodec(enc labelCodec, alphabet string, caseSensitive bool, block int) *codec {
+	c := &codec{enc: enc, alphabet: alphabet, caseSensitive: caseSensitive, block: block}
+	for i := 0; i < len(alphabet); i++ {
+		c.inAlphabet[alphabet[i]] = true
+	}
+	return c
+}
+
+// codecOf returns the codec of e, EncodingBase32 if e is empty, or an error if it is unknown.
+func codecOf(e Encoding) (*codec, error) {
+	if e == "" {
+		e = EncodingBase32
+	}
+	c, ok := codecs[e]
+	if !ok {
+		return nil, fmt.Errorf("Unknown encoding %q", e)
+	}
+	return c, nil
+}
+
+// checkAlphabet returns an error if label contains a character that the codec never produces.
+func (c *codec) checkAlphabet(label string) error {
+	for i := 0; i < len(label); i++ {
+		if !c.inAlphabet[label[i]] {
+			return parseErrorf(reasonAlphabet, "Label %q contains %q, which is not in the alphabet of its encoding", label, label[i])
+		}
+	}
+	return nil
+}
+
+// isChecksum reports whether label is a checksum label rather than data. Encodings whose data may
+// contain hyphens only recognize checksum labels of the exact form that clients produce.
+func (c *codec) isChecksum(label string) bool {
+	if !strings.HasPrefix(label, checksumPrefix) {
+		return false
+	}
+	return !strings.Contains(c.alphabet, "-") || len(label) == len(checksumLabel(""))
+}
+
+// normalizeEncodings validates the encodings of Config.Encodings, and keys them by normalized
+// top domain, each of which must be one of topDomains.
+func normalizeEncodings(encodings map[string]Encoding, topDomains []string) (map[string]Encoding, error) {
+	normalized := make(map[string]Encoding, len(encodings))
+	for domain, e := range encodings {
+		d := dns.Fqdn(strings.ToLower(domain))
+		found := false
+		for _, top := range topDomains {
+			found = found || top == d
+		}
+		if !found {
+			return nil, fmt.Errorf("Encoding is configured for %s, which is not a top domain", domain)
+		}
+		if _, err := codecOf(e); err != nil {
+			return nil, err
+		}
+		normalized[d] = e
+	}
+	return normalized, nil
+}
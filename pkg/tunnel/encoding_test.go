@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodings(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain:  "tunnel.example.com.",
+		TopDomains: []string{"hex.example.com"},
+		Encodings:  map[string]Encoding{"HEX.example.com": EncodingHex},
+		Strict:     true,
+	})
+	defer tun.Close()
+
+	msg := strings.Repeat("hello world? ", 40)
+	tests := []struct {
+		domain string
+		enc    Encoder
+	}{
+		{domain: "tunnel.example.com.", enc: Encoder{LabelLen: 63, Version: Version2, Checksum: true, Encoding: EncodingBase32}},
+		{domain: "tunnel.example.com.", enc: Encoder{LabelLen: 63, Version: Version2, Checksum: true, Encoding: EncodingBase32Hex}},
+		{domain: "tunnel.example.com.", enc: Encoder{LabelLen: 63, Version: Version2, Checksum: true, Encoding: EncodingBase64URL}},
+		{domain: "tunnel.example.com.", enc: Encoder{LabelLen: 63, Version: Version2, Checksum: true, Encoding: EncodingHex}},
+		// Fragments that don't name an encoding carry the one configured for their top domain.
+		{domain: "hex.example.com.", enc: Encoder{LabelLen: 63, Checksum: true, Encoding: EncodingHex}},
+		{domain: "hex.example.com.", enc: Encoder{LabelLen: 63, Version: Version2, Encoding: EncodingBase32}},
+	}
+	for _, test := range tests {
+		domains, err := test.enc.Encode(test.domain, "2jkhm3", msg)
+		require.Nil(t, err)
+		for _, d := range domains {
+			tun.domains <- query{name: strings.ToLower(d), asked: d}
+		}
+		require.Equal(t, msg, string((<-tun.Messages()).Payload), test.enc.Encoding)
+	}
+
+	// Case-sensitive encodings don't survive resolvers that change the case of names.
+	domains, err := Encoder{LabelLen: 63, Version: Version2, Encoding: EncodingBase64URL}.Encode("tunnel.example.com.", "i42ftq", "hello world")
+	require.Nil(t, err)
+	tun.domains <- query{name: strings.ToLower(domains[0]), asked: strings.ToUpper(domains[0])}
+	domains, err = Encoder{LabelLen: 63, Version: Version2}.Encode("tunnel.example.com.", "x7f2aa", "hello world")
+	require.Nil(t, err)
+	tun.domains <- query{name: domains[0]}
+	got := <-tun.Messages()
+	require.Equal(t, "i42ftq", got.ID)
+	require.NotEqual(t, "hello world", string(got.Payload))
+	require.Equal(t, "x7f2aa", (<-tun.Messages()).ID)
+}
+
+func TestNormalizeEncodings(t *testing.T) {
+	topDomains := []string{"tunnel.example.com.", "hex.example.com."}
+	got, err := normalizeEncodings(map[string]Encoding{"Hex.Example.com": EncodingHex}, topDomains)
+	require.Nil(t, err)
+	require.Equal(t, map[string]Encoding{"hex.example.com.": EncodingHex}, got)
+
+	_, err = normalizeEncodings(map[string]Encoding{"other.example.com.": EncodingHex}, topDomains)
+	require.NotNil(t, err)
+	_, err = normalizeEncodings(map[string]Encoding{"hex.example.com.": "base64"}, topDomains)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// An ErrorCategory describes why a fragment, message or query was dropped. Categories match the
+// class attribute of the corresponding log entries.
+type ErrorCategory string
+
+// Categories of TunnelError.
+const (
+	// ErrParse is reported for fragments whose domain can't be parsed. TunnelError.Reason
+	// holds the finer grained reason, as counted by Stats.ParseErrorReasons, e.g. checksum.
+	ErrParse ErrorCategory = classParse
+	// ErrAssembly is reported for messages whose fragments don't decode.
+	ErrAssembly ErrorCategory = classAssembly
+	// ErrAuth is reported for messages lacking a valid HMAC tag or a required signature,
+	// fragments lacking a valid auth token, and queries refused for their client certificate.
+	ErrAuth ErrorCategory = classAuth
+	// ErrDecrypt is reported for messages that fail to decrypt.
+	ErrDecrypt ErrorCategory = classDecrypt
+	// ErrDecompress is reported for messages that fail to decompress.
+	ErrDecompress ErrorCategory = classDecompress
+	// ErrPoll and ErrHeartbeat are reported for malformed polls and heartbeats.
+	ErrPoll      ErrorCategory = classPoll
+	ErrHeartbeat ErrorCategory = classHeartbeat
+	// ErrStream is reported for malformed stream queries, and ErrStatus for malformed status
+	// queries.
+	ErrStream ErrorCategory = classStream
+	ErrStatus ErrorCategory = classStatus
+	// ErrDrain is reported for fragments of new messages received while shutting down.
+	ErrDrain ErrorCategory = classDrain
+	// ErrQuota is reported for fragments of new messages of tenants at their MaxInFlight, and
+	// fragments sent with API keys that exceeded their quotas.
+	ErrQuota ErrorCategory = classQuota
+	// ErrEvict is reported for partial messages evicted to stay within the memory limits.
+	// TunnelError.Reason holds the limit, as in the reason label of the evicted metric.
+	ErrEvict ErrorCategory = classEvict
+	// ErrBackpressure is reported for messages dropped because the Messages channel was full.
+	ErrBackpressure ErrorCategory = classBackpressure
+	// ErrWrite is reported for answers that couldn't be written.
+	ErrWrite ErrorCategory = classWrite
+)
+
+// A TunnelError reports a fragment, message or query that the tunnel dropped, or couldn't
+// answer.
+type TunnelError struct {
+	Category ErrorCategory
+	// Reason refines the category, for parse errors and evictions.
+	Reason string
+	// ID and Tenant identify the message concerned, if known.
+	ID     string
+	Tenant string
+	// Source is the IP address the query was received from, and Domain its name, if the error
+	// concerns a query.
+	Source net.IP
+	Domain string
+	// Time is when the error occurred.
+	Time time.Time
+	// Err is the underlying error.
+	Err error
+}
+
+func (e TunnelError) Error() string {
+	category := string(e.Category)
+	if category != "" {
+		category = strings.ToUpper(category[:1]) + category[1:]
+	}
+	if e.Reason != "" {
+		category += " (" + e.Reason + ")"
+	}
+	if e.ID != "" {
+		return fmt.Sprintf("%s error in message %s: %v", category, e.ID, e.Err)
+	}
+	return fmt.Sprintf("%s error: %v", category, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e TunnelError) Unwrap() error {
+	return e.Err
+}
+
+// Errors returns the channel on which the tunnel reports the fragments, messages and queries it
+// drops, in addition to logging them, so that programs can react to them, e.g. by alerting on a
+// spike of checksum failures. Like expired messages, errors are dropped if nobody is reading from
+// the channel. The channel is closed by Close.
+func (tun *Tunnel) Errors() <-chan TunnelError {
+	return tun.errors
+}
+
+// notifyError reports e without blocking.
+func (tun *Tunnel) notifyError(e TunnelError) {
+	if e.Time.IsZero() {
+		e.Time = tun.clock.Now()
+	}
+	select {
+	case tun.errors <- e:
+	default:
+	}
+}
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrors(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", HMACKey: []byte("secret")})
+
+	for _, name := range []string{
+		"2jkhm3.24.0.crc-00000000.nbswy3dp.tunnel.example.com.",
+		"poll-x7f2.c1.FAIL.0.tunnel.example.com.",
+		"2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+	} {
+		r := &dns.Msg{}
+		r.SetQuestion(name, dns.TypeTXT)
+		tun.ServeDNS(&testResponseWriter{}, r)
+	}
+
+	// The poll is rejected as it is received, before the fragments are parsed.
+	e := <-tun.Errors()
+	require.Equal(t, ErrPoll, e.Category)
+	require.Equal(t, "192.0.2.1", e.Source.String())
+	e = <-tun.Errors()
+	require.Equal(t, ErrParse, e.Category)
+	require.Equal(t, reasonChecksum, e.Reason)
+	require.Equal(t, "2jkhm3.24.0.crc-00000000.nbswy3dp.tunnel.example.com.", e.Domain)
+	// The message isn't signed.
+	e = <-tun.Errors()
+	require.Equal(t, ErrAuth, e.Category)
+	require.Equal(t, "2jkhm3", e.ID)
+	require.False(t, e.Time.IsZero())
+
+	var err error = e
+	var target TunnelError
+	require.True(t, errors.As(err, &target))
+	require.Equal(t, e.Err, errors.Unwrap(err))
+	require.Equal(t, "Auth error in message 2jkhm3: "+e.Err.Error(), err.Error())
+
+	tun.Close()
+	_, ok := <-tun.Errors()
+	require.False(t, ok)
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons for evicting partial messages, as reported in logs and metrics.
+const (
+	evictMaxPartialMessages = "max_partial_messages"
+	evictMaxBufferedBytes   = "max_buffered_bytes"
+	evictMaxFragmentBytes   = "max_fragment_bytes"
+)
+
+// overLimit returns the reason partial messages must be evicted, or an empty string if the
+// tunnel is within its limits.
+func (tun *Tunnel) overLimit() string {
+	if tun.maxPartialMessages > 0 && tun.partials.Load() > int64(tun.maxPartialMessages) {
+		return evictMaxPartialMessages
+	}
+	if tun.maxBufferedBytes > 0 && tun.bufferedBytes.Load() > int64(tun.maxBufferedBytes) {
+		return evictMaxBufferedBytes
+	}
+	return ""
+}
+
+// evict deletes the least recently updated partial messages until the tunnel is within
+// MaxPartialMessages and MaxBufferedBytes. It must be called without any shard locked.
+func (tun *Tunnel) evict() {
+	for {
+		reason := tun.overLimit()
+		if reason == "" {
+			return
+		}
+		// The front of each shard's LRU list is its least recently updated message, so the oldest
+		// of the fronts is the least recently updated message overall.
+		var oldest *shard
+		var oldestAt time.Time
+		for _, sh := range tun.shards {
+			sh.mu.Lock()
+			if e := sh.lru.Front(); e != nil {
+				if at := sh.lists[e.Value.(string)].expiresAt; oldest == nil || at.Before(oldestAt) {
+					oldest, oldestAt = sh, at
+				}
+			}
+			sh.mu.Unlock()
+		}
+		if oldest == nil {
+			return
+		}
+		oldest.mu.Lock()
+		if e := oldest.lru.Front(); e != nil {
+			tun.evictList(oldest, e.Value.(string), reason)
+		}
+		oldest.mu.Unlock()
+	}
+}
+
+// evictList deletes the fragment list under key from sh, whose lock must be held, because of
+// reason.
+func (tun *Tunnel) evictList(sh *shard, key, reason string) {
+	fgList := sh.lists[key]
+	tun.deleteList(sh, key)
+	id := strings.TrimPrefix(key, listKey(fgList.tenant, ""))
+	if tun.store != nil {
+		if err := tun.store.Delete(fgList.tenant, id); err != nil {
+			tun.logger.Warn("Failed to update fragment store", "id", fgList.id, "error", err)
+		}
+	}
+	switch reason {
+	case evictMaxPartialMessages:
+		atomic.AddUint64(&tun.stats.EvictedMessages, 1)
+	case evictMaxBufferedBytes:
+		atomic.AddUint64(&tun.stats.EvictedBytes, 1)
+	case evictMaxFragmentBytes:
+		atomic.AddUint64(&tun.stats.Oversized, 1)
+	}
+	tun.logger.Warn("Evicting partial message", "id", fgList.id, "class", classEvict, "reason", reason, "size", fgList.size, "fragments", len(fgList.fragments))
+	tun.notifyError(TunnelError{Category: ErrEvict, Reason: reason, ID: fgList.id, Tenant: fgList.tenant, Err: fmt.Errorf("Partial message of %d bytes in %d fragments was evicted", fgList.size, len(fgList.fragments))})
+}
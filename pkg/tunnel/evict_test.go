@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+)
+
+func TestMaxPartialMessages(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", MaxPartialMessages: 2})
+	defer tun.Close()
+
+	tun.domains <- query{name: "aaaaaa.24.0.nbswy3dp.tunnel.example.com."}
+	tun.domains <- query{name: "bbbbbb.24.0.nbswy3dp.tunnel.example.com."}
+	tun.domains <- query{name: "aaaaaa.24.8.eb3w.tunnel.example.com."}
+	// bbbbbb is now the least recently updated message, and is evicted to make room.
+	tun.domains <- query{name: "cccccc.24.0.nbswy3dp.tunnel.example.com."}
+	tun.domains <- query{name: "aaaaaa.24.12.64tmmq000000.tunnel.example.com."}
+	msg := <-tun.Messages()
+	require.Equal(t, "aaaaaa", msg.ID)
+	require.Equal(t, []byte("hello world"), msg.Payload)
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(1), stats.EvictedMessages)
+	require.Equal(t, 1, stats.InFlight)
+	require.Equal(t, 8, stats.BufferedBytes)
+
+	var buf bytes.Buffer
+	require.Nil(t, metrics.Write(&buf, tun.Collect()))
+	require.Contains(t, buf.String(), "browsertunnel_evicted_total{reason=\"max_partial_messages\"} 1\n")
+	require.Contains(t, buf.String(), "browsertunnel_buffered_bytes 8\n")
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", MaxBufferedBytes: 30})
+	defer tun.Close()
+
+	tun.domains <- query{name: "aaaaaa.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "bbbbbb.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	// Holding 36 bytes, aaaaaa is evicted.
+	tun.domains <- query{name: "cccccc.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "cccccc.24.12.64tmmq000000.tunnel.example.com."}
+	require.Equal(t, "cccccc", (<-tun.Messages()).ID)
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(1), stats.EvictedBytes)
+	require.Equal(t, 1, stats.InFlight)
+	require.Equal(t, 12, stats.BufferedBytes)
+}
+
+func TestMaxFragmentBytes(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", MaxFragmentBytes: 30})
+	defer tun.Close()
+
+	// Overlapping fragments buffer more than the declared size of the message.
+	tun.domains <- query{name: "aaaaaa.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "aaaaaa.24.1.bswy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "aaaaaa.24.2.swy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}
+	require.Equal(t, "2jkhm3", (<-tun.Messages()).ID)
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(1), stats.Oversized)
+	require.Equal(t, 0, stats.InFlight)
+	require.Equal(t, 0, stats.BufferedBytes)
+}
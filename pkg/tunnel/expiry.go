@@ -0,0 +1,118 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// An ExpirationPolicy overrides Config.Expiration and Config.DeletionInterval for the partial
+// messages of a tenant, or of a top domain in Config.DomainExpirations, e.g. so that beacons
+// expire within seconds while large uploads are kept for minutes. Zero fields keep the values
+// of the top domain, then of Config. The policy of the tenant of a message takes precedence over
+// that of its top domain.
+type ExpirationPolicy struct {
+	// Expiration is how long the partial messages are held after their last fragment.
+	Expiration time.Duration
+	// DeletionInterval is how often the partial messages are checked for expiration, which
+	// bounds how late after expiring they are deleted.
+	DeletionInterval time.Duration
+}
+
+// override returns p, with the fields set in o replaced.
+func (p ExpirationPolicy) override(o ExpirationPolicy) ExpirationPolicy {
+	if o.Expiration != 0 {
+		p.Expiration = o.Expiration
+	}
+	if o.DeletionInterval != 0 {
+		p.DeletionInterval = o.DeletionInterval
+	}
+	return p
+}
+
+// normalizeDomainExpirations validates the policies of Config.DomainExpirations, and keys them by
+// normalized top domain, each of which must be one of topDomains.
+func normalizeDomainExpirations(policies map[string]ExpirationPolicy, topDomains []string) (map[string]ExpirationPolicy, error) {
+	normalized := make(map[string]ExpirationPolicy, len(policies))
+	for domain, p := range policies {
+		d := dns.Fqdn(strings.ToLower(domain))
+		found := false
+		for _, top := range topDomains {
+			found = found || top == d
+		}
+		if !found {
+			return nil, fmt.Errorf("Expiration is configured for %s, which is not a top domain", domain)
+		}
+		if p.Expiration < 0 || p.DeletionInterval < 0 {
+			return nil, fmt.Errorf("Expiration of %s must not be negative", domain)
+		}
+		normalized[d] = p
+	}
+	return normalized, nil
+}
+
+// policyOf returns the expiration policy of the partial messages of tenant, which may be empty,
+// sent through top, which is empty for messages restored from a Store.
+func (tun *Tunnel) policyOf(tenant, top string) ExpirationPolicy {
+	p := tun.defaultPolicy
+	if dp, ok := tun.domainPolicies[top]; ok {
+		p = p.override(dp)
+	}
+	if t := tun.tenants[tenant]; t != nil {
+		p = p.override(t.ExpirationPolicy)
+	}
+	return p
+}
+
+// policies returns the expiration policies that partial messages may have.
+func (tun *Tunnel) policies() []ExpirationPolicy {
+	tops := append([]string{""}, tun.topDomains...)
+	tenants := []string{""}
+	for name := range tun.tenants {
+		tenants = append(tenants, name)
+	}
+	var policies []ExpirationPolicy
+	for _, top := range tops {
+		for _, tenant := range tenants {
+			policies = append(policies, tun.policyOf(tenant, top))
+		}
+	}
+	return policies
+}
+
+// sweepSchedule tells the background sweep, which ticks at the shortest deletion interval
+// configured, on which ticks the partial messages of each deletion interval are due to be
+// checked.
+type sweepSchedule struct {
+	tick time.Duration
+	// every holds the number of ticks between the checks of each deletion interval.
+	every map[time.Duration]uint64
+}
+
+// newSweepSchedule returns the schedule of the deletion intervals of policies.
+func newSweepSchedule(policies []ExpirationPolicy) sweepSchedule {
+	s := sweepSchedule{every: make(map[time.Duration]uint64)}
+	for _, p := range policies {
+		if s.tick == 0 || p.DeletionInterval < s.tick {
+			s.tick = p.DeletionInterval
+		}
+	}
+	for _, p := range policies {
+		// Intervals that aren't multiples of the tick are rounded to the nearest one.
+		s.every[p.DeletionInterval] = max(1, uint64((p.DeletionInterval+s.tick/2)/s.tick))
+	}
+	return s
+}
+
+// due returns the deletion intervals due to be checked on tick n, the first of which is 1.
+func (s sweepSchedule) due(n uint64) map[time.Duration]bool {
+	due := make(map[time.Duration]bool, len(s.every))
+	for interval, every := range s.every {
+		if n%every == 0 {
+			due[interval] = true
+		}
+	}
+	return due
+}
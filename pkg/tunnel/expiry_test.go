@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainExpirations(t *testing.T) {
+	_, err := New(Config{TopDomain: "t1.example.com.", DomainExpirations: map[string]ExpirationPolicy{"t2.example.com": {Expiration: time.Second}}})
+	require.NotNil(t, err)
+	_, err = New(Config{TopDomain: "t1.example.com.", DomainExpirations: map[string]ExpirationPolicy{"t1.example.com": {Expiration: -time.Second}}})
+	require.NotNil(t, err)
+
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tun := newTestTunnel(t, Config{
+		TopDomains:        []string{"t1.example.com.", "t2.example.com."},
+		DomainExpirations: map[string]ExpirationPolicy{"T2.example.com": {Expiration: 10 * time.Second, DeletionInterval: time.Second}},
+		Clock:             clock,
+	})
+	defer tun.Close()
+	require.Eventually(t, func() bool { return clock.Tickers() == 1 }, time.Second, time.Millisecond)
+
+	tun.domains <- query{name: "aaaaaa.24.0.nbswy3dpeb3w.t1.example.com."}
+	tun.domains <- query{name: "bbbbbb.24.0.nbswy3dpeb3w.t2.example.com."}
+	tun.Flush()
+
+	// The background sweep ticks every second, but only checks the messages sent through t1 every
+	// DefaultDeletionInterval.
+	clock.Advance(11 * time.Second)
+	require.Equal(t, "bbbbbb", (<-tun.Expired()).ID)
+	partials := tun.Partials()
+	require.Len(t, partials, 1)
+	require.Equal(t, "aaaaaa", partials[0].ID)
+
+	clock.Advance(DefaultExpiration)
+	tun.Sweep()
+	require.Equal(t, "aaaaaa", (<-tun.Expired()).ID)
+}
+
+func TestTenantExpirations(t *testing.T) {
+	_, err := New(Config{TopDomain: "tunnel.example.com.", Tenants: []Tenant{{Name: "alpha", ExpirationPolicy: ExpirationPolicy{DeletionInterval: -time.Second}}}})
+	require.NotNil(t, err)
+
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tun := newTestTunnel(t, Config{
+		TopDomain:         "tunnel.example.com.",
+		DomainExpirations: map[string]ExpirationPolicy{"tunnel.example.com": {Expiration: 10 * time.Second}},
+		Tenants:           []Tenant{{Name: "alpha", ExpirationPolicy: ExpirationPolicy{Expiration: 5 * time.Minute}}, {Name: "beta"}},
+		Clock:             clock,
+	})
+	defer tun.Close()
+	require.Equal(t, 50*time.Minute, tun.maxExpiration)
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.alpha.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.beta.tunnel.example.com."}
+	tun.Flush()
+	expiresAt := map[string]time.Time{}
+	for _, p := range tun.Partials() {
+		expiresAt[p.Tenant] = p.ExpiresAt
+	}
+	require.Equal(t, map[string]time.Time{"alpha": clock.Now().Add(5 * time.Minute), "beta": clock.Now().Add(10 * time.Second)}, expiresAt)
+}
+
+func TestSweepSchedule(t *testing.T) {
+	s := newSweepSchedule([]ExpirationPolicy{{DeletionInterval: 5 * time.Second}, {DeletionInterval: time.Second}, {DeletionInterval: 2500 * time.Millisecond}, {DeletionInterval: 5 * time.Second}})
+	require.Equal(t, time.Second, s.tick)
+	require.Equal(t, map[time.Duration]uint64{time.Second: 1, 2500 * time.Millisecond: 3, 5 * time.Second: 5}, s.every)
+	require.Equal(t, map[time.Duration]bool{time.Second: true}, s.due(1))
+	require.Equal(t, map[time.Duration]bool{time.Second: true, 2500 * time.Millisecond: true}, s.due(3))
+	require.Equal(t, map[time.Duration]bool{time.Second: true, 2500 * time.Millisecond: true, 5 * time.Second: true}, s.due(15))
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// A recentQueries remembers the names of the fragment queries admitted within a window. Stub
+// resolvers and browsers often send a query to several recursive resolvers at once, and
+// resolvers retry queries from other addresses of their pool, so a single query of a client
+// arrives several times from different sources. Repeats are recognized by the name alone, in
+// lower case, since some resolvers randomize its case and clients often ask for the A and AAAA
+// records of a name together.
+type recentQueries struct {
+	mu     sync.Mutex
+	window time.Duration
+	names  map[string]time.Time
+}
+
+func newRecentQueries(window time.Duration) *recentQueries {
+	return &recentQueries{window: window, names: make(map[string]time.Time)}
+}
+
+// seen reports whether name was added within the window.
+func (r *recentQueries) seen(name string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	until, ok := r.names[name]
+	return ok && now.Before(until)
+}
+
+// add remembers name for the window.
+func (r *recentQueries) add(name string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.names[name] = now.Add(r.window)
+}
+
+// prune forgets the names added before the window.
+func (r *recentQueries) prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, until := range r.names {
+		if !now.Before(until) {
+			delete(r.names, name)
+		}
+	}
+}
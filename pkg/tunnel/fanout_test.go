@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// resolverResponseWriter is a testResponseWriter for queries from the resolver at addr.
+type resolverResponseWriter struct {
+	testResponseWriter
+	addr string
+}
+
+func (w *resolverResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(w.addr), Port: 5353}
+}
+
+func TestRecentQueries(t *testing.T) {
+	r := newRecentQueries(time.Second)
+	now := time.Now()
+
+	require.False(t, r.seen("a.example.com.", now))
+	r.add("a.example.com.", now)
+	require.True(t, r.seen("a.example.com.", now.Add(500*time.Millisecond)))
+	require.False(t, r.seen("a.example.com.", now.Add(time.Second)))
+	require.False(t, r.seen("b.example.com.", now))
+
+	r.prune(now.Add(500 * time.Millisecond))
+	require.Len(t, r.names, 1)
+	r.prune(now.Add(time.Second))
+	require.Empty(t, r.names)
+}
+
+func TestFanout(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", RateLimit: 0.001, RateBurst: 1})
+	defer tun.Close()
+
+	rcode := func(resolver, domain string, qtype uint16) int {
+		req := &dns.Msg{}
+		req.SetQuestion(domain, qtype)
+		w := &resolverResponseWriter{addr: resolver}
+		tun.ServeDNS(w, req)
+		return w.msg.Rcode
+	}
+	first := "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."
+	last := "2jkhm3.24.12.64tmmq000000.tunnel.example.com."
+	require.Equal(t, dns.RcodeSuccess, rcode("192.0.2.1", first, dns.TypeA))
+	// Repeats of the query, in any case and query type and from any resolver, aren't charged to
+	// the rate limit.
+	require.Equal(t, dns.RcodeSuccess, rcode("192.0.2.1", first, dns.TypeAAAA))
+	require.Equal(t, dns.RcodeSuccess, rcode("192.0.2.2", "2JKhm3.24.0.nbSWY3dpeb3w.tunnel.example.com.", dns.TypeA))
+	require.Equal(t, dns.RcodeRefused, rcode("192.0.2.1", last, dns.TypeA))
+	require.Equal(t, dns.RcodeSuccess, rcode("192.0.2.3", last, dns.TypeA))
+
+	msg := <-tun.Messages()
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, 2, msg.Fragments)
+
+	// A repeat arriving once the message was delivered doesn't start it again.
+	require.Equal(t, dns.RcodeSuccess, rcode("192.0.2.4", last, dns.TypeA))
+	require.Eventually(t, func() bool { return tun.Stats().FanoutDuplicates == 3 && len(tun.domains) == 0 }, time.Second, time.Millisecond)
+	tun.Close()
+	_, ok := <-tun.Messages()
+	require.False(t, ok)
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(2), stats.Fragments)
+	require.Equal(t, 0, stats.InFlight)
+	require.Equal(t, uint64(1), stats.RateLimited)
+	clients := tun.ClientStats()
+	require.Equal(t, uint64(1), clients["192.0.2.1"].Fragments)
+	require.Equal(t, uint64(0), clients["192.0.2.2"].Fragments)
+	require.Equal(t, uint64(1), clients["192.0.2.3"].Fragments)
+	require.Equal(t, uint64(0), clients["192.0.2.4"].Fragments)
+}
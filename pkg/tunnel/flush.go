@@ -0,0 +1,46 @@
+package tunnel
+
+import "sync"
+
+// A flushBarrier stops the workers that receive it until every worker has.
+type flushBarrier struct {
+	reached sync.WaitGroup
+	release chan struct{}
+}
+
+// wait marks that a worker reached b, and stops it until b is released or the tunnel is closed.
+func (b *flushBarrier) wait(cancel <-chan struct{}) {
+	b.reached.Done()
+	select {
+	case <-b.release:
+	case <-cancel:
+	}
+}
+
+// Flush waits until the queries that ServeDNS received before Flush was called are processed, so
+// that the messages they completed can be read from Messages. It is meant for tunnels fed from
+// captures or files rather than resolvers, which can't tell otherwise when their last fragments
+// were reassembled. Flush returns early if the tunnel is closed.
+func (tun *Tunnel) Flush() {
+	b := &flushBarrier{release: make(chan struct{})}
+	defer close(b.release)
+	// Every worker receives a barrier after the queries queued before them, and is stopped there,
+	// so that the next barrier is received by another.
+	b.reached.Add(tun.workers)
+	for i := 0; i < tun.workers; i++ {
+		select {
+		case tun.domains <- query{flush: b}:
+		case <-tun.ctx.Done():
+			return
+		}
+	}
+	reached := make(chan struct{})
+	go func() {
+		b.reached.Wait()
+		close(reached)
+	}()
+	select {
+	case <-reached:
+	case <-tun.ctx.Done():
+	}
+}
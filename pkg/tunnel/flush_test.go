@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlush(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Workers: 4})
+	defer tun.Close()
+
+	// AAAA queries aren't acknowledged, so ServeDNS returns before they are processed.
+	for _, domain := range []string{
+		"2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com.",
+		"2jkhm3.24.12.64tmmq000000.tunnel.example.com.",
+		"abcdef.24.0.nbswy3dpeb3w.tunnel.example.com.",
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion(domain, dns.TypeAAAA)
+		tun.ServeDNS(&testResponseWriter{}, req)
+	}
+	tun.Flush()
+	require.Len(t, tun.Messages(), 1)
+	require.Equal(t, 1, tun.Stats().InFlight)
+
+	// The workers are released afterwards.
+	tun.Flush()
+	tun.Close()
+	tun.Flush()
+}
@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Versions of the framing of fragments. Fragments of version 1 start with the message ID.
+// Fragments of later versions start with a label of the form v<version>-<flags>, e.g. v2-05,
+// followed by the session label if FlagSession is set, the sequence number if FlagSequence is set,
+// the auth token if FlagToken is set, the encoding if FlagEncoding is set, the key ID if FlagKey is
+// set, the expiration if FlagExpiration is set, and by the fields of version 1. The JavaScript
+// client's message IDs never contain a hyphen, so the two can be told apart by the first label
+// alone.
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+// Flags describe how a message sent with version 2 framing was encoded. They are carried by every
+// fragment of the message in its version label, as two hexadecimal digits, or four if any flag
+// beyond the first eight is set.
+type Flags uint16
+
+const (
+	// FlagCompressed marks a message that was gzipped.
+	FlagCompressed Flags = 1 << iota
+	// FlagEncrypted marks a message that was encrypted with AES-GCM.
+	FlagEncrypted
+	// FlagBinary marks a message of binary data rather than text.
+	FlagBinary
+	// FlagAck requests that each fragment be answered with an acknowledgement, as if the tunnel
+	// was configured with Acks.
+	FlagAck
+	// FlagSession marks a message sent within a session, whose label follows the version label.
+	FlagSession
+	// FlagSequence marks a message numbered within its session, whose sequence number follows the
+	// session label. It requires FlagSession.
+	FlagSequence
+	// FlagToken marks a fragment carrying an auth token, as required by Config.AuthTokens and
+	// Config.AuthTokenKey, which follows the labels of the other flags.
+	FlagToken
+	// FlagEncoding marks a fragment whose data labels are encoded with the Encoding named in a
+	// label after the auth token, rather than with the encoding configured for its top domain.
+	FlagEncoding
+	// FlagKey marks a fragment of a message encrypted with one of the named keys of
+	// Config.DecryptKeys, whose ID follows the encoding label. It requires FlagEncrypted.
+	FlagKey
+	// FlagExpiration marks a message that the client asked to be held for the number of seconds in
+	// a label after the key ID since its last fragment, rather than for Config.Expiration, e.g. a
+	// long upload over slow resolvers. The tunnel holds it for Config.MaxExpiration at most.
+	FlagExpiration
+	// FlagParity marks a message whose fragments are followed by parity fragments, as sent by
+	// Encoder.Parity, from which the tunnel rebuilds a fragment missing from each group. Parity
+	// fragments are placed after the end of the message, as described in parity.go.
+	FlagParity
+
+	// knownFlags are the flags understood by this version of the tunnel.
+	knownFlags = FlagCompressed | FlagEncrypted | FlagBinary | FlagAck | FlagSession | FlagSequence | FlagToken | FlagEncoding | FlagKey | FlagExpiration | FlagParity
+)
+
+// A framing is the protocol version and flags of a fragment. The zero value is the framing of
+// fragments without a version label, i.e. Version1.
+type framing struct {
+	version int
+	flags   Flags
+	// session is the session label of fragments framed with FlagSession.
+	session string
+	// seq is the sequence number of fragments framed with FlagSequence.
+	seq int
+	// token is the auth token of fragments framed with FlagToken. It is only kept until the
+	// fragment is accepted.
+	token string
+	// encoding is the encoding of the data labels, as named by fragments framed with FlagEncoding
+	// or configured for their top domain. It is empty for EncodingBase32.
+	encoding Encoding
+	// keyID names the decryption key of fragments framed with FlagKey.
+	keyID string
+	// expiration is the number of seconds that the message of fragments framed with
+	// FlagExpiration is held for.
+	expiration int
+}
+
+// prefix returns the labels starting fragments framed as f, followed by a dot, or an empty string
+// for version 1.
+func (f framing) prefix() string {
+	if f.version < Version2 {
+		return ""
+	}
+	prefix := fmt.Sprintf("v%d-%02x.", f.version, uint16(f.flags))
+	if f.flags > 0xff {
+		prefix = fmt.Sprintf("v%d-%04x.", f.version, uint16(f.flags))
+	}
+	if f.flags&FlagSession != 0 {
+		prefix += f.session + "."
+	}
+	if f.flags&FlagSequence != 0 {
+		prefix += strconv.Itoa(f.seq) + "."
+	}
+	if f.flags&FlagToken != 0 {
+		prefix += f.token + "."
+	}
+	if f.flags&FlagEncoding != 0 {
+		prefix += string(f.encoding) + "."
+	}
+	if f.flags&FlagKey != 0 {
+		prefix += f.keyID + "."
+	}
+	if f.flags&FlagExpiration != 0 {
+		prefix += strconv.Itoa(f.expiration) + "."
+	}
+	return prefix
+}
+
+// parseVersionLabel parses the first label of a fragment. It returns false if the label isn't a
+// version label, in which case the fragment is framed as version 1, and an error if it is one
+// that this version of the tunnel doesn't understand.
+func parseVersionLabel(label string) (framing, bool, error) {
+	version, flags, ok := strings.Cut(label, "-")
+	if !ok || len(version) < 2 || version[0] != 'v' || (len(flags) != 2 && len(flags) != 4) {
+		return framing{}, false, nil
+	}
+	v, err := strconv.Atoi(version[1:])
+	if err != nil || strconv.Itoa(v) != version[1:] {
+		return framing{}, false, nil
+	}
+	bits, err := strconv.ParseUint(flags, 16, 16)
+	if err != nil {
+		return framing{}, false, nil
+	}
+	if v != Version2 {
+		return framing{}, true, parseErrorf(reasonVersion, "Unsupported protocol version %d", v)
+	}
+	if unknown := Flags(bits) &^ knownFlags; unknown != 0 {
+		return framing{}, true, parseErrorf(reasonVersion, "Unknown flags %02x", uint16(unknown))
+	}
+	if Flags(bits)&FlagSequence != 0 && Flags(bits)&FlagSession == 0 {
+		return framing{}, true, parseErrorf(reasonVersion, "Sequence numbers require a session")
+	}
+	if Flags(bits)&FlagKey != 0 && Flags(bits)&FlagEncrypted == 0 {
+		return framing{}, true, parseErrorf(reasonVersion, "Key IDs require encryption")
+	}
+	return framing{version: v, flags: Flags(bits)}, true, nil
+}
+
+// requestsAck reports whether the fragment encoded in domain is framed with FlagAck. It only looks
+// at the first label, so that queries can be answered with acknowledgements before they are
+// parsed.
+func requestsAck(domain string) bool {
+	label, _, _ := strings.Cut(domain, ".")
+	f, ok, err := parseVersionLabel(label)
+	return ok && err == nil && f.flags&FlagAck != 0
+}
+
+func (f framing) String() string {
+	if f.version < Version2 {
+		return "v1"
+	}
+	return strings.TrimSuffix(f.prefix(), ".")
+}
@@ -0,0 +1,185 @@
+package tunnel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersionLabel(t *testing.T) {
+	tests := []struct {
+		label     string
+		output    framing
+		isVersion bool
+		reason    string
+	}{
+		{label: "2jkhm3"},
+		{label: "v2"},
+		{label: "v2-abc"},
+		{label: "v02-00"},
+		{label: "va-00"},
+		{label: "v2-zz"},
+		{label: "v2-00", output: framing{version: Version2}, isVersion: true},
+		{label: "v2-0f", output: framing{version: Version2, flags: FlagCompressed | FlagEncrypted | FlagBinary | FlagAck}, isVersion: true},
+		{label: "v2-10", output: framing{version: Version2, flags: FlagSession}, isVersion: true},
+		{label: "v2-30", output: framing{version: Version2, flags: FlagSession | FlagSequence}, isVersion: true},
+		{label: "v2-40", output: framing{version: Version2, flags: FlagToken}, isVersion: true},
+		{label: "v2-20", isVersion: true, reason: reasonVersion},
+		{label: "v2-80", output: framing{version: Version2, flags: FlagEncoding}, isVersion: true},
+		{label: "v2-0102", output: framing{version: Version2, flags: FlagEncrypted | FlagKey}, isVersion: true},
+		{label: "v2-0100", isVersion: true, reason: reasonVersion},
+		{label: "v2-0200", output: framing{version: Version2, flags: FlagExpiration}, isVersion: true},
+		{label: "v2-0400", output: framing{version: Version2, flags: FlagParity}, isVersion: true},
+		{label: "v2-0800", isVersion: true, reason: reasonVersion},
+		{label: "v2-002"},
+		{label: "v3-00", isVersion: true, reason: reasonVersion},
+	}
+	for _, test := range tests {
+		got, isVersion, err := parseVersionLabel(test.label)
+		require.Equal(t, test.isVersion, isVersion, test.label)
+		if test.reason != "" {
+			require.NotNil(t, err, test.label)
+			require.Equal(t, test.reason, parseErrorReason(err), test.label)
+			continue
+		}
+		require.Nil(t, err, test.label)
+		require.Equal(t, test.output, got, test.label)
+	}
+}
+
+func TestEncoderVersion2(t *testing.T) {
+	domains, err := Encoder{LabelLen: 63, Version: Version2}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, []string{"v2-00.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}, domains)
+
+	domains, err = Encoder{LabelLen: 63, Version: Version2, Binary: true, Ack: true}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, []string{"v2-0c.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}, domains)
+
+	domains, err = Encoder{LabelLen: 63, Version: Version2, Session: "tab1"}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, []string{"v2-10.tab1.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}, domains)
+
+	domains, err = Encoder{LabelLen: 63, Version: Version2, Session: "tab1", Sequence: 7}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, []string{"v2-30.tab1.7.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}, domains)
+
+	domains, err = Encoder{LabelLen: 63, Version: Version2, Session: "tab1", AuthToken: "k3y"}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, []string{"v2-50.tab1.k3y.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}, domains)
+
+	domains, err = Encoder{LabelLen: 63, Version: Version2, AuthToken: "k3y", Encoding: EncodingHex}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, []string{"v2-c0.k3y.hex.2jkhm3.22.0.68656c6c6f20776f726c64.tunnel.example.com."}, domains)
+
+	domains, err = Encoder{LabelLen: 63, Version: Version2, Session: "tab1", Expiration: 1500 * time.Millisecond}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	require.Equal(t, []string{"v2-0210.tab1.2.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}, domains)
+	fg, err := parseDomain("tunnel.example.com.", domains[0], parseRules{maxMessageSize: 5000})
+	require.Nil(t, err)
+	require.Equal(t, framing{version: Version2, flags: FlagSession | FlagExpiration, session: "tab1", expiration: 2}, fg.framing)
+	_, err = parseDomain("tunnel.example.com.", "v2-0200.0.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", parseRules{maxMessageSize: 5000})
+	require.NotNil(t, err)
+
+	_, err = Encoder{LabelLen: 63, Expiration: time.Minute}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, Ack: true}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, Session: "tab1"}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, Version: Version2, Session: "tab.1"}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, Version: Version2, Sequence: 1}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, Version: Version2, Session: "tab1", Sequence: -1}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, AuthToken: "k3y"}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, Version: Version2, AuthToken: "k3y", AuthTokenKey: []byte("secret")}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, Version: 3}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.NotNil(t, err)
+
+	domains, err = Encoder{LabelLen: 63, Version: Version2, Checksum: true}.Encode("tunnel.example.com.", "i42ftq", strings.Repeat("x", 2000))
+	require.Nil(t, err)
+	for _, domain := range domains {
+		require.True(t, len(domain)-1 <= maxNameLen, "domain %s is too long", domain)
+		fg, err := parseDomain("tunnel.example.com.", domain, parseRules{maxMessageSize: 5000, strict: true})
+		require.Nil(t, err)
+		require.Equal(t, framing{version: Version2}, fg.framing)
+	}
+}
+
+func TestVersion2RoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	plain := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer plain.Close()
+	encrypted := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", DecryptKey: key})
+	defer encrypted.Close()
+
+	// Without flags, payloads that look like gzip streams or binary markers are left alone.
+	lookalike := string([]byte{0xff, 0x1f, 0x8b, 'h', 'i'})
+	tests := []struct {
+		tun *Tunnel
+		enc Encoder
+		msg string
+	}{
+		{tun: plain, enc: Encoder{LabelLen: 63, Version: Version2}, msg: "hello world"},
+		{tun: plain, enc: Encoder{LabelLen: 63, Version: Version2}, msg: lookalike},
+		{tun: plain, enc: Encoder{LabelLen: 63, Version: Version2, Binary: true}, msg: lookalike},
+		{tun: plain, enc: Encoder{LabelLen: 63, Version: Version2, Compress: true}, msg: strings.Repeat("hello ", 50)},
+		{tun: encrypted, enc: Encoder{LabelLen: 63, Version: Version2, Compress: true, Binary: true, EncryptKey: key}, msg: lookalike},
+	}
+	for _, test := range tests {
+		domains, err := test.enc.Encode("tunnel.example.com.", "2jkhm3", test.msg)
+		require.Nil(t, err)
+		for _, domain := range domains {
+			test.tun.domains <- query{name: domain}
+		}
+		msg := <-test.tun.Messages()
+		require.Equal(t, []byte(test.msg), msg.Payload)
+		require.Equal(t, test.enc.Binary, msg.Binary)
+	}
+
+	// Messages must be encrypted exactly when the tunnel decrypts them.
+	domains, err := Encoder{LabelLen: 63, Version: Version2}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	encrypted.domains <- query{name: domains[0]}
+	domains, err = Encoder{LabelLen: 63, Version: Version2, EncryptKey: key}.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+	require.Nil(t, err)
+	plain.domains <- query{name: domains[0]}
+	plain.domains <- query{name: "abcdef.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}
+	domains, err = Encoder{LabelLen: 63, Version: Version2, EncryptKey: key}.Encode("tunnel.example.com.", "abcdef", "hello world")
+	require.Nil(t, err)
+	encrypted.domains <- query{name: domains[0]}
+	require.Equal(t, "abcdef", (<-plain.Messages()).ID)
+	require.Equal(t, "abcdef", (<-encrypted.Messages()).ID)
+	require.Equal(t, uint64(1), plain.Stats().Undecryptable)
+	require.Equal(t, uint64(1), encrypted.Stats().Undecryptable)
+}
+
+func TestVersion2Ack(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	ack := ackServer(t, tun, "v2-08.2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com.", dns.TypeA)
+	require.Equal(t, Ack{Received: 12, Total: 24}, ack)
+
+	// Fragments of one message must agree on their framing.
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com."}
+	ack = ackServer(t, tun, "v2-08.2jkhm3.24.12.64tmmq000000.tunnel.example.com.", dns.TypeTXT)
+	require.True(t, ack.Complete())
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+	require.Equal(t, uint64(1), tun.Stats().ParseErrorReasons[reasonVersion])
+
+	// Without the flag, fragments are answered as usual.
+	req := &dns.Msg{}
+	req.SetQuestion("v2-00.abcdef.24.0.nbswy3dpeb3w.tunnel.example.com.", dns.TypeA)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+	require.IsType(t, &dns.CNAME{}, w.msg.Answer[0])
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Clients prove that they are alive by querying domains of the form
+//
+//	hb-<nonce>.<clientID>.<topDomain>
+//
+// with any type that can carry fragments. Like in polls, the nonce is chosen randomly so that
+// resolvers never answer a heartbeat from their cache. Heartbeats are answered like fragments, and
+// polls count as heartbeats too.
+const heartbeatPrefix = "hb-"
+
+// livenessIdle is how long the liveness of a client is kept after its last heartbeat.
+const livenessIdle = time.Hour
+
+// Liveness describes the heartbeats of a single client ID.
+type Liveness struct {
+	// Tenant is the name of the tenant the latest heartbeat was sent to, if tenants are configured.
+	Tenant string
+	// Source is the IP address that the latest heartbeat was received from.
+	Source net.IP
+	// LastSeen is when the latest heartbeat or poll was received.
+	LastSeen time.Time
+	// Heartbeats and Polls count the heartbeats and polls received from the client.
+	Heartbeats uint64
+	Polls      uint64
+}
+
+// A livenessTracker holds the liveness of the clients that sent heartbeats recently, keyed by
+// client ID.
+type livenessTracker struct {
+	mu      sync.Mutex
+	clients map[string]*Liveness
+}
+
+func newLivenessTracker() *livenessTracker {
+	return &livenessTracker{clients: make(map[string]*Liveness)}
+}
+
+// seen records a heartbeat, or a poll if poll is true, of clientID.
+func (lt *livenessTracker) seen(clientID, tenant string, source net.IP, poll bool, now time.Time) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	l, ok := lt.clients[clientID]
+	if !ok {
+		l = &Liveness{}
+		lt.clients[clientID] = l
+	}
+	l.Tenant = tenant
+	l.Source = source
+	l.LastSeen = now
+	if poll {
+		l.Polls++
+	} else {
+		l.Heartbeats++
+	}
+}
+
+// prune forgets the clients that haven't sent a heartbeat for livenessIdle.
+func (lt *livenessTracker) prune(now time.Time) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	for id, l := range lt.clients {
+		if now.Sub(l.LastSeen) > livenessIdle {
+			delete(lt.clients, id)
+		}
+	}
+}
+
+// heartbeat records a heartbeat, or a poll if poll is true, of clientID received from source.
+func (tun *Tunnel) heartbeat(clientID string, tenant *tenantState, source net.Addr, poll bool, now time.Time) {
+	var tenantName string
+	if tenant != nil {
+		tenantName = tenant.Name
+	}
+	tun.liveness.seen(clientID, tenantName, sourceIP(source), poll, now)
+}
+
+// Liveness returns a snapshot of the liveness of each client ID that sent a heartbeat or polled
+// the tunnel in the last hour. Client IDs are in lower case.
+func (tun *Tunnel) Liveness() map[string]Liveness {
+	tun.liveness.mu.Lock()
+	defer tun.liveness.mu.Unlock()
+
+	clients := make(map[string]Liveness, len(tun.liveness.clients))
+	for id, l := range tun.liveness.clients {
+		clients[id] = *l
+	}
+	return clients
+}
+
+// EncodeHeartbeat returns the domain a client identified by clientID queries to send a heartbeat.
+func EncodeHeartbeat(topDomain, clientID, nonce string) string {
+	return fmt.Sprintf("%s%s.%s.%s", heartbeatPrefix, nonce, clientID, dns.Fqdn(topDomain))
+}
+
+// parseHeartbeat parses a heartbeat domain, returning the client ID. It returns false if domain
+// is not a heartbeat.
+func parseHeartbeat(topDomain string, domain string) (string, bool, error) {
+	under, ok := underDomain(domain, topDomain)
+	if !ok || !strings.HasPrefix(under, heartbeatPrefix) {
+		return "", false, nil
+	}
+	labels := strings.Split(under, ".")
+	if len(labels) != 2 {
+		return "", true, fmt.Errorf("Heartbeat has %d labels but expected 2", len(labels))
+	}
+	return labels[1], true, nil
+}
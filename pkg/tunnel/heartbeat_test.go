@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHeartbeat(t *testing.T) {
+	tests := []struct {
+		domain      string
+		isHeartbeat bool
+		fails       bool
+		clientID    string
+	}{
+		{domain: "hb-x7f2.c1.tunnel.example.com.", isHeartbeat: true, clientID: "c1"},
+		{domain: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", isHeartbeat: false},
+		{domain: "poll-x7f2.c1.3.180.tunnel.example.com.", isHeartbeat: false},
+		{domain: "hb-x7f2.tunnel.example.com.", isHeartbeat: true, fails: true},
+		{domain: "hb-x7f2.c1.extra.tunnel.example.com.", isHeartbeat: true, fails: true},
+	}
+	for _, test := range tests {
+		got, isHeartbeat, err := parseHeartbeat("tunnel.example.com.", test.domain)
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+		}
+		require.Equal(t, test.isHeartbeat, isHeartbeat)
+		require.Equal(t, test.clientID, got)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com"})
+	defer tun.Close()
+
+	for _, name := range []string{
+		EncodeHeartbeat("tunnel.example.com", "c1", "n0nce"),
+		"Hb-N0nCe.C1.tUnNeL.eXaMpLe.CoM.",
+		EncodePoll("tunnel.example.com", "c2", "n0nce", 0, 0),
+		"hb-n0nce.tunnel.example.com.",
+	} {
+		r := &dns.Msg{}
+		r.SetQuestion(name, dns.TypeA)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, r)
+		require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+	}
+
+	live := tun.Liveness()
+	require.Len(t, live, 2)
+	require.EqualValues(t, 2, live["c1"].Heartbeats)
+	require.EqualValues(t, 0, live["c1"].Polls)
+	require.Equal(t, "192.0.2.1", live["c1"].Source.String())
+	require.WithinDuration(t, time.Now(), live["c1"].LastSeen, time.Second)
+	require.EqualValues(t, 1, live["c2"].Polls)
+	require.EqualValues(t, 2, tun.Stats().Heartbeats)
+	// Heartbeats aren't fragments.
+	require.Zero(t, tun.Stats().ParseErrors)
+
+	var lastSeen []string
+	for _, m := range tun.Collect() {
+		if m.Name == "browsertunnel_client_last_seen_timestamp_seconds" {
+			lastSeen = append(lastSeen, m.Labels["client_id"])
+		}
+	}
+	require.Equal(t, []string{"c1", "c2"}, lastSeen)
+
+	// Clients are forgotten once they haven't sent a heartbeat for a while.
+	tun.liveness.prune(time.Now().Add(livenessIdle / 2))
+	require.Len(t, tun.Liveness(), 2)
+	tun.liveness.prune(time.Now().Add(2 * livenessIdle))
+	require.Empty(t, tun.Liveness())
+}
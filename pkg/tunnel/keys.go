@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// A namedKey is one of the named decryption keys of a tunnel.
+type namedKey struct {
+	aead cipher.AEAD
+	// messages counts the messages decrypted with the key. It is carried over when the keys are
+	// replaced by ones with the same ID.
+	messages *atomic.Uint64
+}
+
+// A keyring holds the named decryption keys of a tunnel by ID. It is replaced as a whole by
+// SetDecryptKeys, and never modified in place.
+type keyring map[string]namedKey
+
+// newKeyring validates keys, whose IDs are matched case-insensitively like the rest of the
+// domain. The counters of the keys of prev with the same IDs are kept.
+func newKeyring(keys map[string][]byte, prev keyring) (keyring, error) {
+	ring := make(keyring, len(keys))
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ".") || len(id) > maxLabelLen {
+			return nil, fmt.Errorf("Key ID %q must be a single label", id)
+		}
+		id = strings.ToLower(id)
+		if _, ok := ring[id]; ok {
+			return nil, fmt.Errorf("Key ID %s is configured twice", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %s: %w", id, err)
+		}
+		k := namedKey{aead: aead, messages: new(atomic.Uint64)}
+		if old, ok := prev[id]; ok {
+			k.messages = old.messages
+		}
+		ring[id] = k
+	}
+	return ring, nil
+}
+
+// SetDecryptKeys replaces the named decryption keys of a running tunnel, as configured by
+// Config.DecryptKeys, e.g. to add a key for new clients or to retire one that has been rotated
+// out. Messages are decrypted with the keys current when they are complete, so partial messages
+// are unaffected unless their key is removed. If keys are invalid, an error is returned and the
+// current keys are kept.
+func (tun *Tunnel) SetDecryptKeys(keys map[string][]byte) error {
+	ring, err := newKeyring(keys, *tun.keys.Load())
+	if err != nil {
+		return err
+	}
+	tun.keys.Store(&ring)
+	return nil
+}
+
+// DecryptKeyIDs returns the IDs of the named decryption keys, in order.
+func (tun *Tunnel) DecryptKeyIDs() []string {
+	ring := *tun.keys.Load()
+	ids := make([]string, 0, len(ring))
+	for id := range ring {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// keyMessages returns the number of messages decrypted with each named key.
+func (tun *Tunnel) keyMessages() map[string]uint64 {
+	ring := *tun.keys.Load()
+	counts := make(map[string]uint64, len(ring))
+	for id, k := range ring {
+		counts[id] = k.messages.Load()
+	}
+	return counts
+}
+
+// ParseKeys reads named decryption keys, one per line as an ID followed by the hex encoded key,
+// from r. Blank lines and lines starting with # are ignored.
+func ParseKeys(r io.Reader) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Line %d has %d fields but expected an ID and a key", n, len(fields))
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Key %s on line %d is not hex encoded: %w", fields[0], n, err)
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, fmt.Errorf("Key ID %s on line %d is configured twice", fields[0], n)
+		}
+		keys[fields[0]] = key
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys(strings.NewReader("# campaign keys\nalpha 4242424242424242424242424242424242424242424242424242424242424242\n\n  beta 00112233445566778899aabbccddeeff\n"))
+	require.Nil(t, err)
+	require.Equal(t, map[string][]byte{
+		"alpha": bytes.Repeat([]byte{0x42}, 32),
+		"beta":  {0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	}, keys)
+
+	for _, s := range []string{"alpha", "alpha 42 43", "alpha xyz", "alpha 42\nalpha 43"} {
+		_, err := ParseKeys(strings.NewReader(s))
+		require.NotNil(t, err, s)
+	}
+}
+
+func TestNamedKeys(t *testing.T) {
+	alpha := bytes.Repeat([]byte{0x42}, 32)
+	beta := bytes.Repeat([]byte{0x43}, 16)
+	def := bytes.Repeat([]byte{0x44}, 32)
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", DecryptKey: def, DecryptKeys: map[string][]byte{"Alpha": alpha}})
+	defer tun.Close()
+	require.Equal(t, []string{"alpha"}, tun.DecryptKeyIDs())
+
+	send := func(id string, enc Encoder) {
+		domains, err := enc.Encode("tunnel.example.com.", id, "hello world")
+		require.Nil(t, err)
+		for _, domain := range domains {
+			tun.domains <- query{name: domain}
+		}
+		tun.Flush()
+	}
+	received := func() bool {
+		select {
+		case msg := <-tun.Messages():
+			require.Equal(t, []byte("hello world"), msg.Payload)
+			return true
+		default:
+			return false
+		}
+	}
+
+	send("x7f2aa", Encoder{LabelLen: 63, Version: Version2, EncryptKey: alpha, KeyID: "alpha"})
+	require.True(t, received())
+	send("x7f2ab", Encoder{LabelLen: 63, Version: Version2, EncryptKey: def})
+	require.True(t, received())
+	send("x7f2ac", Encoder{LabelLen: 63, Version: Version2, EncryptKey: beta, KeyID: "beta"})
+	require.False(t, received())
+	require.Equal(t, uint64(1), tun.Stats().Undecryptable)
+
+	// Rotating the keys keeps the counters of the keys that remain.
+	require.Nil(t, tun.SetDecryptKeys(map[string][]byte{"alpha": alpha, "beta": beta}))
+	send("x7f2ad", Encoder{LabelLen: 63, Version: Version2, EncryptKey: beta, KeyID: "beta"})
+	require.True(t, received())
+	require.Equal(t, map[string]uint64{"alpha": 1, "beta": 1}, tun.Stats().KeyMessages)
+
+	require.NotNil(t, tun.SetDecryptKeys(map[string][]byte{"gamma": []byte("not a valid key")}))
+	require.Equal(t, []string{"alpha", "beta"}, tun.DecryptKeyIDs())
+
+	require.Nil(t, tun.SetDecryptKeys(map[string][]byte{"beta": beta}))
+	send("x7f2ae", Encoder{LabelLen: 63, Version: Version2, EncryptKey: alpha, KeyID: "alpha"})
+	require.False(t, received())
+	require.Equal(t, uint64(2), tun.Stats().Undecryptable)
+
+	for _, keys := range []map[string][]byte{
+		{"a.b": alpha},
+		{"": alpha},
+		{"alpha": alpha, "ALPHA": alpha},
+		{"alpha": []byte("short")},
+	} {
+		_, err := New(Config{TopDomain: "tunnel.example.com.", DecryptKeys: keys})
+		require.NotNil(t, err)
+	}
+
+	_, err := Encoder{LabelLen: 63, Version: Version2, KeyID: "alpha"}.Encode("tunnel.example.com.", "x7f2aa", "hello world")
+	require.NotNil(t, err)
+	_, err = Encoder{LabelLen: 63, EncryptKey: alpha, KeyID: "alpha"}.Encode("tunnel.example.com.", "x7f2aa", "hello world")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Clients that can read answers ask the tunnel what it is missing of a message by querying TXT
+// records of domains of the form
+//
+//	stat-<nonce>.<id>.<totalSize>.<topDomain>
+//
+// where totalSize is the encoded size of the message, which tells colliding messages apart. Like
+// in polls, the nonce is chosen randomly so that resolvers never answer from their cache. Once the
+// message has gone without a new fragment for Config.NackDelay, the answer is a negative
+// acknowledgement: its first string is "nack.<received>.<total>", followed by a
+// "<offset>.<length>" string for each of the first maxNackRanges missing ranges, so that the
+// client only sends the fragments overlapping them again. Until then, its fragments may still be
+// on their way, and the answer is an acknowledgement without ranges, as described on ParseAck. A
+// message the tunnel holds no fragment of is reported as missing entirely, and one delivered
+// within the dedup window as complete: without Config.DedupWindow, the tunnel can't tell messages
+// it delivered from those it never received.
+const (
+	statusPrefix = "stat-"
+	nackPrefix   = "nack."
+)
+
+const (
+	// DefaultNackDelay is how long a partial message goes without a new fragment before status
+	// queries list the ranges missing from it, by default.
+	DefaultNackDelay = 2 * time.Second
+	// maxNackRanges is the maximum number of missing ranges listed in a negative
+	// acknowledgement. It keeps the answer well within the EDNS payload size clients ask for.
+	maxNackRanges = 64
+)
+
+// A statusQuery asks what the tunnel received of the message id of encoded length totalSize.
+type statusQuery struct {
+	id        string
+	totalSize int
+}
+
+// EncodeStatus returns the domain a client queries for the status of message id, of encoded
+// length totalSize.
+func EncodeStatus(topDomain, id string, totalSize int, nonce string) string {
+	return fmt.Sprintf("%s%s.%s.%d.%s", statusPrefix, nonce, id, totalSize, dns.Fqdn(topDomain))
+}
+
+// parseStatus parses a status query. It returns false if domain is not a status query.
+func parseStatus(topDomain string, domain string) (statusQuery, bool, error) {
+	under, ok := underDomain(domain, topDomain)
+	if !ok || !strings.HasPrefix(under, statusPrefix) {
+		return statusQuery{}, false, nil
+	}
+	labels := strings.Split(under, ".")
+	if len(labels) != 3 {
+		return statusQuery{}, true, fmt.Errorf("Status query has %d labels but expected 3", len(labels))
+	}
+	totalSize, err := strconv.Atoi(labels[2])
+	if err != nil || totalSize <= 0 {
+		return statusQuery{}, true, fmt.Errorf("Invalid total size %q in status query", labels[2])
+	}
+	return statusQuery{id: labels[1], totalSize: totalSize}, true, nil
+}
+
+// status answers sq, sent to tenant if tenants are configured.
+func (tun *Tunnel) status(sq statusQuery, tenant *tenantState, now time.Time) Ack {
+	var tenantName string
+	if tenant != nil {
+		tenantName = tenant.Name
+	}
+	key := listKey(tenantName, sq.id)
+	sh := tun.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	key = listFor(sh, key, sq.totalSize)
+	if until, ok := sh.delivered[key]; ok && now.Before(until) {
+		return Ack{Received: sq.totalSize, Total: sq.totalSize}
+	}
+	fgList, ok := sh.lists[key]
+	if !ok {
+		return Ack{Total: sq.totalSize, Missing: []Range{{Offset: 0, Length: sq.totalSize}}, Nack: true}
+	}
+	a := fgList.ack()
+	if now.Sub(fgList.lastSeen) < tun.nackDelay {
+		a.Missing = nil
+		return a
+	}
+	a.Nack = true
+	return a
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		domain   string
+		isStatus bool
+		fails    bool
+		query    statusQuery
+	}{
+		{domain: "stat-x7f2.2jkhm3.24.tunnel.example.com.", isStatus: true, query: statusQuery{id: "2jkhm3", totalSize: 24}},
+		{domain: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", isStatus: false},
+		{domain: "hb-x7f2.c1.tunnel.example.com.", isStatus: false},
+		{domain: "stat-x7f2.2jkhm3.tunnel.example.com.", isStatus: true, fails: true},
+		{domain: "stat-x7f2.2jkhm3.0.tunnel.example.com.", isStatus: true, fails: true},
+		{domain: "stat-x7f2.2jkhm3.24.extra.tunnel.example.com.", isStatus: true, fails: true},
+	}
+	for _, test := range tests {
+		got, isStatus, err := parseStatus("tunnel.example.com.", test.domain)
+		if test.fails {
+			require.NotNil(t, err, test.domain)
+		} else {
+			require.Nil(t, err, test.domain)
+		}
+		require.Equal(t, test.isStatus, isStatus)
+		require.Equal(t, test.query, got)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", NackDelay: 20 * time.Millisecond, DedupWindow: time.Minute})
+	defer tun.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("2jkhm3.24.5.3dpeb3w.tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(&testResponseWriter{}, r)
+	require.Eventually(t, func() bool { return len(tun.Partials()) == 1 }, time.Second, time.Millisecond)
+
+	// Until the message is idle, more fragments may be on their way.
+	status := EncodeStatus("tunnel.example.com", "2jkhm3", 24, "n0nce")
+	require.Equal(t, Ack{Received: 7, Total: 24}, ackServer(t, tun, status, dns.TypeTXT))
+
+	time.Sleep(30 * time.Millisecond)
+	require.Equal(t, Ack{Received: 7, Total: 24, Missing: []Range{{Offset: 0, Length: 5}, {Offset: 12, Length: 12}}, Nack: true}, ackServer(t, tun, status, dns.TypeTXT))
+
+	// Messages of another length, and unknown messages, are missing entirely.
+	require.Equal(t, Ack{Total: 30, Missing: []Range{{Offset: 0, Length: 30}}, Nack: true}, ackServer(t, tun, EncodeStatus("tunnel.example.com", "2jkhm3", 30, "n0nce"), dns.TypeTXT))
+	require.Equal(t, Ack{Total: 8, Missing: []Range{{Offset: 0, Length: 8}}, Nack: true}, ackServer(t, tun, EncodeStatus("tunnel.example.com", "q8rt2z", 8, "n0nce"), dns.TypeTXT))
+
+	for _, name := range []string{"2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com.", "2jkhm3.24.12.64tmmq000000.tunnel.example.com."} {
+		r := &dns.Msg{}
+		r.SetQuestion(name, dns.TypeA)
+		tun.ServeDNS(&testResponseWriter{}, r)
+	}
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+	require.Equal(t, Ack{Received: 24, Total: 24}, ackServer(t, tun, status, dns.TypeTXT))
+	require.EqualValues(t, 5, tun.Stats().StatusQueries)
+	require.Zero(t, tun.Stats().ParseErrors)
+}
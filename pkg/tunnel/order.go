@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A heldMessage is a message waiting in a reorderBuffer for the messages sent before it.
+type heldMessage struct {
+	msg   Message
+	since time.Time
+}
+
+// A sequencedSession is the delivery state of a session whose messages carry sequence numbers.
+type sequencedSession struct {
+	// next is the sequence number of the next message to deliver.
+	next     int
+	held     map[int]heldMessage
+	lastSeen time.Time
+}
+
+// A reorderBuffer holds back the messages of sessions that arrive ahead of messages sent before
+// them, as described on Config.OrderedDelivery. Sessions are keyed by listKey. Messages are
+// delivered with the lock held, so that those released by different goroutines can't overtake
+// each other.
+type reorderBuffer struct {
+	mu       sync.Mutex
+	sessions map[string]*sequencedSession
+	timeout  time.Duration
+	idle     time.Duration
+	// reordered counts the messages held back, gaps the sequence numbers given up on, and
+	// holding the messages currently held. They are read without the lock, which is held while
+	// messages are delivered.
+	reordered atomic.Uint64
+	gaps      atomic.Uint64
+	holding   atomic.Int64
+}
+
+func newReorderBuffer(timeout, idle time.Duration) *reorderBuffer {
+	return &reorderBuffer{sessions: make(map[string]*sequencedSession), timeout: timeout, idle: idle}
+}
+
+// push delivers msg, and the held messages that were waiting for it, unless it arrived ahead of
+// a message sent before it, in which case it is held back. Messages without a sequence number,
+// and those whose turn has passed because their predecessors were given up on, are delivered
+// immediately.
+func (rb *reorderBuffer) push(msg Message, now time.Time, deliver func(Message)) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if msg.Sequence == 0 {
+		deliver(msg)
+		return
+	}
+	key := listKey(msg.Tenant, msg.Session)
+	s, ok := rb.sessions[key]
+	if !ok {
+		s = &sequencedSession{next: 1, held: make(map[int]heldMessage)}
+		rb.sessions[key] = s
+	}
+	s.lastSeen = now
+	_, duplicate := s.held[msg.Sequence]
+	switch {
+	case msg.Sequence < s.next || duplicate:
+		deliver(msg)
+	case msg.Sequence == s.next:
+		deliver(msg)
+		s.next++
+		rb.release(s, deliver)
+	default:
+		s.held[msg.Sequence] = heldMessage{msg: msg, since: now}
+		rb.reordered.Add(1)
+		rb.holding.Add(1)
+	}
+}
+
+// release delivers the held messages of s that are next in sequence.
+func (rb *reorderBuffer) release(s *sequencedSession, deliver func(Message)) {
+	for {
+		h, ok := s.held[s.next]
+		if !ok {
+			return
+		}
+		delete(s.held, s.next)
+		rb.holding.Add(-1)
+		deliver(h.msg)
+		s.next++
+	}
+}
+
+// sweep gives up on the messages that held messages have waited for longer than the timeout,
+// delivering the held messages up to the overdue ones, and forgets the sessions that are idle.
+func (rb *reorderBuffer) sweep(now time.Time, deliver func(Message)) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for key, s := range rb.sessions {
+		if overdue := rb.overdue(s, now); overdue != 0 {
+			rb.skipTo(s, overdue, deliver)
+		}
+		if len(s.held) == 0 && now.Sub(s.lastSeen) >= rb.idle {
+			delete(rb.sessions, key)
+		}
+	}
+}
+
+// overdue returns the highest sequence number of the messages of s held for longer than the
+// timeout, or 0 if there is none.
+func (rb *reorderBuffer) overdue(s *sequencedSession, now time.Time) int {
+	seq := 0
+	for n, h := range s.held {
+		if n > seq && now.Sub(h.since) >= rb.timeout {
+			seq = n
+		}
+	}
+	return seq
+}
+
+// skipTo delivers the held messages of s up to seq, giving up on the missing ones.
+func (rb *reorderBuffer) skipTo(s *sequencedSession, seq int, deliver func(Message)) {
+	for _, n := range s.sequences() {
+		if n > seq {
+			break
+		}
+		if n < s.next {
+			continue
+		}
+		rb.gaps.Add(uint64(n - s.next))
+		s.next = n
+		rb.release(s, deliver)
+	}
+}
+
+// flush delivers every held message, in sequence within each session.
+func (rb *reorderBuffer) flush(deliver func(Message)) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for _, s := range rb.sessions {
+		if seqs := s.sequences(); len(seqs) > 0 {
+			rb.skipTo(s, seqs[len(seqs)-1], deliver)
+		}
+	}
+}
+
+// sequences returns the sequence numbers of the held messages of s, in order.
+func (s *sequencedSession) sequences() []int {
+	seqs := make([]int, 0, len(s.held))
+	for n := range s.held {
+		seqs = append(seqs, n)
+	}
+	sort.Ints(seqs)
+	return seqs
+}
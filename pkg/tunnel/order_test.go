@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequenceLabel(t *testing.T) {
+	rules := parseRules{maxMessageSize: DefaultMaxMessageSize}
+	fg, err := parseDomain("tunnel.example.com.", "v2-30.tab1.7.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", rules)
+	require.Nil(t, err)
+	require.Equal(t, framing{version: Version2, flags: FlagSession | FlagSequence, session: "tab1", seq: 7}, fg.framing)
+	require.Equal(t, "2jkhm3", fg.id)
+
+	for _, domain := range []string{
+		"v2-30.tab1.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+		"v2-30.tab1.0.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+		"v2-30.tab1.tunnel.example.com.",
+	} {
+		_, err := parseDomain("tunnel.example.com.", domain, rules)
+		require.NotNil(t, err, domain)
+		require.Equal(t, reasonLabels, parseErrorReason(err), domain)
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", OrderedDelivery: true, ReorderTimeout: time.Minute})
+	defer tun.Close()
+
+	send := func(session string, seq int, id string) {
+		enc := Encoder{LabelLen: 63, Version: Version2, Session: session, Sequence: seq}
+		domains, err := enc.Encode("tunnel.example.com", id, id)
+		require.Nil(t, err)
+		for _, domain := range domains {
+			_, ok := tun.handleQuery(query{name: domain, receivedAt: time.Now()})
+			require.True(t, ok)
+		}
+	}
+	received := func() []string {
+		var ids []string
+		for len(tun.Messages()) > 0 {
+			ids = append(ids, (<-tun.Messages()).ID)
+		}
+		return ids
+	}
+
+	// Messages are held back until the messages sent before them are delivered, while those of
+	// other sessions and without sequence numbers aren't.
+	send("tab1", 2, "second")
+	send("tab1", 3, "third")
+	send("tab2", 1, "other")
+	send("", 0, "unsequenced")
+	require.Equal(t, []string{"other", "unsequenced"}, received())
+	require.Equal(t, 2, tun.Stats().Held)
+	send("tab1", 1, "first")
+	require.Equal(t, []string{"first", "second", "third"}, received())
+	require.EqualValues(t, 2, tun.Stats().Reordered)
+	require.Zero(t, tun.Stats().Held)
+
+	// Missing messages are given up on once the held messages have waited for the timeout, and
+	// delivered as they arrive if they turn up later.
+	send("tab1", 6, "sixth")
+	send("tab1", 8, "eighth")
+	tun.order.sweep(time.Now().Add(30*time.Second), tun.deliver)
+	require.Empty(t, received())
+	tun.order.sweep(time.Now().Add(2*time.Minute), tun.deliver)
+	require.Equal(t, []string{"sixth", "eighth"}, received())
+	require.EqualValues(t, 3, tun.Stats().SequenceGaps)
+	send("tab1", 4, "fourth")
+	send("tab1", 9, "ninth")
+	require.Equal(t, []string{"fourth", "ninth"}, received())
+
+	// Idle sessions are forgotten.
+	tun.order.sweep(time.Now().Add(2*DefaultSessionTimeout), tun.deliver)
+	require.Empty(t, tun.order.sessions)
+}
+
+func TestOrderedDeliveryShutdown(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", OrderedDelivery: true})
+
+	for seq, id := range map[int]string{2: "second", 3: "third"} {
+		enc := Encoder{LabelLen: 63, Version: Version2, Session: "tab1", Sequence: seq}
+		domains, err := enc.Encode("tunnel.example.com", id, "hello world")
+		require.Nil(t, err)
+		tun.domains <- query{name: domains[0], receivedAt: time.Now()}
+	}
+	require.Eventually(t, func() bool { return tun.Stats().Held == 2 }, time.Second, 10*time.Millisecond)
+
+	// Held messages are delivered in sequence when the tunnel shuts down.
+	require.Nil(t, tun.Shutdown(context.Background()))
+	var ids []string
+	for msg := range tun.Messages() {
+		ids = append(ids, msg.ID)
+	}
+	require.Equal(t, []string{"second", "third"}, ids)
+}
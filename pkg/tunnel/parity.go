@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parity fragments let the tunnel rebuild a fragment that never arrives without the client sending
+// it again. A message framed with FlagParity is split into groups of consecutive fragments, each
+// followed by a parity fragment laid out like the others, but at an offset past the end of the
+// message: the parity fragment of the group starting at offset o of a message of length total is
+// at offset total+o. Its data is the length of the group and its number of fragments, each written
+// in as many digits of the alphabet of the encoding as it takes to write total, followed by the
+// parity of the group: the sum modulo the size of the alphabet of the positions in the alphabet of
+// the characters at each position of its fragments, as long as the longest of them. The tunnel
+// rebuilds the one fragment of a group that is missing by subtracting the others from the parity.
+
+// parityDigits returns the number of digits that total is written with in base.
+func parityDigits(total, base int) int {
+	digits := 1
+	for n := total; n >= base; n /= base {
+		digits++
+	}
+	return digits
+}
+
+// formatDigits writes n in digits digits of the alphabet of c.
+func (c *codec) formatDigits(n, digits int) string {
+	buf := make([]byte, digits)
+	for i := digits - 1; i >= 0; i-- {
+		buf[i] = c.alphabet[n%len(c.alphabet)]
+		n /= len(c.alphabet)
+	}
+	return string(buf)
+}
+
+// parseDigits parses a number written in the alphabet of c, reporting false if s has a character
+// outside of it.
+func (c *codec) parseDigits(s string) (int, bool) {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(c.alphabet, s[i])
+		if d < 0 {
+			return 0, false
+		}
+		n = n*len(c.alphabet) + d
+	}
+	return n, true
+}
+
+// parity returns the parity of members, encoded with c.
+func (c *codec) parity(members []string) string {
+	length := 0
+	for _, m := range members {
+		length = max(length, len(m))
+	}
+	sum := make([]int, length)
+	for _, m := range members {
+		for i := 0; i < len(m); i++ {
+			sum[i] += strings.IndexByte(c.alphabet, m[i])
+		}
+	}
+	buf := make([]byte, length)
+	for i, s := range sum {
+		buf[i] = c.alphabet[s%len(c.alphabet)]
+	}
+	return string(buf)
+}
+
+// parityReserve returns the number of bytes by which a parity fragment may be longer than the
+// longest fragment of its group, when the message is encoded to total bytes with c into labels of
+// at most labelLen bytes: the digits that its offset has in addition to those of the first
+// fragment, and the length and count of its group along with the labels that they may spill into.
+func parityReserve(total int, c *codec, labelLen int) int {
+	header := 2 * parityDigits(total, len(c.alphabet))
+	return len(strconv.Itoa(2*total)) + header + (header+labelLen-1)/labelLen
+}
+
+// addParity follows every k fragments of coded, laid out by StandardCodec from encoded, with their
+// parity fragment. opts.Space must leave parityReserve bytes for it beyond the space the fragments
+// were laid out in.
+func addParity(id, encoded string, coded []CodedFragment, k int, c *codec, opts CodecOptions) ([]CodedFragment, error) {
+	digits := parityDigits(len(encoded), len(c.alphabet))
+	withParity := make([]CodedFragment, 0, len(coded)+(len(coded)+k-1)/k)
+	for start := 0; start < len(coded); start += k {
+		group := coded[start:min(start+k, len(coded))]
+		members := make([]string, len(group))
+		length := 0
+		for i, f := range group {
+			members[i] = encoded[f.Offset : f.Offset+f.Length]
+			length += f.Length
+		}
+		data := c.formatDigits(length, digits) + c.formatDigits(len(group), digits) + c.parity(members)
+
+		header := fmt.Sprintf("%s.%d.%d.", id, len(encoded), len(encoded)+group[0].Offset)
+		if opts.Checksum {
+			header += checksumLabel(data) + "."
+		}
+		var labels []string
+		for i := 0; i < len(data); i += opts.LabelLen {
+			labels = append(labels, data[i:min(i+opts.LabelLen, len(data))])
+		}
+		parity := CodedFragment{
+			Labels: header + strings.Join(labels, "."),
+			Range:  Range{Offset: len(encoded) + group[0].Offset, Length: len(data)},
+		}
+		if len(parity.Labels) > opts.Space {
+			return nil, ErrNoRoom
+		}
+		withParity = append(append(withParity, group...), parity)
+	}
+	return withParity, nil
+}
+
+// putParity adds fg, a parity fragment, to the list, replacing any parity fragment of the same
+// group.
+func (fl *fragmentList) putParity(fg fragment) {
+	if fl.parity == nil {
+		fl.parity = make(map[int]fragment)
+	}
+	start := fg.offset - fl.totalSize
+	if prev, ok := fl.parity[start]; ok {
+		fl.size -= len(prev.data)
+	}
+	fl.parity[start] = fg
+	fl.size += len(fg.data)
+}
+
+// recover rebuilds the fragments of the list that can be recovered from its parity fragments, and
+// returns how many it added. Parity fragments are discarded once their group is complete, or if
+// they can't describe one.
+func (fl *fragmentList) recover() int {
+	c, err := codecOf(fl.framing.encoding)
+	if err != nil {
+		return 0
+	}
+	recovered := 0
+	for start, p := range fl.parity {
+		fg, done := fl.recoverGroup(c, start, p)
+		if !done {
+			continue
+		}
+		delete(fl.parity, start)
+		fl.size -= len(p.data)
+		if fg.data != "" {
+			fl.put(fg)
+			recovered++
+		}
+	}
+	return recovered
+}
+
+// recoverGroup returns the fragment missing from the group starting at start, whose parity fragment
+// is p, if it is the only one. It reports false if the group may still be completed by fragments or
+// recovered later.
+func (fl *fragmentList) recoverGroup(c *codec, start int, p fragment) (fragment, bool) {
+	digits := parityDigits(fl.totalSize, len(c.alphabet))
+	if len(p.data) <= 2*digits || start < fl.emitted {
+		return fragment{}, true
+	}
+	length, ok := c.parseDigits(p.data[:digits])
+	count, ok2 := c.parseDigits(p.data[digits : 2*digits])
+	if !ok || !ok2 || length <= 0 || count <= 0 || start+length > fl.totalSize {
+		return fragment{}, true
+	}
+	sum := p.data[2*digits:]
+
+	// Follow the fragments of the group from its start, over the only gap between them.
+	end := start + length
+	var members []string
+	gap := Range{Offset: -1}
+	pos := start
+	for pos < end {
+		if f, ok := fl.fragments[pos]; ok && f.data != "" {
+			members = append(members, f.data)
+			pos += len(f.data)
+			continue
+		}
+		if gap.Offset >= 0 {
+			return fragment{}, false
+		}
+		next := end
+		for offset := range fl.fragments {
+			if offset > pos && offset < next {
+				next = offset
+			}
+		}
+		gap = Range{Offset: pos, Length: next - pos}
+		pos = next
+	}
+	if pos != end {
+		// A fragment crosses the end of the group, so the message wasn't split as its parity
+		// fragment says.
+		return fragment{}, true
+	}
+	if gap.Offset < 0 {
+		return fragment{}, true
+	}
+	if len(members)+1 != count || gap.Length > len(sum) {
+		return fragment{}, false
+	}
+
+	data := make([]byte, gap.Length)
+	for i := range data {
+		s := strings.IndexByte(c.alphabet, sum[i])
+		if s < 0 {
+			return fragment{}, true
+		}
+		for _, m := range members {
+			if i >= len(m) {
+				continue
+			}
+			d := strings.IndexByte(c.alphabet, m[i])
+			if d < 0 {
+				return fragment{}, false
+			}
+			s -= d
+		}
+		n := len(c.alphabet)
+		data[i] = c.alphabet[(s%n+n)%n]
+	}
+	return fragment{id: p.id, framing: p.framing, totalSize: p.totalSize, offset: gap.Offset, data: string(data)}, true
+}
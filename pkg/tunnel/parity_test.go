@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParity(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Strict: true})
+	defer tun.Close()
+
+	msg := strings.Repeat("hello world? ", 100)
+	tests := []Encoder{
+		{LabelLen: 63, Version: Version2, Parity: 3},
+		{LabelLen: 63, Version: Version2, Parity: 1},
+		{LabelLen: 10, Version: Version2, Parity: 4, Checksum: true},
+		{LabelLen: 63, Version: Version2, Parity: 3, Encoding: EncodingBase64URL},
+		{LabelLen: 63, Version: Version2, Parity: 2, Encoding: EncodingHex, Session: "tab1"},
+	}
+	recovered := uint64(0)
+	for _, enc := range tests {
+		domains, err := enc.Encode("tunnel.example.com.", "2jkhm3", msg)
+		require.Nil(t, err)
+		// Each group is followed by its parity fragment. Drop a different fragment of each group,
+		// including the last one of the message.
+		group := 0
+		for i := 0; i < len(domains); {
+			end := min(i+enc.Parity, len(domains)-1)
+			drop := i + group%(end-i)
+			if end == len(domains)-1 {
+				drop = end - 1
+			}
+			for j := i; j <= end; j++ {
+				require.LessOrEqual(t, len(domains[j]), maxNameLen+1)
+				if j != drop {
+					tun.domains <- query{name: strings.ToLower(domains[j]), asked: domains[j]}
+				}
+			}
+			i, group = end+1, group+1
+		}
+		recovered += uint64(group)
+		require.Equal(t, msg, string((<-tun.Messages()).Payload), enc)
+	}
+	require.Equal(t, recovered, tun.Stats().Recovered)
+}
+
+func TestParityLosses(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Expiration: time.Minute})
+	defer tun.Close()
+
+	msg := strings.Repeat("x", 500)
+	fragments, err := Encoder{LabelLen: 63, Version: Version2, Parity: 3}.EncodeFragments("tunnel.example.com.", "2jkhm3", msg)
+	require.Nil(t, err)
+	// The parity fragment of the first group follows its three fragments, past the end of the
+	// message.
+	require.Greater(t, len(fragments), 4)
+	last := fragments[len(fragments)-2]
+	require.Equal(t, last.Offset+last.Length, fragments[3].Offset)
+
+	// Two fragments of the first group are lost, which its parity can't make up for.
+	for _, f := range fragments[2:] {
+		tun.domains <- query{name: f.Domain, asked: f.Domain}
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, tun.Messages(), 0)
+	partials := tun.Partials()
+	require.Len(t, partials, 1)
+	require.Equal(t, []Range{{Offset: 0, Length: fragments[2].Offset}}, partials[0].Missing)
+
+	// Once either arrives, the other is recovered.
+	tun.domains <- query{name: fragments[1].Domain, asked: fragments[1].Domain}
+	require.Equal(t, msg, string((<-tun.Messages()).Payload))
+	require.Equal(t, uint64(1), tun.Stats().Recovered)
+}
+
+func TestParityErrors(t *testing.T) {
+	rules := parseRules{maxMessageSize: 100}
+	_, err := parseDomain("tunnel.example.com.", "2jkhm3.24.24.nbswy3dp.tunnel.example.com.", rules)
+	require.Equal(t, reasonOffset, parseErrorReason(err))
+	_, err = parseDomain("tunnel.example.com.", "v2-0400.2jkhm3.24.24.nbswy3dp.tunnel.example.com.", rules)
+	require.Nil(t, err)
+	_, err = parseDomain("tunnel.example.com.", "v2-0400.2jkhm3.24.48.nbswy3dp.tunnel.example.com.", rules)
+	require.Equal(t, reasonOffset, parseErrorReason(err))
+
+	for _, enc := range []Encoder{
+		{LabelLen: 63, Parity: 3},
+		{LabelLen: 63, Version: Version2, Parity: -1},
+		{LabelLen: 63, Version: Version2, Parity: 3, Codec: fixedCodec{}},
+	} {
+		_, err := enc.Encode("tunnel.example.com.", "2jkhm3", "hello world")
+		require.NotNil(t, err, enc)
+	}
+}
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reasons a fragment fails to parse, as reported in logs and metrics.
+const (
+	reasonRoute    = "route"
+	reasonLabels   = "labels"
+	reasonSize     = "size"
+	reasonOffset   = "offset"
+	reasonChecksum = "checksum"
+	reasonAlphabet = "alphabet"
+	reasonVersion  = "version"
+)
+
+// parseReasons lists every reason a fragment can fail to parse.
+var parseReasons = []string{reasonRoute, reasonLabels, reasonSize, reasonOffset, reasonChecksum, reasonAlphabet, reasonVersion}
+
+// A parseError is an error parsing a fragment, along with the reason it failed.
+type parseError struct {
+	reason string
+	err    error
+}
+
+func (e *parseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// parseErrorf returns a parseError for reason, formatted as by fmt.Errorf.
+func parseErrorf(reason, format string, a ...any) error {
+	return &parseError{reason: reason, err: fmt.Errorf(format, a...)}
+}
+
+// parseErrorReason returns the reason of a parseError, or reasonRoute for any other error.
+func parseErrorReason(err error) string {
+	var pe *parseError
+	if errors.As(err, &pe) {
+		return pe.reason
+	}
+	return reasonRoute
+}
+
+// parseRules bound the fragments accepted by parseDomain.
+type parseRules struct {
+	maxMessageSize int
+	// maxDataLabels, if not zero, is the maximum number of labels carrying data.
+	maxDataLabels int
+	// strict rejects fragments that no conforming client sends, as described on Config.Strict.
+	strict bool
+	// encoding is the encoding of fragments that aren't framed with FlagEncoding, as configured
+	// for their top domain.
+	encoding Encoding
+	// codec lays out the fields of fragments, as configured for their top domain, or StandardCodec
+	// if nil.
+	codec Codec
+	// parity accepts the offsets of parity fragments, for fragments framed with FlagParity.
+	parity bool
+}
+
+// checkSize returns an error if a message can't have the declared length of totalSize.
+func (r parseRules) checkSize(totalSize int) error {
+	if totalSize <= 0 {
+		return parseErrorf(reasonSize, "Message declares non-positive length %d", totalSize)
+	}
+	if totalSize > r.maxMessageSize {
+		return parseErrorf(reasonSize, "Message declares length %d. Max message size is %d", totalSize, r.maxMessageSize)
+	}
+	return nil
+}
+
+// checkOffset returns an error if offset is outside of a message of length totalSize, or of the
+// parity fragments that follow it if the rules accept them.
+func (r parseRules) checkOffset(offset, totalSize int) error {
+	limit := totalSize
+	if r.parity {
+		limit = 2 * totalSize
+	}
+	if offset < 0 || offset >= limit {
+		return parseErrorf(reasonOffset, "Offset %d is outside of message of length %d", offset, totalSize)
+	}
+	return nil
+}
+
+// checkDataLabels returns an error if a fragment carries its data in more than the allowed
+// number of labels.
+func (r parseRules) checkDataLabels(n int) error {
+	if r.maxDataLabels > 0 && n > r.maxDataLabels {
+		return parseErrorf(reasonLabels, "Fragment has %d data labels. Max is %d", n, r.maxDataLabels)
+	}
+	return nil
+}
+
+// parseNumber parses a size or offset. Strict rules only accept the canonical form that clients
+// produce, without signs or leading zeros.
+func (r parseRules) parseNumber(reason, name, s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, parseErrorf(reason, "Invalid %s %q: %w", name, s, err)
+	}
+	var canonical [20]byte
+	if r.strict && string(strconv.AppendInt(canonical[:0], int64(n), 10)) != s {
+		return 0, parseErrorf(reason, "Invalid %s %q: not in canonical form", name, s)
+	}
+	return n, nil
+}
+
+// Every query is parsed while it is served, so the parsing below avoids allocating: names are
+// sliced rather than split and joined, and data labels are joined in pooled buffers.
+
+// maxHeaderLabels is the number of labels that parsing expects at most, which splitLabels
+// stores without allocating.
+const maxHeaderLabels = 16
+
+// splitLabels appends the dot-separated labels of s to dst. Callers pass a slice of an array on
+// their stack, so that splitting names of up to its capacity doesn't allocate.
+func splitLabels(dst []string, s string) []string {
+	for {
+		i := strings.IndexByte(s, '.')
+		if i < 0 {
+			return append(dst, s)
+		}
+		dst, s = append(dst, s[:i]), s[i+1:]
+	}
+}
+
+// underDomain returns the labels of domain in front of parent, or false if domain isn't a
+// subdomain of parent. It is strings.CutSuffix(domain, "."+parent), without concatenating.
+func underDomain(domain, parent string) (string, bool) {
+	n := len(domain) - len(parent) - 1
+	if n < 0 || domain[n] != '.' || domain[n+1:] != parent {
+		return "", false
+	}
+	return domain[:n], true
+}
+
+// dataBuffers pools the buffers that the data labels of fragments are joined in.
+var dataBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// joinData joins labels, which must pass the strict alphabet check of c if strict is set, and
+// verifies them against checksum if it isn't empty. Joining them in a pooled buffer leaves the
+// returned string as the only allocation.
+func joinData(labels []string, c *codec, strict bool, checksum string, offset int) (string, error) {
+	buf := dataBuffers.Get().(*[]byte)
+	defer dataBuffers.Put(buf)
+	data := (*buf)[:0]
+	for _, label := range labels {
+		if strict {
+			if err := c.checkAlphabet(label); err != nil {
+				return "", err
+			}
+		}
+		data = append(data, label...)
+	}
+	*buf = data
+	if checksum != "" {
+		sum, err := strconv.ParseUint(checksum[len(checksumPrefix):], 16, 32)
+		if err != nil || len(checksum) != len(checksumPrefix)+8 || uint32(sum) != crc32.ChecksumIEEE(data) {
+			return "", parseErrorf(reasonChecksum, "Fragment at offset %d does not match checksum %s", offset, checksum)
+		}
+	}
+	return string(data), nil
+}
@@ -0,0 +1,114 @@
+package tunnel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+)
+
+func TestParseDomainReasons(t *testing.T) {
+	lenient := parseRules{maxMessageSize: 5000}
+	strict := parseRules{maxMessageSize: 5000, maxDataLabels: 2, strict: true}
+	tests := []struct {
+		domain string
+		rules  parseRules
+		reason string
+	}{
+		{domain: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", rules: strict},
+		{domain: "2jkhm3.24.0.nbswy3dpeb3w.64tmmq000000.tunnel.example.com.", rules: strict},
+		{domain: "2jkhm3.24.0.crc-48c3fd0d.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", rules: strict},
+		{domain: "2jkhm3.24.0.tunnel.example.com.", rules: lenient, reason: reasonLabels},
+		{domain: "2jkhm3.24.0.nbswy3dp.eb3w.64tmmq000000.tunnel.example.com.", rules: lenient},
+		{domain: "2jkhm3.24.0.nbswy3dp.eb3w.64tmmq000000.tunnel.example.com.", rules: strict, reason: reasonLabels},
+		{domain: "2jkhm3.FAIL.0.nbswy3dp.tunnel.example.com.", rules: lenient, reason: reasonSize},
+		{domain: "2jkhm3.99999.0.nbswy3dp.tunnel.example.com.", rules: lenient, reason: reasonSize},
+		{domain: "2jkhm3.+24.0.nbswy3dp.tunnel.example.com.", rules: lenient},
+		{domain: "2jkhm3.+24.0.nbswy3dp.tunnel.example.com.", rules: strict, reason: reasonSize},
+		{domain: "2jkhm3.24.-1.nbswy3dp.tunnel.example.com.", rules: lenient, reason: reasonOffset},
+		{domain: "2jkhm3.24.00.nbswy3dp.tunnel.example.com.", rules: lenient},
+		{domain: "2jkhm3.24.00.nbswy3dp.tunnel.example.com.", rules: strict, reason: reasonOffset},
+		{domain: "2jkhm3.24.20.nbswy3dp.tunnel.example.com.", rules: lenient, reason: reasonOffset},
+		{domain: "2jkhm3.24.0.crc-00000000.nbswy3dp.tunnel.example.com.", rules: lenient, reason: reasonChecksum},
+		{domain: "2jkhm3.24.0.nbswy-dp.tunnel.example.com.", rules: lenient},
+		{domain: "2jkhm3.24.0.nbswy-dp.tunnel.example.com.", rules: strict, reason: reasonAlphabet},
+		{domain: "2jkhm3.24.0.nbswy1dp.tunnel.example.com.", rules: strict, reason: reasonAlphabet},
+		{domain: "2jkhm3.24.0.nbswy3dp.other.example.com.", rules: lenient, reason: reasonRoute},
+		{domain: "v2-00.2jkhm3.24.0.nbswy3dp.tunnel.example.com.", rules: strict},
+		{domain: "v2-00.2jkhm3.24.0.tunnel.example.com.", rules: lenient, reason: reasonLabels},
+		{domain: "v3-00.2jkhm3.24.0.nbswy3dp.tunnel.example.com.", rules: lenient, reason: reasonVersion},
+		{domain: "v2-80.hex.2jkhm3.22.0.68656c6c6f.tunnel.example.com.", rules: strict},
+		{domain: "v2-80.hex.2jkhm3.22.0.68656C6C6F.tunnel.example.com.", rules: strict},
+		{domain: "v2-80.hex.2jkhm3.22.0.68656c6g6f.tunnel.example.com.", rules: strict, reason: reasonAlphabet},
+		{domain: "v2-80.base64url.2jkhm3.16.0.aGVsbG8gd29y.tunnel.example.com.", rules: strict},
+		{domain: "v2-80.base64.2jkhm3.16.0.aGVsbG8gd29y.tunnel.example.com.", rules: lenient, reason: reasonVersion},
+		{domain: "v2-80.tunnel.example.com.", rules: lenient, reason: reasonLabels},
+	}
+	for _, test := range tests {
+		_, err := parseDomain("tunnel.example.com.", test.domain, test.rules)
+		if test.reason == "" {
+			require.Nil(t, err, test.domain)
+			continue
+		}
+		require.NotNil(t, err, test.domain)
+		require.Equal(t, test.reason, parseErrorReason(err), test.domain)
+	}
+}
+
+func TestParseErrorReasons(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Strict: true})
+	defer tun.Close()
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy!dp.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.FAIL.0.nbswy3dp.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.other.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}
+	<-tun.Messages()
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(3), stats.ParseErrors)
+	require.Equal(t, map[string]uint64{
+		reasonRoute:    1,
+		reasonLabels:   0,
+		reasonSize:     1,
+		reasonOffset:   0,
+		reasonChecksum: 0,
+		reasonAlphabet: 1,
+		reasonVersion:  0,
+	}, stats.ParseErrorReasons)
+
+	var buf bytes.Buffer
+	require.Nil(t, metrics.Write(&buf, tun.Collect()))
+	require.Contains(t, buf.String(), "browsertunnel_parse_errors_total{reason=\"alphabet\"} 1\n")
+}
+
+func TestParseDomainAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("The race detector adds allocations")
+	}
+	domains, err := Encoder{LabelLen: 20, Version: Version2, Session: "tab1", Checksum: true}.Encode("tunnel.example.com.", "2jkhm3", strings.Repeat("hello world ", 40))
+	require.Nil(t, err)
+	rules := parseRules{maxMessageSize: 5000, strict: true}
+	// The data of the fragment is the only allocation, however many labels it is split into.
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := parseDomain("tunnel.example.com.", domains[0], rules); err != nil {
+			t.Fatal(err)
+		}
+	})
+	require.Equal(t, 1.0, allocs)
+}
+
+func BenchmarkParseDomain(b *testing.B) {
+	domains, err := Encoder{LabelLen: 63, Version: Version2, Session: "tab1", Checksum: true}.Encode("tunnel.example.com.", "2jkhm3", strings.Repeat("hello world ", 40))
+	require.Nil(b, err)
+	rules := parseRules{maxMessageSize: 5000, strict: true}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseDomain("tunnel.example.com.", domains[i%len(domains)], rules); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
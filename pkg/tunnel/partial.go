@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"sort"
+)
+
+// partial describes the fragment list of the message id.
+func (fl *fragmentList) partial(id string) PartialMessage {
+	missing := fl.missing()
+	received := fl.totalSize
+	for _, gap := range missing {
+		received -= gap.Length
+	}
+	return PartialMessage{
+		ID:            id,
+		Tenant:        fl.tenant,
+		TotalSize:     fl.totalSize,
+		Received:      received,
+		Missing:       missing,
+		Fragments:     len(fl.fragments) + fl.discarded,
+		FirstFragment: fl.firstSeen,
+		ExpiresAt:     fl.expiresAt,
+	}
+}
+
+// Partials returns the partial messages currently held in memory, by tenant and ID.
+func (tun *Tunnel) Partials() []PartialMessage {
+	var partials []PartialMessage
+	for _, sh := range tun.shards {
+		sh.mu.Lock()
+		for _, fgList := range sh.lists {
+			partials = append(partials, fgList.partial(fgList.id))
+		}
+		sh.mu.Unlock()
+	}
+	sort.Slice(partials, func(i, j int) bool {
+		if partials[i].Tenant != partials[j].Tenant {
+			return partials[i].Tenant < partials[j].Tenant
+		}
+		return partials[i].ID < partials[j].ID
+	})
+	return partials
+}
+
+// Expire expires the partial message id of tenant right away, as if it had timed out: it is
+// deleted, counted in Stats.Expired and reported on the Expired channel. Pass an empty tenant if
+// tenants aren't configured. It returns false if there is no such partial message.
+func (tun *Tunnel) Expire(tenant, id string) bool {
+	key := listKey(tenant, id)
+	sh := tun.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.lists[key]; !ok {
+		return false
+	}
+	tun.expireList(sh, key)
+	return true
+}
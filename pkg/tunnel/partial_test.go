@@ -0,0 +1,36 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartials(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", Expiration: time.Minute})
+	defer tun.Close()
+
+	tun.domains <- query{name: "i42ftq.592.218.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.qqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tf.mfwca33omvzsyidon52caztjm52xeylunf3gkidpnzsxgoranvqwg2djnzsxgid.eojuxm2lom4qg65dimvzca3lbmn.tunnel.example.com.", receivedAt: time.Now()}
+	tun.domains <- query{name: "abcdef.24.0.nbswy3dp.tunnel.example.com.", receivedAt: time.Now()}
+	require.Eventually(t, func() bool { return len(tun.Partials()) == 2 }, time.Second, time.Millisecond)
+
+	partials := tun.Partials()
+	require.Equal(t, "abcdef", partials[0].ID)
+	require.Equal(t, 8, partials[0].Received)
+	require.Equal(t, "i42ftq", partials[1].ID)
+	require.Equal(t, 592, partials[1].TotalSize)
+	require.Equal(t, 216, partials[1].Received)
+	require.Equal(t, 1, partials[1].Fragments)
+	require.WithinDuration(t, time.Now(), partials[1].FirstFragment, time.Second)
+	require.WithinDuration(t, time.Now().Add(time.Minute), partials[1].ExpiresAt, time.Second)
+
+	// Expiring a message reports it like a timeout would.
+	require.True(t, tun.Expire("", "i42ftq"))
+	require.False(t, tun.Expire("", "i42ftq"))
+	require.False(t, tun.Expire("alpha", "abcdef"))
+	require.Equal(t, "i42ftq", (<-tun.Expired()).ID)
+	require.Len(t, tun.Partials(), 1)
+	require.EqualValues(t, 1, tun.Stats().Expired)
+	require.Equal(t, 1, tun.Stats().InFlight)
+}
@@ -0,0 +1,46 @@
+package tunnel
+
+import "time"
+
+// A ProgressEvent reports how much of a partial message has been received, as sent on
+// Tunnel.Progress after each of its fragments when Config.Progress is set, so that large uploads
+// can be followed as they arrive.
+type ProgressEvent struct {
+	ID     string
+	Tenant string
+	// Received is the number of bytes of the encoded message received so far, out of TotalSize.
+	// It reaches TotalSize with the fragment that completes the message.
+	Received  int
+	TotalSize int
+	// Fragments is the number of distinct fragments received.
+	Fragments int
+	// Time is when the fragment was received.
+	Time time.Time
+}
+
+// Progress returns the channel on which the progress of partial messages is reported, if
+// Config.Progress is set. Events are dropped while the channel is full. The channel is closed by
+// Close.
+func (tun *Tunnel) Progress() <-chan ProgressEvent {
+	return tun.progressEvents
+}
+
+// notifyProgress reports the progress of the message of fl without blocking, if Config.Progress is
+// set. The lock of the shard of fl must be held.
+func (tun *Tunnel) notifyProgress(fl *fragmentList, at time.Time) {
+	if !tun.progress {
+		return
+	}
+	e := ProgressEvent{
+		ID:        fl.id,
+		Tenant:    fl.tenant,
+		Received:  fl.ack().Received,
+		TotalSize: fl.totalSize,
+		Fragments: len(fl.fragments) + fl.discarded,
+		Time:      at,
+	}
+	select {
+	case tun.progressEvents <- e:
+	default:
+	}
+}
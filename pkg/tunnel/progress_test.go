@@ -0,0 +1,36 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Progress: true})
+	defer tun.Close()
+
+	domains, err := Encoder{LabelLen: 63, Version: Version2}.Encode("tunnel.example.com.", "pr0gr5", strings.Repeat("progress ", 30))
+	require.Nil(t, err)
+	require.Greater(t, len(domains), 2)
+	// A duplicate fragment doesn't report progress.
+	domains = append(domains[:1], domains...)
+	received, total := 0, 0
+	for i, domain := range domains {
+		tun.domains <- query{name: domain, receivedAt: time.Now()}
+		if i == 1 {
+			continue
+		}
+		e := <-tun.Progress()
+		require.Equal(t, "pr0gr5", e.ID)
+		require.Greater(t, e.Received, received)
+		require.Equal(t, max(i, 1), e.Fragments)
+		require.False(t, e.Time.IsZero())
+		received, total = e.Received, e.TotalSize
+	}
+	// The fragment that completes the message reports all of it.
+	require.Equal(t, total, received)
+	<-tun.Messages()
+}
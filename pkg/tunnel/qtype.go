@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// otherType is the label counting queries of types that miekg/dns doesn't know, which would
+// otherwise make the number of labels unbounded.
+const otherType = "other"
+
+// typeCounters counts queries of the types that don't carry fragments, by the name of the type.
+// It is built once, so it is read without locking.
+type typeCounters map[uint16]*uint64
+
+func newTypeCounters() typeCounters {
+	counters := make(typeCounters, len(dns.TypeToString)+1)
+	for qtype := range dns.TypeToString {
+		if !payloadTypes[qtype] {
+			counters[qtype] = new(uint64)
+		}
+	}
+	counters[dns.TypeNone] = new(uint64)
+	return counters
+}
+
+// add counts a query of type qtype.
+func (c typeCounters) add(qtype uint16) {
+	n, ok := c[qtype]
+	if !ok {
+		n = c[dns.TypeNone]
+	}
+	atomic.AddUint64(n, 1)
+}
+
+// snapshot returns the counts of the types that were queried, by name.
+func (c typeCounters) snapshot() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for qtype, n := range c {
+		if v := atomic.LoadUint64(n); v > 0 {
+			name := otherType
+			if qtype != dns.TypeNone {
+				name = dns.TypeToString[qtype]
+			}
+			counts[name] = v
+		}
+	}
+	return counts
+}
+
+// sortedTypes returns the names of counts in order.
+func sortedTypes(counts map[string]uint64) []string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// answerOtherType fills m, a reply to a query for domain of type qtype, which doesn't carry
+// fragments, as configured by r. A name the tunnel answers exists for every type, so such
+// queries get NODATA, unless the tunnel pretends that names don't exist at all. ANY queries get
+// the HINFO record of RFC 8482 instead of every record of the name, and zone transfers are
+// refused.
+func (r Response) answerOtherType(m *dns.Msg, domain string, qtype uint16) {
+	switch {
+	case qtype == dns.TypeAXFR || qtype == dns.TypeIXFR:
+		m.Rcode = dns.RcodeRefused
+	case r.Mode == ResponseNXDomain || r.Mode == ResponseStealth:
+		m.Rcode = dns.RcodeNameError
+	case qtype == dns.TypeANY:
+		m.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: r.ttl(qtype)},
+			Cpu: "RFC8482",
+		}}
+	}
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+)
+
+func TestOtherTypes(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", Response: Response{TTL: 5}})
+	defer tun.Close()
+
+	tests := []struct {
+		qtype  uint16
+		rcode  int
+		answer bool
+	}{
+		{dns.TypeCAA, dns.RcodeSuccess, false},
+		{65, dns.RcodeSuccess, false}, // HTTPS, which miekg/dns doesn't know
+		{dns.TypeCNAME, dns.RcodeSuccess, false},
+		{65000, dns.RcodeSuccess, false},
+		{dns.TypeANY, dns.RcodeSuccess, true},
+		{dns.TypeAXFR, dns.RcodeRefused, false},
+	}
+	// The name is a valid fragment, which must not be delivered.
+	name := "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."
+	for _, test := range tests {
+		w := &testResponseWriter{}
+		r := &dns.Msg{}
+		r.SetQuestion(name, test.qtype)
+		tun.ServeDNS(w, r)
+		require.Equal(t, test.rcode, w.msg.Rcode, dns.Type(test.qtype).String())
+		require.True(t, w.msg.Authoritative)
+		if test.answer {
+			hinfo := w.msg.Answer[0].(*dns.HINFO)
+			require.Equal(t, "RFC8482", hinfo.Cpu)
+			require.EqualValues(t, 5, hinfo.Hdr.Ttl)
+		} else {
+			require.Empty(t, w.msg.Answer, dns.Type(test.qtype).String())
+		}
+		if test.rcode == dns.RcodeSuccess && !test.answer {
+			require.IsType(t, &dns.SOA{}, w.msg.Ns[0])
+		}
+	}
+
+	stats := tun.Stats()
+	require.Zero(t, stats.Fragments)
+	require.Equal(t, map[string]uint64{"CAA": 1, "CNAME": 1, "other": 2, "ANY": 1, "AXFR": 1}, stats.OtherTypes)
+
+	var buf bytes.Buffer
+	require.Nil(t, metrics.Write(&buf, tun.Collect()))
+	require.Contains(t, buf.String(), "browsertunnel_other_type_queries_total{qtype=\"CAA\"} 1\n")
+	require.NotContains(t, buf.String(), "browsertunnel_other_type_queries_total{qtype=\"SRV\"}")
+}
+
+func TestOtherTypesNXDomain(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", Response: Response{Mode: ResponseNXDomain}})
+	defer tun.Close()
+
+	// Names don't exist for any type when the tunnel answers with NXDOMAIN.
+	for _, qtype := range []uint16{dns.TypeCAA, dns.TypeANY} {
+		w := &testResponseWriter{}
+		r := &dns.Msg{}
+		r.SetQuestion("anything.tunnel.example.com.", qtype)
+		tun.ServeDNS(w, r)
+		require.Equal(t, dns.RcodeNameError, w.msg.Rcode)
+		require.Empty(t, w.msg.Answer)
+	}
+}
+
+func TestQueryCounts(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomains: []string{"tunnel.example.com", "t.example.net"}})
+	defer tun.Close()
+
+	tests := []struct {
+		name  string
+		qtype uint16
+	}{
+		{"2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.TUNNEL.example.com.", dns.TypeA},
+		{"2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA},
+		{"tunnel.example.com.", dns.TypeAXFR},
+		{"t.example.net.", dns.TypeSOA},
+		{"t.example.net.", 65000},
+		{"www.example.org.", dns.TypeA},
+	}
+	for _, test := range tests {
+		r := &dns.Msg{}
+		r.SetQuestion(test.name, test.qtype)
+		tun.ServeDNS(&testResponseWriter{}, r)
+	}
+	// Queries without a question aren't counted.
+	tun.ServeDNS(&testResponseWriter{}, &dns.Msg{})
+
+	counts := tun.Stats().QueryCounts
+	require.Equal(t, map[QueryKey]uint64{
+		{Type: "A", TopDomain: "tunnel.example.com.", Rcode: "NOERROR"}:    2,
+		{Type: "AXFR", TopDomain: "tunnel.example.com.", Rcode: "REFUSED"}: 1,
+		{Type: "SOA", TopDomain: "t.example.net.", Rcode: "NOERROR"}:       1,
+		{Type: "other", TopDomain: "t.example.net.", Rcode: "NOERROR"}:     1,
+		{Type: "A", TopDomain: "", Rcode: "NOERROR"}:                       1,
+	}, counts)
+	require.Equal(t, "t.example.net.", SortedQueryKeys(counts)[1].TopDomain)
+
+	var buf bytes.Buffer
+	require.Nil(t, metrics.Write(&buf, tun.Collect()))
+	require.Contains(t, buf.String(), "browsertunnel_answered_queries_total{domain=\"tunnel.example.com.\",qtype=\"AXFR\",rcode=\"REFUSED\"} 1\n")
+}
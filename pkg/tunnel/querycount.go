@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// A QueryKey identifies the queries counted together in Stats.QueryCounts.
+type QueryKey struct {
+	// Type is the name of the query type, or "other" for types that package dns doesn't know.
+	Type string
+	// TopDomain is the top domain that the query was for or under, or empty if it matched none.
+	TopDomain string
+	// Rcode is the name of the response code of the reply, e.g. NOERROR or NXDOMAIN.
+	Rcode string
+}
+
+// queryCountKey is the unformatted form of a QueryKey.
+type queryCountKey struct {
+	qtype     uint16
+	topDomain string
+	rcode     int
+}
+
+// queryCounters counts the queries replied to by type, top domain and response code. Types the
+// tunnel doesn't know are counted as otherType, and there are few top domains and response
+// codes, so the number of counters is bounded.
+type queryCounters struct {
+	mu     sync.RWMutex
+	counts map[queryCountKey]*uint64
+}
+
+func newQueryCounters() *queryCounters {
+	return &queryCounters{counts: make(map[queryCountKey]*uint64)}
+}
+
+// add counts a query of type qtype for or under topDomain, replied to with rcode.
+func (c *queryCounters) add(qtype uint16, topDomain string, rcode int) {
+	if _, ok := dns.TypeToString[qtype]; !ok {
+		qtype = dns.TypeNone
+	}
+	key := queryCountKey{qtype: qtype, topDomain: topDomain, rcode: rcode}
+	c.mu.RLock()
+	n, ok := c.counts[key]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		if n, ok = c.counts[key]; !ok {
+			n = new(uint64)
+			c.counts[key] = n
+		}
+		c.mu.Unlock()
+	}
+	atomic.AddUint64(n, 1)
+}
+
+// snapshot returns the counts of the queries replied to.
+func (c *queryCounters) snapshot() map[QueryKey]uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make(map[QueryKey]uint64, len(c.counts))
+	for key, n := range c.counts {
+		qtype := otherType
+		if key.qtype != dns.TypeNone {
+			qtype = dns.TypeToString[key.qtype]
+		}
+		rcode, ok := dns.RcodeToString[key.rcode]
+		if !ok {
+			rcode = otherType
+		}
+		counts[QueryKey{Type: qtype, TopDomain: key.topDomain, Rcode: rcode}] += atomic.LoadUint64(n)
+	}
+	return counts
+}
+
+// countReply counts the reply m to the query r in Stats.QueryCounts.
+func (tun *Tunnel) countReply(r, m *dns.Msg) {
+	if len(r.Question) == 0 {
+		return
+	}
+	top, _ := tun.zoneOf(strings.ToLower(r.Question[0].Name))
+	tun.queryCounts.add(r.Question[0].Qtype, top, m.Rcode)
+}
+
+// SortedQueryKeys returns the keys of counts, ordered by top domain, type and response code.
+func SortedQueryKeys(counts map[QueryKey]uint64) []QueryKey {
+	keys := make([]QueryKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.TopDomain != b.TopDomain {
+			return a.TopDomain < b.TopDomain
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Rcode < b.Rcode
+	})
+	return keys
+}
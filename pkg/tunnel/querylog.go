@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+// A Disposition tells how ServeDNS handled a query, in a QueryRecord.
+type Disposition string
+
+// Dispositions of queries.
+const (
+	// DispositionFragment is a query carrying a fragment, which is handed to the reassembly
+	// whether or not the fragment turns out to be valid.
+	DispositionFragment  Disposition = "fragment"
+	DispositionPoll      Disposition = "poll"
+	DispositionStream    Disposition = "stream"
+	DispositionStatus    Disposition = "status"
+	DispositionHeartbeat Disposition = "heartbeat"
+	// DispositionZone is a query answered from the records of the zone, such as its SOA or NS.
+	DispositionZone Disposition = "zone"
+	// DispositionOtherType is a query of a type that can't carry fragments.
+	DispositionOtherType Disposition = "other_type"
+	// DispositionMalformed is a poll, stream, status or heartbeat query whose name doesn't parse.
+	DispositionMalformed Disposition = "malformed"
+	// DispositionBadVersion is a query with an EDNS version other than 0.
+	DispositionBadVersion Disposition = "bad_version"
+	// DispositionDenied is a query refused by Settings.AllowCIDRs or Settings.DenyCIDRs.
+	DispositionDenied Disposition = "denied"
+	// DispositionCertDenied is a query refused because the client certificate isn't allowed to
+	// send to the tenant.
+	DispositionCertDenied Disposition = "cert_denied"
+	// DispositionRateLimited is a query refused by the rate limit of its client.
+	DispositionRateLimited Disposition = "rate_limited"
+	// DispositionOverQuota is a query refused by the rate limit of its tenant.
+	DispositionOverQuota Disposition = "over_quota"
+)
+
+// A QueryRecord describes a query served by ServeDNS, for Config.QueryLog.
+type QueryRecord struct {
+	// Time is when the query was received.
+	Time   time.Time
+	Source net.IP
+	// Name is the query name, as it was asked.
+	Name string
+	Type uint16
+	// Tenant is the tenant the name was routed to, if any.
+	Tenant      string
+	Disposition Disposition
+	// Rcode is the response code of the answer, or -1 if the tunnel was closed before the query
+	// was answered.
+	Rcode int
+}
+
+// A QueryLogger records every query served by the tunnel, e.g. to keep an audit log apart from
+// the messages that are delivered. LogQuery is called by ServeDNS once the query is answered,
+// from many goroutines at once, so it should be quick.
+type QueryLogger interface {
+	LogQuery(QueryRecord)
+}
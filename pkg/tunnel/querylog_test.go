@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingQueryLog is a QueryLogger that keeps the records it is told about.
+type recordingQueryLog struct {
+	mu      sync.Mutex
+	records []QueryRecord
+}
+
+func (l *recordingQueryLog) LogQuery(rec QueryRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, rec)
+}
+
+func TestQueryLog(t *testing.T) {
+	log := &recordingQueryLog{}
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", RateLimit: 0.001, RateBurst: 1, QueryLog: log})
+	defer tun.Close()
+
+	tests := []struct {
+		name        string
+		qtype       uint16
+		disposition Disposition
+		rcode       int
+	}{
+		{"tunnel.example.com.", dns.TypeSOA, DispositionZone, dns.RcodeSuccess},
+		{"Scan.Tunnel.Example.com.", dns.TypeANY, DispositionOtherType, dns.RcodeSuccess},
+		{"poll-x7f2.c1.FAIL.0.tunnel.example.com.", dns.TypeTXT, DispositionMalformed, dns.RcodeSuccess},
+		{"hb-x7f2.c1.tunnel.example.com.", dns.TypeA, DispositionHeartbeat, dns.RcodeSuccess},
+		{"2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA, DispositionFragment, dns.RcodeSuccess},
+		{"abcdef.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA, DispositionRateLimited, dns.RcodeRefused},
+	}
+	for _, test := range tests {
+		r := &dns.Msg{}
+		r.SetQuestion(test.name, test.qtype)
+		tun.ServeDNS(&testResponseWriter{}, r)
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	require.Len(t, log.records, len(tests))
+	for i, test := range tests {
+		rec := log.records[i]
+		require.Equal(t, test.name, rec.Name)
+		require.Equal(t, test.qtype, rec.Type)
+		require.Equal(t, test.disposition, rec.Disposition, test.name)
+		require.Equal(t, test.rcode, rec.Rcode, test.name)
+		require.Equal(t, "192.0.2.1", rec.Source.String())
+		require.False(t, rec.Time.IsZero())
+	}
+}
+
+func TestQueryLogTenant(t *testing.T) {
+	log := &recordingQueryLog{}
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", Tenants: []Tenant{{Name: "alpha"}}, QueryLog: log})
+	defer tun.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.Alpha.tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(&testResponseWriter{}, r)
+	require.Equal(t, "hello world", string((<-tun.Messages()).Payload))
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	require.Len(t, log.records, 1)
+	require.Equal(t, "alpha", log.records[0].Tenant)
+	require.Equal(t, DispositionFragment, log.records[0].Disposition)
+}
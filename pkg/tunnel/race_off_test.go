@@ -0,0 +1,6 @@
+//go:build !race
+
+package tunnel
+
+// raceEnabled reports whether tests run with the race detector, whose instrumentation allocates.
+const raceEnabled = false
@@ -0,0 +1,28 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow("192.0.2.1", now))
+	}
+	require.False(t, l.allow("192.0.2.1", now))
+	require.True(t, l.allow("192.0.2.2", now))
+
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, l.allow("192.0.2.1", now))
+	require.False(t, l.allow("192.0.2.1", now))
+
+	l.prune(now)
+	require.Len(t, l.buckets, 1)
+	l.prune(now.Add(2 * time.Second))
+	require.Len(t, l.buckets, 0)
+}
@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"fmt"
+	"math"
+	"net"
+)
+
+// Settings are the parts of a Config that can be changed while a tunnel is running, with
+// Reconfigure. Their fields are documented on Config.
+type Settings struct {
+	RateLimit  float64
+	RateBurst  int
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+	Response   Response
+}
+
+// settings is the validated form of Settings that queries are handled with. It is replaced as a
+// whole by Reconfigure, and never modified in place.
+type settings struct {
+	Settings
+	limiter *rateLimiter
+	acl     acl
+}
+
+// newSettings validates s and fills in defaults. The rate limiter of prev, if any, is kept if
+// the rate limit is unchanged, so that its buckets aren't refilled.
+func newSettings(s Settings, prev *settings) (*settings, error) {
+	if s.RateLimit < 0 || s.RateBurst < 0 {
+		return nil, fmt.Errorf("Rate limit and burst must not be negative")
+	}
+	if s.RateBurst == 0 {
+		s.RateBurst = int(math.Ceil(s.RateLimit))
+	}
+	if err := s.Response.validate(); err != nil {
+		return nil, err
+	}
+	st := &settings{Settings: s, acl: acl{allow: s.AllowCIDRs, deny: s.DenyCIDRs}}
+	if s.RateLimit > 0 {
+		if prev != nil && prev.limiter != nil && prev.RateLimit == s.RateLimit && prev.RateBurst == s.RateBurst {
+			st.limiter = prev.limiter
+		} else {
+			st.limiter = newRateLimiter(s.RateLimit, s.RateBurst)
+		}
+	}
+	return st, nil
+}
+
+// Reconfigure replaces the rate limit, CIDR lists and response of a running tunnel. Partial
+// messages are unaffected. If s is invalid, an error is returned and the current settings are
+// kept.
+func (tun *Tunnel) Reconfigure(s Settings) error {
+	st, err := newSettings(s, tun.settings.Load())
+	if err != nil {
+		return err
+	}
+	tun.settings.Store(st)
+	return nil
+}
@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconfigure(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", RateLimit: 0.001, RateBurst: 5})
+	defer tun.Close()
+
+	serve := func(domain string) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(domain, dns.TypeA)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, req)
+		return w.msg
+	}
+	m := serve("2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com.")
+	require.IsType(t, &dns.CNAME{}, m.Answer[0])
+
+	// Keeping the rate limit keeps the buckets, and the partial message survives.
+	limiter := tun.settings.Load().limiter
+	deny, err := ParseCIDRs([]string{"198.51.100.0/24"})
+	require.Nil(t, err)
+	require.Nil(t, tun.Reconfigure(Settings{
+		RateLimit: 0.001,
+		RateBurst: 5,
+		DenyCIDRs: deny,
+		Response:  Response{Mode: ResponseAddress, Addresses: []net.IP{net.ParseIP("192.0.2.10")}, TTL: 30},
+	}))
+	require.Same(t, limiter, tun.settings.Load().limiter)
+	m = serve("2jkhm3.24.12.64tmmq000000.tunnel.example.com.")
+	require.Equal(t, "192.0.2.10", m.Answer[0].(*dns.A).A.String())
+	require.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+
+	// Invalid settings are rejected, and the current ones are kept.
+	require.NotNil(t, tun.Reconfigure(Settings{RateLimit: -1}))
+	require.NotNil(t, tun.Reconfigure(Settings{Response: Response{Mode: ResponseAddress}}))
+	require.Equal(t, uint32(30), tun.settings.Load().Response.TTL)
+
+	deny, err = ParseCIDRs([]string{"192.0.2.0/24"})
+	require.Nil(t, err)
+	require.Nil(t, tun.Reconfigure(Settings{DenyCIDRs: deny}))
+	require.Nil(t, tun.settings.Load().limiter)
+	m = serve("abcdef.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.")
+	require.Equal(t, dns.RcodeRefused, m.Rcode)
+}
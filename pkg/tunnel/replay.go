@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"strings"
+	"time"
+)
+
+// A Delivered records that a message was delivered, so that replays of its fragments are ignored
+// until the end of the dedup window.
+type Delivered struct {
+	ID string
+	// Tenant is the name of the tenant the message was sent to, if tenants are configured.
+	Tenant string
+	// Until is the end of the dedup window.
+	Until time.Time
+}
+
+// A ReplayStore persists the messages delivered within the dedup window, so that an observer
+// who recorded their queries can't replay them right after a restart. Methods are called while a
+// shard of the tunnel's internal map of messages is locked, and may be called by several workers
+// at once, so they should be fast and safe for concurrent use.
+type ReplayStore interface {
+	// PutDelivered records a delivered message, replacing any record of the same message.
+	PutDelivered(d Delivered) error
+	// DeleteDelivered removes the record of message id of tenant.
+	DeleteDelivered(tenant, id string) error
+	// LoadDelivered returns every record.
+	LoadDelivered() ([]Delivered, error)
+}
+
+// splitListKey returns the tenant and message ID that key was made from by listKey.
+func (tun *Tunnel) splitListKey(key string) (string, string) {
+	if len(tun.tenants) == 0 {
+		return "", key
+	}
+	tenant, id, _ := strings.Cut(key, ".")
+	return tenant, id
+}
+
+// markDelivered records that the message under key in sh, whose lock must be held, was
+// delivered, if a dedup window is configured.
+func (tun *Tunnel) markDelivered(sh *shard, key string, now time.Time) {
+	if tun.dedupWindow <= 0 {
+		return
+	}
+	until := now.Add(tun.dedupWindow)
+	sh.delivered[key] = until
+	if tun.replayStore != nil {
+		tenant, id := tun.splitListKey(key)
+		if err := tun.replayStore.PutDelivered(Delivered{ID: id, Tenant: tenant, Until: until}); err != nil {
+			tun.logger.Warn("Failed to update replay store", "id", id, "error", err)
+		}
+	}
+}
+
+// forgetDelivered removes the record of the message under key from sh, whose lock must be held,
+// once its dedup window has ended.
+func (tun *Tunnel) forgetDelivered(sh *shard, key string) {
+	delete(sh.delivered, key)
+	if tun.replayStore != nil {
+		tenant, id := tun.splitListKey(key)
+		if err := tun.replayStore.DeleteDelivered(tenant, id); err != nil {
+			tun.logger.Warn("Failed to update replay store", "id", id, "error", err)
+		}
+	}
+}
+
+// restoreDelivered loads the messages delivered within their dedup window from tun.replayStore.
+// Records whose window ended while the process wasn't running are deleted. It is called before
+// any worker is started, so shards aren't locked.
+func (tun *Tunnel) restoreDelivered() error {
+	records, err := tun.replayStore.LoadDelivered()
+	if err != nil {
+		return err
+	}
+	now := tun.clock.Now()
+	for _, d := range records {
+		if d.Until.Before(now) {
+			if err := tun.replayStore.DeleteDelivered(d.Tenant, d.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		key := listKey(d.Tenant, d.ID)
+		tun.shardOf(key).delivered[key] = d.Until
+	}
+	return nil
+}
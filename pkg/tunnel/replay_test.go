@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memReplayStore is a ReplayStore held in memory.
+type memReplayStore struct {
+	mu      sync.Mutex
+	records map[string]Delivered
+}
+
+func newMemReplayStore() *memReplayStore {
+	return &memReplayStore{records: make(map[string]Delivered)}
+}
+
+func (s *memReplayStore) PutDelivered(d Delivered) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[listKey(d.Tenant, d.ID)] = d
+	return nil
+}
+
+func (s *memReplayStore) DeleteDelivered(tenant, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, listKey(tenant, id))
+	return nil
+}
+
+func (s *memReplayStore) LoadDelivered() ([]Delivered, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []Delivered
+	for _, d := range s.records {
+		records = append(records, d)
+	}
+	return records, nil
+}
+
+func TestReplayStore(t *testing.T) {
+	store := newMemReplayStore()
+	cfg := Config{
+		TopDomain:   "tunnel.example.com.",
+		Tenants:     []Tenant{{Name: "alpha"}},
+		DedupWindow: time.Minute,
+		ReplayStore: store,
+	}
+	tun := newTestTunnel(t, cfg)
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.alpha.tunnel.example.com."}
+	<-tun.Messages()
+	tun.Close()
+	require.Contains(t, store.records, "alpha.2jkhm3")
+	require.Equal(t, "2jkhm3", store.records["alpha.2jkhm3"].ID)
+	require.Equal(t, "alpha", store.records["alpha.2jkhm3"].Tenant)
+
+	// Records whose window ended are deleted on restart.
+	require.Nil(t, store.PutDelivered(Delivered{ID: "old", Tenant: "alpha", Until: time.Now().Add(-time.Second)}))
+
+	// The message is still recognized as a replay after a restart.
+	tun = newTestTunnel(t, cfg)
+	defer tun.Close()
+	require.NotContains(t, store.records, "alpha.old")
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.alpha.tunnel.example.com."}
+	tun.domains <- query{name: "abcdef.24.0.nbswy3dpeb3w64tmmq000000.alpha.tunnel.example.com."}
+	require.Equal(t, "abcdef", (<-tun.Messages()).ID)
+	require.Equal(t, uint64(1), tun.Stats().Replayed)
+}
+
+func TestReplayStoreExpired(t *testing.T) {
+	store := newMemReplayStore()
+	tun := newTestTunnel(t, Config{
+		TopDomain:        "tunnel.example.com.",
+		DedupWindow:      10 * time.Millisecond,
+		DeletionInterval: 5 * time.Millisecond,
+		ReplayStore:      store,
+	})
+	defer tun.Close()
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}
+	<-tun.Messages()
+	require.Eventually(t, func() bool {
+		records, _ := store.LoadDelivered()
+		return len(records) == 0
+	}, time.Second, time.Millisecond)
+}
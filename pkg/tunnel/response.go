@@ -0,0 +1,217 @@
+package tunnel
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultCNAMETarget is the CNAME target queries are answered with by default.
+const DefaultCNAMETarget = "blackhole-1.iana.org."
+
+// DefaultMinNegativeTTL and DefaultMaxNegativeTTL bound the negative TTLs of ResponseStealth by
+// default, in seconds.
+const (
+	DefaultMinNegativeTTL = 300
+	DefaultMaxNegativeTTL = 3600
+)
+
+// A ResponseMode selects how queries other than TXT queries are answered.
+type ResponseMode int
+
+const (
+	// ResponseCNAME answers with a CNAME to Response.Target.
+	ResponseCNAME ResponseMode = iota
+	// ResponseAddress answers A and AAAA queries with an address picked at random from
+	// Response.Addresses, and other queries with NODATA.
+	ResponseAddress
+	// ResponseNXDomain answers with NXDOMAIN.
+	ResponseNXDomain
+	// ResponseNoData answers with NOERROR and no records.
+	ResponseNoData
+	// ResponseStealth answers every query for a name under a top domain with NXDOMAIN, like a
+	// zone without the name would, including TXT queries that carry no downstream message or
+	// acknowledgement. The SOA record in the authority section of each answer has a negative TTL
+	// picked at random between Response.MinNegativeTTL and MaxNegativeTTL, as if it came from a
+	// cache, so that answers don't carry the fixed fingerprint of the other modes. Resolvers
+	// cache the NXDOMAIN for that long, so clients must not repeat the names of queries.
+	ResponseStealth
+)
+
+// A Response describes how the tunnel answers queries. TXT queries are always answered with a
+// TXT record, which carries downstream messages and acknowledgements.
+type Response struct {
+	Mode ResponseMode
+	// Target is the CNAME target of ResponseCNAME. Defaults to DefaultCNAMETarget.
+	Target string
+	// Addresses is the pool of addresses of ResponseAddress. AAAA queries are answered with
+	// NODATA if it holds no IPv6 addresses, and likewise for A queries and IPv4 addresses.
+	Addresses []net.IP
+	// TTL is the TTL of every record in an answer. Defaults to 0, so that resolvers don't cache
+	// answers.
+	TTL uint32
+	// TTLs overrides TTL in the answers to queries of some types, keyed by query type, e.g. to let
+	// resolvers cache the answers to AAAA queries, which carry nothing, but not TXT answers.
+	TTLs map[uint16]uint32
+	// NegativeTTL, if set, is the TTL and minimum of the SOA record of negative answers, which
+	// tells resolvers how long to cache them. It defaults to the TTL of the query's type, and
+	// doesn't apply to ResponseStealth, whose negative TTLs are random.
+	NegativeTTL uint32
+	// MinNegativeTTL and MaxNegativeTTL bound the negative TTLs of ResponseStealth, in seconds.
+	// They default to DefaultMinNegativeTTL and DefaultMaxNegativeTTL.
+	MinNegativeTTL uint32
+	MaxNegativeTTL uint32
+}
+
+// ParseResponse parses a response mode as passed on the command line: cname[:target],
+// a:address[,address...], nxdomain, nodata or stealth[:minTTL-maxTTL].
+func ParseResponse(s string) (Response, error) {
+	mode, arg, _ := strings.Cut(s, ":")
+	switch strings.ToLower(mode) {
+	case "cname":
+		return Response{Mode: ResponseCNAME, Target: arg}, nil
+	case "a":
+		var r Response
+		r.Mode = ResponseAddress
+		for _, addr := range strings.Split(arg, ",") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return Response{}, fmt.Errorf("Invalid address %q in response %q", addr, s)
+			}
+			r.Addresses = append(r.Addresses, ip)
+		}
+		return r, nil
+	case "nxdomain":
+		return Response{Mode: ResponseNXDomain}, nil
+	case "nodata":
+		return Response{Mode: ResponseNoData}, nil
+	case "stealth":
+		r := Response{Mode: ResponseStealth}
+		if arg == "" {
+			return r, nil
+		}
+		lo, hi, ok := strings.Cut(arg, "-")
+		minTTL, err := strconv.ParseUint(lo, 10, 32)
+		if err != nil || !ok {
+			return Response{}, fmt.Errorf("Invalid negative TTLs %q in response %q, expected minTTL-maxTTL", arg, s)
+		}
+		maxTTL, err := strconv.ParseUint(hi, 10, 32)
+		if err != nil {
+			return Response{}, fmt.Errorf("Invalid negative TTLs %q in response %q, expected minTTL-maxTTL", arg, s)
+		}
+		r.MinNegativeTTL, r.MaxNegativeTTL = uint32(minTTL), uint32(maxTTL)
+		return r, nil
+	default:
+		return Response{}, fmt.Errorf("Unknown response mode %q", mode)
+	}
+}
+
+// validate checks r and fills in defaults.
+func (r *Response) validate() error {
+	switch r.Mode {
+	case ResponseCNAME:
+		if r.Target == "" {
+			r.Target = DefaultCNAMETarget
+		}
+		r.Target = dns.Fqdn(r.Target)
+		if _, ok := dns.IsDomainName(r.Target); !ok {
+			return fmt.Errorf("Invalid CNAME target %q", r.Target)
+		}
+	case ResponseAddress:
+		if len(r.Addresses) == 0 {
+			return fmt.Errorf("Address responses require at least one address")
+		}
+	case ResponseStealth:
+		if r.NegativeTTL != 0 {
+			return fmt.Errorf("Stealth responses have random negative TTLs, bounded by their minimum and maximum")
+		}
+		if r.MinNegativeTTL == 0 {
+			r.MinNegativeTTL = DefaultMinNegativeTTL
+		}
+		if r.MaxNegativeTTL == 0 {
+			r.MaxNegativeTTL = max(DefaultMaxNegativeTTL, r.MinNegativeTTL)
+		}
+		if r.MinNegativeTTL > r.MaxNegativeTTL {
+			return fmt.Errorf("Minimum negative TTL %d exceeds the maximum of %d", r.MinNegativeTTL, r.MaxNegativeTTL)
+		}
+	case ResponseNXDomain, ResponseNoData:
+	default:
+		return fmt.Errorf("Unknown response mode %d", r.Mode)
+	}
+	return nil
+}
+
+// answer fills m, a reply to a query for domain of type qtype, as configured by r.
+func (r Response) answer(m *dns.Msg, domain string, qtype uint16) {
+	hdr := dns.RR_Header{Name: domain, Rrtype: qtype, Class: dns.ClassINET, Ttl: r.ttl(qtype)}
+	switch r.Mode {
+	case ResponseCNAME:
+		hdr.Rrtype = dns.TypeCNAME
+		m.Answer = []dns.RR{&dns.CNAME{Hdr: hdr, Target: r.Target}}
+	case ResponseAddress:
+		if ip := r.pick(qtype == dns.TypeAAAA); ip != nil && qtype == dns.TypeA {
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip}}
+		} else if ip != nil && qtype == dns.TypeAAAA {
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+		}
+	case ResponseNXDomain, ResponseStealth:
+		m.Rcode = dns.RcodeNameError
+	}
+}
+
+// ttl returns the TTL of the records answering a query of type qtype.
+func (r Response) ttl(qtype uint16) uint32 {
+	if ttl, ok := r.TTLs[qtype]; ok {
+		return ttl
+	}
+	return r.TTL
+}
+
+// negativeTTL returns the TTL of the SOA record of negative answers to queries of type qtype,
+// which is random with ResponseStealth, and NegativeTTL or the TTL of other records otherwise.
+func (r Response) negativeTTL(qtype uint16) uint32 {
+	if r.Mode != ResponseStealth && r.NegativeTTL != 0 {
+		return r.NegativeTTL
+	}
+	if r.Mode != ResponseStealth {
+		return r.ttl(qtype)
+	}
+	return r.MinNegativeTTL + uint32(rand.Int63n(int64(r.MaxNegativeTTL-r.MinNegativeTTL)+1))
+}
+
+// ParseTTLs parses TTLs of query types as passed on the command line, each as TYPE=SECONDS, e.g.
+// AAAA=3600.
+func ParseTTLs(specs []string) (map[uint16]uint32, error) {
+	ttls := make(map[uint16]uint32, len(specs))
+	for _, spec := range specs {
+		name, seconds, ok := strings.Cut(spec, "=")
+		qtype, known := dns.StringToType[strings.ToUpper(name)]
+		if !ok || !known {
+			return nil, fmt.Errorf("Invalid TTL %q, expected TYPE=SECONDS", spec)
+		}
+		ttl, err := strconv.ParseUint(seconds, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TTL %q: %w", spec, err)
+		}
+		ttls[qtype] = uint32(ttl)
+	}
+	return ttls, nil
+}
+
+// pick returns a random IPv4 or IPv6 address from the pool, or nil if there are none.
+func (r Response) pick(v6 bool) net.IP {
+	var pool []net.IP
+	for _, ip := range r.Addresses {
+		if (ip.To4() == nil) == v6 {
+			pool = append(pool, ip)
+		}
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+	return pool[rand.Intn(len(pool))]
+}
@@ -0,0 +1,199 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		input  string
+		output Response
+		fails  bool
+	}{
+		{input: "cname", output: Response{Mode: ResponseCNAME}},
+		{input: "cname:cdn.example.net", output: Response{Mode: ResponseCNAME, Target: "cdn.example.net"}},
+		{input: "a:192.0.2.1,2001:db8::1", output: Response{Mode: ResponseAddress, Addresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}}},
+		{input: "NXDOMAIN", output: Response{Mode: ResponseNXDomain}},
+		{input: "nodata", output: Response{Mode: ResponseNoData}},
+		{input: "stealth", output: Response{Mode: ResponseStealth}},
+		{input: "stealth:60-120", output: Response{Mode: ResponseStealth, MinNegativeTTL: 60, MaxNegativeTTL: 120}},
+		{input: "stealth:60", fails: true},
+		{input: "stealth:60-x", fails: true},
+		{input: "a:", fails: true},
+		{input: "a:192.0.2.300", fails: true},
+		{input: "refused", fails: true},
+	}
+	for _, test := range tests {
+		got, err := ParseResponse(test.input)
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+			require.Equal(t, test.output, got)
+		}
+	}
+}
+
+func TestResponse(t *testing.T) {
+	pool := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	tests := []struct {
+		response Response
+		qtype    uint16
+		rcode    int
+		answer   dns.RR
+	}{
+		{
+			response: Response{},
+			qtype:    dns.TypeA,
+			answer:   &dns.CNAME{Target: DefaultCNAMETarget},
+		},
+		{
+			response: Response{Mode: ResponseCNAME, Target: "cdn.example.net", TTL: 300},
+			qtype:    dns.TypeMX,
+			answer:   &dns.CNAME{Target: "cdn.example.net."},
+		},
+		{
+			response: Response{Mode: ResponseAddress, Addresses: pool[:1]},
+			qtype:    dns.TypeA,
+			answer:   &dns.A{A: pool[0]},
+		},
+		{
+			response: Response{Mode: ResponseAddress, Addresses: pool},
+			qtype:    dns.TypeAAAA,
+		},
+		{
+			response: Response{Mode: ResponseNXDomain},
+			qtype:    dns.TypeA,
+			rcode:    dns.RcodeNameError,
+		},
+		{
+			response: Response{Mode: ResponseNoData},
+			qtype:    dns.TypeAAAA,
+		},
+	}
+	for _, test := range tests {
+		tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Response: test.response})
+		req := &dns.Msg{}
+		req.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", test.qtype)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, req)
+		tun.Close()
+
+		require.Equal(t, test.rcode, w.msg.Rcode)
+		if test.answer == nil {
+			require.Empty(t, w.msg.Answer)
+			continue
+		}
+		require.Len(t, w.msg.Answer, 1)
+		require.Equal(t, test.response.TTL, w.msg.Answer[0].Header().Ttl)
+		switch expected := test.answer.(type) {
+		case *dns.CNAME:
+			require.Equal(t, expected.Target, w.msg.Answer[0].(*dns.CNAME).Target)
+		case *dns.A:
+			require.True(t, expected.A.Equal(w.msg.Answer[0].(*dns.A).A))
+		}
+	}
+
+	_, err := New(Config{TopDomain: "tunnel.example.com.", Response: Response{Mode: ResponseAddress}})
+	require.NotNil(t, err)
+}
+
+func TestStealthResponse(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain: "tunnel.example.com.",
+		Response:  Response{Mode: ResponseStealth, MinNegativeTTL: 60, MaxNegativeTTL: 120},
+		Authority: Authority{Nameservers: []Nameserver{{Name: "ns1.example.com"}}},
+	})
+	defer tun.Close()
+
+	ttls := map[uint32]bool{}
+	for i, qtype := range []uint16{dns.TypeA, dns.TypeTXT, dns.TypeCAA, dns.TypeA, dns.TypeTXT, dns.TypeMX, dns.TypeA, dns.TypeA} {
+		req := &dns.Msg{}
+		req.SetQuestion(fmt.Sprintf("2jkhm%d.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", i), qtype)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, req)
+
+		// Fragments and other queries alike are answered like names missing from the zone.
+		require.Equal(t, dns.RcodeNameError, w.msg.Rcode)
+		require.Empty(t, w.msg.Answer)
+		require.True(t, w.msg.Authoritative)
+		require.Len(t, w.msg.Ns, 1)
+		soa := w.msg.Ns[0].(*dns.SOA)
+		require.Equal(t, "ns1.example.com.", soa.Ns)
+		require.GreaterOrEqual(t, soa.Hdr.Ttl, uint32(60))
+		require.LessOrEqual(t, soa.Hdr.Ttl, uint32(120))
+		ttls[soa.Hdr.Ttl] = true
+	}
+	require.Greater(t, len(ttls), 1)
+
+	// The apex still answers like an authoritative server.
+	req := &dns.Msg{}
+	req.SetQuestion("tunnel.example.com.", dns.TypeSOA)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+	require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+	require.Len(t, w.msg.Answer, 1)
+
+	_, err := New(Config{TopDomain: "tunnel.example.com.", Response: Response{Mode: ResponseStealth, MinNegativeTTL: 120, MaxNegativeTTL: 60}})
+	require.NotNil(t, err)
+}
+
+func TestResponseTTLs(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain: "tunnel.example.com.",
+		Response:  Response{Mode: ResponseNoData, TTL: 5, TTLs: map[uint16]uint32{dns.TypeTXT: 0, dns.TypeMX: 600}, NegativeTTL: 900},
+	})
+	defer tun.Close()
+
+	tests := []struct {
+		qtype uint16
+		ttl   uint32
+	}{
+		{qtype: dns.TypeTXT, ttl: 0},
+		{qtype: dns.TypeA, ttl: 5},
+		{qtype: dns.TypeMX, ttl: 600},
+	}
+	for i, test := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(fmt.Sprintf("2jkhm%d.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", i), test.qtype)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, req)
+		if test.qtype == dns.TypeTXT {
+			require.Len(t, w.msg.Answer, 1)
+			require.Equal(t, test.ttl, w.msg.Answer[0].Header().Ttl)
+			continue
+		}
+		// Negative answers carry the SOA with the negative TTL, whatever the type.
+		require.Empty(t, w.msg.Answer)
+		soa := w.msg.Ns[0].(*dns.SOA)
+		require.EqualValues(t, 900, soa.Hdr.Ttl)
+		require.EqualValues(t, 900, soa.Minttl)
+	}
+
+	// Without a negative TTL, the SOA takes the TTL of the query's type.
+	require.Nil(t, tun.Reconfigure(Settings{Response: Response{Mode: ResponseNoData, TTLs: map[uint16]uint32{dns.TypeMX: 600}}}))
+	req := &dns.Msg{}
+	req.SetQuestion("2jkhm9.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeMX)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+	require.EqualValues(t, 600, w.msg.Ns[0].(*dns.SOA).Minttl)
+
+	_, err := New(Config{TopDomain: "tunnel.example.com.", Response: Response{Mode: ResponseStealth, NegativeTTL: 60}})
+	require.NotNil(t, err)
+}
+
+func TestParseTTLs(t *testing.T) {
+	ttls, err := ParseTTLs([]string{"a=60", "AAAA=3600", "TXT=0"})
+	require.Nil(t, err)
+	require.Equal(t, map[uint16]uint32{dns.TypeA: 60, dns.TypeAAAA: 3600, dns.TypeTXT: 0}, ttls)
+
+	for _, spec := range []string{"A", "BOGUS=60", "A=-1", "A=x"} {
+		_, err := ParseTTLs([]string{spec})
+		require.NotNil(t, err, spec)
+	}
+}
@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Default values of Config.SessionTimeout and Config.SessionHeartbeat.
+const (
+	DefaultSessionTimeout   = 5 * time.Minute
+	DefaultSessionHeartbeat = time.Minute
+)
+
+// A SessionEventType is the kind of a SessionEvent.
+type SessionEventType int
+
+const (
+	// SessionStart is reported when the first message of a session is assembled.
+	SessionStart SessionEventType = iota
+	// SessionHeartbeat is reported periodically while a session keeps sending messages.
+	SessionHeartbeat
+	// SessionEnd is reported once a session hasn't sent a message for Config.SessionTimeout.
+	SessionEnd
+)
+
+func (t SessionEventType) String() string {
+	switch t {
+	case SessionStart:
+		return "start"
+	case SessionHeartbeat:
+		return "heartbeat"
+	case SessionEnd:
+		return "end"
+	}
+	return "unknown"
+}
+
+// A SessionEvent reports a change in the lifecycle of a session, as described on
+// Tunnel.Sessions.
+type SessionEvent struct {
+	Type SessionEventType
+	// Session is the label of the session, as chosen by the client.
+	Session string
+	// Tenant is the name of the tenant the session's messages were sent to, if tenants are
+	// configured.
+	Tenant string
+	// Source is the IP address that the latest message of the session was received from.
+	Source net.IP
+	// Time is when the event was reported.
+	Time time.Time
+	// Started and LastMessage are the times the first and latest messages of the session were
+	// assembled.
+	Started     time.Time
+	LastMessage time.Time
+	// Messages and Bytes count the messages assembled in the session so far, and the bytes of
+	// their payloads.
+	Messages int
+	Bytes    int
+}
+
+// A session is the state of an active session.
+type session struct {
+	SessionEvent
+	// lastEvent is when the latest event of the session was reported, and recent the number of
+	// messages assembled since then.
+	lastEvent time.Time
+	recent    int
+}
+
+// A sessionTracker follows the sessions that sent messages recently, keyed by listKey.
+type sessionTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func newSessionTracker(timeout, interval time.Duration) *sessionTracker {
+	return &sessionTracker{sessions: make(map[string]*session), timeout: timeout, interval: interval}
+}
+
+// observe records msg, which must belong to a session, and returns the SessionStart event to
+// report if it is the first message of its session.
+func (st *sessionTracker) observe(msg Message, now time.Time) (SessionEvent, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := listKey(msg.Tenant, msg.Session)
+	s, ok := st.sessions[key]
+	if !ok {
+		s = &session{SessionEvent: SessionEvent{Session: msg.Session, Tenant: msg.Tenant, Started: now}, lastEvent: now}
+		st.sessions[key] = s
+	} else {
+		s.recent++
+	}
+	s.Source = msg.Source
+	s.LastMessage = now
+	s.Messages++
+	s.Bytes += len(msg.Payload)
+	if ok {
+		return SessionEvent{}, false
+	}
+	return s.event(SessionStart, now), true
+}
+
+// event returns an event of type t describing s at now.
+func (s *session) event(t SessionEventType, now time.Time) SessionEvent {
+	e := s.SessionEvent
+	e.Type = t
+	e.Time = now
+	return e
+}
+
+// sweep ends the sessions that timed out, and returns their SessionEnd events along with the
+// SessionHeartbeat events of those that are due one.
+func (st *sessionTracker) sweep(now time.Time) []SessionEvent {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var events []SessionEvent
+	for key, s := range st.sessions {
+		switch {
+		case now.Sub(s.LastMessage) >= st.timeout:
+			delete(st.sessions, key)
+			events = append(events, s.event(SessionEnd, now))
+		case s.recent > 0 && now.Sub(s.lastEvent) >= st.interval:
+			s.lastEvent, s.recent = now, 0
+			events = append(events, s.event(SessionHeartbeat, now))
+		}
+	}
+	return events
+}
+
+// len returns the number of active sessions.
+func (st *sessionTracker) len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+// Sessions returns the channel on which the lifecycle of client sessions is reported. Clients
+// label the messages sent within a session with Encoder.Session, which the messages carry in
+// Message.Session. The first message of a session is reported as a SessionStart event, a
+// SessionHeartbeat is reported every Config.SessionHeartbeat for as long as the session keeps
+// sending messages, and a SessionEnd once it hasn't sent any for Config.SessionTimeout. Like
+// expired messages, events are dropped if nobody is reading from the channel. The channel is
+// closed by Close.
+func (tun *Tunnel) Sessions() <-chan SessionEvent {
+	return tun.sessionEvents
+}
+
+// notifySession reports a session event without blocking.
+func (tun *Tunnel) notifySession(e SessionEvent) {
+	select {
+	case tun.sessionEvents <- e:
+	default:
+	}
+}
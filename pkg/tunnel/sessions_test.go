@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com", SessionTimeout: time.Minute, SessionHeartbeat: 10 * time.Second})
+	defer tun.Close()
+
+	enc := Encoder{LabelLen: 63, Version: Version2, Session: "tab1"}
+	for _, id := range []string{"aaaaaa", "bbbbbb"} {
+		domains, err := enc.Encode("tunnel.example.com.", id, "hello world")
+		require.Nil(t, err)
+		tun.domains <- query{name: domains[0], receivedAt: time.Now()}
+		msg := <-tun.Messages()
+		require.Equal(t, "tab1", msg.Session)
+		require.Equal(t, "hello world", string(msg.Payload))
+	}
+	// Messages outside of a session don't start one.
+	tun.domains <- query{name: "cccccc.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", receivedAt: time.Now()}
+	require.Equal(t, "", (<-tun.Messages()).Session)
+
+	start := <-tun.Sessions()
+	require.Equal(t, SessionStart, start.Type)
+	require.Equal(t, "tab1", start.Session)
+	require.Equal(t, 1, start.Messages)
+	require.Equal(t, 1, tun.Stats().Sessions)
+
+	// A heartbeat reports the messages since the start, and the session then ends once it times
+	// out.
+	now := time.Now()
+	require.Empty(t, tun.sessions.sweep(now))
+	events := tun.sessions.sweep(now.Add(15 * time.Second))
+	require.Len(t, events, 1)
+	require.Equal(t, SessionHeartbeat, events[0].Type)
+	require.Equal(t, 2, events[0].Messages)
+	require.Equal(t, 2*len("hello world"), events[0].Bytes)
+	require.Empty(t, tun.sessions.sweep(now.Add(30*time.Second)))
+	events = tun.sessions.sweep(now.Add(2 * time.Minute))
+	require.Len(t, events, 1)
+	require.Equal(t, SessionEnd, events[0].Type)
+	require.Equal(t, start.Started, events[0].Started)
+	require.Equal(t, 0, tun.Stats().Sessions)
+}
+
+func TestSessionLabel(t *testing.T) {
+	fg, err := parseDomain("tunnel.example.com.", "v2-10.tab1.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", parseRules{maxMessageSize: DefaultMaxMessageSize})
+	require.Nil(t, err)
+	require.Equal(t, "tab1", fg.framing.session)
+	require.Equal(t, "2jkhm3", fg.id)
+
+	_, err = parseDomain("tunnel.example.com.", "v2-10.2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", parseRules{maxMessageSize: DefaultMaxMessageSize})
+	require.NotNil(t, err)
+
+	// Fragments of a message must agree on its session.
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com"})
+	defer tun.Close()
+	_, ok := tun.handleQuery(query{name: "v2-10.tab1.2jkhm3.24.0.nbswy3dp.tunnel.example.com.", receivedAt: time.Now()})
+	require.True(t, ok)
+	_, ok = tun.handleQuery(query{name: "v2-10.tab2.2jkhm3.24.8.eb3w64tmmq000000.tunnel.example.com.", receivedAt: time.Now()})
+	require.False(t, ok)
+}
@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardCount is the number of shards the fragment lists are split into. Fragments of different
+// messages are usually in different shards, so that workers rarely wait for each other.
+const shardCount = 64
+
+// A shard holds the fragment lists and delivered messages whose keys hash to it.
+type shard struct {
+	mu    sync.Mutex
+	lists map[string]*fragmentList
+	// lru holds the keys of lists, from the least to the most recently updated.
+	lru *list.List
+	// delivered maps the keys of recently delivered messages to the end of their dedup window.
+	delivered map[string]time.Time
+}
+
+func newShards() []*shard {
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{lists: make(map[string]*fragmentList), lru: list.New(), delivered: make(map[string]time.Time)}
+	}
+	return shards
+}
+
+// shardOf returns the shard holding the fragment list under key.
+func (tun *Tunnel) shardOf(key string) *shard {
+	// Messages that collided with another share its shard, so that they can be found together.
+	key, _, _ = strings.Cut(key, collisionSeparator)
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return tun.shards[h.Sum32()%uint32(len(tun.shards))]
+}
+
+// inFlight returns the number of partial messages held in memory.
+func (tun *Tunnel) inFlight() int {
+	return int(tun.partials.Load())
+}
+
+// addList records a new fragment list under key in sh, whose lock must be held.
+func (tun *Tunnel) addList(sh *shard, key string, fgList *fragmentList) {
+	fgList.elem = sh.lru.PushBack(key)
+	sh.lists[key] = fgList
+	tun.partials.Add(1)
+}
+
+// putFragment adds fg to fgList, replacing any fragment at the same offset, and marks the list as
+// the most recently updated of sh, whose lock must be held.
+func (tun *Tunnel) putFragment(sh *shard, fgList *fragmentList, fg fragment) {
+	before := fgList.size
+	fgList.put(fg)
+	if fgList.framing.flags&FlagParity != 0 {
+		atomic.AddUint64(&tun.stats.Recovered, uint64(fgList.recover()))
+	}
+	tun.bufferedBytes.Add(int64(fgList.size - before))
+	sh.lru.MoveToBack(fgList.elem)
+}
+
+// deleteList removes the fragment list under key from sh, whose lock must be held.
+func (tun *Tunnel) deleteList(sh *shard, key string) {
+	fgList, ok := sh.lists[key]
+	if !ok {
+		return
+	}
+	delete(sh.lists, key)
+	sh.lru.Remove(fgList.elem)
+	tun.partials.Add(-1)
+	tun.bufferedBytes.Add(-int64(fgList.size))
+	if t := tun.tenants[fgList.tenant]; t != nil {
+		t.inFlight.Add(-1)
+	}
+}
@@ -0,0 +1,53 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkers(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Workers: 8})
+	defer tun.Close()
+
+	const count = 200
+	payload := strings.Repeat("hello world ", 40)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		domains, err := EncodeMessage("tunnel.example.com.", fmt.Sprintf("msg%d", i), payload, 63)
+		require.Nil(t, err)
+		require.Greater(t, len(domains), 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, domain := range domains {
+				tun.domains <- query{name: domain}
+			}
+		}()
+	}
+
+	seen := make(map[string]bool)
+	for len(seen) < count {
+		msg := <-tun.Messages()
+		require.Equal(t, []byte(payload), msg.Payload)
+		require.False(t, seen[msg.ID])
+		seen[msg.ID] = true
+	}
+	wg.Wait()
+	require.Equal(t, 0, tun.Stats().InFlight)
+}
+
+func TestShardOf(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	require.Same(t, tun.shardOf("abc"), tun.shardOf("abc"))
+	used := make(map[*shard]bool)
+	for i := 0; i < 1000; i++ {
+		used[tun.shardOf(fmt.Sprintf("msg%d", i))] = true
+	}
+	require.Greater(t, len(used), shardCount/2)
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// A SigningKey is the Ed25519 public key of a client that signs its messages, as configured by
+// Config.SigningKeys.
+type SigningKey struct {
+	// Identity names the client, and is reported as Message.Signer for the messages it signed.
+	Identity  string
+	PublicKey ed25519.PublicKey
+}
+
+// ParseSigningKey parses a signing key as passed on the command line: identity:publicKey, where
+// the public key is hex encoded.
+func ParseSigningKey(s string) (SigningKey, error) {
+	identity, key, ok := strings.Cut(s, ":")
+	if !ok || identity == "" {
+		return SigningKey{}, fmt.Errorf("Signing key %q is not of the form identity:publicKey", s)
+	}
+	pub, err := hex.DecodeString(key)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("Public key of %s is not hex encoded: %w", identity, err)
+	}
+	return SigningKey{Identity: identity, PublicKey: pub}, nil
+}
+
+// ParsePrivateKey parses a hex encoded Ed25519 private key, or the 32 byte seed it is derived
+// from.
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Private key is not hex encoded: %w", err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	default:
+		return nil, fmt.Errorf("Private key has %d bytes, expected %d or %d", len(key), ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+}
+
+// validateSigningKeys checks that keys are public keys with distinct identities.
+func validateSigningKeys(keys []SigningKey) error {
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if k.Identity == "" {
+			return fmt.Errorf("Signing key has no identity")
+		}
+		if seen[k.Identity] {
+			return fmt.Errorf("Signing key %s is configured twice", k.Identity)
+		}
+		seen[k.Identity] = true
+		if len(k.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("Public key of %s has %d bytes, expected %d", k.Identity, len(k.PublicKey), ed25519.PublicKeySize)
+		}
+	}
+	return nil
+}
+
+// signMessage appends the Ed25519 signature of payload under key to payload.
+func signMessage(key ed25519.PrivateKey, payload []byte) []byte {
+	return append(payload, ed25519.Sign(key, payload)...)
+}
+
+// verifySignature checks whether msg ends with the signature of the rest of msg by one of keys.
+// If so, it returns msg without the signature and the identity of the key. Otherwise it returns
+// msg as is and an empty identity, since unsigned messages carry nothing to tell them apart.
+func verifySignature(keys []SigningKey, msg []byte) ([]byte, string) {
+	if len(msg) < ed25519.SignatureSize {
+		return msg, ""
+	}
+	payload, sig := msg[:len(msg)-ed25519.SignatureSize], msg[len(msg)-ed25519.SignatureSize:]
+	for _, k := range keys {
+		if ed25519.Verify(k.PublicKey, payload, sig) {
+			return payload, k.Identity
+		}
+	}
+	return msg, ""
+}
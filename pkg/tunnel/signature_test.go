@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSigningKey(t *testing.T) {
+	pub := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	k, err := ParseSigningKey("alice:" + hex.EncodeToString(pub))
+	require.Nil(t, err)
+	require.Equal(t, SigningKey{Identity: "alice", PublicKey: pub}, k)
+
+	for _, s := range []string{"alice", ":" + hex.EncodeToString(pub), "alice:xyz"} {
+		_, err := ParseSigningKey(s)
+		require.NotNil(t, err, s)
+	}
+
+	seed := bytes.Repeat([]byte{1}, ed25519.SeedSize)
+	priv, err := ParsePrivateKey(hex.EncodeToString(seed))
+	require.Nil(t, err)
+	require.Equal(t, ed25519.NewKeyFromSeed(seed), priv)
+	priv, err = ParsePrivateKey(hex.EncodeToString(priv))
+	require.Nil(t, err)
+	require.Equal(t, ed25519.NewKeyFromSeed(seed), priv)
+	_, err = ParsePrivateKey("abcd")
+	require.NotNil(t, err)
+}
+
+func TestSignatures(t *testing.T) {
+	alice := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	bob := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+	mallory := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize))
+	keys := []SigningKey{
+		{Identity: "alice", PublicKey: alice.Public().(ed25519.PublicKey)},
+		{Identity: "bob", PublicKey: bob.Public().(ed25519.PublicKey)},
+	}
+
+	tests := map[string]struct {
+		require bool
+		key     ed25519.PrivateKey
+		text    string
+		signer  string
+		dropped bool
+	}{
+		"signed":                 {key: alice, text: "hello world", signer: "alice"},
+		"signed, required":       {require: true, key: bob, text: "hello world", signer: "bob"},
+		"unsigned":               {text: "hello world"},
+		"unsigned, required":     {require: true, text: "hello world", dropped: true},
+		"short":                  {text: "hi"},
+		"short, required":        {require: true, text: "hi", dropped: true},
+		"unknown key":            {key: mallory, text: "hello world"},
+		"unknown key, required":  {require: true, key: mallory, text: "hello world", dropped: true},
+		"signed short, required": {require: true, key: alice, text: "hi", signer: "alice"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", SigningKeys: keys, RequireSignatures: test.require})
+			defer tun.Close()
+			domains, err := Encoder{LabelLen: 63, Version: Version2, SigningKey: test.key}.Encode("tunnel.example.com.", "x7f2aa", test.text)
+			require.Nil(t, err)
+			for _, domain := range domains {
+				tun.domains <- query{name: domain}
+			}
+			tun.Flush()
+			select {
+			case msg := <-tun.Messages():
+				require.False(t, test.dropped)
+				require.Equal(t, test.signer, msg.Signer)
+				if test.key == nil || test.signer != "" {
+					require.Equal(t, test.text, string(msg.Payload))
+				} else {
+					// Signatures by unknown keys are left in the payload.
+					require.Equal(t, test.text, string(msg.Payload[:len(test.text)]))
+				}
+			default:
+				require.True(t, test.dropped)
+				require.Equal(t, uint64(1), tun.Stats().Unsigned)
+			}
+		})
+	}
+
+	_, err := New(Config{TopDomain: "tunnel.example.com.", RequireSignatures: true})
+	require.NotNil(t, err)
+	_, err = New(Config{TopDomain: "tunnel.example.com.", SigningKeys: []SigningKey{{Identity: "alice", PublicKey: []byte("short")}}})
+	require.NotNil(t, err)
+	_, err = New(Config{TopDomain: "tunnel.example.com.", SigningKeys: append(keys, keys[0])})
+	require.NotNil(t, err)
+}
+
+func TestSignaturesWithHMACAndEncryption(t *testing.T) {
+	alice := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	key := bytes.Repeat([]byte{0x42}, 32)
+	hmacKey := []byte("secret")
+	tun := newTestTunnel(t, Config{
+		TopDomain:         "tunnel.example.com.",
+		SigningKeys:       []SigningKey{{Identity: "alice", PublicKey: alice.Public().(ed25519.PublicKey)}},
+		RequireSignatures: true,
+		DecryptKey:        key,
+		HMACKey:           hmacKey,
+	})
+	defer tun.Close()
+
+	domains, err := Encoder{LabelLen: 63, Version: Version2, Compress: true, EncryptKey: key, HMACKey: hmacKey, SigningKey: alice}.Encode("tunnel.example.com.", "x7f2aa", "hello world")
+	require.Nil(t, err)
+	for _, domain := range domains {
+		tun.domains <- query{name: domain}
+	}
+	msg := <-tun.Messages()
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, "alice", msg.Signer)
+}
@@ -0,0 +1,355 @@
+package tunnel
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+)
+
+// Upper bounds of the buckets of the reassembly duration and fragments per message histograms.
+var (
+	reassemblyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	fragmentBuckets   = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256}
+)
+
+// Stats holds counters describing the traffic a Tunnel has processed, and gauges describing its
+// current state.
+type Stats struct {
+	// Queries counts DNS queries received.
+	Queries uint64
+	// Fragments counts fragments parsed successfully.
+	Fragments uint64
+	// ParseErrors counts payload-bearing queries whose domain could not be parsed as a fragment.
+	ParseErrors uint64
+	// ParseErrorReasons breaks ParseErrors down by the reason fragments were rejected:
+	// route, labels, size, offset, checksum or alphabet.
+	ParseErrorReasons map[string]uint64
+	// Assembled counts messages that were reassembled and delivered.
+	Assembled uint64
+	// Corrupt counts messages dropped because they could not be assembled, decoded or
+	// decompressed.
+	Corrupt uint64
+	// Unauthenticated counts messages dropped because they lacked a valid HMAC tag.
+	Unauthenticated uint64
+	// Unsigned counts messages dropped because Config.RequireSignatures is set and they weren't
+	// signed by any of Config.SigningKeys.
+	Unsigned uint64
+	// Unauthorized counts fragments dropped because they lacked a valid auth token.
+	Unauthorized uint64
+	// CertDenied counts queries refused because their TLS client certificate isn't allowed to
+	// send to their tenant.
+	CertDenied uint64
+	// Undecryptable counts messages dropped because they failed to decrypt.
+	Undecryptable uint64
+	// Expired counts partial messages that expired before they were complete.
+	Expired uint64
+	// RateLimited counts queries refused because their source exceeded the rate limit.
+	RateLimited uint64
+	// Denied counts queries refused because their source is not allowed by the CIDR lists.
+	Denied uint64
+	// Duplicates counts fragments ignored because they repeat a fragment that was already
+	// received.
+	Duplicates uint64
+	// Replayed counts fragments ignored because they belong to a message delivered within the
+	// dedup window.
+	Replayed uint64
+	// Collisions counts messages whose ID was already taken by a partial message of another
+	// length, which are reassembled separately.
+	Collisions uint64
+	// FanoutDuplicates counts fragment queries that repeated one received within
+	// Config.FanoutWindow, usually from another resolver, which are counted once.
+	FanoutDuplicates uint64
+	// Recovered counts fragments that never arrived but were rebuilt from the parity fragments of
+	// their message, as sent by Encoder.Parity.
+	Recovered uint64
+	// EvictedMessages and EvictedBytes count partial messages evicted to stay within
+	// Config.MaxPartialMessages and Config.MaxBufferedBytes respectively.
+	EvictedMessages uint64
+	EvictedBytes    uint64
+	// Oversized counts partial messages dropped because their fragments exceeded
+	// Config.MaxFragmentBytes.
+	Oversized uint64
+	// Overflowed counts assembled messages dropped because the Messages channel was full.
+	Overflowed uint64
+	// Spilled counts assembled messages appended to the spool because the Messages channel was
+	// full.
+	Spilled uint64
+	// OtherTypes counts queries of types that can't carry fragments, such as SOA, CAA or ANY,
+	// by type. Types unknown to miekg/dns are counted together as "other".
+	OtherTypes map[string]uint64
+	// QueryCounts counts the queries replied to by type, top domain and response code, to spot
+	// resolvers that mangle queries and unexpected traffic.
+	QueryCounts map[QueryKey]uint64
+	// KeyMessages counts messages decrypted with each of Config.DecryptKeys, by key ID, which
+	// tells when a key rotated out is no longer in use.
+	KeyMessages map[string]uint64
+	// Truncated counts UDP replies truncated to fit the payload size of the requester, which is
+	// expected to retry the query over TCP.
+	Truncated uint64
+	// Heartbeats counts heartbeats received from clients.
+	Heartbeats uint64
+	// StatusQueries counts the status queries received from clients.
+	StatusQueries uint64
+	// Reordered counts messages held back by Config.OrderedDelivery because they were assembled
+	// before a message sent ahead of them, and SequenceGaps the missing messages given up on.
+	Reordered    uint64
+	SequenceGaps uint64
+	// IDBursts, ClientSpikes and EntropyAlerts count the alerts raised by Config.Anomalies, of
+	// kinds AlertIDBurst, AlertClientSpike and AlertEntropy respectively.
+	IDBursts      uint64
+	ClientSpikes  uint64
+	EntropyAlerts uint64
+
+	// InFlight is the number of partial messages currently held in memory.
+	InFlight int
+	// BufferedBytes is the number of bytes of encoded data held in partial messages.
+	BufferedBytes int
+	// Backlog is the number of assembled messages waiting to be read from Messages.
+	Backlog int
+	// Spooled is the number of spilled messages waiting in the spool.
+	Spooled int
+	// Sessions is the number of client sessions that haven't timed out.
+	Sessions int
+	// Streams is the number of open streams.
+	Streams int
+	// Held is the number of messages currently held back by Config.OrderedDelivery.
+	Held int
+}
+
+// Stats returns a snapshot of the tunnel's counters.
+func (tun *Tunnel) Stats() Stats {
+	parseErrorReasons := make(map[string]uint64, len(tun.parseErrors))
+	for reason, n := range tun.parseErrors {
+		parseErrorReasons[reason] = atomic.LoadUint64(n)
+	}
+	stats := Stats{
+		Queries:           atomic.LoadUint64(&tun.stats.Queries),
+		Fragments:         atomic.LoadUint64(&tun.stats.Fragments),
+		ParseErrors:       atomic.LoadUint64(&tun.stats.ParseErrors),
+		ParseErrorReasons: parseErrorReasons,
+		Assembled:         atomic.LoadUint64(&tun.stats.Assembled),
+		Corrupt:           atomic.LoadUint64(&tun.stats.Corrupt),
+		Unauthenticated:   atomic.LoadUint64(&tun.stats.Unauthenticated),
+		Unsigned:          atomic.LoadUint64(&tun.stats.Unsigned),
+		Unauthorized:      atomic.LoadUint64(&tun.stats.Unauthorized),
+		CertDenied:        atomic.LoadUint64(&tun.stats.CertDenied),
+		Undecryptable:     atomic.LoadUint64(&tun.stats.Undecryptable),
+		Expired:           atomic.LoadUint64(&tun.stats.Expired),
+		RateLimited:       atomic.LoadUint64(&tun.stats.RateLimited),
+		Denied:            atomic.LoadUint64(&tun.stats.Denied),
+		Duplicates:        atomic.LoadUint64(&tun.stats.Duplicates),
+		Replayed:          atomic.LoadUint64(&tun.stats.Replayed),
+		Collisions:        atomic.LoadUint64(&tun.stats.Collisions),
+		FanoutDuplicates:  atomic.LoadUint64(&tun.stats.FanoutDuplicates),
+		Recovered:         atomic.LoadUint64(&tun.stats.Recovered),
+		EvictedMessages:   atomic.LoadUint64(&tun.stats.EvictedMessages),
+		EvictedBytes:      atomic.LoadUint64(&tun.stats.EvictedBytes),
+		Oversized:         atomic.LoadUint64(&tun.stats.Oversized),
+		IDBursts:          atomic.LoadUint64(&tun.stats.IDBursts),
+		ClientSpikes:      atomic.LoadUint64(&tun.stats.ClientSpikes),
+		EntropyAlerts:     atomic.LoadUint64(&tun.stats.EntropyAlerts),
+		InFlight:          tun.inFlight(),
+		BufferedBytes:     int(tun.bufferedBytes.Load()),
+		Overflowed:        atomic.LoadUint64(&tun.stats.Overflowed),
+		Spilled:           atomic.LoadUint64(&tun.stats.Spilled),
+		Truncated:         atomic.LoadUint64(&tun.stats.Truncated),
+		Heartbeats:        atomic.LoadUint64(&tun.stats.Heartbeats),
+		StatusQueries:     atomic.LoadUint64(&tun.stats.StatusQueries),
+		OtherTypes:        tun.queryTypes.snapshot(),
+		QueryCounts:       tun.queryCounts.snapshot(),
+		KeyMessages:       tun.keyMessages(),
+		Backlog:           len(tun.messages),
+		Spooled:           int(tun.spooled.Load()),
+		Sessions:          tun.sessions.len(),
+		Streams:           tun.openStreams(),
+	}
+	if tun.order != nil {
+		stats.Reordered = tun.order.reordered.Load()
+		stats.SequenceGaps = tun.order.gaps.Load()
+		stats.Held = int(tun.order.holding.Load())
+	}
+	return stats
+}
+
+// Collect implements metrics.Collector, so that a tunnel can be registered with a
+// metrics.Registry.
+func (tun *Tunnel) Collect() []metrics.Metric {
+	stats := tun.Stats()
+	dropped := func(reason string, value uint64) metrics.Metric {
+		return metrics.Metric{
+			Name:   "browsertunnel_messages_dropped_total",
+			Help:   "Messages dropped after all of their fragments were received.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"reason": reason},
+			Value:  float64(value),
+		}
+	}
+	evicted := func(reason string, value uint64) metrics.Metric {
+		return metrics.Metric{
+			Name:   "browsertunnel_evicted_total",
+			Help:   "Partial messages evicted to bound memory usage.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"reason": reason},
+			Value:  float64(value),
+		}
+	}
+	alerts := func(kind AlertKind, value uint64) metrics.Metric {
+		return metrics.Metric{
+			Name:   "browsertunnel_alerts_total",
+			Help:   "Suspicious traffic patterns detected.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"kind": string(kind)},
+			Value:  float64(value),
+		}
+	}
+	ms := []metrics.Metric{
+		{Name: "browsertunnel_queries_total", Help: "DNS queries received.", Type: metrics.Counter, Value: float64(stats.Queries)},
+		{Name: "browsertunnel_fragments_total", Help: "Fragments parsed successfully.", Type: metrics.Counter, Value: float64(stats.Fragments)},
+		{Name: "browsertunnel_messages_assembled_total", Help: "Messages reassembled and delivered.", Type: metrics.Counter, Value: float64(stats.Assembled)},
+		dropped("corrupt", stats.Corrupt),
+		dropped("unauthenticated", stats.Unauthenticated),
+		dropped("unsigned", stats.Unsigned),
+		dropped("undecryptable", stats.Undecryptable),
+		dropped("backlog_full", stats.Overflowed),
+		{Name: "browsertunnel_expired_total", Help: "Partial messages that expired before they were complete.", Type: metrics.Counter, Value: float64(stats.Expired)},
+		{Name: "browsertunnel_rate_limited_total", Help: "Queries refused because their source exceeded the rate limit.", Type: metrics.Counter, Value: float64(stats.RateLimited)},
+		{Name: "browsertunnel_unauthorized_total", Help: "Fragments dropped because they lacked a valid auth token.", Type: metrics.Counter, Value: float64(stats.Unauthorized)},
+		{Name: "browsertunnel_cert_denied_total", Help: "Queries refused because their TLS client certificate isn't allowed to send to their tenant.", Type: metrics.Counter, Value: float64(stats.CertDenied)},
+		{Name: "browsertunnel_denied_total", Help: "Queries refused because their source is not allowed.", Type: metrics.Counter, Value: float64(stats.Denied)},
+		{Name: "browsertunnel_duplicates_total", Help: "Duplicate fragments ignored.", Type: metrics.Counter, Value: float64(stats.Duplicates)},
+		{Name: "browsertunnel_replayed_total", Help: "Fragments of recently delivered messages ignored.", Type: metrics.Counter, Value: float64(stats.Replayed)},
+		{Name: "browsertunnel_id_collisions_total", Help: "Messages whose ID collided with a partial message of another length.", Type: metrics.Counter, Value: float64(stats.Collisions)},
+		{Name: "browsertunnel_fanout_duplicates_total", Help: "Fragment queries repeating a recent one, usually from another resolver.", Type: metrics.Counter, Value: float64(stats.FanoutDuplicates)},
+		{Name: "browsertunnel_recovered_fragments_total", Help: "Missing fragments rebuilt from parity fragments.", Type: metrics.Counter, Value: float64(stats.Recovered)},
+		evicted(evictMaxPartialMessages, stats.EvictedMessages),
+		evicted(evictMaxBufferedBytes, stats.EvictedBytes),
+		evicted(evictMaxFragmentBytes, stats.Oversized),
+		{Name: "browsertunnel_in_flight", Help: "Partial messages held in memory.", Type: metrics.Gauge, Value: float64(stats.InFlight)},
+		{Name: "browsertunnel_buffered_bytes", Help: "Bytes of encoded data held in partial messages.", Type: metrics.Gauge, Value: float64(stats.BufferedBytes)},
+		{Name: "browsertunnel_messages_backlog", Help: "Assembled messages waiting to be consumed.", Type: metrics.Gauge, Value: float64(stats.Backlog)},
+		{Name: "browsertunnel_messages_spilled_total", Help: "Assembled messages spilled to the spool because the backlog was full.", Type: metrics.Counter, Value: float64(stats.Spilled)},
+		{Name: "browsertunnel_truncated_total", Help: "UDP replies truncated to fit the requester's payload size.", Type: metrics.Counter, Value: float64(stats.Truncated)},
+		{Name: "browsertunnel_messages_spooled", Help: "Spilled messages waiting in the spool.", Type: metrics.Gauge, Value: float64(stats.Spooled)},
+		{Name: "browsertunnel_sessions", Help: "Client sessions that haven't timed out.", Type: metrics.Gauge, Value: float64(stats.Sessions)},
+		{Name: "browsertunnel_streams", Help: "Open streams.", Type: metrics.Gauge, Value: float64(stats.Streams)},
+		{Name: "browsertunnel_heartbeats_total", Help: "Heartbeats received from clients.", Type: metrics.Counter, Value: float64(stats.Heartbeats)},
+		{Name: "browsertunnel_status_queries_total", Help: "Status queries received from clients.", Type: metrics.Counter, Value: float64(stats.StatusQueries)},
+		{Name: "browsertunnel_messages_reordered_total", Help: "Messages held back to be delivered in sequence.", Type: metrics.Counter, Value: float64(stats.Reordered)},
+		{Name: "browsertunnel_sequence_gaps_total", Help: "Missing messages given up on by ordered delivery.", Type: metrics.Counter, Value: float64(stats.SequenceGaps)},
+		alerts(AlertIDBurst, stats.IDBursts),
+		alerts(AlertClientSpike, stats.ClientSpikes),
+		alerts(AlertEntropy, stats.EntropyAlerts),
+		{Name: "browsertunnel_messages_held", Help: "Messages waiting for the messages sent before them.", Type: metrics.Gauge, Value: float64(stats.Held)},
+	}
+
+	for _, reason := range parseReasons {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_parse_errors_total",
+			Help:   "Queries that could not be parsed as fragments.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"reason": reason},
+			Value:  float64(stats.ParseErrorReasons[reason]),
+		})
+	}
+
+	for _, qtype := range sortedTypes(stats.OtherTypes) {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_other_type_queries_total",
+			Help:   "Queries of types that can't carry fragments.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"qtype": qtype},
+			Value:  float64(stats.OtherTypes[qtype]),
+		})
+	}
+
+	for _, key := range SortedQueryKeys(stats.QueryCounts) {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_answered_queries_total",
+			Help:   "Queries replied to, by type, top domain and response code.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"qtype": key.Type, "domain": key.TopDomain, "rcode": key.Rcode},
+			Value:  float64(stats.QueryCounts[key]),
+		})
+	}
+
+	for _, id := range sortedTypes(stats.KeyMessages) {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_key_messages_total",
+			Help:   "Messages decrypted with each named decryption key.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"key": id},
+			Value:  float64(stats.KeyMessages[id]),
+		})
+	}
+
+	liveness := tun.Liveness()
+	ids := make([]string, 0, len(liveness))
+	for id := range liveness {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_client_last_seen_timestamp_seconds",
+			Help:   "Unix time of the latest heartbeat or poll of each client ID.",
+			Type:   metrics.Gauge,
+			Labels: map[string]string{"client_id": id},
+			Value:  float64(liveness[id].LastSeen.UnixNano()) / 1e9,
+		})
+	}
+
+	ms = append(ms, tun.reassemblyTimes.Metrics("browsertunnel_reassembly_duration_seconds", "Time between the first and last fragment of assembled messages.", nil)...)
+	ms = append(ms, tun.messageFragments.Metrics("browsertunnel_message_fragments", "Fragments of assembled messages.", nil)...)
+
+	clients := tun.ClientStats()
+	ips := make([]string, 0, len(clients))
+	for ip := range clients {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		ms = append(ms, metrics.Metric{
+			Name:   "browsertunnel_client_bytes_total",
+			Help:   "Bytes of assembled messages received from each source IP seen in the last 10 minutes.",
+			Type:   metrics.Counter,
+			Labels: map[string]string{"client": ip},
+			Value:  float64(clients[ip].Bytes),
+		})
+	}
+
+	tenants := tun.TenantStats()
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ts := tenants[name]
+		labels := map[string]string{"tenant": name}
+		ms = append(ms,
+			metrics.Metric{Name: "browsertunnel_tenant_fragments_total", Help: "Fragments parsed successfully, by tenant.", Type: metrics.Counter, Labels: labels, Value: float64(ts.Fragments)},
+			metrics.Metric{Name: "browsertunnel_tenant_messages_assembled_total", Help: "Messages reassembled and delivered, by tenant.", Type: metrics.Counter, Labels: labels, Value: float64(ts.Assembled)},
+			metrics.Metric{Name: "browsertunnel_tenant_over_quota_total", Help: "Fragments and queries refused because a tenant exceeded its quotas.", Type: metrics.Counter, Labels: labels, Value: float64(ts.OverQuota)},
+			metrics.Metric{Name: "browsertunnel_tenant_in_flight", Help: "Partial messages held in memory, by tenant.", Type: metrics.Gauge, Labels: labels, Value: float64(ts.InFlight)},
+		)
+	}
+
+	keys := tun.APIKeyStats()
+	names = make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ks := keys[name]
+		labels := map[string]string{"key": name}
+		ms = append(ms,
+			metrics.Metric{Name: "browsertunnel_api_key_fragments_total", Help: "Fragments accepted, by API key.", Type: metrics.Counter, Labels: labels, Value: float64(ks.Fragments)},
+			metrics.Metric{Name: "browsertunnel_api_key_over_quota_total", Help: "Fragments dropped because an API key exceeded its quotas.", Type: metrics.Counter, Labels: labels, Value: float64(ks.OverQuota)},
+			metrics.Metric{Name: "browsertunnel_api_key_hourly_messages", Help: "Messages started with each API key in the current hour.", Type: metrics.Gauge, Labels: labels, Value: float64(ks.Messages)},
+			metrics.Metric{Name: "browsertunnel_api_key_daily_bytes", Help: "Bytes sent with each API key in the current day.", Type: metrics.Gauge, Labels: labels, Value: float64(ks.Bytes)},
+		)
+	}
+	return ms
+}
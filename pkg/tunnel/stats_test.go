@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+)
+
+func TestStats(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	domains := []string{
+		"2jkhm3.FAIL.0.aaaa.tunnel.example.com.",
+		"i42ftq.592.0.aaaa.tunnel.example.com.",
+		"2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+	}
+	for _, domain := range domains {
+		req := &dns.Msg{}
+		req.SetQuestion(domain, dns.TypeA)
+		tun.ServeDNS(&testResponseWriter{}, req)
+	}
+	<-tun.Messages()
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(3), stats.Queries)
+	require.Equal(t, uint64(2), stats.Fragments)
+	require.Equal(t, uint64(1), stats.ParseErrors)
+	require.Equal(t, uint64(1), stats.Assembled)
+	require.Equal(t, 1, stats.InFlight)
+	require.Equal(t, 0, stats.Backlog)
+
+	var buf bytes.Buffer
+	require.Nil(t, metrics.Write(&buf, tun.Collect()))
+	require.Contains(t, buf.String(), "browsertunnel_queries_total 3\n")
+	require.Contains(t, buf.String(), "browsertunnel_messages_dropped_total{reason=\"corrupt\"} 0\n")
+	require.Contains(t, buf.String(), "browsertunnel_in_flight 1\n")
+	require.Contains(t, buf.String(), "# TYPE browsertunnel_reassembly_duration_seconds histogram\n")
+	require.Contains(t, buf.String(), "browsertunnel_reassembly_duration_seconds_count 1\n")
+	require.Contains(t, buf.String(), "browsertunnel_message_fragments_bucket{le=\"1\"} 1\n")
+	require.Contains(t, buf.String(), "browsertunnel_client_bytes_total{client=\"192.0.2.1\"} 11\n")
+}
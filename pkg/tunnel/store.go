@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Fragment is a fragment of a partial message, as persisted by a FragmentStore.
+type Fragment struct {
+	ID string
+	// Tenant is the name of the tenant the message was sent to, if tenants are configured.
+	Tenant string
+	// Version, Flags, Session, Sequence, Encoding, KeyID and Expiration are the framing of the
+	// fragment. Version is zero for fragments framed as Version1, which carry no version label,
+	// Encoding is empty for EncodingBase32, and Expiration, in seconds, is zero unless the message
+	// is framed with FlagExpiration.
+	Version    int
+	Flags      Flags
+	Session    string
+	Sequence   int
+	Encoding   Encoding
+	KeyID      string
+	Expiration int
+	TotalSize  int
+	Offset     int
+	// Data is the encoded data carried by the fragment.
+	Data string
+	// ReceivedAt is when the fragment was received.
+	ReceivedAt time.Time
+}
+
+// A FragmentStore persists the fragments of partial messages, so that they can be reassembled
+// after the process restarts. Methods are called while a shard of the tunnel's internal map of
+// messages is locked, and may be called by several workers at once, so they should be fast and
+// safe for concurrent use.
+type FragmentStore interface {
+	// Put persists a fragment, replacing any fragment of the same message at the same offset.
+	Put(f Fragment) error
+	// Delete removes every fragment of message id of tenant, which is empty if tenants aren't
+	// configured.
+	Delete(tenant, id string) error
+	// Load returns every persisted fragment.
+	Load() ([]Fragment, error)
+}
+
+// A SharedFragmentStore is a FragmentStore shared by several servers, e.g. the servers behind an
+// anycast or load balanced address, which the fragments of a message may be spread across.
+// Servers put every fragment they receive in the store and complete messages with the fragments
+// that the others put there, so that each message is reassembled once, by whichever server has
+// every fragment first.
+type SharedFragmentStore interface {
+	FragmentStore
+	// Fragments returns the fragments of message id of tenant put by any server.
+	Fragments(tenant, id string) ([]Fragment, error)
+	// Claim reports whether this server is the first to claim message id of tenant, which it then
+	// delivers. Claims outlive the fragments of the message, so that servers completing it at the
+	// same time, or receiving its fragments again, don't deliver it twice.
+	Claim(tenant, id string) (bool, error)
+}
+
+// persisted returns fg as persisted in a FragmentStore, with the ID of its message in the store.
+func (fg fragment) persisted(id, tenant string, receivedAt time.Time) Fragment {
+	return Fragment{ID: id, Tenant: tenant, Version: fg.framing.version, Flags: fg.framing.flags, Session: fg.framing.session, Sequence: fg.framing.seq, Encoding: fg.framing.encoding, KeyID: fg.framing.keyID, Expiration: fg.framing.expiration, TotalSize: fg.totalSize, Offset: fg.offset, Data: fg.data, ReceivedAt: receivedAt}
+}
+
+// restored returns the fragment persisted as f.
+func restored(f Fragment) fragment {
+	fr := framing{version: f.Version, flags: f.Flags, session: f.Session, seq: f.Sequence, encoding: f.Encoding, keyID: f.KeyID, expiration: f.Expiration}
+	return fragment{id: messageID(f.ID), framing: fr, totalSize: f.TotalSize, offset: f.Offset, data: f.Data}
+}
+
+// share puts fg, the fragment just added to fgList, in the shared store and adds the fragments of
+// the message that other servers received to fgList. The message is known as id to the store. It
+// reports whether the message is complete, and if so, whether this server claimed it. Failures of
+// the store are logged, and leave the message to be reassembled from the fragments in memory.
+func (tun *Tunnel) share(store SharedFragmentStore, sh *shard, fgList *fragmentList, fg fragment, id, tenant string, receivedAt time.Time) (complete, claimed bool) {
+	if !fgList.complete() {
+		if err := store.Put(fg.persisted(id, tenant, receivedAt)); err != nil {
+			tun.logger.Warn("Failed to update fragment store", "id", fg.id, "error", err)
+		}
+		fragments, err := store.Fragments(tenant, id)
+		if err != nil {
+			tun.logger.Warn("Failed to read fragment store", "id", fg.id, "error", err)
+		}
+		for _, f := range fragments {
+			other := restored(f)
+			if _, ok := fgList.fragments[other.offset]; ok || other.totalSize != fgList.totalSize || other.framing != fgList.framing {
+				continue
+			}
+			tun.putFragment(sh, fgList, other)
+			if f.ReceivedAt.Before(fgList.firstSeen) {
+				fgList.firstSeen = f.ReceivedAt
+			}
+		}
+		if !fgList.complete() {
+			return false, false
+		}
+	}
+	claimed, err := store.Claim(tenant, id)
+	if err != nil {
+		tun.logger.Warn("Failed to claim message in fragment store", "id", fg.id, "error", err)
+		claimed = true
+	}
+	if claimed {
+		if err := store.Delete(tenant, id); err != nil {
+			tun.logger.Warn("Failed to update fragment store", "id", fg.id, "error", err)
+		}
+	}
+	return true, claimed
+}
+
+// restore rebuilds the fragment lists from the fragments in tun.store. Messages that expired
+// while the process wasn't running are deleted. It is called before any worker is started, so
+// shards aren't locked.
+func (tun *Tunnel) restore() error {
+	fragments, err := tun.store.Load()
+	if err != nil {
+		return err
+	}
+	// Restore fragments in the order they were received, so that messages are ordered from the
+	// least to the most recently updated for eviction.
+	sort.SliceStable(fragments, func(i, j int) bool {
+		return fragments[i].ReceivedAt.Before(fragments[j].ReceivedAt)
+	})
+	now := tun.clock.Now()
+	for _, f := range fragments {
+		fg := restored(f)
+		key := listKey(f.Tenant, f.ID)
+		sh := tun.shardOf(key)
+		fgList, ok := sh.lists[key]
+		if !ok {
+			// Fragments don't record their top domain, so restored messages expire as configured
+			// for their tenant.
+			fgList = &fragmentList{id: fg.id, tenant: f.Tenant, framing: fg.framing, fragments: make(map[int]fragment), firstSeen: f.ReceivedAt, policy: tun.policyOf(f.Tenant, "")}
+			tun.addList(sh, key, fgList)
+			if t := tun.tenants[f.Tenant]; t != nil {
+				t.inFlight.Add(1)
+			}
+		}
+		fgList.totalSize = f.TotalSize
+		tun.putFragment(sh, fgList, fg)
+		if f.ReceivedAt.Before(fgList.firstSeen) {
+			fgList.firstSeen = f.ReceivedAt
+		}
+		if expiresAt := f.ReceivedAt.Add(tun.expirationOf(fgList.policy, fg.framing)); expiresAt.After(fgList.expiresAt) {
+			fgList.expiresAt = expiresAt
+		}
+	}
+	for _, sh := range tun.shards {
+		for key, fgList := range sh.lists {
+			if fgList.expiresAt.Before(now) {
+				tun.deleteList(sh, key)
+				id := strings.TrimPrefix(key, listKey(fgList.tenant, ""))
+				if err := tun.store.Delete(fgList.tenant, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	tun.logger.Info("Restored partial messages", "messages", tun.inFlight(), "fragments", len(fragments))
+	return nil
+}
@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memStore is a FragmentStore that keeps fragments in memory.
+type memStore struct {
+	mu        sync.Mutex
+	fragments map[string]map[int]Fragment
+}
+
+func newMemStore() *memStore {
+	return &memStore{fragments: make(map[string]map[int]Fragment)}
+}
+
+func (s *memStore) Put(f Fragment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := listKey(f.Tenant, f.ID)
+	if s.fragments[key] == nil {
+		s.fragments[key] = make(map[int]Fragment)
+	}
+	s.fragments[key][f.Offset] = f
+	return nil
+}
+
+func (s *memStore) Delete(tenant, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.fragments, listKey(tenant, id))
+	return nil
+}
+
+func (s *memStore) Load() ([]Fragment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var fragments []Fragment
+	for _, fs := range s.fragments {
+		for _, f := range fs {
+			fragments = append(fragments, f)
+		}
+	}
+	sort.Slice(fragments, func(i, j int) bool { return fragments[i].Offset < fragments[j].Offset })
+	return fragments, nil
+}
+
+func (s *memStore) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.fragments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestStoreResumesReassembly(t *testing.T) {
+	store := newMemStore()
+	cfg := Config{TopDomain: "tunnel.example.com.", Store: store}
+
+	tun := newTestTunnel(t, cfg)
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com.", receivedAt: time.Now()}
+	tun.domains <- query{name: "abcdef.24.0.nbswy3dpeb3w.tunnel.example.com.", receivedAt: time.Now()}
+	require.Eventually(t, func() bool { return len(store.ids()) == 2 }, 5*time.Second, time.Millisecond)
+	tun.Close()
+
+	tun = newTestTunnel(t, cfg)
+	defer tun.Close()
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com.", receivedAt: time.Now()}
+	msg := <-tun.Messages()
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, 2, msg.Fragments)
+	require.Eventually(t, func() bool { return len(store.ids()) == 1 }, 5*time.Second, time.Millisecond)
+	require.Equal(t, []string{"abcdef"}, store.ids())
+}
+
+func TestStoreDropsExpired(t *testing.T) {
+	store := newMemStore()
+	now := time.Now()
+	require.Nil(t, store.Put(Fragment{ID: "old", TotalSize: 24, Offset: 0, Data: "nbswy3dp", ReceivedAt: now.Add(-2 * time.Minute)}))
+	require.Nil(t, store.Put(Fragment{ID: "new", TotalSize: 24, Offset: 0, Data: "nbswy3dp", ReceivedAt: now.Add(-2 * time.Minute)}))
+	require.Nil(t, store.Put(Fragment{ID: "new", TotalSize: 24, Offset: 8, Data: "eb3w64tm", ReceivedAt: now.Add(-30 * time.Second)}))
+
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Store: store})
+	defer tun.Close()
+	require.Equal(t, []string{"new"}, store.ids())
+	require.Equal(t, 1, tun.Stats().InFlight)
+	require.Equal(t, now.Add(-2*time.Minute), tun.shardOf("new").lists["new"].firstSeen)
+	require.Equal(t, now.Add(30*time.Second), tun.shardOf("new").lists["new"].expiresAt)
+}
+
+// sharedMemStore is a SharedFragmentStore that keeps fragments and claims in memory.
+type sharedMemStore struct {
+	*memStore
+	claimed map[string]bool
+}
+
+func newSharedMemStore() *sharedMemStore {
+	return &sharedMemStore{memStore: newMemStore(), claimed: make(map[string]bool)}
+}
+
+func (s *sharedMemStore) Fragments(tenant, id string) ([]Fragment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var fragments []Fragment
+	for _, f := range s.fragments[listKey(tenant, id)] {
+		fragments = append(fragments, f)
+	}
+	return fragments, nil
+}
+
+func (s *sharedMemStore) Claim(tenant, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := listKey(tenant, id)
+	if s.claimed[key] {
+		return false, nil
+	}
+	s.claimed[key] = true
+	return true, nil
+}
+
+func TestSharedStore(t *testing.T) {
+	store := newSharedMemStore()
+	a := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Store: store, Expiration: 200 * time.Millisecond, DeletionInterval: 10 * time.Millisecond})
+	defer a.Close()
+	b := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", Store: store})
+	defer b.Close()
+
+	// Each server receives one of the fragments, and the second to receive one completes the
+	// message with the fragment the first put in the store.
+	a.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com.", receivedAt: time.Now()}
+	a.domains <- query{name: "abcdef.24.0.nbswy3dpeb3w.tunnel.example.com.", receivedAt: time.Now()}
+	require.Eventually(t, func() bool { return len(store.ids()) == 2 }, 5*time.Second, time.Millisecond)
+	b.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com.", receivedAt: time.Now()}
+	msg := <-b.Messages()
+	require.Equal(t, "2jkhm3", msg.ID)
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, 2, msg.Fragments)
+	b.domains <- query{name: "abcdef.24.12.64tmmq000000.tunnel.example.com.", receivedAt: time.Now()}
+	require.Equal(t, "abcdef", (<-b.Messages()).ID)
+	require.Empty(t, store.ids())
+
+	// A message completed by another server isn't delivered again, even if this server receives
+	// the rest of its fragments, nor reported as expired.
+	a.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com.", receivedAt: time.Now()}
+	require.Eventually(t, func() bool { return a.Stats().InFlight == 0 }, 5*time.Second, time.Millisecond)
+	select {
+	case msg := <-a.Messages():
+		t.Fatalf("Message %s delivered twice", msg.ID)
+	case partial := <-a.Expired():
+		t.Fatalf("Message %s reported as expired", partial.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Equal(t, 0, int(a.Stats().Expired))
+}
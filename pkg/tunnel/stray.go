@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+// A StrayReason describes why a query didn't match the tunnel format.
+type StrayReason string
+
+// Reasons of StrayQuery.
+const (
+	// StrayZone is reported for queries answered from the zone of a top domain, such as its SOA
+	// and NS records and the addresses of its nameservers.
+	StrayZone StrayReason = "zone"
+	// StrayType is reported for queries of types that can't carry fragments, e.g. ANY or CAA.
+	StrayType StrayReason = "type"
+	// StrayMalformed is reported for queries of types that carry fragments whose names aren't a
+	// fragment, poll or heartbeat of a top domain.
+	StrayMalformed StrayReason = "malformed"
+)
+
+// A StrayQuery reports a query that didn't match the tunnel format. Most come from scanners,
+// misconfigured resolvers and clients sending corrupted names, which makes them worth recording
+// separately from the messages.
+type StrayQuery struct {
+	// Name is the name as it was asked, and Type its type.
+	Name string
+	Type uint16
+	// Source is the IP address the query was received from, and ClientSubnet the client subnet
+	// forwarded by the resolver, if any.
+	Source       net.IP
+	ClientSubnet *net.IPNet
+	Reason       StrayReason
+	// Err is why the name failed to parse, for StrayMalformed.
+	Err error
+	// Time is when the query was received.
+	Time time.Time
+}
+
+// StrayQueries returns the channel on which queries that don't match the tunnel format are
+// reported. Like errors, they are dropped if nobody is reading from the channel. The channel is
+// closed by Close.
+func (tun *Tunnel) StrayQueries() <-chan StrayQuery {
+	return tun.strays
+}
+
+// notifyStray reports a stray query without blocking.
+func (tun *Tunnel) notifyStray(q StrayQuery) {
+	if q.Time.IsZero() {
+		q.Time = tun.clock.Now()
+	}
+	select {
+	case tun.strays <- q:
+	default:
+	}
+}
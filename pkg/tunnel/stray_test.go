@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrayQueries(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com"})
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"tunnel.example.com.", dns.TypeSOA},
+		{"Scan.Tunnel.Example.com.", dns.TypeANY},
+		{"poll-x7f2.c1.FAIL.0.tunnel.example.com.", dns.TypeTXT},
+		{"2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA},
+		{"www.tunnel.example.com.", dns.TypeA},
+	} {
+		r := &dns.Msg{}
+		r.SetQuestion(q.name, q.qtype)
+		tun.ServeDNS(&testResponseWriter{}, r)
+	}
+
+	s := <-tun.StrayQueries()
+	require.Equal(t, StrayZone, s.Reason)
+	require.Equal(t, dns.TypeSOA, s.Type)
+	require.Equal(t, "192.0.2.1", s.Source.String())
+	require.False(t, s.Time.IsZero())
+	s = <-tun.StrayQueries()
+	require.Equal(t, StrayType, s.Reason)
+	require.Equal(t, "Scan.Tunnel.Example.com.", s.Name)
+	s = <-tun.StrayQueries()
+	require.Equal(t, StrayMalformed, s.Reason)
+	require.Equal(t, "poll-x7f2.c1.FAIL.0.tunnel.example.com.", s.Name)
+	require.NotNil(t, s.Err)
+	// The valid fragment isn't reported.
+	s = <-tun.StrayQueries()
+	require.Equal(t, StrayMalformed, s.Reason)
+	require.Equal(t, "www.tunnel.example.com.", s.Name)
+	require.Equal(t, dns.TypeA, s.Type)
+	require.NotNil(t, s.Err)
+	require.Equal(t, "hello world", string((<-tun.Messages()).Payload))
+
+	tun.Close()
+	_, ok := <-tun.StrayQueries()
+	require.False(t, ok)
+}
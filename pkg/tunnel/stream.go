@@ -0,0 +1,545 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Streams carry a byte stream in each direction between a client and the program embedding the
+// tunnel, for interactive channels rather than discrete messages. Clients send TXT queries for
+// domains of the form
+//
+//	st-<nonce>.<streamID>.<offset>.<ack>.<data>....<topDomain>
+//
+// where the data labels, if any, carry the upstream bytes starting at offset, encoded like the
+// data of fragments with EncodingBase32, and ack is the number of downstream bytes the client has
+// received. A client closes its side of the stream with the prefix fin- instead, once offset plus
+// the length of the data is the length of everything it sent. Like in polls, the nonce is chosen
+// randomly so that resolvers never answer a query from their cache.
+//
+// The answer is a TXT record whose first string is "<received>.<offset>", where received is the
+// number of upstream bytes the tunnel has received in order, followed by ".fin" if the tunnel has
+// closed its side and nothing follows the downstream bytes in the answer. Its second string is the
+// base64 encoded downstream bytes starting at offset, which is the ack of the query. Clients send
+// again the upstream bytes after received, and acknowledge downstream bytes once they have
+// received every byte before them. Queries for streams that don't exist, or can't be opened, are
+// answered with the single string "reset". A stream is opened by the first query naming it, with
+// an offset and ack of 0.
+const (
+	streamPrefix    = "st-"
+	streamFinPrefix = "fin-"
+	streamReset     = "reset"
+)
+
+const (
+	// DefaultStreamTimeout is the default value of Config.StreamTimeout.
+	DefaultStreamTimeout = time.Minute
+	// maxStreamBuffer is the maximum number of bytes buffered in each direction of a stream:
+	// received upstream bytes that weren't read yet, and downstream bytes that weren't
+	// acknowledged yet. Writes block while the downstream buffer is full.
+	maxStreamBuffer = 64 << 10
+	// maxStreamSegments is the maximum number of upstream segments received out of order that
+	// are held for each stream.
+	maxStreamSegments = 64
+)
+
+// ErrStreamTimeout is returned by the reads and writes of streams closed because their client
+// stopped querying them for Config.StreamTimeout.
+var ErrStreamTimeout = errors.New("Stream timed out")
+
+// A streamQuery is a parsed stream query.
+type streamQuery struct {
+	id     string
+	offset int
+	ack    int
+	data   []byte
+	fin    bool
+}
+
+// A StreamAnswer is the answer to a stream query, as parsed by ParseStreamAnswer.
+type StreamAnswer struct {
+	// Received is the number of upstream bytes the tunnel received in order.
+	Received int
+	// Offset is the position of Data in the downstream bytes.
+	Offset int
+	Data   []byte
+	// Fin is set if the tunnel closed its side of the stream after Data.
+	Fin bool
+}
+
+// EncodeStreamQuery returns the domain a client queries to send data, the upstream bytes of
+// stream streamID starting at offset, and to acknowledge ack downstream bytes, closing its side of
+// the stream if fin is set. It returns an error if data doesn't fit in a single domain; see
+// MaxStreamData.
+func EncodeStreamQuery(topDomain, streamID, nonce string, offset, ack int, data []byte, fin bool) (string, error) {
+	prefix := streamPrefix
+	if fin {
+		prefix = streamFinPrefix
+	}
+	labels := []string{fmt.Sprintf("%s%s.%s.%d.%d", prefix, nonce, streamID, offset, ack)}
+	encoded := decoder.EncodeToString(data)
+	for len(encoded) > 0 {
+		size := min(maxLabelLen, len(encoded))
+		labels = append(labels, encoded[:size])
+		encoded = encoded[size:]
+	}
+	domain := strings.Join(labels, ".") + "." + dns.Fqdn(topDomain)
+	if len(domain)-1 > maxNameLen {
+		return "", fmt.Errorf("Stream query carrying %d bytes is %d characters long, more than %d", len(data), len(domain)-1, maxNameLen)
+	}
+	return domain, nil
+}
+
+// MaxStreamData returns the number of upstream bytes that fit in a stream query encoded by
+// EncodeStreamQuery with the same arguments.
+func MaxStreamData(topDomain, streamID, nonce string, offset, ack int) int {
+	header := len(fmt.Sprintf("%s%s.%s.%d.%d.", streamFinPrefix, nonce, streamID, offset, ack))
+	space := maxNameLen - header - (len(dns.Fqdn(topDomain)) - 1)
+	// Every label of encoded data takes a dot of its own, and base32 encodes 5 bytes in 8
+	// characters.
+	chars := space - (space+maxLabelLen)/(maxLabelLen+1)
+	return max(chars/8*5, 0)
+}
+
+// ParseStreamAnswer parses the strings of a TXT answer to a stream query. It returns an error if
+// the stream was reset.
+func ParseStreamAnswer(txt []string) (StreamAnswer, error) {
+	if len(txt) == 1 && txt[0] == streamReset {
+		return StreamAnswer{}, fmt.Errorf("Stream was reset by the tunnel")
+	}
+	if len(txt) != 2 {
+		return StreamAnswer{}, fmt.Errorf("Stream answer has %d strings but expected 2", len(txt))
+	}
+	header := strings.Split(txt[0], ".")
+	var a StreamAnswer
+	if len(header) == 3 && header[2] == "fin" {
+		a.Fin, header = true, header[:2]
+	}
+	if len(header) != 2 {
+		return StreamAnswer{}, fmt.Errorf("Malformed stream answer header %q", txt[0])
+	}
+	var err error
+	if a.Received, err = strconv.Atoi(header[0]); err != nil {
+		return StreamAnswer{}, err
+	}
+	if a.Offset, err = strconv.Atoi(header[1]); err != nil {
+		return StreamAnswer{}, err
+	}
+	if a.Data, err = base64.StdEncoding.DecodeString(txt[1]); err != nil {
+		return StreamAnswer{}, err
+	}
+	return a, nil
+}
+
+// txt encodes the answer as the strings of a TXT record.
+func (a StreamAnswer) txt() []string {
+	header := fmt.Sprintf("%d.%d", a.Received, a.Offset)
+	if a.Fin {
+		header += ".fin"
+	}
+	return []string{header, base64.StdEncoding.EncodeToString(a.Data)}
+}
+
+// parseStream parses a stream query. It returns false if domain is not a stream query.
+func parseStream(topDomain string, domain string) (streamQuery, bool, error) {
+	under, ok := underDomain(domain, topDomain)
+	if !ok {
+		return streamQuery{}, false, nil
+	}
+	q := streamQuery{fin: strings.HasPrefix(under, streamFinPrefix)}
+	if !q.fin && !strings.HasPrefix(under, streamPrefix) {
+		return streamQuery{}, false, nil
+	}
+	labels := strings.Split(under, ".")
+	if len(labels) < 4 {
+		return streamQuery{}, true, fmt.Errorf("Stream query has %d labels but expected at least 4", len(labels))
+	}
+	q.id = labels[1]
+	var err error
+	if q.offset, err = strconv.Atoi(labels[2]); err != nil {
+		return streamQuery{}, true, err
+	}
+	if q.ack, err = strconv.Atoi(labels[3]); err != nil {
+		return streamQuery{}, true, err
+	}
+	if q.offset < 0 || q.ack < 0 {
+		return streamQuery{}, true, fmt.Errorf("Stream query declares negative offset %d or ack %d", q.offset, q.ack)
+	}
+	if q.data, err = decoder.DecodeString(strings.Join(labels[4:], "")); err != nil {
+		return streamQuery{}, true, fmt.Errorf("Failed to decode stream data: %w", err)
+	}
+	return q, true, nil
+}
+
+// A Stream is the tunnel's side of a stream opened by a client, as accepted from
+// Tunnel.StreamListener. It implements net.Conn: reads return the bytes sent by the client in
+// order, and writes queue bytes for the client to receive in the answers to its queries. Reads
+// return io.EOF once the client closed its side and every byte it sent was read.
+type Stream struct {
+	tun    *Tunnel
+	id     string
+	tenant string
+	local  net.Addr
+	remote net.Addr
+
+	mu sync.Mutex
+	// changed is closed, and replaced, whenever the stream changes, to wake up blocked reads and
+	// writes.
+	changed chan struct{}
+	// readBuf holds the upstream bytes received in order that weren't read yet, and received
+	// counts every upstream byte received in order. segments holds those received out of order
+	// by offset.
+	readBuf  []byte
+	received int
+	segments map[int][]byte
+	// finAt is the length of the upstream bytes once the client closed its side, or -1.
+	finAt int
+	// writeBuf holds the downstream bytes that weren't acknowledged yet, starting at acked.
+	writeBuf []byte
+	acked    int
+	closed   bool
+	// err is set once the stream is gone from the tunnel.
+	err           error
+	lastSeen      time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// ID returns the stream ID chosen by the client, in lower case.
+func (s *Stream) ID() string {
+	return s.id
+}
+
+// Tenant returns the name of the tenant the stream was opened under, if tenants are configured.
+func (s *Stream) Tenant() string {
+	return s.tenant
+}
+
+// Read reads upstream bytes sent by the client.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		switch {
+		case s.closed:
+			return 0, net.ErrClosed
+		case len(s.readBuf) > 0:
+			n := copy(p, s.readBuf)
+			s.readBuf = s.readBuf[n:]
+			return n, nil
+		case s.finAt >= 0 && s.received >= s.finAt:
+			return 0, io.EOF
+		case s.err != nil:
+			return 0, s.err
+		}
+		if err := s.wait(s.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues p for the client to receive. It blocks while more than 64 KiB are waiting to be
+// acknowledged by the client.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		switch {
+		case s.closed:
+			return written, net.ErrClosed
+		case s.err != nil:
+			return written, s.err
+		}
+		if space := maxStreamBuffer - len(s.writeBuf); space > 0 {
+			n := min(space, len(p))
+			s.writeBuf = append(s.writeBuf, p[:n]...)
+			p, written = p[n:], written+n
+			continue
+		}
+		if err := s.wait(s.writeDeadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the tunnel's side of the stream. Bytes already written are still delivered to the
+// client, which learns that nothing follows them.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.notify()
+	}
+	return nil
+}
+
+// LocalAddr returns the top domain that the stream was opened through.
+func (s *Stream) LocalAddr() net.Addr {
+	return s.local
+}
+
+// RemoteAddr returns the address of the resolver that sent the first query of the stream.
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.notify()
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.notify()
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	s.notify()
+	return nil
+}
+
+// notify wakes up the reads and writes waiting for the stream to change. The lock of s must be
+// held.
+func (s *Stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait releases the lock of s until the stream changes, or returns os.ErrDeadlineExceeded once
+// deadline, if set, has passed.
+func (s *Stream) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	changed := s.changed
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// receive handles a query of the stream received at now, and returns its answer. It reports
+// whether both sides of the stream are done, so that it can be removed.
+func (s *Stream) receive(q streamQuery, now time.Time) (StreamAnswer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = now
+	if q.ack > s.acked && q.ack <= s.acked+len(s.writeBuf) {
+		s.writeBuf = append([]byte(nil), s.writeBuf[q.ack-s.acked:]...)
+		s.acked = q.ack
+	}
+	if q.fin && s.finAt < 0 {
+		s.finAt = q.offset + len(q.data)
+	}
+	if len(q.data) > 0 {
+		s.segments[q.offset] = q.data
+		s.reassemble()
+		if len(s.segments) > maxStreamSegments {
+			// The client will send them again once they are next in line.
+			clear(s.segments)
+		}
+	}
+	s.notify()
+
+	offset := s.acked
+	end := min(offset+downstreamChunkSize, s.acked+len(s.writeBuf))
+	a := StreamAnswer{Received: s.received, Offset: offset, Data: s.writeBuf[:end-offset]}
+	a.Fin = s.closed && end == s.acked+len(s.writeBuf)
+	done := s.closed && len(s.writeBuf) == 0 && s.finAt >= 0 && s.received >= s.finAt
+	return a, done
+}
+
+// reassemble moves the segments that continue the upstream bytes received in order to readBuf,
+// as far as it has room for them.
+func (s *Stream) reassemble() {
+	for moved := true; moved; {
+		moved = false
+		for offset, data := range s.segments {
+			end := offset + len(data)
+			if end <= s.received {
+				delete(s.segments, offset)
+				continue
+			}
+			if offset > s.received {
+				continue
+			}
+			room := maxStreamBuffer - len(s.readBuf)
+			if s.closed {
+				// Nobody reads them anymore, so they are only counted.
+				room = len(data)
+			}
+			n := min(end-s.received, room)
+			if n == 0 {
+				return
+			}
+			if !s.closed {
+				s.readBuf = append(s.readBuf, data[s.received-offset:s.received-offset+n]...)
+			}
+			s.received += n
+			delete(s.segments, offset)
+			moved = true
+		}
+	}
+}
+
+// fail marks the stream as gone from the tunnel, returning err from its reads and writes from
+// then on.
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+		s.notify()
+	}
+}
+
+// streamAddr is the net.Addr of the top domain of a stream.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "dns" }
+
+func (a streamAddr) String() string { return string(a) }
+
+// serveStream answers q, a stream query under topDomain received from source. It opens the
+// stream if it doesn't exist yet.
+func (tun *Tunnel) serveStream(q streamQuery, topDomain string, tenant *tenantState, source net.Addr, now time.Time) []string {
+	tun.streamsLock.Lock()
+	s, ok := tun.streams[q.id]
+	if !ok {
+		if tun.maxStreams == 0 || len(tun.streams) >= tun.maxStreams || q.offset != 0 || q.ack != 0 {
+			tun.streamsLock.Unlock()
+			return []string{streamReset}
+		}
+		s = &Stream{tun: tun, id: q.id, local: streamAddr(topDomain), remote: source, changed: make(chan struct{}), segments: make(map[int][]byte), finAt: -1, lastSeen: now}
+		if tenant != nil {
+			s.tenant = tenant.Name
+		}
+		select {
+		case tun.accepted <- s:
+		default:
+			// Nobody accepts streams, or not fast enough.
+			tun.streamsLock.Unlock()
+			return []string{streamReset}
+		}
+		tun.streams[q.id] = s
+	}
+	tun.streamsLock.Unlock()
+
+	a, done := s.receive(q, now)
+	if done {
+		tun.closeStream(q.id, s, io.EOF)
+	}
+	return a.txt()
+}
+
+// closeStream removes stream s from the tunnel, failing its further reads and writes with err.
+func (tun *Tunnel) closeStream(id string, s *Stream, err error) {
+	tun.streamsLock.Lock()
+	if tun.streams[id] == s {
+		delete(tun.streams, id)
+	}
+	tun.streamsLock.Unlock()
+	s.fail(err)
+}
+
+// sweepStreams closes the streams whose clients haven't queried them for the stream timeout.
+func (tun *Tunnel) sweepStreams(now time.Time) {
+	tun.streamsLock.Lock()
+	var idle []*Stream
+	for _, s := range tun.streams {
+		s.mu.Lock()
+		if now.Sub(s.lastSeen) > tun.streamTimeout {
+			idle = append(idle, s)
+		}
+		s.mu.Unlock()
+	}
+	tun.streamsLock.Unlock()
+	for _, s := range idle {
+		tun.closeStream(s.id, s, ErrStreamTimeout)
+	}
+}
+
+// closeStreams fails the reads and writes of every stream once the tunnel is closed.
+func (tun *Tunnel) closeStreams() {
+	tun.streamsLock.Lock()
+	streams := tun.streams
+	tun.streams = make(map[string]*Stream)
+	tun.streamsLock.Unlock()
+	for _, s := range streams {
+		s.fail(net.ErrClosed)
+	}
+}
+
+// openStreams returns the number of open streams.
+func (tun *Tunnel) openStreams() int {
+	tun.streamsLock.Lock()
+	defer tun.streamsLock.Unlock()
+	return len(tun.streams)
+}
+
+// StreamListener returns a listener accepting the streams opened by clients, as described on
+// Stream, which requires Config.MaxStreams. Each stream is accepted by a single call to Accept of
+// any listener of the tunnel. Streams that aren't accepted promptly are reset. Closing the
+// listener doesn't affect the streams already accepted.
+func (tun *Tunnel) StreamListener() net.Listener {
+	return &streamListener{tun: tun, done: make(chan struct{})}
+}
+
+type streamListener struct {
+	tun  *Tunnel
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.tun.accepted:
+		return s, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.tun.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return streamAddr(l.tun.topDomains[0])
+}
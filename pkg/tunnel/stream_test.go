@@ -0,0 +1,183 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStream(t *testing.T) {
+	tests := []struct {
+		domain   string
+		isStream bool
+		fails    bool
+		output   streamQuery
+	}{
+		{
+			domain:   "st-x7f2.s1.0.0.tunnel.example.com.",
+			isStream: true,
+			output:   streamQuery{id: "s1", data: []byte{}},
+		},
+		{
+			domain:   "st-x7f2.s1.11.180.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+			isStream: true,
+			output:   streamQuery{id: "s1", offset: 11, ack: 180, data: []byte("hello world")},
+		},
+		{
+			domain:   "fin-x7f2.s1.22.0.tunnel.example.com.",
+			isStream: true,
+			output:   streamQuery{id: "s1", offset: 22, data: []byte{}, fin: true},
+		},
+		{
+			domain: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+		},
+		{domain: "st-x7f2.s1.0.tunnel.example.com.", isStream: true, fails: true},
+		{domain: "st-x7f2.s1.-1.0.tunnel.example.com.", isStream: true, fails: true},
+		{domain: "st-x7f2.s1.0.x.tunnel.example.com.", isStream: true, fails: true},
+		{domain: "st-x7f2.s1.0.0.1.tunnel.example.com.", isStream: true, fails: true},
+	}
+	for _, test := range tests {
+		got, isStream, err := parseStream("tunnel.example.com.", test.domain)
+		require.Equal(t, test.isStream, isStream, test.domain)
+		if test.fails {
+			require.NotNil(t, err, test.domain)
+			continue
+		}
+		require.Nil(t, err, test.domain)
+		require.Equal(t, test.output, got, test.domain)
+	}
+}
+
+func TestEncodeStreamQuery(t *testing.T) {
+	domain, err := EncodeStreamQuery("tunnel.example.com", "s1", "x7f2", 11, 180, []byte("hello world"), false)
+	require.Nil(t, err)
+	require.Equal(t, "st-x7f2.s1.11.180.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", domain)
+
+	n := MaxStreamData("tunnel.example.com.", "s1", "x7f2", 12345, 67890)
+	require.Greater(t, n, 100)
+	data := bytes.Repeat([]byte{0xff}, n)
+	domain, err = EncodeStreamQuery("tunnel.example.com.", "s1", "x7f2", 12345, 67890, data, true)
+	require.Nil(t, err)
+	q, _, err := parseStream("tunnel.example.com.", domain)
+	require.Nil(t, err)
+	require.Equal(t, data, q.data)
+	_, err = EncodeStreamQuery("tunnel.example.com.", "s1", "x7f2", 12345, 67890, append(data, 1, 2, 3, 4, 5), true)
+	require.NotNil(t, err)
+
+	a := StreamAnswer{Received: 11, Offset: 5, Data: []byte("hi"), Fin: true}
+	parsed, err := ParseStreamAnswer(a.txt())
+	require.Nil(t, err)
+	require.Equal(t, a, parsed)
+	_, err = ParseStreamAnswer([]string{streamReset})
+	require.NotNil(t, err)
+	_, err = ParseStreamAnswer([]string{"1.2.3", ""})
+	require.NotNil(t, err)
+}
+
+// queryStream sends a stream query to tun, and returns the strings of its answer.
+func queryStream(t *testing.T, tun *Tunnel, id string, offset, ack int, data string, fin bool) []string {
+	domain, err := EncodeStreamQuery("tunnel.example.com.", id, "x7f2", offset, ack, []byte(data), fin)
+	require.Nil(t, err)
+	req := &dns.Msg{}
+	req.SetQuestion(domain, dns.TypeTXT)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+	require.Len(t, w.msg.Answer, 1)
+	return w.msg.Answer[0].(*dns.TXT).Txt
+}
+
+// streamAnswer is like queryStream, but parses the answer.
+func streamAnswer(t *testing.T, tun *Tunnel, id string, offset, ack int, data string, fin bool) StreamAnswer {
+	a, err := ParseStreamAnswer(queryStream(t, tun, id, offset, ack, data, fin))
+	require.Nil(t, err)
+	return a
+}
+
+func TestStream(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", MaxStreams: 1})
+	defer tun.Close()
+	l := tun.StreamListener()
+	defer l.Close()
+
+	require.Equal(t, StreamAnswer{Received: 6, Data: []byte{}}, streamAnswer(t, tun, "s1", 0, 0, "hello ", false))
+	conn, err := l.Accept()
+	require.Nil(t, err)
+	s := conn.(*Stream)
+	require.Equal(t, "s1", s.ID())
+	require.Equal(t, "tunnel.example.com.", s.LocalAddr().String())
+	require.Equal(t, 1, tun.Stats().Streams)
+
+	// Streams are limited by MaxStreams, and others can't be joined midway.
+	require.Equal(t, []string{streamReset}, queryStream(t, tun, "s2", 0, 0, "", false))
+	require.Equal(t, []string{streamReset}, queryStream(t, tun, "s3", 6, 0, "", false))
+
+	// Segments received out of order are held until the bytes before them arrive, and repeats
+	// are ignored.
+	require.Equal(t, 6, streamAnswer(t, tun, "s1", 12, 0, "stream", false).Received)
+	require.Equal(t, 18, streamAnswer(t, tun, "s1", 6, 0, "world ", false).Received)
+	require.Equal(t, 18, streamAnswer(t, tun, "s1", 0, 0, "hello ", false).Received)
+	buf := make([]byte, 100)
+	n, err := s.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "hello world stream", string(buf[:n]))
+
+	long := bytes.Repeat([]byte("downstream "), 50)
+	_, err = s.Write(long)
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	var got []byte
+	for {
+		a := streamAnswer(t, tun, "s1", 18, len(got), "", false)
+		require.Equal(t, len(got), a.Offset)
+		got = append(got, a.Data...)
+		if a.Fin {
+			break
+		}
+	}
+	require.Equal(t, long, got)
+	_, err = s.Read(buf)
+	require.Equal(t, net.ErrClosed, err)
+
+	a := streamAnswer(t, tun, "s1", 18, len(got), "", true)
+	require.Equal(t, StreamAnswer{Received: 18, Offset: len(got), Data: []byte{}, Fin: true}, a)
+	require.Equal(t, 0, tun.Stats().Streams)
+	require.Equal(t, []string{streamReset}, queryStream(t, tun, "s1", 18, len(got), "", false))
+}
+
+func TestStreamEOF(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", MaxStreams: 1})
+	defer tun.Close()
+	l := tun.StreamListener()
+
+	streamAnswer(t, tun, "s1", 0, 0, "bye", true)
+	conn, err := l.Accept()
+	require.Nil(t, err)
+	data, err := io.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, "bye", string(data))
+
+	require.Nil(t, conn.SetDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = conn.Write(make([]byte, maxStreamBuffer+1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	tun.sweepStreams(time.Now().Add(DefaultStreamTimeout + time.Second))
+	require.Nil(t, conn.SetDeadline(time.Time{}))
+	_, err = conn.Write([]byte("more"))
+	require.Equal(t, ErrStreamTimeout, err)
+
+	require.Nil(t, l.Close())
+	_, err = l.Accept()
+	require.Equal(t, net.ErrClosed, err)
+}
+
+func TestStreamsDisabled(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+	require.Equal(t, []string{streamReset}, queryStream(t, tun, "s1", 0, 0, "hello", false))
+}
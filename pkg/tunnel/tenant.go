@@ -0,0 +1,176 @@
+package tunnel
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Tenant is one of several isolated projects served by a tunnel. When tenants are configured,
+// clients send fragments through domains of the form
+//
+//	<id>.<totalSize>.<offset>[.crc-<checksum>].<data>.<tenant>.<topDomain>
+//
+// and polls through poll-<nonce>.<clientID>.<seq>.<offset>.<tenant>.<topDomain>. Message IDs are
+// scoped to a tenant, so that tenants can't interfere with each other's partial messages, and each
+// message is tagged with its tenant. Downstream client IDs are shared by every tenant.
+type Tenant struct {
+	// Name is the label identifying the tenant. It is matched case-insensitively, and messages
+	// are tagged with it in lower case.
+	Name string
+
+	// MaxInFlight is the maximum number of the tenant's partial messages held in memory.
+	// Fragments that would start another message are dropped and counted in
+	// TenantStats.OverQuota. Zero means no limit.
+	MaxInFlight int
+
+	// RateLimit is the number of payload-bearing queries per second accepted for the tenant,
+	// across every source, with bursts of up to RateBurst queries. Queries beyond the limit are
+	// refused and counted in TenantStats.OverQuota. Zero disables rate limiting.
+	RateLimit float64
+	// RateBurst defaults to RateLimit, rounded up.
+	RateBurst int
+
+	// ExpirationPolicy, if set, overrides the expiration of the tenant's partial messages.
+	ExpirationPolicy
+}
+
+// TenantStats holds the counters and gauges of a single tenant.
+type TenantStats struct {
+	// Fragments counts fragments parsed successfully.
+	Fragments uint64
+	// Assembled counts messages that were reassembled and delivered.
+	Assembled uint64
+	// OverQuota counts fragments dropped and queries refused because the tenant exceeded its
+	// quotas.
+	OverQuota uint64
+
+	// InFlight is the number of the tenant's partial messages currently held in memory.
+	InFlight int
+}
+
+// ParseTenant parses a tenant as passed on the command line: name[:maxInFlight[:rateLimit]].
+func ParseTenant(s string) (Tenant, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) > 3 {
+		return Tenant{}, fmt.Errorf("Tenant %q has %d fields but expected at most 3", s, len(fields))
+	}
+	t := Tenant{Name: fields[0]}
+	var err error
+	if len(fields) > 1 && fields[1] != "" {
+		if t.MaxInFlight, err = strconv.Atoi(fields[1]); err != nil {
+			return Tenant{}, fmt.Errorf("Invalid max in-flight messages in tenant %q: %w", s, err)
+		}
+	}
+	if len(fields) > 2 && fields[2] != "" {
+		if t.RateLimit, err = strconv.ParseFloat(fields[2], 64); err != nil {
+			return Tenant{}, fmt.Errorf("Invalid rate limit in tenant %q: %w", s, err)
+		}
+	}
+	return t, nil
+}
+
+// tenantState is the state the tunnel keeps for a configured tenant.
+type tenantState struct {
+	Tenant
+	limiter  *rateLimiter
+	inFlight atomic.Int64
+	stats    TenantStats
+}
+
+// newTenants validates tenants and returns their state keyed by name.
+func newTenants(tenants []Tenant) (map[string]*tenantState, error) {
+	states := make(map[string]*tenantState)
+	for _, t := range tenants {
+		if t.Name == "" || strings.Contains(t.Name, ".") {
+			return nil, fmt.Errorf("Tenant name %q must be a single non-empty label", t.Name)
+		}
+		t.Name = strings.ToLower(t.Name)
+		if _, ok := states[t.Name]; ok {
+			return nil, fmt.Errorf("Tenant %s is configured more than once", t.Name)
+		}
+		if t.MaxInFlight < 0 || t.RateLimit < 0 || t.RateBurst < 0 {
+			return nil, fmt.Errorf("Quotas of tenant %s must not be negative", t.Name)
+		}
+		if t.Expiration < 0 || t.DeletionInterval < 0 {
+			return nil, fmt.Errorf("Expiration of tenant %s must not be negative", t.Name)
+		}
+		st := &tenantState{Tenant: t}
+		if t.RateLimit > 0 {
+			if st.RateBurst == 0 {
+				st.RateBurst = int(math.Ceil(t.RateLimit))
+			}
+			st.limiter = newRateLimiter(t.RateLimit, st.RateBurst)
+		}
+		states[t.Name] = st
+	}
+	return states, nil
+}
+
+// route returns the domain that fragments and polls in domain are encoded under, i.e. the top
+// domain, preceded by the tenant if tenants are configured, along with the tenant's state.
+func (tun *Tunnel) route(domain string) (string, *tenantState, error) {
+	top, ok := tun.topDomainOf(domain)
+	if !ok {
+		return "", nil, fmt.Errorf("Domain %s is not under any top domain", domain)
+	}
+	if len(tun.tenants) == 0 {
+		return top, nil, nil
+	}
+	under, _ := underDomain(domain, top)
+	name := under[strings.LastIndexByte(under, '.')+1:]
+	t, ok := tun.tenants[name]
+	if !ok {
+		return "", nil, fmt.Errorf("Domain %s is not under a configured tenant", domain)
+	}
+	return domain[len(domain)-len(name)-1-len(top):], t, nil
+}
+
+// allow reports whether the tenant's rate limit admits another query.
+func (t *tenantState) allow(now time.Time) bool {
+	if t.limiter == nil || t.limiter.allow(t.Name, now) {
+		return true
+	}
+	atomic.AddUint64(&t.stats.OverQuota, 1)
+	return false
+}
+
+// listKey is the key of a message's fragment list. Labels never contain dots, so keys of
+// different tenants can't collide.
+func listKey(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + "." + id
+}
+
+// reserve counts another partial message of the tenant, unless it already has MaxInFlight of
+// them, in which case it returns false.
+func (t *tenantState) reserve() bool {
+	for {
+		n := t.inFlight.Load()
+		if t.MaxInFlight > 0 && n >= int64(t.MaxInFlight) {
+			return false
+		}
+		if t.inFlight.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// TenantStats returns a snapshot of the counters of each configured tenant, keyed by name.
+func (tun *Tunnel) TenantStats() map[string]TenantStats {
+	stats := make(map[string]TenantStats, len(tun.tenants))
+	for name, t := range tun.tenants {
+		stats[name] = TenantStats{
+			Fragments: atomic.LoadUint64(&t.stats.Fragments),
+			Assembled: atomic.LoadUint64(&t.stats.Assembled),
+			OverQuota: atomic.LoadUint64(&t.stats.OverQuota),
+			InFlight:  int(t.inFlight.Load()),
+		}
+	}
+	return stats
+}
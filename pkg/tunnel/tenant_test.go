@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+)
+
+func TestNewTenants(t *testing.T) {
+	tests := []struct {
+		tenants []Tenant
+		fails   bool
+	}{
+		{tenants: []Tenant{{Name: "a"}, {Name: "b", MaxInFlight: 2, RateLimit: 1.5}}},
+		{tenants: []Tenant{{Name: ""}}, fails: true},
+		{tenants: []Tenant{{Name: "a.b"}}, fails: true},
+		{tenants: []Tenant{{Name: "a"}, {Name: "a"}}, fails: true},
+		{tenants: []Tenant{{Name: "a", MaxInFlight: -1}}, fails: true},
+	}
+	for _, test := range tests {
+		states, err := newTenants(test.tenants)
+		if test.fails {
+			require.NotNil(t, err)
+			continue
+		}
+		require.Nil(t, err)
+		require.Len(t, states, len(test.tenants))
+	}
+
+	states, err := newTenants([]Tenant{{Name: "b", RateLimit: 1.5}})
+	require.Nil(t, err)
+	require.Equal(t, 2, states["b"].RateBurst)
+}
+
+func TestParseTenant(t *testing.T) {
+	tests := []struct {
+		input  string
+		fails  bool
+		output Tenant
+	}{
+		{input: "alpha", output: Tenant{Name: "alpha"}},
+		{input: "alpha:100", output: Tenant{Name: "alpha", MaxInFlight: 100}},
+		{input: "alpha:100:2.5", output: Tenant{Name: "alpha", MaxInFlight: 100, RateLimit: 2.5}},
+		{input: "alpha::2.5", output: Tenant{Name: "alpha", RateLimit: 2.5}},
+		{input: "alpha:FAIL", fails: true},
+		{input: "alpha:1:FAIL", fails: true},
+		{input: "alpha:1:2:3", fails: true},
+	}
+	for _, test := range tests {
+		got, err := ParseTenant(test.input)
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+		}
+		require.Equal(t, test.output, got)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain: "tunnel.example.com.",
+		Tenants:   []Tenant{{Name: "alpha"}, {Name: "beta", MaxInFlight: 1}},
+	})
+	defer tun.Close()
+
+	// The same message ID is kept apart for each tenant.
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.alpha.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.beta.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.gamma.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}
+	tun.domains <- query{name: "abcdef.24.0.nbswy3dpeb3w.beta.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.alpha.tunnel.example.com."}
+	msg := <-tun.Messages()
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, "alpha", msg.Tenant)
+	require.Equal(t, "tunnel.example.com.", msg.Domain)
+	require.Equal(t, 2, msg.Fragments)
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.beta.tunnel.example.com."}
+	msg = <-tun.Messages()
+	require.Equal(t, "beta", msg.Tenant)
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(2), stats.ParseErrors)
+	require.Equal(t, map[string]TenantStats{
+		"alpha": {Fragments: 2, Assembled: 1},
+		"beta":  {Fragments: 3, Assembled: 1, OverQuota: 1},
+	}, tun.TenantStats())
+
+	var buf bytes.Buffer
+	require.Nil(t, metrics.Write(&buf, tun.Collect()))
+	require.Contains(t, buf.String(), "browsertunnel_tenant_over_quota_total{tenant=\"beta\"} 1\n")
+	require.Contains(t, buf.String(), "browsertunnel_tenant_in_flight{tenant=\"alpha\"} 0\n")
+}
+
+func TestTenantExpired(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain:        "tunnel.example.com.",
+		Tenants:          []Tenant{{Name: "alpha", MaxInFlight: 1}},
+		Expiration:       10 * time.Millisecond,
+		DeletionInterval: 5 * time.Millisecond,
+	})
+	defer tun.Close()
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.alpha.tunnel.example.com."}
+	partial := <-tun.Expired()
+	require.Equal(t, "2jkhm3", partial.ID)
+	require.Equal(t, "alpha", partial.Tenant)
+
+	// The expired message no longer counts towards the quota.
+	tun.domains <- query{name: "abcdef.24.0.nbswy3dpeb3w64tmmq000000.alpha.tunnel.example.com."}
+	require.Equal(t, "abcdef", (<-tun.Messages()).ID)
+}
+
+func TestTenantRateLimit(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain: "tunnel.example.com.",
+		Tenants:   []Tenant{{Name: "alpha", RateLimit: 0.001, RateBurst: 1}, {Name: "beta"}},
+	})
+	defer tun.Close()
+
+	rcode := func(domain string) int {
+		req := &dns.Msg{}
+		req.SetQuestion(domain, dns.TypeA)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, req)
+		return w.msg.Rcode
+	}
+	require.Equal(t, dns.RcodeSuccess, rcode("2jkhm3.24.0.nbswy3dpeb3w.alpha.tunnel.example.com."))
+	require.Equal(t, dns.RcodeRefused, rcode("2jkhm3.24.12.64tmmq000000.alpha.tunnel.example.com."))
+	require.Equal(t, dns.RcodeSuccess, rcode("2jkhm3.24.0.nbswy3dpeb3w.beta.tunnel.example.com."))
+	require.Equal(t, uint64(1), tun.TenantStats()["alpha"].OverQuota)
+}
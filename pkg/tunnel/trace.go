@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer returns the tracer of the spans of the reassembly pipeline:
+//
+//	browsertunnel.query       a DNS query, from receipt to answer
+//	browsertunnel.fragment    the parsing of the fragment it carries, as a child of the query
+//	browsertunnel.reassemble  from the first fragment of a message until it was assembled, as a
+//	                          child of the final fragment
+//
+// Sinks add a browsertunnel.deliver span as a child of browsertunnel.reassemble, whose context is
+// carried in Message.SpanContext. The tracer comes from the global tracer provider, so spans are
+// only recorded once the program installs one with otel.SetTracerProvider.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/veggiedefender/browsertunnel/pkg/tunnel")
+}
+
+// Attributes of the spans.
+const (
+	attrMessageID = attribute.Key("browsertunnel.message.id")
+	attrTenant    = attribute.Key("browsertunnel.tenant")
+	attrQueryName = attribute.Key("dns.question.name")
+	attrQueryType = attribute.Key("dns.question.type")
+	attrClient    = attribute.Key("client.address")
+	attrOffset    = attribute.Key("browsertunnel.fragment.offset")
+	attrSize      = attribute.Key("browsertunnel.fragment.size")
+	attrTotalSize = attribute.Key("browsertunnel.message.total_size")
+	attrFragments = attribute.Key("browsertunnel.message.fragments")
+	attrKind      = attribute.Key("browsertunnel.query.kind")
+)
+
+// MessageIDAttribute returns the attribute of spans that identifies the message they relate to.
+func MessageIDAttribute(id string) attribute.KeyValue {
+	return attrMessageID.String(id)
+}
+
+// fail marks span as failed with err.
+func fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a global tracer provider recording every span for the duration of the
+// test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return exporter
+}
+
+func TestTracing(t *testing.T) {
+	exporter := recordSpans(t)
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com"})
+	defer tun.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(&testResponseWriter{}, r)
+	msg := <-tun.Messages()
+
+	require.Eventually(t, func() bool { return len(exporter.GetSpans()) == 3 }, time.Second, time.Millisecond)
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+	}
+	query, fragment, reassembly := spans["browsertunnel.query"], spans["browsertunnel.fragment"], spans["browsertunnel.reassemble"]
+	require.Equal(t, query.SpanContext.SpanID(), fragment.Parent.SpanID())
+	require.Equal(t, fragment.SpanContext.SpanID(), reassembly.Parent.SpanID())
+	require.Equal(t, query.SpanContext.TraceID(), reassembly.SpanContext.TraceID())
+	require.Contains(t, reassembly.Attributes, MessageIDAttribute("2jkhm3"))
+	require.Equal(t, reassembly.SpanContext, msg.SpanContext)
+
+	// Fragments that can't be parsed fail their span.
+	exporter.Reset()
+	r.SetQuestion("2jkhm3.FAIL.0.nbswy3dp.tunnel.example.com.", dns.TypeA)
+	tun.ServeDNS(&testResponseWriter{}, r)
+	require.Eventually(t, func() bool { return len(exporter.GetSpans()) == 2 }, time.Second, time.Millisecond)
+	for _, s := range exporter.GetSpans() {
+		if s.Name == "browsertunnel.fragment" {
+			require.Len(t, s.Events, 1)
+		}
+	}
+}
@@ -0,0 +1,1980 @@
+// Package tunnel implements the server side of browsertunnel: a DNS handler that collects message
+// fragments encoded in the subdomains of queries and reassembles them into messages.
+//
+// Each fragment is sent as a query for a domain of the form
+//
+//	<id>.<totalSize>.<offset>[.crc-<checksum>].<data>.<topDomain>
+//
+// where data is a chunk of the base32 encoded message, optionally split across several labels,
+// and checksum is the optional hex encoded CRC32 of data. Fragments whose checksum doesn't match
+// are dropped. An Encoder produces these domains from a message.
+package tunnel
+
+import (
+	"container/list"
+	"context"
+	"crypto/cipher"
+	"encoding/base32"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/veggiedefender/browsertunnel/pkg/metrics"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var decoder = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding('0')
+
+// checksumPrefix marks the optional label that carries the CRC32 checksum of a fragment's data.
+// Hyphens never appear in base32 data, so the label can't be mistaken for payload.
+const checksumPrefix = "crc-"
+
+// payloadTypes are the query types whose names are parsed for fragments. Browsers and resolvers
+// treat query types differently, so clients may use whichever reaches the tunnel most reliably.
+var payloadTypes = map[uint16]bool{
+	dns.TypeA:    true,
+	dns.TypeAAAA: true,
+	dns.TypeTXT:  true,
+	dns.TypeMX:   true,
+	dns.TypeNULL: true,
+}
+
+// A Tunnel listens for DNS queries. Messages that are collected and decoded are outputted through
+// the channel returned by Messages. Partial messages that expire before they are complete are
+// reported through the channel returned by Expired on a best-effort basis: if nobody is reading
+// from it, notifications are dropped rather than stalling the tunnel, as are the session events
+// reported through the channel returned by Sessions.
+type Tunnel struct {
+	messages       chan Message
+	chunks         chan MessageChunk
+	expired        chan PartialMessage
+	sessionEvents  chan SessionEvent
+	progressEvents chan ProgressEvent
+	errors         chan TunnelError
+	strays         chan StrayQuery
+	alerts         chan Alert
+	// ctx is canceled by stop when the tunnel is closed.
+	ctx                 context.Context
+	stop                context.CancelFunc
+	closeOnce           sync.Once
+	wg                  sync.WaitGroup
+	shards              []*shard
+	partials            atomic.Int64
+	bufferedBytes       atomic.Int64
+	topDomains          []string
+	encodings           map[string]Encoding
+	codecs              map[string]Codec
+	authority           Authority
+	tenants             map[string]*tenantState
+	domains             chan query
+	logger              *slog.Logger
+	clock               Clock
+	queryLog            QueryLogger
+	anomalies           *detector
+	settings            atomic.Pointer[settings]
+	draining            atomic.Bool
+	defaultPolicy       ExpirationPolicy
+	domainPolicies      map[string]ExpirationPolicy
+	sweeps              sweepSchedule
+	maxExpiration       time.Duration
+	maxMessageSize      int
+	chunkThreshold      int
+	parseRules          parseRules
+	parseErrors         map[string]*uint64
+	queryTypes          typeCounters
+	queryCounts         *queryCounters
+	clients             *clientTracker
+	sessions            *sessionTracker
+	progress            bool
+	liveness            *livenessTracker
+	order               *reorderBuffer
+	reassemblyTimes     *metrics.Distribution
+	messageFragments    *metrics.Distribution
+	maxPartialMessages  int
+	maxBufferedBytes    int
+	maxFragmentBytes    int
+	outboxes            map[string]*outbox
+	outboxesLock        sync.Mutex
+	streams             map[string]*Stream
+	streamsLock         sync.Mutex
+	accepted            chan *Stream
+	maxStreams          int
+	streamTimeout       time.Duration
+	hmacKey             []byte
+	signingKeys         []SigningKey
+	requireSignatures   bool
+	authTokens          authTokens
+	certTenants         map[string]string
+	aead                cipher.AEAD
+	keys                atomic.Pointer[keyring]
+	maxDecompressedSize int
+	store               FragmentStore
+	workers             int
+	dedupWindow         time.Duration
+	replayStore         ReplayStore
+	recent              *recentQueries
+	acks                bool
+	nackDelay           time.Duration
+	backpressure        Backpressure
+	spool               Spool
+	spoolLock           sync.Mutex
+	spooled             atomic.Int64
+	unspool             chan struct{}
+	stats               Stats
+}
+
+// Config configures a Tunnel. Zero values are replaced with the defaults documented on each field.
+type Config struct {
+	// TopDomain is the domain that queries are tunneled through, e.g. t1.example.com. TopDomains
+	// lists further domains to tunnel through, for servers that several domains are delegated to.
+	// At least one domain is required. Fragments of a message may arrive through any of them.
+	TopDomain  string
+	TopDomains []string
+
+	// Encodings maps top domains to the encoding of the data labels of fragments sent through
+	// them that don't name one with FlagEncoding, such as those framed as Version1. Top domains
+	// that aren't listed carry EncodingBase32.
+	Encodings map[string]Encoding
+
+	// Codecs maps top domains to the Codec laying out the fragments sent through them, for clients
+	// encoding them with the same Encoder.Codec. Top domains that aren't listed use StandardCodec.
+	Codecs map[string]Codec
+
+	// DomainExpirations maps top domains to the Expiration and DeletionInterval of the partial
+	// messages sent through them, where they differ from those of Config. The ExpirationPolicy of
+	// a tenant takes precedence.
+	DomainExpirations map[string]ExpirationPolicy
+
+	// Expiration decides how long (at a minimum) a partial message is kept in memory before being
+	// deleted. Updating a message resets its expiration timer. Defaults to 60 seconds.
+	Expiration time.Duration
+
+	// MaxExpiration bounds how long clients may ask for their partial messages to be kept with
+	// FlagExpiration, as set by Encoder.Expiration. Defaults to ten times the longest of
+	// Expiration and the expirations of DomainExpirations and Tenants.
+	MaxExpiration time.Duration
+
+	// DeletionInterval controls how often a goroutine running in the background loops through
+	// each partial message in memory and removes messages that are expired. Checking for
+	// expiration locks each shard of the internal map of messages in turn; therefore, values of
+	// DeletionInterval that are too frequent may hurt performance. Defaults to 5 seconds. The
+	// shards are locked as often as the shortest interval of DomainExpirations and Tenants.
+	DeletionInterval time.Duration
+
+	// Workers is the number of goroutines parsing fragments and reassembling messages. Messages
+	// are kept in a map sharded by message ID, so that workers handling different messages don't
+	// contend for a lock. Defaults to GOMAXPROCS.
+	Workers int
+
+	// MaxMessageSize configures the maximum size of an encoded message that the tunnel will
+	// accept. Fragments that declare a size greater than MaxMessageSize, or an offset outside of
+	// the declared size, are discarded before any memory is allocated for them. Defaults to 5000.
+	MaxMessageSize int
+
+	// Strict, if set, rejects fragments that a conforming client never sends, even though they could
+	// be parsed: data labels with characters outside of the base32 alphabet, and sizes or offsets
+	// with signs or leading zeros. Such fragments are otherwise only rejected, if at all, once the
+	// whole message fails to decode. MaxDataLabels, if not zero, is the maximum number of labels
+	// carrying data in a fragment. Rejected fragments are counted in Stats.ParseErrors, and by
+	// reason in Stats.ParseErrorReasons.
+	Strict        bool
+	MaxDataLabels int
+
+	// MaxPartialMessages and MaxBufferedBytes bound the memory used by partial messages, which a
+	// flood of bogus message IDs could otherwise grow until they expire. When the tunnel holds
+	// more than MaxPartialMessages partial messages, or more than MaxBufferedBytes bytes of
+	// encoded data across all of them, the least recently updated messages are evicted, and
+	// counted in Stats.EvictedMessages and Stats.EvictedBytes. Zero means no limit.
+	MaxPartialMessages int
+	MaxBufferedBytes   int
+
+	// MaxFragmentBytes is the maximum number of bytes of encoded data buffered for a single
+	// message. Fragments may overlap, so a message can buffer more than its declared size; one
+	// that exceeds MaxFragmentBytes is dropped and counted in Stats.Oversized. Defaults to twice
+	// MaxMessageSize.
+	MaxFragmentBytes int
+
+	// ChunkThreshold, if set, emits the messages whose encoded size is above it on
+	// Tunnel.MessageChunks as they are received, as described on MessageChunk, rather than
+	// buffering them until they are complete. Their fragments still count towards
+	// MaxFragmentBytes until they are emitted, so that a message larger than MaxFragmentBytes can
+	// be received as long as its fragments arrive roughly in order. It can't be combined with
+	// HMACKey, SigningKeys, DecryptKey or Store.
+	ChunkThreshold int
+
+	// HMACKey, if set, requires every message to end with an HMAC-SHA256 tag of the rest of the
+	// message computed with HMACKey. Messages without a valid tag are dropped and counted in
+	// Stats.Unauthenticated. The tag is stripped before messages are delivered.
+	HMACKey []byte
+
+	// SigningKeys are the Ed25519 public keys that clients may sign messages with, as
+	// Encoder.SigningKey does. A message that ends with the signature of the rest of the message
+	// by one of the keys is delivered without the signature, with the key's identity as
+	// Message.Signer. Signatures are checked after HMAC tags and before decryption, so they cover
+	// the ciphertext. Other messages are delivered as is, unless RequireSignatures is set, in which
+	// case they are dropped and counted in Stats.Unsigned. Messages signed with a key that isn't
+	// configured can't be told apart from unsigned ones.
+	SigningKeys       []SigningKey
+	RequireSignatures bool
+
+	// AuthTokens and AuthTokenKey, if set, require every fragment to carry an auth token, framed
+	// with FlagToken: either one of AuthTokens, matched case-insensitively, or the token that
+	// DeriveAuthToken derives from the message ID with AuthTokenKey. Fragments without a valid
+	// token are dropped before anything is stored for their message, and counted in
+	// Stats.Unauthorized, so that queries from scanners can't fill up the partial messages.
+	AuthTokens   []string
+	AuthTokenKey []byte
+	// APIKeys are further auth tokens, each limited to a tenant and quotas of its own, as
+	// described on APIKey. Like AuthTokens, they require every fragment to carry a token.
+	APIKeys []APIKey
+	// CertTenants maps the identities of TLS client certificates, the subject common name or
+	// one of the DNS or email SANs, to the tenant they may send to. Queries received over TLS
+	// with a client certificate, e.g. from a DoT or DoH listener configured to verify them, are
+	// refused and counted in Stats.CertDenied if they are for another tenant, or if the
+	// certificate has no identity listed. It requires Tenants.
+	CertTenants map[string]string
+
+	// DecryptKey, if set, is the 16, 24 or 32 byte AES key that messages are encrypted with.
+	// Encrypted messages consist of a 12 byte random nonce followed by the AES-GCM ciphertext, so
+	// recursive resolvers never see the plaintext. Messages that fail to decrypt are dropped and
+	// counted in Stats.Undecryptable. If HMACKey is also set, the tag covers the ciphertext.
+	DecryptKey []byte
+
+	// DecryptKeys are further AES keys by ID, for messages whose fragments carry FlagKey and the
+	// ID of the key they are encrypted with, so that different clients or campaigns can use keys
+	// of their own. Messages without a key ID are still decrypted with DecryptKey, and messages
+	// naming an unknown key are counted in Stats.Undecryptable. The keys can be replaced while
+	// the tunnel is running with Tunnel.SetDecryptKeys.
+	DecryptKeys map[string][]byte
+
+	// MaxDecompressedSize is the maximum size of a gzip compressed message once decompressed.
+	// Messages whose (decrypted) payload starts with the gzip magic number are decompressed before
+	// they are delivered. Defaults to 1 MiB.
+	MaxDecompressedSize int
+
+	// RateLimit is the number of payload-bearing queries per second accepted from a single
+	// source IP, with bursts of up to RateBurst queries. Queries beyond the limit are refused
+	// and counted in Stats.RateLimited. Zero disables rate limiting.
+	RateLimit float64
+	// RateBurst defaults to RateLimit, rounded up.
+	RateBurst int
+
+	// AllowCIDRs, if not empty, restricts the tunnel to queries from these networks. Queries from
+	// networks in DenyCIDRs are always refused. Refused queries are counted in Stats.Denied.
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+
+	// DedupWindow, if set, suppresses duplicate and replayed messages: once a message is
+	// delivered, fragments with the same ID are ignored for DedupWindow, and counted in
+	// Stats.Replayed. Recursive resolvers often retry queries, which would otherwise start a new
+	// partial message after the original was delivered, or deliver single-fragment messages
+	// twice, and an observer who recorded the queries could replay them. Clients must not reuse a
+	// message ID within the window. Fragments that repeat the data already received at the same
+	// offset are always ignored, and counted in Stats.Duplicates.
+	DedupWindow time.Duration
+	// ReplayStore, if set, persists the messages delivered within the dedup window, so that they
+	// are still ignored after a restart.
+	ReplayStore ReplayStore
+	// FanoutWindow is how long a fragment query is recognized when it arrives again, usually from
+	// another recursive resolver that the client or its resolver fanned the query out to. Repeats
+	// are counted once: they aren't charged to the rate limits, nor counted in the fragments of
+	// Stats, tenants and clients, and they don't start a new partial message once the original
+	// was completed. They are counted in Stats.FanoutDuplicates. Defaults to
+	// DefaultFanoutWindow, and is disabled if negative.
+	FanoutWindow time.Duration
+
+	// Acks, if set, answers A and TXT queries carrying a fragment with an acknowledgement of what
+	// has been received of its message, as described on ParseAck. Answering a query then waits for
+	// its fragment to be processed.
+	Acks bool
+	// NackDelay is how long a partial message must go without a new fragment before status
+	// queries are answered with the ranges missing from it, as described on statusPrefix.
+	// Defaults to DefaultNackDelay. Status queries only recognize the messages delivered within
+	// DedupWindow.
+	NackDelay time.Duration
+
+	// Backpressure decides what happens to assembled messages when the Messages channel is full.
+	// Defaults to Block. Messages dropped by DropNewest and DropOldest are counted in
+	// Stats.Overflowed.
+	Backpressure Backpressure
+	// Spool holds the messages spilled by the Spill policy, which requires it.
+	Spool Spool
+
+	// Tenants, if not empty, splits the tunnel between isolated projects, as described on Tenant.
+	// Queries that don't carry the name of a configured tenant are dropped.
+	Tenants []Tenant
+
+	// Response configures how queries are answered. By default, queries other than TXT queries
+	// are answered with a CNAME to DefaultCNAMETarget, with a TTL of 0.
+	Response Response
+	// Authority configures the SOA and NS records of the top domains, which are served
+	// alongside the tunnel, as described on Authority. Replies to queries under a top domain
+	// are authoritative, and those without an answer carry its SOA record.
+	Authority Authority
+
+	// SessionTimeout is how long a session may go without sending a message before it ends, and
+	// SessionHeartbeat how often an active session is reported, as described on Tunnel.Sessions.
+	// They default to DefaultSessionTimeout and DefaultSessionHeartbeat.
+	SessionTimeout   time.Duration
+	SessionHeartbeat time.Duration
+
+	// Progress, if set, reports how much of each partial message has been received on
+	// Tunnel.Progress after each of its fragments.
+	Progress bool
+
+	// MaxStreams is the maximum number of streams open at once, as described on Stream. Streams
+	// are disabled if 0. StreamTimeout is how long a stream may go without a query before it is
+	// closed, and defaults to DefaultStreamTimeout.
+	MaxStreams    int
+	StreamTimeout time.Duration
+
+	// OrderedDelivery delivers the messages of each session in the order of their sequence
+	// numbers, as set by Encoder.Sequence, rather than in the order they are assembled. A message
+	// assembled before one sent ahead of it in its session is held back until that message is
+	// delivered, or until it has waited for ReorderTimeout, after which the missing messages are
+	// given up on and counted in Stats.SequenceGaps. Messages without a sequence number are
+	// delivered as soon as they are assembled.
+	OrderedDelivery bool
+	// ReorderTimeout defaults to Expiration, after which the missing messages would have expired
+	// unless more of their fragments were received.
+	ReorderTimeout time.Duration
+
+	// Store, if set, persists the fragments of partial messages so that they survive a restart.
+	// Partial messages are restored from it by New, and those that expired in the meantime are
+	// deleted. Failures to persist a fragment are logged, and don't prevent it from being
+	// reassembled. A SharedFragmentStore also lets several servers reassemble messages whose
+	// fragments were spread across them.
+	Store FragmentStore
+
+	// Logger receives structured logs about dropped fragments and messages. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+
+	// Clock tells the time that fragments are received and delivered messages are deduplicated
+	// at, and ticks the sweep run every DeletionInterval. A ManualClock, together with Sweep,
+	// makes expiration deterministic in tests. Queries handed over by a CapturedResponseWriter
+	// keep the time they were captured at. Defaults to the system clock.
+	Clock Clock
+
+	// QueryLog, if set, is told about every query served, with how it was handled, including
+	// those that are refused or carry no data.
+	QueryLog QueryLogger
+
+	// Anomalies configures the detection of suspicious traffic patterns reported on Alerts.
+	// Nothing is detected by default.
+	Anomalies AnomalyConfig
+}
+
+// Default values for the fields of Config.
+const (
+	DefaultExpiration          = 60 * time.Second
+	DefaultDeletionInterval    = 5 * time.Second
+	DefaultMaxMessageSize      = 5000
+	DefaultMaxDecompressedSize = 1 << 20
+	DefaultFanoutWindow        = 5 * time.Second
+)
+
+// A Message is a message reassembled from its fragments, along with metadata describing how it
+// arrived.
+type Message struct {
+	// ID is the message ID chosen by the client.
+	ID string
+	// Payload is the decoded message.
+	Payload []byte
+	// Binary reports whether the client marked the message as binary data rather than text.
+	// Text payloads are usually, but not necessarily, valid UTF-8.
+	Binary bool
+	// Signer is the identity of the SigningKey that signed the message, if any.
+	Signer string
+	// Source is the IP address that the final fragment was received from. This is usually the
+	// client's recursive resolver rather than the client itself.
+	Source net.IP
+	// ClientSubnet is the network of the client that the final fragment was resolved on behalf
+	// of, if the resolver forwarded it in an EDNS Client Subnet option. Resolvers truncate the
+	// client's address to a prefix, typically a /24 or a /56.
+	ClientSubnet *net.IPNet
+	// QueryType is the DNS query type of the final fragment, e.g. dns.TypeA.
+	QueryType uint16
+	// Domain is the fully qualified top domain that the final fragment was received through.
+	Domain string
+	// Tenant is the name of the tenant the message was sent to, if tenants are configured.
+	Tenant string
+	// Fragments is the number of distinct fragments the message was assembled from.
+	Fragments int
+	// FirstFragment and LastFragment are the times the first and last fragments were received.
+	FirstFragment time.Time
+	LastFragment  time.Time
+	// Session is the label of the client session the message was sent in, if any, as described
+	// on Tunnel.Sessions.
+	Session string
+	// Sequence is the number of the message within its session, if the client set one, as
+	// described on Config.OrderedDelivery.
+	Sequence int
+	// Tags are labels attached to the message after it was assembled, e.g. by a hook. The tunnel
+	// doesn't set any.
+	Tags map[string]string
+	// SpanContext identifies the span of the reassembly of the message, if tracing is enabled, so
+	// that its delivery can be traced as part of the same trace. It isn't persisted, e.g. by
+	// spools.
+	SpanContext trace.SpanContext `json:"-"`
+}
+
+// A PartialMessage describes a message that hasn't received all of its fragments, either
+// because it is still in flight or because it expired before they were received.
+type PartialMessage struct {
+	ID        string
+	Tenant    string
+	TotalSize int
+	Received  int
+	Missing   []Range
+	// Fragments is the number of distinct fragments received.
+	Fragments int
+	// FirstFragment is when the first fragment was received, and ExpiresAt when the message
+	// expires, or expired, unless another fragment is received.
+	FirstFragment time.Time
+	ExpiresAt     time.Time
+}
+
+// A Range is a span of bytes within an encoded message.
+type Range struct {
+	Offset int
+	Length int
+}
+
+// A query is a payload-bearing DNS query waiting to be parsed.
+type query struct {
+	name string
+	// asked is the name as it was asked, in its original case, which name is the lower case of.
+	asked string
+	// client is the IP address of source, as formatted by clientIP.
+	client     string
+	qtype      uint16
+	source     net.Addr
+	subnet     *net.IPNet
+	receivedAt time.Time
+	// span is the context of the span of the query, which the span of its fragment belongs to.
+	span trace.SpanContext
+	// ack, if not nil, receives the acknowledgement of the fragment once it is processed, or is
+	// closed if the fragment can't be parsed.
+	ack chan Ack
+	// repeat is set if the query repeats one received within the fanout window.
+	repeat bool
+	// flush, if not nil, marks the end of the queries that Flush waits for, instead of a fragment.
+	flush *flushBarrier
+}
+
+// askedName returns the name of q as it was asked, or its lower case if that is unknown.
+func (q query) askedName() string {
+	if q.asked == "" {
+		return q.name
+	}
+	return q.asked
+}
+
+// Error classes attached to logs, describing why a fragment or message was dropped.
+const (
+	classParse        = "parse"
+	classAssembly     = "assembly"
+	classAuth         = "auth"
+	classDecrypt      = "decrypt"
+	classDecompress   = "decompress"
+	classPoll         = "poll"
+	classHeartbeat    = "heartbeat"
+	classStream       = "stream"
+	classStatus       = "status"
+	classDrain        = "drain"
+	classQuota        = "quota"
+	classEvict        = "evict"
+	classBackpressure = "backpressure"
+	classWrite        = "write"
+)
+
+type fragmentList struct {
+	// id is the ID of the message, and tenant the name of its tenant.
+	id        string
+	tenant    string
+	framing   framing
+	totalSize int
+	fragments map[int]fragment
+	// parity holds the parity fragments of messages framed with FlagParity, by the offset of the
+	// first fragment of their group.
+	parity map[int]fragment
+	// size is the number of bytes of data in fragments and parity.
+	size int
+	// covered lists the ranges of the message received so far, as maintained by cover.
+	covered []Range
+	// emitted is the number of bytes of the message emitted as chunks, and discarded the number of
+	// fragments discarded once emitted, as described on MessageChunk.
+	emitted   int
+	discarded int
+	expiresAt time.Time
+	// policy is the expiration policy of the message, as of when it was started.
+	policy    ExpirationPolicy
+	firstSeen time.Time
+	// lastSeen is when the latest fragment was received.
+	lastSeen time.Time
+	// elem is the list's entry in its shard's LRU list.
+	elem *list.Element
+}
+
+type fragment struct {
+	id        string
+	framing   framing
+	totalSize int
+	offset    int
+	data      string
+}
+
+// New creates a new tunnel and starts goroutines to manage messages. The tunnel does not listen
+// on the network by itself; register it as a dns.Handler for each top domain on a dns.Server.
+func New(cfg Config) (*Tunnel, error) {
+	return NewContext(context.Background(), cfg)
+}
+
+// NewContext creates a new tunnel like New, which is closed as by Close once ctx is done, so that
+// its goroutines are tied to the lifetime of the caller. Restoring partial messages from
+// Config.Store is not interrupted by ctx. To drain partial messages before the tunnel is closed,
+// call Shutdown rather than canceling ctx.
+func NewContext(ctx context.Context, cfg Config) (*Tunnel, error) {
+	topDomains, err := normalizeTopDomains(append([]string{cfg.TopDomain}, cfg.TopDomains...))
+	if err != nil {
+		return nil, err
+	}
+	encodings, err := normalizeEncodings(cfg.Encodings, topDomains)
+	if err != nil {
+		return nil, err
+	}
+	codecs, err := normalizeCodecs(cfg.Codecs, topDomains)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Expiration == 0 {
+		cfg.Expiration = DefaultExpiration
+	}
+	if cfg.MaxExpiration == 0 {
+		longest := cfg.Expiration
+		for _, p := range cfg.DomainExpirations {
+			longest = max(longest, p.Expiration)
+		}
+		for _, t := range cfg.Tenants {
+			longest = max(longest, t.Expiration)
+		}
+		cfg.MaxExpiration = 10 * longest
+	}
+	if cfg.DeletionInterval == 0 {
+		cfg.DeletionInterval = DefaultDeletionInterval
+	}
+	domainPolicies, err := normalizeDomainExpirations(cfg.DomainExpirations, topDomains)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if cfg.MaxFragmentBytes == 0 {
+		cfg.MaxFragmentBytes = 2 * cfg.MaxMessageSize
+	}
+	if cfg.MaxDecompressedSize == 0 {
+		cfg.MaxDecompressedSize = DefaultMaxDecompressedSize
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.FanoutWindow == 0 {
+		cfg.FanoutWindow = DefaultFanoutWindow
+	}
+	if cfg.SessionTimeout == 0 {
+		cfg.SessionTimeout = DefaultSessionTimeout
+	}
+	if cfg.SessionHeartbeat == 0 {
+		cfg.SessionHeartbeat = DefaultSessionHeartbeat
+	}
+	if cfg.ReorderTimeout == 0 {
+		cfg.ReorderTimeout = cfg.Expiration
+	}
+	if cfg.StreamTimeout == 0 {
+		cfg.StreamTimeout = DefaultStreamTimeout
+	}
+	if cfg.NackDelay == 0 {
+		cfg.NackDelay = DefaultNackDelay
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = systemClock{}
+	}
+	tenants, err := newTenants(cfg.Tenants)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Authority.validate(); err != nil {
+		return nil, err
+	}
+	tokens, err := newAuthTokens(cfg.AuthTokens, cfg.AuthTokenKey, cfg.APIKeys, tenants)
+	if err != nil {
+		return nil, err
+	}
+	certTenants, err := newCertTenants(cfg.CertTenants, tenants)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSigningKeys(cfg.SigningKeys); err != nil {
+		return nil, err
+	}
+	if cfg.RequireSignatures && len(cfg.SigningKeys) == 0 {
+		return nil, fmt.Errorf("RequireSignatures requires SigningKeys")
+	}
+	st, err := newSettings(Settings{
+		RateLimit:  cfg.RateLimit,
+		RateBurst:  cfg.RateBurst,
+		AllowCIDRs: cfg.AllowCIDRs,
+		DenyCIDRs:  cfg.DenyCIDRs,
+		Response:   cfg.Response,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Expiration < 0 || cfg.MaxExpiration < 0 || cfg.DeletionInterval < 0 || cfg.MaxMessageSize < 0 || cfg.MaxDecompressedSize < 0 || cfg.DedupWindow < 0 || cfg.Workers < 0 || cfg.MaxDataLabels < 0 {
+		return nil, fmt.Errorf("Expirations, deletion interval, dedup window, message sizes and workers must not be negative")
+	}
+	if cfg.SessionTimeout < 0 || cfg.SessionHeartbeat < 0 || cfg.ReorderTimeout < 0 {
+		return nil, fmt.Errorf("Session timeout and heartbeat and reorder timeout must not be negative")
+	}
+	if cfg.ChunkThreshold < 0 {
+		return nil, fmt.Errorf("Chunk threshold must not be negative")
+	}
+	if a := cfg.Anomalies; a.Window < 0 || a.NewMessageIDs < 0 || a.ClientQueries < 0 || a.Entropy < 0 || a.EntropyLabelLength < 0 {
+		return nil, fmt.Errorf("Anomaly thresholds and window must not be negative")
+	}
+	if cfg.ChunkThreshold > 0 && (cfg.HMACKey != nil || len(cfg.SigningKeys) > 0 || cfg.DecryptKey != nil || cfg.Store != nil) {
+		return nil, fmt.Errorf("Messages emitted as chunks can't be authenticated, signed, decrypted or persisted in a store")
+	}
+	if cfg.MaxStreams < 0 || cfg.StreamTimeout < 0 {
+		return nil, fmt.Errorf("Maximum streams and stream timeout must not be negative")
+	}
+	if cfg.NackDelay < 0 {
+		return nil, fmt.Errorf("Nack delay must not be negative")
+	}
+	if cfg.Backpressure == Spill && cfg.Spool == nil {
+		return nil, fmt.Errorf("Spilling messages requires a spool")
+	}
+	if cfg.MaxPartialMessages < 0 || cfg.MaxBufferedBytes < 0 || cfg.MaxFragmentBytes < 0 {
+		return nil, fmt.Errorf("Memory limits must not be negative")
+	}
+
+	// The tunnel is only tied to ctx once it is started, so that restoring it isn't interrupted.
+	runCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+	tun := &Tunnel{
+		ctx:                 runCtx,
+		stop:                stop,
+		messages:            make(chan Message, 256),
+		chunks:              make(chan MessageChunk, 256),
+		expired:             make(chan PartialMessage, 256),
+		sessionEvents:       make(chan SessionEvent, 256),
+		progressEvents:      make(chan ProgressEvent, 256),
+		errors:              make(chan TunnelError, 256),
+		strays:              make(chan StrayQuery, 256),
+		alerts:              make(chan Alert, 256),
+		topDomains:          topDomains,
+		encodings:           encodings,
+		codecs:              codecs,
+		authority:           cfg.Authority,
+		tenants:             tenants,
+		domains:             make(chan query, 256),
+		logger:              cfg.Logger,
+		clock:               cfg.Clock,
+		queryLog:            cfg.QueryLog,
+		anomalies:           newDetector(cfg.Anomalies),
+		shards:              newShards(),
+		defaultPolicy:       ExpirationPolicy{Expiration: cfg.Expiration, DeletionInterval: cfg.DeletionInterval},
+		domainPolicies:      domainPolicies,
+		maxExpiration:       cfg.MaxExpiration,
+		maxMessageSize:      cfg.MaxMessageSize,
+		chunkThreshold:      cfg.ChunkThreshold,
+		parseRules:          parseRules{maxMessageSize: cfg.MaxMessageSize, maxDataLabels: cfg.MaxDataLabels, strict: cfg.Strict},
+		parseErrors:         make(map[string]*uint64),
+		queryTypes:          newTypeCounters(),
+		queryCounts:         newQueryCounters(),
+		clients:             newClientTracker(),
+		sessions:            newSessionTracker(cfg.SessionTimeout, cfg.SessionHeartbeat),
+		progress:            cfg.Progress,
+		liveness:            newLivenessTracker(),
+		reassemblyTimes:     metrics.NewDistribution(reassemblyBuckets...),
+		messageFragments:    metrics.NewDistribution(fragmentBuckets...),
+		maxPartialMessages:  cfg.MaxPartialMessages,
+		maxBufferedBytes:    cfg.MaxBufferedBytes,
+		maxFragmentBytes:    cfg.MaxFragmentBytes,
+		outboxes:            make(map[string]*outbox),
+		streams:             make(map[string]*Stream),
+		accepted:            make(chan *Stream, cfg.MaxStreams),
+		maxStreams:          cfg.MaxStreams,
+		streamTimeout:       cfg.StreamTimeout,
+		hmacKey:             cfg.HMACKey,
+		signingKeys:         cfg.SigningKeys,
+		requireSignatures:   cfg.RequireSignatures,
+		authTokens:          tokens,
+		certTenants:         certTenants,
+		maxDecompressedSize: cfg.MaxDecompressedSize,
+		store:               cfg.Store,
+		workers:             cfg.Workers,
+		dedupWindow:         cfg.DedupWindow,
+		replayStore:         cfg.ReplayStore,
+		acks:                cfg.Acks,
+		nackDelay:           cfg.NackDelay,
+		backpressure:        cfg.Backpressure,
+		spool:               cfg.Spool,
+		unspool:             make(chan struct{}, 1),
+	}
+	tun.settings.Store(st)
+	if cfg.FanoutWindow > 0 {
+		tun.recent = newRecentQueries(cfg.FanoutWindow)
+	}
+	if cfg.OrderedDelivery {
+		tun.order = newReorderBuffer(cfg.ReorderTimeout, cfg.SessionTimeout)
+	}
+	for _, reason := range parseReasons {
+		tun.parseErrors[reason] = new(uint64)
+	}
+	if cfg.DecryptKey != nil {
+		aead, err := newAEAD(cfg.DecryptKey)
+		if err != nil {
+			return nil, err
+		}
+		tun.aead = aead
+	}
+	ring, err := newKeyring(cfg.DecryptKeys, nil)
+	if err != nil {
+		return nil, err
+	}
+	tun.keys.Store(&ring)
+	if tun.store != nil {
+		if err := tun.restore(); err != nil {
+			return nil, fmt.Errorf("Failed to restore partial messages: %w", err)
+		}
+		tun.evict()
+	}
+	if tun.replayStore != nil {
+		if err := tun.restoreDelivered(); err != nil {
+			return nil, fmt.Errorf("Failed to restore delivered messages: %w", err)
+		}
+	}
+	if tun.backpressure == Spill {
+		n, err := tun.spool.Len()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read spool: %w", err)
+		}
+		tun.spooled.Store(int64(n))
+		tun.wg.Add(1)
+		go tun.unspoolMessages()
+	}
+	tun.sweeps = newSweepSchedule(tun.policies())
+	tun.wg.Add(cfg.Workers + 1)
+	for i := 0; i < cfg.Workers; i++ {
+		go tun.listenDomains()
+	}
+	go tun.removeExpiredMessages()
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				tun.Close()
+			case <-tun.ctx.Done():
+			}
+		}()
+	}
+	return tun, nil
+}
+
+// Messages returns the channel on which assembled messages are delivered. The channel is closed
+// by Close.
+func (tun *Tunnel) Messages() <-chan Message {
+	return tun.messages
+}
+
+// Expired returns the channel on which partial messages are reported when they expire. The
+// channel is closed by Close.
+func (tun *Tunnel) Expired() <-chan PartialMessage {
+	return tun.expired
+}
+
+// Close stops the goroutines created by the tunnel and waits for them to exit, after which the
+// Messages, MessageChunks, Expired, Sessions, Progress, Errors, StrayQueries and Alerts channels
+// are closed. Partial messages still in memory are discarded. It is safe to call Close more than
+// once; calls after the first do nothing.
+func (tun *Tunnel) Close() error {
+	tun.closeOnce.Do(func() {
+		tun.stop()
+		tun.wg.Wait()
+		tun.closeStreams()
+		close(tun.messages)
+		close(tun.chunks)
+		close(tun.expired)
+		close(tun.sessionEvents)
+		close(tun.progressEvents)
+		close(tun.errors)
+		close(tun.strays)
+		close(tun.alerts)
+	})
+	return nil
+}
+
+// drainPollInterval is how often Shutdown checks whether every partial message is complete.
+const drainPollInterval = 50 * time.Millisecond
+
+// Shutdown closes the tunnel gracefully. Fragments that would start a new message are dropped
+// from then on, but partial messages keep being reassembled until every one of them is complete,
+// or ctx is done, after which the tunnel is closed as by Close. Messages assembled in the
+// meantime can still be read from Messages before and after it is closed. If ctx is done first,
+// Shutdown returns its error, and the remaining partial messages are discarded; if a Store is
+// configured, they remain in it. Otherwise, messages held back by OrderedDelivery are delivered
+// before the tunnel is closed, without waiting for the messages missing before them.
+func (tun *Tunnel) Shutdown(ctx context.Context) error {
+	tun.draining.Store(true)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	var err error
+	for err == nil && tun.Stats().InFlight > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	if err == nil && tun.order != nil {
+		tun.order.flush(tun.deliver)
+	}
+	tun.Close()
+	return err
+}
+
+// normalizeTopDomains returns the non-empty domains in fully qualified form, without duplicates
+// and ordered from longest to shortest, so that the first one a name is a subdomain of is the
+// most specific.
+func normalizeTopDomains(domains []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var fqdns []string
+	for _, d := range domains {
+		if d == "" {
+			continue
+		}
+		d = dns.Fqdn(strings.ToLower(d))
+		if !seen[d] {
+			seen[d] = true
+			fqdns = append(fqdns, d)
+		}
+	}
+	if len(fqdns) == 0 {
+		return nil, fmt.Errorf("Top domain is required")
+	}
+	sort.SliceStable(fqdns, func(i, j int) bool { return len(fqdns[i]) > len(fqdns[j]) })
+	return fqdns, nil
+}
+
+// TopDomains returns the fully qualified domains that the tunnel accepts queries for.
+func (tun *Tunnel) TopDomains() []string {
+	return append([]string(nil), tun.topDomains...)
+}
+
+// topDomainOf returns the most specific top domain that domain is a subdomain of, or false if
+// there is none.
+func (tun *Tunnel) topDomainOf(domain string) (string, bool) {
+	for _, top := range tun.topDomains {
+		if _, ok := underDomain(domain, top); ok {
+			return top, true
+		}
+	}
+	return "", false
+}
+
+// parseDomain parses the fragment carried by domain, which must be a subdomain of topDomain.
+// The domain is parsed in lower case, except for the data labels of case-sensitive encodings.
+// Errors are parseErrors describing why the fragment was rejected.
+func parseDomain(topDomain string, domain string, rules parseRules) (fragment, error) {
+	asked := domain
+	domain = strings.ToLower(domain)
+	if len(asked) != len(domain) {
+		asked = domain
+	}
+	payload, ok := underDomain(domain, topDomain)
+	if !ok {
+		return fragment{}, parseErrorf(reasonRoute, "Domain %s does not have top domain %s", domain, topDomain)
+	}
+	var labelsBuf [maxHeaderLabels]string
+	labels := splitLabels(labelsBuf[:0], payload)
+	fr, ok, err := parseVersionLabel(labels[0])
+	if err != nil {
+		return fragment{}, err
+	}
+	if ok {
+		labels = labels[1:]
+	}
+	if fr.flags&FlagSession != 0 {
+		if len(labels) == 0 || labels[0] == "" {
+			return fragment{}, parseErrorf(reasonLabels, "Domain is framed with a session but has no session label")
+		}
+		fr.session, labels = labels[0], labels[1:]
+	}
+	if fr.flags&FlagSequence != 0 {
+		if len(labels) == 0 {
+			return fragment{}, parseErrorf(reasonLabels, "Domain is framed with a sequence number but has no sequence label")
+		}
+		seq, err := rules.parseNumber(reasonLabels, "sequence number", labels[0])
+		if err != nil {
+			return fragment{}, err
+		}
+		if seq <= 0 {
+			return fragment{}, parseErrorf(reasonLabels, "Sequence number %d is not positive", seq)
+		}
+		fr.seq, labels = seq, labels[1:]
+	}
+	if fr.flags&FlagToken != 0 {
+		if len(labels) == 0 || labels[0] == "" {
+			return fragment{}, parseErrorf(reasonLabels, "Domain is framed with an auth token but has no token label")
+		}
+		fr.token, labels = labels[0], labels[1:]
+	}
+	fr.encoding = rules.encoding
+	if fr.flags&FlagEncoding != 0 {
+		if len(labels) == 0 || labels[0] == "" {
+			return fragment{}, parseErrorf(reasonLabels, "Domain is framed with an encoding but has no encoding label")
+		}
+		fr.encoding, labels = Encoding(labels[0]), labels[1:]
+	}
+	if fr.flags&FlagKey != 0 {
+		if len(labels) == 0 || labels[0] == "" {
+			return fragment{}, parseErrorf(reasonLabels, "Domain is framed with a key ID but has no key label")
+		}
+		fr.keyID, labels = labels[0], labels[1:]
+	}
+	if fr.flags&FlagExpiration != 0 {
+		if len(labels) == 0 {
+			return fragment{}, parseErrorf(reasonLabels, "Domain is framed with an expiration but has no expiration label")
+		}
+		seconds, err := rules.parseNumber(reasonLabels, "expiration", labels[0])
+		if err != nil {
+			return fragment{}, err
+		}
+		if seconds <= 0 {
+			return fragment{}, parseErrorf(reasonLabels, "Expiration %d is not positive", seconds)
+		}
+		fr.expiration, labels = seconds, labels[1:]
+	}
+	c, err := codecOf(fr.encoding)
+	if err != nil {
+		return fragment{}, parseErrorf(reasonVersion, "%w", err)
+	}
+	askedLabels := labels
+	if c.caseSensitive {
+		var askedBuf [maxHeaderLabels]string
+		askedLabels = splitLabels(askedBuf[:0], asked[:len(payload)])
+		askedLabels = askedLabels[len(askedLabels)-len(labels):]
+	}
+	rules.parity = fr.flags&FlagParity != 0
+	d, err := decodeFragment(labels, askedLabels, c, fr.encoding, rules)
+	if err != nil {
+		return fragment{}, err
+	}
+	// Parity fragments carry the length of their group along with its parity, so only data
+	// fragments are bound by the message.
+	if d.Offset < d.Total && d.Offset+len(d.Data) > d.Total {
+		return fragment{}, parseErrorf(reasonOffset, "Fragment at offset %d with %d bytes overflows message of length %d", d.Offset, len(d.Data), d.Total)
+	}
+
+	return fragment{
+		id:        d.ID,
+		framing:   fr,
+		totalSize: d.Total,
+		offset:    d.Offset,
+		data:      d.Data,
+	}, nil
+}
+
+// sortedFragments returns the fragments of the list ordered by offset.
+func (fl fragmentList) sortedFragments() []fragment {
+	fragments := make([]fragment, 0, len(fl.fragments))
+	for _, f := range fl.fragments {
+		fragments = append(fragments, f)
+	}
+	sort.Slice(fragments, func(i, j int) bool {
+		return fragments[i].offset < fragments[j].offset
+	})
+	return fragments
+}
+
+// put adds fg to the list, replacing any fragment at the same offset.
+func (fl *fragmentList) put(fg fragment) {
+	if fg.offset >= fl.totalSize {
+		fl.putParity(fg)
+		return
+	}
+	prev, replaced := fl.fragments[fg.offset]
+	if replaced {
+		fl.size -= len(prev.data)
+	}
+	fl.fragments[fg.offset] = fg
+	fl.size += len(fg.data)
+	if replaced && len(fg.data) < len(prev.data) {
+		fl.recomputeCoverage()
+	} else {
+		fl.cover(fg.offset, len(fg.data))
+	}
+}
+
+// cover records that the bytes [offset, offset+length) are received. Covered ranges are kept
+// sorted and merged, so that completeness doesn't depend on how fragments overlap.
+func (fl *fragmentList) cover(offset, length int) {
+	end := offset + length
+	// Find the ranges that overlap or touch [offset, end), and merge them into one.
+	i := sort.Search(len(fl.covered), func(i int) bool {
+		return fl.covered[i].Offset+fl.covered[i].Length >= offset
+	})
+	j := i
+	for j < len(fl.covered) && fl.covered[j].Offset <= end {
+		if r := fl.covered[j]; r.Offset < offset {
+			offset = r.Offset
+		}
+		if rEnd := fl.covered[j].Offset + fl.covered[j].Length; rEnd > end {
+			end = rEnd
+		}
+		j++
+	}
+	merged := Range{Offset: offset, Length: end - offset}
+	fl.covered = append(fl.covered[:i], append([]Range{merged}, fl.covered[j:]...)...)
+}
+
+// recomputeCoverage recomputes the covered ranges from the fragments, after a fragment was replaced
+// by a shorter one.
+func (fl *fragmentList) recomputeCoverage() {
+	fl.covered = nil
+	if fl.emitted > 0 {
+		fl.cover(0, fl.emitted)
+	}
+	for _, f := range fl.fragments {
+		fl.cover(f.offset, len(f.data))
+	}
+}
+
+// complete reports whether the fragments cover every byte in [0, totalSize) without gaps.
+func (fl fragmentList) complete() bool {
+	return len(fl.missing()) == 0
+}
+
+// missing returns the ranges of [0, totalSize) that are not covered by any fragment.
+func (fl fragmentList) missing() []Range {
+	var gaps []Range
+	end := 0
+	for _, r := range fl.covered {
+		if r.Offset >= fl.totalSize {
+			break
+		}
+		if r.Offset > end {
+			gaps = append(gaps, Range{Offset: end, Length: r.Offset - end})
+		}
+		end = r.Offset + r.Length
+	}
+	if end < fl.totalSize {
+		gaps = append(gaps, Range{Offset: end, Length: fl.totalSize - end})
+	}
+	return gaps
+}
+
+// checksumLabel returns the label carrying the CRC32 checksum of data.
+func checksumLabel(data string) string {
+	return fmt.Sprintf("%s%08x", checksumPrefix, crc32.ChecksumIEEE([]byte(data)))
+}
+
+// assemble joins the data of the fragments in a pooled buffer, verifying that overlapping
+// fragments agree, and decodes it.
+func (fl fragmentList) assemble() ([]byte, error) {
+	buf := dataBuffers.Get().(*[]byte)
+	defer dataBuffers.Put(buf)
+	encoded := slices.Grow((*buf)[:0], fl.totalSize)[:fl.totalSize]
+	*buf = encoded
+	// Fragments are visited in order of offset, so [f.offset, end) is already covered when f
+	// overlaps the fragments before it, and the first gap is the first offset beyond end that
+	// the next fragment doesn't start at.
+	end, gap := 0, -1
+	for _, f := range fl.sortedFragments() {
+		if f.offset < 0 || f.offset >= fl.totalSize {
+			return nil, fmt.Errorf("Offset %d is outside of total size %d", f.offset, fl.totalSize)
+		}
+		if f.offset+len(f.data) > fl.totalSize {
+			return nil, fmt.Errorf("Fragment at offset %d overflows total size %d", f.offset, fl.totalSize)
+		}
+		if f.offset > end && gap < 0 {
+			gap = end
+		}
+		for i := 0; i < len(f.data); i++ {
+			pos := f.offset + i
+			if pos < end && encoded[pos] != f.data[i] {
+				return nil, fmt.Errorf("Fragments overlap with inconsistent data at offset %d", pos)
+			}
+			encoded[pos] = f.data[i]
+		}
+		end = max(end, f.offset+len(f.data))
+	}
+	if gap < 0 && end < fl.totalSize {
+		gap = end
+	}
+	if gap >= 0 {
+		return nil, fmt.Errorf("Message is missing data at offset %d", gap)
+	}
+	c, err := codecOf(fl.framing.encoding)
+	if err != nil {
+		return nil, err
+	}
+	dec := make([]byte, c.enc.DecodedLen(len(encoded)))
+	n, err := c.enc.Decode(dec, encoded)
+	if err != nil {
+		return nil, err
+	}
+	return dec[:n], nil
+}
+
+func (tun *Tunnel) listenDomains() {
+	defer tun.wg.Done()
+	for {
+		select {
+		case <-tun.ctx.Done():
+			return
+		case q := <-tun.domains:
+			if q.flush != nil {
+				q.flush.wait(tun.ctx.Done())
+				continue
+			}
+			ack, ok := tun.handleQuery(q)
+			tun.evict()
+			if q.ack != nil {
+				if ok {
+					q.ack <- ack
+				}
+				close(q.ack)
+			}
+		}
+	}
+}
+
+// handleQuery parses the fragment carried by q, and delivers the message it belongs to if it is
+// complete. It returns the acknowledgement of the fragment, or false if it can't be parsed.
+func (tun *Tunnel) handleQuery(q query) (Ack, bool) {
+	ctx, span := tracer().Start(trace.ContextWithSpanContext(context.Background(), q.span), "browsertunnel.fragment")
+	defer span.End()
+	client := q.client
+	if client == "" {
+		client = clientIP(q.source)
+	}
+	var fg fragment
+	var tenantName string
+	var apiKey *apiKeyState
+	// Attaching attributes to a logger allocates, so the logger of the fragment is only built once
+	// something is logged, and debug logs are skipped unless they are enabled.
+	logger := func() *slog.Logger {
+		l := tun.logger.With("client", client, "qtype", dns.TypeToString[q.qtype])
+		if fg.id != "" {
+			l = l.With("id", fg.id)
+		}
+		if tenantName != "" {
+			l = l.With("tenant", tenantName)
+		}
+		if apiKey != nil {
+			l = l.With("key", apiKey.Name)
+		}
+		return l
+	}
+	debug := tun.logger.Enabled(ctx, slog.LevelDebug)
+	under, tenant, err := tun.route(q.name)
+	if err == nil {
+		rules := tun.parseRules
+		if top, ok := tun.topDomainOf(q.name); ok {
+			rules.encoding = tun.encodings[top]
+			rules.codec = tun.codecs[top]
+		}
+		fg, err = parseDomain(under, q.askedName(), rules)
+	}
+	if err != nil {
+		reason := parseErrorReason(err)
+		atomic.AddUint64(&tun.stats.ParseErrors, 1)
+		atomic.AddUint64(tun.parseErrors[reason], 1)
+		logger().Warn("Dropping fragment", "domain", q.name, "class", classParse, "reason", reason, "error", err)
+		tun.notifyError(TunnelError{Category: ErrParse, Reason: reason, Source: sourceIP(q.source), Domain: q.name, Err: err})
+		tun.notifyStray(StrayQuery{Name: q.askedName(), Type: q.qtype, Source: sourceIP(q.source), ClientSubnet: q.subnet, Reason: StrayMalformed, Err: err, Time: q.receivedAt})
+		fail(span, err)
+		return Ack{}, false
+	}
+	if tenant != nil {
+		tenantName = tenant.Name
+	}
+	apiKey, err = tun.authTokens.check(fg, tenantName)
+	if err != nil {
+		atomic.AddUint64(&tun.stats.Unauthorized, 1)
+		logger().Warn("Dropping fragment", "domain", q.name, "class", classAuth, "error", err)
+		tun.notifyError(TunnelError{Category: ErrAuth, ID: fg.id, Tenant: tenantName, Source: sourceIP(q.source), Domain: q.name, Err: err})
+		fail(span, err)
+		return Ack{}, false
+	}
+	// The token isn't stored, so that fragments restored from the store are framed alike.
+	fg.framing.token = ""
+	if span.IsRecording() {
+		span.SetAttributes(attrMessageID.String(fg.id), attrOffset.Int(fg.offset), attrSize.Int(len(fg.data)), attrTotalSize.Int(fg.totalSize))
+		if tenant != nil {
+			span.SetAttributes(attrTenant.String(tenantName))
+		}
+	}
+	if !q.repeat {
+		atomic.AddUint64(&tun.stats.Fragments, 1)
+		tun.clients.update(client, func(c *ClientStats) { c.Fragments++ })
+		if tenant != nil {
+			atomic.AddUint64(&tenant.stats.Fragments, 1)
+		}
+	}
+	key := listKey(tenantName, fg.id)
+	if debug {
+		logger().Debug("Received fragment", "offset", fg.offset, "size", len(fg.data), "total", fg.totalSize)
+	}
+
+	sh := tun.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	collided := false
+	if k := listFor(sh, key, fg.totalSize); k != key {
+		key, collided = k, true
+	}
+	// storeID is the ID of the message in the fragment store, which differs from its ID if it
+	// collided with another message.
+	storeID := strings.TrimPrefix(key, listKey(tenantName, ""))
+	if until, ok := sh.delivered[key]; ok && tun.clock.Now().Before(until) {
+		atomic.AddUint64(&tun.stats.Replayed, 1)
+		if debug {
+			logger().Debug("Ignoring fragment of delivered message", "offset", fg.offset)
+		}
+		return Ack{Received: fg.totalSize, Total: fg.totalSize}, true
+	}
+	if fgList, ok := sh.lists[key]; ok {
+		if fgList.framing != fg.framing {
+			err := parseErrorf(reasonVersion, "Fragment is framed as %s but its message as %s", fg.framing, fgList.framing)
+			atomic.AddUint64(&tun.stats.ParseErrors, 1)
+			atomic.AddUint64(tun.parseErrors[reasonVersion], 1)
+			logger().Warn("Dropping fragment", "domain", q.name, "class", classParse, "reason", reasonVersion, "error", err)
+			tun.notifyError(TunnelError{Category: ErrParse, Reason: reasonVersion, ID: fg.id, Tenant: tenantName, Source: sourceIP(q.source), Domain: q.name, Err: err})
+			return Ack{}, false
+		}
+		if prev, ok := fgList.fragments[fg.offset]; ok && prev == fg || fg.offset+len(fg.data) <= fgList.emitted {
+			atomic.AddUint64(&tun.stats.Duplicates, 1)
+			if debug {
+				logger().Debug("Ignoring duplicate fragment", "offset", fg.offset)
+			}
+			return fgList.ack(), true
+		}
+	}
+	_, exists := sh.lists[key]
+	if !exists && q.repeat {
+		// The original query was processed first, and completed its message, or hasn't been
+		// processed yet and will start it.
+		if debug {
+			logger().Debug("Ignoring repeated query", "offset", fg.offset)
+		}
+		return Ack{}, false
+	}
+	if !exists {
+		if tun.draining.Load() {
+			err := fmt.Errorf("Tunnel is shutting down")
+			logger().Warn("Dropping fragment", "class", classDrain, "error", err)
+			tun.notifyError(TunnelError{Category: ErrDrain, ID: fg.id, Tenant: tenantName, Source: sourceIP(q.source), Domain: q.name, Err: err})
+			return Ack{}, false
+		}
+		if tenant != nil && !tenant.reserve() {
+			atomic.AddUint64(&tenant.stats.OverQuota, 1)
+			err := fmt.Errorf("Tenant already has %d partial messages", tenant.MaxInFlight)
+			logger().Warn("Dropping fragment", "class", classQuota, "error", err)
+			tun.notifyError(TunnelError{Category: ErrQuota, ID: fg.id, Tenant: tenantName, Source: sourceIP(q.source), Domain: q.name, Err: err})
+			return Ack{}, false
+		}
+	}
+	if apiKey != nil {
+		if err := apiKey.admit(!exists, len(fg.data), tun.clock.Now()); err != nil {
+			if !exists && tenant != nil {
+				tenant.inFlight.Add(-1)
+			}
+			logger().Warn("Dropping fragment", "class", classQuota, "error", err)
+			tun.notifyError(TunnelError{Category: ErrQuota, ID: fg.id, Tenant: tenantName, Source: sourceIP(q.source), Domain: q.name, Err: err})
+			return Ack{}, false
+		}
+	}
+	if !exists {
+		if a, ok := tun.anomalies.newID(q.receivedAt); ok {
+			tun.notifyAlert(a)
+		}
+		if collided {
+			atomic.AddUint64(&tun.stats.Collisions, 1)
+			logger().Info("Message ID collides with a partial message of another length", "total", fg.totalSize)
+		}
+		tun.addList(sh, key, &fragmentList{
+			id:        fg.id,
+			tenant:    tenantName,
+			framing:   fg.framing,
+			totalSize: fg.totalSize,
+			fragments: make(map[int]fragment),
+			firstSeen: q.receivedAt,
+			policy:    tun.policyOf(tenantName, strings.TrimPrefix(under, listKey(tenantName, ""))),
+		})
+	}
+	fgList := sh.lists[key]
+	fgList.lastSeen = tun.clock.Now()
+	fgList.expiresAt = fgList.lastSeen.Add(tun.expirationOf(fgList.policy, fgList.framing))
+	tun.putFragment(sh, fgList, fg)
+	if tun.chunked(fgList) {
+		complete, err := tun.emitChunk(fgList, sourceIP(q.source))
+		if err != nil {
+			tun.deleteList(sh, key)
+			atomic.AddUint64(&tun.stats.Corrupt, 1)
+			logger().Warn("Dropping message", "class", classAssembly, "error", err)
+			tun.notifyError(TunnelError{Category: ErrAssembly, ID: fg.id, Tenant: tenantName, Source: sourceIP(q.source), Domain: q.name, Err: err})
+			fail(span, err)
+			return Ack{Received: fg.totalSize, Total: fg.totalSize}, true
+		}
+		tun.notifyProgress(fgList, q.receivedAt)
+		if !complete {
+			if fgList.size > tun.maxFragmentBytes {
+				tun.evictList(sh, key, evictMaxFragmentBytes)
+				return Ack{}, false
+			}
+			return fgList.ack(), true
+		}
+		tun.deleteList(sh, key)
+		tun.markDelivered(sh, key, tun.clock.Now())
+		atomic.AddUint64(&tun.stats.Assembled, 1)
+		if tenant != nil {
+			atomic.AddUint64(&tenant.stats.Assembled, 1)
+		}
+		fragments := len(fgList.fragments) + fgList.discarded
+		elapsed := q.receivedAt.Sub(fgList.firstSeen)
+		tun.reassemblyTimes.Observe(elapsed.Seconds())
+		tun.messageFragments.Observe(float64(fragments))
+		tun.clients.update(client, func(c *ClientStats) {
+			c.Messages++
+			c.MessageFragments += uint64(fragments)
+			c.Reassembly += elapsed
+		})
+		if debug {
+			logger().Debug("Emitted last chunk of message", "fragments", fragments)
+		}
+		return Ack{Received: fg.totalSize, Total: fg.totalSize}, true
+	}
+	if fgList.size > tun.maxFragmentBytes {
+		tun.evictList(sh, key, evictMaxFragmentBytes)
+		return Ack{}, false
+	}
+	tun.notifyProgress(fgList, q.receivedAt)
+
+	complete := fgList.complete()
+	if shared, ok := tun.store.(SharedFragmentStore); ok {
+		var claimed bool
+		if complete, claimed = tun.share(shared, sh, fgList, fg, storeID, tenantName, q.receivedAt); complete && !claimed {
+			// Another server completed the message, and delivers it.
+			tun.deleteList(sh, key)
+			tun.markDelivered(sh, key, tun.clock.Now())
+			return Ack{Received: fg.totalSize, Total: fg.totalSize}, true
+		}
+	} else if tun.store != nil {
+		var err error
+		if complete {
+			err = tun.store.Delete(tenantName, storeID)
+		} else {
+			err = tun.store.Put(fg.persisted(storeID, tenantName, q.receivedAt))
+		}
+		if err != nil {
+			logger().Warn("Failed to update fragment store", "error", err)
+		}
+	}
+	if !complete {
+		return fgList.ack(), true
+	}
+	tun.deleteList(sh, key)
+	_, reassembly := tracer().Start(ctx, "browsertunnel.reassemble", trace.WithTimestamp(fgList.firstSeen),
+		trace.WithAttributes(attrMessageID.String(fg.id), attrFragments.Int(len(fgList.fragments)), attrTotalSize.Int(fg.totalSize)))
+	defer reassembly.End()
+	ack := Ack{Received: fg.totalSize, Total: fg.totalSize}
+	assembled, err := fgList.assemble()
+	if err != nil {
+		atomic.AddUint64(&tun.stats.Corrupt, 1)
+		logger().Warn("Dropping message", "class", classAssembly, "error", err)
+		tun.notifyError(TunnelError{Category: ErrAssembly, ID: fg.id, Tenant: tenantName, Source: sourceIP(q.source), Domain: q.name, Err: err})
+		fail(reassembly, err)
+		return ack, true
+	}
+	payload, binary, signer, class, err := tun.unwrap(assembled, fgList.framing)
+	if err != nil {
+		logger().Warn("Dropping message", "class", class, "error", err)
+		tun.notifyError(TunnelError{Category: ErrorCategory(class), ID: fg.id, Tenant: tenantName, Source: sourceIP(q.source), Domain: q.name, Err: err})
+		fail(reassembly, err)
+		return ack, true
+	}
+	atomic.AddUint64(&tun.stats.Assembled, 1)
+	if tenant != nil {
+		atomic.AddUint64(&tenant.stats.Assembled, 1)
+	}
+	tun.markDelivered(sh, key, tun.clock.Now())
+	elapsed := q.receivedAt.Sub(fgList.firstSeen)
+	tun.reassemblyTimes.Observe(elapsed.Seconds())
+	tun.messageFragments.Observe(float64(len(fgList.fragments)))
+	tun.clients.update(client, func(c *ClientStats) {
+		c.Messages++
+		c.Bytes += uint64(len(payload))
+		c.MessageFragments += uint64(len(fgList.fragments))
+		c.Reassembly += elapsed
+	})
+	if debug {
+		logger().Debug("Assembled message", "fragments", len(fgList.fragments), "size", len(payload))
+	}
+	msg := Message{
+		ID:            fg.id,
+		Payload:       payload,
+		Binary:        binary,
+		Signer:        signer,
+		Source:        sourceIP(q.source),
+		ClientSubnet:  q.subnet,
+		QueryType:     q.qtype,
+		Domain:        strings.TrimPrefix(under, listKey(tenantName, "")),
+		Tenant:        tenantName,
+		Session:       fgList.framing.session,
+		Sequence:      fgList.framing.seq,
+		Fragments:     len(fgList.fragments),
+		FirstFragment: fgList.firstSeen,
+		LastFragment:  q.receivedAt,
+		SpanContext:   reassembly.SpanContext(),
+	}
+	if msg.Session != "" {
+		if e, ok := tun.sessions.observe(msg, tun.clock.Now()); ok {
+			tun.notifySession(e)
+		}
+	}
+	if tun.order != nil {
+		tun.order.push(msg, tun.clock.Now(), tun.deliver)
+	} else {
+		tun.deliver(msg)
+	}
+	return ack, true
+}
+
+// unwrap verifies, decrypts and decompresses an assembled message, as configured and as declared
+// by the flags of its framing, and reports whether it is binary and the identity of its signer,
+// if any. Messages framed as version 1 carry no flags, so gzip streams and binary markers are
+// recognized by their first bytes instead. If the message is dropped, the class of the error is
+// returned along with it.
+func (tun *Tunnel) unwrap(msg []byte, fr framing) ([]byte, bool, string, string, error) {
+	var err error
+	if tun.hmacKey != nil {
+		msg, err = verify(tun.hmacKey, msg)
+		if err != nil {
+			atomic.AddUint64(&tun.stats.Unauthenticated, 1)
+			return nil, false, "", classAuth, err
+		}
+	}
+	var signer string
+	if len(tun.signingKeys) > 0 {
+		msg, signer = verifySignature(tun.signingKeys, msg)
+		if signer == "" && tun.requireSignatures {
+			atomic.AddUint64(&tun.stats.Unsigned, 1)
+			return nil, false, "", classAuth, fmt.Errorf("Message isn't signed by any of the signing keys")
+		}
+	}
+	aead, key := tun.aead, namedKey{}
+	if fr.flags&FlagKey != 0 {
+		var ok bool
+		if key, ok = (*tun.keys.Load())[strings.ToLower(fr.keyID)]; !ok {
+			atomic.AddUint64(&tun.stats.Undecryptable, 1)
+			return nil, false, "", classDecrypt, fmt.Errorf("Message is encrypted with unknown key %s", fr.keyID)
+		}
+		aead = key.aead
+	}
+	encrypted := aead != nil
+	if fr.version >= Version2 && (fr.flags&FlagEncrypted != 0) != encrypted {
+		atomic.AddUint64(&tun.stats.Undecryptable, 1)
+		if encrypted {
+			return nil, false, "", classDecrypt, fmt.Errorf("Message is not encrypted")
+		}
+		return nil, false, "", classDecrypt, fmt.Errorf("Message is encrypted, but no decryption key is configured")
+	}
+	if encrypted {
+		msg, err = decrypt(aead, msg)
+		if err != nil {
+			atomic.AddUint64(&tun.stats.Undecryptable, 1)
+			return nil, false, "", classDecrypt, err
+		}
+		if key.messages != nil {
+			key.messages.Add(1)
+		}
+	}
+	compressed, binary := isCompressed(msg), false
+	if fr.version >= Version2 {
+		compressed = fr.flags&FlagCompressed != 0
+	}
+	if compressed {
+		msg, err = decompress(msg, tun.maxDecompressedSize)
+		if err != nil {
+			atomic.AddUint64(&tun.stats.Corrupt, 1)
+			return nil, false, "", classDecompress, err
+		}
+	}
+	if fr.version >= Version2 {
+		binary = fr.flags&FlagBinary != 0
+	} else if isBinary(msg) {
+		msg, binary = msg[len(binaryMarker):], true
+	}
+	return msg, binary, signer, "", nil
+}
+
+// clientIP returns the IP address of addr as a string, or an empty string if it has none.
+func clientIP(addr net.Addr) string {
+	ip := sourceIP(addr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// expirationOf returns how long a partial message framed as fr is held after its last fragment:
+// the Expiration of its policy p, unless its client asked otherwise with FlagExpiration.
+func (tun *Tunnel) expirationOf(p ExpirationPolicy, fr framing) time.Duration {
+	if fr.flags&FlagExpiration == 0 {
+		return p.Expiration
+	}
+	return min(time.Duration(fr.expiration)*time.Second, tun.maxExpiration)
+}
+
+// removeExpiredMessages runs the sweep every tick of tun.sweeps, checking the partial messages
+// whose deletion interval is due.
+func (tun *Tunnel) removeExpiredMessages() {
+	defer tun.wg.Done()
+	ticker := tun.clock.NewTicker(tun.sweeps.tick)
+	var n uint64
+	for {
+		select {
+		case <-tun.ctx.Done():
+			ticker.Stop()
+			return
+		case <-ticker.C():
+			n++
+			tun.sweep(tun.clock.Now(), tun.sweeps.due(n))
+		}
+	}
+}
+
+// Sweep expires the partial messages, dedup entries, idle clients, streams and sessions that are
+// due by the time of Config.Clock, as the background sweep run every DeletionInterval does, and
+// returns once they are. Together with a ManualClock, it lets tests expire messages without
+// racing the background sweep. Partial messages are checked whatever their deletion interval.
+func (tun *Tunnel) Sweep() {
+	tun.sweep(tun.clock.Now(), nil)
+}
+
+// sweep checks the partial messages whose deletion interval is in due, or all of them if due is
+// nil. Everything else is only checked every Config.DeletionInterval.
+func (tun *Tunnel) sweep(now time.Time, due map[time.Duration]bool) {
+	for _, sh := range tun.shards {
+		tun.removeExpired(sh, now, due)
+	}
+	if due != nil && !due[tun.defaultPolicy.DeletionInterval] {
+		return
+	}
+	for _, sh := range tun.shards {
+		tun.forgetExpired(sh, now)
+	}
+	if limiter := tun.settings.Load().limiter; limiter != nil {
+		limiter.prune(now)
+	}
+	if tun.recent != nil {
+		tun.recent.prune(now)
+	}
+	tun.clients.prune(now)
+	tun.liveness.prune(now)
+	tun.sweepStreams(now)
+	for _, e := range tun.sessions.sweep(now) {
+		tun.notifySession(e)
+	}
+	if tun.order != nil {
+		tun.order.sweep(now, tun.deliver)
+	}
+}
+
+// removeExpired deletes the expired fragment lists of sh whose deletion interval is in due, or all
+// of them if due is nil.
+func (tun *Tunnel) removeExpired(sh *shard, now time.Time, due map[time.Duration]bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for key, fgList := range sh.lists {
+		if fgList.expiresAt.Before(now) && (due == nil || due[fgList.policy.DeletionInterval]) {
+			tun.expireList(sh, key)
+		}
+	}
+}
+
+// forgetExpired deletes the expired dedup entries of sh.
+func (tun *Tunnel) forgetExpired(sh *shard, now time.Time) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for key, until := range sh.delivered {
+		if until.Before(now) {
+			tun.forgetDelivered(sh, key)
+		}
+	}
+}
+
+// expireList deletes the fragment list under key from sh, whose lock must be held, and reports
+// it as expired.
+func (tun *Tunnel) expireList(sh *shard, key string) {
+	fgList := sh.lists[key]
+	tun.deleteList(sh, key)
+	id := strings.TrimPrefix(key, listKey(fgList.tenant, ""))
+	if shared, ok := tun.store.(SharedFragmentStore); ok {
+		// Messages whose fragments are gone from a shared store were completed, or expired, by
+		// another server.
+		if fragments, err := shared.Fragments(fgList.tenant, id); err == nil && len(fragments) == 0 {
+			return
+		}
+	}
+	if tun.store != nil {
+		if err := tun.store.Delete(fgList.tenant, id); err != nil {
+			tun.logger.Warn("Failed to update fragment store", "id", fgList.id, "error", err)
+		}
+	}
+	atomic.AddUint64(&tun.stats.Expired, 1)
+	tun.notifyExpired(fgList)
+}
+
+// notifyExpired reports an expired fragment list without blocking.
+func (tun *Tunnel) notifyExpired(fgList *fragmentList) {
+	select {
+	case tun.expired <- fgList.partial(fgList.id):
+	default:
+	}
+}
+
+// A CapturedResponseWriter is the dns.ResponseWriter of a query that was received before it is
+// served, such as one read from a packet capture. ServeDNS records the query, and the fragment it
+// carries, as received at ReceivedAt rather than when it is served.
+type CapturedResponseWriter interface {
+	dns.ResponseWriter
+	ReceivedAt() time.Time
+}
+
+// ServeDNS handles DNS queries and records fragments carried by A, AAAA, TXT, MX and NULL queries,
+// as well as heartbeats. TXT queries are answered with an empty TXT record, or with a chunk of a
+// downstream message if the query is a poll, as are A and AAAA polls with an address. All other
+// queries are answered with a CNAME to blackhole-1.iana.org.
+func (tun *Tunnel) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) < 1 {
+		return
+	}
+
+	atomic.AddUint64(&tun.stats.Queries, 1)
+	client := clientIP(w.RemoteAddr())
+	_, span := tracer().Start(context.Background(), "browsertunnel.query", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttributes(attrQueryName.String(r.Question[0].Name), attrQueryType.String(dns.TypeToString[r.Question[0].Qtype]), attrClient.String(client))
+	}
+	now := tun.clock.Now()
+	if cw, ok := w.(CapturedResponseWriter); ok {
+		now = cw.ReceivedAt()
+	}
+	tun.clients.update(client, func(c *ClientStats) {
+		c.Queries++
+		c.LastSeen = now
+	})
+	if a, ok := tun.anomalies.query(client, sourceIP(w.RemoteAddr()), now); ok {
+		tun.notifyAlert(a)
+	}
+	// rec is completed at each way out, and logged once the query is answered.
+	var rec QueryRecord
+	var resp *dns.Msg
+	if tun.queryLog != nil {
+		rec = QueryRecord{Time: now, Source: sourceIP(w.RemoteAddr()), Name: r.Question[0].Name, Type: r.Question[0].Qtype, Disposition: DispositionFragment}
+		defer func() {
+			rec.Rcode = -1
+			if resp != nil {
+				rec.Rcode = resp.Rcode
+			}
+			tun.queryLog.LogQuery(rec)
+		}()
+	}
+	st := tun.settings.Load()
+	if !st.acl.permits(sourceIP(w.RemoteAddr())) {
+		atomic.AddUint64(&tun.stats.Denied, 1)
+		rec.Disposition = DispositionDenied
+		resp = tun.refuse(w, r)
+		return
+	}
+	opt := r.IsEdns0()
+	if opt != nil && opt.Version() != 0 {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		rec.Disposition, resp = DispositionBadVersion, m
+		tun.reply(w, r, m)
+		return
+	}
+
+	// Some resolvers randomize the case of query names (DNS 0x20). Data is encoded in lower case,
+	// except by case-sensitive encodings, so names are parsed in lower case, while answers repeat
+	// the name as it was asked.
+	domain := r.Question[0].Name
+	name := strings.ToLower(domain)
+	qtype := r.Question[0].Qtype
+	if !payloadTypes[qtype] {
+		tun.queryTypes.add(qtype)
+	}
+	stray := StrayQuery{Name: domain, Type: qtype, Source: sourceIP(w.RemoteAddr()), ClientSubnet: clientSubnet(opt), Time: now}
+	m := &dns.Msg{}
+	m.SetReply(r)
+	zone, inZone := tun.zoneOf(name)
+	if inZone {
+		if tun.authority.answer(m, zone, domain, name, qtype, st.Response.ttl(qtype)) {
+			stray.Reason = StrayZone
+			tun.notifyStray(stray)
+			// The records of the zone are the same in every mode, so negative answers about them
+			// don't take the random TTLs of ResponseStealth.
+			negativeTTL := st.Response.ttl(qtype)
+			if st.Response.Mode != ResponseStealth {
+				negativeTTL = st.Response.negativeTTL(qtype)
+			}
+			tun.authority.complete(m, zone, negativeTTL)
+			rec.Disposition, resp = DispositionZone, m
+			tun.reply(w, r, m)
+			return
+		}
+	}
+	// Queries of other types can't carry fragments or polls, so they are answered without
+	// looking at their names.
+	if !payloadTypes[qtype] {
+		stray.Reason = StrayType
+		tun.notifyStray(stray)
+		st.Response.answerOtherType(m, domain, qtype)
+		if inZone {
+			tun.authority.complete(m, zone, st.Response.negativeTTL(qtype))
+		}
+		rec.Disposition, resp = DispositionOtherType, m
+		tun.reply(w, r, m)
+		return
+	}
+	var txt []string
+	var addr net.IP
+	var ack chan Ack
+	var p poll
+	var sq streamQuery
+	var stq statusQuery
+	var isPoll, isAddressPoll, isStream, isStatus, isHeartbeat bool
+	var err error
+	under, tenant, routeErr := tun.route(name)
+	if tenant != nil {
+		rec.Tenant = tenant.Name
+	}
+	if identity, ok := tun.certPermits(w, tenant); !ok {
+		atomic.AddUint64(&tun.stats.CertDenied, 1)
+		err := fmt.Errorf("Client certificate %q is not allowed to send to tenant %s", identity, tenant.Name)
+		tun.logger.Warn("Refusing query", "client", client, "domain", domain, "class", classAuth, "error", err)
+		tun.notifyError(TunnelError{Category: ErrAuth, Tenant: tenant.Name, Source: sourceIP(w.RemoteAddr()), Domain: name, Err: err})
+		rec.Disposition = DispositionCertDenied
+		resp = tun.refuse(w, r)
+		return
+	}
+	if routeErr == nil {
+		p, isPoll, err = parsePoll(under, name)
+	}
+	if err != nil {
+		tun.logger.Warn("Ignoring poll", "client", client, "domain", domain, "class", classPoll, "error", err)
+		tun.notifyError(TunnelError{Category: ErrPoll, Source: sourceIP(w.RemoteAddr()), Domain: name, Err: err})
+	}
+	if routeErr == nil && !isPoll {
+		sq, isStream, err = parseStream(under, name)
+		if err != nil {
+			tun.logger.Warn("Ignoring stream query", "client", client, "domain", domain, "class", classStream, "error", err)
+			tun.notifyError(TunnelError{Category: ErrStream, Source: sourceIP(w.RemoteAddr()), Domain: name, Err: err})
+		}
+	}
+	if routeErr == nil && !isPoll && !isStream {
+		stq, isStatus, err = parseStatus(under, name)
+		if err != nil {
+			tun.logger.Warn("Ignoring status query", "client", client, "domain", domain, "class", classStatus, "error", err)
+			tun.notifyError(TunnelError{Category: ErrStatus, Source: sourceIP(w.RemoteAddr()), Domain: name, Err: err})
+		}
+	}
+	var clientID string
+	if routeErr == nil && !isPoll && !isStream && !isStatus {
+		clientID, isHeartbeat, err = parseHeartbeat(under, name)
+		if err != nil {
+			tun.logger.Warn("Ignoring heartbeat", "client", client, "domain", domain, "class", classHeartbeat, "error", err)
+			tun.notifyError(TunnelError{Category: ErrHeartbeat, Source: sourceIP(w.RemoteAddr()), Domain: name, Err: err})
+		}
+	}
+	if err != nil {
+		fail(span, err)
+		stray.Reason, stray.Err = StrayMalformed, err
+		tun.notifyStray(stray)
+	}
+	switch {
+	case isPoll:
+		rec.Disposition = DispositionPoll
+		if span.IsRecording() {
+			span.SetAttributes(attrKind.String("poll"))
+		}
+		if err == nil {
+			tun.heartbeat(p.clientID, tenant, w.RemoteAddr(), true, now)
+		}
+		if err == nil && qtype == dns.TypeTXT {
+			if chunk, ok := tun.nextChunk(p); ok {
+				txt = chunk.txt()
+			}
+		}
+		isAddressPoll = err == nil && (qtype == dns.TypeA || qtype == dns.TypeAAAA)
+		if isAddressPoll {
+			addr = tun.pollAddress(p, qtype)
+		}
+	case isStream:
+		rec.Disposition = DispositionStream
+		if span.IsRecording() {
+			span.SetAttributes(attrKind.String("stream"))
+		}
+		if err == nil && qtype == dns.TypeTXT {
+			txt = tun.serveStream(sq, under, tenant, w.RemoteAddr(), now)
+		}
+	case isStatus:
+		rec.Disposition = DispositionStatus
+		if span.IsRecording() {
+			span.SetAttributes(attrKind.String("status"))
+		}
+		if err == nil {
+			atomic.AddUint64(&tun.stats.StatusQueries, 1)
+		}
+		if err == nil && qtype == dns.TypeTXT {
+			ack = make(chan Ack, 1)
+			ack <- tun.status(stq, tenant, tun.clock.Now())
+		}
+	case isHeartbeat:
+		rec.Disposition = DispositionHeartbeat
+		if span.IsRecording() {
+			span.SetAttributes(attrKind.String("heartbeat"))
+		}
+		if err == nil {
+			atomic.AddUint64(&tun.stats.Heartbeats, 1)
+			tun.heartbeat(clientID, tenant, w.RemoteAddr(), false, now)
+		}
+	default:
+		// Repeats of an admitted query were charged to the rate limits already, while those of a
+		// refused one are charged again.
+		repeat := tun.recent != nil && tun.recent.seen(name, now)
+		if !repeat && st.limiter != nil && !st.limiter.allow(client, tun.clock.Now()) {
+			atomic.AddUint64(&tun.stats.RateLimited, 1)
+			rec.Disposition = DispositionRateLimited
+			resp = tun.refuse(w, r)
+			return
+		}
+		if !repeat && tenant != nil && !tenant.allow(tun.clock.Now()) {
+			rec.Disposition = DispositionOverQuota
+			resp = tun.refuse(w, r)
+			return
+		}
+		if repeat {
+			atomic.AddUint64(&tun.stats.FanoutDuplicates, 1)
+		} else if tun.recent != nil {
+			tun.recent.add(name, now)
+		}
+		if span.IsRecording() {
+			span.SetAttributes(attrKind.String("fragment"))
+		}
+		q := query{name: name, asked: domain, client: client, qtype: qtype, source: w.RemoteAddr(), subnet: clientSubnet(opt), receivedAt: now, span: span.SpanContext(), repeat: repeat}
+		if (tun.acks || requestsAck(name)) && (qtype == dns.TypeA || qtype == dns.TypeTXT) {
+			ack = make(chan Ack, 1)
+			q.ack = ack
+		}
+		select {
+		case tun.domains <- q:
+		case <-tun.ctx.Done():
+			return
+		}
+	}
+
+	if a, ok := tun.waitAck(ack); ok {
+		m.Answer = []dns.RR{a.rr(domain, qtype, st.Response.ttl(qtype))}
+	} else if isAddressPoll {
+		// Polls without an answer get none, rather than an address that would read as data.
+		if addr != nil {
+			m.Answer = []dns.RR{addressRR(domain, qtype, st.Response.ttl(qtype), addr)}
+		}
+	} else if qtype == dns.TypeTXT && (txt != nil || st.Response.Mode != ResponseStealth) {
+		if txt == nil {
+			txt = []string{""}
+		}
+		m.Answer = []dns.RR{
+			&dns.TXT{
+				Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: st.Response.ttl(qtype)},
+				Txt: txt,
+			},
+		}
+	} else {
+		st.Response.answer(m, domain, qtype)
+	}
+	if inZone {
+		tun.authority.complete(m, zone, st.Response.negativeTTL(qtype))
+	}
+	if err != nil {
+		rec.Disposition = DispositionMalformed
+	}
+	resp = m
+	tun.reply(w, r, m)
+}
+
+// reply writes the reply m to the request r, with the OPT record that r calls for, if any.
+// Replies over UDP that exceed the payload size of the requester are truncated, so that it
+// retries the query over TCP.
+func (tun *Tunnel) reply(w dns.ResponseWriter, r, m *dns.Msg) {
+	opt := r.IsEdns0()
+	setEDNS(m, opt)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(udpSize(opt))
+		if m.Truncated {
+			atomic.AddUint64(&tun.stats.Truncated, 1)
+		}
+	}
+	if err := w.WriteMsg(m); err != nil {
+		tun.logger.Warn("Failed to write response", "client", clientIP(w.RemoteAddr()), "class", classWrite, "error", err)
+		tun.notifyError(TunnelError{Category: ErrWrite, Source: sourceIP(w.RemoteAddr()), Err: err})
+		return
+	}
+	tun.countReply(r, m)
+}
+
+// waitAck waits for the acknowledgement sent on ack, if it isn't nil. It returns false if the
+// fragment couldn't be parsed, or wasn't processed within ackTimeout.
+func (tun *Tunnel) waitAck(ack chan Ack) (Ack, bool) {
+	if ack == nil {
+		return Ack{}, false
+	}
+	timer := time.NewTimer(ackTimeout)
+	defer timer.Stop()
+	select {
+	case a, ok := <-ack:
+		return a, ok
+	case <-timer.C:
+	case <-tun.ctx.Done():
+	}
+	return Ack{}, false
+}
+
+// refuse answers r with a REFUSED response, which it returns.
+func (tun *Tunnel) refuse(w dns.ResponseWriter, r *dns.Msg) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetRcode(r, dns.RcodeRefused)
+	tun.reply(w, r, m)
+	return m
+}
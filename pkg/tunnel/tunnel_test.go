@@ -0,0 +1,852 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// testResponseWriter is a dns.ResponseWriter that records the message written to it.
+type testResponseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
+
+// newTestTunnel creates a tunnel with a single worker unless cfg says otherwise, so that queries
+// are processed in the order they are sent.
+func newTestTunnel(t *testing.T, cfg Config) *Tunnel {
+	if cfg.Workers == 0 {
+		cfg.Workers = 1
+	}
+	tun, err := New(cfg)
+	require.Nil(t, err)
+	return tun
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{})
+	require.NotNil(t, err)
+
+	_, err = New(Config{TopDomain: "tunnel.example.com", MaxMessageSize: -1})
+	require.NotNil(t, err)
+
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com"})
+	defer tun.Close()
+	require.Equal(t, []string{"tunnel.example.com."}, tun.TopDomains())
+	require.Equal(t, DefaultExpiration, tun.defaultPolicy.Expiration)
+	require.Equal(t, DefaultMaxMessageSize, tun.maxMessageSize)
+}
+
+func TestParseDomain(t *testing.T) {
+	tests := []struct {
+		topDomain string
+		domain    string
+		fails     bool
+		output    fragment
+	}{
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.592.0.jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43.nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4.zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2ca.zlborzs4icjoqqhg2djorzsaylomq.tunnel.example.com.",
+			output: fragment{
+				id:        "2jkhm3",
+				totalSize: 592,
+				offset:    0,
+				data:      "jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2cazlborzs4icjoqqhg2djorzsaylomq",
+			},
+			fails: false,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.FAIL.0.jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43.nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4.zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2ca.zlborzs4icjoqqhg2djorzsaylomq.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.592.FAIL.jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43.nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4.zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2ca.zlborzs4icjoqqhg2djorzsaylomq.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.592.0.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.-5.0.aaaa.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.0.0.aaaa.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.999999999.0.aaaa.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.592.592.aaaa.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.592.-1.aaaa.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.8.4.aaaaaaaa.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.24.0.crc-48c3fd0d.nbswy3dpeb3w.64tmmq000000.tunnel.example.com.",
+			output: fragment{
+				id:        "2jkhm3",
+				totalSize: 24,
+				offset:    0,
+				data:      "nbswy3dpeb3w64tmmq000000",
+			},
+			fails: false,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.24.0.crc-48c3fd0e.nbswy3dpeb3w64tmmq000000.tunnel.example.com.",
+			fails:     true,
+		},
+		{
+			topDomain: "tunnel.example.com.",
+			domain:    "2jkhm3.24.0.crc-48c3fd0d.tunnel.example.com.",
+			fails:     true,
+		},
+	}
+	for _, test := range tests {
+		got, err := parseDomain(test.topDomain, test.domain, parseRules{maxMessageSize: 5000})
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+		}
+		require.Equal(t, test.output, got)
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		input  fragmentList
+		output string
+		fails  bool
+	}{
+		{
+			input: fragmentList{
+				totalSize: 592,
+				fragments: map[int]fragment{
+					0: fragment{
+						id:        "2jkhm3",
+						totalSize: 592,
+						offset:    0,
+						data:      "jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2cazlborzs4icjoqqhg2djorzsaylomq",
+					},
+					218: fragment{
+						id:        "2jkhm3",
+						totalSize: 592,
+						offset:    218,
+						data:      "qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljmqqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tfmfwca33omvzsyidon52caztjm52xeylunf3gkidpnzsxgoranvqwg2djnzsxgideojuxm2lom4qg65dimvzca3lbmn",
+					},
+					434: fragment{
+						id:        "2jkhm3",
+						totalSize: 592,
+						offset:    434,
+						data:      "ugs3tfomwca3lbmnugs3tfomqgezljnztsazdsnf3gk3ramj4sa33unbsxeidnmfrwq2lomvzsyidxnf2gqidbnrwca5dimuqg4zldmvzxgylspeqgg33vobwgs3thomqgc3teebrw63tomvrxi2lpnzzs4000",
+					},
+				},
+			},
+			output: "It is at work everywhere, functioning smoothly at times, at other times in fits and starts. It breathes, it heats, it eats. It shits and fucks. What a mistake to have ever said the id. Everywhere it is machines—real ones, not figurative ones: machines driving other machines, machines being driven by other machines, with all the necessary couplings and connections.",
+			fails:  false,
+		},
+		{
+			input: fragmentList{
+				totalSize: 10,
+				fragments: map[int]fragment{
+					30: fragment{
+						id:        "2jkhm3",
+						totalSize: 10,
+						offset:    30,
+						data:      "jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2cazlborzs4icjoqqhg2djorzsaylomq",
+					},
+				},
+			},
+			fails: true,
+		},
+		{
+			input: fragmentList{
+				totalSize: 10,
+				fragments: map[int]fragment{
+					-1: fragment{
+						id:        "2jkhm3",
+						totalSize: 10,
+						offset:    -1,
+						data:      "aaaaaaaaaa",
+					},
+				},
+			},
+			fails: true,
+		},
+		{
+			input: fragmentList{
+				totalSize: 10,
+				fragments: map[int]fragment{
+					5: fragment{
+						id:        "2jkhm3",
+						totalSize: 10,
+						offset:    5,
+						data:      "aaaaaaaaaa",
+					},
+				},
+			},
+			fails: true,
+		},
+		{
+			input: fragmentList{
+				totalSize: 10,
+				fragments: map[int]fragment{
+					10: fragment{
+						id:        "2jkhm3",
+						totalSize: 10,
+						offset:    0,
+						data:      "not base32",
+					},
+				},
+			},
+			fails: true,
+		},
+		{
+			input: fragmentList{
+				totalSize: 24,
+				fragments: map[int]fragment{
+					0: fragment{
+						id:        "2jkhm3",
+						totalSize: 24,
+						offset:    0,
+						data:      "nbswy3dpeb3w",
+					},
+					8: fragment{
+						id:        "2jkhm3",
+						totalSize: 24,
+						offset:    8,
+						data:      "eb3w64tm",
+					},
+					16: fragment{
+						id:        "2jkhm3",
+						totalSize: 24,
+						offset:    16,
+						data:      "mq000000",
+					},
+				},
+			},
+			output: "hello world",
+			fails:  false,
+		},
+		{
+			input: fragmentList{
+				totalSize: 24,
+				fragments: map[int]fragment{
+					0: fragment{
+						id:        "2jkhm3",
+						totalSize: 24,
+						offset:    0,
+						data:      "nbswy3dp",
+					},
+					4: fragment{
+						id:        "2jkhm3",
+						totalSize: 24,
+						offset:    4,
+						data:      "aaaaaaaa",
+					},
+				},
+			},
+			fails: true,
+		},
+		{
+			input: fragmentList{
+				totalSize: 24,
+				fragments: map[int]fragment{
+					0: fragment{
+						id:        "2jkhm3",
+						totalSize: 24,
+						offset:    0,
+						data:      "nbswy3dp",
+					},
+					16: fragment{
+						id:        "2jkhm3",
+						totalSize: 24,
+						offset:    16,
+						data:      "mq000000",
+					},
+				},
+			},
+			fails: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := test.input.assemble()
+		if test.fails {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+		}
+		require.Equal(t, test.output, string(got))
+	}
+}
+
+// newFragmentList returns a fragment list of the given fragments, as built by the tunnel.
+func newFragmentList(totalSize int, fragments ...fragment) *fragmentList {
+	fl := &fragmentList{totalSize: totalSize, fragments: make(map[int]fragment)}
+	for _, f := range fragments {
+		fl.put(f)
+	}
+	return fl
+}
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		input  *fragmentList
+		output bool
+	}{
+		{
+			input:  newFragmentList(8, fragment{offset: 0, data: "aaaa"}, fragment{offset: 4, data: "aaaa"}),
+			output: true,
+		},
+		{
+			input:  newFragmentList(8, fragment{offset: 0, data: "aaaaaa"}, fragment{offset: 2, data: "aaaaaa"}),
+			output: true,
+		},
+		{
+			input:  newFragmentList(8, fragment{offset: 0, data: "aaaaaa"}, fragment{offset: 6, data: "a"}),
+			output: false,
+		},
+		{
+			input:  newFragmentList(8, fragment{offset: 2, data: "aaaaaa"}),
+			output: false,
+		},
+		{
+			// Overlapping fragments whose lengths add up to the total size leave a gap.
+			input:  newFragmentList(8, fragment{offset: 0, data: "aaaa"}, fragment{offset: 2, data: "aa"}, fragment{offset: 6, data: "aa"}),
+			output: false,
+		},
+		{
+			input:  newFragmentList(8, fragment{offset: 4, data: "aaaa"}, fragment{offset: 0, data: "aa"}, fragment{offset: 1, data: "aaa"}),
+			output: true,
+		},
+		{
+			// A fragment replaced by a shorter one at the same offset no longer covers its tail.
+			input:  newFragmentList(8, fragment{offset: 0, data: "aaaaaaaa"}, fragment{offset: 0, data: "aaaa"}),
+			output: false,
+		},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.output, test.input.complete())
+	}
+}
+
+func TestMissing(t *testing.T) {
+	fl := newFragmentList(16,
+		fragment{offset: 10, data: "aa"},
+		fragment{offset: 2, data: "aaaa"},
+		fragment{offset: 4, data: "aaaa"},
+	)
+	require.Equal(t, []Range{{Offset: 2, Length: 6}, {Offset: 10, Length: 2}}, fl.covered)
+	require.Equal(t, []Range{{Offset: 0, Length: 2}, {Offset: 8, Length: 2}, {Offset: 12, Length: 4}}, fl.missing())
+
+	fl.cover(8, 2)
+	require.Equal(t, []Range{{Offset: 2, Length: 10}}, fl.covered)
+}
+
+func TestIDCollision(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	// A fragment of another length is taken for a colliding message rather than corrupting the
+	// partial message of its ID.
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.8.0.nbswy3dp.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com."}
+	msg := <-tun.Messages()
+	require.Equal(t, "2jkhm3", msg.ID)
+	require.Equal(t, []byte("hello"), msg.Payload)
+	msg = <-tun.Messages()
+	require.Equal(t, "2jkhm3", msg.ID)
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	stats := tun.Stats()
+	require.Equal(t, uint64(0), stats.ParseErrors)
+	require.Equal(t, uint64(1), stats.Collisions)
+}
+
+func TestListenDomains(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	tun.domains <- query{name: "i42ftq.592.218.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.qqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tf.mfwca33omvzsyidon52caztjm52xeylunf3gkidpnzsxgoranvqwg2djnzsxgid.eojuxm2lom4qg65dimvzca3lbmn.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.218.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.qqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tf.mfwca33omvzsyidon52caztjm52xeylunf3gkidpnzsxgoranvqwg2djnzsxgid.eojuxm2lom4qg65dimvzca3lbmn.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.434.ugs3tfomwca3lbmnugs3tfomqgezljnztsazdsnf3gk3ramj4sa33unbsxeidnm.frwq2lomvzsyidxnf2gqidbnrwca5dimuqg4zldmvzxgylspeqgg33vobwgs3th.omqgc3teebrw63tomvrxi2lpnzzs4000.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.FAIL.0.jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43.nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4.zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2ca.zlborzs4icjoqqhg2djorzsaylomq.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.434.ugs3tfomwca3lbmnugs3tfomqgezljnztsazdsnf3gk3ramj4sa33unbsxeidnm.frwq2lomvzsyidxnf2gqidbnrwca5dimuqg4zldmvzxgylspeqgg33vobwgs3th.omqgc3teebrw63tomvrxi2lpnzzs4000.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.218.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.qqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tf.mfwca33omvzsyidon52caztjm52xeylunf3gkidpnzsxgoranvqwg2djnzsxgid.eojuxm2lom4qg65dimvzca3lbmn.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.592.0.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.0.jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43.nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4.zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2ca.zlborzs4icjoqqhg2djorzsaylomq.tunnel.example.com."}
+
+	got := string((<-tun.Messages()).Payload)
+	expected := "It is at work everywhere, functioning smoothly at times, at other times in fits and starts. It breathes, it heats, it eats. It shits and fucks. What a mistake to have ever said the id. Everywhere it is machines—real ones, not figurative ones: machines driving other machines, machines being driven by other machines, with all the necessary couplings and connections."
+	require.Equal(t, expected, got)
+}
+
+func TestListenDomainsSurvivesBadOffsets(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	tun.domains <- query{name: "i42ftq.592.-1.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.500.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.qqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tf.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.0.jf2ca2ltebqxiidxn5zgwidfozsxe6lxnbsxezjmebthk3tdoruw63tjnztsa43.nn5xxi2dmpeqgc5baoruw2zltfqqgc5ban52gqzlseb2gs3lfomqgs3ramzuxi4.zamfxgiidtorqxe5dtfyqes5bamjzgkylunbsxglbanf2ca2dfmf2hglbanf2ca.zlborzs4icjoqqhg2djorzsaylomq.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.218.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.qqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tf.mfwca33omvzsyidon52caztjm52xeylunf3gkidpnzsxgoranvqwg2djnzsxgid.eojuxm2lom4qg65dimvzca3lbmn.tunnel.example.com."}
+	tun.domains <- query{name: "i42ftq.592.434.ugs3tfomwca3lbmnugs3tfomqgezljnztsazdsnf3gk3ramj4sa33unbsxeidnm.frwq2lomvzsyidxnf2gqidbnrwca5dimuqg4zldmvzxgylspeqgg33vobwgs3th.omqgc3teebrw63tomvrxi2lpnzzs4000.tunnel.example.com."}
+
+	got := string((<-tun.Messages()).Payload)
+	expected := "It is at work everywhere, functioning smoothly at times, at other times in fits and starts. It breathes, it heats, it eats. It shits and fucks. What a mistake to have ever said the id. Everywhere it is machines—real ones, not figurative ones: machines driving other machines, machines being driven by other machines, with all the necessary couplings and connections."
+	require.Equal(t, expected, got)
+}
+
+func TestServeDNS(t *testing.T) {
+	// The message is sent again in each query type, which would be taken for repeats.
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", FanoutWindow: -1})
+	defer tun.Close()
+
+	domain := "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeMX, dns.TypeNULL} {
+		before := time.Now()
+		req := &dns.Msg{}
+		req.SetQuestion(domain, qtype)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, req)
+
+		require.NotNil(t, w.msg)
+		require.Len(t, w.msg.Answer, 1)
+		if qtype == dns.TypeTXT {
+			require.IsType(t, &dns.TXT{}, w.msg.Answer[0])
+		} else {
+			require.IsType(t, &dns.CNAME{}, w.msg.Answer[0])
+		}
+		msg := <-tun.Messages()
+		require.Equal(t, "2jkhm3", msg.ID)
+		require.Equal(t, []byte("hello world"), msg.Payload)
+		require.Equal(t, "192.0.2.1", msg.Source.String())
+		require.Equal(t, qtype, msg.QueryType)
+		require.Equal(t, 1, msg.Fragments)
+		require.False(t, msg.FirstFragment.Before(before))
+		require.Equal(t, msg.FirstFragment, msg.LastFragment)
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(domain, dns.TypeCAA)
+	tun.ServeDNS(&testResponseWriter{}, req)
+	require.Len(t, tun.domains, 0)
+}
+
+func TestMixedCase(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "Tunnel.Example.com", Tenants: []Tenant{{Name: "Alpha"}}})
+	defer tun.Close()
+
+	// Resolvers using DNS 0x20 randomize the case of each fragment independently.
+	domains := []string{
+		"2JkHm3.24.0.NbSwY3dPeB3w.aLpHa.TuNnEl.ExAmPlE.cOm.",
+		"2jKhM3.24.12.64TmMq000000.AlPhA.tUnNeL.eXaMpLe.CoM.",
+	}
+	for _, domain := range domains {
+		req := &dns.Msg{}
+		req.SetQuestion(domain, dns.TypeA)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, req)
+		require.Len(t, w.msg.Answer, 1)
+		require.Equal(t, domain, w.msg.Answer[0].Header().Name)
+	}
+	msg := <-tun.Messages()
+	require.Equal(t, "2jkhm3", msg.ID)
+	require.Equal(t, "alpha", msg.Tenant)
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, 2, msg.Fragments)
+}
+
+// capturedResponseWriter is a testResponseWriter of a query captured at a time.
+type capturedResponseWriter struct {
+	testResponseWriter
+	at time.Time
+}
+
+func (w *capturedResponseWriter) ReceivedAt() time.Time { return w.at }
+
+func TestCapturedQueries(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	defer tun.Close()
+
+	first := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	domains := []string{
+		"2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com.",
+		"2jkhm3.24.12.64tmmq000000.tunnel.example.com.",
+	}
+	for i, domain := range domains {
+		req := &dns.Msg{}
+		req.SetQuestion(domain, dns.TypeA)
+		tun.ServeDNS(&capturedResponseWriter{at: first.Add(time.Duration(i) * time.Second)}, req)
+	}
+	msg := <-tun.Messages()
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, first, msg.FirstFragment)
+	require.Equal(t, first.Add(time.Second), msg.LastFragment)
+	require.Equal(t, first.Add(time.Second), tun.ClientStats()["192.0.2.1"].LastSeen)
+}
+
+func TestExpired(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain:        "tunnel.example.com.",
+		Expiration:       10 * time.Millisecond,
+		DeletionInterval: 5 * time.Millisecond,
+	})
+	defer tun.Close()
+
+	tun.domains <- query{name: "i42ftq.592.218.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.qqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tf.mfwca33omvzsyidon52caztjm52xeylunf3gkidpnzsxgoranvqwg2djnzsxgid.eojuxm2lom4qg65dimvzca3lbmn.tunnel.example.com."}
+
+	got := <-tun.Expired()
+	require.False(t, got.ExpiresAt.IsZero())
+	got.ExpiresAt = time.Time{}
+	expected := PartialMessage{
+		ID:        "i42ftq",
+		TotalSize: 592,
+		Received:  216,
+		Missing:   []Range{{Offset: 0, Length: 218}, {Offset: 434, Length: 158}},
+		Fragments: 1,
+	}
+	require.Equal(t, expected, got)
+}
+
+func TestExpirationHint(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain:        "tunnel.example.com.",
+		Expiration:       10 * time.Millisecond,
+		MaxExpiration:    time.Minute,
+		DeletionInterval: 5 * time.Millisecond,
+	})
+	defer tun.Close()
+
+	for id, expiration := range map[string]time.Duration{"long01": 30 * time.Second, "long02": time.Hour} {
+		domains, err := Encoder{LabelLen: 63, Version: Version2, Expiration: expiration}.Encode("tunnel.example.com.", id, strings.Repeat("x", 500))
+		require.Nil(t, err)
+		tun.domains <- query{name: domains[0]}
+	}
+	time.Sleep(50 * time.Millisecond)
+	partials := tun.Partials()
+	require.Len(t, partials, 2)
+	for _, p := range partials {
+		expected := 30 * time.Second
+		if p.ID == "long02" {
+			expected = time.Minute
+		}
+		require.WithinDuration(t, time.Now().Add(expected), p.ExpiresAt, time.Second, p.ID)
+	}
+}
+
+func TestClose(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	tun.domains <- query{name: "i42ftq.592.218.qgm5ldnnzs4icxnbqxiidbebwws43umfvwkidun4qgqylwmuqgk5tfoiqhgyljm.qqhi2dfebuwilraiv3gk4tzo5ugk4tfebuxiidjomqg2yldnbuw4zlt4kaji4tf.mfwca33omvzsyidon52caztjm52xeylunf3gkidpnzsxgoranvqwg2djnzsxgid.eojuxm2lom4qg65dimvzca3lbmn.tunnel.example.com."}
+
+	require.Nil(t, tun.Close())
+	require.Nil(t, tun.Close())
+
+	_, ok := <-tun.Messages()
+	require.False(t, ok)
+	_, ok = <-tun.Expired()
+	require.False(t, ok)
+
+	req := &dns.Msg{}
+	req.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA)
+	for i := 0; i < cap(tun.domains)+1; i++ {
+		tun.ServeDNS(&testResponseWriter{}, req)
+	}
+}
+
+func TestNewContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tun, err := NewContext(ctx, Config{TopDomain: "tunnel.example.com.", Workers: 1})
+	require.Nil(t, err)
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.Flush()
+
+	cancel()
+	_, ok := <-tun.Messages()
+	require.False(t, ok)
+	require.Nil(t, tun.Close())
+
+	// Tunnels created with a context that is already done are closed right away.
+	tun, err = NewContext(ctx, Config{TopDomain: "tunnel.example.com."})
+	require.Nil(t, err)
+	_, ok = <-tun.Messages()
+	require.False(t, ok)
+}
+
+func TestHMAC(t *testing.T) {
+	key := []byte("secret")
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", HMACKey: key})
+	defer tun.Close()
+
+	unsigned, err := EncodeMessage("tunnel.example.com.", "2jkhm3", "forged", 63)
+	require.Nil(t, err)
+	wrongKey, err := Encoder{LabelLen: 63, HMACKey: []byte("wrong")}.Encode("tunnel.example.com.", "i42ftq", "forged")
+	require.Nil(t, err)
+	signed, err := Encoder{LabelLen: 63, HMACKey: key}.Encode("tunnel.example.com.", "x7f2aa", "hello world")
+	require.Nil(t, err)
+
+	for _, domain := range append(append(unsigned, wrongKey...), signed...) {
+		tun.domains <- query{name: domain}
+	}
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+	require.Equal(t, uint64(2), tun.Stats().Unauthenticated)
+}
+
+func TestDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	hmacKey := []byte("secret")
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", DecryptKey: key, HMACKey: hmacKey})
+	defer tun.Close()
+
+	plaintext, err := Encoder{LabelLen: 63, HMACKey: hmacKey}.Encode("tunnel.example.com.", "2jkhm3", "not encrypted")
+	require.Nil(t, err)
+	encrypted, err := Encoder{LabelLen: 63, EncryptKey: key, HMACKey: hmacKey}.Encode("tunnel.example.com.", "x7f2aa", "hello world")
+	require.Nil(t, err)
+	for _, domain := range encrypted {
+		require.NotContains(t, domain, "nbswy3dp")
+	}
+
+	for _, domain := range append(plaintext, encrypted...) {
+		tun.domains <- query{name: domain}
+	}
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+	require.Equal(t, uint64(1), tun.Stats().Undecryptable)
+
+	_, err = New(Config{TopDomain: "tunnel.example.com.", DecryptKey: []byte("short")})
+	require.NotNil(t, err)
+}
+
+func TestDecompress(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", DecryptKey: key})
+	defer tun.Close()
+
+	msg := strings.Repeat(`{"key":"value"},`, 100)
+	enc := Encoder{LabelLen: 63, Compress: true, EncryptKey: key}
+	domains, err := enc.Encode("tunnel.example.com.", "2jkhm3", msg)
+	require.Nil(t, err)
+	uncompressed, err := Encoder{LabelLen: 63, EncryptKey: key}.Encode("tunnel.example.com.", "i42ftq", msg)
+	require.Nil(t, err)
+	require.True(t, len(domains) < len(uncompressed))
+
+	for _, domain := range domains {
+		tun.domains <- query{name: domain}
+	}
+	require.Equal(t, []byte(msg), (<-tun.Messages()).Payload)
+}
+
+func TestRateLimit(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", RateLimit: 0.001, RateBurst: 2})
+	defer tun.Close()
+
+	for i, id := range []string{"2jkhm3", "abcdef", "i42ftq"} {
+		req := &dns.Msg{}
+		req.SetQuestion(id+".24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA)
+		w := &testResponseWriter{}
+		tun.ServeDNS(w, req)
+		if i < 2 {
+			require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+		} else {
+			require.Equal(t, dns.RcodeRefused, w.msg.Rcode)
+		}
+	}
+	require.Equal(t, uint64(1), tun.Stats().RateLimited)
+}
+
+func TestCIDRs(t *testing.T) {
+	deny, err := ParseCIDRs([]string{"192.0.2.0/24"})
+	require.Nil(t, err)
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", DenyCIDRs: deny})
+	defer tun.Close()
+
+	req := &dns.Msg{}
+	req.SetQuestion("2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com.", dns.TypeA)
+	w := &testResponseWriter{}
+	tun.ServeDNS(w, req)
+	require.Equal(t, dns.RcodeRefused, w.msg.Rcode)
+	require.Len(t, tun.domains, 0)
+	require.Equal(t, uint64(1), tun.Stats().Denied)
+}
+
+func TestShutdown(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	require.Eventually(t, func() bool { return tun.Stats().InFlight == 1 }, time.Second, time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- tun.Shutdown(context.Background()) }()
+	require.Eventually(t, tun.draining.Load, time.Second, time.Millisecond)
+
+	// New messages are refused, but the partial message can still complete.
+	tun.domains <- query{name: "abcdef.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com."}
+	require.Nil(t, <-done)
+	msg, ok := <-tun.Messages()
+	require.True(t, ok)
+	require.Equal(t, "2jkhm3", msg.ID)
+	_, ok = <-tun.Messages()
+	require.False(t, ok)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com."})
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	require.Eventually(t, func() bool { return tun.Stats().InFlight == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, tun.Shutdown(ctx))
+	_, ok := <-tun.Messages()
+	require.False(t, ok)
+}
+
+func TestDedup(t *testing.T) {
+	tun := newTestTunnel(t, Config{TopDomain: "tunnel.example.com.", DedupWindow: time.Minute})
+	defer tun.Close()
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.tunnel.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com."}
+	require.Equal(t, []byte("hello world"), (<-tun.Messages()).Payload)
+
+	// A retry of the final fragment doesn't start a new partial message.
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.tunnel.example.com."}
+	tun.domains <- query{name: "abcdef.24.0.nbswy3dpeb3w64tmmq000000.tunnel.example.com."}
+	require.Equal(t, "abcdef", (<-tun.Messages()).ID)
+
+	stats := tun.Stats()
+	require.Equal(t, uint64(1), stats.Duplicates)
+	require.Equal(t, uint64(1), stats.Replayed)
+	require.Equal(t, uint64(2), stats.Assembled)
+	require.Equal(t, 0, stats.InFlight)
+}
+
+func TestTopDomains(t *testing.T) {
+	tun := newTestTunnel(t, Config{
+		TopDomain:  "example.com",
+		TopDomains: []string{"t1.example.com", "t2.example.org.", "example.com."},
+	})
+	defer tun.Close()
+	require.Equal(t, []string{"t1.example.com.", "t2.example.org.", "example.com."}, tun.TopDomains())
+
+	_, err := New(Config{TopDomains: []string{""}})
+	require.NotNil(t, err)
+
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.t2.example.org."}
+	msg := <-tun.Messages()
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, "t2.example.org.", msg.Domain)
+
+	// The most specific domain is matched, and fragments may arrive through different domains.
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w.example.com."}
+	tun.domains <- query{name: "2jkhm3.24.0.nbswy3dpeb3w64tmmq000000.example.net."}
+	tun.domains <- query{name: "2jkhm3.24.12.64tmmq000000.t1.example.com."}
+	msg = <-tun.Messages()
+	require.Equal(t, []byte("hello world"), msg.Payload)
+	require.Equal(t, "t1.example.com.", msg.Domain)
+	require.Equal(t, 2, msg.Fragments)
+	require.Equal(t, uint64(1), tun.Stats().ParseErrors)
+}
+
+// benchmarkQueries returns n queries, each carrying a complete message of its own.
+func benchmarkQueries(b *testing.B, n int) []*dns.Msg {
+	queries := make([]*dns.Msg, n)
+	for i := range queries {
+		domains, err := Encoder{LabelLen: 63, Version: Version2, Checksum: true}.Encode("tunnel.example.com.", fmt.Sprintf("m%d", i), "hello world")
+		require.Nil(b, err)
+		queries[i] = &dns.Msg{}
+		queries[i].SetQuestion(domains[0], dns.TypeA)
+	}
+	return queries
+}
+
+func BenchmarkServeDNS(b *testing.B) {
+	tun, err := New(Config{TopDomain: "tunnel.example.com.", Workers: 1, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	require.Nil(b, err)
+	defer tun.Close()
+	go func() {
+		for range tun.Messages() {
+		}
+	}()
+	queries := benchmarkQueries(b, b.N)
+	w := &testResponseWriter{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, r := range queries {
+		tun.ServeDNS(w, r)
+	}
+	for tun.Stats().Assembled < uint64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkHandleQuery(b *testing.B) {
+	tun, err := New(Config{TopDomain: "tunnel.example.com.", Workers: 1, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	require.Nil(b, err)
+	defer tun.Close()
+	go func() {
+		for range tun.Messages() {
+		}
+	}()
+	queries := benchmarkQueries(b, b.N)
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, r := range queries {
+		if _, ok := tun.handleQuery(query{name: r.Question[0].Name, qtype: dns.TypeA, source: source}); !ok {
+			b.Fatal("Fragment was dropped")
+		}
+	}
+}